@@ -0,0 +1,322 @@
+// Command loadtest drives register, login and profile traffic at a running
+// auth server and reports latency percentiles for each scenario.
+//
+//	go run ./cmd/loadtest -url http://localhost:8080 -duration 30s -concurrency 20
+//
+// Scenarios run one after another. login and profile first register -users
+// accounts to work with. -rate caps the total requests per second across
+// workers; without it every worker sends requests back to back.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+func main() {
+	baseURL := flag.String("url", "http://localhost:8080", "base URL of the server")
+	scenarios := flag.String("scenarios", "register,login,profile", "comma-separated scenarios to run: register, login, profile")
+	duration := flag.Duration("duration", 10*time.Second, "how long to run each scenario")
+	concurrency := flag.Int("concurrency", 10, "number of concurrent workers")
+	rate := flag.Int("rate", 0, "maximum requests per second across workers, 0 for no limit")
+	users := flag.Int("users", 50, "accounts registered for the login and profile scenarios")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout for each request")
+	flag.Parse()
+
+	if *concurrency < 1 || *users < 1 {
+		log.Fatal("-concurrency and -users must be at least 1")
+	}
+
+	runner := &runner{
+		baseURL:     strings.TrimSuffix(*baseURL, "/"),
+		prefix:      fmt.Sprintf("load%d", time.Now().UnixNano()),
+		concurrency: *concurrency,
+		rate:        *rate,
+		timeout:     *timeout,
+	}
+
+	var results []*result
+	for _, name := range strings.Split(*scenarios, ",") {
+		name = strings.TrimSpace(name)
+		var s scenario
+		switch name {
+		case "register":
+			s = runner.register()
+		case "login":
+			s = runner.login(*users)
+		case "profile":
+			s = runner.profile(*users)
+		default:
+			log.Fatalf("Unknown scenario %q", name)
+		}
+
+		fmt.Fprintf(os.Stderr, "Running %s for %v with %d workers\n", name, *duration, *concurrency)
+		results = append(results, runner.run(name, s, *duration))
+	}
+
+	report(os.Stdout, results)
+	for _, r := range results {
+		if r.failures() > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+// scenario is the traffic one worker sends
+type scenario struct {
+	// setup prepares a worker's client before it is timed, when set
+	setup func(worker int, client *http.Client) error
+	// request sends one request and returns its status
+	request func(client *http.Client) (int, error)
+}
+
+type runner struct {
+	baseURL     string
+	prefix      string // makes usernames unique to this run
+	concurrency int
+	rate        int
+	timeout     time.Duration
+
+	mutex      sync.Mutex
+	registered int
+}
+
+func (r *runner) newClient() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{Jar: jar, Timeout: r.timeout}
+}
+
+// post sends body as JSON and returns the response status
+func (r *runner) post(client *http.Client, path string, body interface{}) (int, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Post(r.baseURL+path, "application/json", bytes.NewReader(encoded))
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func (r *runner) get(client *http.Client, path string) (int, error) {
+	resp, err := client.Get(r.baseURL + path)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+type account struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// newAccount returns details for an account no earlier request used
+func (r *runner) newAccount() account {
+	r.mutex.Lock()
+	r.registered++
+	n := r.registered
+	r.mutex.Unlock()
+
+	username := fmt.Sprintf("%s_%d", r.prefix, n)
+	return account{Username: username, Email: username + "@example.com", Password: "loadtest-password"}
+}
+
+// seed registers n accounts for the login and profile scenarios
+func (r *runner) seed(n int) []account {
+	fmt.Fprintf(os.Stderr, "Registering %d accounts\n", n)
+	client := r.newClient()
+	accounts := make([]account, n)
+	for i := range accounts {
+		accounts[i] = r.newAccount()
+		status, err := r.post(client, "/api/register", accounts[i])
+		if err != nil || status != http.StatusCreated {
+			log.Fatalf("Failed to register %s: status %d, %v", accounts[i].Username, status, err)
+		}
+	}
+	return accounts
+}
+
+func (r *runner) register() scenario {
+	return scenario{request: func(client *http.Client) (int, error) {
+		return r.post(client, "/api/register", r.newAccount())
+	}}
+}
+
+func (r *runner) login(users int) scenario {
+	accounts := r.seed(users)
+	return scenario{request: func(client *http.Client) (int, error) {
+		a := accounts[rand.IntN(len(accounts))]
+		return r.post(client, "/api/login", map[string]string{"username": a.Username, "password": a.Password})
+	}}
+}
+
+// profile signs each worker in once, then fetches the profile repeatedly
+func (r *runner) profile(users int) scenario {
+	accounts := r.seed(users)
+	return scenario{
+		setup: func(worker int, client *http.Client) error {
+			a := accounts[worker%len(accounts)]
+			status, err := r.post(client, "/api/login", map[string]string{"username": a.Username, "password": a.Password})
+			if err == nil && status != http.StatusOK {
+				err = fmt.Errorf("login as %s failed with status %d", a.Username, status)
+			}
+			return err
+		},
+		request: func(client *http.Client) (int, error) {
+			return r.get(client, "/api/profile")
+		},
+	}
+}
+
+// run sends requests from every worker until duration has passed
+func (r *runner) run(name string, s scenario, duration time.Duration) *result {
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	// With a rate, workers take a token per request
+	var tokens <-chan time.Time
+	if r.rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(r.rate))
+		defer ticker.Stop()
+		tokens = ticker.C
+	}
+
+	res := &result{name: name, statuses: make(map[int]int)}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for worker := 0; worker < r.concurrency; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			client := r.newClient()
+			if s.setup != nil {
+				if err := s.setup(worker, client); err != nil {
+					log.Fatalf("Failed to set up worker %d: %v", worker, err)
+				}
+			}
+			for {
+				if tokens != nil {
+					select {
+					case <-tokens:
+					case <-ctx.Done():
+						return
+					}
+				}
+				if ctx.Err() != nil {
+					return
+				}
+
+				sent := time.Now()
+				status, err := s.request(client)
+				res.add(time.Since(sent), status, err)
+			}
+		}(worker)
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	return res
+}
+
+// result collects the outcome of every request in a scenario
+type result struct {
+	name    string
+	elapsed time.Duration
+
+	mutex     sync.Mutex
+	latencies []time.Duration
+	statuses  map[int]int
+	errors    int
+}
+
+func (r *result) add(latency time.Duration, status int, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.latencies = append(r.latencies, latency)
+	if err != nil {
+		r.errors++
+		return
+	}
+	r.statuses[status]++
+}
+
+// failures counts requests that errored or got a non-2xx status
+func (r *result) failures() int {
+	failed := r.errors
+	for status, count := range r.statuses {
+		if status < 200 || status > 299 {
+			failed += count
+		}
+	}
+	return failed
+}
+
+// percentile returns the latency p percent of requests were at or under
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	index := int(p/100*float64(len(sorted))+0.5) - 1
+	index = max(0, min(index, len(sorted)-1))
+	return sorted[index]
+}
+
+func report(out io.Writer, results []*result) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "scenario\trequests\tfailed\treq/s\tp50\tp95\tp99\tmax\tstatuses\t")
+	for _, r := range results {
+		sorted := append([]time.Duration{}, r.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		var slowest time.Duration
+		if len(sorted) > 0 {
+			slowest = sorted[len(sorted)-1]
+		}
+
+		codes := make([]int, 0, len(r.statuses))
+		for status := range r.statuses {
+			codes = append(codes, status)
+		}
+		sort.Ints(codes)
+		statuses := make([]string, 0, len(codes)+1)
+		for _, status := range codes {
+			statuses = append(statuses, fmt.Sprintf("%d:%d", status, r.statuses[status]))
+		}
+		if r.errors > 0 {
+			statuses = append(statuses, fmt.Sprintf("error:%d", r.errors))
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%v\t%v\t%v\t%v\t%s\t\n",
+			r.name,
+			len(sorted),
+			r.failures(),
+			float64(len(sorted))/r.elapsed.Seconds(),
+			percentile(sorted, 50).Round(time.Microsecond),
+			percentile(sorted, 95).Round(time.Microsecond),
+			percentile(sorted, 99).Round(time.Microsecond),
+			slowest.Round(time.Microsecond),
+			strings.Join(statuses, " "),
+		)
+	}
+	w.Flush()
+}
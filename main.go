@@ -1,243 +1,152 @@
 package main
 
 import (
-	"auth-server/pkg/base64util"
-	"encoding/json"
+	"auth-server/pkg/server"
+	"context"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
-	"sync"
-	"time"
-
-	"github.com/gorilla/mux"
+	"os/signal"
+	"syscall"
 )
 
-// User represents a user account
-type User struct {
-	ID       string    `json:"id"`
-	Username string    `json:"username"`
-	Email    string    `json:"email"`
-	Password string    `json:"-"` // Don't include password in JSON responses
-	Created  time.Time `json:"created"`
-}
-
-// LoginRequest represents a login request
-type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-}
-
-// RegisterRequest represents a registration request
-type RegisterRequest struct {
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
-}
-
-// ChangePasswordRequest represents a password change request
-type ChangePasswordRequest struct {
-	CurrentPassword string `json:"currentPassword"`
-	NewPassword     string `json:"newPassword"`
-}
-
-// Response represents a generic API response
-type Response struct {
-	Success bool        `json:"success"`
-	Message string      `json:"message"`
-	Data    interface{} `json:"data,omitempty"`
-}
-
-// Server represents the HTTP server
-type Server struct {
-	authHandler *AuthHandler
-	mutex       sync.RWMutex
-}
-
-// NewServer creates a new server instance
-func NewServer() *Server {
-	return &Server{
-		authHandler: NewAuthHandler([]byte("0mgn3wcryptok3y")),
-		mutex:       sync.RWMutex{},
-	}
-}
-
-// registerHandler delegates to AuthHandler
-func (s *Server) registerHandler(w http.ResponseWriter, r *http.Request) {
-	s.authHandler.RegisterHandler(w, r)
-}
-
-// loginHandler delegates to AuthHandler
-func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
-	s.authHandler.LoginHandler(w, r)
-}
-
-// logoutHandler delegates to AuthHandler
-func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
-	s.authHandler.LogoutHandler(w, r)
-}
-
-// profileHandler delegates to AuthHandler
-func (s *Server) profileHandler(w http.ResponseWriter, r *http.Request) {
-	s.authHandler.ProfileHandler(w, r)
-}
-
-// changePasswordHandler delegates to AuthHandler
-func (s *Server) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
-	s.authHandler.ChangePasswordHandler(w, r)
-}
-
-// base64EncodeHandler handles base64 encoding requests
-func (s *Server) base64EncodeHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(os.Stderr, "[DEBUG] Base64 encode request received\n")
-
-	if r.Method != http.MethodPost {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Invalid method: %s\n", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var req struct {
-		Text string `json:"text"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Failed to decode request body: %v\n", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-
-	if req.Text == "" {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Empty text provided\n")
-		http.Error(w, "Text is required", http.StatusBadRequest)
-		return
-	}
-
-	encoder := base64util.NewEncoder()
-	encoded, err := encoder.Encode(req.Text)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Encoding failed: %v\n", err)
-		http.Error(w, "Encoding failed", http.StatusInternalServerError)
-		return
-	}
-
-	response := Response{
-		Success: true,
-		Message: "Text encoded successfully",
-		Data: map[string]interface{}{
-			"original": req.Text,
-			"encoded":  encoded,
-		},
-	}
-
-	fmt.Fprintf(os.Stderr, "[DEBUG] Base64 encoding successful for text: %s\n", req.Text)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
-// base64DecodeHandler handles base64 decoding requests
-func (s *Server) base64DecodeHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(os.Stderr, "[DEBUG] Base64 decode request received\n")
-
-	if r.Method != http.MethodPost {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Invalid method: %s\n", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var req struct {
-		Text string `json:"text"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Failed to decode request body: %v\n", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-
-	if req.Text == "" {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Empty text provided\n")
-		http.Error(w, "Text is required", http.StatusBadRequest)
-		return
-	}
-
-	encoder := base64util.NewEncoder()
-	decoded, err := encoder.Decode(req.Text)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Decoding failed: %v\n", err)
-		http.Error(w, "Invalid base64 text", http.StatusBadRequest)
-		return
-	}
-
-	response := Response{
-		Success: true,
-		Message: "Text decoded successfully",
-		Data: map[string]interface{}{
-			"original": req.Text,
-			"decoded":  decoded,
-		},
-	}
-
-	fmt.Fprintf(os.Stderr, "[DEBUG] Base64 decoding successful for text: %s\n", req.Text)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
-// healthHandler provides a health check endpoint
-func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
-	response := Response{
-		Success: true,
-		Message: "Server is healthy",
-		Data: map[string]interface{}{
-			"timestamp": time.Now().Format(time.RFC3339),
-			"status":    "running",
-		},
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
 func main() {
 	fmt.Fprintf(os.Stderr, "[DEBUG] Starting authentication server...\n")
 
-	server := NewServer()
+	cfg := server.LoadConfig()
+	srv, err := server.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
 	fmt.Fprintf(os.Stderr, "[DEBUG] Server instance created\n")
 
-	// Create router
-	router := mux.NewRouter()
-	fmt.Fprintf(os.Stderr, "[DEBUG] Router created\n")
-
-	// API routes
-	router.HandleFunc("/api/register", server.registerHandler).Methods("POST")
-	router.HandleFunc("/api/login", server.loginHandler).Methods("POST")
-	router.HandleFunc("/api/logout", server.logoutHandler).Methods("POST")
-	router.HandleFunc("/api/profile", server.profileHandler).Methods("GET")
-	router.HandleFunc("/api/change-password", server.changePasswordHandler).Methods("POST")
-	router.HandleFunc("/api/base64/encode", server.base64EncodeHandler).Methods("POST")
-	router.HandleFunc("/api/base64/decode", server.base64DecodeHandler).Methods("POST")
-	router.HandleFunc("/api/health", server.healthHandler).Methods("GET")
-	fmt.Fprintf(os.Stderr, "[DEBUG] All API routes registered\n")
-
-	// Serve static files (optional - for a simple frontend)
-	router.PathPrefix("/").Handler(http.FileServer(http.Dir("static")))
-	fmt.Fprintf(os.Stderr, "[DEBUG] Static file handler registered\n")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Start server
-	port := ":8080"
-	fmt.Fprintf(os.Stderr, "[DEBUG] Server starting on port %s\n", port)
-	fmt.Printf("Server starting on port %s\n", port)
+	fmt.Printf("Server starting on %s\n", cfg.Addr)
 	fmt.Printf("Available endpoints:\n")
 	fmt.Printf("  POST /api/register        - Create a new account\n")
 	fmt.Printf("  POST /api/login           - Login to existing account\n")
+	fmt.Printf("  POST /api/login/magic-link - Email a single-use passwordless sign-in link\n")
+	fmt.Printf("  GET  /api/login/magic-link/verify?token=... - Sign in with an emailed link\n")
+	if cfg.KerberosKeytab != "" {
+		fmt.Printf("  GET  /api/login/kerberos  - Sign in with a Kerberos ticket (SPNEGO)\n")
+	}
+	fmt.Printf("  POST /api/login/sso       - Find the identity provider of an email's organization and start signing in there\n")
 	fmt.Printf("  POST /api/logout          - Logout from account\n")
 	fmt.Printf("  GET  /api/profile         - Get current user profile\n")
+	fmt.Printf("  GET  /api/ws              - WebSocket telling the client when its session ends or its role changes\n")
+	fmt.Printf("  PATCH /api/profile        - Update username, locale or public profile fields (send If-Match with the profile ETag)\n")
+	fmt.Printf("  GET  /api/preferences     - Get notification preferences (PUT updates them)\n")
+	fmt.Printf("  GET  /api/account/export  - Download all data held about your account\n")
+	fmt.Printf("  DELETE /api/account       - Delete your account (restorable by admins until purged)\n")
+	fmt.Printf("  GET  /api/identities      - List your sign-in methods and linked identities (DELETE /{id} unlinks one)\n")
+	fmt.Printf("  POST /api/account/merge   - Merge another account you can sign in to into yours (/undo reverses it)\n")
+	fmt.Printf("  GET  /api/2fa             - Two-factor authentication status\n")
+	fmt.Printf("  POST /api/2fa/setup       - Start two-factor enrollment (returns TOTP secret)\n")
+	fmt.Printf("  POST /api/2fa/enable      - Confirm a TOTP code and receive recovery codes\n")
+	fmt.Printf("  POST /api/2fa/disable     - Turn off two-factor authentication\n")
+	fmt.Printf("  POST /api/2fa/recovery-codes - Regenerate recovery codes (?download=1 for a file)\n")
+	fmt.Printf("  POST /api/2fa/sms/enable  - Turn on texted login codes\n")
+	fmt.Printf("  POST /api/2fa/sms/disable - Turn off texted login codes\n")
+	fmt.Printf("  POST /api/2fa/sms/send    - Text a code to the verified phone\n")
+	fmt.Printf("  GET  /api/legal           - Current terms of service and privacy policy versions\n")
+	fmt.Printf("  POST /api/reauth          - Confirm password (and optionally 2FA) for step-up policies\n")
+	fmt.Printf("  POST /api/phone           - Text a verification code to a new phone number\n")
+	fmt.Printf("  POST /api/phone/verify    - Confirm the code and save the phone number\n")
 	fmt.Printf("  POST /api/change-password - Change user password\n")
+	fmt.Printf("  POST /api/change-email    - Change account email address\n")
+	fmt.Printf("  POST /api/change-username - Change username (once per cooldown)\n")
+	fmt.Printf("  GET  /api/users/{username}/public - Public profile, as the user chose to show it\n")
+	if cfg.BlobStore != "" {
+		fmt.Printf("  PUT  /api/profile/avatar  - Upload a PNG, JPEG, GIF or WebP avatar (DELETE removes it)\n")
+		fmt.Printf("  GET  /api/avatars/{key}   - Redirect to a signed download of an uploaded avatar\n")
+	}
+	fmt.Printf("  POST /api/change-locale   - Set preferred language for messages and emails (en, es, de)\n")
+	fmt.Printf("  GET  /api/api-secret      - View your HMAC API secret (POST rotates it)\n")
+	fmt.Printf("  GET  /api/tokens          - List your personal access tokens (POST creates one)\n")
+	fmt.Printf("  DELETE /api/tokens/{id}   - Revoke a personal access token\n")
+	if cfg.RememberMe {
+		fmt.Printf("  GET  /api/remembered-devices - List browsers kept signed in (DELETE /{id} forgets one)\n")
+	}
+	fmt.Printf("  POST /api/password-reset/request - Email a password reset link\n")
+	fmt.Printf("  POST /api/password-reset/confirm - Set a new password with a reset token\n")
 	fmt.Printf("  POST /api/base64/encode   - Encode text to base64\n")
 	fmt.Printf("  POST /api/base64/decode   - Decode base64 to text\n")
+	fmt.Printf("  POST /api/base64/encode-file - Encode an uploaded file (multipart) to base64\n")
+	fmt.Printf("  POST /api/base64/encode/stream - Stream raw body to base64\n")
+	fmt.Printf("  POST /api/base64/decode/stream - Stream base64 body to raw bytes\n")
+	fmt.Printf("  POST /api/transform       - Encode/decode with base64, base32, hex or url codecs\n")
+	fmt.Printf("  POST /api/hash            - Hash text or a raw body (sha256, sha512, blake2b)\n")
+	fmt.Printf("  POST /api/hmac            - HMAC text or a raw body with your API secret\n")
+	fmt.Printf("  POST /api/encrypt         - Encrypt text with your AES-GCM data key\n")
+	fmt.Printf("  POST /api/decrypt         - Decrypt text encrypted with your data key\n")
+	fmt.Printf("  GET  /api/random          - Secure random hex, base64 or UUID values\n")
+	fmt.Printf("  GET  /api/usage           - Your quota usage and metered requests per key and endpoint (?from=, ?to=, ?granularity=)\n")
+	fmt.Printf("  GET  /api/billing         - Your account tier and its limits (POST /api/billing/customer links you to a Stripe customer)\n")
+	fmt.Printf("  POST /api/billing/stripe/webhook - Receive Stripe subscription events\n")
+	fmt.Printf("  GET  /api/flags           - Feature flags that are on for you\n")
 	fmt.Printf("  GET  /api/health          - Health check\n")
-	fmt.Printf("\nServer running at http://localhost%s\n", port)
+	fmt.Printf("  GET  /api/admin/acl       - List network access rules (POST adds, DELETE /{id} removes)\n")
+	fmt.Printf("  GET  /api/admin/geo-policy - View country login restrictions (PUT updates)\n")
+	fmt.Printf("  GET  /api/admin/email-policy - View blocked and allowed email domains (PUT updates)\n")
+	fmt.Printf("  GET  /api/admin/username-policy - View reserved usernames and blocked patterns (PUT updates)\n")
+	fmt.Printf("  POST /api/admin/gc        - Purge expired sessions and stale state now\n")
+	fmt.Printf("  GET  /api/admin/blocked-ips - List blocked and suspicious login IPs (DELETE /{ip} unblocks)\n")
+	fmt.Printf("  GET  /api/admin/security  - Security overview for the admin dashboard\n")
+	fmt.Printf("  GET  /api/admin/reports/security-posture - Per-user security weaknesses, ?format=csv to download\n")
+	fmt.Printf("  GET  /api/admin/reports/usage - Requests and bytes per API key and endpoint (?from=, ?to=, ?key=, ?user=, ?endpoint=, ?granularity=, ?format=csv)\n")
+	fmt.Printf("  GET  /api/admin/maintenance - View maintenance mode (PUT turns it on or off)\n")
+	fmt.Printf("  GET  /api/admin/flags - List feature flags\n")
+	fmt.Printf("  PUT  /api/admin/flags/{name} - Change a feature flag\n")
+	fmt.Printf("  GET  /api/admin/events/stream - Live audit events over SSE (?type=, ?user= filters)\n")
+	fmt.Printf("  GET  /api/admin/outbox    - Undelivered emails and webhooks (?status=pending|dead)\n")
+	fmt.Printf("  POST /api/admin/outbox/{id}/redeliver - Retry an undelivered message now\n")
+	fmt.Printf("  GET  /api/admin/webhooks/deliveries - Recent webhook attempts (?status=failed|succeeded, ?hook=, ?limit=)\n")
+	fmt.Printf("  GET  /api/admin/webhooks/deliveries/{id} - A webhook attempt with its payload (POST /{id}/replay sends it again)\n")
+	fmt.Printf("  GET  /api/admin/webhooks/endpoints - Webhook endpoints and their backlog (PUT pauses or resumes one)\n")
+	fmt.Printf("  GET  /api/admin/clients   - List machine clients (POST registers, DELETE /{id} removes)\n")
+	fmt.Printf("  GET  /api/admin/service-accounts - List service accounts (POST creates; /{id} GET, PATCH, DELETE; /{id}/keys, /{id}/audit)\n")
+	fmt.Printf("  GET  /api/admin/sso/connections - List organizations' OIDC and SAML connections (POST creates; /{id} GET, PATCH, DELETE; PUT /{id}/metadata)\n")
+	fmt.Printf("  GET  /api/admin/users/search?q= - Search users by username, email or display name (offset, limit)\n")
+	fmt.Printf("  GET  /api/admin/signups/review - Sign-ups held over velocity limits (POST /{id}/approve or /{id}/reject)\n")
+	fmt.Printf("  DELETE /api/admin/users/{id} - Delete an account (POST /{id}/restore undoes it until purged)\n")
+	fmt.Printf("  POST /api/admin/users/{id}/suspend - Suspend or ban an account with a reason and optional expiry (/unsuspend lifts it)\n")
+	fmt.Printf("  GET  /api/admin/users/deleted - List deleted accounts awaiting purge\n")
+	fmt.Printf("  PUT  /api/admin/users/{id}/role - Assign a user a role such as support, which grants a subset of admin permissions\n")
+	if cfg.AdminBootstrapToken != "" {
+		fmt.Printf("  POST /api/admin/bootstrap - Become the first admin with ADMIN_BOOTSTRAP_TOKEN\n")
+	}
+	fmt.Printf("  GET  /api/admin/policy    - View the permission policy model and rules (PUT replaces the rules, POST /reload rereads POLICY_FILE)\n")
+	fmt.Printf("  POST /api/admin/policy/enforce - Check how the policy decides a subject, object and action\n")
+	fmt.Printf("  GET  /api/admin/access-rules - View rules refusing requests by user attributes (PUT replaces them, POST /reload rereads ACCESS_RULES_FILE)\n")
+	fmt.Printf("  GET  /api/admin/billing/accounts - List billing accounts (PUT /{account} links user:<id> or org:<domain> to a customer or sets its tier)\n")
+	fmt.Printf("  GET  /api/admin/email-templates - List email templates and overrides (/{locale}/{name} GET, PUT overrides, DELETE restores the default; POST /preview renders or sends a test)\n")
+	fmt.Printf("  GET  /api/admin/provisioning-rules - View rules setting up or refusing accounts of SSO users (PUT replaces them, POST /reload rereads PROVISIONING_RULES_FILE)\n")
+	fmt.Printf("  POST /api/admin/users/merge - Merge one account into another (POST /{id}/unmerge reverses it)\n")
+	fmt.Printf("  POST /oauth/token         - Issue a service token (client_credentials or device_code grant)\n")
+	fmt.Printf("  POST /api/oauth/device/code - Start a device authorization for a CLI or TV\n")
+	fmt.Printf("  GET  /api/oauth/device/verify - Show the device behind a user code (POST approves or denies it)\n")
+	fmt.Printf("  GET  /.well-known/jwks.json - Public keys for verifying issued tokens\n")
+	fmt.Printf("  GET  /api/admin/signing-keys - View signing keys (POST rotates now)\n")
+	fmt.Printf("  GET  /api/internal/users/{id} - Look up a user (service token with users:read)\n")
+	fmt.Printf("  GET  /metrics             - Prometheus metrics\n")
+	if cfg.HostedPages {
+		fmt.Printf("  GET  /login, /register, /reset-password, /device - Hosted account pages\n")
+	}
+	if cfg.GraphQLEnabled {
+		fmt.Printf("  POST /graphql             - GraphQL queries (viewer, profile) and mutations (login, register, changePassword)\n")
+	}
+	fmt.Printf("\nServer running at %s\n", cfg.PublicURL)
+	if cfg.TrustedHeaderAuth {
+		fmt.Printf("Signing in users named by the SSO proxy in %s\n", cfg.TrustedHeaderUser)
+	}
+	if cfg.MTLSAddr != "" {
+		fmt.Printf("Internal callers with client certificates: https://%s\n", cfg.MTLSAddr)
+	}
 
-	fmt.Fprintf(os.Stderr, "[DEBUG] Server ready to accept connections\n")
-	log.Fatal(http.ListenAndServe(port, router))
+	if err := srv.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "[DEBUG] Server stopped\n")
 }
@@ -0,0 +1,24 @@
+package account
+
+import (
+	"auth-server/pkg/mailer"
+	"auth-server/pkg/sms"
+	"context"
+)
+
+// Hasher hashes passwords and checks them against stored hashes. Compare
+// returns nil on a match. NeedsRehash reports whether a stored hash should
+// be replaced the next time the password is known, such as after a change
+// of algorithm or cost.
+type Hasher interface {
+	Hash(ctx context.Context, password string) (string, error)
+	Compare(ctx context.Context, stored, password string) error
+	NeedsRehash(stored string) bool
+}
+
+// Mailer delivers the server's emails, such as verification and password
+// reset links
+type Mailer = mailer.Mailer
+
+// SMSSender delivers the server's text messages, such as login codes
+type SMSSender = sms.Sender
@@ -0,0 +1,152 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrUserNotFound is returned by UserStore lookups that match no user
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrVersionConflict is returned by UserStore.Update when the user was
+// changed by someone else after it was read
+var ErrVersionConflict = errors.New("user was modified concurrently")
+
+// UserStore persists user accounts. Every method takes the request context
+// so implementations backed by a database or remote service can stop work
+// once the client has gone or the request deadline has passed.
+//
+// Update is a compare-and-swap on User.Version: it fails with
+// ErrVersionConflict unless the stored version still matches, and on
+// success increments the version of both the stored and the passed user.
+//
+// Delete removes a user for good. Accounts users delete are only marked
+// deleted (see User.Deletion) and reach Delete once their retention period
+// has passed.
+type UserStore interface {
+	Create(ctx context.Context, user *User) error
+	Get(ctx context.Context, id string) (*User, error)
+	GetByUsername(ctx context.Context, username string) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	Update(ctx context.Context, user *User) error
+	List(ctx context.Context) ([]*User, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// memoryStore keeps users in a map and is the server's default UserStore. It
+// stores and hands out copies so callers cannot change a user without
+// going through Update.
+type memoryStore struct {
+	mutex sync.RWMutex
+	users map[string]*User
+}
+
+// NewMemoryStore creates an empty in-memory user store
+func NewMemoryStore() UserStore {
+	return &memoryStore{users: make(map[string]*User)}
+}
+
+func (s *memoryStore) Create(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user.Version = 1
+	stored := *user
+	s.users[user.ID] = &stored
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	user, ok := s.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (s *memoryStore) GetByUsername(ctx context.Context, username string) (*User, error) {
+	return s.find(ctx, func(u *User) bool { return u.Username == username })
+}
+
+func (s *memoryStore) GetByEmail(ctx context.Context, email string) (*User, error) {
+	return s.find(ctx, func(u *User) bool { return u.Email == email })
+}
+
+func (s *memoryStore) find(ctx context.Context, match func(*User) bool) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, user := range s.users {
+		if match(user) {
+			copied := *user
+			return &copied, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (s *memoryStore) Update(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stored, ok := s.users[user.ID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if stored.Version != user.Version {
+		return ErrVersionConflict
+	}
+	user.Version++
+	updated := *user
+	s.users[user.ID] = &updated
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.users[id]; !ok {
+		return ErrUserNotFound
+	}
+	delete(s.users, id)
+	return nil
+}
+
+// List returns every user ordered by ID, which is also creation order
+func (s *memoryStore) List(ctx context.Context) ([]*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	users := make([]*User, 0, len(s.users))
+	for _, user := range s.users {
+		copied := *user
+		users = append(users, &copied)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
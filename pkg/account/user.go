@@ -0,0 +1,420 @@
+// Package account defines user accounts and the interfaces through which
+// the auth server stores them and hashes their passwords, so applications
+// embedding the server can supply their own without importing it
+package account
+
+import (
+	"auth-server/pkg/geoip"
+	"strings"
+	"time"
+)
+
+// User represents a user account
+type User struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Email    string    `json:"email"`
+	Password string    `json:"-"` // Don't include password in JSON responses
+	Role     string    `json:"role"`
+	Created  time.Time `json:"created"`
+	// Organization is the tenant the account belongs to when it is not
+	// the domain of Email, as assigned when the account was provisioned
+	Organization string `json:"organization,omitempty"`
+	// Tier is the plan the user pays for themselves, set by their
+	// subscription or an admin; empty means their organization's tier or
+	// the default
+	Tier string `json:"tier,omitempty"`
+
+	UpdatedAt         time.Time  `json:"updatedAt"`
+	LastLoginAt       *time.Time `json:"lastLoginAt,omitempty"`
+	LastLoginIP       string     `json:"lastLoginIp,omitempty"`
+	LastLoginCountry  string     `json:"lastLoginCountry,omitempty"`
+	PasswordChangedAt time.Time  `json:"passwordChangedAt"`
+	// EmailVerifiedAt is when the user last proved they receive mail at
+	// Email, by following a sign-in or password reset link. Changing the
+	// address clears it.
+	EmailVerifiedAt *time.Time `json:"emailVerifiedAt,omitempty"`
+
+	// Version is bumped by the store on every update and is the user's
+	// ETag for optimistic concurrency control
+	Version int64 `json:"version"`
+
+	// Locale is the preferred language for messages and emails; the
+	// request's Accept-Language is used when empty
+	Locale string `json:"locale,omitempty"`
+
+	// DisplayName, AvatarURL and Bio are shown on the public profile as
+	// far as Preferences.Profile Allows
+	DisplayName string `json:"displayName,omitempty"`
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	// AvatarBlob is the blob store key of an uploaded avatar, which
+	// AvatarURL then points to
+	AvatarBlob string `json:"-"`
+
+	// Preferences choose which optional emails the user receives and what
+	// their public profile shows
+	Preferences NotificationPreferences `json:"-"`
+
+	// LastLoginLocation is kept for impossible travel detection
+	LastLoginLocation *geoip.Location `json:"-"`
+	// RecentLogins are the latest successful logins, oldest first, that
+	// login risk is scored against. Replace the slice rather than
+	// modifying it in place.
+	RecentLogins []LoginFingerprint `json:"-"`
+
+	// APISecret keys the user's HMAC operations; never serialized
+	APISecret []byte `json:"-"`
+	// AccessTokens are the user's personal access tokens. Replace the
+	// slice rather than modifying it in place.
+	AccessTokens []PersonalAccessToken `json:"-"`
+	// RememberedDevices are the browsers that stay signed in through a
+	// remember me cookie. Replace the slice rather than modifying it in
+	// place.
+	RememberedDevices []RememberedDevice `json:"-"`
+
+	// TwoFactorEnabled requires a TOTP or recovery code at login
+	TwoFactorEnabled bool `json:"twoFactorEnabled"`
+	// TOTPSecret is the authenticator app secret; PendingTOTPSecret holds
+	// the secret of an unconfirmed enrollment
+	TOTPSecret        string `json:"-"`
+	PendingTOTPSecret string `json:"-"`
+	// TOTPLastStep is the time step of the last accepted code, so a code
+	// cannot be used twice
+	TOTPLastStep int64 `json:"-"`
+	// RecoveryCodes are SHA-256 hashes of the unused recovery codes. The
+	// slice is shared between copies of the user, so replace it rather
+	// than modifying it in place.
+	RecoveryCodes []string `json:"-"`
+
+	// Phone is the verified phone number in E.164 form
+	Phone string `json:"phone,omitempty"`
+	// SMSTwoFactorEnabled texts a login code to Phone as a second factor
+	SMSTwoFactorEnabled bool `json:"smsTwoFactorEnabled"`
+
+	// EncryptedEmail and EncryptedPhone hold Email and Phone at rest when
+	// the server encrypts personal data
+	EncryptedEmail []byte `json:"-"`
+	EncryptedPhone []byte `json:"-"`
+
+	// Consents is the history of legal document acceptances, oldest
+	// first. Like RecoveryCodes, replace the slice rather than appending
+	// to it in place.
+	Consents []ConsentRecord `json:"-"`
+
+	// Identities are the external accounts linked for signing in. Replace
+	// the slice rather than modifying it in place.
+	Identities []Identity `json:"-"`
+
+	// UsernameHistory is the usernames the user gave up, oldest first.
+	// Replace the slice rather than modifying it in place.
+	UsernameHistory []UsernameChange `json:"-"`
+
+	// Suspension bars the account from signing in while it is active
+	Suspension *AccountSuspension `json:"-"`
+
+	// SignupReview is set while a new account waits for an admin to let
+	// it sign in
+	SignupReview *SignupReview `json:"-"`
+
+	// Dormancy tracks the dormancy policy's steps against an inactive
+	// account
+	Dormancy *AccountDormancy `json:"-"`
+
+	// Deletion is set once the account has been deleted, until it is
+	// purged
+	Deletion *AccountDeletion `json:"-"`
+
+	// Merge is set once the account has been merged into another, after
+	// which it cannot sign in
+	Merge *AccountMerge `json:"-"`
+}
+
+// HasTwoFactor reports whether any second factor is enabled
+func (u *User) HasTwoFactor() bool {
+	return u.TwoFactorEnabled || u.SMSTwoFactorEnabled
+}
+
+// PasswordExpired reports whether the password is older than maxAge.
+// A zero maxAge means passwords never expire.
+func (u *User) PasswordExpired(maxAge time.Duration, now time.Time) bool {
+	return maxAge > 0 && now.Sub(u.PasswordChangedAt) > maxAge
+}
+
+// Sanitized returns a copy of the user that is safe to return to clients
+func (u *User) Sanitized() User {
+	return User{
+		ID:                  u.ID,
+		Username:            u.Username,
+		Email:               u.Email,
+		Role:                u.Role,
+		Created:             u.Created,
+		Organization:        u.Organization,
+		Tier:                u.Tier,
+		UpdatedAt:           u.UpdatedAt,
+		LastLoginAt:         u.LastLoginAt,
+		LastLoginIP:         u.LastLoginIP,
+		LastLoginCountry:    u.LastLoginCountry,
+		PasswordChangedAt:   u.PasswordChangedAt,
+		EmailVerifiedAt:     u.EmailVerifiedAt,
+		Locale:              u.Locale,
+		DisplayName:         u.DisplayName,
+		AvatarURL:           u.AvatarURL,
+		Bio:                 u.Bio,
+		Version:             u.Version,
+		TwoFactorEnabled:    u.TwoFactorEnabled,
+		Phone:               u.Phone,
+		SMSTwoFactorEnabled: u.SMSTwoFactorEnabled,
+	}
+}
+
+// LastActive is when the user was last known to be active: their last
+// sign-in, a reactivation, or else registration
+func (u *User) LastActive() time.Time {
+	last := u.Created
+	if u.LastLoginAt != nil && u.LastLoginAt.After(last) {
+		last = *u.LastLoginAt
+	}
+	if u.Dormancy != nil && u.Dormancy.ReactivatedAt != nil && u.Dormancy.ReactivatedAt.After(last) {
+		last = *u.Dormancy.ReactivatedAt
+	}
+	return last
+}
+
+// SignInMethods counts the ways user can sign in on their own. Second
+// factors are not counted, since they cannot be used alone.
+func (u *User) SignInMethods() int {
+	methods := len(u.Identities)
+	if u.Password != "" {
+		methods++
+	}
+	return methods
+}
+
+// FindIdentity returns the index of the identity provider and subject
+// refer to, or -1
+func (u *User) FindIdentity(provider, subject string) int {
+	for i, identity := range u.Identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return i
+		}
+	}
+	return -1
+}
+
+// SecondFactorMethods lists the second factors a user can sign in with
+func (u *User) SecondFactorMethods() []string {
+	var methods []string
+	if u.TwoFactorEnabled {
+		methods = append(methods, "totp")
+	}
+	if u.SMSTwoFactorEnabled {
+		methods = append(methods, "sms")
+	}
+	return append(methods, "recovery")
+}
+
+// NotificationPreferences controls which optional emails a user receives.
+// Emails the account cannot work without, such as password reset links,
+// are always sent.
+type NotificationPreferences struct {
+	// NewLoginEmail sends an email on every successful sign-in
+	NewLoginEmail bool `json:"newLoginEmail"`
+	// SecurityAlerts sends emails about suspicious activity, such as
+	// impossible travel between sign-ins
+	SecurityAlerts bool `json:"securityAlerts"`
+	// ProductUpdates opts in to announcements about the service
+	ProductUpdates bool `json:"productUpdates"`
+
+	// Profile chooses what the public profile shows
+	Profile ProfileVisibility `json:"profile"`
+}
+
+// Notification kinds, each governed by one preference
+const (
+	NotifyNewLogin       = "new_login"
+	NotifySecurityAlert  = "security_alert"
+	NotifyProductUpdates = "product_updates"
+)
+
+// Allows reports whether the user wants notifications of kind
+func (p NotificationPreferences) Allows(kind string) bool {
+	switch kind {
+	case NotifyNewLogin:
+		return p.NewLoginEmail
+	case NotifySecurityAlert:
+		return p.SecurityAlerts
+	case NotifyProductUpdates:
+		return p.ProductUpdates
+	}
+	return false
+}
+
+// ProfileVisibility chooses what a user's public profile shows. Nothing is
+// public until Public is set, and then only the username and the fields
+// turned on here.
+type ProfileVisibility struct {
+	Public      bool `json:"public"`
+	DisplayName bool `json:"displayName"`
+	Avatar      bool `json:"avatar"`
+	Bio         bool `json:"bio"`
+}
+
+// LoginFingerprint describes one successful login for risk scoring
+type LoginFingerprint struct {
+	IP     string    `json:"ip"`
+	Device string    `json:"device"` // a fingerprint of the user agent
+	At     time.Time `json:"at"`
+}
+
+// PersonalAccessToken lets scripts and tools act for a user within its
+// scopes until it expires or is revoked. Only a hash of the token is kept.
+type PersonalAccessToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	LastUsedIP string     `json:"lastUsedIp,omitempty"`
+	Hash       string     `json:"-"`
+}
+
+// Allows reports whether the token was granted scope
+func (t PersonalAccessToken) Allows(scope string) bool {
+	for _, granted := range t.Scopes {
+		if granted == scope {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(granted, "*"); ok && strings.HasPrefix(scope, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// RememberedDevice is a browser that stays signed in through a remember me
+// cookie, following Barry Jaspan's persistent login scheme. The cookie
+// carries the device's ID, which is the login series, and a token that is
+// replaced every time it signs the browser in; only the token's hash is
+// kept. A known series with a wrong token means an earlier token was
+// copied and used, so every device and session of the user is revoked.
+// The device is also bound to the user agent it was remembered on.
+type RememberedDevice struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	LastUsedIP string    `json:"lastUsedIp,omitempty"`
+
+	// AuthenticatedAt and MultiFactor are those of the password login
+	// the device was remembered at, which its sessions inherit, so a
+	// remembered device never counts as having just re-authenticated
+	AuthenticatedAt time.Time `json:"-"`
+	MultiFactor     bool      `json:"-"`
+	Fingerprint     string    `json:"-"`
+	TokenHash       string    `json:"-"`
+	// PreviousTokenHash is the token TokenHash replaced at RotatedAt. It
+	// is accepted for a moment after, from requests the browser sent
+	// before it received the new token.
+	PreviousTokenHash string    `json:"-"`
+	RotatedAt         time.Time `json:"-"`
+}
+
+// ConsentRecord is a user's acceptance of one version of a legal document
+type ConsentRecord struct {
+	Document   string    `json:"document"`
+	Version    string    `json:"version"`
+	AcceptedAt time.Time `json:"acceptedAt"`
+	IP         string    `json:"ip"`
+}
+
+// Identity is an account at an external identity provider, such as an
+// OAuth provider, linked to a user so they can sign in with it. The
+// provider's email is not kept, since the account has its own.
+type Identity struct {
+	ID       string `json:"id"`
+	Provider string `json:"provider"`
+	// Subject is the provider's identifier for the account, which unlike
+	// the email never changes
+	Subject  string    `json:"subject"`
+	LinkedAt time.Time `json:"linkedAt"`
+}
+
+// UsernameChange records a username a user gave up. Former usernames stay
+// reserved for their last owner for server.Config.UsernameReservationPeriod,
+// and can be resolved to the account that now has a new name.
+type UsernameChange struct {
+	Username  string    `json:"username"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+// AccountSuspension bars an account from signing in, for good (a ban) or
+// until ExpiresAt
+type AccountSuspension struct {
+	At time.Time `json:"at"`
+	By string    `json:"by"` // the admin's user ID
+	// Reason is shown to the user
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// ActiveAt reports whether the suspension is in force at now. A nil
+// suspension never is.
+func (s *AccountSuspension) ActiveAt(now time.Time) bool {
+	return s != nil && (s.ExpiresAt == nil || now.Before(*s.ExpiresAt))
+}
+
+// SignupReview holds a new account back from signing in until an admin
+// approves it
+type SignupReview struct {
+	At     time.Time `json:"at"`
+	IP     string    `json:"ip"`
+	Device string    `json:"device"`
+	// Limits are the velocity limits the registration went over
+	Limits []string `json:"limits"`
+	// Risk is why a risk provider challenged the registration
+	Risk string `json:"risk,omitempty"`
+}
+
+// AccountDormancy records how far an inactive account has gone through the
+// dormancy policy. Signing in clears it.
+type AccountDormancy struct {
+	// FlaggedAt is when the account was found inactive for
+	// server.Config.DormantAccountAge
+	FlaggedAt *time.Time `json:"flaggedAt,omitempty"`
+	// NotifiedAt is when the owner was emailed about it
+	NotifiedAt *time.Time `json:"notifiedAt,omitempty"`
+	// DeactivatedAt is when the account was suspended for inactivity
+	DeactivatedAt *time.Time `json:"deactivatedAt,omitempty"`
+	// ReactivatedAt is when an admin lifted the deactivation; inactivity
+	// is counted from then
+	ReactivatedAt *time.Time `json:"reactivatedAt,omitempty"`
+}
+
+// AccountDeletion marks a deleted account. The account is kept as a
+// tombstone for server.Config.DeletedUserRetention, during which admins can
+// look into it and restore it, and is then purged. It keeps its username
+// and email meanwhile, so nobody else can take them before it is gone.
+type AccountDeletion struct {
+	At time.Time `json:"at"`
+	// By is the ID of the user who deleted the account: the account
+	// itself, or an admin
+	By     string `json:"by"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// AccountMerge records an account's merge into another, kept on the merged
+// account so the merge can be undone within server.Config.MergeGracePeriod
+type AccountMerge struct {
+	Into string    `json:"into"`
+	At   time.Time `json:"at"`
+	// Identities, the phone number and Locale are what moved to the
+	// surviving account; the phone and locale only move when it has none.
+	// The merged account keeps its phone, so only the fact it moved is
+	// recorded here.
+	Identities []Identity `json:"identities,omitempty"`
+	PhoneMoved bool       `json:"phoneMoved,omitempty"`
+	Locale     string     `json:"locale,omitempty"`
+}
@@ -0,0 +1,154 @@
+// Package v1 defines the JSON bodies of version 1 of the auth server's
+// HTTP API, the requests under /api and the Response envelope every
+// endpoint answers with, so clients can share them with the server
+package v1
+
+// LoginRequest represents a login request
+type LoginRequest struct {
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	CaptchaToken string `json:"captchaToken,omitempty"`
+	// TOTPCode, SMSCode or RecoveryCode is required for accounts with
+	// two-factor authentication enabled
+	TOTPCode     string `json:"totpCode,omitempty"`
+	SMSCode      string `json:"smsCode,omitempty"`
+	RecoveryCode string `json:"recoveryCode,omitempty"`
+	// SendSMSCode asks for a code to be texted when the account also has
+	// an authenticator app
+	SendSMSCode bool `json:"sendSmsCode,omitempty"`
+	// EmailCode answers the challenge of a login that looked risky
+	EmailCode string `json:"emailCode,omitempty"`
+	// AcceptTerms accepts updated legal documents the user has not yet
+	// accepted
+	AcceptTerms bool `json:"acceptTerms,omitempty"`
+	// Transport is how the session is handed over: "cookie", the default,
+	// or "bearer"
+	Transport string `json:"transport,omitempty"`
+	// RememberMe keeps the browser signed in beyond the session, when the
+	// server allows it and the session is a cookie
+	RememberMe bool `json:"rememberMe,omitempty"`
+}
+
+// RegisterRequest represents a registration request
+type RegisterRequest struct {
+	Username     string `json:"username"`
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	CaptchaToken string `json:"captchaToken,omitempty"`
+	// Locale optionally sets the preferred language, e.g. "de"
+	Locale string `json:"locale,omitempty"`
+	// AcceptTerms accepts the current legal documents, which is required
+	// when any are configured
+	AcceptTerms bool `json:"acceptTerms,omitempty"`
+	// DeviceID is an identifier the client app keeps for the device, which
+	// sharpens the detection of many sign-ups from one device
+	DeviceID string `json:"deviceId,omitempty"`
+}
+
+// ChangePasswordRequest represents a password change request
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// ChangeEmailRequest represents an email change request
+type ChangeEmailRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewEmail        string `json:"newEmail"`
+}
+
+// ChangeUsernameRequest represents a username change request
+type ChangeUsernameRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewUsername     string `json:"newUsername"`
+}
+
+// UpdateProfileRequest is a partial profile update; omitted fields are
+// left unchanged
+type UpdateProfileRequest struct {
+	Username    *string `json:"username,omitempty"`
+	Locale      *string `json:"locale,omitempty"`
+	DisplayName *string `json:"displayName,omitempty"`
+	AvatarURL   *string `json:"avatarUrl,omitempty"`
+	Bio         *string `json:"bio,omitempty"`
+}
+
+// TwoFactorSetupRequest starts two-factor enrollment
+type TwoFactorSetupRequest struct {
+	Password string `json:"password"`
+}
+
+// TwoFactorEnableRequest confirms enrollment with a code from the
+// authenticator app
+type TwoFactorEnableRequest struct {
+	Code string `json:"code"`
+}
+
+// TwoFactorDisableRequest turns a second factor off; one of Code, SMSCode
+// or RecoveryCode is required
+type TwoFactorDisableRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code,omitempty"`
+	SMSCode      string `json:"smsCode,omitempty"`
+	RecoveryCode string `json:"recoveryCode,omitempty"`
+}
+
+// ReauthRequest confirms the password, and optionally a second factor, for
+// the current session
+type ReauthRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code,omitempty"`
+	SMSCode      string `json:"smsCode,omitempty"`
+	RecoveryCode string `json:"recoveryCode,omitempty"`
+}
+
+// PhoneRequest starts verification of a new phone number
+type PhoneRequest struct {
+	Phone    string `json:"phone"`
+	Password string `json:"password"`
+}
+
+// PhoneVerifyRequest confirms a phone number with the texted code
+type PhoneVerifyRequest struct {
+	Code string `json:"code"`
+}
+
+// RecoveryCodesRequest regenerates the recovery codes
+type RecoveryCodesRequest struct {
+	Password string `json:"password"`
+}
+
+// ChangeLocaleRequest sets the preferred language for messages and emails
+type ChangeLocaleRequest struct {
+	Locale string `json:"locale"`
+}
+
+// MagicLinkRequest asks for a passwordless sign-in link to be emailed
+type MagicLinkRequest struct {
+	Email string `json:"email"`
+}
+
+// PasswordResetRequest asks for a password reset link to be emailed
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// PasswordResetConfirmRequest sets a new password using an emailed token
+type PasswordResetConfirmRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+// TransformRequest represents a codec transform request
+type TransformRequest struct {
+	Codec     string `json:"codec"`
+	Direction string `json:"direction"`
+	Input     string `json:"input"`
+}
+
+// Response represents a generic API response
+type Response struct {
+	Success bool        `json:"success"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
@@ -0,0 +1,243 @@
+// Package authmiddleware lets other Go services protect their routes with
+// sessions and tokens issued by the auth server.
+//
+// Session cookies are resolved by asking the auth server for the session's
+// profile. Bearer tokens are verified locally against the auth server's
+// published JSON Web Key Set.
+package authmiddleware
+
+import (
+	"auth-server/pkg/jwt"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCookieName is the auth server's session cookie name
+const DefaultCookieName = "user-session"
+
+// ErrUnauthenticated is returned when a request carries no valid credentials
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// User is the authenticated account attached to a request
+type User struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+}
+
+// Config configures an Authenticator
+type Config struct {
+	// BaseURL is the auth server's root URL, e.g. https://auth.internal
+	BaseURL string
+	// Issuer is the expected iss claim of bearer tokens
+	Issuer string
+	// CookieName overrides DefaultCookieName
+	CookieName string
+	// SessionCacheTTL is how long a resolved session is reused before the
+	// auth server is asked again; zero disables caching
+	SessionCacheTTL time.Duration
+	// HTTPClient is used for calls to the auth server; defaults to a client
+	// with a 10 second timeout
+	HTTPClient *http.Client
+}
+
+// Authenticator builds middleware backed by one auth server
+type Authenticator struct {
+	config Config
+	client *http.Client
+	keys   *remoteKeySet
+
+	mutex    sync.Mutex
+	sessions map[string]cachedSession
+}
+
+type cachedSession struct {
+	user    User
+	expires time.Time
+}
+
+// New creates an Authenticator for the auth server described by cfg
+func New(cfg Config) *Authenticator {
+	if cfg.CookieName == "" {
+		cfg.CookieName = DefaultCookieName
+	}
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &Authenticator{
+		config:   cfg,
+		client:   client,
+		keys:     newRemoteKeySet(client, cfg.BaseURL+"/.well-known/jwks.json"),
+		sessions: make(map[string]cachedSession),
+	}
+}
+
+type userKey struct{}
+type claimsKey struct{}
+
+// UserFromContext returns the user authenticated by RequireSession, or the
+// token subject for requests authenticated by RequireToken
+func UserFromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(userKey{}).(User)
+	return user, ok
+}
+
+// ClaimsFromContext returns the verified token claims stored by RequireToken
+func ClaimsFromContext(ctx context.Context) (jwt.Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(jwt.Claims)
+	return claims, ok
+}
+
+// RequireSession only calls next for requests with a valid auth server
+// session cookie, storing the session's user in the request context
+func (a *Authenticator) RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := a.sessionUser(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// RequireToken only calls next for requests with a valid bearer token that
+// was granted every listed scope. The claims are stored in the request
+// context and the token subject is available as the User ID.
+func (a *Authenticator) RequireToken(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || token == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			claims, err := a.VerifyToken(r.Context(), token)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			for _, scope := range scopes {
+				if !claims.HasScope(scope) {
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Join(scopes, " ")))
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+			}
+
+			ctx := context.WithValue(r.Context(), claimsKey{}, claims)
+			ctx = context.WithValue(ctx, userKey{}, User{ID: claims.Subject})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequireRole only calls next when the authenticated user has one of roles.
+// It must be wrapped by RequireSession.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := UserFromContext(r.Context())
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			for _, role := range roles {
+				if user.Role == role {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		})
+	}
+}
+
+// VerifyToken checks a bearer token's signature against the auth server's
+// key set, its expiry, and its issuer when Config.Issuer is set
+func (a *Authenticator) VerifyToken(ctx context.Context, token string) (jwt.Claims, error) {
+	keyFunc := func(kid string) (*ecdsa.PublicKey, error) {
+		return a.keys.key(ctx, kid)
+	}
+
+	claims, err := jwt.Verify(token, keyFunc, time.Now())
+	if err != nil {
+		return jwt.Claims{}, err
+	}
+	if a.config.Issuer != "" && claims.Issuer != a.config.Issuer {
+		return jwt.Claims{}, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	return claims, nil
+}
+
+// sessionUser resolves the request's session cookie to a user by calling
+// the auth server's profile endpoint
+func (a *Authenticator) sessionUser(r *http.Request) (User, error) {
+	cookie, err := r.Cookie(a.config.CookieName)
+	if err != nil || cookie.Value == "" {
+		return User{}, ErrUnauthenticated
+	}
+
+	now := time.Now()
+	if a.config.SessionCacheTTL > 0 {
+		a.mutex.Lock()
+		cached, ok := a.sessions[cookie.Value]
+		a.mutex.Unlock()
+		if ok && now.Before(cached.expires) {
+			return cached.user, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, a.config.BaseURL+"/api/profile", nil)
+	if err != nil {
+		return User{}, err
+	}
+	req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return User{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return User{}, ErrUnauthenticated
+	}
+
+	var body struct {
+		Data User `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return User{}, err
+	}
+
+	if a.config.SessionCacheTTL > 0 {
+		a.mutex.Lock()
+		// Drop expired entries so the cache cannot grow without bound
+		for key, entry := range a.sessions {
+			if !now.Before(entry.expires) {
+				delete(a.sessions, key)
+			}
+		}
+		a.sessions[cookie.Value] = cachedSession{user: body.Data, expires: now.Add(a.config.SessionCacheTTL)}
+		a.mutex.Unlock()
+	}
+
+	return body.Data, nil
+}
@@ -0,0 +1,89 @@
+package authmiddleware
+
+import (
+	"auth-server/pkg/jwt"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// minRefreshInterval limits how often an unknown kid can trigger a key set
+// fetch, so forged tokens cannot be used to flood the auth server
+const minRefreshInterval = 30 * time.Second
+
+// remoteKeySet caches the auth server's JWKS, refetching it when a token
+// names a key it has not seen yet
+type remoteKeySet struct {
+	client *http.Client
+	url    string
+
+	mutex       sync.Mutex
+	keys        map[string]*ecdsa.PublicKey
+	lastRefresh time.Time
+}
+
+func newRemoteKeySet(client *http.Client, url string) *remoteKeySet {
+	return &remoteKeySet{client: client, url: url, keys: make(map[string]*ecdsa.PublicKey)}
+}
+
+// key returns the verification key for kid
+func (ks *remoteKeySet) key(ctx context.Context, kid string) (*ecdsa.PublicKey, error) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	if key, ok := ks.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Since(ks.lastRefresh) < minRefreshInterval {
+		return nil, jwt.ErrUnknownKey
+	}
+	if err := ks.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	if key, ok := ks.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, jwt.ErrUnknownKey
+}
+
+// refresh replaces the cached keys with the auth server's current key set.
+// The caller must hold the mutex.
+func (ks *remoteKeySet) refresh(ctx context.Context) error {
+	ks.lastRefresh = time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching key set: unexpected status %d", resp.StatusCode)
+	}
+
+	var set jwt.JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decoding key set: %w", err)
+	}
+
+	keys := make(map[string]*ecdsa.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	ks.keys = keys
+	return nil
+}
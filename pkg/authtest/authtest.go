@@ -0,0 +1,427 @@
+// Package authtest runs the auth server for tests. It provides HTTP
+// clients, user and session factories and golden response assertions, so
+// integration tests do not each rebuild the same setup.
+package authtest
+
+import (
+	"auth-server/pkg/server"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DefaultPassword is the password CreateUser gives users that have none
+const DefaultPassword = "password123"
+
+// bootstrapToken is the ADMIN_BOOTSTRAP_TOKEN of servers with admins
+const bootstrapToken = "authtest-bootstrap-token"
+
+// Options configure a test server
+type Options struct {
+	// Env sets environment variables read by server.LoadConfig for the
+	// duration of the test
+	Env map[string]string
+	// Admins are usernames CreateUser makes admins once they have
+	// registered, as an operator would: the first through the bootstrap
+	// token and the rest through the role API
+	Admins []string
+	// Clock and IDGenerator replace the server's when set
+	Clock       server.Clock
+	IDGenerator server.IDGenerator
+}
+
+// Server is an auth server listening on a local port for one test. It is
+// closed when the test ends.
+type Server struct {
+	*httptest.Server
+	// Auth is the server handling requests, for registering routes or
+	// reaching other server APIs
+	Auth *server.Server
+
+	t      testing.TB
+	mutex  sync.Mutex
+	users  int
+	admins []string
+	// admin is signed in as the first admin, who appoints the others
+	admin *Client
+}
+
+// NewServer starts a server configured by opts. The maintenance setting and
+// the outbox are kept in a temporary directory so tests cannot leave them
+// behind.
+func NewServer(t testing.TB, opts Options) *Server {
+	t.Helper()
+
+	t.Setenv("MAINTENANCE_FILE", filepath.Join(t.TempDir(), "maintenance.json"))
+	t.Setenv("OUTBOX_FILE", filepath.Join(t.TempDir(), "outbox.json"))
+	if len(opts.Admins) > 0 {
+		t.Setenv("ADMIN_BOOTSTRAP_TOKEN", bootstrapToken)
+	}
+	for name, value := range opts.Env {
+		t.Setenv(name, value)
+	}
+
+	var options []server.Option
+	if opts.Clock != nil {
+		options = append(options, server.WithClock(opts.Clock))
+	}
+	if opts.IDGenerator != nil {
+		options = append(options, server.WithIDGenerator(opts.IDGenerator))
+	}
+	auth, err := server.New(server.LoadConfig(), options...)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	s := &Server{Server: httptest.NewServer(auth.Handler()), Auth: auth, t: t, admins: opts.Admins}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Client returns a new client with its own cookie jar, so it starts
+// without a session
+func (s *Server) Client() *Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		s.t.Fatalf("Failed to create cookie jar: %v", err)
+	}
+	// A copy, since httptest shares one client between callers
+	httpClient := *s.Server.Client()
+	httpClient.Jar = jar
+	// Redirects are part of what tests check, so they are not followed
+	httpClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &Client{t: s.t, baseURL: s.URL, http: &httpClient}
+}
+
+// User is an account created by CreateUser
+type User struct {
+	Username string
+	Email    string
+	Password string
+}
+
+// CreateUser registers an account through the API. Empty fields are filled
+// with unique defaults.
+func (s *Server) CreateUser(user User) User {
+	s.t.Helper()
+
+	s.mutex.Lock()
+	s.users++
+	n := s.users
+	s.mutex.Unlock()
+
+	if user.Username == "" {
+		user.Username = fmt.Sprintf("user%d", n)
+	}
+	if user.Email == "" {
+		user.Email = user.Username + "@example.com"
+	}
+	if user.Password == "" {
+		user.Password = DefaultPassword
+	}
+
+	resp := s.Client().Post("/api/register", server.RegisterRequest{
+		Username: user.Username,
+		Email:    user.Email,
+		Password: user.Password,
+	})
+	resp.RequireStatus(http.StatusCreated)
+	if slices.Contains(s.admins, user.Username) {
+		s.grantAdmin(user)
+	}
+	return user
+}
+
+// grantAdmin makes user an admin
+func (s *Server) grantAdmin(user User) {
+	s.t.Helper()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	client := s.Login(user)
+	if s.admin == nil {
+		client.Post("/api/admin/bootstrap", server.AdminBootstrapRequest{Token: bootstrapToken}).RequireStatus(http.StatusOK)
+		s.admin = client
+		return
+	}
+	var profile struct {
+		ID string `json:"id"`
+	}
+	client.Get("/api/profile").RequireStatus(http.StatusOK).Envelope(&profile)
+	s.admin.Put("/api/admin/users/"+profile.ID+"/role", server.RoleRequest{Role: server.RoleAdmin}).RequireStatus(http.StatusOK)
+}
+
+// Login returns a client signed in as user
+func (s *Server) Login(user User) *Client {
+	s.t.Helper()
+
+	client := s.Client()
+	client.Post("/api/login", server.LoginRequest{
+		Username: user.Username,
+		Password: user.Password,
+	}).RequireStatus(http.StatusOK)
+	return client
+}
+
+// NewSession creates a user with default details and signs them in
+func (s *Server) NewSession() (*Client, User) {
+	s.t.Helper()
+
+	user := s.CreateUser(User{})
+	return s.Login(user), user
+}
+
+// Client sends requests to a test server, keeping cookies between them.
+// Request failures fail the test.
+type Client struct {
+	t       testing.TB
+	baseURL string
+	http    *http.Client
+	header  http.Header
+}
+
+// SetHeader sends a header with every later request, such as Accept or
+// Accept-Language
+func (c *Client) SetHeader(name, value string) {
+	if c.header == nil {
+		c.header = make(http.Header)
+	}
+	c.header.Set(name, value)
+}
+
+// Get sends a GET request
+func (c *Client) Get(path string) *Response {
+	c.t.Helper()
+	return c.Do(http.MethodGet, path, nil)
+}
+
+// Post sends body as JSON in a POST request
+func (c *Client) Post(path string, body interface{}) *Response {
+	c.t.Helper()
+	return c.Do(http.MethodPost, path, body)
+}
+
+// Put sends body as JSON in a PUT request
+func (c *Client) Put(path string, body interface{}) *Response {
+	c.t.Helper()
+	return c.Do(http.MethodPut, path, body)
+}
+
+// Patch sends body as JSON in a PATCH request
+func (c *Client) Patch(path string, body interface{}) *Response {
+	c.t.Helper()
+	return c.Do(http.MethodPatch, path, body)
+}
+
+// Delete sends a DELETE request
+func (c *Client) Delete(path string) *Response {
+	c.t.Helper()
+	return c.Do(http.MethodDelete, path, nil)
+}
+
+// Do sends a request with body encoded as JSON, or without a body when it
+// is nil. A []byte or string body is sent as is, still as JSON.
+func (c *Client) Do(method, path string, body interface{}) *Response {
+	c.t.Helper()
+
+	var reader io.Reader
+	switch body := body.(type) {
+	case nil:
+	case []byte:
+		reader = bytes.NewReader(body)
+	case string:
+		reader = strings.NewReader(body)
+	default:
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatalf("Failed to encode request body: %v", err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		c.t.Fatalf("Failed to create request: %v", err)
+	}
+	for name, values := range c.header {
+		req.Header[name] = values
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	contents, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("Failed to read response to %s %s: %v", method, path, err)
+	}
+
+	return &Response{
+		t:       c.t,
+		request: method + " " + path,
+		Status:  resp.StatusCode,
+		Header:  resp.Header,
+		Body:    contents,
+	}
+}
+
+// Response is a complete response read by a Client
+type Response struct {
+	t       testing.TB
+	request string
+
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// RequireStatus fails the test immediately unless the response has the
+// given status
+func (r *Response) RequireStatus(status int) *Response {
+	r.t.Helper()
+	if r.Status != status {
+		r.t.Fatalf("%s: expected status %d, got %d: %s", r.request, status, r.Status, r.Body)
+	}
+	return r
+}
+
+// Decode decodes the JSON body into v
+func (r *Response) Decode(v interface{}) {
+	r.t.Helper()
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		r.t.Fatalf("%s: failed to decode response %q: %v", r.request, r.Body, err)
+	}
+}
+
+// Envelope decodes the standard response body, with Data decoded into data
+// when it is not nil
+func (r *Response) Envelope(data interface{}) server.Response {
+	r.t.Helper()
+	envelope := server.Response{Data: data}
+	r.Decode(&envelope)
+	return envelope
+}
+
+// AssertGolden compares the JSON body with testdata/<name>.golden, after
+// replacing the values of the redact fields, at any depth, with
+// "<redacted>". Run the tests with AUTHTEST_UPDATE=1 to write the files.
+func (r *Response) AssertGolden(name string, redact ...string) {
+	r.t.Helper()
+
+	var body interface{}
+	r.Decode(&body)
+	fields := make(map[string]bool, len(redact))
+	for _, field := range redact {
+		fields[field] = true
+	}
+	normalized, err := json.MarshalIndent(redactJSON(body, fields), "", "  ")
+	if err != nil {
+		r.t.Fatalf("%s: failed to encode response: %v", r.request, err)
+	}
+	AssertGolden(r.t, name, append(normalized, '\n'))
+}
+
+// AssertGolden compares got with testdata/<name>.golden. Run the tests
+// with AUTHTEST_UPDATE=1 to write the file instead.
+func AssertGolden(t testing.TB, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name+".golden")
+	if os.Getenv("AUTHTEST_UPDATE") != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("Failed to create %s: %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s, run with AUTHTEST_UPDATE=1 to create it: %v", path, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Response does not match %s\n--- want\n%s\n--- got\n%s", path, want, got)
+	}
+}
+
+// redactJSON replaces the values of fields in a decoded JSON value
+func redactJSON(v interface{}, fields map[string]bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if fields[key] && value != nil {
+				v[key] = "<redacted>"
+				continue
+			}
+			v[key] = redactJSON(value, fields)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactJSON(value, fields)
+		}
+	}
+	return v
+}
+
+// Clock is a server.Clock that stands still until advanced
+type Clock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewClock returns a clock stopped at now
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the clock's time
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *Clock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// SequentialIDs is a server.IDGenerator that numbers IDs per prefix, such
+// as usr_1, usr_2 and sess_1
+type SequentialIDs struct {
+	mutex sync.Mutex
+	next  map[string]int
+}
+
+// NewID returns the next ID for prefix
+func (g *SequentialIDs) NewID(prefix string) string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.next == nil {
+		g.next = make(map[string]int)
+	}
+	g.next[prefix]++
+	return fmt.Sprintf("%s_%d", prefix, g.next[prefix])
+}
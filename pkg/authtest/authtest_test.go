@@ -0,0 +1,47 @@
+package authtest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHarness(t *testing.T) {
+	clock := NewClock(time.Date(2030, time.January, 1, 12, 0, 0, 0, time.UTC))
+	srv := NewServer(t, Options{
+		Admins:      []string{"alice", "bob"},
+		Clock:       clock,
+		IDGenerator: &SequentialIDs{},
+	})
+
+	client, user := srv.NewSession()
+	if user.Username != "user1" || user.Email != "user1@example.com" {
+		t.Errorf("Expected default user details, got %+v", user)
+	}
+	profile := client.Get("/api/profile").RequireStatus(http.StatusOK)
+	profile.AssertGolden("profile")
+
+	var data struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	}
+	if envelope := profile.Envelope(&data); !envelope.Success || data.ID != "usr_1" || data.Username != "user1" {
+		t.Errorf("Expected the profile of usr_1, got %+v %+v", envelope, data)
+	}
+
+	if resp := srv.Client().Get("/api/profile"); resp.Status != http.StatusUnauthorized {
+		t.Errorf("Expected new clients to start without a session, got %d", resp.Status)
+	}
+
+	admin := srv.Login(srv.CreateUser(User{Username: "alice"}))
+	admin.Get("/api/admin/flags").RequireStatus(http.StatusOK)
+	srv.Login(srv.CreateUser(User{Username: "bob"})).Get("/api/admin/flags").RequireStatus(http.StatusOK)
+	client.Get("/api/admin/flags").RequireStatus(http.StatusForbidden)
+
+	client.Post("/api/logout", nil).RequireStatus(http.StatusOK)
+	client.Get("/api/profile").RequireStatus(http.StatusUnauthorized)
+
+	// Sessions expire on the injected clock
+	clock.Advance(25 * time.Hour)
+	admin.Get("/api/admin/flags").RequireStatus(http.StatusUnauthorized)
+}
@@ -3,6 +3,7 @@ package base64util
 import (
 	"encoding/base64"
 	"errors"
+	"io"
 )
 
 // Encoder provides base64 encoding and decoding functionality
@@ -70,3 +71,46 @@ func (e *Encoder) DecodeBytes(encodedText string) ([]byte, error) {
 
 	return decoded, nil
 }
+
+// EncodeStream reads raw data from r and writes its base64 encoding to w
+// without buffering the whole input in memory
+func (e *Encoder) EncodeStream(r io.Reader, w io.Writer) (int64, error) {
+	encoder := base64.NewEncoder(base64.StdEncoding, w)
+
+	n, err := io.Copy(encoder, r)
+	if err != nil {
+		return n, err
+	}
+
+	if n == 0 {
+		return 0, errors.New("input cannot be empty")
+	}
+
+	// Close flushes any partially written block and padding
+	if err := encoder.Close(); err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
+
+// DecodeStream reads base64 text from r and writes the decoded bytes to w
+// without buffering the whole input in memory. Line breaks in the input are ignored.
+func (e *Encoder) DecodeStream(r io.Reader, w io.Writer) (int64, error) {
+	decoder := base64.NewDecoder(base64.StdEncoding, r)
+
+	n, err := io.Copy(w, decoder)
+	if err != nil {
+		var corrupt base64.CorruptInputError
+		if errors.As(err, &corrupt) {
+			return n, errors.New("invalid base64 text")
+		}
+		return n, err
+	}
+
+	if n == 0 {
+		return 0, errors.New("encoded text cannot be empty")
+	}
+
+	return n, nil
+}
@@ -0,0 +1,121 @@
+package base64util
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// defaultDataURIMIMEType is the media type implied by a data URI without one (RFC 2397)
+const defaultDataURIMIMEType = "text/plain;charset=US-ASCII"
+
+// maxDataURIHeaderLength bounds how much of a stream is read looking for the
+// comma that ends a data URI header
+const maxDataURIHeaderLength = 1024
+
+// IsDataURI reports whether text looks like a data: URI
+func (e *Encoder) IsDataURI(text string) bool {
+	return len(text) >= len("data:") && strings.EqualFold(text[:len("data:")], "data:")
+}
+
+// BuildDataURI builds a base64 data URI of the form data:<mime>;base64,<data>
+func (e *Encoder) BuildDataURI(mimeType string, data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", errors.New("data cannot be empty")
+	}
+
+	return e.DataURIPrefix(mimeType) + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// DataURIPrefix returns the "data:<mime>;base64," header that precedes the
+// payload of a base64 data URI, for callers that stream the payload themselves
+func (e *Encoder) DataURIPrefix(mimeType string) string {
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	return "data:" + mimeType + ";base64,"
+}
+
+// ParseDataURI parses a data URI, returning its MIME type and decoded payload.
+// Both base64 and percent-encoded payloads are supported.
+func (e *Encoder) ParseDataURI(uri string) (string, []byte, error) {
+	if !e.IsDataURI(uri) {
+		return "", nil, errors.New("not a data URI")
+	}
+
+	header, payload, found := strings.Cut(uri[len("data:"):], ",")
+	if !found {
+		return "", nil, errors.New("invalid data URI: missing comma")
+	}
+
+	mimeType, isBase64 := parseDataURIHeader(header)
+
+	if !isBase64 {
+		decoded, err := url.PathUnescape(payload)
+		if err != nil {
+			return "", nil, errors.New("invalid data URI payload")
+		}
+		return mimeType, []byte(decoded), nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", nil, errors.New("invalid base64 text")
+	}
+
+	return mimeType, decoded, nil
+}
+
+// ReadDataURIHeader consumes a leading "data:<mime>;base64," header from r if
+// one is present, leaving r positioned at the start of the base64 payload.
+// It reports whether a header was found and the MIME type it declared.
+func (e *Encoder) ReadDataURIHeader(r *bufio.Reader) (string, bool, error) {
+	prefix, err := r.Peek(len("data:"))
+	if err != nil || !e.IsDataURI(string(prefix)) {
+		// Too short or not a data URI; leave the stream untouched
+		return "", false, nil
+	}
+
+	var header strings.Builder
+	for header.Len() <= maxDataURIHeaderLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", true, errors.New("invalid data URI: missing comma")
+		}
+		if b == ',' {
+			mimeType, isBase64 := parseDataURIHeader(header.String()[len("data:"):])
+			if !isBase64 {
+				return "", true, errors.New("only base64 data URIs are supported")
+			}
+			return mimeType, true, nil
+		}
+		header.WriteByte(b)
+	}
+
+	return "", true, errors.New("invalid data URI: header too long")
+}
+
+// parseDataURIHeader splits the part between "data:" and "," into the media
+// type (with any parameters) and whether the payload is base64 encoded
+func parseDataURIHeader(header string) (string, bool) {
+	isBase64 := false
+	if len(header) >= len(";base64") && strings.EqualFold(header[len(header)-len(";base64"):], ";base64") {
+		isBase64 = true
+		header = header[:len(header)-len(";base64")]
+	}
+
+	var mimeType string
+	switch {
+	case header == "":
+		mimeType = defaultDataURIMIMEType
+	case strings.HasPrefix(header, ";"):
+		// Only parameters were given, e.g. "data:;charset=utf-8,..."
+		mimeType = "text/plain" + header
+	default:
+		mimeType = header
+	}
+
+	return mimeType, isBase64
+}
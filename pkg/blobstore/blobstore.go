@@ -0,0 +1,99 @@
+// Package blobstore stores files such as profile pictures by their
+// content. A blob's key is the hex SHA-256 of its bytes, so identical
+// uploads share one blob and a key never changes meaning. Blobs are
+// handed out through short-lived signed URLs, and blobs nothing refers to
+// any more are removed by Collect.
+package blobstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned for keys that are not stored
+	ErrNotFound = errors.New("blobstore: blob not found")
+	// ErrInvalidKey is returned for keys that are not a hex SHA-256
+	ErrInvalidKey = errors.New("blobstore: invalid key")
+	// ErrInvalidSignature is returned by Disk.Verify for URLs that were
+	// not signed by the store or have expired
+	ErrInvalidSignature = errors.New("blobstore: invalid or expired signature")
+)
+
+// Info describes a stored blob
+type Info struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Store keeps blobs. Implementations are safe for concurrent use.
+type Store interface {
+	// Put stores everything read from data and returns its info. Storing
+	// content that is already there returns the existing blob, with
+	// CreatedAt renewed as if it had just been stored.
+	Put(ctx context.Context, data io.Reader, contentType string) (Info, error)
+	// Open returns the blob's content, which the caller must close
+	Open(ctx context.Context, key string) (io.ReadCloser, Info, error)
+	// Stat returns the blob's info without its content
+	Stat(ctx context.Context, key string) (Info, error)
+	// Delete removes the blob; deleting a missing blob is not an error
+	Delete(ctx context.Context, key string) error
+	// List returns every stored blob. ContentType may be left empty.
+	List(ctx context.Context) ([]Info, error)
+	// SignedURL returns a URL that downloads the blob until ttl after now
+	// without further credentials
+	SignedURL(key string, now time.Time, ttl time.Duration) (string, error)
+}
+
+// Key returns the key of content
+func Key(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidKey reports whether key has the form of a blob key: 64 lowercase
+// hex digits
+func ValidKey(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range key {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Collect deletes the blobs created before cutoff that referenced does
+// not report as in use, and returns how many it deleted. The cutoff keeps
+// blobs whose reference is still being saved. Blobs that fail to delete
+// are skipped and the first error is returned with the count.
+func Collect(ctx context.Context, store Store, referenced func(key string) bool, cutoff time.Time) (int, error) {
+	blobs, err := store.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	var firstErr error
+	for _, blob := range blobs {
+		if !blob.CreatedAt.Before(cutoff) || referenced(blob.Key) {
+			continue
+		}
+		if err := store.Delete(ctx, blob.Key); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		deleted++
+	}
+	return deleted, firstErr
+}
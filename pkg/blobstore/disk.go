@@ -0,0 +1,230 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Disk keeps blobs in a directory, each under a subdirectory named after
+// the first two digits of its key, with its content type in a ".meta"
+// file next to it. Disk has no web server of its own: signed URLs point to
+// BaseURL, where the application checks them with Verify and serves the
+// blob.
+type Disk struct {
+	root       string
+	baseURL    string
+	signingKey []byte
+}
+
+// diskMeta is what a ".meta" file holds
+type diskMeta struct {
+	ContentType string `json:"contentType"`
+}
+
+// NewDisk returns a store in root, creating the directory if needed.
+// SignedURL returns baseURL followed by "/<key>" and a signature made
+// with signingKey.
+func NewDisk(root, baseURL string, signingKey []byte) (*Disk, error) {
+	if len(signingKey) == 0 {
+		return nil, errors.New("blobstore: a signing key is required")
+	}
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, err
+	}
+	return &Disk{root: root, baseURL: strings.TrimRight(baseURL, "/"), signingKey: signingKey}, nil
+}
+
+func (d *Disk) path(key string) string {
+	return filepath.Join(d.root, key[:2], key)
+}
+
+// Put stores data under its key. The content is written to a temporary
+// file first and renamed into place, so a blob is never seen half written.
+func (d *Disk) Put(ctx context.Context, data io.Reader, contentType string) (Info, error) {
+	tmp, err := os.CreateTemp(d.root, ".upload-*")
+	if err != nil {
+		return Info{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), data); err != nil {
+		return Info{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return Info{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return Info{}, err
+	}
+	key := hex.EncodeToString(hash.Sum(nil))
+
+	// Content already stored gets a new modification time, so Collect
+	// gives it the grace period of a fresh upload instead of deleting it
+	// before the caller saves its reference
+	now := time.Now()
+	if err := os.Chtimes(d.path(key), now, now); err == nil {
+		return d.Stat(ctx, key)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return Info{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.path(key)), 0o750); err != nil {
+		return Info{}, err
+	}
+	// The meta file goes first, so every visible blob has one
+	meta, err := json.Marshal(diskMeta{ContentType: contentType})
+	if err != nil {
+		return Info{}, err
+	}
+	if err := os.WriteFile(d.path(key)+".meta", meta, 0o640); err != nil {
+		return Info{}, err
+	}
+	if err := os.Rename(tmp.Name(), d.path(key)); err != nil {
+		return Info{}, err
+	}
+	return d.Stat(ctx, key)
+}
+
+// Open returns the blob's file
+func (d *Disk) Open(ctx context.Context, key string) (io.ReadCloser, Info, error) {
+	if !ValidKey(key) {
+		return nil, Info{}, ErrInvalidKey
+	}
+	file, err := os.Open(d.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, Info{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, Info{}, err
+	}
+	info, err := d.Stat(ctx, key)
+	if err != nil {
+		file.Close()
+		return nil, Info{}, err
+	}
+	return file, info, nil
+}
+
+// Stat returns the blob's size, content type and the time it was stored
+func (d *Disk) Stat(ctx context.Context, key string) (Info, error) {
+	if !ValidKey(key) {
+		return Info{}, ErrInvalidKey
+	}
+	stat, err := os.Stat(d.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return Info{}, ErrNotFound
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{Key: key, Size: stat.Size(), CreatedAt: stat.ModTime()}
+	if encoded, err := os.ReadFile(d.path(key) + ".meta"); err == nil {
+		var meta diskMeta
+		if json.Unmarshal(encoded, &meta) == nil {
+			info.ContentType = meta.ContentType
+		}
+	}
+	return info, nil
+}
+
+// Delete removes the blob and its meta file
+func (d *Disk) Delete(ctx context.Context, key string) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	if err := os.Remove(d.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(d.path(key) + ".meta"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List returns every blob without its content type
+func (d *Disk) List(ctx context.Context) ([]Info, error) {
+	dirs, err := os.ReadDir(d.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var blobs []Info
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(d.root, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !ValidKey(entry.Name()) || !strings.HasPrefix(entry.Name(), dir.Name()) {
+				continue
+			}
+			stat, err := entry.Info()
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			blobs = append(blobs, Info{Key: entry.Name(), Size: stat.Size(), CreatedAt: stat.ModTime()})
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return blobs, nil
+}
+
+// signature is the MAC of a download URL for key expiring at expires
+func (d *Disk) signature(key string, expires int64) string {
+	mac := hmac.New(sha256.New, d.signingKey)
+	fmt.Fprintf(mac, "%s\n%d", key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignedURL returns the base URL's download URL for key, with its expiry
+// and signature in the expires and signature parameters
+func (d *Disk) SignedURL(key string, now time.Time, ttl time.Duration) (string, error) {
+	if !ValidKey(key) {
+		return "", ErrInvalidKey
+	}
+	expires := now.Add(ttl).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", d.signature(key, expires))
+	return d.baseURL + "/" + key + "?" + query.Encode(), nil
+}
+
+// Verify checks the expires and signature parameters of a download of key
+// at now
+func (d *Disk) Verify(key string, query url.Values, now time.Time) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || !now.Before(time.Unix(expires, 0)) {
+		return ErrInvalidSignature
+	}
+	given, err := hex.DecodeString(query.Get("signature"))
+	expected, _ := hex.DecodeString(d.signature(key, expires))
+	if err != nil || !hmac.Equal(given, expected) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
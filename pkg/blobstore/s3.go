@@ -0,0 +1,315 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3UnsignedPayload is the payload hash presigned URLs are signed with
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3 keeps blobs in an S3 bucket, or a service with the S3 API, as objects
+// named Prefix followed by the key. Requests are signed with AWS
+// Signature Version 4 and use path-style addressing, which S3-compatible
+// services also accept.
+type S3 struct {
+	Bucket string
+	Region string
+	// Prefix is put before every key, such as "blobs/"
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// Endpoint defaults to https://s3.<Region>.amazonaws.com
+	Endpoint string
+	Client   *http.Client
+}
+
+func (s *S3) endpoint() string {
+	if s.Endpoint != "" {
+		return strings.TrimRight(s.Endpoint, "/")
+	}
+	return "https://s3." + s.Region + ".amazonaws.com"
+}
+
+func (s *S3) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
+
+// objectURL returns the URL of the object for key, or of the bucket when
+// key is ""
+func (s *S3) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(s.endpoint() + "/" + s.Bucket + "/")
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		u.Path += s.Prefix + key
+	}
+	return u, nil
+}
+
+// Put uploads data, which is read into memory to find its key
+func (s *S3) Put(ctx context.Context, data io.Reader, contentType string) (Info, error) {
+	content, err := io.ReadAll(data)
+	if err != nil {
+		return Info{}, err
+	}
+	// Content already stored is put again all the same, which renews its
+	// LastModified so Collect does not take it for an old orphan
+	key := Key(content)
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, nil, header, content)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return Info{}, fmt.Errorf("s3 returned %s storing %s", resp.Status, key)
+	}
+	return Info{Key: key, Size: int64(len(content)), ContentType: contentType, CreatedAt: time.Now()}, nil
+}
+
+// Open downloads the object
+func (s *S3) Open(ctx context.Context, key string) (io.ReadCloser, Info, error) {
+	if !ValidKey(key) {
+		return nil, Info{}, ErrInvalidKey
+	}
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	if err := s3Status(resp, key); err != nil {
+		resp.Body.Close()
+		return nil, Info{}, err
+	}
+	return resp.Body, s3Info(key, resp), nil
+}
+
+// Stat reads the object's headers
+func (s *S3) Stat(ctx context.Context, key string) (Info, error) {
+	if !ValidKey(key) {
+		return Info{}, ErrInvalidKey
+	}
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	if err := s3Status(resp, key); err != nil {
+		return Info{}, err
+	}
+	return s3Info(key, resp), nil
+}
+
+// Delete removes the object
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return s3Status(resp, key)
+}
+
+// s3ListResult is the part of a ListObjectsV2 answer List reads
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List pages through the objects under Prefix, skipping any whose name is
+// not a key
+func (s *S3) List(ctx context.Context) ([]Info, error) {
+	var blobs []Info
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		if s.Prefix != "" {
+			query.Set("prefix", s.Prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		if err = s3Status(resp, ""); err == nil {
+			err = xml.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			key := strings.TrimPrefix(object.Key, s.Prefix)
+			if ValidKey(key) {
+				blobs = append(blobs, Info{Key: key, Size: object.Size, CreatedAt: object.LastModified})
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return blobs, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// SignedURL returns a presigned GET URL for the object
+func (s *S3) SignedURL(key string, now time.Time, ttl time.Duration) (string, error) {
+	if !ValidKey(key) {
+		return "", ErrInvalidKey
+	}
+	u, err := s.objectURL(key)
+	if err != nil {
+		return "", err
+	}
+	now = now.UTC()
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.AccessKeyID+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(ttl.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = s3Query(query)
+
+	header := http.Header{}
+	header.Set("Host", u.Host)
+	signature := s.signature(http.MethodGet, u, header, []string{"host"}, s3UnsignedPayload, now)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+// do sends a signed request for the object with key, or for the bucket
+// when key is ""
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	now := time.Now().UTC()
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("Host", u.Host)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	signature := s.signature(method, u, req.Header, signed, hex.EncodeToString(payloadHash[:]), now)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, s.scope(now), strings.Join(signed, ";"), signature))
+	req.Header.Del("Host")
+	return s.client().Do(req)
+}
+
+// scope is the credential scope of requests signed at now
+func (s *S3) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+}
+
+// signature signs a request as Signature Version 4 describes: a canonical
+// form of the request is hashed into a string to sign, which is signed
+// with a key derived from the secret, date, region and service
+func (s *S3) signature(method string, u *url.URL, header http.Header, signed []string, payloadHash string, now time.Time) string {
+	var canonicalHeaders strings.Builder
+	for _, name := range signed {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(header.Get(name)) + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		u.RawQuery,
+		canonicalHeaders.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + s.scope(now) + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), s.Region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	return hex.EncodeToString(key)
+}
+
+// s3Query encodes query sorted by name with the escaping Signature
+// Version 4 expects, which differs from url.Values.Encode for spaces
+func s3Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, s3Escape(name)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but RFC 3986 unreserved characters
+func s3Escape(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
+
+// s3Status turns an error response about key into an error
+func s3Status(resp *http.Response, key string) error {
+	switch {
+	case resp.StatusCode == http.StatusNotFound && key != "":
+		return ErrNotFound
+	case resp.StatusCode >= 300:
+		return errors.New("s3 returned " + resp.Status)
+	}
+	return nil
+}
+
+// s3Info reads a blob's info from the headers of its object
+func s3Info(key string, resp *http.Response) Info {
+	info := Info{Key: key, Size: resp.ContentLength, ContentType: resp.Header.Get("Content-Type")}
+	info.CreatedAt, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info
+}
@@ -0,0 +1,102 @@
+package cryptoutil
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Ciphertext format, version 1:
+//
+//	version (1 byte) || nonce (12 bytes) || AES-256-GCM ciphertext and tag
+//
+// Nonces are random per message, which is safe for well under 2^32 messages
+// per key. A new version byte must be allocated for any change to the layout,
+// algorithm, or key derivation so old ciphertexts stay decryptable.
+const (
+	ciphertextVersion1 byte = 1
+
+	// KeySize is the size of AES-256 keys used for encryption
+	KeySize = 32
+)
+
+var (
+	// ErrInvalidCiphertext is returned when a ciphertext is malformed or fails authentication
+	ErrInvalidCiphertext = errors.New("invalid ciphertext")
+	// ErrUnsupportedVersion is returned when a ciphertext has an unknown version byte
+	ErrUnsupportedVersion = errors.New("unsupported ciphertext version")
+)
+
+// DeriveKey derives a purpose-specific AES-256 key from a master key using
+// HKDF-SHA256, so each user or purpose gets an independent data key
+func DeriveKey(masterKey []byte, info string) ([]byte, error) {
+	if len(masterKey) < KeySize {
+		return nil, errors.New("master key must be at least 32 bytes")
+	}
+
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey, nil, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Encrypt seals plaintext with AES-256-GCM. additionalData is authenticated
+// but not encrypted and must be supplied again to Decrypt.
+func Encrypt(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	out[0] = ciphertextVersion1
+	if _, err := rand.Read(out[1:]); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(out, out[1:], plaintext, additionalData), nil
+}
+
+// Decrypt opens a ciphertext produced by Encrypt
+func Decrypt(key, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) == 0 {
+		return nil, ErrInvalidCiphertext
+	}
+	if ciphertext[0] != ciphertextVersion1 {
+		return nil, ErrUnsupportedVersion
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < 1+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidCiphertext
+	}
+
+	nonce := ciphertext[1 : 1+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, ciphertext[1+aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, errors.New("key must be 32 bytes")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
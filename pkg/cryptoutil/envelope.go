@@ -0,0 +1,85 @@
+package cryptoutil
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// Envelope format, version 1:
+//
+//	version (1 byte) || wrapped key length (2 bytes, big endian) ||
+//	wrapped data key || ciphertext from Encrypt under the data key
+//
+// Every envelope has its own random data key, so only the small wrapped
+// key has to go to the key wrapper, which may be a remote KMS.
+const envelopeVersion1 byte = 1
+
+// KeyWrapper encrypts data keys under a master key it holds, such as a
+// local key or a key in a KMS
+type KeyWrapper interface {
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// LocalKeyWrapper wraps data keys with AES-256-GCM under a 32 byte key
+type LocalKeyWrapper struct {
+	Key []byte
+}
+
+// WrapKey encrypts dataKey under the wrapper's key
+func (w *LocalKeyWrapper) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	return Encrypt(w.Key, dataKey, []byte("data-key"))
+}
+
+// UnwrapKey decrypts a key produced by WrapKey
+func (w *LocalKeyWrapper) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return Decrypt(w.Key, wrapped, []byte("data-key"))
+}
+
+// SealEnvelope encrypts plaintext under a new data key and wraps the data
+// key with wrapper. additionalData must be supplied again to OpenEnvelope.
+func SealEnvelope(ctx context.Context, wrapper KeyWrapper, plaintext, additionalData []byte) ([]byte, error) {
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	wrapped, err := wrapper.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) > 0xffff {
+		return nil, ErrInvalidCiphertext
+	}
+	ciphertext, err := Encrypt(dataKey, plaintext, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 3, 3+len(wrapped)+len(ciphertext))
+	out[0] = envelopeVersion1
+	binary.BigEndian.PutUint16(out[1:3], uint16(len(wrapped)))
+	out = append(out, wrapped...)
+	return append(out, ciphertext...), nil
+}
+
+// OpenEnvelope decrypts an envelope produced by SealEnvelope
+func OpenEnvelope(ctx context.Context, wrapper KeyWrapper, envelope, additionalData []byte) ([]byte, error) {
+	if len(envelope) < 3 {
+		return nil, ErrInvalidCiphertext
+	}
+	if envelope[0] != envelopeVersion1 {
+		return nil, ErrUnsupportedVersion
+	}
+	wrappedLen := int(binary.BigEndian.Uint16(envelope[1:3]))
+	if len(envelope) < 3+wrappedLen {
+		return nil, ErrInvalidCiphertext
+	}
+
+	dataKey, err := wrapper.UnwrapKey(ctx, envelope[3:3+wrappedLen])
+	if err != nil {
+		return nil, err
+	}
+	return Decrypt(dataKey, envelope[3+wrappedLen:], additionalData)
+}
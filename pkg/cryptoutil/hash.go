@@ -0,0 +1,95 @@
+package cryptoutil
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// ErrUnknownAlgorithm is returned when a hash algorithm is not supported
+var ErrUnknownAlgorithm = errors.New("unknown hash algorithm")
+
+// hashConstructors maps algorithm names to hash constructors
+var hashConstructors = map[string]func() hash.Hash{
+	"sha256":      sha256.New,
+	"sha512":      sha512.New,
+	"blake2b-256": newBlake2b256,
+	"blake2b-512": newBlake2b512,
+}
+
+// blake2b.New* only fail for oversized keys, and no key is passed here
+func newBlake2b256() hash.Hash {
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
+func newBlake2b512() hash.Hash {
+	h, _ := blake2b.New512(nil)
+	return h
+}
+
+// HashAlgorithms returns the supported hash algorithm names in sorted order
+func HashAlgorithms() []string {
+	names := make([]string, 0, len(hashConstructors))
+	for name := range hashConstructors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewHash returns a new hash.Hash for the named algorithm
+func NewHash(algorithm string) (hash.Hash, error) {
+	constructor, ok := hashConstructors[strings.ToLower(algorithm)]
+	if !ok {
+		return nil, ErrUnknownAlgorithm
+	}
+	return constructor(), nil
+}
+
+// NewHMAC returns a keyed HMAC for the named algorithm
+func NewHMAC(algorithm string, key []byte) (hash.Hash, error) {
+	constructor, ok := hashConstructors[strings.ToLower(algorithm)]
+	if !ok {
+		return nil, ErrUnknownAlgorithm
+	}
+	if len(key) == 0 {
+		return nil, errors.New("HMAC key cannot be empty")
+	}
+	return hmac.New(constructor, key), nil
+}
+
+// HashReader streams r through the named hash algorithm and returns the
+// digest along with the number of bytes read
+func HashReader(algorithm string, r io.Reader) ([]byte, int64, error) {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return nil, 0, err
+	}
+	return sum(h, r)
+}
+
+// HMACReader streams r through a keyed HMAC and returns the MAC along with
+// the number of bytes read
+func HMACReader(algorithm string, key []byte, r io.Reader) ([]byte, int64, error) {
+	h, err := NewHMAC(algorithm, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return sum(h, r)
+}
+
+func sum(h hash.Hash, r io.Reader) ([]byte, int64, error) {
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return nil, n, err
+	}
+	return h.Sum(nil), n, nil
+}
@@ -0,0 +1,169 @@
+package emailpolicy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrInvalidEmail is returned for addresses that cannot be parsed
+	ErrInvalidEmail = errors.New("invalid email address")
+	// ErrDisposableDomain is returned for addresses at blocked domains
+	ErrDisposableDomain = errors.New("email domain is not accepted")
+	// ErrDomainNotAllowed is returned when an allowlist is set and the domain is not on it
+	ErrDomainNotAllowed = errors.New("email domain is not on the allowed list")
+)
+
+// DefaultBlockedDomains is a small built-in list of well-known disposable
+// email providers, used when no list file is configured
+var DefaultBlockedDomains = []string{
+	"10minutemail.com",
+	"dispostable.com",
+	"getnada.com",
+	"guerrillamail.com",
+	"mailinator.com",
+	"maildrop.cc",
+	"sharklasers.com",
+	"temp-mail.org",
+	"tempmail.com",
+	"throwawaymail.com",
+	"trashmail.com",
+	"yopmail.com",
+}
+
+// Policy decides which email domains may be used for accounts. Blocked
+// domains always fail; when the allowed list is non-empty, only those
+// domains pass. Both lists also match subdomains.
+type Policy struct {
+	mutex   sync.RWMutex
+	blocked map[string]bool
+	allowed map[string]bool
+}
+
+// New creates a policy from blocked and allowed domain lists
+func New(blocked, allowed []string) *Policy {
+	p := &Policy{}
+	p.SetBlocked(blocked)
+	p.SetAllowed(allowed)
+	return p
+}
+
+// Domain returns the normalized domain of an email address
+func Domain(email string) (string, error) {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != strings.TrimSpace(email) {
+		// Reject display-name forms such as "Name <a@b.c>"
+		return "", ErrInvalidEmail
+	}
+
+	at := strings.LastIndex(address.Address, "@")
+	domain := strings.ToLower(address.Address[at+1:])
+	if !strings.Contains(domain, ".") {
+		return "", ErrInvalidEmail
+	}
+	return domain, nil
+}
+
+// Check validates an email address against the policy
+func (p *Policy) Check(email string) error {
+	domain, err := Domain(email)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if matches(p.blocked, domain) {
+		return ErrDisposableDomain
+	}
+	if len(p.allowed) > 0 && !matches(p.allowed, domain) {
+		return ErrDomainNotAllowed
+	}
+	return nil
+}
+
+// SetBlocked replaces the blocked domain list
+func (p *Policy) SetBlocked(domains []string) {
+	set := toSet(domains)
+	p.mutex.Lock()
+	p.blocked = set
+	p.mutex.Unlock()
+}
+
+// SetAllowed replaces the allowed domain list; an empty list allows all
+// domains that are not blocked
+func (p *Policy) SetAllowed(domains []string) {
+	set := toSet(domains)
+	p.mutex.Lock()
+	p.allowed = set
+	p.mutex.Unlock()
+}
+
+// Blocked returns the blocked domains in sorted order
+func (p *Policy) Blocked() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return sortedKeys(p.blocked)
+}
+
+// Allowed returns the allowed domains in sorted order
+func (p *Policy) Allowed() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return sortedKeys(p.allowed)
+}
+
+// LoadDomainList reads one domain per line, ignoring blank lines and
+// lines starting with #
+func LoadDomainList(r io.Reader) ([]string, error) {
+	var domains []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, line)
+	}
+	return domains, scanner.Err()
+}
+
+// matches reports whether domain or any of its parent domains is in set
+func matches(set map[string]bool, domain string) bool {
+	for {
+		if set[domain] {
+			return true
+		}
+		dot := strings.IndexByte(domain, '.')
+		if dot < 0 {
+			return false
+		}
+		domain = domain[dot+1:]
+	}
+}
+
+func toSet(domains []string) map[string]bool {
+	set := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" {
+			set[domain] = true
+		}
+	}
+	return set
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,158 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Domain event types
+const (
+	TypeUserRegistered  = "user.registered"
+	TypeLoginSucceeded  = "user.login_succeeded"
+	TypePasswordChanged = "user.password_changed"
+	TypeUserDeleted     = "user.deleted"
+	TypeUserRestored    = "user.restored"
+	TypeUserSuspended   = "user.suspended"
+	TypeRoleChanged     = "user.role_changed"
+	TypeSessionRevoked  = "session.revoked"
+)
+
+// Event is a domain event published to downstream systems
+type Event struct {
+	ID     string            `json:"id"`
+	Type   string            `json:"type"`
+	Time   time.Time         `json:"time"`
+	UserID string            `json:"userId,omitempty"`
+	Data   map[string]string `json:"data,omitempty"`
+}
+
+// Sink delivers events to an external system
+type Sink interface {
+	Publish(ctx context.Context, event Event) error
+	Close() error
+}
+
+// publishTimeout bounds how long a single sink may take to accept an event
+const publishTimeout = 5 * time.Second
+
+// Bus fans events out to sinks and in-process subscribers. Publishing never
+// blocks the caller: events are queued and delivered by a background
+// goroutine, and are dropped when the queue is full.
+type Bus struct {
+	queue chan Event
+	sinks []Sink
+	done  chan struct{}
+
+	// mutex guards subscribers, and closed so that nothing is sent on
+	// queue once Close has closed it
+	mutex       sync.RWMutex
+	subscribers []func(Event)
+	closed      bool
+
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+	errLog  io.Writer
+}
+
+// NewBus starts a bus that queues up to bufferSize events. Delivery errors
+// are written to errLog when it is not nil.
+func NewBus(bufferSize int, errLog io.Writer, sinks ...Sink) *Bus {
+	b := &Bus{
+		queue:  make(chan Event, bufferSize),
+		sinks:  sinks,
+		done:   make(chan struct{}),
+		errLog: errLog,
+	}
+	go b.dispatch()
+	return b
+}
+
+// Publish queues an event for delivery, filling in its time if unset.
+// Events published after Close are dropped.
+func (b *Bus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.closed {
+		b.dropped.Add(1)
+		return
+	}
+	select {
+	case b.queue <- event:
+	default:
+		b.dropped.Add(1)
+	}
+}
+
+// Subscribe registers fn to be called for every event. fn runs on the
+// delivery goroutine and must not block.
+func (b *Bus) Subscribe(fn func(Event)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscribers = append(b.subscribers, fn)
+}
+
+// Dropped returns how many events were discarded because the queue was full
+func (b *Bus) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+// Failed returns how many sink deliveries returned an error
+func (b *Bus) Failed() uint64 {
+	return b.failed.Load()
+}
+
+// Close stops accepting events, delivers those already queued and closes
+// every sink. Later calls do nothing.
+func (b *Bus) Close() error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.queue)
+	b.mutex.Unlock()
+	<-b.done
+
+	var firstErr error
+	for _, sink := range b.sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (b *Bus) dispatch() {
+	defer close(b.done)
+
+	for event := range b.queue {
+		b.mutex.RLock()
+		subscribers := b.subscribers
+		b.mutex.RUnlock()
+
+		for _, fn := range subscribers {
+			fn(event)
+		}
+
+		for _, sink := range b.sinks {
+			ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+			err := sink.Publish(ctx, event)
+			cancel()
+			if err != nil {
+				b.failed.Add(1)
+				if b.errLog != nil {
+					fmt.Fprintf(b.errLog, "[DEBUG] Failed to publish event %s to %T: %v\n", event.ID, sink, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATSSink publishes events as JSON to the subject <prefix>.<event type>,
+// so consumers can subscribe to a single type or to <prefix>.>
+type NATSSink struct {
+	conn   *nats.Conn
+	prefix string
+}
+
+// NewNATSSink connects to the NATS server at url
+func NewNATSSink(url, subjectPrefix string) (*NATSSink, error) {
+	conn, err := nats.Connect(url, nats.Name("auth-server"))
+	if err != nil {
+		return nil, err
+	}
+	return &NATSSink{conn: conn, prefix: subjectPrefix}, nil
+}
+
+// Publish sends the event to its subject
+func (s *NATSSink) Publish(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.conn.Publish(s.prefix+"."+event.Type, data)
+}
+
+// Close drains buffered messages and closes the connection
+func (s *NATSSink) Close() error {
+	return s.conn.Drain()
+}
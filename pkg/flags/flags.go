@@ -0,0 +1,181 @@
+// Package flags provides feature flags that can be toggled at runtime and
+// rolled out gradually to a percentage of users, or to chosen users and
+// tenants
+package flags
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnknownFlag is returned when no flag has the given name
+	ErrUnknownFlag = errors.New("unknown flag")
+	// ErrInvalidRollout is returned for rollout percentages outside 0-100
+	ErrInvalidRollout = errors.New("rollout must be between 0 and 100")
+)
+
+// Flag is a feature that can be turned on for some or all subjects
+type Flag struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Enabled switches the flag off for everyone when false, whatever the
+	// other settings
+	Enabled bool `json:"enabled"`
+	// Rollout is the percentage of users the flag is on for. Each user
+	// falls in a stable bucket per flag, so raising the percentage only
+	// adds users. Subjects without a user are only included at 100.
+	Rollout int `json:"rollout"`
+	// Users and Tenants always get the flag while it is enabled
+	Users     []string  `json:"users"`
+	Tenants   []string  `json:"tenants"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Subject is who a flag is evaluated for. Either field may be empty.
+type Subject struct {
+	UserID string
+	Tenant string
+}
+
+// Set holds the defined flags and is safe for concurrent use
+type Set struct {
+	mutex sync.RWMutex
+	flags map[string]Flag
+}
+
+// NewSet creates a set holding flags
+func NewSet(flags ...Flag) *Set {
+	s := &Set{flags: make(map[string]Flag)}
+	for _, flag := range flags {
+		s.Define(flag)
+	}
+	return s
+}
+
+// Define adds a flag, or replaces the description of an existing one
+// while keeping its settings
+func (s *Set) Define(flag Flag) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if existing, ok := s.flags[flag.Name]; ok {
+		existing.Description = flag.Description
+		s.flags[flag.Name] = existing
+		return
+	}
+	s.flags[flag.Name] = normalize(flag)
+}
+
+// Get returns the named flag
+func (s *Set) Get(name string) (Flag, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	flag, ok := s.flags[name]
+	if !ok {
+		return Flag{}, ErrUnknownFlag
+	}
+	return flag, nil
+}
+
+// List returns every flag sorted by name
+func (s *Set) List() []Flag {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	flags := make([]Flag, 0, len(s.flags))
+	for _, flag := range s.flags {
+		flags = append(flags, flag)
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
+
+// Update replaces the settings of an existing flag. The description is
+// kept, since it belongs to the code that defined the flag.
+func (s *Set) Update(flag Flag) (Flag, error) {
+	if flag.Rollout < 0 || flag.Rollout > 100 {
+		return Flag{}, ErrInvalidRollout
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	existing, ok := s.flags[flag.Name]
+	if !ok {
+		return Flag{}, ErrUnknownFlag
+	}
+	flag.Description = existing.Description
+	flag.UpdatedAt = time.Now()
+	flag = normalize(flag)
+	s.flags[flag.Name] = flag
+	return flag, nil
+}
+
+// Enabled reports whether the named flag is on for subject. Unknown flags
+// are off.
+func (s *Set) Enabled(name string, subject Subject) bool {
+	flag, err := s.Get(name)
+	if err != nil {
+		return false
+	}
+	return flag.EnabledFor(subject)
+}
+
+// Evaluate returns whether each flag is on for subject
+func (s *Set) Evaluate(subject Subject) map[string]bool {
+	result := make(map[string]bool)
+	for _, flag := range s.List() {
+		result[flag.Name] = flag.EnabledFor(subject)
+	}
+	return result
+}
+
+// EnabledFor reports whether the flag is on for subject
+func (f Flag) EnabledFor(subject Subject) bool {
+	if !f.Enabled {
+		return false
+	}
+	if f.Rollout >= 100 {
+		return true
+	}
+	if subject.UserID != "" && contains(f.Users, subject.UserID) {
+		return true
+	}
+	if subject.Tenant != "" && contains(f.Tenants, subject.Tenant) {
+		return true
+	}
+	return subject.UserID != "" && bucket(f.Name, subject.UserID) < f.Rollout
+}
+
+// bucket places a user in 0-99 for a flag. Hashing the flag name in keeps
+// the same users from always being first to get every feature.
+func bucket(flag, userID string) int {
+	sum := sha256.Sum256([]byte(flag + ":" + userID))
+	return int(binary.BigEndian.Uint32(sum[:4]) % 100)
+}
+
+// normalize replaces nil lists so flags always serialize them as arrays
+func normalize(flag Flag) Flag {
+	if flag.Users == nil {
+		flag.Users = []string{}
+	}
+	if flag.Tenants == nil {
+		flag.Tenants = []string{}
+	}
+	return flag
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
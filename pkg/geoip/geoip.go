@@ -0,0 +1,95 @@
+package geoip
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/netip"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// ErrNotFound is returned when an address has no location data
+var ErrNotFound = errors.New("location not found")
+
+// Location is the geographic information known for an address
+type Location struct {
+	// Country is the ISO 3166-1 alpha-2 country code
+	Country        string  `json:"country,omitempty"`
+	Latitude       float64 `json:"latitude,omitempty"`
+	Longitude      float64 `json:"longitude,omitempty"`
+	HasCoordinates bool    `json:"-"`
+}
+
+// Locator looks up the location of an IP address
+type Locator interface {
+	Lookup(addr netip.Addr) (Location, error)
+}
+
+// MaxMindLocator reads locations from a MaxMind GeoIP2/GeoLite2 database.
+// Country databases provide only the country; City databases also provide
+// coordinates.
+type MaxMindLocator struct {
+	reader *maxminddb.Reader
+}
+
+// OpenMaxMind opens a MaxMind .mmdb database file
+func OpenMaxMind(path string) (*MaxMindLocator, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MaxMindLocator{reader: reader}, nil
+}
+
+// Close releases the database
+func (l *MaxMindLocator) Close() error {
+	return l.reader.Close()
+}
+
+// Lookup returns the location recorded for addr
+func (l *MaxMindLocator) Lookup(addr netip.Addr) (Location, error) {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		Location struct {
+			Latitude  *float64 `maxminddb:"latitude"`
+			Longitude *float64 `maxminddb:"longitude"`
+		} `maxminddb:"location"`
+	}
+
+	if err := l.reader.Lookup(net.IP(addr.AsSlice()), &record); err != nil {
+		return Location{}, err
+	}
+
+	if record.Country.ISOCode == "" {
+		return Location{}, ErrNotFound
+	}
+
+	location := Location{Country: record.Country.ISOCode}
+	if record.Location.Latitude != nil && record.Location.Longitude != nil {
+		location.Latitude = *record.Location.Latitude
+		location.Longitude = *record.Location.Longitude
+		location.HasCoordinates = true
+	}
+	return location, nil
+}
+
+// earthRadiusKm is the mean radius of the Earth
+const earthRadiusKm = 6371.0
+
+// DistanceKm returns the great-circle distance between two locations using
+// the haversine formula
+func DistanceKm(a, b Location) float64 {
+	lat1, lat2 := radians(a.Latitude), radians(b.Latitude)
+	dLat := lat2 - lat1
+	dLon := radians(b.Longitude - a.Longitude)
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
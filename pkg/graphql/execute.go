@@ -0,0 +1,458 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"sort"
+)
+
+// Scalar types of arguments
+const (
+	String  = "String"
+	Int     = "Int"
+	Float   = "Float"
+	Boolean = "Boolean"
+)
+
+// Schema is the root types operations start from. A nil Mutation refuses
+// mutations.
+type Schema struct {
+	Query    *Object
+	Mutation *Object
+}
+
+// Object is an object type
+type Object struct {
+	Name   string
+	Fields map[string]*FieldDef
+}
+
+// FieldDef defines a field. Fields without a Type are scalars, serialized
+// as their resolved value with encoding/json. Every field is nullable: a
+// field whose resolver fails is null and the error is reported.
+type FieldDef struct {
+	Type *Object
+	// List fields resolve to a slice of Type
+	List bool
+	Args map[string]ArgDef
+	// Resolve returns the field's value; without it the field is looked up
+	// in a map[string]interface{} source by name
+	Resolve func(p ResolveParams) (interface{}, error)
+}
+
+// ArgDef defines an argument of one of the scalar types
+type ArgDef struct {
+	Type     string
+	Required bool
+}
+
+// ResolveParams are what a resolver is called with: the value of the
+// object the field is on, nil for root fields, and the field's arguments
+// coerced to string, int, float64 or bool
+type ResolveParams struct {
+	Context context.Context
+	Source  interface{}
+	Args    map[string]interface{}
+}
+
+// Limits bound what an operation may select. Depth counts nested fields,
+// top-level fields being at depth 1; complexity counts every field
+// selected, fragments expanded. A bound left zero takes its default, so
+// no operation runs unbounded.
+type Limits struct {
+	MaxDepth      int
+	MaxComplexity int
+}
+
+// Default limits
+const (
+	DefaultMaxDepth      = 10
+	DefaultMaxComplexity = 200
+)
+
+// Error is an error in a Result. Path locates the field that failed.
+type Error struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// Result is the response to a request. Data is absent when the request
+// failed before execution.
+type Result struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []Error     `json:"errors,omitempty"`
+}
+
+// ErrorResult returns the result of a request that could not be executed
+func ErrorResult(err error) *Result {
+	return &Result{Errors: []Error{{Message: err.Error()}}}
+}
+
+// Execute validates op from doc against the schema and, if it is valid,
+// runs it. Variables are coerced into the operation's declared variables.
+func (s *Schema) Execute(ctx context.Context, doc *Document, op *Operation, variables map[string]interface{}, limits Limits) *Result {
+	root := s.Query
+	if op.Type == Mutation {
+		root = s.Mutation
+	} else if op.Type != Query {
+		root = nil
+	}
+	if root == nil {
+		return ErrorResult(fmt.Errorf("%s operations are not supported", op.Type))
+	}
+
+	if limits.MaxDepth <= 0 {
+		limits.MaxDepth = DefaultMaxDepth
+	}
+	if limits.MaxComplexity <= 0 {
+		limits.MaxComplexity = DefaultMaxComplexity
+	}
+	e := &executor{ctx: ctx, doc: doc, limits: limits, args: make(map[*Field]map[string]interface{})}
+	var err error
+	if e.variables, err = coerceVariables(op, variables); err != nil {
+		return ErrorResult(err)
+	}
+	if err := e.validate(root, op.SelectionSet, 1, nil); err != nil {
+		return ErrorResult(err)
+	}
+	data := e.executeObject(root, nil, op.SelectionSet, nil)
+	return &Result{Data: data, Errors: e.errors}
+}
+
+// coerceVariables returns the values of op's variables: those provided,
+// or else their defaults
+func coerceVariables(op *Operation, provided map[string]interface{}) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(op.Variables))
+	for _, definition := range op.Variables {
+		value, ok := provided[definition.Name]
+		if !ok {
+			value = definition.Default
+		}
+		if value == nil && definition.Type.NonNull {
+			return nil, fmt.Errorf("variable $%s of type %s is required", definition.Name, definition.Type)
+		}
+		values[definition.Name] = value
+	}
+	return values, nil
+}
+
+// executor runs one operation
+type executor struct {
+	ctx        context.Context
+	doc        *Document
+	limits     Limits
+	variables  map[string]interface{}
+	args       map[*Field]map[string]interface{}
+	complexity int
+	errors     []Error
+}
+
+// validate checks a selection set on obj at depth, coercing the arguments
+// of its fields and enforcing the limits as it goes, so a document that
+// expands to a huge selection is refused without being walked in full.
+// spreading are the fragments being expanded, to catch cycles.
+func (e *executor) validate(obj *Object, set []Selection, depth int, spreading []string) error {
+	for _, selection := range set {
+		switch selection := selection.(type) {
+		case *Field:
+			if depth > e.limits.MaxDepth {
+				return fmt.Errorf("the query is deeper than the maximum depth of %d", e.limits.MaxDepth)
+			}
+			e.complexity++
+			if e.complexity > e.limits.MaxComplexity {
+				return fmt.Errorf("the query is more complex than the maximum of %d fields", e.limits.MaxComplexity)
+			}
+
+			if selection.Name == "__typename" {
+				if len(selection.Arguments) > 0 || len(selection.SelectionSet) > 0 {
+					return fmt.Errorf("field __typename takes no arguments or subfields")
+				}
+				continue
+			}
+			def, ok := obj.Fields[selection.Name]
+			if !ok {
+				return fmt.Errorf("cannot query field %q on type %s", selection.Name, obj.Name)
+			}
+			args, err := e.coerceArgs(selection, def)
+			if err != nil {
+				return err
+			}
+			e.args[selection] = args
+
+			switch {
+			case def.Type == nil && len(selection.SelectionSet) > 0:
+				return fmt.Errorf("field %q on type %s has no subfields", selection.Name, obj.Name)
+			case def.Type != nil && len(selection.SelectionSet) == 0:
+				return fmt.Errorf("field %q on type %s needs a selection of subfields", selection.Name, obj.Name)
+			case def.Type != nil:
+				if err := e.validate(def.Type, selection.SelectionSet, depth+1, spreading); err != nil {
+					return err
+				}
+			}
+		case *FragmentSpread:
+			fragment, ok := e.doc.Fragments[selection.Name]
+			if !ok {
+				return fmt.Errorf("unknown fragment %q", selection.Name)
+			}
+			if slices.Contains(spreading, selection.Name) {
+				return fmt.Errorf("fragment %q spreads itself", selection.Name)
+			}
+			if fragment.TypeCondition != obj.Name {
+				return fmt.Errorf("fragment %q on %s cannot be spread on %s", selection.Name, fragment.TypeCondition, obj.Name)
+			}
+			if err := e.validate(obj, fragment.SelectionSet, depth, append(spreading, selection.Name)); err != nil {
+				return err
+			}
+		case *InlineFragment:
+			if selection.TypeCondition != "" && selection.TypeCondition != obj.Name {
+				return fmt.Errorf("a fragment on %s cannot be spread on %s", selection.TypeCondition, obj.Name)
+			}
+			if err := e.validate(obj, selection.SelectionSet, depth, spreading); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// coerceArgs returns field's arguments with variables substituted, checked
+// against def
+func (e *executor) coerceArgs(field *Field, def *FieldDef) (map[string]interface{}, error) {
+	args := make(map[string]interface{}, len(field.Arguments))
+	for _, argument := range field.Arguments {
+		argDef, ok := def.Args[argument.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown argument %q on field %q", argument.Name, field.Name)
+		}
+		value := argument.Value
+		if variable, ok := value.(Variable); ok {
+			if value, ok = e.variables[variable.Name]; !ok {
+				return nil, fmt.Errorf("variable $%s is not defined", variable.Name)
+			}
+		}
+		if value == nil {
+			continue
+		}
+		coerced, err := coerceScalar(argDef.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("argument %q of field %q: %v", argument.Name, field.Name, err)
+		}
+		args[argument.Name] = coerced
+	}
+
+	names := make([]string, 0, len(def.Args))
+	for name := range def.Args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := args[name]; !ok && def.Args[name].Required {
+			return nil, fmt.Errorf("field %q requires argument %q", field.Name, name)
+		}
+	}
+	return args, nil
+}
+
+// coerceScalar converts value to the Go type of a scalar type. Integers
+// arrive as float64 in JSON variables.
+func coerceScalar(typ string, value interface{}) (interface{}, error) {
+	switch typ {
+	case String:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case Int:
+		switch n := value.(type) {
+		case int:
+			return n, nil
+		case float64:
+			if n == math.Trunc(n) && n >= math.MinInt32 && n <= math.MaxInt32 {
+				return int(n), nil
+			}
+		}
+	case Float:
+		switch n := value.(type) {
+		case int:
+			return float64(n), nil
+		case float64:
+			return n, nil
+		}
+	case Boolean:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type %s", typ)
+	}
+	return nil, fmt.Errorf("expected a value of type %s", typ)
+}
+
+// fieldGroup is the fields of a selection set answering under one key,
+// which fragments may select more than once
+type fieldGroup struct {
+	key    string
+	fields []*Field
+}
+
+// collect groups the fields set selects by response key, in order
+func (e *executor) collect(set []Selection, groups []*fieldGroup) []*fieldGroup {
+	for _, selection := range set {
+		switch selection := selection.(type) {
+		case *Field:
+			key := selection.Alias
+			if key == "" {
+				key = selection.Name
+			}
+			found := false
+			for _, group := range groups {
+				if group.key == key {
+					group.fields = append(group.fields, selection)
+					found = true
+					break
+				}
+			}
+			if !found {
+				groups = append(groups, &fieldGroup{key: key, fields: []*Field{selection}})
+			}
+		case *FragmentSpread:
+			groups = e.collect(e.doc.Fragments[selection.Name].SelectionSet, groups)
+		case *InlineFragment:
+			groups = e.collect(selection.SelectionSet, groups)
+		}
+	}
+	return groups
+}
+
+// fail records a field error
+func (e *executor) fail(path []interface{}, err error) {
+	e.errors = append(e.errors, Error{Message: err.Error(), Path: path})
+}
+
+// executeObject resolves the fields set selects on source, of type obj
+func (e *executor) executeObject(obj *Object, source interface{}, set []Selection, path []interface{}) *resultMap {
+	result := &resultMap{values: make(map[string]interface{})}
+	for _, group := range e.collect(set, nil) {
+		field := group.fields[0]
+		fieldPath := append(slices.Clone(path), group.key)
+		if field.Name == "__typename" {
+			result.set(group.key, obj.Name)
+			continue
+		}
+
+		var subset []Selection
+		conflict := false
+		for _, other := range group.fields {
+			conflict = conflict || other.Name != field.Name
+			subset = append(subset, other.SelectionSet...)
+		}
+		if conflict {
+			e.fail(fieldPath, fmt.Errorf("several fields answer as %q", group.key))
+			result.set(group.key, nil)
+			continue
+		}
+
+		def := obj.Fields[field.Name]
+		value, err := e.resolve(def, source, field)
+		if err != nil {
+			e.fail(fieldPath, err)
+			result.set(group.key, nil)
+			continue
+		}
+		result.set(group.key, e.complete(def, value, subset, fieldPath))
+	}
+	return result
+}
+
+// resolve returns the value of field on source
+func (e *executor) resolve(def *FieldDef, source interface{}, field *Field) (interface{}, error) {
+	if def.Resolve == nil {
+		if values, ok := source.(map[string]interface{}); ok {
+			return values[field.Name], nil
+		}
+		return nil, nil
+	}
+	return def.Resolve(ResolveParams{Context: e.ctx, Source: source, Args: e.args[field]})
+}
+
+// complete turns a resolved value into its result: the value itself for
+// scalars, and the selected fields for objects
+func (e *executor) complete(def *FieldDef, value interface{}, set []Selection, path []interface{}) interface{} {
+	if isNil(value) {
+		return nil
+	}
+	if !def.List {
+		return e.completeItem(def.Type, value, set, path)
+	}
+
+	list := reflect.ValueOf(value)
+	if list.Kind() != reflect.Slice && list.Kind() != reflect.Array {
+		e.fail(path, fmt.Errorf("expected a list"))
+		return nil
+	}
+	items := make([]interface{}, list.Len())
+	for i := range items {
+		items[i] = e.completeItem(def.Type, list.Index(i).Interface(), set, append(slices.Clone(path), i))
+	}
+	return items
+}
+
+func (e *executor) completeItem(obj *Object, value interface{}, set []Selection, path []interface{}) interface{} {
+	if obj == nil || isNil(value) {
+		return value
+	}
+	return e.executeObject(obj, value, set, path)
+}
+
+// isNil reports whether value is nil or a nil pointer, map or slice
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	switch v := reflect.ValueOf(value); v.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// resultMap is an object in a result, which keeps its fields in the order
+// they were selected
+type resultMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (m *resultMap) set(key string, value interface{}) {
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+func (m *resultMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(m.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,216 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testSchema has a user with a list of friends, who are users, so
+// queries can nest as deep as they like
+func testSchema() *Schema {
+	user := &Object{Name: "User", Fields: map[string]*FieldDef{
+		"name": {},
+		"age":  {},
+	}}
+	user.Fields["friends"] = &FieldDef{Type: user, List: true}
+	user.Fields["greeting"] = &FieldDef{
+		Args: map[string]ArgDef{"prefix": {Type: String, Required: true}, "times": {Type: Int}},
+		Resolve: func(p ResolveParams) (interface{}, error) {
+			times := 1
+			if n, ok := p.Args["times"].(int); ok {
+				times = n
+			}
+			return strings.Repeat(p.Args["prefix"].(string), times) + p.Source.(map[string]interface{})["name"].(string), nil
+		},
+	}
+	user.Fields["secret"] = &FieldDef{Resolve: func(ResolveParams) (interface{}, error) {
+		return nil, errors.New("not allowed")
+	}}
+
+	bob := map[string]interface{}{"name": "bob", "age": 41}
+	alice := map[string]interface{}{"name": "alice", "age": 37, "friends": []interface{}{bob}}
+	bob["friends"] = []interface{}{alice}
+
+	return &Schema{
+		Query: &Object{Name: "Query", Fields: map[string]*FieldDef{
+			"user": {
+				Type: user,
+				Args: map[string]ArgDef{"name": {Type: String, Required: true}},
+				Resolve: func(p ResolveParams) (interface{}, error) {
+					switch p.Args["name"] {
+					case "alice":
+						return alice, nil
+					case "bob":
+						return bob, nil
+					}
+					return nil, nil
+				},
+			},
+		}},
+	}
+}
+
+// run parses and executes query, returning its result as JSON
+func run(t *testing.T, query string, variables map[string]interface{}, limits Limits) string {
+	t.Helper()
+	doc, err := Parse(query)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	op, err := doc.Operation("")
+	if err != nil {
+		t.Fatalf("Operation: %v", err)
+	}
+	b, err := json.Marshal(testSchema().Execute(context.Background(), doc, op, variables, limits))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		want      string
+	}{
+		{
+			"fields in the order selected",
+			`{ user(name: "alice") { name age __typename } }`, nil,
+			`{"data":{"user":{"name":"alice","age":37,"__typename":"User"}}}`,
+		},
+		{
+			"aliases and lists",
+			`{ a: user(name: "alice") { friends { name } } b: user(name: "bob") { n: name } }`, nil,
+			`{"data":{"a":{"friends":[{"name":"bob"}]},"b":{"n":"bob"}}}`,
+		},
+		{
+			"fragments merged into the fields they spread on",
+			`query { user(name: "alice") { name ...F ... on User { friends { age } } } } fragment F on User { friends { name } }`, nil,
+			`{"data":{"user":{"name":"alice","friends":[{"name":"bob","age":41}]}}}`,
+		},
+		{
+			"arguments from variables and defaults",
+			`query($who: String!, $times: Int = 2) { user(name: $who) { greeting(prefix: "hi ", times: $times) } }`,
+			map[string]interface{}{"who": "bob"},
+			`{"data":{"user":{"greeting":"hi hi bob"}}}`,
+		},
+		{
+			"a null object",
+			`{ user(name: "carol") { name } }`, nil,
+			`{"data":{"user":null}}`,
+		},
+		{
+			"a failed field is null with its path",
+			`{ user(name: "alice") { friends { secret } } }`, nil,
+			`{"data":{"user":{"friends":[{"secret":null}]}},"errors":[{"message":"not allowed","path":["user","friends",0,"secret"]}]}`,
+		},
+		{
+			"conflicting fields under one name",
+			`{ user(name: "alice") { x: name x: age } }`, nil,
+			`{"data":{"user":{"x":null}},"errors":[{"message":"several fields answer as \"x\"","path":["user","x"]}]}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := run(t, test.query, test.variables, Limits{}); got != test.want {
+				t.Errorf("got  %s\nwant %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExecuteInvalid(t *testing.T) {
+	tests := []struct {
+		query     string
+		variables map[string]interface{}
+		want      string
+	}{
+		{`{ nobody }`, nil, `cannot query field \"nobody\" on type Query`},
+		{`{ user(name: "alice") }`, nil, `needs a selection of subfields`},
+		{`{ user(name: "alice") { name { first } } }`, nil, `has no subfields`},
+		{`{ user { name } }`, nil, `requires argument \"name\"`},
+		{`{ user(name: 1) { name } }`, nil, `expected a value of type String`},
+		{`{ user(name: "a", nick: "b") { name } }`, nil, `unknown argument \"nick\"`},
+		{`{ user(name: $who) { name } }`, nil, `variable $who is not defined`},
+		{`query($who: String!) { user(name: $who) { name } }`, nil, `variable $who of type String! is required`},
+		{`{ user(name: "alice") { ...F } } fragment F on User { friends { ...F } }`, nil, `fragment \"F\" spreads itself`},
+		{`{ user(name: "alice") { ...F } } fragment F on Query { user(name: "bob") { name } }`, nil, `cannot be spread on User`},
+		{`{ user(name: "alice") { ...G } }`, nil, `unknown fragment \"G\"`},
+		{`mutation { user(name: "alice") { name } }`, nil, `mutation operations are not supported`},
+	}
+	for _, test := range tests {
+		got := run(t, test.query, test.variables, Limits{})
+		if !strings.Contains(got, test.want) || strings.Contains(got, `"data"`) {
+			t.Errorf("%s: got %s, want the error %s", test.query, got, test.want)
+		}
+	}
+}
+
+// friends nests the friends field levels times below user, so the query
+// has a depth of levels+2 and selects as many fields
+func friends(levels int) string {
+	return `{ user(name: "alice") { ` + strings.Repeat(`friends { `, levels) + `name` + strings.Repeat(` }`, levels) + ` } }`
+}
+
+func TestExecuteLimits(t *testing.T) {
+	limits := Limits{MaxDepth: 4, MaxComplexity: 6}
+	if got := run(t, friends(2), nil, limits); strings.Contains(got, "errors") {
+		t.Errorf("depth 4: %s", got)
+	}
+	if got := run(t, friends(3), nil, limits); !strings.Contains(got, "deeper than the maximum depth of 4") {
+		t.Errorf("depth 5: %s", got)
+	}
+
+	// Complexity counts every field, those of fragments each time they
+	// are spread and the same field under several aliases
+	wide := `{ user(name: "alice") { a: name b: name c: name d: name e: name } }`
+	if got := run(t, wide, nil, limits); strings.Contains(got, "errors") {
+		t.Errorf("6 fields: %s", got)
+	}
+	wide = `{ user(name: "alice") { a: name b: name c: name d: name e: name f: name } }`
+	if got := run(t, wide, nil, limits); !strings.Contains(got, "more complex than the maximum of 6 fields") {
+		t.Errorf("7 fields: %s", got)
+	}
+	spread := `{ user(name: "alice") { ...F ...F ...F } } fragment F on User { name age }`
+	if got := run(t, spread, nil, limits); !strings.Contains(got, "more complex") {
+		t.Errorf("7 fields through fragments: %s", got)
+	}
+
+	// Fragments that each spread the next twice select 2^19 fields; the
+	// limit stops validation long before it would walk them all
+	var doc strings.Builder
+	doc.WriteString(`{ user(name: "alice") { ...F0 } }`)
+	for i := 0; i < 20; i++ {
+		next := "name"
+		if i < 19 {
+			next = "...F" + string(rune('A'+i)) + " ...F" + string(rune('A'+i))
+		}
+		name := "F0"
+		if i > 0 {
+			name = "F" + string(rune('A'+i-1))
+		}
+		doc.WriteString(" fragment " + name + " on User { " + next + " }")
+	}
+	if got := run(t, doc.String(), nil, limits); !strings.Contains(got, "more complex") {
+		t.Errorf("2^19 fields through fragments: %s", got)
+	}
+}
+
+func TestExecuteDefaultLimits(t *testing.T) {
+	if got := run(t, friends(DefaultMaxDepth-2), nil, Limits{}); strings.Contains(got, "errors") {
+		t.Errorf("depth %d: %s", DefaultMaxDepth, got)
+	}
+	if got := run(t, friends(DefaultMaxDepth-1), nil, Limits{}); !strings.Contains(got, "deeper than the maximum depth") {
+		t.Errorf("depth %d without limits: %s", DefaultMaxDepth+1, got)
+	}
+
+	wide := `{ user(name: "alice") { ` + strings.Repeat("name ", DefaultMaxComplexity) + `} }`
+	if got := run(t, wide, nil, Limits{MaxDepth: 3}); !strings.Contains(got, "more complex than the maximum") {
+		t.Errorf("%d fields without a complexity limit: %s", DefaultMaxComplexity+1, got)
+	}
+}
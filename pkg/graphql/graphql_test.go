@@ -0,0 +1,151 @@
+package graphql
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	doc, err := Parse(`
+		# Comments and commas are ignored
+		query Profile($name: String!, $ids: [Int!] = [1, 2]) {
+			me: profile(username: $name, filter: {kind: ADMIN, tags: ["a", "b"]}, limit: 10, ratio: 1.5, on: true) {
+				username,
+				...Fields
+				... on Profile { bio }
+			}
+		}
+		mutation { login(username: "alice", password: """block
+			string""") { token } }
+		fragment Fields on Profile { displayName }
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Operations) != 2 || len(doc.Fragments) != 1 {
+		t.Fatalf("got %d operations and %d fragments", len(doc.Operations), len(doc.Fragments))
+	}
+
+	query := doc.Operations[0]
+	if query.Type != Query || query.Name != "Profile" {
+		t.Errorf("first operation is %s %q", query.Type, query.Name)
+	}
+	if len(query.Variables) != 2 || query.Variables[0].Type.String() != "String!" || query.Variables[1].Type.String() != "[Int!]" {
+		t.Errorf("variables = %+v", query.Variables)
+	}
+	if want := []interface{}{1, 2}; !reflect.DeepEqual(query.Variables[1].Default, want) {
+		t.Errorf("default = %#v, want %#v", query.Variables[1].Default, want)
+	}
+
+	field := query.SelectionSet[0].(*Field)
+	if field.Alias != "me" || field.Name != "profile" {
+		t.Errorf("field is %q aliased %q", field.Name, field.Alias)
+	}
+	args := map[string]interface{}{}
+	for _, argument := range field.Arguments {
+		args[argument.Name] = argument.Value
+	}
+	want := map[string]interface{}{
+		"username": Variable{Name: "name"},
+		"filter":   map[string]interface{}{"kind": EnumValue("ADMIN"), "tags": []interface{}{"a", "b"}},
+		"limit":    10,
+		"ratio":    1.5,
+		"on":       true,
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("arguments = %#v, want %#v", args, want)
+	}
+	if len(field.SelectionSet) != 3 {
+		t.Fatalf("got %d selections", len(field.SelectionSet))
+	}
+	if spread, ok := field.SelectionSet[1].(*FragmentSpread); !ok || spread.Name != "Fields" {
+		t.Errorf("second selection = %#v", field.SelectionSet[1])
+	}
+	if inline, ok := field.SelectionSet[2].(*InlineFragment); !ok || inline.TypeCondition != "Profile" {
+		t.Errorf("third selection = %#v", field.SelectionSet[2])
+	}
+
+	mutation := doc.Operations[1]
+	login := mutation.SelectionSet[0].(*Field)
+	if mutation.Type != Mutation || login.Arguments[1].Value != "block\nstring" {
+		t.Errorf("mutation %s has password %q", mutation.Type, login.Arguments[1].Value)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{``, "no operations"},
+		{`{}`, "empty selection set"},
+		{`{ a `, "unexpected end of document"},
+		{`{ a(b: $c) }`, ""},
+		{`query($a: Int = $b) { a }`, "unexpected"},
+		{`{ a @include(if: true) }`, "directives are not supported"},
+		{`{ a(b: "unterminated) }`, "unterminated string"},
+		{`{ a(b: 99999999999999999999) }`, "out of range"},
+		{`fragment on on T { a } { a }`, "cannot be named"},
+		{`fragment F on T { a } fragment F on T { b } { ...F }`, "defined more than once"},
+		{"{ a }\n}", "line 2, column 1"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.query)
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("%q: %v", test.query, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got %v, want an error containing %q", test.query, err, test.want)
+		}
+	}
+}
+
+func TestParseNesting(t *testing.T) {
+	nested := func(open, close string, levels int) string {
+		return strings.Repeat(open, levels) + strings.Repeat(close, levels)
+	}
+	fields := func(levels int) string {
+		return "{" + strings.Repeat("a {", levels-1) + "b" + strings.Repeat("}", levels)
+	}
+	tests := []string{
+		fields(maxNesting + 1),
+		"{ a(b: " + nested("[", "]", maxNesting+1) + ") }",
+		"{ a(b: " + nested("{c: ", "}", maxNesting+1) + "0) }",
+		"query($a: " + nested("[", "]", maxNesting+1) + "Int) { a }",
+	}
+	for _, query := range tests {
+		if _, err := Parse(query); err == nil || !strings.Contains(err.Error(), "nested more than") {
+			t.Errorf("%.30q...: got %v", query, err)
+		}
+	}
+
+	// Far more than any real query, yet within the bound
+	if _, err := Parse(fields(maxNesting)); err != nil {
+		t.Errorf("nesting of %d: %v", maxNesting, err)
+	}
+	// A huge document of opening braces fails quickly rather than
+	// recursing through all of it
+	if _, err := Parse(strings.Repeat("{", 1<<20)); err == nil {
+		t.Error("a megabyte of braces parsed")
+	}
+}
+
+func TestDocumentOperation(t *testing.T) {
+	doc, err := Parse(`query A { a } query B { b }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op, err := doc.Operation("B"); err != nil || op.Name != "B" {
+		t.Errorf("Operation(B) = %+v, %v", op, err)
+	}
+	if _, err := doc.Operation(""); err == nil {
+		t.Error("an unnamed operation was picked from two")
+	}
+	if _, err := doc.Operation("C"); err == nil {
+		t.Error("an unknown operation was found")
+	}
+}
@@ -0,0 +1,242 @@
+// Package i18n translates user-facing messages and renders localized email
+// templates. Catalogs are keyed by the English source text, so a message
+// without a translation falls back to English.
+package i18n
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// DefaultLocale is used when nothing better can be negotiated
+const DefaultLocale = "en"
+
+//go:embed locales/*.json emails/*/*.tmpl
+var files embed.FS
+
+// Bundle holds the message catalogs and email templates for every
+// supported locale
+type Bundle struct {
+	catalogs map[string]map[string]string
+	emails   map[string]map[string]*template.Template // locale -> email name
+}
+
+var defaultBundle = mustLoad()
+
+// Default returns the bundle built from the embedded catalogs
+func Default() *Bundle {
+	return defaultBundle
+}
+
+func mustLoad() *Bundle {
+	b, err := load()
+	if err != nil {
+		panic(fmt.Sprintf("i18n: %v", err))
+	}
+	return b
+}
+
+func load() (*Bundle, error) {
+	b := &Bundle{
+		catalogs: map[string]map[string]string{DefaultLocale: {}},
+		emails:   make(map[string]map[string]*template.Template),
+	}
+
+	catalogFiles, err := files.ReadDir("locales")
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range catalogFiles {
+		data, err := files.ReadFile(path.Join("locales", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		catalog := make(map[string]string)
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", entry.Name(), err)
+		}
+		b.catalogs[strings.TrimSuffix(entry.Name(), ".json")] = catalog
+	}
+
+	emailDirs, err := files.ReadDir("emails")
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range emailDirs {
+		locale := dir.Name()
+		templates, err := files.ReadDir(path.Join("emails", locale))
+		if err != nil {
+			return nil, err
+		}
+		b.emails[locale] = make(map[string]*template.Template)
+		for _, entry := range templates {
+			name := path.Join("emails", locale, entry.Name())
+			tmpl, err := template.ParseFS(files, name)
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", name, err)
+			}
+			b.emails[locale][strings.TrimSuffix(entry.Name(), ".tmpl")] = tmpl
+		}
+	}
+	if b.emails[DefaultLocale] == nil {
+		return nil, fmt.Errorf("missing %s email templates", DefaultLocale)
+	}
+	return b, nil
+}
+
+// Locales returns the supported locale codes in sorted order
+func (b *Bundle) Locales() []string {
+	locales := make([]string, 0, len(b.catalogs))
+	for locale := range b.catalogs {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Supports reports whether locale has a catalog
+func (b *Bundle) Supports(locale string) bool {
+	_, ok := b.catalogs[locale]
+	return ok
+}
+
+// T returns the translation of msg for locale, or msg itself when there is
+// none
+func (b *Bundle) T(locale, msg string) string {
+	if translated, ok := b.catalogs[locale][msg]; ok && translated != "" {
+		return translated
+	}
+	return msg
+}
+
+// Sprintf translates format for locale and then formats it with args.
+// Translations may reorder arguments with explicit indexes such as %[2]s.
+func (b *Bundle) Sprintf(locale, format string, args ...interface{}) string {
+	return fmt.Sprintf(b.T(locale, format), args...)
+}
+
+// Negotiate picks the best supported locale for an Accept-Language header,
+// matching a region tag such as "es-MX" to its base language. It returns
+// DefaultLocale when nothing matches.
+func (b *Bundle) Negotiate(acceptLanguage string) string {
+	type candidate struct {
+		tag     string
+		quality float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		if tag == "" || quality <= 0 {
+			continue
+		}
+		candidates = append(candidates, candidate{tag: strings.ToLower(tag), quality: quality})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].quality > candidates[j].quality })
+
+	for _, c := range candidates {
+		if b.Supports(c.tag) {
+			return c.tag
+		}
+		base, _, _ := strings.Cut(c.tag, "-")
+		if b.Supports(base) {
+			return base
+		}
+	}
+	return DefaultLocale
+}
+
+// Email renders the named email template for locale, falling back to
+// English when the locale has no version of it. Each template file defines
+// "subject" and "body".
+func (b *Bundle) Email(locale, name string, data interface{}) (subject, body string, err error) {
+	tmpl := b.emails[locale][name]
+	if tmpl == nil {
+		tmpl = b.emails[DefaultLocale][name]
+	}
+	if tmpl == nil {
+		return "", "", fmt.Errorf("unknown email template %q", name)
+	}
+	return RenderEmail(tmpl, data)
+}
+
+// HasEmail reports whether locale has its own version of the named email
+// template
+func (b *Bundle) HasEmail(locale, name string) bool {
+	return b.emails[locale][name] != nil
+}
+
+// EmailNames returns the names of the email templates in sorted order
+func (b *Bundle) EmailNames() []string {
+	names := make([]string, 0, len(b.emails[DefaultLocale]))
+	for name := range b.emails[DefaultLocale] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EmailSource returns the text of the named email template that Email
+// uses for locale
+func (b *Bundle) EmailSource(locale, name string) (string, bool) {
+	if !b.HasEmail(locale, name) {
+		locale = DefaultLocale
+	}
+	data, err := files.ReadFile(path.Join("emails", locale, name+".tmpl"))
+	return string(data), err == nil
+}
+
+// ParseEmail parses an email template, which must define "subject" and
+// "body". When sample is given the template is also rendered with it, and
+// fails if it uses a field the sample does not have.
+func ParseEmail(name, text string, sample interface{}) (*template.Template, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range []string{"subject", "body"} {
+		if tmpl.Lookup(part) == nil {
+			return nil, fmt.Errorf("template %s does not define %q", name, part)
+		}
+	}
+	if sample != nil {
+		strict, err := tmpl.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if _, _, err := RenderEmail(strict.Option("missingkey=error"), sample); err != nil {
+			return nil, err
+		}
+	}
+	return tmpl, nil
+}
+
+// RenderEmail renders the subject and body of an email template
+func RenderEmail(tmpl *template.Template, data interface{}) (subject, body string, err error) {
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return "", "", err
+	}
+	subject = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	if err := tmpl.ExecuteTemplate(&buf, "body", data); err != nil {
+		return "", "", err
+	}
+	return subject, strings.TrimLeft(buf.String(), "\n"), nil
+}
@@ -0,0 +1,165 @@
+package ids
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"auth-server/pkg/randutil"
+)
+
+// Type prefixes for identifiers, so an ID's kind is obvious in logs and URLs
+const (
+	PrefixUser           = "usr"
+	PrefixSession        = "sess"
+	PrefixEvent          = "evt"
+	PrefixClient         = "cli"
+	PrefixToken          = "tok"
+	PrefixIdentity       = "idn"
+	PrefixMessage        = "msg"
+	PrefixDelivery       = "dlv"
+	PrefixServiceAccount = "svc"
+	PrefixKey            = "key"
+	PrefixConnection     = "con"
+	PrefixDevice         = "dev"
+)
+
+// crockford is the Crockford base32 alphabet used by ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidLength is the length of the encoded ULID part of an ID
+const ulidLength = 26
+
+// ErrInvalidID is returned when a string is not a recognised identifier
+var ErrInvalidID = errors.New("invalid identifier")
+
+// ID is a parsed identifier
+type ID struct {
+	Prefix string
+	// Time is when the ID was generated; zero for legacy IDs
+	Time time.Time
+	// Legacy is true for IDs issued before prefixed ULIDs were introduced
+	Legacy bool
+}
+
+// generator produces monotonic ULIDs: IDs created within the same
+// millisecond increment the random component so they still sort in order
+type generator struct {
+	mutex    sync.Mutex
+	lastTime uint64
+	lastRand [10]byte
+}
+
+var defaultGenerator = &generator{}
+
+// New returns a new identifier of the form <prefix>_<ULID>. IDs sort
+// lexically in creation order.
+func New(prefix string) (string, error) {
+	ulid, err := defaultGenerator.next(time.Now())
+	if err != nil {
+		return "", err
+	}
+	return prefix + "_" + ulid, nil
+}
+
+// Parse parses an identifier produced by New. Legacy 32-character hex IDs
+// are accepted with an empty prefix and Legacy set.
+func Parse(id string) (ID, error) {
+	if isLegacy(id) {
+		return ID{Legacy: true}, nil
+	}
+
+	prefix, ulid, found := strings.Cut(id, "_")
+	if !found || prefix == "" || len(ulid) != ulidLength {
+		return ID{}, ErrInvalidID
+	}
+
+	// The first 10 characters hold the 48-bit millisecond timestamp; the
+	// leading character may only use its low 3 bits
+	if strings.IndexByte(crockford[:8], ulid[0]) < 0 {
+		return ID{}, ErrInvalidID
+	}
+
+	var ms uint64
+	for i := 0; i < ulidLength; i++ {
+		v := strings.IndexByte(crockford, ulid[i])
+		if v < 0 {
+			return ID{}, ErrInvalidID
+		}
+		if i < 10 {
+			ms = ms<<5 | uint64(v)
+		}
+	}
+
+	return ID{Prefix: prefix, Time: time.UnixMilli(int64(ms)).UTC()}, nil
+}
+
+// HasPrefix reports whether id is a well-formed identifier with the given prefix
+func HasPrefix(id, prefix string) bool {
+	parsed, err := Parse(id)
+	return err == nil && parsed.Prefix == prefix
+}
+
+func isLegacy(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (g *generator) next(now time.Time) (string, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	ms := uint64(now.UnixMilli())
+	if ms <= g.lastTime {
+		// Same millisecond (or clock went backwards): bump the random part
+		ms = g.lastTime
+		if !increment(g.lastRand[:]) {
+			return "", errors.New("identifier space exhausted for this millisecond")
+		}
+	} else {
+		random, err := randutil.Bytes(len(g.lastRand))
+		if err != nil {
+			return "", err
+		}
+		copy(g.lastRand[:], random)
+		g.lastTime = ms
+	}
+
+	var raw [16]byte
+	binary.BigEndian.PutUint16(raw[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(raw[2:6], uint32(ms))
+	copy(raw[6:], g.lastRand[:])
+
+	return encode(raw), nil
+}
+
+// increment adds one to a big-endian byte slice, reporting false on overflow
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encode renders 128 bits as 26 Crockford base32 characters
+func encode(raw [16]byte) string {
+	hi := binary.BigEndian.Uint64(raw[0:8])
+	lo := binary.BigEndian.Uint64(raw[8:16])
+
+	out := make([]byte, ulidLength)
+	for i := ulidLength - 1; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
@@ -0,0 +1,143 @@
+package ids
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	for _, prefix := range []string{PrefixUser, PrefixSession, PrefixDevice} {
+		before := time.Now().Truncate(time.Millisecond)
+		id, err := New(prefix)
+		after := time.Now()
+		if err != nil {
+			t.Fatalf("New(%q): %v", prefix, err)
+		}
+		if !strings.HasPrefix(id, prefix+"_") || len(id) != len(prefix)+1+ulidLength {
+			t.Errorf("New(%q) = %q, want %s_ and %d characters", prefix, id, prefix, ulidLength)
+		}
+		parsed, err := Parse(id)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", id, err)
+		}
+		if parsed.Prefix != prefix || parsed.Legacy {
+			t.Errorf("Parse(%q) = %+v, want prefix %s", id, parsed, prefix)
+		}
+		if parsed.Time.Before(before) || parsed.Time.After(after) {
+			t.Errorf("Parse(%q).Time = %s, want between %s and %s", id, parsed.Time, before, after)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		id   string
+		want ID
+		err  error
+	}{
+		// The example of the ULID specification
+		{id: "usr_01ARZ3NDEKTSV4RRFFQ69G5FAV", want: ID{Prefix: "usr", Time: time.UnixMilli(1469922850259).UTC()}},
+		{id: "sess_00000000000000000000000000", want: ID{Prefix: "sess", Time: time.UnixMilli(0).UTC()}},
+		// The largest timestamp 48 bits hold
+		{id: "evt_7ZZZZZZZZZZZZZZZZZZZZZZZZZ", want: ID{Prefix: "evt", Time: time.UnixMilli(1<<48 - 1).UTC()}},
+		{id: "0123456789abcdef0123456789abcdef", want: ID{Legacy: true}},
+		{id: "0123456789ABCDEF0123456789ABCDEF", want: ID{Legacy: true}},
+
+		{id: "", err: ErrInvalidID},
+		{id: "usr", err: ErrInvalidID},
+		{id: "usr_", err: ErrInvalidID},
+		{id: "_01ARZ3NDEKTSV4RRFFQ69G5FAV", err: ErrInvalidID},
+		{id: "01ARZ3NDEKTSV4RRFFQ69G5FAV", err: ErrInvalidID},
+		{id: "usr_01ARZ3NDEKTSV4RRFFQ69G5FA", err: ErrInvalidID},
+		{id: "usr_01ARZ3NDEKTSV4RRFFQ69G5FAVX", err: ErrInvalidID},
+		{id: "usr_81ARZ3NDEKTSV4RRFFQ69G5FAV", err: ErrInvalidID},
+		{id: "usr_01ARZ3NDEKTSV4RRFFQ69G5FAU", err: ErrInvalidID},
+		{id: "usr_01arz3ndektsv4rrffq69g5fav", err: ErrInvalidID},
+		{id: "0123456789abcdef0123456789abcde", err: ErrInvalidID},
+		{id: "0123456789abcdef0123456789abcdeg", err: ErrInvalidID},
+	}
+	for _, test := range tests {
+		got, err := Parse(test.id)
+		if err != test.err {
+			t.Errorf("Parse(%q) error = %v, want %v", test.id, err, test.err)
+			continue
+		}
+		if got.Prefix != test.want.Prefix || !got.Time.Equal(test.want.Time) || got.Legacy != test.want.Legacy {
+			t.Errorf("Parse(%q) = %+v, want %+v", test.id, got, test.want)
+		}
+	}
+}
+
+func TestHasPrefix(t *testing.T) {
+	tests := []struct {
+		id     string
+		prefix string
+		want   bool
+	}{
+		{"usr_01ARZ3NDEKTSV4RRFFQ69G5FAV", PrefixUser, true},
+		{"usr_01ARZ3NDEKTSV4RRFFQ69G5FAV", PrefixSession, false},
+		{"usr_01ARZ3NDEKTSV4RRFFQ69G5FAV", "us", false},
+		{"usr_01ARZ3NDEKTSV4RRFFQ69G5FA", PrefixUser, false},
+		{"usr_not-a-ulid", PrefixUser, false},
+		// Legacy IDs carry no prefix
+		{"0123456789abcdef0123456789abcdef", PrefixUser, false},
+		{"0123456789abcdef0123456789abcdef", "", true},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		if got := HasPrefix(test.id, test.prefix); got != test.want {
+			t.Errorf("HasPrefix(%q, %q) = %v, want %v", test.id, test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestGeneratorMonotonic(t *testing.T) {
+	g := &generator{}
+	now := time.UnixMilli(1469922850259)
+
+	// Within one millisecond, and when the clock goes backwards, the
+	// random part is incremented and the time is kept
+	previous := ""
+	for i, at := range []time.Time{now, now, now.Add(time.Microsecond), now.Add(-time.Second), now} {
+		ulid, err := g.next(at)
+		if err != nil {
+			t.Fatalf("next %d: %v", i, err)
+		}
+		if ulid <= previous {
+			t.Errorf("next %d = %s, want after %s", i, ulid, previous)
+		}
+		if parsed, err := Parse("usr_" + ulid); err != nil || !parsed.Time.Equal(now) {
+			t.Errorf("next %d has time %s (%v), want %s", i, parsed.Time, err, now)
+		}
+		previous = ulid
+	}
+
+	// A later millisecond sorts after everything before it
+	ulid, err := g.next(now.Add(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ulid <= previous || !strings.HasPrefix(ulid, encodeTime(now.Add(time.Millisecond))) {
+		t.Errorf("next = %s, want after %s in the next millisecond", ulid, previous)
+	}
+
+	// The random part running out within a millisecond is an error
+	for i := range g.lastRand {
+		g.lastRand[i] = 0xFF
+	}
+	if _, err := g.next(now.Add(time.Millisecond)); err == nil {
+		t.Error("next succeeded with the random part exhausted")
+	}
+}
+
+// encodeTime returns the first 10 characters of a ULID made at t
+func encodeTime(t time.Time) string {
+	var raw [16]byte
+	ms := uint64(t.UnixMilli())
+	for i := 5; i >= 0; i-- {
+		raw[i] = byte(ms)
+		ms >>= 8
+	}
+	return encode(raw)[:10]
+}
@@ -0,0 +1,149 @@
+package ipacl
+
+import (
+	"errors"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Rule actions
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// Rule allows or denies a CIDR range, either globally (empty Path) or for
+// requests whose path starts with Path
+type Rule struct {
+	ID     string       `json:"id"`
+	Action string       `json:"action"`
+	CIDR   netip.Prefix `json:"cidr"`
+	Path   string       `json:"path,omitempty"`
+}
+
+// List is a concurrency-safe set of access rules.
+//
+// Rules are evaluated per scope: first the global scope, then every path
+// scope whose prefix matches the request. Within a scope a matching deny
+// rule always blocks, and if the scope has any allow rules the address
+// must match one of them.
+type List struct {
+	mutex  sync.RWMutex
+	rules  []Rule
+	nextID int
+}
+
+// NewList creates an empty access list
+func NewList() *List {
+	return &List{}
+}
+
+// ParseCIDR parses a CIDR range or a single address, which is treated as a
+// host-length prefix
+func ParseCIDR(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, errors.New("invalid CIDR range")
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, errors.New("invalid IP address")
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// Add validates and stores a rule, returning it with its assigned ID
+func (l *List) Add(action string, cidr netip.Prefix, path string) (Rule, error) {
+	if action != ActionAllow && action != ActionDeny {
+		return Rule{}, errors.New("action must be \"allow\" or \"deny\"")
+	}
+	if !cidr.IsValid() {
+		return Rule{}, errors.New("invalid CIDR range")
+	}
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return Rule{}, errors.New("path must start with /")
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.nextID++
+	rule := Rule{
+		ID:     "acl_" + strconv.Itoa(l.nextID),
+		Action: action,
+		CIDR:   cidr,
+		Path:   path,
+	}
+	l.rules = append(l.rules, rule)
+	return rule, nil
+}
+
+// Remove deletes a rule, reporting whether it existed
+func (l *List) Remove(id string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for i, rule := range l.rules {
+		if rule.ID == id {
+			l.rules = append(l.rules[:i], l.rules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Rules returns all rules in the order they were added
+func (l *List) Rules() []Rule {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	rules := make([]Rule, len(l.rules))
+	copy(rules, l.rules)
+	return rules
+}
+
+// Check reports whether addr may access path. When access is refused the
+// returned rule is the deny rule that matched, or the zero Rule when the
+// address was simply missing from an allowlist.
+func (l *List) Check(addr netip.Addr, path string) (bool, Rule) {
+	addr = addr.Unmap()
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	// Group rules by scope
+	scopes := make(map[string][]Rule)
+	for _, rule := range l.rules {
+		if rule.Path == "" || strings.HasPrefix(path, rule.Path) {
+			scopes[rule.Path] = append(scopes[rule.Path], rule)
+		}
+	}
+
+	for _, rules := range scopes {
+		hasAllow, allowed := false, false
+		for _, rule := range rules {
+			if !rule.CIDR.Contains(addr) {
+				if rule.Action == ActionAllow {
+					hasAllow = true
+				}
+				continue
+			}
+			if rule.Action == ActionDeny {
+				return false, rule
+			}
+			hasAllow, allowed = true, true
+		}
+		if hasAllow && !allowed {
+			return false, Rule{}
+		}
+	}
+
+	return true, Rule{}
+}
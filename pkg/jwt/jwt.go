@@ -0,0 +1,197 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// AlgES256 is the only supported signing algorithm: ECDSA on P-256 with SHA-256
+const AlgES256 = "ES256"
+
+var (
+	// ErrMalformed is returned for tokens that are not three base64url JSON segments
+	ErrMalformed = errors.New("malformed token")
+	// ErrUnsupportedAlgorithm is returned for tokens not signed with ES256
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	// ErrInvalidSignature is returned when the signature does not verify
+	ErrInvalidSignature = errors.New("invalid token signature")
+	// ErrExpired is returned for tokens past their expiry time
+	ErrExpired = errors.New("token has expired")
+	// ErrNotYetValid is returned for tokens used before their not-before time
+	ErrNotYetValid = errors.New("token is not valid yet")
+)
+
+// Header is the JOSE header of a token
+type Header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// Claims are the registered claims plus the ones this server issues
+type Claims struct {
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ID        string `json:"jti,omitempty"`
+
+	// Scope is a space-separated list of granted scopes
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	// Organization limits the caller to users of one tenant
+	Organization string `json:"org,omitempty"`
+}
+
+// Scopes returns the granted scopes as a slice
+func (c Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// HasScope reports whether scope was granted
+func (c Claims) HasScope(scope string) bool {
+	for _, granted := range c.Scopes() {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyFunc returns the public key to verify a token signed with key ID kid
+type KeyFunc func(kid string) (*ecdsa.PublicKey, error)
+
+// GenerateKey creates a new P-256 signing key
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// ParsePrivateKey reads a P-256 key from PEM, in either SEC 1 ("EC PRIVATE
+// KEY") or PKCS #8 ("PRIVATE KEY") form
+func ParsePrivateKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	private, ok := key.(*ecdsa.PrivateKey)
+	if !ok || private.Curve != elliptic.P256() {
+		return nil, ErrUnsupportedAlgorithm
+	}
+	return private, nil
+}
+
+// Sign encodes and signs claims with ES256. kid is placed in the header
+// when not empty so verifiers can select the right key.
+func Sign(claims Claims, kid string, key *ecdsa.PrivateKey) (string, error) {
+	header, err := json.Marshal(Header{Alg: AlgES256, Typ: "JWT", Kid: kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encode(header) + "." + encode(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	// JWS uses the fixed-width r || s encoding rather than ASN.1
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return signingInput + "." + encode(signature), nil
+}
+
+// Verify checks the token's signature with the key returned by keyFunc and
+// its time-based claims at now, returning the claims when valid
+func Verify(token string, keyFunc KeyFunc, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrMalformed
+	}
+
+	var header Header
+	if err := decodeJSON(parts[0], &header); err != nil {
+		return Claims{}, ErrMalformed
+	}
+	if header.Alg != AlgES256 {
+		return Claims{}, ErrUnsupportedAlgorithm
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		return Claims{}, ErrInvalidSignature
+	}
+
+	key, err := keyFunc(header.Kid)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(key, digest[:], r, s) {
+		return Claims{}, ErrInvalidSignature
+	}
+
+	var claims Claims
+	if err := decodeJSON(parts[1], &claims); err != nil {
+		return Claims{}, ErrMalformed
+	}
+
+	if claims.ExpiresAt != 0 && now.Unix() >= claims.ExpiresAt {
+		return Claims{}, ErrExpired
+	}
+	if claims.NotBefore != 0 && now.Unix() < claims.NotBefore {
+		return Claims{}, ErrNotYetValid
+	}
+
+	return claims, nil
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeJSON(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,270 @@
+package jwt
+
+import (
+	"auth-server/pkg/randutil"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// ErrUnknownKey is returned when a token names a key ID the set does not hold
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// Key states within a KeySet
+const (
+	KeyStateNext    = "next"    // published but not yet signing
+	KeyStateCurrent = "current" // signs new tokens
+	KeyStateRetired = "retired" // still published so existing tokens verify
+)
+
+// SigningKey is one key in a KeySet
+type SigningKey struct {
+	ID        string    `json:"kid"`
+	State     string    `json:"state"`
+	CreatedAt time.Time `json:"createdAt"`
+	// RetiredAt is when the key stopped signing; zero while next or current
+	RetiredAt time.Time `json:"retiredAt,omitempty"`
+
+	private *ecdsa.PrivateKey
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+// JWKS is a JSON Web Key Set document
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// KeySet manages signing key rotation. The next key is published one
+// rotation ahead of use, so relying parties that cache the key set already
+// know it when it starts signing, and retired keys stay published for the
+// grace period so tokens they signed keep verifying until they expire.
+type KeySet struct {
+	mutex       sync.RWMutex
+	keys        []*SigningKey // oldest first
+	gracePeriod time.Duration
+}
+
+// NewKeySet creates a key set with a current and a next key
+func NewKeySet(gracePeriod time.Duration) (*KeySet, error) {
+	ks := &KeySet{gracePeriod: gracePeriod}
+
+	now := time.Now()
+	for _, state := range []string{KeyStateCurrent, KeyStateNext} {
+		key, err := newSigningKey(state, now)
+		if err != nil {
+			return nil, err
+		}
+		ks.keys = append(ks.keys, key)
+	}
+	return ks, nil
+}
+
+func newSigningKey(state string, now time.Time) (*SigningKey, error) {
+	private, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	kid, err := randutil.Hex(8)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{ID: kid, State: state, CreatedAt: now, private: private}, nil
+}
+
+// Rotate retires the current key, promotes the next key to current and
+// generates a new next key. It returns the new current key.
+func (ks *KeySet) Rotate(now time.Time) (SigningKey, error) {
+	next, err := newSigningKey(KeyStateNext, now)
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	var current SigningKey
+	for _, key := range ks.keys {
+		switch key.State {
+		case KeyStateCurrent:
+			key.State = KeyStateRetired
+			key.RetiredAt = now
+		case KeyStateNext:
+			key.State = KeyStateCurrent
+			current = *key
+		}
+	}
+	ks.keys = append(ks.keys, next)
+	return current, nil
+}
+
+// Install makes an externally managed key the current key, retiring the
+// previous current key. Its key ID is the key's JWK thumbprint (RFC 7638),
+// so every server sharing the key uses the same ID. Installing the key that
+// is already current changes nothing.
+func (ks *KeySet) Install(private *ecdsa.PrivateKey, now time.Time) (SigningKey, error) {
+	if private.Curve != elliptic.P256() {
+		return SigningKey{}, ErrUnsupportedAlgorithm
+	}
+	installed := &SigningKey{ID: thumbprint(&private.PublicKey), State: KeyStateCurrent, CreatedAt: now, private: private}
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	kept := ks.keys[:0]
+	for _, key := range ks.keys {
+		if key.ID == installed.ID {
+			if key.State == KeyStateCurrent {
+				return *key, nil
+			}
+			// Installed again after being replaced; drop the old entry
+			continue
+		}
+		if key.State == KeyStateCurrent {
+			key.State = KeyStateRetired
+			key.RetiredAt = now
+		}
+		kept = append(kept, key)
+	}
+	ks.keys = append(kept, installed)
+	return *installed, nil
+}
+
+// thumbprint is the base64url SHA-256 JWK thumbprint of a P-256 key
+func thumbprint(public *ecdsa.PublicKey) string {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	public.X.FillBytes(x)
+	public.Y.FillBytes(y)
+
+	// Members in lexicographic order with no whitespace, per RFC 7638
+	canonical := `{"crv":"P-256","kty":"EC","x":"` + base64.RawURLEncoding.EncodeToString(x) +
+		`","y":"` + base64.RawURLEncoding.EncodeToString(y) + `"}`
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Prune removes retired keys whose grace period has passed, returning how
+// many were removed
+func (ks *KeySet) Prune(now time.Time) int {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	kept := ks.keys[:0]
+	pruned := 0
+	for _, key := range ks.keys {
+		if key.State == KeyStateRetired && now.Sub(key.RetiredAt) > ks.gracePeriod {
+			pruned++
+			continue
+		}
+		kept = append(kept, key)
+	}
+	ks.keys = kept
+	return pruned
+}
+
+// Sign signs claims with the current key, setting the kid header
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	ks.mutex.RLock()
+	var current *SigningKey
+	for _, key := range ks.keys {
+		if key.State == KeyStateCurrent {
+			current = key
+		}
+	}
+	ks.mutex.RUnlock()
+
+	return Sign(claims, current.ID, current.private)
+}
+
+// KeyFunc looks up verification keys by kid. Tokens signed by the current
+// or a retired key within its grace period verify.
+func (ks *KeySet) KeyFunc(kid string) (*ecdsa.PublicKey, error) {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	for _, key := range ks.keys {
+		if key.ID == kid && key.State != KeyStateNext {
+			return &key.private.PublicKey, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// Keys returns the metadata of every key in the set, oldest first
+func (ks *KeySet) Keys() []SigningKey {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	keys := make([]SigningKey, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		keys = append(keys, SigningKey{ID: key.ID, State: key.State, CreatedAt: key.CreatedAt, RetiredAt: key.RetiredAt})
+	}
+	return keys
+}
+
+// JWKS returns the public half of every published key
+func (ks *KeySet) JWKS() JWKS {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	set := JWKS{Keys: make([]JWK, 0, len(ks.keys))}
+	for _, key := range ks.keys {
+		public := key.private.PublicKey
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		public.X.FillBytes(x)
+		public.Y.FillBytes(y)
+
+		set.Keys = append(set.Keys, JWK{
+			Kty: "EC",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(x),
+			Y:   base64.RawURLEncoding.EncodeToString(y),
+			Kid: key.ID,
+			Use: "sig",
+			Alg: AlgES256,
+		})
+	}
+	return set
+}
+
+// PublicKey converts an EC P-256 JWK back into a verification key
+func (k JWK) PublicKey() (*ecdsa.PublicKey, error) {
+	if k.Kty != "EC" || k.Crv != "P-256" {
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil || len(x) != 32 {
+		return nil, ErrMalformed
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil || len(y) != 32 {
+		return nil, ErrMalformed
+	}
+
+	key := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, ErrMalformed
+	}
+	return key, nil
+}
@@ -0,0 +1,451 @@
+// Package kerberos accepts Kerberos 5 service tickets sent through SPNEGO
+// (RFC 4178, RFC 4559), the "Negotiate" HTTP authentication browsers use
+// for Windows integrated sign-in. It covers only the service's side:
+// reading the keytab, decrypting the ticket and authenticator and
+// answering mutual authentication. Only the AES encryption types of
+// RFC 3962 are supported, so the service account must not be limited to
+// RC4 or DES.
+package kerberos
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Encryption types of RFC 3962
+const (
+	AES128CTSHMACSHA196 int32 = 17
+	AES256CTSHMACSHA196 int32 = 18
+)
+
+// Key usages of RFC 4120 section 7.5.1
+const (
+	usageTicket        = 2
+	usageAuthenticator = 11
+	usageAPRepPart     = 12
+)
+
+var (
+	// ErrMalformed is returned for tokens and keytabs that cannot be parsed
+	ErrMalformed = errors.New("kerberos: malformed message")
+	// ErrUnsupportedMechanism is returned for Negotiate tokens for a
+	// mechanism other than Kerberos, such as NTLM
+	ErrUnsupportedMechanism = errors.New("kerberos: unsupported mechanism")
+	// ErrUnsupportedEncryption is returned for keys of encryption types
+	// other than AES
+	ErrUnsupportedEncryption = errors.New("kerberos: unsupported encryption type")
+	// ErrNoKey is returned when the keytab has no key the ticket was
+	// encrypted with
+	ErrNoKey = errors.New("kerberos: no key for ticket in keytab")
+	// ErrIntegrity is returned when a message does not decrypt, because it
+	// was tampered with or encrypted with another key
+	ErrIntegrity = errors.New("kerberos: integrity check failed")
+	// ErrTicketExpired is returned for tickets used outside their lifetime
+	ErrTicketExpired = errors.New("kerberos: ticket expired or not yet valid")
+	// ErrClockSkew is returned for authenticators made too far from now
+	ErrClockSkew = errors.New("kerberos: clock skew too great")
+	// ErrReplay is returned for an authenticator that was already used
+	ErrReplay = errors.New("kerberos: request is a replay")
+)
+
+// Principal names a Kerberos user or service, such as alice@CORP.EXAMPLE
+// or HTTP/intranet.corp.example@CORP.EXAMPLE
+type Principal struct {
+	Components []string
+	Realm      string
+}
+
+// ParsePrincipal parses a principal written as name/instance@REALM
+func ParsePrincipal(s string) (Principal, error) {
+	name, realm, ok := strings.Cut(s, "@")
+	if !ok || name == "" || realm == "" {
+		return Principal{}, fmt.Errorf("kerberos: principal %q has no realm", s)
+	}
+	return Principal{Components: strings.Split(name, "/"), Realm: realm}, nil
+}
+
+// String returns the principal in the form ParsePrincipal reads
+func (p Principal) String() string {
+	return strings.Join(p.Components, "/") + "@" + p.Realm
+}
+
+// Equal reports whether p and other name the same principal
+func (p Principal) Equal(other Principal) bool {
+	return p.String() == other.String()
+}
+
+// Key is a long-term or session key
+type Key struct {
+	Type  int32
+	Value []byte
+}
+
+// NewKey returns a random key of the given encryption type
+func NewKey(etype int32) (Key, error) {
+	size, err := keySize(etype)
+	if err != nil {
+		return Key{}, err
+	}
+	value := make([]byte, size)
+	if _, err := rand.Read(value); err != nil {
+		return Key{}, errors.New("kerberos: failed to read random bytes")
+	}
+	return Key{Type: etype, Value: value}, nil
+}
+
+func keySize(etype int32) (int, error) {
+	switch etype {
+	case AES128CTSHMACSHA196:
+		return 16, nil
+	case AES256CTSHMACSHA196:
+		return 32, nil
+	}
+	return 0, ErrUnsupportedEncryption
+}
+
+// ASN.1 messages of RFC 4120. KerberosString is a GeneralString, which
+// encoding/asn1 cannot read into a string, so names are kept raw. An
+// explicitly tagged RawValue is read with its tag but written without
+// one, so those fields hold the tagged element themselves.
+
+type principalName struct {
+	NameType   int32           `asn1:"explicit,tag:0"`
+	NameString []asn1.RawValue `asn1:"explicit,tag:1"`
+}
+
+type encryptedData struct {
+	EType  int32  `asn1:"explicit,tag:0"`
+	KVNO   int    `asn1:"optional,explicit,tag:1"`
+	Cipher []byte `asn1:"explicit,tag:2"`
+}
+
+type encryptionKey struct {
+	KeyType  int32  `asn1:"explicit,tag:0"`
+	KeyValue []byte `asn1:"explicit,tag:1"`
+}
+
+type ticket struct {
+	TktVNO  int           `asn1:"explicit,tag:0"`
+	Realm   asn1.RawValue `asn1:"explicit,tag:1"`
+	SName   principalName `asn1:"explicit,tag:2"`
+	EncPart encryptedData `asn1:"explicit,tag:3"`
+}
+
+type transitedEncoding struct {
+	TRType   int32  `asn1:"explicit,tag:0"`
+	Contents []byte `asn1:"explicit,tag:1"`
+}
+
+type encTicketPart struct {
+	Flags             asn1.BitString    `asn1:"explicit,tag:0"`
+	Key               encryptionKey     `asn1:"explicit,tag:1"`
+	CRealm            asn1.RawValue     `asn1:"explicit,tag:2"`
+	CName             principalName     `asn1:"explicit,tag:3"`
+	Transited         transitedEncoding `asn1:"explicit,tag:4"`
+	AuthTime          time.Time         `asn1:"generalized,explicit,tag:5"`
+	StartTime         time.Time         `asn1:"generalized,optional,explicit,tag:6"`
+	EndTime           time.Time         `asn1:"generalized,explicit,tag:7"`
+	RenewTill         time.Time         `asn1:"generalized,optional,explicit,tag:8"`
+	CAddr             asn1.RawValue     `asn1:"optional,explicit,tag:9"`
+	AuthorizationData asn1.RawValue     `asn1:"optional,explicit,tag:10"`
+}
+
+type apReq struct {
+	PVNO          int            `asn1:"explicit,tag:0"`
+	MsgType       int            `asn1:"explicit,tag:1"`
+	APOptions     asn1.BitString `asn1:"explicit,tag:2"`
+	Ticket        asn1.RawValue  `asn1:"explicit,tag:3"`
+	Authenticator encryptedData  `asn1:"explicit,tag:4"`
+}
+
+type authenticator struct {
+	AVNO              int           `asn1:"explicit,tag:0"`
+	CRealm            asn1.RawValue `asn1:"explicit,tag:1"`
+	CName             principalName `asn1:"explicit,tag:2"`
+	Cksum             asn1.RawValue `asn1:"optional,explicit,tag:3"`
+	Cusec             int           `asn1:"explicit,tag:4"`
+	CTime             time.Time     `asn1:"generalized,explicit,tag:5"`
+	Subkey            encryptionKey `asn1:"optional,explicit,tag:6"`
+	SeqNumber         int64         `asn1:"optional,explicit,tag:7"`
+	AuthorizationData asn1.RawValue `asn1:"optional,explicit,tag:8"`
+}
+
+type apRep struct {
+	PVNO    int           `asn1:"explicit,tag:0"`
+	MsgType int           `asn1:"explicit,tag:1"`
+	EncPart encryptedData `asn1:"explicit,tag:2"`
+}
+
+type encAPRepPart struct {
+	CTime     time.Time `asn1:"generalized,explicit,tag:0"`
+	Cusec     int       `asn1:"explicit,tag:1"`
+	SeqNumber int64     `asn1:"optional,explicit,tag:3"`
+}
+
+// ASN.1 application tags and message types of the messages above
+const (
+	tagTicket        = "application,explicit,tag:1"
+	tagAuthenticator = "application,explicit,tag:2"
+	tagEncTicketPart = "application,explicit,tag:3"
+	tagAPReq         = "application,explicit,tag:14"
+	tagAPRep         = "application,explicit,tag:15"
+	tagEncAPRepPart  = "application,explicit,tag:27"
+
+	msgTypeAPReq = 14
+	msgTypeAPRep = 15
+	// apOptionMutualRequired is the AP-REQ option bit asking the service to
+	// prove it could read the ticket
+	apOptionMutualRequired = 2
+	nameTypePrincipal      = 1
+)
+
+func generalString(s string) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagGeneralString, Bytes: []byte(s)}
+}
+
+// tagged wraps the DER element b in the explicit context tag
+func tagged(tag int, b []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: b}
+}
+
+// taggedString is a KerberosString field with an explicit tag
+func taggedString(tag int, s string) asn1.RawValue {
+	b, _ := asn1.Marshal(generalString(s))
+	return tagged(tag, b)
+}
+
+// stringOf reads the KerberosString inside an explicitly tagged field
+func stringOf(field asn1.RawValue) string {
+	var s asn1.RawValue
+	if _, err := asn1.Unmarshal(field.Bytes, &s); err != nil {
+		return ""
+	}
+	return string(s.Bytes)
+}
+
+func (n principalName) principal(realm asn1.RawValue) Principal {
+	components := make([]string, len(n.NameString))
+	for i, component := range n.NameString {
+		components[i] = string(component.Bytes)
+	}
+	return Principal{Components: components, Realm: stringOf(realm)}
+}
+
+func newPrincipalName(p Principal) principalName {
+	name := principalName{NameType: nameTypePrincipal}
+	for _, component := range p.Components {
+		name.NameString = append(name.NameString, generalString(component))
+	}
+	return name
+}
+
+// unmarshal parses exactly one DER message into v
+func unmarshal(b []byte, v interface{}, params string) error {
+	rest, err := asn1.UnmarshalWithParams(b, v, params)
+	if err != nil || len(rest) > 0 {
+		return ErrMalformed
+	}
+	return nil
+}
+
+// Encryption per RFC 3961 and RFC 3962: AES in CBC mode with ciphertext
+// stealing under a key derived for the usage, a random confounder block
+// and an HMAC-SHA1 tag truncated to 96 bits under a second derived key.
+
+const macSize = 12
+
+func encrypt(key Key, usage uint32, plaintext []byte) ([]byte, error) {
+	ke, ki, err := usageKeys(key, usage)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, aes.BlockSize, aes.BlockSize+len(plaintext))
+	if _, err := rand.Read(data); err != nil {
+		return nil, errors.New("kerberos: failed to read random bytes")
+	}
+	data = append(data, plaintext...)
+	ciphertext, err := ctsEncrypt(ke, data)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, ki)
+	mac.Write(data)
+	return append(ciphertext, mac.Sum(nil)[:macSize]...), nil
+}
+
+func decrypt(key Key, usage uint32, ciphertext []byte) ([]byte, error) {
+	ke, ki, err := usageKeys(key, usage)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aes.BlockSize+macSize {
+		return nil, ErrMalformed
+	}
+	body, tag := ciphertext[:len(ciphertext)-macSize], ciphertext[len(ciphertext)-macSize:]
+	data, err := ctsDecrypt(ke, body)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, ki)
+	mac.Write(data)
+	if !hmac.Equal(mac.Sum(nil)[:macSize], tag) {
+		return nil, ErrIntegrity
+	}
+	return data[aes.BlockSize:], nil
+}
+
+// usageKeys derives the encryption and integrity keys for usage
+func usageKeys(key Key, usage uint32) ([]byte, []byte, error) {
+	size, err := keySize(key.Type)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(key.Value) != size {
+		return nil, nil, ErrMalformed
+	}
+	constant := binary.BigEndian.AppendUint32(nil, usage)
+	ke, err := deriveKey(key.Value, append(constant, 0xAA))
+	if err != nil {
+		return nil, nil, err
+	}
+	ki, err := deriveKey(key.Value, append(constant, 0x55))
+	if err != nil {
+		return nil, nil, err
+	}
+	return ke, ki, nil
+}
+
+// deriveKey is DK of RFC 3961: the base key encrypts the n-folded
+// constant, then its own output, until there are enough bytes
+func deriveKey(base, constant []byte) ([]byte, error) {
+	block, err := aes.NewCipher(base)
+	if err != nil {
+		return nil, err
+	}
+	derived := make([]byte, 0, len(base))
+	input := nfold(constant, aes.BlockSize)
+	for len(derived) < len(base) {
+		output := make([]byte, aes.BlockSize)
+		block.Encrypt(output, input)
+		derived = append(derived, output...)
+		input = output
+	}
+	return derived[:len(base)], nil
+}
+
+// nfold stretches in to size bytes as RFC 3961 section 5.1 describes:
+// copies of in, each rotated 13 bits further right, are added together
+// with end-around carry
+func nfold(in []byte, size int) []byte {
+	inBits := len(in) * 8
+	total := lcm(len(in), size)
+	// Expand to total bytes of rotated copies
+	expanded := make([]byte, 0, total)
+	for copies := 0; len(expanded) < total; copies++ {
+		rotation := (13 * copies) % inBits
+		for i := range in {
+			bit := (i*8 - rotation + inBits) % inBits
+			b := (uint16(in[bit/8])<<8 | uint16(in[(bit/8+1)%len(in)])) >> (8 - bit%8)
+			expanded = append(expanded, byte(b))
+		}
+	}
+	// Add the size-byte chunks with ones' complement addition
+	out := make([]byte, size)
+	for chunk := 0; chunk < total; chunk += size {
+		carry := 0
+		for i := size - 1; i >= 0; i-- {
+			sum := int(out[i]) + int(expanded[chunk+i]) + carry
+			out[i], carry = byte(sum), sum>>8
+		}
+		for i := size - 1; carry > 0 && i >= 0; i-- {
+			sum := int(out[i]) + carry
+			out[i], carry = byte(sum), sum>>8
+		}
+	}
+	return out
+}
+
+func lcm(a, b int) int {
+	x, y := a, b
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return a / x * b
+}
+
+// ctsEncrypt is AES-CBC with a zero IV and ciphertext stealing: the last
+// two blocks are swapped and the final one cut to the plaintext's length
+func ctsEncrypt(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) <= aes.BlockSize {
+		if len(plaintext) < aes.BlockSize {
+			return nil, ErrMalformed
+		}
+		out := make([]byte, aes.BlockSize)
+		block.Encrypt(out, plaintext)
+		return out, nil
+	}
+	padded := make([]byte, (len(plaintext)+aes.BlockSize-1)/aes.BlockSize*aes.BlockSize)
+	copy(padded, plaintext)
+	out := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(out, padded)
+
+	n := len(out)
+	last := len(plaintext) - (n - aes.BlockSize)
+	result := make([]byte, 0, len(plaintext))
+	result = append(result, out[:n-2*aes.BlockSize]...)
+	result = append(result, out[n-aes.BlockSize:]...)
+	return append(result, out[n-2*aes.BlockSize:n-2*aes.BlockSize+last]...), nil
+}
+
+func ctsDecrypt(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) <= aes.BlockSize {
+		if len(ciphertext) < aes.BlockSize {
+			return nil, ErrMalformed
+		}
+		out := make([]byte, aes.BlockSize)
+		block.Decrypt(out, ciphertext)
+		return out, nil
+	}
+
+	blocks := (len(ciphertext) + aes.BlockSize - 1) / aes.BlockSize
+	head := (blocks - 2) * aes.BlockSize
+	out := make([]byte, len(ciphertext))
+	iv := make([]byte, aes.BlockSize)
+	if head > 0 {
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out[:head], ciphertext[:head])
+		iv = ciphertext[head-aes.BlockSize : head]
+	}
+
+	// The full block sent second to last was encrypted last; its
+	// decryption holds the stolen tail of the block before
+	swapped := ciphertext[head : head+aes.BlockSize]
+	partial := ciphertext[head+aes.BlockSize:]
+	decrypted := make([]byte, aes.BlockSize)
+	block.Decrypt(decrypted, swapped)
+	previous := append(append([]byte{}, partial...), decrypted[len(partial):]...)
+	for i := range partial {
+		out[head+aes.BlockSize+i] = decrypted[i] ^ partial[i]
+	}
+	block.Decrypt(out[head:head+aes.BlockSize], previous)
+	for i := 0; i < aes.BlockSize; i++ {
+		out[head+i] ^= iv[i]
+	}
+	return out, nil
+}
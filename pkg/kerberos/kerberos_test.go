@@ -0,0 +1,148 @@
+package kerberos
+
+import (
+	"bytes"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+// RFC 3961 appendix A.1
+func TestNfold(t *testing.T) {
+	tests := []struct {
+		bits int
+		in   string
+		want string
+	}{
+		{64, "012345", "be072631276b1955"},
+		{56, "password", "78a07b6caf85fa"},
+		{64, "Rough Consensus, and Running Code", "bb6ed30870b7f0e0"},
+		{168, "password", "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{192, "MASSACHVSETTS INSTITVTE OF TECHNOLOGY", "db3b0d8f0b061e603282b308a50841229ad798fab9540c1b"},
+		{168, "Q", "518a54a215a8452a518a54a215a8452a518a54a215"},
+		{168, "ba", "fb25d531ae8974499f52fd92ea9857c4ba24cf297e"},
+		{64, "kerberos", "6b65726265726f73"},
+		{128, "kerberos", "6b65726265726f737b9b5b2b93132b93"},
+		{168, "kerberos", "8372c236344e5f1550cd0747e15d62ca7a5a3bcea4"},
+		{256, "kerberos", "6b65726265726f737b9b5b2b93132b935c9bdcdad95c9899c4cae4dee6d6cae4"},
+	}
+	for _, test := range tests {
+		if got := nfold([]byte(test.in), test.bits/8); !bytes.Equal(got, unhex(t, test.want)) {
+			t.Errorf("%d-fold(%q) = %x, want %s", test.bits, test.in, got, test.want)
+		}
+	}
+}
+
+// stringToKey is the string-to-key function of RFC 3962 section 4, which
+// the package has no use for but which ties deriveKey to the RFC's
+// vectors and to keys kadmin and ktutil make from passwords
+func stringToKey(t *testing.T, etype int32, password, salt string, iterations int) []byte {
+	t.Helper()
+	size, err := keySize(etype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkey, err := pbkdf2.Key(sha1.New, password, []byte(salt), iterations, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := deriveKey(tkey, []byte("kerberos"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// RFC 3962 appendix B
+func TestStringToKey(t *testing.T) {
+	tests := []struct {
+		iterations int
+		etype      int32
+		tkey       string
+		key        string
+	}{
+		{1, AES128CTSHMACSHA196,
+			"cd ed b5 28 1b b2 f8 01 56 5a 11 22 b2 56 35 15",
+			"42 26 3c 6e 89 f4 fc 28 b8 df 68 ee 09 79 9f 15"},
+		{1, AES256CTSHMACSHA196,
+			"cd ed b5 28 1b b2 f8 01 56 5a 11 22 b2 56 35 15 0a d1 f7 a0 4b b9 f3 a3 33 ec c0 e2 e1 f7 08 37",
+			"fe 69 7b 52 bc 0d 3c e1 44 32 ba 03 6a 92 e6 5b bb 52 28 09 90 a2 fa 27 88 39 98 d7 2a f3 01 61"},
+		{2, AES128CTSHMACSHA196,
+			"01 db ee 7f 4a 9e 24 3e 98 8b 62 c7 3c da 93 5d",
+			"c6 51 bf 29 e2 30 0a c2 7f a4 69 d6 93 bd da 13"},
+		{2, AES256CTSHMACSHA196,
+			"01 db ee 7f 4a 9e 24 3e 98 8b 62 c7 3c da 93 5d a0 53 78 b9 32 44 ec 8f 48 a9 9e 61 ad 79 9d 86",
+			"a2 e1 6d 16 b3 60 69 c1 35 d5 e9 d2 e2 5f 89 61 02 68 56 18 b9 59 14 b4 67 c6 76 22 22 58 24 ff"},
+		{1200, AES128CTSHMACSHA196,
+			"5c 08 eb 61 fd f7 1e 4e 4e c3 cf 6b a1 f5 51 2b",
+			"4c 01 cd 46 d6 32 d0 1e 6d be 23 0a 01 ed 64 2a"},
+		{1200, AES256CTSHMACSHA196,
+			"5c 08 eb 61 fd f7 1e 4e 4e c3 cf 6b a1 f5 51 2b a7 e5 2d db c5 e5 14 2f 70 8a 31 e2 e6 2b 1e 13",
+			"55 a6 ac 74 0a d1 7b 48 46 94 10 51 e1 e8 b0 a7 54 8d 93 b0 ab 30 a8 bc 3f f1 62 80 38 2b 8c 2a"},
+	}
+	for _, test := range tests {
+		// The intermediate key checks the vector was copied right, so a
+		// mismatch in the final one is deriveKey's
+		tkey, err := pbkdf2.Key(sha1.New, "password", []byte("ATHENA.MIT.EDUraeburn"), test.iterations, len(unhex(t, test.key)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tkey, unhex(t, test.tkey)) {
+			t.Fatalf("PBKDF2 with %d iterations = %x, want %s", test.iterations, tkey, test.tkey)
+		}
+		got := stringToKey(t, test.etype, "password", "ATHENA.MIT.EDUraeburn", test.iterations)
+		if !bytes.Equal(got, unhex(t, test.key)) {
+			t.Errorf("string-to-key for etype %d with %d iterations = %x, want %s", test.etype, test.iterations, got, test.key)
+		}
+	}
+}
+
+// RFC 3962 appendix B, AES-128 with the key "chicken teriyaki" and a zero IV
+func TestCTS(t *testing.T) {
+	key := []byte("chicken teriyaki")
+	tests := []struct {
+		plaintext  string
+		ciphertext string
+	}{
+		{"I would like the ",
+			"c6 35 35 68 f2 bf 8c b4 d8 a5 80 36 2d a7 ff 7f 97"},
+		{"I would like the General Gau's ",
+			"fc 00 78 3e 0e fd b2 c1 d4 45 d4 c8 ef f7 ed 22 97 68 72 68 d6 ec cc c0 c0 7b 25 e2 5e cf e5"},
+		{"I would like the General Gau's C",
+			"39 31 25 23 a7 86 62 d5 be 7f cb cc 98 eb f5 a8 97 68 72 68 d6 ec cc c0 c0 7b 25 e2 5e cf e5 84"},
+		{"I would like the General Gau's Chicken, please,",
+			"97 68 72 68 d6 ec cc c0 c0 7b 25 e2 5e cf e5 84 b3 ff fd 94 0c 16 a1 8c 1b 55 49 d2 f8 38 02 9e 39 31 25 23 a7 86 62 d5 be 7f cb cc 98 eb f5"},
+		{"I would like the General Gau's Chicken, please, ",
+			"97 68 72 68 d6 ec cc c0 c0 7b 25 e2 5e cf e5 84 9d ad 8b bb 96 c4 cd c0 3b c1 03 e1 a1 94 bb d8 39 31 25 23 a7 86 62 d5 be 7f cb cc 98 eb f5 a8"},
+		{"I would like the General Gau's Chicken, please, and wonton soup.",
+			"97 68 72 68 d6 ec cc c0 c0 7b 25 e2 5e cf e5 84 39 31 25 23 a7 86 62 d5 be 7f cb cc 98 eb f5 a8 48 07 ef e8 36 ee 89 a5 26 73 0d bc 2f 7b c8 40 9d ad 8b bb 96 c4 cd c0 3b c1 03 e1 a1 94 bb d8"},
+	}
+	for _, test := range tests {
+		want := unhex(t, test.ciphertext)
+		got, err := ctsEncrypt(key, []byte(test.plaintext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("encrypting %q = %x, want %x", test.plaintext, got, want)
+		}
+		plaintext, err := ctsDecrypt(key, want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plaintext) != test.plaintext {
+			t.Errorf("decrypting %x = %q, want %q", want, plaintext, test.plaintext)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package kerberos
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// keytabVersion is the MIT keytab format written by ktutil and ktpass,
+// with big-endian numbers
+const keytabVersion = 0x0502
+
+// KeytabEntry is a service principal's key at one key version
+type KeytabEntry struct {
+	Principal Principal
+	Timestamp time.Time
+	KVNO      uint32
+	Key       Key
+}
+
+// Keytab holds the long-term keys of one or more service principals
+type Keytab struct {
+	Entries []KeytabEntry
+}
+
+// ParseKeytab reads a keytab file's contents. Keys of unsupported
+// encryption types are kept, so a keytab exported with RC4 keys alongside
+// AES ones still loads.
+func ParseKeytab(b []byte) (*Keytab, error) {
+	if len(b) < 2 || binary.BigEndian.Uint16(b) != keytabVersion {
+		return nil, errors.New("kerberos: keytab is not in the 0x502 format")
+	}
+	b = b[2:]
+
+	keytab := &Keytab{}
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, ErrMalformed
+		}
+		size := int32(binary.BigEndian.Uint32(b))
+		b = b[4:]
+		if size < 0 {
+			// A hole left by a deleted entry
+			if int(-int64(size)) > len(b) {
+				return nil, ErrMalformed
+			}
+			b = b[-size:]
+			continue
+		}
+		if int(size) > len(b) {
+			return nil, ErrMalformed
+		}
+		entry, err := parseKeytabEntry(b[:size])
+		if err != nil {
+			return nil, err
+		}
+		keytab.Entries = append(keytab.Entries, entry)
+		b = b[size:]
+	}
+	return keytab, nil
+}
+
+func parseKeytabEntry(b []byte) (KeytabEntry, error) {
+	r := reader{b: b}
+	var entry KeytabEntry
+	components := int(r.uint16())
+	entry.Principal.Realm = string(r.counted())
+	for i := 0; i < components; i++ {
+		entry.Principal.Components = append(entry.Principal.Components, string(r.counted()))
+	}
+	r.uint32() // name type
+	entry.Timestamp = time.Unix(int64(r.uint32()), 0).UTC()
+	entry.KVNO = uint32(r.uint8())
+	entry.Key.Type = int32(r.uint16())
+	entry.Key.Value = r.counted()
+	// Newer writers append the full key version after the 8-bit one
+	if len(r.b) >= 4 {
+		if kvno := r.uint32(); kvno != 0 {
+			entry.KVNO = kvno
+		}
+	}
+	if r.failed {
+		return KeytabEntry{}, ErrMalformed
+	}
+	return entry, nil
+}
+
+// Add adds key as principal's key at version kvno
+func (k *Keytab) Add(principal Principal, kvno uint32, key Key) {
+	k.Entries = append(k.Entries, KeytabEntry{
+		Principal: principal,
+		Timestamp: time.Now().UTC().Truncate(time.Second),
+		KVNO:      kvno,
+		Key:       key,
+	})
+}
+
+// Marshal encodes the keytab in the format ParseKeytab reads
+func (k *Keytab) Marshal() []byte {
+	out := binary.BigEndian.AppendUint16(nil, keytabVersion)
+	for _, entry := range k.Entries {
+		var b []byte
+		b = binary.BigEndian.AppendUint16(b, uint16(len(entry.Principal.Components)))
+		b = appendCounted(b, []byte(entry.Principal.Realm))
+		for _, component := range entry.Principal.Components {
+			b = appendCounted(b, []byte(component))
+		}
+		b = binary.BigEndian.AppendUint32(b, nameTypePrincipal)
+		b = binary.BigEndian.AppendUint32(b, uint32(entry.Timestamp.Unix()))
+		b = append(b, byte(min(entry.KVNO, math.MaxUint8)))
+		b = binary.BigEndian.AppendUint16(b, uint16(entry.Key.Type))
+		b = appendCounted(b, entry.Key.Value)
+		b = binary.BigEndian.AppendUint32(b, entry.KVNO)
+
+		out = binary.BigEndian.AppendUint32(out, uint32(len(b)))
+		out = append(out, b...)
+	}
+	return out
+}
+
+// key returns the key principal's tickets are encrypted with: the one of
+// version kvno, or the newest when kvno is 0
+func (k *Keytab) key(principal Principal, etype int32, kvno uint32) (Key, bool) {
+	var found *KeytabEntry
+	for i := range k.Entries {
+		entry := &k.Entries[i]
+		if entry.Key.Type != etype || !entry.Principal.Equal(principal) {
+			continue
+		}
+		if kvno != 0 && entry.KVNO == kvno {
+			return entry.Key, true
+		}
+		if kvno == 0 && (found == nil || entry.KVNO > found.KVNO) {
+			found = entry
+		}
+	}
+	if found == nil {
+		return Key{}, false
+	}
+	return found.Key, true
+}
+
+func appendCounted(b, value []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+// reader reads big-endian keytab fields, remembering whether it ran short
+type reader struct {
+	b      []byte
+	failed bool
+}
+
+func (r *reader) next(n int) []byte {
+	if r.failed || len(r.b) < n {
+		r.failed = true
+		return make([]byte, n)
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) uint8() uint8   { return r.next(1)[0] }
+func (r *reader) uint16() uint16 { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *reader) uint32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+
+func (r *reader) counted() []byte {
+	n := int(r.uint16())
+	return append([]byte(nil), r.next(n)...)
+}
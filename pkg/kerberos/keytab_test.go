@@ -0,0 +1,86 @@
+package kerberos
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+// testdata/http.keytab is written by testdata/generate.py as ktutil would
+// for this password; see there
+const (
+	keytabPassword = "Intranet-Keytab-2026"
+	keytabSalt     = "CORP.EXAMPLEHTTPintranet.corp.example"
+)
+
+func readKeytab(t *testing.T) *Keytab {
+	t.Helper()
+	b, err := os.ReadFile("testdata/http.keytab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keytab, err := ParseKeytab(b)
+	if err != nil {
+		t.Fatalf("ParseKeytab: %v", err)
+	}
+	return keytab
+}
+
+func TestParseKeytab(t *testing.T) {
+	keytab := readKeytab(t)
+	if len(keytab.Entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(keytab.Entries))
+	}
+	for i, etype := range []int32{AES256CTSHMACSHA196, AES128CTSHMACSHA196} {
+		entry := keytab.Entries[i]
+		if entry.Principal.String() != "HTTP/intranet.corp.example@CORP.EXAMPLE" {
+			t.Errorf("entry %d is for %s", i, entry.Principal)
+		}
+		if entry.KVNO != 3 || entry.Key.Type != etype {
+			t.Errorf("entry %d has kvno %d and etype %d, want 3 and %d", i, entry.KVNO, entry.Key.Type, etype)
+		}
+		if want := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC); !entry.Timestamp.Equal(want) {
+			t.Errorf("entry %d has timestamp %s, want %s", i, entry.Timestamp, want)
+		}
+		if want := stringToKey(t, etype, keytabPassword, keytabSalt, 4096); !bytes.Equal(entry.Key.Value, want) {
+			t.Errorf("entry %d has key %x, want %x", i, entry.Key.Value, want)
+		}
+	}
+}
+
+func TestKeytabMarshal(t *testing.T) {
+	b, err := os.ReadFile("testdata/http.keytab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keytab, err := ParseKeytab(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keytab.Marshal(); !bytes.Equal(got, b) {
+		t.Errorf("Marshal = %x, want the file's %x", got, b)
+	}
+}
+
+func TestParseKeytabMalformed(t *testing.T) {
+	b, err := os.ReadFile("testdata/http.keytab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseKeytab(append([]byte{0x05, 0x01}, b[2:]...)); err == nil {
+		t.Error("a keytab in the 0x501 format was read")
+	}
+	for _, n := range []int{3, 20, len(b) - 1} {
+		if _, err := ParseKeytab(b[:n]); err != ErrMalformed {
+			t.Errorf("keytab cut to %d bytes: got %v, want ErrMalformed", n, err)
+		}
+	}
+
+	// A deleted entry leaves its space behind with a negative length
+	hole := append([]byte{0x05, 0x02, 0xff, 0xff, 0xff, 0xfc, 0, 0, 0, 0}, b[2:]...)
+	keytab, err := ParseKeytab(hole)
+	if err != nil || len(keytab.Entries) != 2 {
+		t.Errorf("keytab with a hole: got %v, %v", keytab, err)
+	}
+}
@@ -0,0 +1,337 @@
+package kerberos
+
+import (
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultMaxSkew is how far apart client and server clocks may be, the
+// usual Kerberos default
+const DefaultMaxSkew = 5 * time.Minute
+
+var (
+	oidSPNEGO = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+	oidKRB5   = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+	// oidMSKRB5 is the Kerberos OID as mistyped by early Windows, which
+	// browsers on Windows still offer first
+	oidMSKRB5 = asn1.ObjectIdentifier{1, 2, 840, 48018, 1, 2, 2}
+)
+
+// GSS-API token IDs of RFC 4121 section 4.1
+var (
+	tokenIDAPReq = []byte{0x01, 0x00}
+	tokenIDAPRep = []byte{0x02, 0x00}
+)
+
+type negTokenInit struct {
+	MechTypes   []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
+	ReqFlags    asn1.BitString          `asn1:"optional,explicit,tag:1"`
+	MechToken   []byte                  `asn1:"optional,explicit,tag:2"`
+	MechListMIC []byte                  `asn1:"optional,explicit,tag:3"`
+}
+
+type negTokenResp struct {
+	NegState      asn1.Enumerated       `asn1:"explicit,tag:0"`
+	SupportedMech asn1.ObjectIdentifier `asn1:"optional,explicit,tag:1"`
+	ResponseToken []byte                `asn1:"optional,explicit,tag:2"`
+}
+
+// negStateAcceptCompleted tells the client negotiation succeeded
+const negStateAcceptCompleted = 0
+
+// Acceptor verifies the tokens clients send in "Authorization: Negotiate"
+// headers against a keytab. It is safe for concurrent use.
+type Acceptor struct {
+	keytab *Keytab
+	// MaxSkew bounds the difference between the client's clock and Now
+	MaxSkew time.Duration
+	// Now returns the current time; it is time.Now unless replaced
+	Now func() time.Time
+
+	mutex sync.Mutex
+	seen  map[string]time.Time
+}
+
+// NewAcceptor creates an acceptor for tickets to any principal in keytab
+func NewAcceptor(keytab *Keytab) *Acceptor {
+	return &Acceptor{
+		keytab:  keytab,
+		MaxSkew: DefaultMaxSkew,
+		Now:     time.Now,
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// Accept verifies a Negotiate token, either SPNEGO or a bare Kerberos
+// token, and returns the client principal. When the client asked for
+// mutual authentication it also returns the token to send back in the
+// WWW-Authenticate header, which is nil otherwise.
+func (a *Acceptor) Accept(token []byte) (Principal, []byte, error) {
+	mech, inner, err := unwrapGSS(token)
+	if err != nil {
+		return Principal{}, nil, err
+	}
+	spnego := mech.Equal(oidSPNEGO)
+	if spnego {
+		var init negTokenInit
+		if err := unmarshal(inner, &init, "explicit,tag:0"); err != nil {
+			return Principal{}, nil, err
+		}
+		// The optimistic token is for the client's preferred mechanism
+		if len(init.MechTypes) == 0 || !isKerberos(init.MechTypes[0]) || len(init.MechToken) == 0 {
+			return Principal{}, nil, ErrUnsupportedMechanism
+		}
+		if mech, inner, err = unwrapGSS(init.MechToken); err != nil {
+			return Principal{}, nil, err
+		}
+	}
+	if !isKerberos(mech) {
+		return Principal{}, nil, ErrUnsupportedMechanism
+	}
+	if len(inner) < 2 || inner[0] != tokenIDAPReq[0] || inner[1] != tokenIDAPReq[1] {
+		return Principal{}, nil, ErrMalformed
+	}
+
+	client, reply, err := a.acceptAPReq(inner[2:])
+	if err != nil || reply == nil {
+		return client, nil, err
+	}
+	reply = wrapGSS(oidKRB5, append(append([]byte{}, tokenIDAPRep...), reply...))
+	if !spnego {
+		return client, reply, nil
+	}
+	resp, err := asn1.MarshalWithParams(negTokenResp{
+		NegState:      negStateAcceptCompleted,
+		SupportedMech: oidKRB5,
+		ResponseToken: reply,
+	}, "explicit,tag:1")
+	if err != nil {
+		return Principal{}, nil, err
+	}
+	return client, resp, nil
+}
+
+// acceptAPReq checks an AP-REQ and returns its client, and the AP-REP
+// when mutual authentication was requested
+func (a *Acceptor) acceptAPReq(b []byte) (Principal, []byte, error) {
+	var req apReq
+	if err := unmarshal(b, &req, tagAPReq); err != nil {
+		return Principal{}, nil, err
+	}
+	if req.PVNO != 5 || req.MsgType != msgTypeAPReq {
+		return Principal{}, nil, ErrMalformed
+	}
+	var tkt ticket
+	if err := unmarshal(req.Ticket.Bytes, &tkt, tagTicket); err != nil {
+		return Principal{}, nil, err
+	}
+
+	service := tkt.SName.principal(tkt.Realm)
+	serviceKey, ok := a.keytab.key(service, tkt.EncPart.EType, uint32(tkt.EncPart.KVNO))
+	if !ok {
+		return Principal{}, nil, ErrNoKey
+	}
+	plaintext, err := decrypt(serviceKey, usageTicket, tkt.EncPart.Cipher)
+	if err != nil {
+		return Principal{}, nil, err
+	}
+	var part encTicketPart
+	if err := unmarshal(plaintext, &part, tagEncTicketPart); err != nil {
+		return Principal{}, nil, err
+	}
+
+	sessionKey := Key{Type: part.Key.KeyType, Value: part.Key.KeyValue}
+	if plaintext, err = decrypt(sessionKey, usageAuthenticator, req.Authenticator.Cipher); err != nil {
+		return Principal{}, nil, err
+	}
+	var auth authenticator
+	if err := unmarshal(plaintext, &auth, tagAuthenticator); err != nil {
+		return Principal{}, nil, err
+	}
+
+	client := part.CName.principal(part.CRealm)
+	if !auth.CName.principal(auth.CRealm).Equal(client) {
+		return Principal{}, nil, ErrIntegrity
+	}
+	now := a.Now()
+	start := part.AuthTime
+	if !part.StartTime.IsZero() {
+		start = part.StartTime
+	}
+	if now.Before(start.Add(-a.MaxSkew)) || now.After(part.EndTime.Add(a.MaxSkew)) {
+		return Principal{}, nil, ErrTicketExpired
+	}
+	ctime := auth.CTime.Add(time.Duration(auth.Cusec) * time.Microsecond)
+	if ctime.Before(now.Add(-a.MaxSkew)) || ctime.After(now.Add(a.MaxSkew)) {
+		return Principal{}, nil, ErrClockSkew
+	}
+	if a.replayed(client, ctime, now) {
+		return Principal{}, nil, ErrReplay
+	}
+
+	if !hasBit(req.APOptions, apOptionMutualRequired) {
+		return client, nil, nil
+	}
+	reply, err := a.apRep(sessionKey, auth)
+	if err != nil {
+		return Principal{}, nil, err
+	}
+	return client, reply, nil
+}
+
+// replayed records an authenticator and reports whether it was seen
+// before. Authenticators are only accepted within MaxSkew of now, so they
+// are forgotten after that.
+func (a *Acceptor) replayed(client Principal, ctime, now time.Time) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for key, at := range a.seen {
+		if now.Sub(at) > 2*a.MaxSkew {
+			delete(a.seen, key)
+		}
+	}
+	key := client.String() + " " + ctime.UTC().Format(time.RFC3339Nano)
+	if _, ok := a.seen[key]; ok {
+		return true
+	}
+	a.seen[key] = now
+	return false
+}
+
+// apRep proves to the client that the service read its ticket, by
+// encrypting the authenticator's time with the session key
+func (a *Acceptor) apRep(sessionKey Key, auth authenticator) ([]byte, error) {
+	part, err := asn1.MarshalWithParams(encAPRepPart{CTime: auth.CTime, Cusec: auth.Cusec, SeqNumber: auth.SeqNumber}, tagEncAPRepPart)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := encrypt(sessionKey, usageAPRepPart, part)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.MarshalWithParams(apRep{
+		PVNO:    5,
+		MsgType: msgTypeAPRep,
+		EncPart: encryptedData{EType: sessionKey.Type, Cipher: cipher},
+	}, tagAPRep)
+}
+
+// NewInitiatorToken builds the SPNEGO token a client sends after getting
+// a ticket for service from its KDC. It stands in for the KDC and the
+// client, so it needs the service's key; it is for tests and tools that
+// check a service's configuration.
+func NewInitiatorToken(service Principal, kvno uint32, serviceKey Key, client Principal, now time.Time) ([]byte, error) {
+	sessionKey, err := NewKey(serviceKey.Type)
+	if err != nil {
+		return nil, err
+	}
+	now = now.UTC().Truncate(time.Second)
+
+	part, err := asn1.MarshalWithParams(encTicketPart{
+		Flags:     asn1.BitString{Bytes: make([]byte, 4), BitLength: 32},
+		Key:       encryptionKey{KeyType: sessionKey.Type, KeyValue: sessionKey.Value},
+		CRealm:    taggedString(2, client.Realm),
+		CName:     newPrincipalName(client),
+		Transited: transitedEncoding{Contents: []byte{}},
+		AuthTime:  now,
+		EndTime:   now.Add(10 * time.Hour),
+	}, tagEncTicketPart)
+	if err != nil {
+		return nil, err
+	}
+	ticketCipher, err := encrypt(serviceKey, usageTicket, part)
+	if err != nil {
+		return nil, err
+	}
+	tkt, err := asn1.MarshalWithParams(ticket{
+		TktVNO:  5,
+		Realm:   taggedString(1, service.Realm),
+		SName:   newPrincipalName(service),
+		EncPart: encryptedData{EType: serviceKey.Type, KVNO: int(kvno), Cipher: ticketCipher},
+	}, tagTicket)
+	if err != nil {
+		return nil, err
+	}
+
+	var cusec [4]byte
+	if _, err := rand.Read(cusec[:]); err != nil {
+		return nil, errors.New("kerberos: failed to read random bytes")
+	}
+	auth, err := asn1.MarshalWithParams(authenticator{
+		AVNO:   5,
+		CRealm: taggedString(1, client.Realm),
+		CName:  newPrincipalName(client),
+		Cusec:  int(binary.BigEndian.Uint32(cusec[:]) % 1000000),
+		CTime:  now,
+	}, tagAuthenticator)
+	if err != nil {
+		return nil, err
+	}
+	authCipher, err := encrypt(sessionKey, usageAuthenticator, auth)
+	if err != nil {
+		return nil, err
+	}
+	options := asn1.BitString{Bytes: make([]byte, 4), BitLength: 32}
+	options.Bytes[0] = 0x80 >> apOptionMutualRequired
+	req, err := asn1.MarshalWithParams(apReq{
+		PVNO:          5,
+		MsgType:       msgTypeAPReq,
+		APOptions:     options,
+		Ticket:        tagged(3, tkt),
+		Authenticator: encryptedData{EType: sessionKey.Type, Cipher: authCipher},
+	}, tagAPReq)
+	if err != nil {
+		return nil, err
+	}
+
+	mechToken := wrapGSS(oidKRB5, append(append([]byte{}, tokenIDAPReq...), req...))
+	init, err := asn1.MarshalWithParams(negTokenInit{
+		MechTypes: []asn1.ObjectIdentifier{oidKRB5},
+		MechToken: mechToken,
+	}, "explicit,tag:0")
+	if err != nil {
+		return nil, err
+	}
+	return wrapGSS(oidSPNEGO, init), nil
+}
+
+func isKerberos(mech asn1.ObjectIdentifier) bool {
+	return mech.Equal(oidKRB5) || mech.Equal(oidMSKRB5)
+}
+
+func hasBit(bits asn1.BitString, i int) bool {
+	return i < bits.BitLength && bits.At(i) == 1
+}
+
+// unwrapGSS splits a GSS-API initial context token (RFC 2743 section
+// 3.1) into its mechanism and the mechanism's own token
+func unwrapGSS(token []byte) (asn1.ObjectIdentifier, []byte, error) {
+	var outer asn1.RawValue
+	if rest, err := asn1.Unmarshal(token, &outer); err != nil || len(rest) > 0 {
+		return nil, nil, ErrMalformed
+	}
+	if outer.Class != asn1.ClassApplication || outer.Tag != 0 || !outer.IsCompound {
+		return nil, nil, ErrMalformed
+	}
+	var mech asn1.ObjectIdentifier
+	inner, err := asn1.Unmarshal(outer.Bytes, &mech)
+	if err != nil {
+		return nil, nil, ErrMalformed
+	}
+	return mech, inner, nil
+}
+
+func wrapGSS(mech asn1.ObjectIdentifier, inner []byte) []byte {
+	oid, _ := asn1.Marshal(mech)
+	token, _ := asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassApplication,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      append(oid, inner...),
+	})
+	return token
+}
@@ -0,0 +1,126 @@
+package kerberos
+
+import (
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testdata/negotiate.txt is an SPNEGO token for alice@CORP.EXAMPLE to
+// testdata/http.keytab's service, made by testdata/generate.py with these
+// times and session key
+var (
+	negotiateAuthTime   = time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	negotiateCTime      = negotiateAuthTime.Add(5 * time.Second)
+	negotiateSessionKey = Key{Type: AES256CTSHMACSHA196, Value: []byte{
+		0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27, 0x28, 0x29, 0x2a, 0x2b, 0x2c, 0x2d, 0x2e, 0x2f,
+		0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x3b, 0x3c, 0x3d, 0x3e, 0x3f,
+	}}
+)
+
+func readNegotiateToken(t *testing.T) []byte {
+	t.Helper()
+	b, err := os.ReadFile("testdata/negotiate.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func newTestAcceptor(t *testing.T, now time.Time) *Acceptor {
+	t.Helper()
+	acceptor := NewAcceptor(readKeytab(t))
+	acceptor.Now = func() time.Time { return now }
+	return acceptor
+}
+
+func TestAcceptFixture(t *testing.T) {
+	acceptor := newTestAcceptor(t, negotiateAuthTime.Add(time.Minute))
+	client, reply, err := acceptor.Accept(readNegotiateToken(t))
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if client.String() != "alice@CORP.EXAMPLE" {
+		t.Errorf("client = %s, want alice@CORP.EXAMPLE", client)
+	}
+
+	// The client asked for mutual authentication, so the reply must carry
+	// its authenticator's time encrypted with the session key
+	var resp negTokenResp
+	if err := unmarshal(reply, &resp, "explicit,tag:1"); err != nil {
+		t.Fatalf("reply is not a NegTokenResp: %v", err)
+	}
+	if resp.NegState != negStateAcceptCompleted || !resp.SupportedMech.Equal(oidKRB5) {
+		t.Errorf("reply has state %d and mechanism %v", resp.NegState, resp.SupportedMech)
+	}
+	mech, inner, err := unwrapGSS(resp.ResponseToken)
+	if err != nil || !mech.Equal(oidKRB5) || len(inner) < 2 || inner[0] != 0x02 || inner[1] != 0x00 {
+		t.Fatalf("response token is not a Kerberos AP-REP: %x", resp.ResponseToken)
+	}
+	var rep apRep
+	if err := unmarshal(inner[2:], &rep, tagAPRep); err != nil {
+		t.Fatalf("AP-REP: %v", err)
+	}
+	plaintext, err := decrypt(negotiateSessionKey, usageAPRepPart, rep.EncPart.Cipher)
+	if err != nil {
+		t.Fatalf("decrypting the AP-REP: %v", err)
+	}
+	var part encAPRepPart
+	if err := unmarshal(plaintext, &part, tagEncAPRepPart); err != nil {
+		t.Fatalf("EncAPRepPart: %v", err)
+	}
+	if !part.CTime.Equal(negotiateCTime) || part.Cusec != 123456 || part.SeqNumber != 0x2a1b3c4d {
+		t.Errorf("AP-REP has ctime %s, cusec %d and sequence number %#x", part.CTime, part.Cusec, part.SeqNumber)
+	}
+
+	if _, _, err := acceptor.Accept(readNegotiateToken(t)); !errors.Is(err, ErrReplay) {
+		t.Errorf("second use: got %v, want ErrReplay", err)
+	}
+}
+
+func TestAcceptFixtureRejected(t *testing.T) {
+	token := readNegotiateToken(t)
+
+	if _, _, err := newTestAcceptor(t, negotiateAuthTime.Add(11*time.Hour)).Accept(token); !errors.Is(err, ErrTicketExpired) {
+		t.Errorf("after the ticket's end time: got %v, want ErrTicketExpired", err)
+	}
+	if _, _, err := newTestAcceptor(t, negotiateAuthTime.Add(time.Hour)).Accept(token); !errors.Is(err, ErrClockSkew) {
+		t.Errorf("an hour after the authenticator: got %v, want ErrClockSkew", err)
+	}
+
+	// The last bytes are the authenticator's MAC
+	tampered := append([]byte{}, token...)
+	tampered[len(tampered)-1] ^= 1
+	if _, _, err := newTestAcceptor(t, negotiateAuthTime.Add(time.Minute)).Accept(tampered); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("tampered authenticator: got %v, want ErrIntegrity", err)
+	}
+
+	other := NewAcceptor(&Keytab{})
+	other.Now = func() time.Time { return negotiateAuthTime.Add(time.Minute) }
+	if _, _, err := other.Accept(token); !errors.Is(err, ErrNoKey) {
+		t.Errorf("empty keytab: got %v, want ErrNoKey", err)
+	}
+}
+
+func TestAcceptOtherMechanism(t *testing.T) {
+	ntlm := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 10}
+	init, err := asn1.MarshalWithParams(negTokenInit{
+		MechTypes: []asn1.ObjectIdentifier{ntlm, oidKRB5},
+		MechToken: []byte("NTLMSSP\x00"),
+	}, "explicit,tag:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = newTestAcceptor(t, time.Now()).Accept(wrapGSS(oidSPNEGO, init))
+	if !errors.Is(err, ErrUnsupportedMechanism) {
+		t.Errorf("NTLM token: got %v, want ErrUnsupportedMechanism", err)
+	}
+}
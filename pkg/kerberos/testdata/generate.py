@@ -0,0 +1,254 @@
+#!/usr/bin/env python3
+"""Writes the keytab and Negotiate token the kerberos package tests read.
+
+The fixtures are built here, with Python's standard library and the openssl
+command line tool for AES, so that the tests check the package against an
+implementation that shares none of its code. The keytab is what
+
+    ktutil: addent -password -p HTTP/intranet.corp.example@CORP.EXAMPLE -k 3 -e aes256-cts-hmac-sha1-96
+    ktutil: addent -password -p HTTP/intranet.corp.example@CORP.EXAMPLE -k 3 -e aes128-cts-hmac-sha1-96
+    ktutil: wkt http.keytab
+
+writes for the password below, bar the timestamps. The token has the shape
+of the one a browser on a domain-joined machine sends: SPNEGO offering the
+Microsoft OID first, an authenticator with the GSS checksum, a subkey and a
+sequence number, and mutual authentication asked for. Every random value is
+fixed so the output is the same on each run.
+
+Run it from this directory: python3 generate.py
+"""
+
+import base64
+import hashlib
+import hmac
+import math
+import struct
+import subprocess
+import time
+
+REALM = "CORP.EXAMPLE"
+SERVICE = ["HTTP", "intranet.corp.example"]
+CLIENT = ["alice"]
+PASSWORD = "Intranet-Keytab-2026"
+KVNO = 3
+ITERATIONS = 4096  # the RFC 3962 default MIT uses
+TIMESTAMP = 1772442000  # 2026-03-02T09:00:00Z
+
+AES128, AES256 = 17, 18
+SESSION_KEY = bytes(range(0x20, 0x40))
+SUBKEY = bytes(range(0x40, 0x60))
+
+# AES
+
+
+def aes(mode, key, data, iv=None):
+    cmd = ["openssl", "enc", "-aes-%d-%s" % (len(key) * 8, mode), "-nopad", "-K", key.hex()]
+    if iv is not None:
+        cmd += ["-iv", iv.hex()]
+    return subprocess.run(cmd, input=data, capture_output=True, check=True).stdout
+
+
+def nfold(data, size):
+    # RFC 3961 section 5.1, working on the whole input as one integer
+    bits = len(data) * 8
+    n = int.from_bytes(data, "big")
+    lcm = len(data) * size // math.gcd(len(data), size)
+    copies = []
+    for i in range(lcm // len(data)):
+        r = (13 * i) % bits
+        copies.append(((n >> r) | (n << (bits - r))) & ((1 << bits) - 1))
+    stream = b"".join(c.to_bytes(len(data), "big") for c in copies)
+    total = 0
+    modulus = (1 << (size * 8)) - 1
+    for i in range(0, lcm, size):
+        total += int.from_bytes(stream[i:i + size], "big")
+        while total > modulus:
+            total = (total & modulus) + (total >> (size * 8))
+    return total.to_bytes(size, "big")
+
+
+def dk(key, constant):
+    block = nfold(constant, 16)
+    out = b""
+    while len(out) < len(key):
+        block = aes("ecb", key, block)
+        out += block
+    return out[:len(key)]
+
+
+def string_to_key(password, salt, size):
+    tkey = hashlib.pbkdf2_hmac("sha1", password.encode(), salt.encode(), ITERATIONS, size)
+    return dk(tkey, b"kerberos")
+
+
+def cts_encrypt(key, data):
+    if len(data) == 16:
+        return aes("ecb", key, data)
+    padded = data + b"\0" * (-len(data) % 16)
+    out = aes("cbc", key, padded, iv=b"\0" * 16)
+    last = len(data) - (len(out) - 16)
+    return out[:-32] + out[-16:] + out[-32:-32 + last]
+
+
+def encrypt(key, usage, plaintext, confounder):
+    ke = dk(key, struct.pack(">I", usage) + b"\xaa")
+    ki = dk(key, struct.pack(">I", usage) + b"\x55")
+    data = confounder + plaintext
+    mac = hmac.new(ki, data, hashlib.sha1).digest()[:12]
+    return cts_encrypt(ke, data) + mac
+
+
+# DER
+
+
+def tlv(tag, body):
+    n = len(body)
+    if n < 0x80:
+        length = bytes([n])
+    else:
+        raw = n.to_bytes((n.bit_length() + 7) // 8, "big")
+        length = bytes([0x80 | len(raw)]) + raw
+    return bytes([tag]) + length + body
+
+
+def seq(*items):
+    return tlv(0x30, b"".join(items))
+
+
+def ctx(n, body):
+    return tlv(0xA0 | n, body)
+
+
+def app(n, body):
+    return tlv(0x60 | n, body)
+
+
+def integer(v):
+    return tlv(0x02, v.to_bytes(max(1, (v.bit_length() + 8) // 8), "big", signed=True))
+
+
+def octets(b):
+    return tlv(0x04, b)
+
+
+def gstring(s):
+    return tlv(0x1B, s.encode())
+
+
+def gtime(t):
+    return tlv(0x18, time.strftime("%Y%m%d%H%M%SZ", time.gmtime(t)).encode())
+
+
+def bits(b):
+    return tlv(0x03, b"\0" + b)
+
+
+def oid(*arcs):
+    body = bytes([40 * arcs[0] + arcs[1]])
+    for arc in arcs[2:]:
+        chunk = [arc & 0x7F]
+        arc >>= 7
+        while arc:
+            chunk.insert(0, 0x80 | (arc & 0x7F))
+            arc >>= 7
+        body += bytes(chunk)
+    return tlv(0x06, body)
+
+
+def principal_name(components):
+    return seq(ctx(0, integer(1)), ctx(1, seq(*[gstring(c) for c in components])))
+
+
+def encryption_key(etype, value):
+    return seq(ctx(0, integer(etype)), ctx(1, octets(value)))
+
+
+def encrypted_data(etype, cipher, kvno=None):
+    fields = [ctx(0, integer(etype))]
+    if kvno is not None:
+        fields.append(ctx(1, integer(kvno)))
+    fields.append(ctx(2, octets(cipher)))
+    return seq(*fields)
+
+
+OID_SPNEGO = oid(1, 3, 6, 1, 5, 5, 2)
+OID_KRB5 = oid(1, 2, 840, 113554, 1, 2, 2)
+OID_MS_KRB5 = oid(1, 2, 840, 48018, 1, 2, 2)
+
+
+def keytab(keys):
+    out = struct.pack(">H", 0x0502)
+    for etype, value in keys:
+        entry = struct.pack(">H", len(SERVICE))
+        for s in [REALM] + SERVICE:
+            entry += struct.pack(">H", len(s)) + s.encode()
+        entry += struct.pack(">IIBH", 1, TIMESTAMP, KVNO, etype)
+        entry += struct.pack(">H", len(value)) + value
+        entry += struct.pack(">I", KVNO)
+        out += struct.pack(">i", len(entry)) + entry
+    return out
+
+
+def negotiate_token(service_key):
+    auth_time = TIMESTAMP
+    # forwardable, renewable, initial, pre-authent
+    flags = bytes([0x40, 0xE1, 0x00, 0x00])
+    enc_ticket_part = app(3, seq(
+        ctx(0, bits(flags)),
+        ctx(1, encryption_key(AES256, SESSION_KEY)),
+        ctx(2, gstring(REALM)),
+        ctx(3, principal_name(CLIENT)),
+        ctx(4, seq(ctx(0, integer(1)), ctx(1, octets(b"")))),
+        ctx(5, gtime(auth_time)),
+        ctx(6, gtime(auth_time)),
+        ctx(7, gtime(auth_time + 10 * 3600)),
+        ctx(8, gtime(auth_time + 7 * 24 * 3600)),
+    ))
+    ticket = app(1, seq(
+        ctx(0, integer(5)),
+        ctx(1, gstring(REALM)),
+        ctx(2, principal_name(SERVICE)),
+        ctx(3, encrypted_data(AES256, encrypt(service_key, 2, enc_ticket_part, b"T" * 16), KVNO)),
+    ))
+
+    # RFC 4121 section 4.1.1: channel binding hash, then the context
+    # flags mutual, replay, sequence, confidentiality and integrity
+    checksum = struct.pack("<I", 16) + b"\0" * 16 + struct.pack("<I", 0x3E)
+    authenticator = app(2, seq(
+        ctx(0, integer(5)),
+        ctx(1, gstring(REALM)),
+        ctx(2, principal_name(CLIENT)),
+        ctx(3, seq(ctx(0, integer(0x8003)), ctx(1, octets(checksum)))),
+        ctx(4, integer(123456)),
+        ctx(5, gtime(auth_time + 5)),
+        ctx(6, encryption_key(AES256, SUBKEY)),
+        ctx(7, integer(0x2A1B3C4D)),
+    ))
+    ap_req = app(14, seq(
+        ctx(0, integer(5)),
+        ctx(1, integer(14)),
+        ctx(2, bits(bytes([0x20, 0, 0, 0]))),  # mutual-required
+        ctx(3, ticket),
+        ctx(4, encrypted_data(AES256, encrypt(SESSION_KEY, 11, authenticator, b"A" * 16))),
+    ))
+
+    mech_token = app(0, OID_KRB5 + b"\x01\x00" + ap_req)
+    init = ctx(0, seq(
+        ctx(0, seq(OID_MS_KRB5, OID_KRB5)),
+        ctx(2, octets(mech_token)),
+    ))
+    return app(0, OID_SPNEGO + init)
+
+
+def main():
+    salt = REALM + "".join(SERVICE)
+    aes256 = string_to_key(PASSWORD, salt, 32)
+    aes128 = string_to_key(PASSWORD, salt, 16)
+    with open("http.keytab", "wb") as f:
+        f.write(keytab([(AES256, aes256), (AES128, aes128)]))
+    with open("negotiate.txt", "w") as f:
+        f.write(base64.b64encode(negotiate_token(aes256)).decode() + "\n")
+
+
+if __name__ == "__main__":
+    main()
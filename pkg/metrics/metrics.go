@@ -0,0 +1,217 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	value atomic.Uint64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add adds n to the counter
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+// Value returns the current count
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+// Set replaces the gauge value
+func (g *Gauge) Set(value float64) {
+	g.bits.Store(math.Float64bits(value))
+}
+
+// Value returns the current gauge value
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	mutex   sync.Mutex
+	bounds  []float64 // upper bounds, ascending
+	counts  []uint64  // per bucket, plus one for +Inf
+	sum     float64
+	samples uint64
+}
+
+// Observe records one value
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	i := sort.SearchFloat64s(h.bounds, value)
+	h.counts[i]++
+	h.sum += value
+	h.samples++
+}
+
+// gaugeFunc is a gauge computed when the metrics are written
+type gaugeFunc func() float64
+
+type family struct {
+	help   string
+	kind   string
+	series map[string]interface{} // formatted label set -> *Counter, *Gauge, *Histogram or gaugeFunc
+	labels map[string][]string    // formatted label set -> its key/value pairs
+}
+
+// Registry holds named metrics and renders them in the Prometheus text
+// exposition format
+type Registry struct {
+	mutex    sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Counter returns the counter for name and the given label key/value pairs,
+// creating it on first use
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return r.metric(name, help, "counter", labels, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+// Gauge returns the gauge for name and the given label key/value pairs,
+// creating it on first use
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return r.metric(name, help, "gauge", labels, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+// GaugeFunc registers a gauge for name and the given label key/value pairs
+// whose value is computed by fn each time the metrics are written. The
+// first function registered for a label set is kept.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64, labels ...string) {
+	r.metric(name, help, "gauge", labels, func() interface{} { return gaugeFunc(fn) })
+}
+
+// Histogram returns the histogram for name and the given label key/value
+// pairs, creating it with the given ascending bucket upper bounds on first
+// use
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return r.metric(name, help, "histogram", labels, func() interface{} {
+		return &Histogram{bounds: buckets, counts: make([]uint64, len(buckets)+1)}
+	}).(*Histogram)
+}
+
+func (r *Registry) metric(name, help, kind string, labels []string, create func() interface{}) interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{help: help, kind: kind, series: make(map[string]interface{}), labels: make(map[string][]string)}
+		r.families[name] = f
+	}
+	if f.kind != kind {
+		panic(fmt.Sprintf("metrics: %s registered as %s, not %s", name, f.kind, kind))
+	}
+
+	key := formatLabels(labels)
+	m, ok := f.series[key]
+	if !ok {
+		m = create()
+		f.series[key] = m
+		f.labels[key] = labels
+	}
+	return m
+}
+
+// WriteText writes every metric in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		f := r.families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, f.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			switch m := f.series[key].(type) {
+			case *Counter:
+				fmt.Fprintf(&b, "%s%s %d\n", name, key, m.Value())
+			case *Gauge:
+				fmt.Fprintf(&b, "%s%s %s\n", name, key, formatFloat(m.Value()))
+			case gaugeFunc:
+				fmt.Fprintf(&b, "%s%s %s\n", name, key, formatFloat(m()))
+			case *Histogram:
+				writeHistogram(&b, name, key, f.labels[key], m)
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeHistogram writes the cumulative buckets, sum and count of h
+func writeHistogram(b *strings.Builder, name, key string, labels []string, h *Histogram) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var cumulative uint64
+	for i, count := range h.counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = formatFloat(h.bounds[i])
+		}
+		withLE := append(append([]string{}, labels[:len(labels)&^1]...), "le", le)
+		fmt.Fprintf(b, "%s_bucket%s %d\n", name, formatLabels(withLE), cumulative)
+	}
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, key, formatFloat(h.sum))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, key, h.samples)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// formatLabels renders key/value pairs as {k="v",...}; an odd trailing key
+// is ignored
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// Window counts good and bad events over a sliding span of time, split
+// into slots so old events fall out a slot at a time. It is safe for
+// concurrent use.
+type Window struct {
+	mutex sync.Mutex
+	slot  time.Duration
+	slots []windowSlot
+}
+
+type windowSlot struct {
+	index     int64 // which slot of time the counts belong to
+	good, bad uint64
+}
+
+// NewWindow creates a window covering span in the given number of slots
+func NewWindow(span time.Duration, slots int) *Window {
+	slot := span / time.Duration(slots)
+	if slot <= 0 {
+		slot = 1
+	}
+	return &Window{slot: slot, slots: make([]windowSlot, slots)}
+}
+
+// Observe records an event at now
+func (w *Window) Observe(now time.Time, good bool) {
+	index := now.UnixNano() / int64(w.slot)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	s := &w.slots[index%int64(len(w.slots))]
+	if s.index != index {
+		*s = windowSlot{index: index}
+	}
+	if good {
+		s.good++
+	} else {
+		s.bad++
+	}
+}
+
+// Counts returns how many good and bad events were observed in the span
+// up to now
+func (w *Window) Counts(now time.Time) (good, bad uint64) {
+	index := now.UnixNano() / int64(w.slot)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, s := range w.slots {
+		if s.index > index-int64(len(w.slots)) && s.index <= index {
+			good += s.good
+			bad += s.bad
+		}
+	}
+	return good, bad
+}
@@ -0,0 +1,296 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// minRSAKeyBits is the smallest RSA key ID tokens may be signed with
+const minRSAKeyBits = 2048
+
+var (
+	// ErrUnsupportedAlgorithm is returned for tokens signed with another
+	// algorithm, including "none", and for keys of other types
+	ErrUnsupportedAlgorithm = errors.New("oidc: unsupported signing algorithm")
+	// ErrUnknownKey is returned when the key set has no key for the token;
+	// the provider may have rotated its keys
+	ErrUnknownKey = errors.New("oidc: no key for token")
+	// ErrInvalidSignature is returned when the signature does not verify
+	ErrInvalidSignature = errors.New("oidc: invalid token signature")
+	// ErrExpired is returned for tokens used outside their lifetime
+	ErrExpired = errors.New("oidc: token expired or not yet valid")
+	// ErrAudience is returned for tokens issued to another client
+	ErrAudience = errors.New("oidc: token issued to another client")
+	// ErrNonce is returned when the token's nonce is not the one sent in
+	// the authorization request
+	ErrNonce = errors.New("oidc: nonce mismatch")
+)
+
+// algorithms maps the accepted JWS algorithms to their hash and whether
+// they are RSA-PSS
+var algorithms = map[string]struct {
+	hash crypto.Hash
+	pss  bool
+}{
+	"RS256": {crypto.SHA256, false},
+	"RS384": {crypto.SHA384, false},
+	"RS512": {crypto.SHA512, false},
+	"PS256": {crypto.SHA256, true},
+	"ES256": {crypto.SHA256, false},
+}
+
+// Key is a verification key from a provider's key set
+type Key struct {
+	ID string
+	// Algorithm is the key's alg, when the key set names it
+	Algorithm string
+	Public    crypto.PublicKey
+}
+
+// KeySet is a provider's verification keys
+type KeySet []Key
+
+// jwk is a JSON Web Key (RFC 7517) of type RSA or EC
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseKeySet reads a JWKS document. Keys for encryption and of types
+// other than RSA and EC P-256 are skipped.
+func ParseKeySet(data []byte) (KeySet, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	var keys KeySet
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		public, err := k.publicKey()
+		if errors.Is(err, ErrUnsupportedAlgorithm) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, Key{ID: k.Kid, Algorithm: k.Alg, Public: public})
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, ErrMalformed
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < minRSAKeyBits {
+			return nil, ErrUnsupportedAlgorithm
+		}
+		return key, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, ErrUnsupportedAlgorithm
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != 32 {
+			return nil, ErrMalformed
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil || len(y) != 32 {
+			return nil, ErrMalformed
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, ErrMalformed
+		}
+		return key, nil
+	}
+	return nil, ErrUnsupportedAlgorithm
+}
+
+// find returns the keys a token with the header's kid and alg may be
+// signed with: the key with the kid, or when the token has none, every
+// key of the algorithm's type
+func (ks KeySet) find(kid, alg string) []Key {
+	var found []Key
+	for _, key := range ks {
+		if kid != "" && key.ID != kid {
+			continue
+		}
+		if key.Algorithm != "" && key.Algorithm != alg {
+			continue
+		}
+		_, isEC := key.Public.(*ecdsa.PublicKey)
+		if isEC != (alg == "ES256") {
+			continue
+		}
+		found = append(found, key)
+	}
+	return found
+}
+
+// stringList is a claim such as aud that is a string or an array of them
+type stringList []string
+
+func (a *stringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*a = stringList{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// IDToken holds the verified claims of an ID token
+type IDToken struct {
+	Issuer          string     `json:"iss"`
+	Subject         string     `json:"sub"`
+	Audience        stringList `json:"aud"`
+	AuthorizedParty string     `json:"azp"`
+	ExpiresAt       int64      `json:"exp"`
+	IssuedAt        int64      `json:"iat"`
+	NotBefore       int64      `json:"nbf"`
+	Nonce           string     `json:"nonce"`
+
+	Email         string     `json:"email"`
+	EmailVerified bool       `json:"email_verified"`
+	Name          string     `json:"name"`
+	Groups        stringList `json:"groups"`
+}
+
+// Verifier checks ID tokens issued to ClientID by Issuer
+type Verifier struct {
+	Issuer   string
+	ClientID string
+	Keys     KeySet
+	// MaxSkew is how far the provider's clock may be from ours
+	MaxSkew time.Duration
+}
+
+// Verify checks token's signature, issuer, audience, lifetime at now and
+// nonce, returning its claims
+func (v Verifier) Verify(token, nonce string, now time.Time) (IDToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return IDToken{}, ErrMalformed
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return IDToken{}, ErrMalformed
+	}
+	algorithm, ok := algorithms[header.Alg]
+	if !ok {
+		return IDToken{}, ErrUnsupportedAlgorithm
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return IDToken{}, ErrMalformed
+	}
+
+	keys := v.Keys.find(header.Kid, header.Alg)
+	if len(keys) == 0 {
+		return IDToken{}, ErrUnknownKey
+	}
+	hasher := algorithm.hash.New()
+	hasher.Write([]byte(parts[0] + "." + parts[1]))
+	digest := hasher.Sum(nil)
+	verified := false
+	for _, key := range keys {
+		verified = verified || verifySignature(key.Public, algorithm.hash, algorithm.pss, digest, signature)
+	}
+	if !verified {
+		return IDToken{}, ErrInvalidSignature
+	}
+
+	var claims IDToken
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return IDToken{}, ErrMalformed
+	}
+	if claims.Issuer != v.Issuer {
+		return IDToken{}, ErrIssuerMismatch
+	}
+	if !slices.Contains(claims.Audience, v.ClientID) {
+		return IDToken{}, ErrAudience
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != "" && claims.AuthorizedParty != v.ClientID {
+		return IDToken{}, ErrAudience
+	}
+	if claims.ExpiresAt == 0 || !now.Add(-v.MaxSkew).Before(time.Unix(claims.ExpiresAt, 0)) {
+		return IDToken{}, ErrExpired
+	}
+	if claims.NotBefore != 0 && now.Add(v.MaxSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return IDToken{}, ErrExpired
+	}
+	if claims.Nonce != nonce {
+		return IDToken{}, ErrNonce
+	}
+	if claims.Subject == "" {
+		return IDToken{}, ErrMalformed
+	}
+	return claims, nil
+}
+
+func verifySignature(public crypto.PublicKey, hash crypto.Hash, pss bool, digest, signature []byte) bool {
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		if pss {
+			return rsa.VerifyPSS(key, hash, digest, signature, nil) == nil
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS uses the fixed-width r || s encoding rather than ASN.1
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
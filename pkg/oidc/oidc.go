@@ -0,0 +1,207 @@
+// Package oidc is the relying party side of OpenID Connect: reading a
+// provider's discovery document and key set, sending users to its
+// authorization endpoint with the authorization code flow and PKCE,
+// redeeming the code and verifying the ID token that comes back. ID
+// tokens signed with RS256, RS384, RS512, PS256 or ES256 are accepted.
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxDocumentSize bounds discovery documents, key sets and token
+// responses read from a provider
+const maxDocumentSize = 1 << 20
+
+var (
+	// ErrMalformed is returned for documents and tokens that cannot be parsed
+	ErrMalformed = errors.New("oidc: malformed document")
+	// ErrIssuerMismatch is returned for a discovery document or ID token
+	// from an issuer other than the expected one
+	ErrIssuerMismatch = errors.New("oidc: issuer mismatch")
+)
+
+// Provider is what the relying party needs from a provider's discovery
+// document (OpenID Connect Discovery 1.0)
+type Provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// ParseDiscovery reads a discovery document, checking that it has the
+// endpoints the code flow uses
+func ParseDiscovery(data []byte) (Provider, error) {
+	var provider Provider
+	if err := json.Unmarshal(data, &provider); err != nil {
+		return Provider{}, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	for name, endpoint := range map[string]string{
+		"issuer":                 provider.Issuer,
+		"authorization_endpoint": provider.AuthorizationEndpoint,
+		"token_endpoint":         provider.TokenEndpoint,
+		"jwks_uri":               provider.JWKSURI,
+	} {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return Provider{}, fmt.Errorf("%w: %s is not a URL", ErrMalformed, name)
+		}
+	}
+	return provider, nil
+}
+
+// Discover fetches the discovery document of issuer, which must name
+// itself as the issuer
+func Discover(ctx context.Context, client *http.Client, issuer string) (Provider, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	data, err := get(ctx, client, issuer+"/.well-known/openid-configuration")
+	if err != nil {
+		return Provider{}, err
+	}
+	provider, err := ParseDiscovery(data)
+	if err != nil {
+		return Provider{}, err
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != issuer {
+		return Provider{}, ErrIssuerMismatch
+	}
+	return provider, nil
+}
+
+// FetchKeys fetches the provider's key set
+func FetchKeys(ctx context.Context, client *http.Client, provider Provider) (KeySet, error) {
+	data, err := get(ctx, client, provider.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeySet(data)
+}
+
+// Challenge returns the S256 PKCE code challenge for verifier
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthRequest is an authorization request of the code flow
+type AuthRequest struct {
+	ClientID    string
+	RedirectURI string
+	// State comes back with the code; Nonce comes back in the ID token
+	State string
+	Nonce string
+	// Verifier is the PKCE code verifier, sent as its S256 challenge
+	Verifier string
+	// LoginHint is the user's email, so the provider can skip asking
+	LoginHint string
+	// Scopes are requested besides openid
+	Scopes []string
+}
+
+// AuthorizationURL returns the provider's authorization endpoint with the
+// request in its query
+func (p Provider) AuthorizationURL(req AuthRequest) string {
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {req.ClientID},
+		"redirect_uri":          {req.RedirectURI},
+		"scope":                 {strings.Join(append([]string{"openid"}, req.Scopes...), " ")},
+		"state":                 {req.State},
+		"nonce":                 {req.Nonce},
+		"code_challenge":        {Challenge(req.Verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	if req.LoginHint != "" {
+		query.Set("login_hint", req.LoginHint)
+	}
+	separator := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.AuthorizationEndpoint + separator + query.Encode()
+}
+
+// TokenError is an error response of the token endpoint (RFC 6749
+// section 5.2)
+type TokenError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *TokenError) Error() string {
+	if e.Description == "" {
+		return "oidc: token endpoint: " + e.Code
+	}
+	return "oidc: token endpoint: " + e.Code + ": " + e.Description
+}
+
+// Exchange redeems an authorization code at the provider's token endpoint,
+// authenticating with the client secret (client_secret_basic), and returns
+// the ID token
+func (p Provider) Exchange(ctx context.Context, client *http.Client, clientID, clientSecret, redirectURI, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDocumentSize))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		tokenErr := &TokenError{}
+		if json.Unmarshal(data, tokenErr) != nil || tokenErr.Code == "" {
+			return "", fmt.Errorf("oidc: token endpoint: unexpected status %d", resp.StatusCode)
+		}
+		return "", tokenErr
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(data, &tokens); err != nil || tokens.IDToken == "" {
+		return "", fmt.Errorf("%w: token response has no id_token", ErrMalformed)
+	}
+	return tokens.IDToken, nil
+}
+
+func get(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: fetching %s: unexpected status %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxDocumentSize))
+}
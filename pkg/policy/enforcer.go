@@ -0,0 +1,305 @@
+package policy
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// maxRoleDepth bounds how far role inheritance is followed
+const maxRoleDepth = 10
+
+// Rule is a policy line: a "p" rule with the fields of the model's policy
+// definition, or a "g" rule giving the first value the role in the second
+type Rule struct {
+	Type   string
+	Values []string
+}
+
+// Attributes describe a request value to matchers, which read them as
+// r.sub.verified for the attribute "verified" of the "sub" field
+type Attributes map[string]string
+
+// ParseRule parses a rule written as comma-separated values, e.g.
+// "p, support, users, read". A value containing commas is written in
+// double quotes, doubling any quotes inside.
+func ParseRule(line string) (Rule, error) {
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.TrimLeadingSpace = true
+	reader.LazyQuotes = true
+	parts, err := reader.Read()
+	if err != nil {
+		return Rule{}, fmt.Errorf("policy: rule %q: %w", line, err)
+	}
+	rule := Rule{Type: strings.TrimSpace(parts[0])}
+	for _, value := range parts[1:] {
+		rule.Values = append(rule.Values, strings.TrimSpace(value))
+	}
+	if rule.Type != "p" && rule.Type != "g" {
+		return Rule{}, fmt.Errorf("policy: rule %q is neither a p nor a g rule", line)
+	}
+	return rule, nil
+}
+
+// String writes the rule the way ParseRule reads it
+func (r Rule) String() string {
+	values := []string{r.Type}
+	for _, value := range r.Values {
+		if strings.ContainsAny(value, ",\n") || strings.HasPrefix(value, `"`) {
+			value = `"` + strings.ReplaceAll(value, `"`, `""`) + `"`
+		}
+		values = append(values, value)
+	}
+	return strings.Join(values, ", ")
+}
+
+// LoadRules reads one rule per line, ignoring blank lines and lines
+// starting with #
+func LoadRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// Enforcer decides requests against a model and a set of rules, which can
+// be replaced while it is in use
+type Enforcer struct {
+	model *Model
+
+	mutex sync.RWMutex
+	rules []Rule
+	roles map[string][]string
+	// conditions holds each rule's compiled eval conditions by field
+	conditions [][]*node
+}
+
+// NewEnforcer creates an enforcer for model with rules
+func NewEnforcer(model *Model, rules []Rule) (*Enforcer, error) {
+	e := &Enforcer{model: model}
+	if err := e.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Model returns the enforcer's model
+func (e *Enforcer) Model() *Model {
+	return e.model
+}
+
+// SetRules replaces the rules. Nothing changes when any rule does not fit
+// the model.
+func (e *Enforcer) SetRules(rules []Rule) error {
+	roles := make(map[string][]string)
+	normalized := make([]Rule, 0, len(rules))
+	conditions := make([][]*node, 0, len(rules))
+	for _, rule := range rules {
+		rule, err := e.model.normalize(rule)
+		if err != nil {
+			return err
+		}
+		if rule.Type == "g" {
+			roles[rule.Values[0]] = append(roles[rule.Values[0]], rule.Values[1])
+		}
+		compiled, err := e.model.conditions(rule)
+		if err != nil {
+			return err
+		}
+		normalized = append(normalized, rule)
+		conditions = append(conditions, compiled)
+	}
+
+	e.mutex.Lock()
+	e.rules = normalized
+	e.roles = roles
+	e.conditions = conditions
+	e.mutex.Unlock()
+	return nil
+}
+
+// Rules returns the rules in the order they were set
+func (e *Enforcer) Rules() []Rule {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return slices.Clone(e.rules)
+}
+
+// Subjects returns the names the rules mention as a subject or role: the
+// first value of each p rule and both values of each g rule
+func (e *Enforcer) Subjects() []string {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	var names []string
+	for _, rule := range e.rules {
+		names = append(names, rule.Values[0])
+		if rule.Type == "g" {
+			names = append(names, rule.Values[1])
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// Enforce reports whether the model and rules allow subject to take
+// action on object. The model's request definition must have three
+// fields.
+func (e *Enforcer) Enforce(subject, object, action string) bool {
+	allowed, _ := e.Explain(subject, object, action)
+	return allowed
+}
+
+// EnforceAttributes is Enforce for a model whose matcher or rules use
+// attributes of the request values, given by field name such as "sub"
+func (e *Enforcer) EnforceAttributes(attributes map[string]Attributes, subject, object, action string) bool {
+	allowed, _ := e.ExplainAttributes(attributes, subject, object, action)
+	return allowed
+}
+
+// Explain decides a request like Enforce, also returning the rule that
+// decided it, if any. It takes as many values as the model's request
+// definition has fields; a request with the wrong number is denied.
+func (e *Enforcer) Explain(request ...string) (bool, *Rule) {
+	return e.ExplainAttributes(nil, request...)
+}
+
+// ExplainAttributes is Explain for a request whose values have attributes
+func (e *Enforcer) ExplainAttributes(attributes map[string]Attributes, request ...string) (bool, *Rule) {
+	if len(request) != len(e.model.Request) {
+		return false, nil
+	}
+
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	env := &env{r: request, attributes: attributes, roles: e.hasRole}
+	var allow, deny *Rule
+	for i := range e.rules {
+		rule := &e.rules[i]
+		if rule.Type != "p" {
+			continue
+		}
+		env.p = rule.Values
+		env.conditions = e.conditions[i]
+		if !e.model.matcher.cond(env) {
+			continue
+		}
+		allowing := !e.model.hasEffectField() || rule.Values[len(rule.Values)-1] == "allow"
+		if e.model.Effect == Priority {
+			return allowing, rule
+		}
+		if allowing && allow == nil {
+			allow = rule
+		}
+		if !allowing && deny == nil {
+			deny = rule
+		}
+	}
+
+	switch e.model.Effect {
+	case AllowOverride:
+		return allow != nil, allow
+	case DenyOverride:
+		if deny != nil {
+			return false, deny
+		}
+		return true, allow
+	case AllowAndDeny:
+		if deny != nil {
+			return false, deny
+		}
+		return allow != nil, allow
+	}
+	return false, nil
+}
+
+// hasRole reports whether name is role or has it through g rules. The
+// caller holds the read lock.
+func (e *Enforcer) hasRole(name, role string) bool {
+	if name == role {
+		return true
+	}
+	seen := map[string]bool{name: true}
+	current := []string{name}
+	for depth := 0; depth < maxRoleDepth && len(current) > 0; depth++ {
+		var next []string
+		for _, member := range current {
+			for _, parent := range e.roles[member] {
+				if parent == role {
+					return true
+				}
+				if !seen[parent] {
+					seen[parent] = true
+					next = append(next, parent)
+				}
+			}
+		}
+		current = next
+	}
+	return false
+}
+
+// conditions compiles the values of a p rule that the matcher evaluates,
+// returning them by field
+func (m *Model) conditions(rule Rule) ([]*node, error) {
+	if rule.Type != "p" || len(m.evalFields) == 0 {
+		return nil, nil
+	}
+	compiled := make([]*node, len(m.Policy))
+	for _, i := range m.evalFields {
+		condition, err := compile(rule.Values[i], m, true)
+		if err == nil && condition.kind != kindBool {
+			err = fmt.Errorf("policy: %q is not a condition", rule.Values[i])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("policy: %q: %w", rule, err)
+		}
+		compiled[i] = condition
+	}
+	return compiled, nil
+}
+
+// normalize checks that a rule fits the model, defaulting a p rule's
+// missing eft to allow
+func (m *Model) normalize(rule Rule) (Rule, error) {
+	switch rule.Type {
+	case "g":
+		if !m.Roles {
+			return Rule{}, fmt.Errorf("policy: %q: the model has no role definition", rule)
+		}
+		if len(rule.Values) != 2 || rule.Values[0] == "" || rule.Values[1] == "" {
+			return Rule{}, fmt.Errorf("policy: %q: g rules need two values", rule)
+		}
+		return rule, nil
+	case "p":
+		values := slices.Clone(rule.Values)
+		if m.hasEffectField() && len(values) == len(m.Policy)-1 {
+			values = append(values, "allow")
+		}
+		if len(values) != len(m.Policy) || slices.Contains(values, "") {
+			return Rule{}, fmt.Errorf("policy: %q: p rules need %d values", rule, len(m.Policy))
+		}
+		if m.hasEffectField() {
+			if eft := values[len(values)-1]; eft != "allow" && eft != "deny" {
+				return Rule{}, fmt.Errorf("policy: %q: eft must be allow or deny", rule)
+			}
+		}
+		return Rule{Type: "p", Values: values}, nil
+	}
+	return Rule{}, fmt.Errorf("policy: %q is neither a p nor a g rule", rule)
+}
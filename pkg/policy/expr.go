@@ -0,0 +1,404 @@
+package policy
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Matchers are compiled into a tree of closures, typed as they are
+// compiled so a mistyped matcher fails when the model is parsed rather
+// than when a request is checked.
+
+type kind int
+
+const (
+	kindString kind = iota
+	kindBool
+)
+
+// env is what a matcher is evaluated against: one request, with the
+// attributes of its values by field name, and one rule, with the compiled
+// conditions of the fields the matcher passes to eval
+type env struct {
+	r, p       []string
+	attributes map[string]Attributes
+	conditions []*node
+	roles      func(name, role string) bool
+}
+
+type node struct {
+	kind kind
+	str  func(*env) string
+	cond func(*env) bool
+}
+
+// functions are the matcher functions besides g, all taking two strings
+var functions = map[string]func(a, b string) bool{
+	"keyMatch":   KeyMatch,
+	"keyMatch2":  KeyMatch2,
+	"regexMatch": RegexMatch,
+	"ipMatch":    IPMatch,
+	"listMatch":  ListMatch,
+}
+
+// KeyMatch reports whether key matches pattern, where a "*" in pattern
+// matches anything, e.g. "/api/*" matches "/api/users/1"
+func KeyMatch(key, pattern string) bool {
+	prefix, _, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return key == pattern
+	}
+	return strings.HasPrefix(key, prefix)
+}
+
+// KeyMatch2 reports whether key matches pattern, where a ":name" segment
+// in pattern matches one path segment and "*" matches anything, e.g.
+// "/api/users/:id" matches "/api/users/1"
+func KeyMatch2(key, pattern string) bool {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i, segment := range strings.Split(pattern, "/") {
+		if i > 0 {
+			expr.WriteString("/")
+		}
+		if strings.HasPrefix(segment, ":") {
+			expr.WriteString("[^/]+")
+			continue
+		}
+		expr.WriteString(strings.ReplaceAll(regexp.QuoteMeta(segment), `\*`, ".*"))
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String()).MatchString(key)
+}
+
+// RegexMatch reports whether key matches the regular expression pattern.
+// An invalid pattern matches nothing.
+func RegexMatch(key, pattern string) bool {
+	matched, err := regexp.MatchString(pattern, key)
+	return err == nil && matched
+}
+
+// IPMatch reports whether the address ip is pattern or within the CIDR
+// range pattern
+func IPMatch(ip, pattern string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	if prefix, err := netip.ParsePrefix(pattern); err == nil {
+		return prefix.Contains(addr.Unmap())
+	}
+	other, err := netip.ParseAddr(pattern)
+	return err == nil && other.Unmap() == addr.Unmap()
+}
+
+// ListMatch reports whether the comma-separated list has the item, e.g.
+// "staff,admins" has "admins"
+func ListMatch(list, item string) bool {
+	for _, value := range strings.Split(list, ",") {
+		if strings.TrimSpace(value) == item {
+			return true
+		}
+	}
+	return false
+}
+
+type token struct {
+	text   string
+	quoted bool
+}
+
+// tokenize splits a matcher into identifiers, quoted strings and operators
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("policy: unterminated string in matcher")
+			}
+			tokens = append(tokens, token{text: s[i+1 : i+1+end], quoted: true})
+			i += end + 2
+		case strings.HasPrefix(s[i:], "==") || strings.HasPrefix(s[i:], "!=") ||
+			strings.HasPrefix(s[i:], "<=") || strings.HasPrefix(s[i:], ">=") ||
+			strings.HasPrefix(s[i:], "&&") || strings.HasPrefix(s[i:], "||"):
+			tokens = append(tokens, token{text: s[i : i+2]})
+			i += 2
+		case strings.IndexByte("!(),<>", c) >= 0:
+			tokens = append(tokens, token{text: s[i : i+1]})
+			i++
+		case isIdentByte(c):
+			start := i
+			for i < len(s) && (isIdentByte(s[i]) || s[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{text: s[start:i]})
+		default:
+			return nil, fmt.Errorf("policy: unexpected %q in matcher", c)
+		}
+	}
+	return tokens, nil
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// parser compiles a matcher with the grammar
+//
+//	or      = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | compare
+//	compare = primary [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) primary ]
+//	primary = "(" or ")" | string | number | "true" | "false" | field |
+//	          function "(" or "," or ")" | "eval" "(" field ")"
+//
+// Fields are r.name and p.name, or r.name.attribute for an attribute of a
+// request value. The ordering operators compare numbers; a value that is
+// not a number makes the comparison false.
+type parser struct {
+	tokens []token
+	pos    int
+	model  *Model
+	// condition is set when compiling a rule's eval condition, which may
+	// not use eval itself
+	condition bool
+}
+
+func compile(matcher string, m *Model, condition bool) (*node, error) {
+	tokens, err := tokenize(matcher)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, model: m, condition: condition}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("policy: unexpected %q in matcher", p.tokens[p.pos].text)
+	}
+	return n, nil
+}
+
+func (p *parser) peek(text string) bool {
+	return p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && p.tokens[p.pos].text == text
+}
+
+func (p *parser) expect(text string) error {
+	if !p.peek(text) {
+		return fmt.Errorf("policy: expected %q in matcher", text)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *parser) or() (*node, error) {
+	left, err := p.and()
+	for err == nil && p.peek("||") {
+		p.pos++
+		var right *node
+		if right, err = p.and(); err == nil {
+			left, err = logical(left, right, false)
+		}
+	}
+	return left, err
+}
+
+func (p *parser) and() (*node, error) {
+	left, err := p.unary()
+	for err == nil && p.peek("&&") {
+		p.pos++
+		var right *node
+		if right, err = p.unary(); err == nil {
+			left, err = logical(left, right, true)
+		}
+	}
+	return left, err
+}
+
+func logical(left, right *node, and bool) (*node, error) {
+	if left.kind != kindBool || right.kind != kindBool {
+		return nil, fmt.Errorf("policy: && and || need conditions")
+	}
+	if and {
+		return &node{kind: kindBool, cond: func(e *env) bool { return left.cond(e) && right.cond(e) }}, nil
+	}
+	return &node{kind: kindBool, cond: func(e *env) bool { return left.cond(e) || right.cond(e) }}, nil
+}
+
+func (p *parser) unary() (*node, error) {
+	if !p.peek("!") {
+		return p.compare()
+	}
+	p.pos++
+	operand, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	if operand.kind != kindBool {
+		return nil, fmt.Errorf("policy: ! needs a condition")
+	}
+	return &node{kind: kindBool, cond: func(e *env) bool { return !operand.cond(e) }}, nil
+}
+
+func (p *parser) compare() (*node, error) {
+	left, err := p.primary()
+	if err != nil || p.pos >= len(p.tokens) || p.tokens[p.pos].quoted {
+		return left, err
+	}
+	operator := p.tokens[p.pos].text
+	order, ordering := orderings[operator]
+	if !ordering && operator != "==" && operator != "!=" {
+		return left, nil
+	}
+	p.pos++
+	right, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if left.kind != kindString || right.kind != kindString {
+		return nil, fmt.Errorf("policy: %s compares values, not conditions", operator)
+	}
+	if ordering {
+		return &node{kind: kindBool, cond: func(e *env) bool {
+			a, errA := strconv.ParseFloat(left.str(e), 64)
+			b, errB := strconv.ParseFloat(right.str(e), 64)
+			return errA == nil && errB == nil && order(a, b)
+		}}, nil
+	}
+	equal := operator == "=="
+	return &node{kind: kindBool, cond: func(e *env) bool { return (left.str(e) == right.str(e)) == equal }}, nil
+}
+
+// orderings are the numeric comparison operators
+var orderings = map[string]func(a, b float64) bool{
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+}
+
+func (p *parser) primary() (*node, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("policy: matcher ends unexpectedly")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+
+	switch {
+	case t.quoted:
+		return &node{kind: kindString, str: func(*env) string { return t.text }}, nil
+	case t.text == "(":
+		n, err := p.or()
+		if err == nil {
+			err = p.expect(")")
+		}
+		return n, err
+	case t.text == "true" || t.text == "false" || isNumber(t.text):
+		return &node{kind: kindString, str: func(*env) string { return t.text }}, nil
+	case strings.HasPrefix(t.text, "r.") || strings.HasPrefix(t.text, "p."):
+		return p.field(t.text)
+	case t.text == "eval" && p.peek("("):
+		return p.eval()
+	case p.peek("("):
+		return p.call(t.text)
+	}
+	return nil, fmt.Errorf("policy: unexpected %q in matcher", t.text)
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+// field resolves a request or rule field to its position
+func (p *parser) field(name string) (*node, error) {
+	kind, field, _ := strings.Cut(name, ".")
+	field, attribute, hasAttribute := strings.Cut(field, ".")
+	names := p.model.Request
+	if kind == "p" {
+		names = p.model.Policy
+	}
+	i := slices.Index(names, field)
+	if i < 0 || hasAttribute && (kind == "p" || attribute == "") {
+		return nil, fmt.Errorf("policy: unknown field %q in matcher", name)
+	}
+	switch {
+	case hasAttribute:
+		return &node{kind: kindString, str: func(e *env) string { return e.attributes[field][attribute] }}, nil
+	case kind == "p":
+		return &node{kind: kindString, str: func(e *env) string { return e.p[i] }}, nil
+	}
+	return &node{kind: kindString, str: func(e *env) string { return e.r[i] }}, nil
+}
+
+// eval compiles eval(p.field), which evaluates the rule's field as a
+// condition. Conditions are compiled when rules are set.
+func (p *parser) eval() (*node, error) {
+	if p.condition {
+		return nil, fmt.Errorf("policy: eval cannot be used in a rule's condition")
+	}
+	p.pos++ // (
+	if p.pos >= len(p.tokens) || !strings.HasPrefix(p.tokens[p.pos].text, "p.") {
+		return nil, fmt.Errorf("policy: eval takes a rule field")
+	}
+	i := slices.Index(p.model.Policy, strings.TrimPrefix(p.tokens[p.pos].text, "p."))
+	if i < 0 {
+		return nil, fmt.Errorf("policy: unknown field %q in matcher", p.tokens[p.pos].text)
+	}
+	p.pos++
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(p.model.evalFields, i) {
+		p.model.evalFields = append(p.model.evalFields, i)
+	}
+	return &node{kind: kindBool, cond: func(e *env) bool {
+		condition := e.conditions[i]
+		return condition != nil && condition.cond(e)
+	}}, nil
+}
+
+func (p *parser) call(name string) (*node, error) {
+	fn, known := functions[name]
+	if name == "g" {
+		if !p.model.Roles {
+			return nil, fmt.Errorf("policy: g used without a role definition")
+		}
+	} else if !known {
+		return nil, fmt.Errorf("policy: unknown function %q in matcher", name)
+	}
+
+	p.pos++ // (
+	a, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	b, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if a.kind != kindString || b.kind != kindString {
+		return nil, fmt.Errorf("policy: %s takes strings", name)
+	}
+
+	if name == "g" {
+		return &node{kind: kindBool, cond: func(e *env) bool { return e.roles(a.str(e), b.str(e)) }}, nil
+	}
+	return &node{kind: kindBool, cond: func(e *env) bool { return fn(a.str(e), b.str(e)) }}, nil
+}
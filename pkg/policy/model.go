@@ -0,0 +1,166 @@
+// Package policy makes authorization decisions from a model and a set of
+// rules in the style of Casbin. The model declares what a request and a
+// rule consist of, how rules are matched against a request and how the
+// matching rules' effects combine into a decision; the rules are lines
+// such as "p, support, users, read" and "g, lead, support".
+package policy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultModel is role-based access control with deny rules: a request is
+// allowed when an allow rule for the subject or one of its roles matches
+// and no deny rule does. Objects and actions may use keyMatch patterns
+// such as "*".
+const DefaultModel = `[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act, eft
+
+[role_definition]
+g = _, _
+
+[policy_effect]
+e = some(where (p.eft == allow)) && !some(where (p.eft == deny))
+
+[matchers]
+m = g(r.sub, p.sub) && keyMatch(r.obj, p.obj) && keyMatch(r.act, p.act)
+`
+
+// Effect is how the effects of matching rules combine into a decision
+type Effect int
+
+const (
+	// AllowOverride allows when any matching rule allows:
+	// some(where (p.eft == allow))
+	AllowOverride Effect = iota
+	// DenyOverride allows unless a matching rule denies:
+	// !some(where (p.eft == deny))
+	DenyOverride
+	// AllowAndDeny allows when a matching rule allows and none denies:
+	// some(where (p.eft == allow)) && !some(where (p.eft == deny))
+	AllowAndDeny
+	// Priority lets the first matching rule decide, denying when none
+	// does: priority(p.eft) || deny
+	Priority
+)
+
+// effects maps the policy effect expressions, without spaces, to their
+// Effect
+var effects = map[string]Effect{
+	"some(where(p.eft==allow))":                            AllowOverride,
+	"!some(where(p.eft==deny))":                            DenyOverride,
+	"some(where(p.eft==allow))&&!some(where(p.eft==deny))": AllowAndDeny,
+	"priority(p.eft)||deny":                                Priority,
+}
+
+// Model is a parsed model definition
+type Model struct {
+	// Request and Policy are the field names of requests and "p" rules
+	Request []string
+	Policy  []string
+	// Roles reports whether the model defines "g" role rules
+	Roles  bool
+	Effect Effect
+
+	text    string
+	matcher *node
+	// evalFields are the rule fields the matcher evaluates as conditions
+	evalFields []int
+}
+
+// ParseModel parses a model in Casbin's INI format. Only the "r", "p",
+// "g = _, _", "e" and "m" definitions are supported.
+func ParseModel(text string) (*Model, error) {
+	definitions := map[string]string{}
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("policy: invalid model line %q", line)
+		}
+		key = strings.TrimSpace(key)
+		if want, known := sectionOf[key]; !known || want != section {
+			return nil, fmt.Errorf("policy: unexpected %q in section [%s]", key, section)
+		}
+		definitions[key] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	m := &Model{text: text}
+	for _, key := range []string{"r", "p", "e", "m"} {
+		if definitions[key] == "" {
+			return nil, fmt.Errorf("policy: model has no %q definition", key)
+		}
+	}
+	m.Request = fields(definitions["r"])
+	m.Policy = fields(definitions["p"])
+	if roles, ok := definitions["g"]; ok {
+		if strings.ReplaceAll(roles, " ", "") != "_,_" {
+			return nil, errors.New("policy: only g = _, _ role definitions are supported")
+		}
+		m.Roles = true
+	}
+	effect, ok := effects[strings.ReplaceAll(definitions["e"], " ", "")]
+	if !ok {
+		return nil, fmt.Errorf("policy: unsupported policy effect %q", definitions["e"])
+	}
+	m.Effect = effect
+	if effect != AllowOverride && !m.hasEffectField() {
+		return nil, errors.New("policy: policy effect needs an eft field in the policy definition")
+	}
+
+	matcher, err := compile(definitions["m"], m, false)
+	if err != nil {
+		return nil, err
+	}
+	if matcher.kind != kindBool {
+		return nil, errors.New("policy: matcher must be a condition")
+	}
+	m.matcher = matcher
+	return m, nil
+}
+
+// sectionOf is the section each definition belongs in
+var sectionOf = map[string]string{
+	"r": "request_definition",
+	"p": "policy_definition",
+	"g": "role_definition",
+	"e": "policy_effect",
+	"m": "matchers",
+}
+
+// String returns the model's definition as it was parsed
+func (m *Model) String() string {
+	return m.text
+}
+
+// hasEffectField reports whether rules have an eft field, which must be
+// the last one
+func (m *Model) hasEffectField() bool {
+	return len(m.Policy) > 0 && m.Policy[len(m.Policy)-1] == "eft"
+}
+
+func fields(definition string) []string {
+	var names []string
+	for _, name := range strings.Split(definition, ",") {
+		names = append(names, strings.TrimSpace(name))
+	}
+	return names
+}
@@ -0,0 +1,63 @@
+package randutil
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Bounds on the number of random bytes a caller may request
+const (
+	MinBytes = 1
+	MaxBytes = 1024
+)
+
+// ErrInvalidLength is returned when a requested length is outside [MinBytes, MaxBytes]
+var ErrInvalidLength = fmt.Errorf("length must be between %d and %d bytes", MinBytes, MaxBytes)
+
+// Bytes returns n cryptographically secure random bytes
+func Bytes(n int) ([]byte, error) {
+	if n < MinBytes || n > MaxBytes {
+		return nil, ErrInvalidLength
+	}
+
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.New("failed to read random bytes")
+	}
+	return b, nil
+}
+
+// Hex returns n random bytes encoded as lowercase hex
+func Hex(n int) (string, error) {
+	b, err := Bytes(n)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Base64 returns n random bytes encoded as unpadded URL-safe base64, which
+// can be used in URLs, headers, and cookies without further escaping
+func Base64(n int) (string, error) {
+	b, err := Bytes(n)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// UUID returns a random version 4 UUID in canonical form
+func UUID() (string, error) {
+	b, err := Bytes(16)
+	if err != nil {
+		return "", err
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
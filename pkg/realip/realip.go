@@ -0,0 +1,138 @@
+package realip
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Resolver determines the originating client address of a request, trusting
+// forwarding headers only when they were added by a configured proxy
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// NewResolver creates a resolver that trusts forwarding headers set by
+// peers within the given ranges
+func NewResolver(trusted []netip.Prefix) *Resolver {
+	return &Resolver{trusted: trusted}
+}
+
+// ClientIP returns the client address for r. If the direct peer is a trusted
+// proxy, the Forwarded (RFC 7239) or X-Forwarded-For chain is walked from
+// right to left and the first address that is not a trusted proxy is used.
+func (res *Resolver) ClientIP(r *http.Request) string {
+	peer, ok := parseHostPort(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+
+	if !res.isTrusted(peer) {
+		return peer.String()
+	}
+
+	return res.walk(forwardingChain(r), peer).String()
+}
+
+// LocalClientIP returns the client address for a request whose peer has
+// no IP address but is trusted as a proxy, such as a reverse proxy
+// connecting over a unix socket. The forwarding headers are walked as in
+// ClientIP; ok is false when they name no client.
+func (res *Resolver) LocalClientIP(r *http.Request) (ip string, ok bool) {
+	client := res.walk(forwardingChain(r), netip.Addr{})
+	if !client.IsValid() {
+		return "", false
+	}
+	return client.String(), true
+}
+
+// walk returns the first address in chain, from right to left, that is
+// not a trusted proxy, or the last one it could parse. client is returned
+// when the nearest hop cannot be parsed.
+func (res *Resolver) walk(chain []string, client netip.Addr) netip.Addr {
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, ok := parseHostPort(chain[i])
+		if !ok {
+			// An unparseable hop (e.g. "unknown" or an obfuscated
+			// identifier) ends the chain we can vouch for
+			break
+		}
+		client = addr
+		if !res.isTrusted(addr) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardingChain returns the hops named by the Forwarded header, or by
+// X-Forwarded-For without one
+func forwardingChain(r *http.Request) []string {
+	chain := forwardedFor(r.Header.Values("Forwarded"))
+	if chain == nil {
+		chain = xForwardedFor(r.Header.Values("X-Forwarded-For"))
+	}
+	return chain
+}
+
+func (res *Resolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range res.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// xForwardedFor flattens X-Forwarded-For header values into a hop list
+func xForwardedFor(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				chain = append(chain, hop)
+			}
+		}
+	}
+	return chain
+}
+
+// forwardedFor extracts the for= parameters from Forwarded header values,
+// returning nil when no for= parameter is present
+func forwardedFor(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if !found || !strings.EqualFold(key, "for") {
+					continue
+				}
+				chain = append(chain, strings.Trim(val, "\""))
+			}
+		}
+	}
+	return chain
+}
+
+// parseHostPort parses an address with or without a port, including
+// bracketed IPv6 forms such as "[2001:db8::1]:443"
+func parseHostPort(value string) (netip.Addr, bool) {
+	value = strings.TrimSpace(value)
+
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return addr.Unmap(), true
+	}
+
+	host, _, err := net.SplitHostPort(value)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
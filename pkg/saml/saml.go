@@ -0,0 +1,385 @@
+// Package saml is the service provider side of SAML 2.0 Web Browser SSO:
+// reading an identity provider's metadata, sending users to it with an
+// AuthnRequest over the HTTP-Redirect binding and verifying the Response
+// it posts back over the HTTP-POST binding. Responses or their assertion
+// must be signed with exclusive canonicalization and SHA-256 or SHA-512;
+// encrypted assertions are not supported. Unsolicited, IdP-initiated
+// responses are verified the same way but answer no request.
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	protocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	assertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	metadataNamespace  = "urn:oasis:names:tc:SAML:2.0:metadata"
+
+	// RedirectBinding and POSTBinding are the bindings requests are sent
+	// and responses received with
+	RedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	POSTBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	// EmailNameIDFormat is the NameID format asked for in requests
+	EmailNameIDFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+
+	statusSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	bearerMethod  = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+var (
+	// ErrMalformed is returned for metadata and responses that cannot be
+	// parsed or lack required elements
+	ErrMalformed = errors.New("saml: malformed document")
+	// ErrUnsigned is returned for responses with neither a signed
+	// response nor a signed assertion
+	ErrUnsigned = errors.New("saml: response is not signed")
+	// ErrInvalidSignature is returned when a signature does not verify
+	// with the identity provider's certificates
+	ErrInvalidSignature = errors.New("saml: invalid signature")
+	// ErrUnsupportedAlgorithm is returned for signatures made with other
+	// canonicalization, digest or signature algorithms
+	ErrUnsupportedAlgorithm = errors.New("saml: unsupported signature algorithm")
+	// ErrEncrypted is returned for responses with an encrypted assertion
+	ErrEncrypted = errors.New("saml: encrypted assertions are not supported")
+	// ErrIssuerMismatch is returned for responses from another issuer
+	ErrIssuerMismatch = errors.New("saml: issuer mismatch")
+	// ErrRecipient is returned for responses addressed to another service
+	// provider or assertion consumer service
+	ErrRecipient = errors.New("saml: response is for another service provider")
+	// ErrInResponseTo is returned for responses to another request, or to
+	// none
+	ErrInResponseTo = errors.New("saml: response is not to this request")
+	// ErrExpired is returned for assertions used outside their validity
+	ErrExpired = errors.New("saml: assertion expired or not yet valid")
+)
+
+// StatusError is returned for a response whose status is not success,
+// such as when the user could not be authenticated
+type StatusError struct {
+	Code string
+}
+
+func (e *StatusError) Error() string {
+	return "saml: identity provider answered " + e.Code
+}
+
+// IdentityProvider is what the service provider needs from an identity
+// provider's metadata
+type IdentityProvider struct {
+	EntityID string
+	// SSOURL is the single sign-on service of the HTTP-Redirect binding
+	SSOURL string
+	// Certificates hold the keys responses may be signed with
+	Certificates []*x509.Certificate
+}
+
+// ParseMetadata reads an identity provider's EntityDescriptor. The
+// metadata's own signature is not checked: it is trusted as uploaded.
+func ParseMetadata(data []byte) (IdentityProvider, error) {
+	root, err := parse(data)
+	if err != nil {
+		return IdentityProvider{}, err
+	}
+	if !root.is(metadataNamespace, "EntityDescriptor") {
+		return IdentityProvider{}, fmt.Errorf("%w: not an EntityDescriptor", ErrMalformed)
+	}
+	descriptor := root.child(metadataNamespace, "IDPSSODescriptor")
+	if descriptor == nil {
+		return IdentityProvider{}, fmt.Errorf("%w: no IDPSSODescriptor", ErrMalformed)
+	}
+
+	idp := IdentityProvider{EntityID: root.attr("entityID")}
+	for _, service := range descriptor.all(metadataNamespace, "SingleSignOnService") {
+		if service.attr("Binding") == RedirectBinding {
+			idp.SSOURL = service.attr("Location")
+			break
+		}
+	}
+	for _, key := range descriptor.all(metadataNamespace, "KeyDescriptor") {
+		if use := key.attr("use"); use != "" && use != "signing" {
+			continue
+		}
+		data := key.child(dsigNamespace, "KeyInfo").child(dsigNamespace, "X509Data")
+		for _, encoded := range data.all(dsigNamespace, "X509Certificate") {
+			der, err := decodeBase64(encoded.text())
+			if err != nil {
+				return IdentityProvider{}, fmt.Errorf("%w: certificate is not base64", ErrMalformed)
+			}
+			certificate, err := x509.ParseCertificate(der)
+			if err != nil {
+				return IdentityProvider{}, fmt.Errorf("%w: %v", ErrMalformed, err)
+			}
+			idp.Certificates = append(idp.Certificates, certificate)
+		}
+	}
+
+	if idp.EntityID == "" {
+		return IdentityProvider{}, fmt.Errorf("%w: no entityID", ErrMalformed)
+	}
+	if u, err := url.Parse(idp.SSOURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return IdentityProvider{}, fmt.Errorf("%w: no HTTP-Redirect single sign-on service", ErrMalformed)
+	}
+	if len(idp.Certificates) == 0 {
+		return IdentityProvider{}, fmt.Errorf("%w: no signing certificate", ErrMalformed)
+	}
+	return idp, nil
+}
+
+// ServiceProvider is this side of the exchange
+type ServiceProvider struct {
+	EntityID string
+	// ACSURL is the assertion consumer service responses are posted to
+	ACSURL string
+	// MaxSkew is how far the identity provider's clock may be from ours
+	MaxSkew time.Duration
+}
+
+// Metadata returns the service provider's EntityDescriptor, for setting
+// it up at the identity provider
+func (sp ServiceProvider) Metadata() []byte {
+	return []byte(`<md:EntityDescriptor xmlns:md="` + metadataNamespace + `" entityID="` + escapeAttribute(sp.EntityID) + `">` +
+		`<md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="` + protocolNamespace + `">` +
+		`<md:NameIDFormat>` + EmailNameIDFormat + `</md:NameIDFormat>` +
+		`<md:AssertionConsumerService Binding="` + POSTBinding + `" Location="` + escapeAttribute(sp.ACSURL) + `" index="0" isDefault="true"></md:AssertionConsumerService>` +
+		`</md:SPSSODescriptor></md:EntityDescriptor>`)
+}
+
+// AuthnRequestURL returns the URL that sends the user to idp with an
+// AuthnRequest over the HTTP-Redirect binding. id identifies the request,
+// which the response must answer, and must start with a letter;
+// relayState is posted back with the response.
+func (sp ServiceProvider) AuthnRequestURL(idp IdentityProvider, id, relayState string, now time.Time) (string, error) {
+	request := `<samlp:AuthnRequest xmlns:samlp="` + protocolNamespace + `" xmlns:saml="` + assertionNamespace + `"` +
+		` ID="` + escapeAttribute(id) + `" Version="2.0" IssueInstant="` + now.UTC().Format(time.RFC3339) + `"` +
+		` Destination="` + escapeAttribute(idp.SSOURL) + `" AssertionConsumerServiceURL="` + escapeAttribute(sp.ACSURL) + `"` +
+		` ProtocolBinding="` + POSTBinding + `">` +
+		`<saml:Issuer>` + escapeText(sp.EntityID) + `</saml:Issuer>` +
+		`<samlp:NameIDPolicy Format="` + EmailNameIDFormat + `" AllowCreate="true"></samlp:NameIDPolicy>` +
+		`</samlp:AuthnRequest>`
+
+	var deflated bytes.Buffer
+	writer, err := flate.NewWriter(&deflated, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	writer.Write([]byte(request))
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	query := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(deflated.Bytes())}}
+	if relayState != "" {
+		query.Set("RelayState", relayState)
+	}
+	separator := "?"
+	if strings.Contains(idp.SSOURL, "?") {
+		separator = "&"
+	}
+	return idp.SSOURL + separator + query.Encode(), nil
+}
+
+// Assertion is what a verified response says about the user
+type Assertion struct {
+	// ID identifies the assertion; an assertion is used at most once
+	ID           string
+	NameID       string
+	NameIDFormat string
+	SessionIndex string
+	Attributes   map[string][]string
+	// ExpiresAt is when the assertion stops being accepted, give or take
+	// MaxSkew, and until when its ID must be remembered to stop replays
+	ExpiresAt time.Time
+}
+
+// emailAttributes are attribute names identity providers commonly send
+// the email address as
+var emailAttributes = []string{
+	"email",
+	"mail",
+	"urn:oid:0.9.2342.19200300.100.1.3",
+	"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+}
+
+// Email returns the user's email address: the NameID when it has the
+// email format, or else the first common email attribute
+func (a *Assertion) Email() string {
+	if a.NameIDFormat == EmailNameIDFormat {
+		return a.NameID
+	}
+	for _, name := range emailAttributes {
+		if values := a.Attributes[name]; len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// Attribute returns the first value of the named attribute, or "" when
+// the assertion does not have it
+func (a *Assertion) Attribute(name string) string {
+	if values := a.Attributes[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// ParseResponse verifies a base64-encoded Response posted to the
+// assertion consumer service in answer to the AuthnRequest requestID,
+// returning its assertion. Either the response or its one assertion must
+// be signed by idp; only the signed elements are read. An empty requestID
+// accepts only an unsolicited response, which names no request at all.
+func (sp ServiceProvider) ParseResponse(idp IdentityProvider, encoded, requestID string, now time.Time) (*Assertion, error) {
+	data, err := decodeBase64(encoded)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	root, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if !root.is(protocolNamespace, "Response") {
+		return nil, fmt.Errorf("%w: not a Response", ErrMalformed)
+	}
+
+	// Failures are often unsigned; they can only refuse the sign-in
+	status := root.child(protocolNamespace, "Status").child(protocolNamespace, "StatusCode")
+	if code := status.attr("Value"); code != statusSuccess {
+		if detail := status.child(protocolNamespace, "StatusCode").attr("Value"); detail != "" {
+			code += " (" + detail + ")"
+		}
+		return nil, &StatusError{Code: code}
+	}
+
+	signed := false
+	assertions := root.all(assertionNamespace, "Assertion")
+	if len(assertions) == 0 && root.child(assertionNamespace, "EncryptedAssertion") != nil {
+		return nil, ErrEncrypted
+	}
+	for _, e := range append([]*element{root}, assertions...) {
+		err := verifySignature(root, e, idp.Certificates)
+		if errors.Is(err, errNoSignature) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		signed = true
+	}
+	if !signed {
+		return nil, ErrUnsigned
+	}
+
+	if destination := root.attr("Destination"); destination != "" && destination != sp.ACSURL {
+		return nil, ErrRecipient
+	}
+	if root.attr("InResponseTo") != requestID {
+		return nil, ErrInResponseTo
+	}
+	if issuer := root.child(assertionNamespace, "Issuer"); issuer != nil && issuer.text() != idp.EntityID {
+		return nil, ErrIssuerMismatch
+	}
+	if len(assertions) != 1 {
+		return nil, fmt.Errorf("%w: response must have one assertion", ErrMalformed)
+	}
+	return sp.readAssertion(idp, assertions[0], requestID, now)
+}
+
+// readAssertion checks a signed assertion's issuer, subject confirmation
+// and conditions, and reads the user from it
+func (sp ServiceProvider) readAssertion(idp IdentityProvider, assertion *element, requestID string, now time.Time) (*Assertion, error) {
+	if assertion.attr("ID") == "" {
+		return nil, fmt.Errorf("%w: assertion has no ID", ErrMalformed)
+	}
+	if assertion.child(assertionNamespace, "Issuer").text() != idp.EntityID {
+		return nil, ErrIssuerMismatch
+	}
+
+	subject := assertion.child(assertionNamespace, "Subject")
+	nameID := subject.child(assertionNamespace, "NameID")
+	if nameID.text() == "" {
+		return nil, fmt.Errorf("%w: no NameID", ErrMalformed)
+	}
+	confirmed := false
+	var confirmErr error = ErrRecipient
+	var expiresAt time.Time
+	for _, confirmation := range subject.all(assertionNamespace, "SubjectConfirmation") {
+		if confirmation.attr("Method") != bearerMethod {
+			continue
+		}
+		data := confirmation.child(assertionNamespace, "SubjectConfirmationData")
+		switch {
+		case data.attr("Recipient") != sp.ACSURL:
+			confirmErr = ErrRecipient
+		case data.attr("InResponseTo") != requestID:
+			confirmErr = ErrInResponseTo
+		case !sp.valid(now, "", data.attr("NotOnOrAfter"), true):
+			confirmErr = ErrExpired
+		default:
+			confirmed = true
+			expiresAt, _ = time.Parse(time.RFC3339Nano, data.attr("NotOnOrAfter"))
+		}
+	}
+	if !confirmed {
+		return nil, confirmErr
+	}
+
+	conditions := assertion.child(assertionNamespace, "Conditions")
+	if !sp.valid(now, conditions.attr("NotBefore"), conditions.attr("NotOnOrAfter"), false) {
+		return nil, ErrExpired
+	}
+	if notOnOrAfter, err := time.Parse(time.RFC3339Nano, conditions.attr("NotOnOrAfter")); err == nil && notOnOrAfter.Before(expiresAt) {
+		expiresAt = notOnOrAfter
+	}
+	for _, restriction := range conditions.all(assertionNamespace, "AudienceRestriction") {
+		audiences := restriction.all(assertionNamespace, "Audience")
+		if !slices.ContainsFunc(audiences, func(audience *element) bool { return audience.text() == sp.EntityID }) {
+			return nil, ErrRecipient
+		}
+	}
+
+	result := &Assertion{
+		ID:           assertion.attr("ID"),
+		NameID:       nameID.text(),
+		NameIDFormat: nameID.attr("Format"),
+		SessionIndex: assertion.child(assertionNamespace, "AuthnStatement").attr("SessionIndex"),
+		Attributes:   make(map[string][]string),
+		ExpiresAt:    expiresAt.Add(sp.MaxSkew),
+	}
+	for _, statement := range assertion.all(assertionNamespace, "AttributeStatement") {
+		for _, attribute := range statement.all(assertionNamespace, "Attribute") {
+			name := attribute.attr("Name")
+			for _, value := range attribute.all(assertionNamespace, "AttributeValue") {
+				result.Attributes[name] = append(result.Attributes[name], value.text())
+			}
+		}
+	}
+	return result, nil
+}
+
+// valid reports whether now, give or take MaxSkew, is within notBefore
+// and notOnOrAfter, either of which may be empty unless required says
+// notOnOrAfter is not
+func (sp ServiceProvider) valid(now time.Time, notBefore, notOnOrAfter string, required bool) bool {
+	if notBefore != "" {
+		t, err := time.Parse(time.RFC3339Nano, notBefore)
+		if err != nil || now.Add(sp.MaxSkew).Before(t) {
+			return false
+		}
+	}
+	if notOnOrAfter == "" {
+		return !required
+	}
+	t, err := time.Parse(time.RFC3339Nano, notOnOrAfter)
+	return err == nil && now.Add(-sp.MaxSkew).Before(t)
+}
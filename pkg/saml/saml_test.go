@@ -0,0 +1,282 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIdPEntityID = "https://idp.example.com/metadata"
+	testSPEntityID  = "https://app.example.com/saml/metadata"
+	testACSURL      = "https://app.example.com/saml/acs"
+	testRequestID   = "id-7f3c2a"
+
+	// signatureHere marks where sign puts the signature
+	signatureHere = "{{signature}}"
+)
+
+var testNow = time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+
+func newTestIdP(t *testing.T) (IdentityProvider, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    testNow.Add(-time.Hour),
+		NotAfter:     testNow.Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return IdentityProvider{
+		EntityID:     testIdPEntityID,
+		SSOURL:       "https://idp.example.com/sso",
+		Certificates: []*x509.Certificate{certificate},
+	}, key
+}
+
+func testServiceProvider() ServiceProvider {
+	return ServiceProvider{EntityID: testSPEntityID, ACSURL: testACSURL, MaxSkew: time.Minute}
+}
+
+// assertionXML is an assertion for nameID, written in its exclusive
+// canonical form so that sign can digest it as it stands
+func assertionXML(id, nameID string) string {
+	return `<saml:Assertion xmlns:saml="` + assertionNamespace + `" ID="` + id + `" IssueInstant="2026-03-02T08:59:58Z" Version="2.0">` +
+		`<saml:Issuer>` + testIdPEntityID + `</saml:Issuer>` + signatureHere +
+		`<saml:Subject><saml:NameID Format="` + EmailNameIDFormat + `">` + nameID + `</saml:NameID>` +
+		`<saml:SubjectConfirmation Method="` + bearerMethod + `"><saml:SubjectConfirmationData InResponseTo="` + testRequestID + `" NotOnOrAfter="2026-03-02T09:05:00Z" Recipient="` + testACSURL + `"></saml:SubjectConfirmationData></saml:SubjectConfirmation></saml:Subject>` +
+		`<saml:Conditions NotBefore="2026-03-02T08:59:00Z" NotOnOrAfter="2026-03-02T09:05:00Z"><saml:AudienceRestriction><saml:Audience>` + testSPEntityID + `</saml:Audience></saml:AudienceRestriction></saml:Conditions>` +
+		`<saml:AuthnStatement AuthnInstant="2026-03-02T08:59:58Z" SessionIndex="session-1"></saml:AuthnStatement>` +
+		`</saml:Assertion>`
+}
+
+// responseXML wraps assertions in a successful response, in canonical
+// form like assertionXML. The response's signature goes before them.
+func responseXML(id string, assertions ...string) string {
+	return `<samlp:Response xmlns:samlp="` + protocolNamespace + `" Destination="` + testACSURL + `" ID="` + id + `" InResponseTo="` + testRequestID + `" IssueInstant="2026-03-02T08:59:58Z" Version="2.0">` +
+		signatureHere + `<samlp:Status><samlp:StatusCode Value="` + statusSuccess + `"></samlp:StatusCode></samlp:Status>` +
+		strings.Join(assertions, "") + `</samlp:Response>`
+}
+
+// sign replaces the first signatureHere in element with an enveloped
+// signature over it, referenced by uri, and removes any others. element
+// must already be canonical, which the digest relies on rather than on
+// canonicalize.
+func sign(t *testing.T, key *rsa.PrivateKey, element, uri string) string {
+	t.Helper()
+	unsigned := strings.ReplaceAll(element, signatureHere, "")
+	digest := sha256.Sum256([]byte(unsigned))
+	signedInfo := `<ds:SignedInfo>` +
+		`<ds:CanonicalizationMethod Algorithm="` + excC14N + `"></ds:CanonicalizationMethod>` +
+		`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"></ds:SignatureMethod>` +
+		`<ds:Reference URI="` + uri + `"><ds:Transforms>` +
+		`<ds:Transform Algorithm="` + envelopedSignature + `"></ds:Transform>` +
+		`<ds:Transform Algorithm="` + excC14N + `"></ds:Transform></ds:Transforms>` +
+		`<ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"></ds:DigestMethod>` +
+		`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest[:]) + `</ds:DigestValue>` +
+		`</ds:Reference></ds:SignedInfo>`
+	// Canonicalized on its own, SignedInfo declares the prefix it uses
+	canonical := strings.Replace(signedInfo, `<ds:SignedInfo>`, `<ds:SignedInfo xmlns:ds="`+dsigNamespace+`">`, 1)
+	hashed := sha256.Sum256([]byte(canonical))
+	value, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := `<ds:Signature xmlns:ds="` + dsigNamespace + `">` + signedInfo +
+		`<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(value) + `</ds:SignatureValue></ds:Signature>`
+	return strings.Replace(strings.Replace(element, signatureHere, signature, 1), signatureHere, "", -1)
+}
+
+func parseResponse(idp IdentityProvider, response string) (*Assertion, error) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(response))
+	return testServiceProvider().ParseResponse(idp, encoded, testRequestID, testNow)
+}
+
+func TestParseResponse(t *testing.T) {
+	idp, key := newTestIdP(t)
+
+	signedAssertion := sign(t, key, assertionXML("a1", "alice@example.com"), "#a1")
+	assertion, err := parseResponse(idp, responseXML("r1", signedAssertion))
+	if err != nil {
+		t.Fatalf("signed assertion: %v", err)
+	}
+	if assertion.ID != "a1" || assertion.Email() != "alice@example.com" || assertion.SessionIndex != "session-1" {
+		t.Errorf("got %+v", assertion)
+	}
+	if want := time.Date(2026, 3, 2, 9, 6, 0, 0, time.UTC); !assertion.ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt = %s, want %s", assertion.ExpiresAt, want)
+	}
+
+	signedResponse := sign(t, key, responseXML("r1", assertionXML("a1", "alice@example.com")), "#r1")
+	if _, err := parseResponse(idp, signedResponse); err != nil {
+		t.Errorf("signed response: %v", err)
+	}
+
+	if _, err := parseResponse(idp, responseXML("r1", assertionXML("a1", "alice@example.com"))); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("unsigned response: got %v, want ErrUnsigned", err)
+	}
+	tampered := strings.Replace(signedAssertion, "alice@example.com", "admin@example.com", 1)
+	if _, err := parseResponse(idp, responseXML("r1", tampered)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("edited NameID: got %v, want ErrInvalidSignature", err)
+	}
+	other, _ := newTestIdP(t)
+	if _, err := parseResponse(other, responseXML("r1", signedAssertion)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("another identity provider's key: got %v, want ErrInvalidSignature", err)
+	}
+}
+
+// An attacker holding one signed assertion adds an unsigned one of their
+// own and moves the signed one where a careless verifier would still find
+// its signature good
+func TestParseResponseSignatureWrapping(t *testing.T) {
+	idp, key := newTestIdP(t)
+	signed := sign(t, key, assertionXML("a1", "mallory@example.com"), "#a1")
+	forged := assertionXML("evil", "admin@example.com")
+
+	tests := []struct {
+		name     string
+		response string
+		want     error
+	}{
+		{"forged assertion first", responseXML("r1", forged, signed), ErrMalformed},
+		{"forged assertion last", responseXML("r1", signed, forged), ErrMalformed},
+		{"signed assertion in Extensions", responseXML("r1",
+			`<samlp:Extensions>`+signed+`</samlp:Extensions>`, forged), ErrUnsigned},
+		{"signed assertion in the forged one's Advice", responseXML("r1",
+			strings.Replace(forged, `<saml:Subject>`, `<saml:Advice>`+signed+`</saml:Advice><saml:Subject>`, 1)), ErrUnsigned},
+		// The forged assertion takes the signed one's ID and signature, so
+		// the reference finds two elements
+		{"forged assertion with the signed one's ID", responseXML("r1",
+			`<samlp:Extensions>`+signed+`</samlp:Extensions>`,
+			strings.Replace(strings.Replace(forged, `ID="evil"`, `ID="a1"`, 1), signatureHere, signatureOf(signed), 1)), ErrInvalidSignature},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assertion, err := parseResponse(idp, strings.ReplaceAll(test.response, signatureHere, ""))
+			if !errors.Is(err, test.want) {
+				t.Errorf("got %+v, %v; want %v", assertion, err, test.want)
+			}
+		})
+	}
+}
+
+// signatureOf cuts the Signature out of a signed element
+func signatureOf(signed string) string {
+	start := strings.Index(signed, "<ds:Signature ")
+	end := strings.Index(signed, "</ds:Signature>") + len("</ds:Signature>")
+	return signed[start:end]
+}
+
+// Comments are not signed, so one may be put anywhere in a signed
+// assertion; a reader that stops at it would take the NameID for
+// admin@example.com
+func TestParseResponseCommentInNameID(t *testing.T) {
+	idp, key := newTestIdP(t)
+	signed := sign(t, key, assertionXML("a1", "admin@example.com.evil.example"), "#a1")
+	commented := strings.Replace(signed, "admin@example.com", "admin@example.com<!---->", 1)
+
+	assertion, err := parseResponse(idp, responseXML("r1", commented))
+	if err != nil {
+		t.Fatalf("the comment broke the signature: %v", err)
+	}
+	if assertion.NameID != "admin@example.com.evil.example" {
+		t.Errorf("NameID = %q, want admin@example.com.evil.example", assertion.NameID)
+	}
+}
+
+// A signature must be for the element it is in; one whose reference
+// points elsewhere does not sign the element around it
+func TestParseResponseReferenceOutsideElement(t *testing.T) {
+	idp, key := newTestIdP(t)
+
+	// A validly signed response whose signature was moved into the
+	// forged assertion, so it still verifies but covers the response
+	signedResponse := sign(t, key, responseXML("r1", assertionXML("a1", "admin@example.com")), "#r1")
+	moved := strings.Replace(assertionXML("a1", "admin@example.com"), signatureHere, signatureOf(signedResponse), 1)
+	if _, err := parseResponse(idp, strings.ReplaceAll(responseXML("r1", moved), signatureHere, "")); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("signature referencing the response: got %v, want ErrInvalidSignature", err)
+	}
+
+	// An empty URI references the whole document
+	for _, uri := range []string{"", "#r1", "#other"} {
+		signed := sign(t, key, assertionXML("a1", "admin@example.com"), uri)
+		if _, err := parseResponse(idp, strings.ReplaceAll(responseXML("r1", signed), signatureHere, "")); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("reference %q: got %v, want ErrInvalidSignature", uri, err)
+		}
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{
+			"attributes sorted and empty elements expanded",
+			`<a:root xmlns:a="urn:a" z="1" a="2"><a:child/></a:root>`,
+			`<a:root xmlns:a="urn:a" a="2" z="1"><a:child></a:child></a:root>`,
+		},
+		{
+			"namespaces declared where first used",
+			`<a:root xmlns:a="urn:a" xmlns:b="urn:b" xmlns:unused="urn:u"><a:child b:x="1"><b:leaf/></a:child></a:root>`,
+			`<a:root xmlns:a="urn:a"><a:child xmlns:b="urn:b" b:x="1"><b:leaf></b:leaf></a:child></a:root>`,
+		},
+		{
+			"attributes in a namespace after the others",
+			`<root xmlns:b="urn:b" xmlns:a="urn:a" b:y="1" a:z="2" x="3"></root>`,
+			`<root xmlns:a="urn:a" xmlns:b="urn:b" x="3" a:z="2" b:y="1"></root>`,
+		},
+		{
+			"default namespace",
+			`<root xmlns="urn:r"><child xmlns="urn:c"></child><other xmlns=""></other></root>`,
+			`<root xmlns="urn:r"><child xmlns="urn:c"></child><other xmlns=""></other></root>`,
+		},
+		{
+			"text and attributes escaped",
+			`<root a="&quot;&lt;&#9;&#10;'">&lt;&amp;&gt;"'&#13;</root>`,
+			`<root a="&quot;&lt;&#x9;&#xA;'">&lt;&amp;&gt;"'&#xD;</root>`,
+		},
+		{
+			"comments and processing instructions dropped",
+			`<?xml version="1.0"?><root><!-- c -->text<!-- d --></root>`,
+			`<root>text</root>`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root, err := parse([]byte(test.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(canonicalize(root, nil, nil)); got != test.want {
+				t.Errorf("got  %s\nwant %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRefusesDoctype(t *testing.T) {
+	doc := `<!DOCTYPE r [<!ENTITY e "admin">]><r>&e;</r>`
+	if _, err := parse([]byte(doc)); !errors.Is(err, ErrMalformed) {
+		t.Errorf("got %v, want ErrMalformed", err)
+	}
+}
@@ -0,0 +1,420 @@
+package saml
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math/big"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	dsigNamespace      = "http://www.w3.org/2000/09/xmldsig#"
+	xmlNamespace       = "http://www.w3.org/XML/1998/namespace"
+	excC14N            = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	envelopedSignature = dsigNamespace + "enveloped-signature"
+)
+
+// signatureMethods are the accepted XML-DSig signature algorithms. SHA-1
+// is not among them.
+var signatureMethods = map[string]crypto.Hash{
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256":   crypto.SHA256,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512":   crypto.SHA512,
+	"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256": crypto.SHA256,
+}
+
+// digestMethods are the accepted reference digest algorithms
+var digestMethods = map[string]crypto.Hash{
+	"http://www.w3.org/2001/04/xmlenc#sha256": crypto.SHA256,
+	"http://www.w3.org/2001/04/xmlenc#sha512": crypto.SHA512,
+}
+
+// errNoSignature is returned by verifySignature for an element without a
+// signature of its own
+var errNoSignature = errors.New("saml: element is not signed")
+
+// element is a parsed XML element. Names keep the prefixes they were
+// written with, since canonicalization needs them; namespaces are looked
+// up through the declarations in attrs.
+type element struct {
+	parent *element
+	prefix string
+	local  string
+	attrs  []xml.Attr
+	// children holds *element and string character data in document order
+	children []interface{}
+}
+
+// parse reads a document into elements. Document type declarations are
+// refused, so entities cannot be declared; comments are dropped, as
+// canonicalization without comments does.
+func parse(data []byte) (*element, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var root, current *element
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			t = t.Copy()
+			e := &element{parent: current, prefix: t.Name.Space, local: t.Name.Local, attrs: t.Attr}
+			if current != nil {
+				current.children = append(current.children, e)
+			} else if root != nil {
+				return nil, ErrMalformed
+			} else {
+				root = e
+			}
+			current = e
+		case xml.EndElement:
+			if current == nil || t.Name.Space != current.prefix || t.Name.Local != current.local {
+				return nil, ErrMalformed
+			}
+			current = current.parent
+		case xml.CharData:
+			if current != nil {
+				current.children = append(current.children, string(t))
+			} else if strings.TrimSpace(string(t)) != "" {
+				return nil, ErrMalformed
+			}
+		case xml.Directive:
+			return nil, ErrMalformed
+		case xml.ProcInst:
+			if current != nil {
+				return nil, ErrMalformed
+			}
+		}
+	}
+	if root == nil || current != nil {
+		return nil, ErrMalformed
+	}
+	return root, nil
+}
+
+// isNamespaceDeclaration reports whether a is xmlns or xmlns:prefix
+func isNamespaceDeclaration(a xml.Attr) bool {
+	return a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns")
+}
+
+// namespace returns the namespace prefix is bound to at e, reporting
+// whether it is bound at all. The empty prefix is always bound, to no
+// namespace unless a default namespace is declared.
+func (e *element) namespace(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return xmlNamespace, true
+	}
+	for el := e; el != nil; el = el.parent {
+		for _, a := range el.attrs {
+			if prefix == "" && a.Name.Space == "" && a.Name.Local == "xmlns" {
+				return a.Value, true
+			}
+			if prefix != "" && a.Name.Space == "xmlns" && a.Name.Local == prefix {
+				return a.Value, true
+			}
+		}
+	}
+	return "", prefix == ""
+}
+
+// is reports whether e is the element local in namespace space
+func (e *element) is(space, local string) bool {
+	if e == nil || e.local != local {
+		return false
+	}
+	namespace, _ := e.namespace(e.prefix)
+	return namespace == space
+}
+
+// attr returns the value of the unprefixed attribute name
+func (e *element) attr(name string) string {
+	if e == nil {
+		return ""
+	}
+	for _, a := range e.attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// all returns e's child elements local in namespace space
+func (e *element) all(space, local string) []*element {
+	if e == nil {
+		return nil
+	}
+	var found []*element
+	for _, child := range e.children {
+		if child, ok := child.(*element); ok && child.is(space, local) {
+			found = append(found, child)
+		}
+	}
+	return found
+}
+
+// child returns e's first child element local in namespace space, or nil
+func (e *element) child(space, local string) *element {
+	if found := e.all(space, local); len(found) > 0 {
+		return found[0]
+	}
+	return nil
+}
+
+// text returns e's character data, without that of child elements
+func (e *element) text() string {
+	if e == nil {
+		return ""
+	}
+	var text strings.Builder
+	for _, child := range e.children {
+		if s, ok := child.(string); ok {
+			text.WriteString(s)
+		}
+	}
+	return strings.TrimSpace(text.String())
+}
+
+// countIDs counts the elements under and including e with the ID id
+func (e *element) countIDs(id string) int {
+	count := 0
+	if e.attr("ID") == id {
+		count++
+	}
+	for _, child := range e.children {
+		if child, ok := child.(*element); ok {
+			count += child.countIDs(id)
+		}
+	}
+	return count
+}
+
+// canonicalize returns the exclusive canonical form, without comments,
+// of e (https://www.w3.org/TR/xml-exc-c14n/) leaving out skip, the
+// signature an enveloped-signature transform removes. Namespaces of the
+// prefixes in inclusive, "#default" standing for the default namespace,
+// are rendered wherever they are in scope rather than only where used.
+func canonicalize(e, skip *element, inclusive []string) []byte {
+	c := canonicalizer{skip: skip}
+	for _, prefix := range inclusive {
+		if prefix == "#default" {
+			prefix = ""
+		}
+		c.inclusive = append(c.inclusive, prefix)
+	}
+	c.element(e, map[string]string{"": ""})
+	return c.out.Bytes()
+}
+
+type canonicalizer struct {
+	out       bytes.Buffer
+	skip      *element
+	inclusive []string
+}
+
+// element writes e given the namespaces its output ancestors rendered
+func (c *canonicalizer) element(e *element, rendered map[string]string) {
+	used := append([]string{e.prefix}, c.inclusive...)
+	type attribute struct{ namespace, local, name, value string }
+	var attributes []attribute
+	for _, a := range e.attrs {
+		if isNamespaceDeclaration(a) {
+			continue
+		}
+		name := a.Name.Local
+		namespace := ""
+		if a.Name.Space != "" {
+			name = a.Name.Space + ":" + a.Name.Local
+			namespace, _ = e.namespace(a.Name.Space)
+			if a.Name.Space != "xml" {
+				used = append(used, a.Name.Space)
+			}
+		}
+		attributes = append(attributes, attribute{namespace, a.Name.Local, name, a.Value})
+	}
+	sort.Slice(attributes, func(i, j int) bool {
+		if attributes[i].namespace != attributes[j].namespace {
+			return attributes[i].namespace < attributes[j].namespace
+		}
+		return attributes[i].local < attributes[j].local
+	})
+
+	slices.Sort(used)
+	used = slices.Compact(used)
+	scope := rendered
+	var declarations []string
+	for _, prefix := range used {
+		namespace, bound := e.namespace(prefix)
+		if !bound || prefix == "xml" {
+			continue
+		}
+		if current, ok := scope[prefix]; ok && current == namespace {
+			continue
+		}
+		if len(declarations) == 0 {
+			scope = make(map[string]string, len(rendered)+1)
+			for p, ns := range rendered {
+				scope[p] = ns
+			}
+		}
+		scope[prefix] = namespace
+		declarations = append(declarations, prefix)
+	}
+
+	name := e.local
+	if e.prefix != "" {
+		name = e.prefix + ":" + e.local
+	}
+	c.out.WriteString("<" + name)
+	for _, prefix := range declarations {
+		if prefix == "" {
+			c.out.WriteString(` xmlns="`)
+		} else {
+			c.out.WriteString(" xmlns:" + prefix + `="`)
+		}
+		c.out.WriteString(escapeAttribute(scope[prefix]) + `"`)
+	}
+	for _, a := range attributes {
+		c.out.WriteString(" " + a.name + `="` + escapeAttribute(a.value) + `"`)
+	}
+	c.out.WriteString(">")
+	for _, child := range e.children {
+		switch child := child.(type) {
+		case string:
+			c.out.WriteString(escapeText(child))
+		case *element:
+			if child != c.skip {
+				c.element(child, scope)
+			}
+		}
+	}
+	c.out.WriteString("</" + name + ">")
+}
+
+var (
+	textEscaper      = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	attributeEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+func escapeText(s string) string      { return textEscaper.Replace(s) }
+func escapeAttribute(s string) string { return attributeEscaper.Replace(s) }
+
+// inclusivePrefixes returns the InclusiveNamespaces PrefixList of an
+// exclusive canonicalization method or transform
+func inclusivePrefixes(method *element) []string {
+	return strings.Fields(method.child(excC14N, "InclusiveNamespaces").attr("PrefixList"))
+}
+
+// verifySignature checks the enveloped signature of e, which must sign e
+// itself and nothing else, against certificates. root is the document e
+// is in: e's ID must be unique in it, so the signature cannot be pointed
+// at a copy of e placed elsewhere.
+func verifySignature(root, e *element, certificates []*x509.Certificate) error {
+	signatures := e.all(dsigNamespace, "Signature")
+	if len(signatures) == 0 {
+		return errNoSignature
+	}
+	if len(signatures) > 1 {
+		return ErrInvalidSignature
+	}
+	signature := signatures[0]
+	signedInfo := signature.child(dsigNamespace, "SignedInfo")
+	if signedInfo == nil {
+		return ErrMalformed
+	}
+
+	c14nMethod := signedInfo.child(dsigNamespace, "CanonicalizationMethod")
+	if c14nMethod.attr("Algorithm") != excC14N {
+		return ErrUnsupportedAlgorithm
+	}
+	signatureHash, ok := signatureMethods[signedInfo.child(dsigNamespace, "SignatureMethod").attr("Algorithm")]
+	if !ok {
+		return ErrUnsupportedAlgorithm
+	}
+
+	references := signedInfo.all(dsigNamespace, "Reference")
+	id := e.attr("ID")
+	if len(references) != 1 || id == "" || references[0].attr("URI") != "#"+id || root.countIDs(id) != 1 {
+		return ErrInvalidSignature
+	}
+	reference := references[0]
+	var referenceInclusive []string
+	canonicalized := false
+	for _, transform := range reference.child(dsigNamespace, "Transforms").all(dsigNamespace, "Transform") {
+		switch transform.attr("Algorithm") {
+		case envelopedSignature:
+		case excC14N:
+			canonicalized = true
+			referenceInclusive = inclusivePrefixes(transform)
+		default:
+			return ErrUnsupportedAlgorithm
+		}
+	}
+	if !canonicalized {
+		return ErrUnsupportedAlgorithm
+	}
+	digestHash, ok := digestMethods[reference.child(dsigNamespace, "DigestMethod").attr("Algorithm")]
+	if !ok {
+		return ErrUnsupportedAlgorithm
+	}
+	digestValue, err := decodeBase64(reference.child(dsigNamespace, "DigestValue").text())
+	if err != nil {
+		return ErrMalformed
+	}
+	digest := digestHash.New()
+	digest.Write(canonicalize(e, signature, referenceInclusive))
+	if subtle.ConstantTimeCompare(digest.Sum(nil), digestValue) != 1 {
+		return ErrInvalidSignature
+	}
+
+	signatureValue, err := decodeBase64(signature.child(dsigNamespace, "SignatureValue").text())
+	if err != nil {
+		return ErrMalformed
+	}
+	signed := signatureHash.New()
+	signed.Write(canonicalize(signedInfo, nil, inclusivePrefixes(c14nMethod)))
+	sum := signed.Sum(nil)
+	for _, certificate := range certificates {
+		if verifyWithKey(certificate.PublicKey, signatureHash, sum, signatureValue) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func verifyWithKey(public crypto.PublicKey, hash crypto.Hash, digest, signature []byte) bool {
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// XML-DSig writes ECDSA signatures as r || s (RFC 4050)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// decodeBase64 decodes base64 that may be wrapped over several lines
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
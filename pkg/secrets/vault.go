@@ -0,0 +1,180 @@
+// Package secrets fetches secrets and wraps keys with HashiCorp Vault
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ErrNotFound is returned when the secret path does not exist
+var ErrNotFound = errors.New("secret not found")
+
+// maxResponseSize bounds how much of a Vault response is read
+const maxResponseSize = 1 << 20
+
+// Source fetches the current values of a set of named secrets
+type Source interface {
+	Fetch(ctx context.Context) (map[string]string, error)
+}
+
+// Vault holds the connection settings shared by the Vault clients
+type Vault struct {
+	// Addr is the Vault server, e.g. https://vault.internal:8200
+	Addr string
+	// Token authenticates requests. TokenFile, when set, is read on every
+	// request instead, so a token renewed by a Vault agent is picked up.
+	Token     string
+	TokenFile string
+	Client    *http.Client
+}
+
+func (v *Vault) token() (string, error) {
+	if v.TokenFile == "" {
+		return v.Token, nil
+	}
+	contents, err := os.ReadFile(v.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("reading vault token: %w", err)
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
+
+// do sends a request to the Vault API and decodes the JSON response into out
+func (v *Vault) do(ctx context.Context, method, path string, in, out interface{}) error {
+	token, err := v.token()
+	if err != nil {
+		return err
+	}
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var body io.Reader
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(v.Addr, "/")+"/v1/"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		var apiError struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&apiError)
+		return fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(apiError.Errors, "; "))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(out)
+}
+
+// VaultKV reads secrets from a version 2 key/value secrets engine. Every
+// key of the secret at Path becomes a named secret.
+type VaultKV struct {
+	Vault
+	// Mount is where the engine is mounted, "secret" by default
+	Mount string
+	Path  string
+}
+
+// Fetch reads the latest version of the secret
+func (kv *VaultKV) Fetch(ctx context.Context) (map[string]string, error) {
+	mount := kv.Mount
+	if mount == "" {
+		mount = "secret"
+	}
+
+	var resp struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := kv.do(ctx, http.MethodGet, mount+"/data/"+strings.TrimLeft(kv.Path, "/"), nil, &resp); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(resp.Data.Data))
+	for name, value := range resp.Data.Data {
+		if s, ok := value.(string); ok {
+			values[name] = s
+		} else {
+			values[name] = fmt.Sprint(value)
+		}
+	}
+	return values, nil
+}
+
+// VaultTransit wraps data keys with a key held by a transit secrets
+// engine, so the key never leaves Vault. It satisfies
+// cryptoutil.KeyWrapper.
+type VaultTransit struct {
+	Vault
+	// Mount is where the engine is mounted, "transit" by default
+	Mount string
+	Key   string
+}
+
+func (t *VaultTransit) path(operation string) string {
+	mount := t.Mount
+	if mount == "" {
+		mount = "transit"
+	}
+	return mount + "/" + operation + "/" + t.Key
+}
+
+// WrapKey encrypts dataKey with the transit key
+func (t *VaultTransit) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	in := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dataKey)}
+	if err := t.do(ctx, http.MethodPost, t.path("encrypt"), in, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Data.Ciphertext == "" {
+		return nil, errors.New("vault returned no ciphertext")
+	}
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+// UnwrapKey decrypts a key produced by WrapKey
+func (t *VaultTransit) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	in := map[string]string{"ciphertext": string(wrapped)}
+	if err := t.do(ctx, http.MethodPost, t.path("decrypt"), in, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"auth-server/pkg/policy"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// accessRulesModel decides access rules: a request is refused when a
+// deny rule for its path and method has a condition the user meets.
+// Conditions read the user's attributes as r.sub.<name>, so the rule
+//
+//	p, "r.sub.verified != true || r.sub.age_days < 7", /api/tokens, POST, deny
+//
+// only lets verified users whose accounts are a week old create tokens.
+const accessRulesModel = `[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub_rule, obj, act, eft
+
+[policy_effect]
+e = !some(where (p.eft == deny))
+
+[matchers]
+m = keyMatch2(r.obj, p.obj) && keyMatch(r.act, p.act) && eval(p.sub_rule)
+`
+
+// newAccessRules loads the access rules kept in path, or starts without
+// any, kept in memory, when path is empty
+func newAccessRules(path string, interval time.Duration, logger *log.Logger) (*policyEngine, error) {
+	model, err := policy.ParseModel(accessRulesModel)
+	if err != nil {
+		return nil, err
+	}
+	return newPolicyEngine(model, nil, path, interval, logger)
+}
+
+// userAttributes are the attributes of a user that policy rules can use:
+//
+//	id, username, role  the account's ID, username and role
+//	org                 the user's tenant, by default the email's domain
+//	verified            "true" once the email address is verified
+//	two_factor          "true" when a second factor is enabled
+//	country             the country of the last sign-in, when known
+//	age_days            whole days since the account was created
+func userAttributes(user *User, now time.Time) policy.Attributes {
+	return policy.Attributes{
+		"id":         user.ID,
+		"username":   user.Username,
+		"role":       user.Role,
+		"org":        userOrganization(user),
+		"verified":   strconv.FormatBool(user.EmailVerifiedAt != nil),
+		"two_factor": strconv.FormatBool(user.HasTwoFactor()),
+		"country":    user.LastLoginCountry,
+		"age_days":   strconv.Itoa(int(now.Sub(user.Created) / (24 * time.Hour))),
+	}
+}
+
+// accessRulesMiddleware refuses requests of session users that an access
+// rule denies. Requests without a session are passed on, since the rules
+// are about users.
+func (s *Server) accessRulesMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := s.authHandler
+		if len(h.accessRules.rules()) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, err := h.sessionUser(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		attributes := map[string]policy.Attributes{"sub": userAttributes(user, h.clock.Now())}
+		allowed, rule := h.accessRules.enforcer.ExplainAttributes(attributes, user.Username, r.URL.Path, r.Method)
+		if !allowed {
+			s.logger.Printf("[DEBUG] %s %s refused for %s by access rule %q", r.Method, r.URL.Path, user.Username, rule)
+			http.Error(w, localize(r, "Your account is not allowed to make this request"), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AccessRulesHandler lets admins view (GET) and replace (PUT) the access
+// rules, which refuse requests based on the user's attributes
+func (s *Server) AccessRulesHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Access rules request received")
+	s.servePolicy(w, r, s.authHandler.accessRules, "access_rules")
+}
+
+// AccessRulesReloadHandler lets admins reread the access rules file now
+func (s *Server) AccessRulesReloadHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Access rules reload request received")
+	s.reloadPolicy(w, r, s.authHandler.accessRules, "access_rules")
+}
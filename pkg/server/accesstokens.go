@@ -0,0 +1,449 @@
+package server
+
+import (
+	"auth-server/pkg/ids"
+	"auth-server/pkg/randutil"
+	"auth-server/pkg/sessionstore"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Personal access token scopes. A scope ending in ":*" grants every scope
+// with that prefix, e.g. transform:*.
+const (
+	ScopeProfileRead       = "profile:read"
+	ScopeProfileWrite      = "profile:write"
+	ScopeUsersAdmin        = "users:admin"
+	ScopeTransformBase64   = "transform:base64"
+	ScopeTransformPipeline = "transform:pipeline"
+	ScopeTransformHash     = "transform:hash"
+	ScopeTransformHMAC     = "transform:hmac"
+	ScopeTransformEncrypt  = "transform:encrypt"
+	ScopeTransformRandom   = "transform:random"
+)
+
+// accessTokenScopes are the scopes tokens can be granted
+var accessTokenScopes = []string{
+	ScopeProfileRead,
+	ScopeProfileWrite,
+	ScopeUsersAdmin,
+	ScopeTransformBase64,
+	ScopeTransformPipeline,
+	ScopeTransformHash,
+	ScopeTransformHMAC,
+	ScopeTransformEncrypt,
+	ScopeTransformRandom,
+}
+
+// accessTokenRoutes maps the routes personal access tokens may call, by
+// method and path template, to the scope each needs. Every other route,
+// including managing tokens, passwords and second factors, needs a session.
+var accessTokenRoutes = map[string]string{
+	"GET /api/profile":                            ScopeProfileRead,
+	"GET /api/preferences":                        ScopeProfileRead,
+	"GET /api/identities":                         ScopeProfileRead,
+	"GET /api/2fa":                                ScopeProfileRead,
+	"GET /api/account/export":                     ScopeProfileRead,
+	"GET /api/usage":                              ScopeProfileRead,
+	"PATCH /api/profile":                          ScopeProfileWrite,
+	"PUT /api/preferences":                        ScopeProfileWrite,
+	"POST /api/change-locale":                     ScopeProfileWrite,
+	"GET /api/admin/users/search":                 ScopeUsersAdmin,
+	"GET /api/admin/users/deleted":                ScopeUsersAdmin,
+	"DELETE /api/admin/users/{id}":                ScopeUsersAdmin,
+	"POST /api/admin/users/{id}/restore":          ScopeUsersAdmin,
+	"POST /api/admin/users/{id}/suspend":          ScopeUsersAdmin,
+	"POST /api/admin/users/{id}/unsuspend":        ScopeUsersAdmin,
+	"GET /api/admin/signups/review":               ScopeUsersAdmin,
+	"POST /api/admin/signups/review/{id}/approve": ScopeUsersAdmin,
+	"POST /api/admin/signups/review/{id}/reject":  ScopeUsersAdmin,
+	"POST /api/base64/encode":                     ScopeTransformBase64,
+	"POST /api/base64/decode":                     ScopeTransformBase64,
+	"POST /api/base64/encode-file":                ScopeTransformBase64,
+	"POST /api/base64/encode/stream":              ScopeTransformBase64,
+	"POST /api/base64/decode/stream":              ScopeTransformBase64,
+	"POST /api/transform":                         ScopeTransformPipeline,
+	"POST /api/hash":                              ScopeTransformHash,
+	"POST /api/hmac":                              ScopeTransformHMAC,
+	"POST /api/encrypt":                           ScopeTransformEncrypt,
+	"POST /api/decrypt":                           ScopeTransformEncrypt,
+	"GET /api/random":                             ScopeTransformRandom,
+}
+
+const (
+	// accessTokenPrefix starts every personal access token, so they are
+	// easy to tell from session tokens and to find in leaked code
+	accessTokenPrefix = "pat_"
+	// maxAccessTokens caps how many tokens a user may have
+	maxAccessTokens = 50
+	// accessTokenTouchInterval is how often a token's last use is stored,
+	// so busy tokens do not write the user on every request
+	accessTokenTouchInterval = time.Minute
+)
+
+var errUnknownScope = errors.New("unknown scope")
+
+// CreateAccessTokenRequest creates a personal access token. Without
+// ExpiresAt it lasts Config.AccessTokenTTL.
+type CreateAccessTokenRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// CreatedAccessToken is a new personal access token, the only time the
+// token itself is shown
+type CreatedAccessToken struct {
+	PersonalAccessToken
+	Token string `json:"token"`
+}
+
+// checkScopes validates requested scopes, allowing "prefix:*" for any
+// prefix some scope has
+func checkScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errUnknownScope
+	}
+	for _, scope := range scopes {
+		if slices.Contains(accessTokenScopes, scope) {
+			continue
+		}
+		prefix, ok := strings.CutSuffix(scope, "*")
+		if !ok || !strings.HasSuffix(prefix, ":") || !slices.ContainsFunc(accessTokenScopes, func(known string) bool {
+			return strings.HasPrefix(known, prefix)
+		}) {
+			return fmt.Errorf("%w: %s", errUnknownScope, scope)
+		}
+	}
+	return nil
+}
+
+// grantsAdminScope reports whether scopes include one that grants
+// ScopeUsersAdmin
+func grantsAdminScope(scopes []string) bool {
+	return slices.ContainsFunc(scopes, func(scope string) bool {
+		return PersonalAccessToken{Scopes: []string{scope}}.Allows(ScopeUsersAdmin)
+	})
+}
+
+// hashAccessToken is the form a token is stored and compared in
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// accessTokenUserID returns the ID of the user a token belongs to, which
+// it carries between the prefix and the secret
+func accessTokenUserID(token string) (string, bool) {
+	rest, ok := strings.CutPrefix(token, accessTokenPrefix)
+	if !ok {
+		return "", false
+	}
+	i := strings.LastIndex(rest, "_")
+	if i <= 0 {
+		return "", false
+	}
+	return rest[:i], true
+}
+
+// accessTokenAuth is the token a request authenticated with
+type accessTokenAuth struct {
+	userID string
+	token  PersonalAccessToken
+}
+
+// accessTokenKey is the context key for accessTokenAuth
+type accessTokenKey struct{}
+
+// accessTokenSession stands in for a session on requests made with a
+// personal access token, so handlers find the user as usual
+func accessTokenSession(r *http.Request) (sessionstore.Session, bool) {
+	auth, ok := r.Context().Value(accessTokenKey{}).(accessTokenAuth)
+	if !ok {
+		return sessionstore.Session{}, false
+	}
+	return sessionstore.Session{
+		ID:              auth.token.ID,
+		UserID:          auth.userID,
+		CreatedAt:       auth.token.CreatedAt,
+		ExpiresAt:       auth.token.ExpiresAt,
+		AuthenticatedAt: auth.token.CreatedAt,
+	}, true
+}
+
+// verifyAccessToken returns the user and unexpired token that token is
+func (h *AuthHandler) verifyAccessToken(ctx context.Context, token string, now time.Time) (*User, int, error) {
+	userID, ok := accessTokenUserID(token)
+	if !ok {
+		return nil, 0, errNoSession
+	}
+	user, err := h.users.Get(ctx, userID)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, 0, errNoSession
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hash := hashAccessToken(token)
+	for i, stored := range user.AccessTokens {
+		if subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(hash)) == 1 {
+			if !now.Before(stored.ExpiresAt) {
+				return nil, 0, errNoSession
+			}
+			return user, i, nil
+		}
+	}
+	return nil, 0, errNoSession
+}
+
+// touchAccessToken records a use of the user's token at index i
+func (h *AuthHandler) touchAccessToken(ctx context.Context, user *User, i int, ip string, now time.Time) {
+	token := user.AccessTokens[i]
+	if token.LastUsedAt != nil && now.Sub(*token.LastUsedAt) < accessTokenTouchInterval && token.LastUsedIP == ip {
+		return
+	}
+	token.LastUsedAt = &now
+	token.LastUsedIP = ip
+	user.AccessTokens = slices.Clone(user.AccessTokens)
+	user.AccessTokens[i] = token
+	if err := h.users.Update(ctx, user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to record use of access token %s: %v", token.ID, err)
+	}
+}
+
+// accessTokenMiddleware authenticates requests carrying a personal access
+// token, allowing only the routes in accessTokenRoutes whose scope the
+// token was granted. Handlers then see the token's user as the session
+// user. Other requests pass through untouched.
+func (s *Server) accessTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok || !strings.HasPrefix(token, accessTokenPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scope := ""
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				scope = accessTokenRoutes[r.Method+" "+template]
+			}
+		}
+		if scope == "" {
+			s.logger.Printf("[DEBUG] Access token used on a session-only route: %s %s", r.Method, r.URL.Path)
+			http.Error(w, localize(r, "Personal access tokens cannot be used for this request"), http.StatusForbidden)
+			return
+		}
+
+		h := s.authHandler
+		now := h.clock.Now()
+		user, i, err := h.verifyAccessToken(r.Context(), token, now)
+		if err != nil {
+			s.logger.Printf("[DEBUG] Access token rejected: %v", err)
+			if !errors.Is(err, errNoSession) {
+				writeStoreError(w, r, err)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="auth-server", error="invalid_token"`)
+			http.Error(w, localize(r, "Unauthorized"), http.StatusUnauthorized)
+			return
+		}
+
+		granted := user.AccessTokens[i]
+		if !granted.Allows(scope) {
+			s.logger.Printf("[DEBUG] Access token %s lacks scope %s", granted.ID, scope)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="auth-server", error="insufficient_scope", scope=%q`, scope))
+			http.Error(w, localize(r, "Forbidden"), http.StatusForbidden)
+			return
+		}
+
+		h.touchAccessToken(r.Context(), user, i, clientIP(r), now)
+		auth := accessTokenAuth{userID: user.ID, token: granted}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), accessTokenKey{}, auth)))
+	})
+}
+
+// AccessTokensHandler lists the session user's personal access tokens on
+// GET and creates one on POST. Tokens can only be managed from a session.
+func (h *AuthHandler) AccessTokensHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Access tokens request received")
+
+	user := contextUser(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		tokens := user.AccessTokens
+		if tokens == nil {
+			tokens = []PersonalAccessToken{}
+		}
+		json.NewEncoder(w).Encode(Response{Success: true, Data: tokens})
+
+	case http.MethodPost:
+		h.createAccessToken(w, r, user)
+
+	default:
+		h.logger.Printf("[DEBUG] Invalid method: %s", r.Method)
+		http.Error(w, localize(r, "Method not allowed"), http.StatusMethodNotAllowed)
+	}
+}
+
+// createAccessToken issues a personal access token to user
+func (h *AuthHandler) createAccessToken(w http.ResponseWriter, r *http.Request, user *User) {
+	var req CreateAccessTokenRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, localize(r, "A token name is required"), http.StatusBadRequest)
+		return
+	}
+	if err := checkScopes(req.Scopes); err != nil {
+		h.logger.Printf("[DEBUG] Invalid access token scopes %v: %v", req.Scopes, err)
+		http.Error(w, localize(r, "Invalid scopes"), http.StatusBadRequest)
+		return
+	}
+	if grantsAdminScope(req.Scopes) && user.Role != RoleAdmin {
+		http.Error(w, localize(r, "Only admins can grant admin scopes"), http.StatusForbidden)
+		return
+	}
+
+	now := h.clock.Now()
+	expiresAt := now.Add(h.config.AccessTokenTTL)
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+	}
+	if !expiresAt.After(now) || expiresAt.Sub(now) > h.config.AccessTokenMaxTTL {
+		http.Error(w, localize(r, "Tokens must expire within %d days", int(h.config.AccessTokenMaxTTL.Hours()/24)), http.StatusBadRequest)
+		return
+	}
+	if len(user.AccessTokens) >= maxAccessTokens {
+		http.Error(w, localize(r, "You have too many access tokens, revoke some first"), http.StatusConflict)
+		return
+	}
+
+	token, created, err := h.newAccessToken(user, req.Name, req.Scopes, expiresAt, now)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to generate access token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	user.AccessTokens = append(slices.Clone(user.AccessTokens), created)
+	user.UpdatedAt = now
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to store access token for %s: %v", user.Username, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditAccessTokenCreated,
+		UserID:  user.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"token": created.ID, "scopes": strings.Join(created.Scopes, ","), "expiresAt": expiresAt.Format(time.RFC3339)},
+	})
+	h.notifySecurityChange(r, user, NoticeAPIKeyCreated, "")
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: localize(r, "Access token created. Copy it now, it will not be shown again."),
+		Data:    CreatedAccessToken{PersonalAccessToken: created, Token: token},
+	})
+	h.logger.Printf("[DEBUG] Access token %s created for %s", created.ID, user.Username)
+}
+
+// newAccessToken generates a token for user, returning it with the record
+// to store on the user
+func (h *AuthHandler) newAccessToken(user *User, name string, scopes []string, expiresAt, now time.Time) (string, PersonalAccessToken, error) {
+	secret, err := randutil.Bytes(32)
+	if err != nil {
+		return "", PersonalAccessToken{}, err
+	}
+	token := accessTokenPrefix + user.ID + "_" + hex.EncodeToString(secret)
+	return token, PersonalAccessToken{
+		ID:        h.idGenerator.NewID(ids.PrefixToken),
+		Name:      name,
+		Scopes:    slices.Clone(scopes),
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+		Hash:      hashAccessToken(token),
+	}, nil
+}
+
+// AccessTokenDeleteHandler revokes one of the session user's personal
+// access tokens
+func (h *AuthHandler) AccessTokenDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Access token revocation request received")
+
+	user := contextUser(r)
+
+	id := mux.Vars(r)["id"]
+	i := slices.IndexFunc(user.AccessTokens, func(token PersonalAccessToken) bool { return token.ID == id })
+	if i < 0 {
+		http.Error(w, localize(r, "Access token not found"), http.StatusNotFound)
+		return
+	}
+
+	user.AccessTokens = slices.Delete(slices.Clone(user.AccessTokens), i, i+1)
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to revoke access token %s: %v", id, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditAccessTokenRevoked,
+		UserID:  user.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"token": id},
+	})
+
+	json.NewEncoder(w).Encode(Response{Success: true, Message: localize(r, "Access token revoked")})
+}
+
+// purgeExpiredAccessTokens drops expired personal access tokens and
+// returns how many it dropped
+func (h *AuthHandler) purgeExpiredAccessTokens(now time.Time) int {
+	ctx := context.Background()
+	users, err := h.users.List(ctx)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to list users to purge access tokens: %v", err)
+		return 0
+	}
+
+	purged := 0
+	for _, user := range users {
+		kept := slices.DeleteFunc(slices.Clone(user.AccessTokens), func(token PersonalAccessToken) bool {
+			return !now.Before(token.ExpiresAt)
+		})
+		if len(kept) == len(user.AccessTokens) {
+			continue
+		}
+		dropped := len(user.AccessTokens) - len(kept)
+		user.AccessTokens = kept
+		if err := h.users.Update(ctx, user); err != nil {
+			h.logger.Printf("[DEBUG] Failed to purge access tokens of %s: %v", user.ID, err)
+			continue
+		}
+		purged += dropped
+	}
+	return purged
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"auth-server/pkg/ipacl"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+
+	"github.com/gorilla/mux"
+)
+
+// ACLRuleRequest represents a request to add a network access rule
+type ACLRuleRequest struct {
+	Action string `json:"action"`
+	CIDR   string `json:"cidr"`
+	Path   string `json:"path"`
+}
+
+// aclMiddleware rejects requests from addresses blocked by the access list
+// and records each refusal in the audit log
+func (s *Server) aclMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			s.logger.Printf("[DEBUG] Could not parse client IP %q: %v", ip, err)
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+
+		allowed, rule := s.acl.Check(addr, r.URL.Path)
+		if !allowed {
+			details := map[string]string{"path": r.URL.Path, "method": r.Method}
+			if rule.ID != "" {
+				details["rule"] = rule.ID
+			} else {
+				details["rule"] = "not in allowlist"
+			}
+			s.audit.Record(AuditEvent{Type: AuditAccessDenied, IP: ip, Details: details})
+
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ACLRulesHandler lists access rules on GET and adds one on POST
+func (s *Server) ACLRulesHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] ACL rules request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		response := Response{
+			Success: true,
+			Message: "Access rules retrieved successfully",
+			Data:    s.acl.Rules(),
+		}
+
+		json.NewEncoder(w).Encode(response)
+
+	case http.MethodPost:
+		var req ACLRuleRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+			writeBodyError(w, r, err)
+			return
+		}
+
+		cidr, err := ipacl.ParseCIDR(req.CIDR)
+		if err != nil {
+			s.logger.Printf("[DEBUG] Invalid CIDR %q: %v", req.CIDR, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rule, err := s.acl.Add(req.Action, cidr, req.Path)
+		if err != nil {
+			s.logger.Printf("[DEBUG] Invalid access rule: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.audit.Record(AuditEvent{
+			Type:   AuditACLChanged,
+			UserID: admin.ID,
+			IP:     clientIP(r),
+			Details: map[string]string{
+				"change": "added",
+				"rule":   rule.ID,
+				"action": rule.Action,
+				"cidr":   rule.CIDR.String(),
+				"path":   rule.Path,
+			},
+		})
+
+		response := Response{
+			Success: true,
+			Message: "Access rule added successfully",
+			Data:    rule,
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(response)
+
+	default:
+		s.logger.Printf("[DEBUG] Invalid method: %s", r.Method)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ACLRuleDeleteHandler removes an access rule by ID
+func (s *Server) ACLRuleDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] ACL rule delete request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if !s.acl.Remove(id) {
+		s.logger.Printf("[DEBUG] Access rule not found: %s", id)
+		http.Error(w, "Access rule not found", http.StatusNotFound)
+		return
+	}
+
+	s.audit.Record(AuditEvent{
+		Type:    AuditACLChanged,
+		UserID:  admin.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"change": "removed", "rule": id},
+	})
+
+	response := Response{
+		Success: true,
+		Message: "Access rule removed successfully",
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// newACLFromConfig builds the access list from the global rules in cfg
+func newACLFromConfig(cfg Config) *ipacl.List {
+	acl := ipacl.NewList()
+	for _, cidr := range cfg.ACLAllow {
+		acl.Add(ipacl.ActionAllow, cidr, "")
+	}
+	for _, cidr := range cfg.ACLDeny {
+		acl.Add(ipacl.ActionDeny, cidr, "")
+	}
+	return acl
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"auth-server/pkg/metrics"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admin alert types, used in alert payloads and in ALERT_ROUTES
+const (
+	AlertAdminCreated = "admin_created"
+	AlertFailedLogins = "failed_logins"
+	AlertStoreError   = "store_error"
+)
+
+// Alert channels
+const (
+	AlertChannelSlack   = "slack"
+	AlertChannelWebhook = "webhook"
+)
+
+// alertTypes are every alert type, in the order they are documented
+var alertTypes = []string{AlertAdminCreated, AlertFailedLogins, AlertStoreError}
+
+// alertAuditBuffer is how many audit events may wait for the dispatcher
+const alertAuditBuffer = 256
+
+// errAlertsDisabled is returned when an alert is delivered with no
+// channels configured
+var errAlertsDisabled = errors.New("alerts are not configured")
+
+// alertPayload is the JSON body sent to the generic webhook channel
+type alertPayload struct {
+	Alert   string            `json:"alert"`
+	Time    time.Time         `json:"time"`
+	Summary string            `json:"summary"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// slackPayload is the message posted to a Slack incoming webhook
+type slackPayload struct {
+	Text string `json:"text"`
+}
+
+// alertDispatcher sends admin-facing alerts to Slack and a generic webhook,
+// each alert type to the channels Config.AlertRoutes gives it. Alerts go
+// through the outbox, so they are retried like any webhook. Failed login
+// and store error alerts are sent at most once per Config.AlertCooldown,
+// so an outage does not flood the channel.
+type alertDispatcher struct {
+	channels  map[string]string // channel to URL
+	secret    []byte
+	routes    map[string][]string
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	timeout   time.Duration
+	client    *http.Client
+	enqueue   func(ctx context.Context, msg OutboxMessage) OutboxMessage
+	now       func() time.Time
+	logger    *log.Logger
+
+	failedLogins *metrics.Window
+
+	mutex    sync.Mutex
+	lastSent map[string]time.Time
+}
+
+// newAlertDispatcherFromConfig returns nil unless a Slack or generic
+// webhook URL is configured
+func newAlertDispatcherFromConfig(cfg Config, enqueue func(ctx context.Context, msg OutboxMessage) OutboxMessage, now func() time.Time) *alertDispatcher {
+	channels := make(map[string]string)
+	if cfg.AlertSlackWebhookURL != "" {
+		channels[AlertChannelSlack] = cfg.AlertSlackWebhookURL
+	}
+	if cfg.AlertWebhookURL != "" {
+		channels[AlertChannelWebhook] = cfg.AlertWebhookURL
+	}
+	if len(channels) == 0 {
+		return nil
+	}
+
+	cfg.Logger.Printf("[DEBUG] Admin alerts enabled on %d channels", len(channels))
+	return &alertDispatcher{
+		channels:     channels,
+		secret:       []byte(cfg.AlertWebhookSecret),
+		routes:       cfg.AlertRoutes,
+		threshold:    cfg.AlertFailedLoginThreshold,
+		window:       cfg.AlertFailedLoginWindow,
+		cooldown:     cfg.AlertCooldown,
+		timeout:      cfg.HookWebhookTimeout,
+		client:       &http.Client{},
+		enqueue:      enqueue,
+		now:          now,
+		logger:       cfg.Logger,
+		failedLogins: metrics.NewWindow(cfg.AlertFailedLoginWindow, sloWindowSlots),
+		lastSent:     make(map[string]time.Time),
+	}
+}
+
+// channelsFor returns the channels alertType goes to: those its route
+// lists, or every configured channel when it has none
+func (a *alertDispatcher) channelsFor(alertType string) []string {
+	var channels []string
+	route, routed := a.routes[alertType]
+	for channel := range a.channels {
+		if !routed || slices.Contains(route, channel) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// raise queues an alert for its channels. Alerts of a throttled type are
+// dropped while the previous one is within the cooldown. A nil dispatcher
+// sends nothing.
+func (a *alertDispatcher) raise(ctx context.Context, alertType, summary string, details map[string]string, throttled bool) {
+	if a == nil {
+		return
+	}
+	now := a.now()
+	if throttled {
+		a.mutex.Lock()
+		last, sent := a.lastSent[alertType]
+		if sent && now.Sub(last) < a.cooldown {
+			a.mutex.Unlock()
+			return
+		}
+		a.lastSent[alertType] = now
+		a.mutex.Unlock()
+	}
+
+	for _, channel := range a.channelsFor(alertType) {
+		body, err := a.encode(channel, alertPayload{Alert: alertType, Time: now.UTC(), Summary: summary, Details: details})
+		if err != nil {
+			a.logger.Printf("[DEBUG] Failed to encode %s alert: %v", alertType, err)
+			continue
+		}
+		a.enqueue(ctx, OutboxMessage{
+			Kind:    OutboxKindAlert,
+			Label:   alertType,
+			Webhook: &OutboxWebhook{URL: a.channels[channel], Body: body},
+		})
+	}
+	a.logger.Printf("[DEBUG] Raised %s alert: %s", alertType, summary)
+}
+
+// encode renders payload for channel: a text message for Slack, and the
+// payload itself for the generic webhook
+func (a *alertDispatcher) encode(channel string, payload alertPayload) ([]byte, error) {
+	if channel != AlertChannelSlack {
+		return json.Marshal(payload)
+	}
+	lines := []string{fmt.Sprintf("*auth-server %s*: %s", payload.Alert, payload.Summary)}
+	keys := make([]string, 0, len(payload.Details))
+	for key := range payload.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("• %s: %s", key, payload.Details[key]))
+	}
+	return json.Marshal(slackPayload{Text: strings.Join(lines, "\n")})
+}
+
+// send delivers a queued alert; a non-2xx answer is a failure to be
+// retried. Alerts to the generic webhook are signed like hooks, with
+// HMAC-SHA256 of the body in the X-Alert-Signature header.
+func (a *alertDispatcher) send(ctx context.Context, msg OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, msg.Webhook.URL, bytes.NewReader(msg.Webhook.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(a.secret) > 0 && msg.Webhook.URL == a.channels[AlertChannelWebhook] {
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write(msg.Webhook.Body)
+		req.Header.Set("X-Alert-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("alert channel returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// observe raises the alerts audit events call for: a user made an admin,
+// and failed logins reaching the threshold within the window
+func (a *alertDispatcher) observe(event AuditEvent) {
+	switch event.Type {
+	case AuditRoleChanged:
+		if event.Details["role"] == RoleAdmin && event.Details["previous"] != RoleAdmin {
+			a.raise(context.Background(), AlertAdminCreated, "A user was made an admin", map[string]string{
+				"user": event.Details["target"],
+				"by":   event.UserID,
+				"ip":   event.IP,
+			}, false)
+		}
+	case AuditLoginFailed:
+		now := a.now()
+		a.failedLogins.Observe(now, false)
+		if _, failed := a.failedLogins.Counts(now); failed >= uint64(a.threshold) {
+			a.raise(context.Background(), AlertFailedLogins, fmt.Sprintf("%d failed logins in the last %s", failed, a.window), map[string]string{
+				"count":  fmt.Sprint(failed),
+				"lastIP": event.IP,
+			}, true)
+		}
+	}
+}
+
+// start subscribes to audit and raises alerts from its events until
+// stopped
+func (a *alertDispatcher) start(audit *AuditLog) (stop func()) {
+	events, unsubscribe := audit.Subscribe(alertAuditBuffer)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case event := <-events:
+				a.observe(event)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		unsubscribe()
+		close(done)
+		wg.Wait()
+	}
+}
+
+// alertingUserStore raises store error alerts for failed calls to the
+// store under it, and admin created alerts for accounts created with the
+// admin role. It sits under PII encryption, so failures are those of the
+// real storage.
+type alertingUserStore struct {
+	next   UserStore
+	alerts *alertDispatcher // nil when alerts are disabled
+}
+
+// check raises a store error alert unless err is an expected outcome
+func (s *alertingUserStore) check(ctx context.Context, operation string, err error) error {
+	if err == nil || errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrVersionConflict) || isContextError(err) {
+		return err
+	}
+	s.alerts.raise(context.WithoutCancel(ctx), AlertStoreError, "The user store failed", map[string]string{
+		"operation": operation,
+		"error":     err.Error(),
+	}, true)
+	return err
+}
+
+func (s *alertingUserStore) Create(ctx context.Context, user *User) error {
+	if err := s.check(ctx, "create", s.next.Create(ctx, user)); err != nil {
+		return err
+	}
+	if user.Role == RoleAdmin {
+		s.alerts.raise(context.WithoutCancel(ctx), AlertAdminCreated, "An admin account was created", map[string]string{
+			"user":     user.ID,
+			"username": user.Username,
+		}, false)
+	}
+	return nil
+}
+
+func (s *alertingUserStore) Get(ctx context.Context, id string) (*User, error) {
+	user, err := s.next.Get(ctx, id)
+	return user, s.check(ctx, "get", err)
+}
+
+func (s *alertingUserStore) GetByUsername(ctx context.Context, username string) (*User, error) {
+	user, err := s.next.GetByUsername(ctx, username)
+	return user, s.check(ctx, "get", err)
+}
+
+func (s *alertingUserStore) GetByEmail(ctx context.Context, email string) (*User, error) {
+	user, err := s.next.GetByEmail(ctx, email)
+	return user, s.check(ctx, "get", err)
+}
+
+func (s *alertingUserStore) Update(ctx context.Context, user *User) error {
+	return s.check(ctx, "update", s.next.Update(ctx, user))
+}
+
+func (s *alertingUserStore) List(ctx context.Context) ([]*User, error) {
+	users, err := s.next.List(ctx)
+	return users, s.check(ctx, "list", err)
+}
+
+func (s *alertingUserStore) Delete(ctx context.Context, id string) error {
+	return s.check(ctx, "delete", s.next.Delete(ctx, id))
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit event types
+const (
+	AuditAccessDenied             = "access_denied"
+	AuditACLChanged               = "acl_changed"
+	AuditLoginSucceeded           = "login_succeeded"
+	AuditLoginFailed              = "login_failed"
+	AuditLoginBlocked             = "login_blocked"
+	AuditLoginChallenged          = "login_challenged"
+	AuditIdentityLinked           = "identity_linked"
+	AuditIdentityUnlinked         = "identity_unlinked"
+	AuditAccountMerged            = "account_merged"
+	AuditAccountUnmerged          = "account_unmerged"
+	AuditAccountDeleted           = "account_deleted"
+	AuditAccountRestored          = "account_restored"
+	AuditAccountPurged            = "account_purged"
+	AuditAccountSuspended         = "account_suspended"
+	AuditAccountUnsuspended       = "account_unsuspended"
+	AuditAccountDormant           = "account_dormant"
+	AuditSignupBlocked            = "signup_blocked"
+	AuditSignupHeld               = "signup_held"
+	AuditSignupApproved           = "signup_approved"
+	AuditSignupRejected           = "signup_rejected"
+	AuditAccountDeactivated       = "account_deactivated"
+	AuditImpossibleTravel         = "impossible_travel"
+	AuditGeoPolicyChanged         = "geo_policy_changed"
+	AuditEmailPolicyChanged       = "email_policy_changed"
+	AuditUsernamePolicyChanged    = "username_policy_changed"
+	AuditEmailChanged             = "email_changed"
+	AuditUsernameChanged          = "username_changed"
+	AuditGCTriggered              = "gc_triggered"
+	AuditClientChanged            = "client_changed"
+	AuditServiceAccountChanged    = "service_account_changed"
+	AuditTokenIssued              = "token_issued"
+	AuditAccessTokenCreated       = "access_token_created"
+	AuditAccessTokenRevoked       = "access_token_revoked"
+	AuditDeviceAuthorized         = "device_authorized"
+	AuditSigningKeyRotated        = "signing_key_rotated"
+	AuditPasswordResetRequested   = "password_reset_requested"
+	AuditPasswordReset            = "password_reset"
+	AuditPreferencesChanged       = "preferences_changed"
+	AuditAccountExported          = "account_exported"
+	AuditTwoFactorEnabled         = "two_factor_enabled"
+	AuditTwoFactorDisabled        = "two_factor_disabled"
+	AuditRecoveryCodesRegenerated = "recovery_codes_regenerated"
+	AuditRecoveryCodeUsed         = "recovery_code_used"
+	AuditMagicLinkRequested       = "magic_link_requested"
+	AuditMagicLinkOtherDevice     = "magic_link_other_device"
+	AuditPhoneChanged             = "phone_changed"
+	AuditReauthenticated          = "reauthenticated"
+	AuditTermsAccepted            = "terms_accepted"
+	AuditSecretRotated            = "secret_rotated"
+	AuditIPBlocked                = "ip_blocked"
+	AuditIPUnblocked              = "ip_unblocked"
+	AuditMaintenanceChanged       = "maintenance_changed"
+	AuditFlagChanged              = "flag_changed"
+	AuditChaosChanged             = "chaos_changed"
+	AuditOutboxRedelivered        = "outbox_redelivered"
+	AuditWebhookReplayed          = "webhook_replayed"
+	AuditWebhookPaused            = "webhook_paused"
+	AuditWebhookResumed           = "webhook_resumed"
+	AuditRoleChanged              = "role_changed"
+	AuditPolicyChanged            = "policy_changed"
+	AuditSSOConnectionChanged     = "sso_connection_changed"
+	AuditEmailTemplateChanged     = "email_template_changed"
+	AuditTierChanged              = "tier_changed"
+	AuditDeviceRemembered         = "device_remembered"
+	AuditDeviceForgotten          = "device_forgotten"
+	AuditRememberMeTheft          = "remember_me_theft"
+)
+
+// AuditEvent records a security-relevant action
+type AuditEvent struct {
+	Time    time.Time         `json:"time"`
+	Type    string            `json:"type"`
+	UserID  string            `json:"userId,omitempty"`
+	IP      string            `json:"ip,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// AuditLog keeps the most recent audit events in memory and mirrors every
+// event to stderr, or to Config.AuditLogOutput
+type AuditLog struct {
+	mutex       sync.RWMutex
+	events      []AuditEvent
+	capacity    int
+	subscribers map[chan AuditEvent]struct{}
+	out         io.Writer // stderr when nil
+}
+
+// NewAuditLog creates an audit log retaining up to capacity events
+func NewAuditLog(capacity int) *AuditLog {
+	return &AuditLog{
+		capacity:    capacity,
+		subscribers: make(map[chan AuditEvent]struct{}),
+	}
+}
+
+// Record appends an event, evicting the oldest once capacity is reached
+func (a *AuditLog) Record(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	a.mutex.Lock()
+	if len(a.events) >= a.capacity {
+		a.events = a.events[1:]
+	}
+	a.events = append(a.events, event)
+	for ch := range a.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Drop events for subscribers that are not keeping up
+		}
+	}
+	a.mutex.Unlock()
+
+	out := a.out
+	if out == nil {
+		out = os.Stderr
+	}
+	fmt.Fprintf(out, "[AUDIT] %s type=%s user=%s ip=%s %s\n",
+		event.Time.Format(time.RFC3339), event.Type, event.UserID, event.IP, formatDetails(event.Details))
+}
+
+// Recent returns up to n of the most recent events, newest first
+func (a *AuditLog) Recent(n int) []AuditEvent {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if n <= 0 || n > len(a.events) {
+		n = len(a.events)
+	}
+
+	events := make([]AuditEvent, 0, n)
+	for i := len(a.events) - 1; i >= len(a.events)-n; i-- {
+		events = append(events, a.events[i])
+	}
+	return events
+}
+
+// Subscribe returns a channel that receives every event recorded from now
+// on, buffering up to buffer events for slow readers, and a function that
+// ends the subscription
+func (a *AuditLog) Subscribe(buffer int) (<-chan AuditEvent, func()) {
+	ch := make(chan AuditEvent, buffer)
+
+	a.mutex.Lock()
+	a.subscribers[ch] = struct{}{}
+	a.mutex.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			a.mutex.Lock()
+			delete(a.subscribers, ch)
+			a.mutex.Unlock()
+		})
+	}
+}
+
+func formatDetails(details map[string]string) string {
+	keys := make([]string, 0, len(details))
+	for key := range details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%q", key, details[key]))
+	}
+	return strings.Join(parts, " ")
+}
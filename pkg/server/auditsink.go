@@ -0,0 +1,238 @@
+package server
+
+import (
+	"auth-server/pkg/metrics"
+	"auth-server/pkg/siem"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditSinkRetryBase and auditSinkRetryMax bound the wait before writing
+// to an unreachable collector again, doubling between them
+const (
+	auditSinkRetryBase = time.Second
+	auditSinkRetryMax  = 30 * time.Second
+)
+
+// auditSinkFlushTimeout is how long shutdown waits for queued events to
+// reach the collector
+const auditSinkFlushTimeout = 5 * time.Second
+
+// auditSink ships audit events to a SIEM collector. Events wait in a
+// bounded queue while the collector is slow or unreachable; once the queue
+// is full the oldest events are dropped and counted, so a stuck collector
+// never holds up requests.
+type auditSink struct {
+	encoder  *siem.Encoder
+	writer   *siem.Writer
+	capacity int
+	metrics  *metrics.Registry // nil until the server sets it
+	logger   *log.Logger
+
+	mutex sync.Mutex
+	queue []AuditEvent
+	ready chan struct{}
+}
+
+// newAuditSinkFromConfig returns nil unless cfg.AuditSinkURL is set
+func newAuditSinkFromConfig(cfg Config) (*auditSink, error) {
+	if cfg.AuditSinkURL == "" {
+		return nil, nil
+	}
+	writer, err := siem.ParseURL(cfg.AuditSinkURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AUDIT_SINK_URL: %w", err)
+	}
+	switch cfg.AuditSinkFormat {
+	case siem.FormatSyslog, siem.FormatCEF, siem.FormatJSON:
+	default:
+		return nil, fmt.Errorf("invalid AUDIT_SINK_FORMAT %q", cfg.AuditSinkFormat)
+	}
+
+	hostname, _ := os.Hostname()
+	return &auditSink{
+		encoder: &siem.Encoder{
+			Format:   cfg.AuditSinkFormat,
+			Hostname: hostname,
+			AppName:  "auth-server",
+			Vendor:   "auth-server",
+			Product:  "auth-server",
+			Version:  "1.0",
+		},
+		writer:   writer,
+		capacity: cfg.AuditSinkBuffer,
+		logger:   cfg.Logger,
+		ready:    make(chan struct{}, 1),
+	}, nil
+}
+
+// auditSeverity ranks an event type for the collector: refusals and
+// suspicious activity are warnings, other changes notices
+func auditSeverity(eventType string) int {
+	switch eventType {
+	case AuditAccessDenied, AuditLoginFailed, AuditLoginBlocked, AuditLoginChallenged,
+		AuditImpossibleTravel, AuditIPBlocked, AuditAccountSuspended, AuditMagicLinkOtherDevice,
+		AuditSignupBlocked, AuditSignupHeld:
+		return siem.SeverityWarning
+	case AuditLoginSucceeded, AuditTokenIssued, AuditReauthenticated, AuditGCTriggered:
+		return siem.SeverityInfo
+	}
+	return siem.SeverityNotice
+}
+
+// push queues an event, dropping the oldest when the queue is full
+func (s *auditSink) push(event AuditEvent) {
+	s.mutex.Lock()
+	dropped := 0
+	if len(s.queue) >= s.capacity {
+		dropped = len(s.queue) - s.capacity + 1
+		s.queue = s.queue[dropped:]
+	}
+	s.queue = append(s.queue, event)
+	s.observeQueue(dropped)
+	s.mutex.Unlock()
+	s.wake()
+}
+
+// wake tells the writer there is something to send
+func (s *auditSink) wake() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take empties the queue
+func (s *auditSink) take() []AuditEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	events := s.queue
+	s.queue = nil
+	s.observeQueue(0)
+	return events
+}
+
+// giveBack puts events that could not be sent ahead of those queued since,
+// dropping the oldest beyond the capacity
+func (s *auditSink) giveBack(events []AuditEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queue = append(events, s.queue...)
+	dropped := 0
+	if len(s.queue) > s.capacity {
+		dropped = len(s.queue) - s.capacity
+		s.queue = s.queue[dropped:]
+	}
+	s.observeQueue(dropped)
+}
+
+// observeQueue updates the queue metrics; the caller holds the mutex
+func (s *auditSink) observeQueue(dropped int) {
+	if dropped > 0 {
+		s.logger.Printf("[DEBUG] Audit sink queue full, dropped %d events", dropped)
+	}
+	if s.metrics == nil {
+		return
+	}
+	if dropped > 0 {
+		s.metrics.Counter("auth_audit_sink_dropped_total", "Audit events dropped because the SIEM collector fell behind.").Add(uint64(dropped))
+	}
+	s.metrics.Gauge("auth_audit_sink_queued", "Audit events waiting to be sent to the SIEM collector.").Set(float64(len(s.queue)))
+}
+
+// send writes events to the collector in order, returning those not sent
+// when a write fails
+func (s *auditSink) send(ctx context.Context, events []AuditEvent) ([]AuditEvent, error) {
+	for i, event := range events {
+		msg, err := s.encoder.Encode(siem.Event{
+			Time:     event.Time,
+			Type:     event.Type,
+			UserID:   event.UserID,
+			IP:       event.IP,
+			Details:  event.Details,
+			Severity: auditSeverity(event.Type),
+		})
+		if err != nil {
+			s.logger.Printf("[DEBUG] Failed to encode audit event %s: %v", event.Type, err)
+			continue
+		}
+		if err := s.writer.Write(ctx, msg); err != nil {
+			return events[i:], err
+		}
+		if s.metrics != nil {
+			s.metrics.Counter("auth_audit_sink_sent_total", "Audit events sent to the SIEM collector.").Inc()
+		}
+	}
+	return nil, nil
+}
+
+// start subscribes to audit and ships its events until stopped. Stopping
+// makes one last attempt to send what is queued.
+func (s *auditSink) start(audit *AuditLog) (stop func()) {
+	events, unsubscribe := audit.Subscribe(s.capacity)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	// Move events off the subscription at once, so only the sink's own
+	// queue decides what is dropped
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case event := <-events:
+				s.push(event)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		retry := auditSinkRetryBase
+		for {
+			select {
+			case <-s.ready:
+			case <-ctx.Done():
+				return
+			}
+			unsent, err := s.send(ctx, s.take())
+			if err == nil {
+				retry = auditSinkRetryBase
+				continue
+			}
+
+			s.logger.Printf("[DEBUG] Failed to send audit events to %s, retrying in %s: %v", s.writer.Addr, retry, err)
+			s.giveBack(unsent)
+			select {
+			case <-time.After(retry):
+				retry = min(retry*2, auditSinkRetryMax)
+				s.wake()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		unsubscribe()
+		cancel()
+		wg.Wait()
+		for len(events) > 0 {
+			s.push(<-events)
+		}
+
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), auditSinkFlushTimeout)
+		defer cancelFlush()
+		if unsent, err := s.send(flushCtx, s.take()); err != nil {
+			s.logger.Printf("[DEBUG] %d audit events not sent at shutdown: %v", len(unsent), err)
+		}
+		s.writer.Close()
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// auditStreamHeartbeat is how often an idle event stream sends a comment
+// line, keeping proxies from closing the connection
+const auditStreamHeartbeat = 15 * time.Second
+
+// auditStreamBuffer is how many events a slow stream client may fall behind
+// before further events are dropped for it
+const auditStreamBuffer = 64
+
+// auditStreams tells the open audit event streams that the server is
+// shutting down
+type auditStreams struct {
+	stopping chan struct{}
+	stopOnce sync.Once
+}
+
+func newAuditStreams() *auditStreams {
+	return &auditStreams{stopping: make(chan struct{})}
+}
+
+// shutdown ends every audit event stream. It is registered with the HTTP
+// servers, whose Shutdown would otherwise wait for the streams until their
+// clients go away.
+func (as *auditStreams) shutdown() {
+	as.stopOnce.Do(func() { close(as.stopping) })
+}
+
+// AuditStreamHandler pushes audit events to admins as server-sent events.
+// The optional type query parameter (repeatable or comma-separated) limits
+// the stream to those event types and user limits it to one user ID.
+func (s *Server) AuditStreamHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Audit event stream request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.logger.Printf("[DEBUG] Response writer does not support streaming")
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	types := make(map[string]bool)
+	for _, value := range r.URL.Query()["type"] {
+		for _, eventType := range splitList(value) {
+			types[eventType] = true
+		}
+	}
+	userID := r.URL.Query().Get("user")
+
+	events, unsubscribe := s.audit.Subscribe(auditStreamBuffer)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, ": connected\n\n")
+	flusher.Flush()
+
+	s.logger.Printf("[DEBUG] Audit event stream opened for admin: %s", admin.Username)
+
+	heartbeat := time.NewTicker(auditStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			s.logger.Printf("[DEBUG] Audit event stream closed for admin: %s", admin.Username)
+			return
+
+		case <-s.auditStreams.stopping:
+			s.logger.Printf("[DEBUG] Audit event stream of admin %s ended by shutdown", admin.Username)
+			return
+
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+			flusher.Flush()
+
+		case event := <-events:
+			if len(types) > 0 && !types[event.Type] {
+				continue
+			}
+			if userID != "" && event.UserID != userID {
+				continue
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				s.logger.Printf("[DEBUG] Failed to encode audit event: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
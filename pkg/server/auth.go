@@ -0,0 +1,1415 @@
+package server
+
+import (
+	"auth-server/pkg/blobstore"
+	"auth-server/pkg/captcha"
+	"auth-server/pkg/emailpolicy"
+	"auth-server/pkg/events"
+	"auth-server/pkg/flags"
+	"auth-server/pkg/ids"
+	"auth-server/pkg/mailer"
+	"auth-server/pkg/randutil"
+	"auth-server/pkg/sessionstore"
+	"auth-server/pkg/sms"
+	"auth-server/pkg/usernamepolicy"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// minPasswordLength is the minimum length accepted for new passwords
+const minPasswordLength = 6
+
+// defaultSessionCookieName is the session cookie's name unless
+// SESSION_COOKIE_NAME is set
+const defaultSessionCookieName = "user-session"
+
+// genericRegisterMessage is returned for every accepted registration when
+// Config.GenericRegisterResponse is set, so it cannot reveal taken emails
+const genericRegisterMessage = "Registration received. If the details are valid you can now login with your credentials."
+
+// AuthHandler handles all authentication-related operations
+type AuthHandler struct {
+	config   Config
+	logger   *log.Logger
+	users    UserStore
+	sessions SessionManager
+	// stateless is set in stateless session mode, in place of sessions
+	stateless *statelessSessions
+	audit     *AuditLog
+	events    *events.Bus
+	mailer    mailer.Mailer
+	outbox    *outbox
+	webhooks  *webhookHooks    // nil unless hook webhooks are configured
+	alerts    *alertDispatcher // nil unless alert channels are configured
+	slo       *sloMetrics      // nil until the server sets it
+	geo       *geoPolicy
+	captcha   captcha.Verifier // nil when CAPTCHA checks are disabled
+
+	emailPolicy    *emailpolicy.Policy
+	usernamePolicy *usernamepolicy.Policy
+	policy         *policyEngine
+	accessRules    *policyEngine
+	// provisioningRules set up accounts created for external users
+	provisioningRules *policyEngine
+	// emailTemplates are operators' overrides of the built-in emails
+	emailTemplates *emailTemplateStore
+	hooks          *Hooks
+	riskProviders  []RiskProvider
+
+	loginFailures *failureCounter
+	loginAttempts *failureCounter // counts attempts for risk scoring
+	bruteForce    *bruteForceGuard
+	maintenance   *maintenanceMode
+	flags         *flags.Set
+	resetTokens   *resetTokenStore
+
+	signupVelocity *signupVelocity
+
+	magicLinks        *magicLinkStore
+	magicLinkRequests *failureCounter // counts requests for rate limiting
+
+	sms        sms.Sender
+	smsCodes   *smsCodeStore
+	smsLimiter *smsLimiter
+
+	// passwords is the built-in hasher, whose peppers are set from
+	// secrets; hasher is the one in use, which Config.PasswordHasher may
+	// replace
+	passwords *passwordHasher
+	hasher    Hasher
+	// dummyHash is made by Config.PasswordHasher, "" with the built-in
+	// hasher (see dummyPasswordHash)
+	dummyHash string
+
+	// userCache is the cache under users, nil when disabled
+	userCache *cachedUserStore
+	// userSearch is the top of users, indexing them for search
+	userSearch *searchableUserStore
+
+	// blobs holds uploaded files such as avatars, nil unless BLOB_STORE
+	// is set
+	blobs blobstore.Store
+
+	clock       Clock
+	idGenerator IDGenerator
+
+	// bootstrapMutex serializes AdminBootstrapHandler
+	bootstrapMutex sync.Mutex
+
+	cookieMutex sync.RWMutex
+	cookies     *sessions.CookieStore
+	cookieKeys  []CookieKeyPair // newest first
+}
+
+// NewAuthHandler creates a new authentication handler
+func NewAuthHandler(cookieKeys []CookieKeyPair, cfg Config, audit *AuditLog) (*AuthHandler, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = newStderrLogger()
+	}
+	users := cfg.UserStore
+	if users == nil {
+		users = NewMemoryUserStore()
+	}
+	var userCache *cachedUserStore
+	if cfg.UserCacheSize > 0 {
+		userCache = newCachedUserStore(users, cfg)
+		users = userCache
+	}
+	alerting := &alertingUserStore{next: users}
+	users = alerting
+	encrypted, err := newEncryptedUserStore(users, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("setting up PII encryption: %w", err)
+	}
+	users = encrypted
+	userSearch := newSearchableUserStore(users, cfg.Logger)
+	users = userSearch
+
+	outbox, _ := newOutbox("", cfg.OutboxDeadLetterRetention, cfg.Logger)
+	hooks := &Hooks{}
+	accessRules, _ := newAccessRules("", cfg.PolicyReloadInterval, cfg.Logger)
+	provisioningRules, _ := newProvisioningRules("", cfg.PolicyReloadInterval, cfg.Logger)
+	emailTemplates, _ := newEmailTemplateStore("", cfg.PublicURL, cfg.Logger)
+	h := &AuthHandler{
+		config:     cfg,
+		logger:     cfg.Logger,
+		users:      users,
+		userCache:  userCache,
+		userSearch: userSearch,
+		sessions:   cfg.SessionManager,
+		audit:      audit,
+		events:     newEventBusFromConfig(cfg),
+		mailer:     newMailerFromConfig(cfg),
+		outbox:     outbox,
+		geo:        newGeoPolicyFromConfig(cfg),
+		captcha:    newCaptchaFromConfig(cfg),
+
+		emailPolicy:       newEmailPolicyFromConfig(cfg),
+		usernamePolicy:    newUsernamePolicyFromConfig(cfg),
+		policy:            newBuiltinPolicy(cfg),
+		accessRules:       accessRules,
+		provisioningRules: provisioningRules,
+		emailTemplates:    emailTemplates,
+		hooks:             hooks,
+		loginFailures:     newFailureCounter(loginFailureWindow),
+		loginAttempts:     newFailureCounter(riskVelocityWindow),
+		bruteForce:        newBruteForceGuard(cfg),
+		maintenance:       &maintenanceMode{},
+		flags:             newFlagsFromConfig(cfg),
+		resetTokens:       newResetTokenStore(cfg.PasswordResetTTL),
+		signupVelocity:    newSignupVelocity(),
+
+		magicLinks:        newMagicLinkStore(cfg),
+		magicLinkRequests: newFailureCounter(magicLinkRateWindow),
+
+		sms:        newSMSSenderFromConfig(cfg),
+		smsCodes:   newSMSCodeStore(),
+		smsLimiter: newSMSLimiter(cfg),
+
+		passwords: newPasswordHasher(cfg),
+
+		clock:       cfg.Clock,
+		idGenerator: cfg.IDGenerator,
+
+		cookies:    newCookieStore(cfg.BasePath, cookieKeys),
+		cookieKeys: cookieKeys,
+	}
+	if h.sessions == nil {
+		h.sessions = sessionstore.New()
+	}
+	if h.stateless, err = newStatelessSessionsFromConfig(cfg); err != nil {
+		return nil, err
+	}
+	if h.clock == nil {
+		h.clock = systemClock{}
+	}
+	if h.idGenerator == nil {
+		h.idGenerator = ulidGenerator{}
+	}
+	h.hasher = h.passwords
+	if cfg.PasswordHasher != nil {
+		h.hasher = cfg.PasswordHasher
+		// Without a dummy hash, logins of unknown users would skip the
+		// comparison and answer faster than those of real ones
+		if h.dummyHash, err = cfg.PasswordHasher.Hash(context.Background(), dummyPassword); err != nil {
+			return nil, fmt.Errorf("hashing the dummy password: %w", err)
+		}
+	}
+	h.webhooks = registerWebhookHooks(hooks, cfg, h.enqueue)
+	h.alerts = newAlertDispatcherFromConfig(cfg, h.enqueue, func() time.Time { return h.clock.Now() })
+	alerting.alerts = h.alerts
+	return h, nil
+}
+
+// cookieStore returns the store that signs and encrypts session cookies
+func (h *AuthHandler) cookieStore() *sessions.CookieStore {
+	h.cookieMutex.RLock()
+	defer h.cookieMutex.RUnlock()
+	return h.cookies
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// dummyPassword is the password of the dummy hash
+const dummyPassword = "dummy-password-for-timing"
+
+// dummyPasswordHash returns a hash made by the handler's hasher at the
+// same cost as real passwords. Comparing against it when a user does not
+// exist makes failed logins take the same time whether or not the
+// username is known.
+func (h *AuthHandler) dummyPasswordHash() string {
+	if h.dummyHash != "" {
+		return h.dummyHash
+	}
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte(dummyPassword), bcrypt.DefaultCost)
+	})
+	return string(dummyHash)
+}
+
+// RegisterHandler handles user registration
+func (h *AuthHandler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Registration request received")
+
+	var req RegisterRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		status, message := bodyErrorStatus(r, err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: message,
+		})
+		return
+	}
+
+	// Validate input
+	if req.Username == "" || req.Email == "" || req.Password == "" {
+		h.logger.Printf("[DEBUG] Missing required fields")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Username, email, and password are required"),
+		})
+		return
+	}
+
+	if len(req.Password) < minPasswordLength {
+		h.logger.Printf("[DEBUG] Password too short")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Password must be at least %d characters", minPasswordLength),
+		})
+		return
+	}
+
+	if err := h.emailPolicy.Check(req.Email); err != nil {
+		h.logger.Printf("[DEBUG] Email rejected by policy: %s: %v", req.Email, err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, emailPolicyMessage(err)),
+		})
+		return
+	}
+
+	if err := h.checkUsername(req.Username); err != nil {
+		h.logger.Printf("[DEBUG] Username rejected by policy: %s: %v", req.Username, err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, usernamePolicyMessage(err)),
+		})
+		return
+	}
+
+	// The tenant of a new account is its email domain
+	if !h.flags.Enabled(FlagRegistrationOpen, flags.Subject{Tenant: tenantOf(req.Email)}) {
+		h.logger.Printf("[DEBUG] Registration is closed for: %s", req.Email)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Registration is closed"),
+		})
+		return
+	}
+
+	// Registration always requires a CAPTCHA when one is configured
+	if h.captcha != nil {
+		if err := h.captcha.Verify(r.Context(), req.CaptchaToken, clientIP(r)); err != nil {
+			h.logger.Printf("[DEBUG] CAPTCHA verification failed for registration: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(Response{
+				Success: false,
+				Message: localize(r, "CAPTCHA verification failed"),
+				Data:    map[string]bool{"captchaRequired": true},
+			})
+			return
+		}
+	}
+
+	documents := h.legalDocuments()
+	if len(documents) > 0 && !req.AcceptTerms {
+		h.logger.Printf("[DEBUG] Registration without accepting the terms")
+		writeTermsRequired(w, r, http.StatusBadRequest, documents)
+		return
+	}
+
+	if err := h.hooks.runPreRegister(r.Context(), req); err != nil {
+		status, message := h.hookRejection(err)
+		h.logger.Printf("[DEBUG] Registration rejected by pre-register hook: %s", message)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, message),
+		})
+		return
+	}
+
+	ip, device := clientIP(r), signupDevice(r, req.DeviceID)
+	verdict := h.assessRisk(r.Context(), RiskRequest{
+		Flow:      RiskFlowRegister,
+		IP:        ip,
+		Email:     req.Email,
+		Username:  req.Username,
+		Device:    device,
+		UserAgent: r.UserAgent(),
+	})
+	if verdict.Action == RiskDeny {
+		h.logger.Printf("[DEBUG] Registration denied by risk provider: %s", ip)
+		h.audit.Record(AuditEvent{
+			Type:    AuditSignupBlocked,
+			IP:      ip,
+			Details: map[string]string{"username": req.Username, "device": device, "risk": verdict.Reason},
+		})
+		writeRiskDenied(w, r)
+		return
+	}
+
+	// Hold back or refuse sign-ups arriving too fast from one network or
+	// device
+	exceeded := h.signupLimitsExceeded(ip, device, h.clock.Now())
+	if len(exceeded) > 0 && h.config.SignupVelocityAction == SignupActionBlock {
+		h.logger.Printf("[DEBUG] Registration blocked over sign-up limits %v: %s", exceeded, ip)
+		h.audit.Record(AuditEvent{
+			Type:    AuditSignupBlocked,
+			IP:      ip,
+			Details: map[string]string{"username": req.Username, "device": device, "limits": strings.Join(exceeded, ",")},
+		})
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Too many sign-ups from your network or device, please try again later"),
+		})
+		return
+	}
+
+	// Check if user already exists by username or email
+	usernameTaken, err := h.usernameTaken(r.Context(), "", req.Username)
+	var emailTaken bool
+	if err == nil {
+		emailTaken, err = userExists(h.users.GetByEmail(r.Context(), req.Email))
+	}
+	if err != nil {
+		status, message := storeErrorStatus(err)
+		h.logger.Printf("[DEBUG] User lookup failed: %v", err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, message),
+		})
+		return
+	}
+
+	if usernameTaken {
+		h.logger.Printf("[DEBUG] User already exists: %s", req.Username)
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Username already exists"),
+		})
+		return
+	}
+
+	if emailTaken && !h.config.GenericRegisterResponse {
+		h.logger.Printf("[DEBUG] Email already exists: %s", req.Email)
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Email already exists"),
+		})
+		return
+	}
+
+	// Hash password. This also runs for a taken email in generic mode so
+	// both outcomes cost the same.
+	hashedPassword, err := h.hasher.Hash(r.Context(), req.Password)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to hash password: %v", err)
+		setBusyRetryAfter(w, err)
+		status, message := storeErrorStatus(err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, message),
+		})
+		return
+	}
+
+	// Hashing is slow enough for the deadline to pass meanwhile
+	if err := r.Context().Err(); err != nil {
+		status, message := storeErrorStatus(err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, message),
+		})
+		return
+	}
+
+	if emailTaken {
+		h.logger.Printf("[DEBUG] Email already exists, returning generic response: %s", req.Email)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(Response{
+			Success: true,
+			Message: localize(r, genericRegisterMessage),
+			Data:    map[string]string{"username": req.Username},
+		})
+		return
+	}
+
+	// Remember the language the user registered in unless they picked one
+	locale := requestLocale(r)
+	if translations.Supports(req.Locale) {
+		locale = req.Locale
+	}
+
+	// Create user
+	now := h.clock.Now()
+	user := &User{
+		ID:                h.idGenerator.NewID(ids.PrefixUser),
+		Username:          req.Username,
+		Email:             req.Email,
+		Password:          hashedPassword,
+		Role:              RoleUser,
+		Created:           now,
+		UpdatedAt:         now,
+		PasswordChangedAt: now,
+		APISecret:         generateAPISecret(),
+		Locale:            locale,
+		Preferences:       defaultNotificationPreferences(),
+	}
+	if len(documents) > 0 {
+		h.acceptDocuments(r, user, documents, now)
+	}
+	if len(exceeded) > 0 || verdict.Action == RiskChallenge {
+		user.SignupReview = &SignupReview{At: now, IP: ip, Device: device, Limits: exceeded}
+		if verdict.Action == RiskChallenge {
+			user.SignupReview.Risk = verdict.Reason
+		}
+	}
+
+	if err := h.users.Create(r.Context(), user); err != nil {
+		status, message := storeErrorStatus(err)
+		h.logger.Printf("[DEBUG] Failed to store user %s: %v", user.Username, err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, message),
+		})
+		return
+	}
+	h.signupVelocity.record(now, "ip:"+ip, "device:"+device)
+	h.publishEvent(events.TypeUserRegistered, user.ID, map[string]string{"username": user.Username})
+	h.hooks.runPostRegister(r.Context(), user.Sanitized())
+
+	// Return user data (without password)
+	message := "User registered successfully. Please login with your credentials."
+	if user.SignupReview != nil {
+		h.logger.Printf("[DEBUG] Registration held for review (limits %v, risk %q): %s", exceeded, verdict.Reason, user.Username)
+		details := map[string]string{"device": device, "limits": strings.Join(exceeded, ",")}
+		if verdict.Action == RiskChallenge {
+			details["risk"] = verdict.Reason
+		}
+		h.audit.Record(AuditEvent{
+			Type:    AuditSignupHeld,
+			UserID:  user.ID,
+			IP:      ip,
+			Details: details,
+		})
+		message = pendingReviewMessage
+	}
+	if h.config.GenericRegisterResponse {
+		message = genericRegisterMessage
+	}
+
+	response := Response{
+		Success: true,
+		Message: localize(r, message),
+		Data:    map[string]string{"username": user.Username},
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] User registered successfully: %s", user.Username)
+}
+
+// LoginHandler handles user login
+func (h *AuthHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Login request received")
+
+	var req LoginRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		status, message := bodyErrorStatus(r, err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: message,
+		})
+		return
+	}
+
+	if req.Username == "" || req.Password == "" {
+		h.logger.Printf("[DEBUG] Missing required fields")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Username and password are required"),
+		})
+		return
+	}
+
+	if !validSessionTransport(req.Transport) {
+		h.logger.Printf("[DEBUG] Invalid session transport: %s", req.Transport)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Transport must be cookie or bearer"),
+		})
+		return
+	}
+
+	// Refuse addresses blocked for guessing passwords outright
+	ip := clientIP(r)
+	if block, blocked := h.bruteForce.blocked(ip, h.clock.Now()); blocked {
+		h.logger.Printf("[DEBUG] Login refused from blocked address %s", ip)
+		writeIPBlocked(w, r, block)
+		return
+	}
+
+	// Require a CAPTCHA once the account or client has failed repeatedly
+	failureKeys := loginFailureKeys(req.Username, ip)
+	if h.captcha != nil && h.loginFailures.Max(failureKeys...) >= h.config.CaptchaLoginThreshold {
+		if err := h.captcha.Verify(r.Context(), req.CaptchaToken, ip); err != nil {
+			h.logger.Printf("[DEBUG] CAPTCHA verification failed for login: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(Response{
+				Success: false,
+				Message: localize(r, "CAPTCHA verification required"),
+				Data:    map[string]bool{"captchaRequired": true},
+			})
+			return
+		}
+	}
+
+	if err := h.hooks.runPreLogin(r.Context(), req.Username, ip); err != nil {
+		status, message := h.hookRejection(err)
+		h.logger.Printf("[DEBUG] Login rejected by pre-login hook: %s", message)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, message),
+		})
+		return
+	}
+
+	// Find user by username
+	user, err := h.users.GetByUsername(r.Context(), req.Username)
+	if errors.Is(err, ErrUserNotFound) {
+		user, err = nil, nil
+	}
+	if err != nil {
+		status, message := storeErrorStatus(err)
+		h.logger.Printf("[DEBUG] User lookup failed: %v", err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, message),
+		})
+		return
+	}
+
+	// Slow down accounts and clients that keep failing
+	if !h.tarpit(r.Context(), failureKeys) {
+		status, message := storeErrorStatus(r.Context().Err())
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, message),
+		})
+		return
+	}
+
+	// Always run a bcrypt comparison, against a dummy hash when the user
+	// does not exist or has no password, so response timing does not
+	// reveal valid usernames or passwordless accounts
+	passwordHash := h.dummyPasswordHash()
+	if user != nil && user.Password != "" {
+		passwordHash = user.Password
+	}
+	passwordErr := h.hasher.Compare(r.Context(), passwordHash, req.Password)
+
+	// Give up without counting a failure if the deadline passed meanwhile,
+	// or the server was too busy to check the password
+	err = r.Context().Err()
+	if errors.Is(passwordErr, errPasswordHashBusy) {
+		err = passwordErr
+	}
+	if err != nil {
+		setBusyRetryAfter(w, err)
+		status, message := storeErrorStatus(err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, message),
+		})
+		return
+	}
+
+	h.loginAttempts.Add(failureKeys...)
+
+	if user == nil || user.Password == "" || passwordErr != nil {
+		h.logger.Printf("[DEBUG] Invalid credentials for user: %s (exists: %t)", req.Username, user != nil)
+		h.recordLoginFailure(req.Username, ip)
+		h.audit.Record(AuditEvent{
+			Type:    AuditLoginFailed,
+			IP:      ip,
+			Details: map[string]string{"username": req.Username},
+		})
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Invalid credentials"),
+		})
+		return
+	}
+
+	// Only admins get past the maintenance middleware to here, and only
+	// when the setting allows them
+	if state := h.maintenance.get(); state.Enabled && user.Role != RoleAdmin {
+		h.logger.Printf("[DEBUG] Login refused during maintenance for: %s", user.Username)
+		writeMaintenance(w, r, state)
+		return
+	}
+
+	verdict := h.assessRisk(r.Context(), RiskRequest{
+		Flow:      RiskFlowLogin,
+		IP:        ip,
+		Email:     user.Email,
+		Username:  user.Username,
+		UserID:    user.ID,
+		Device:    agentFingerprint(r),
+		UserAgent: r.UserAgent(),
+	})
+	if verdict.Action == RiskDeny {
+		h.logger.Printf("[DEBUG] Login denied by risk provider for: %s", user.Username)
+		h.audit.Record(AuditEvent{
+			Type:    AuditLoginBlocked,
+			UserID:  user.ID,
+			IP:      ip,
+			Details: map[string]string{"reason": "risk provider", "risk": verdict.Reason},
+		})
+		writeRiskDenied(w, r)
+		return
+	}
+
+	// Logins that look unusual, or that a risk provider challenged, need an
+	// emailed code as well
+	risk := h.assessLoginRisk(r, user, ip, failureKeys, h.clock.Now())
+	if verdict.Action == RiskChallenge {
+		risk.Challenged = true
+		risk.Signals = append(risk.Signals, "provider")
+	}
+	if !h.challengeRiskyLogin(w, r, user, req, ip, risk) {
+		return
+	}
+
+	// Accounts with two-factor authentication need a second factor code
+	if user.HasTwoFactor() {
+		codes := secondFactorCodes{TOTP: req.TOTPCode, SMS: req.SMSCode, Recovery: req.RecoveryCode}
+		if codes.empty() {
+			h.logger.Printf("[DEBUG] Two-factor code required for user: %s", user.Username)
+			data := map[string]interface{}{
+				"twoFactorRequired": true,
+				"methods":           user.SecondFactorMethods(),
+			}
+			// Text a code straight away unless the user has an
+			// authenticator app and did not ask for one
+			if user.SMSTwoFactorEnabled && (req.SendSMSCode || !user.TwoFactorEnabled) {
+				if err := h.sendSMSCode(w, r, user, user.Phone, smsPurposeLogin); err != nil {
+					h.logger.Printf("[DEBUG] Failed to send login code to %s: %v", user.Username, err)
+					writeSMSError(w, r, err)
+					return
+				}
+				data["smsSent"] = true
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(Response{
+				Success: false,
+				Message: localize(r, "Two-factor authentication code required"),
+				Data:    data,
+			})
+			return
+		}
+
+		usedRecoveryCode, ok := h.verifySecondFactor(user, codes, h.clock.Now())
+		if !ok {
+			h.logger.Printf("[DEBUG] Invalid second factor for user: %s", user.Username)
+			h.recordLoginFailure(req.Username, ip)
+			h.audit.Record(AuditEvent{
+				Type:    AuditLoginFailed,
+				UserID:  user.ID,
+				IP:      ip,
+				Details: map[string]string{"username": req.Username, "reason": "invalid second factor"},
+			})
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(Response{
+				Success: false,
+				Message: localize(r, "Invalid two-factor authentication code"),
+				Data:    map[string]bool{"twoFactorRequired": true},
+			})
+			return
+		}
+
+		// Store the used code before the session exists so it cannot be
+		// replayed by a concurrent login
+		if err := h.users.Update(r.Context(), user); err != nil {
+			status, message := storeErrorStatus(err)
+			h.logger.Printf("[DEBUG] Failed to store second factor use for %s: %v", user.Username, err)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(Response{
+				Success: false,
+				Message: localize(r, message),
+			})
+			return
+		}
+		if usedRecoveryCode {
+			h.audit.Record(AuditEvent{
+				Type:    AuditRecoveryCodeUsed,
+				UserID:  user.ID,
+				IP:      ip,
+				Details: map[string]string{"remaining": fmt.Sprint(len(user.RecoveryCodes))},
+			})
+		}
+	}
+
+	h.loginFailures.Reset(failureKeys...)
+
+	// Move the hash to the current pepper while the password is at hand;
+	// completeLogin stores it along with the login details
+	if h.hasher.NeedsRehash(user.Password) {
+		if hashedPassword, err := h.hasher.Hash(r.Context(), req.Password); err != nil {
+			h.logger.Printf("[DEBUG] Failed to rehash password for %s: %v", user.Username, err)
+		} else {
+			user.Password = hashedPassword
+		}
+	}
+
+	// New versions of the legal documents must be accepted to continue
+	if pending := pendingDocuments(user, h.legalDocuments()); len(pending) > 0 {
+		if !req.AcceptTerms {
+			h.logger.Printf("[DEBUG] Terms acceptance required for user: %s", user.Username)
+			writeTermsRequired(w, r, http.StatusForbidden, pending)
+			return
+		}
+		h.acceptDocuments(r, user, pending, h.clock.Now())
+		if err := h.users.Update(r.Context(), user); err != nil {
+			status, message := storeErrorStatus(err)
+			h.logger.Printf("[DEBUG] Failed to store terms acceptance for %s: %v", user.Username, err)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(Response{
+				Success: false,
+				Message: localize(r, message),
+			})
+			return
+		}
+	}
+
+	bearer, ok := h.completeLogin(w, r, user, ip, "password", user.HasTwoFactor(), req.Transport)
+	if !ok {
+		return
+	}
+	if req.RememberMe && h.config.RememberMe && bearer == "" {
+		h.rememberDevice(w, r, user, user.HasTwoFactor())
+	}
+
+	// Return user data (without password)
+	response := Response{
+		Success: true,
+		Message: localize(r, "Login successful"),
+		Data:    user.Sanitized(),
+	}
+	if bearer != "" {
+		response.Data = SessionTokenResponse{
+			User:        user.Sanitized(),
+			AccessToken: bearer,
+			TokenType:   "Bearer",
+			ExpiresIn:   int(h.config.SessionTTL.Seconds()),
+		}
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] User logged in successfully: %s", user.Username)
+}
+
+// completeLogin applies the location policy to a user who has proven who
+// they are, then creates their session and records the login. method says
+// how they authenticated and multiFactor whether a second factor was
+// checked. The session goes to the client by transport; for the bearer
+// transport the token is returned for the response. It writes the error
+// response and returns false when the login is refused.
+func (h *AuthHandler) completeLogin(w http.ResponseWriter, r *http.Request, user *User, ip, method string, multiFactor bool, transport string) (string, bool) {
+	// A deleted account answers like one that does not exist
+	if user.Deletion != nil {
+		h.logger.Printf("[DEBUG] Login refused for deleted account: %s", user.Username)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Invalid credentials"),
+		})
+		return "", false
+	}
+
+	if user.Merge != nil {
+		h.logger.Printf("[DEBUG] Login refused for merged account: %s", user.Username)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "This account has been merged into another account, sign in to that one instead"),
+		})
+		return "", false
+	}
+
+	if user.SignupReview != nil {
+		h.logger.Printf("[DEBUG] Login refused for account awaiting review: %s", user.Username)
+		writeAccountPendingReview(w, r)
+		return "", false
+	}
+
+	if user.Suspension.ActiveAt(h.clock.Now()) {
+		h.logger.Printf("[DEBUG] Login refused for suspended account: %s", user.Username)
+		h.audit.Record(AuditEvent{
+			Type:    AuditLoginBlocked,
+			UserID:  user.ID,
+			IP:      ip,
+			Details: map[string]string{"reason": "account suspended"},
+		})
+		h.writeAccountSuspended(w, r, user.Suspension)
+		return "", false
+	}
+
+	// Apply location-based login policy
+	location, located, allowed := h.geo.evaluate(ip)
+	if !allowed {
+		h.logger.Printf("[DEBUG] Login blocked by geo policy for user: %s (country: %q)", user.Username, location.Country)
+		h.audit.Record(AuditEvent{
+			Type:    AuditLoginBlocked,
+			UserID:  user.ID,
+			IP:      ip,
+			Details: map[string]string{"reason": "country not allowed", "country": location.Country},
+		})
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Login is not permitted from your location"),
+		})
+		return "", false
+	}
+
+	// Replace any session the request already has, so a session ID planted
+	// before login never becomes authenticated
+	if previous, err := h.sessionRecord(r); err == nil {
+		if revoked, err := h.revokeSession(r.Context(), previous); err != nil {
+			h.logger.Printf("[DEBUG] Failed to revoke previous session %s: %v", previous.ID, err)
+		} else if revoked {
+			h.publishEvent(events.TypeSessionRevoked, previous.UserID, map[string]string{
+				"sessionId": previous.ID,
+				"reason":    "login",
+			})
+		}
+	}
+
+	// Create a server-side session and hand it to the client
+	now := h.clock.Now()
+	record := sessionstore.Session{
+		ID:        h.idGenerator.NewID(ids.PrefixSession),
+		UserID:    user.ID,
+		IP:        ip,
+		CreatedAt: now,
+		ExpiresAt: now.Add(h.config.SessionTTL),
+
+		AuthenticatedAt: now,
+		MultiFactor:     multiFactor,
+	}
+	token, err := h.issueSession(r.Context(), record)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to issue session for %s: %v", user.Username, err)
+		writeStoreError(w, r, err)
+		return "", false
+	}
+
+	bearer, err := h.handOverSession(w, r, token, int(h.config.SessionTTL.Seconds()), transport)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to encode session token for %s: %v", user.Username, err)
+		writeStoreError(w, r, err)
+		return "", false
+	}
+
+	// Record login activity
+	if located {
+		h.checkImpossibleTravel(r, user, ip, location, now)
+		user.LastLoginLocation = &location
+	}
+	user.LastLoginAt = &now
+	user.LastLoginIP = ip
+	if method == "magic_link" {
+		user.EmailVerifiedAt = &now
+	}
+	user.Dormancy = nil
+	user.LastLoginCountry = location.Country
+	user.RecentLogins = rememberLogin(user.RecentLogins, LoginFingerprint{IP: ip, Device: agentFingerprint(r), At: now})
+	if err := h.users.Update(r.Context(), user); err != nil {
+		// The session already exists, so only the login details are lost
+		h.logger.Printf("[DEBUG] Failed to store login details for %s: %v", user.Username, err)
+	}
+	h.notifyNewLogin(r, user, ip, location.Country, now)
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditLoginSucceeded,
+		UserID:  user.ID,
+		IP:      ip,
+		Details: map[string]string{"country": location.Country, "method": method},
+	})
+	h.publishEvent(events.TypeLoginSucceeded, user.ID, map[string]string{
+		"sessionId": record.ID,
+		"ip":        ip,
+		"country":   location.Country,
+		"method":    method,
+	})
+	h.hooks.runPostLogin(r.Context(), user.Sanitized())
+	return bearer, true
+}
+
+// LogoutHandler handles user logout
+func (h *AuthHandler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Logout request received")
+
+	// Clear session
+	if record, err := h.sessionRecord(r); err == nil {
+		if revoked, err := h.revokeSession(r.Context(), record); err != nil {
+			h.logger.Printf("[DEBUG] Failed to revoke session %s: %v", record.ID, err)
+		} else if revoked {
+			h.publishEvent(events.TypeSessionRevoked, record.UserID, map[string]string{
+				"sessionId": record.ID,
+				"reason":    "logout",
+			})
+		}
+	}
+	h.forgetRequestDevice(w, r)
+	session, _ := h.cookieStore().Get(r, h.config.SessionCookieName)
+	session.Values["session_id"] = ""
+	session.Options.MaxAge = -1
+	session.Save(r, w)
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Logged out successfully"),
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] User logged out successfully")
+}
+
+// ProfileHandler returns user profile information. Clients can revalidate
+// a cached profile by sending its ETag in If-None-Match.
+func (h *AuthHandler) ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Profile request received")
+
+	user := contextUser(r)
+	if h.checkNotModified(w, r, user) {
+		return
+	}
+
+	// Return user data (without password)
+	response := Response{
+		Success: true,
+		Message: localize(r, "Profile retrieved successfully"),
+		Data:    user.Sanitized(),
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Profile retrieved for user: %s", user.Username)
+}
+
+// UpdateProfileHandler applies a partial update to the session user's
+// profile. Clients should send the ETag from GET /api/profile in If-Match
+// so an update based on a stale profile is rejected instead of silently
+// overwriting a newer change.
+func (h *AuthHandler) UpdateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Profile update request received")
+
+	user := contextUser(r)
+
+	if !h.checkIfMatch(w, r, user) {
+		return
+	}
+
+	var req UpdateProfileRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	renamed := false
+	if req.Username != nil && *req.Username != user.Username {
+		if err := h.renameUser(r.Context(), user, *req.Username); err != nil {
+			h.writeRenameError(w, r, user, *req.Username, err)
+			return
+		}
+		renamed = true
+	}
+
+	if req.Locale != nil {
+		if *req.Locale != "" && !translations.Supports(*req.Locale) {
+			h.logger.Printf("[DEBUG] Unsupported locale: %s", *req.Locale)
+			http.Error(w, localize(r, "Unsupported locale"), http.StatusBadRequest)
+			return
+		}
+		user.Locale = *req.Locale
+	}
+
+	if message := applyProfileFields(user, req); message != "" {
+		h.logger.Printf("[DEBUG] Invalid profile update for %s: %s", user.Username, message)
+		http.Error(w, localize(r, message), http.StatusBadRequest)
+		return
+	}
+
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to store profile for %s: %v", user.ID, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+	if renamed {
+		h.recordRename(r, user)
+	}
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Profile updated successfully"),
+		Data:    user.Sanitized(),
+	}
+
+	w.Header().Set("ETag", userETag(user))
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Profile updated for user: %s", user.Username)
+}
+
+// ChangePasswordHandler handles password changes
+func (h *AuthHandler) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Password change request received")
+
+	user := contextUser(r)
+
+	if !h.checkIfMatch(w, r, user) {
+		return
+	}
+
+	var req ChangePasswordRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	// Validate input
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		h.logger.Printf("[DEBUG] Missing required fields")
+		http.Error(w, localize(r, "Current and new password are required"), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.NewPassword) < minPasswordLength {
+		h.logger.Printf("[DEBUG] New password too short")
+		http.Error(w, localize(r, "New password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	// Verify current password
+	if err := h.hasher.Compare(r.Context(), user.Password, req.CurrentPassword); err != nil {
+		if h.passwordUnavailable(w, r, err) {
+			return
+		}
+		h.logger.Printf("[DEBUG] Invalid current password for user: %s", user.Username)
+		http.Error(w, localize(r, "Invalid current password"), http.StatusUnauthorized)
+		return
+	}
+
+	// Hash new password
+	hashedPassword, err := h.hasher.Hash(r.Context(), req.NewPassword)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to hash new password: %v", err)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	// Update user password
+	now := h.clock.Now()
+	user.Password = hashedPassword
+	user.PasswordChangedAt = now
+	user.UpdatedAt = now
+	// Remembered devices sign in without the password, so they must enter
+	// the new one
+	user.RememberedDevices = nil
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to store new password for %s: %v", user.Username, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+	h.setRememberMeCookie(w, "", nil, "")
+	h.publishEvent(events.TypePasswordChanged, user.ID, nil)
+	h.hooks.runPostPasswordChange(r.Context(), user.Sanitized())
+	h.notifySecurityChange(r, user, NoticePasswordChanged, "")
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Password changed successfully"),
+	}
+
+	w.Header().Set("ETag", userETag(user))
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Password changed successfully for user: %s", user.Username)
+}
+
+// ChangeEmailHandler changes the session user's email address after
+// confirming their current password
+func (h *AuthHandler) ChangeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Email change request received")
+
+	user := contextUser(r)
+
+	if !h.checkIfMatch(w, r, user) {
+		return
+	}
+
+	var req ChangeEmailRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if req.CurrentPassword == "" || req.NewEmail == "" {
+		h.logger.Printf("[DEBUG] Missing required fields")
+		http.Error(w, localize(r, "Current password and new email are required"), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.emailPolicy.Check(req.NewEmail); err != nil {
+		h.logger.Printf("[DEBUG] Email rejected by policy: %s: %v", req.NewEmail, err)
+		http.Error(w, localize(r, emailPolicyMessage(err)), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.hasher.Compare(r.Context(), user.Password, req.CurrentPassword); err != nil {
+		if h.passwordUnavailable(w, r, err) {
+			return
+		}
+		h.logger.Printf("[DEBUG] Invalid current password for user: %s", user.Username)
+		http.Error(w, localize(r, "Invalid current password"), http.StatusUnauthorized)
+		return
+	}
+
+	existing, err := h.users.GetByEmail(r.Context(), req.NewEmail)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		h.logger.Printf("[DEBUG] User lookup failed: %v", err)
+		writeStoreError(w, r, err)
+		return
+	}
+	if existing != nil && existing.ID != user.ID {
+		h.logger.Printf("[DEBUG] Email already exists: %s", req.NewEmail)
+		http.Error(w, localize(r, "Email already exists"), http.StatusConflict)
+		return
+	}
+
+	oldEmail := user.Email
+	user.Email = req.NewEmail
+	user.EmailVerifiedAt = nil
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to store new email for %s: %v", user.Username, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditEmailChanged,
+		UserID:  user.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"from": oldEmail, "to": user.Email},
+	})
+	// The old address hears of it, in case it was not its owner's doing
+	h.notifySecurityChange(r, user, NoticeEmailChanged, oldEmail)
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Email changed successfully"),
+		Data:    user.Sanitized(),
+	}
+
+	w.Header().Set("ETag", userETag(user))
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Email changed successfully for user: %s", user.Username)
+}
+
+// APISecretHandler returns the session user's HMAC API secret on GET and
+// replaces it with a fresh one on POST
+func (h *AuthHandler) APISecretHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] API secret request received")
+
+	user := contextUser(r)
+
+	message := "API secret retrieved successfully"
+	if r.Method == http.MethodPost {
+		user.APISecret = generateAPISecret()
+		user.UpdatedAt = h.clock.Now()
+		if err := h.users.Update(r.Context(), user); err != nil {
+			h.logger.Printf("[DEBUG] Failed to store API secret for %s: %v", user.Username, err)
+			writeStoreError(w, r, err)
+			return
+		}
+		message = "API secret rotated successfully"
+		h.notifySecurityChange(r, user, NoticeAPIKeyCreated, "")
+	}
+
+	response := Response{
+		Success: true,
+		Message: localize(r, message),
+		Data:    map[string]string{"secret": hex.EncodeToString(user.APISecret)},
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] API secret served for user: %s", user.Username)
+}
+
+// errNoSession and errSessionUserNotFound are returned by sessionUser
+var (
+	errNoSession           = errors.New("no valid session")
+	errSessionUserNotFound = errors.New("session user not found")
+)
+
+// sessionUser returns the user that owns the session attached to r. The
+// cookie's session ID must refer to an unexpired server-side session.
+func (h *AuthHandler) sessionUser(r *http.Request) (*User, error) {
+	record, err := h.sessionRecord(r)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := h.users.Get(r.Context(), record.UserID)
+	if errors.Is(err, ErrUserNotFound) || (err == nil && (user.Deletion != nil || user.Suspension.ActiveAt(h.clock.Now()))) {
+		return nil, errSessionUserNotFound
+	}
+	return user, err
+}
+
+// sessionUserKey is the request context key for the session user
+type sessionUserKey struct{}
+
+// sessionMiddleware guards the routes of the authenticated subrouter,
+// answering requests without a valid session and otherwise putting the
+// session user in the request context for contextUser
+func (s *Server) sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.authHandler.sessionUser(r)
+		if err != nil {
+			s.logger.Printf("[DEBUG] Session lookup failed: %v", err)
+			writeSessionError(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionUserKey{}, user)))
+	})
+}
+
+// contextUser returns the session user sessionMiddleware found for r. It
+// is only set on routes of the authenticated subrouter.
+func contextUser(r *http.Request) *User {
+	user, _ := r.Context().Value(sessionUserKey{}).(*User)
+	return user
+}
+
+// sessionRecord returns the session the request's bearer token or session
+// cookie carries, or the stand-in for its personal access token
+func (h *AuthHandler) sessionRecord(r *http.Request) (sessionstore.Session, error) {
+	if record, ok := accessTokenSession(r); ok {
+		return record, nil
+	}
+	token, err := h.sessionToken(r)
+	if err != nil {
+		return sessionstore.Session{}, err
+	}
+	return h.lookupSession(r.Context(), token)
+}
+
+// rotateSession moves a session to a new ID after its privileges change,
+// such as on re-authentication, and hands it over the way the request
+// carried it; a new bearer token is returned for the response. The old ID
+// stops working. It returns false when the session was deleted meanwhile.
+func (h *AuthHandler) rotateSession(w http.ResponseWriter, r *http.Request, record sessionstore.Session) (sessionstore.Session, string, bool) {
+	if revoked, err := h.revokeSession(r.Context(), record); err != nil || !revoked {
+		return sessionstore.Session{}, "", false
+	}
+	previousID := record.ID
+	record.ID = h.idGenerator.NewID(ids.PrefixSession)
+	token, err := h.issueSession(r.Context(), record)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to issue rotated session: %v", err)
+		return sessionstore.Session{}, "", false
+	}
+
+	bearer, err := h.handOverSession(w, r, token, int(record.ExpiresAt.Sub(h.clock.Now()).Seconds()), requestTransport(r))
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to encode rotated session token: %v", err)
+		return sessionstore.Session{}, "", false
+	}
+
+	h.logger.Printf("[DEBUG] Session %s rotated to %s", previousID, record.ID)
+	return record, bearer, true
+}
+
+// requireAdmin returns the session user if they have the admin role, or a
+// role with the permission adminRoutes lists for the request's route.
+// Otherwise it writes an error response and returns false.
+func (h *AuthHandler) requireAdmin(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user := contextUser(r)
+
+	if !h.permits(user, routePermission(r)) {
+		h.logger.Printf("[DEBUG] Admin access denied for user: %s", user.Username)
+		http.Error(w, localize(r, "Forbidden"), http.StatusForbidden)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// writeSessionError maps a sessionUser error to the matching HTTP response
+func writeSessionError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errSessionUserNotFound) {
+		http.Error(w, localize(r, "User not found"), http.StatusNotFound)
+		return
+	}
+	if isContextError(err) || errors.Is(err, errSessionsUnavailable) {
+		writeStoreError(w, r, err)
+		return
+	}
+	http.Error(w, localize(r, "Unauthorized"), http.StatusUnauthorized)
+}
+
+// userExists turns a store lookup into a found flag, treating
+// ErrUserNotFound as a successful "no"
+func userExists(user *User, err error) (bool, error) {
+	if errors.Is(err, ErrUserNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// generateID creates a unique, time-sortable ID carrying a type prefix such as ids.PrefixUser
+func generateID(prefix string) string {
+	id, _ := ids.New(prefix)
+	return id
+}
+
+// generateAPISecret creates a random 32-byte key for per-user HMAC operations
+func generateAPISecret() []byte {
+	secret, _ := randutil.Bytes(32)
+	return secret
+}
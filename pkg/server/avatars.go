@@ -0,0 +1,126 @@
+package server
+
+import (
+	"auth-server/pkg/blobstore"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/mux"
+)
+
+// maxAvatarSize is the largest avatar image accepted, in bytes
+const maxAvatarSize = 1 << 20
+
+// avatarContentTypes are the image types accepted as avatars, as sniffed
+// from the upload rather than taken from its Content-Type
+var avatarContentTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// AvatarUploadHandler stores the image in the request body as the session
+// user's avatar and points AvatarURL to it. The previous upload is left to
+// the blob collector, since another user may have uploaded the same image.
+func (h *AuthHandler) AvatarUploadHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Avatar upload request received")
+
+	if h.blobs == nil {
+		http.Error(w, localize(r, "File uploads are not configured"), http.StatusServiceUnavailable)
+		return
+	}
+
+	user := contextUser(r)
+
+	image, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAvatarSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, localize(r, "Avatar is too large"), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to read avatar: %v", err)
+		http.Error(w, localize(r, "Invalid request body"), http.StatusBadRequest)
+		return
+	}
+	contentType := http.DetectContentType(image)
+	if !slices.Contains(avatarContentTypes, contentType) {
+		h.logger.Printf("[DEBUG] Refused avatar of type %s for %s", contentType, user.Username)
+		http.Error(w, localize(r, "Avatar must be a PNG, JPEG, GIF or WebP image"), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	blob, err := h.blobs.Put(r.Context(), bytes.NewReader(image), contentType)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to store avatar for %s: %v", user.Username, err)
+		http.Error(w, localize(r, "File storage is unavailable"), http.StatusServiceUnavailable)
+		return
+	}
+
+	user.AvatarBlob = blob.Key
+	user.AvatarURL = h.config.PublicURL + "/api/avatars/" + blob.Key
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to store avatar for %s: %v", user.ID, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", userETag(user))
+	json.NewEncoder(w).Encode(Response{Success: true, Message: localize(r, "Avatar updated"), Data: user.Sanitized()})
+	h.logger.Printf("[DEBUG] Avatar uploaded for user: %s", user.Username)
+}
+
+// AvatarDeleteHandler removes the session user's avatar, uploaded or not
+func (h *AuthHandler) AvatarDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Avatar removal request received")
+
+	user := contextUser(r)
+
+	user.AvatarBlob = ""
+	user.AvatarURL = ""
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to remove avatar for %s: %v", user.ID, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", userETag(user))
+	json.NewEncoder(w).Encode(Response{Success: true, Message: localize(r, "Avatar removed"), Data: user.Sanitized()})
+}
+
+// AvatarHandler redirects to a signed URL of an uploaded avatar. Avatar
+// URLs name the image's blob, so they never change meaning and the
+// redirect may be cached for part of the signed URL's lifetime. Only
+// images are served, so the endpoint cannot be used to fetch other blobs.
+func (h *AuthHandler) AvatarHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Avatar request received")
+
+	if h.blobs == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	blob, err := h.blobs.Stat(r.Context(), key)
+	if errors.Is(err, blobstore.ErrNotFound) || errors.Is(err, blobstore.ErrInvalidKey) || (err == nil && !slices.Contains(avatarContentTypes, blob.ContentType)) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to look up avatar %s: %v", key, err)
+		http.Error(w, localize(r, "File storage is unavailable"), http.StatusServiceUnavailable)
+		return
+	}
+
+	signed, err := h.blobs.SignedURL(key, h.clock.Now(), h.config.BlobURLTTL)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to sign avatar URL %s: %v", key, err)
+		http.Error(w, localize(r, "File storage is unavailable"), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.config.BlobURLTTL.Seconds()/2)))
+	http.Redirect(w, r, signed, http.StatusFound)
+}
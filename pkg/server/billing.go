@@ -0,0 +1,512 @@
+package server
+
+import (
+	"auth-server/pkg/stripe"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxStripeWebhookSize bounds a Stripe webhook payload
+const maxStripeWebhookSize = 256 << 10
+
+// stripeWebhookTolerance is how far a webhook's signature timestamp may be
+// from now, as Stripe's own libraries allow
+const stripeWebhookTolerance = 5 * time.Minute
+
+// Stripe events that change a subscription
+const (
+	stripeSubscriptionCreated = "customer.subscription.created"
+	stripeSubscriptionUpdated = "customer.subscription.updated"
+	stripeSubscriptionDeleted = "customer.subscription.deleted"
+)
+
+var (
+	errBillingAccountInvalid = errors.New("invalid billing account")
+	errBillingCustomerTaken  = errors.New("customer is linked to another account")
+)
+
+// TierLimits are what accounts on a tier may use. A zero limit leaves the
+// server-wide one in place.
+type TierLimits struct {
+	AccessTokens int `json:"accessTokens"`
+	DailyQuota   int `json:"dailyQuota"`
+	MonthlyQuota int `json:"monthlyQuota"`
+}
+
+// BillingAccount links a user, "user:<id>", or an organization,
+// "org:<domain>", to a Stripe customer and holds the tier its subscription
+// pays for. Members of an organization get its tier unless they pay for
+// their own.
+type BillingAccount struct {
+	Account          string     `json:"account"`
+	CustomerID       string     `json:"customerId"`
+	SubscriptionID   string     `json:"subscriptionId,omitempty"`
+	Status           string     `json:"status,omitempty"`
+	Tier             string     `json:"tier,omitempty"`
+	CurrentPeriodEnd *time.Time `json:"currentPeriodEnd,omitempty"`
+	UpdatedAt        time.Time  `json:"updatedAt"`
+
+	// lastEventAt is when the newest subscription event applied was
+	// created, so events Stripe delivers out of order are not applied
+	// over newer ones
+	lastEventAt time.Time
+}
+
+// billingAccountUser returns the user ID of a user's account
+func billingAccountUser(account string) (string, bool) {
+	return strings.CutPrefix(account, "user:")
+}
+
+// validBillingAccount reports whether account names a user or an
+// organization
+func validBillingAccount(account string) bool {
+	if id, ok := billingAccountUser(account); ok {
+		return id != ""
+	}
+	if domain, ok := strings.CutPrefix(account, "org:"); ok {
+		return validDomain(domain)
+	}
+	return false
+}
+
+// billingRegistry stores billing accounts in memory, by account and by
+// Stripe customer
+type billingRegistry struct {
+	mutex     sync.RWMutex
+	accounts  map[string]*BillingAccount
+	customers map[string]string // customer ID to account
+}
+
+func newBillingRegistry() *billingRegistry {
+	return &billingRegistry{accounts: make(map[string]*BillingAccount), customers: make(map[string]string)}
+}
+
+// get returns a copy of account's billing, if it has any
+func (b *billingRegistry) get(account string) (BillingAccount, bool) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if billing, ok := b.accounts[account]; ok {
+		return *billing, true
+	}
+	return BillingAccount{}, false
+}
+
+// link ties account to customerID, replacing the customer it had. A
+// customer can only pay for one account.
+func (b *billingRegistry) link(account, customerID string, now time.Time) (BillingAccount, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if owner, ok := b.customers[customerID]; ok && owner != account {
+		return BillingAccount{}, errBillingCustomerTaken
+	}
+	billing, ok := b.accounts[account]
+	if !ok {
+		billing = &BillingAccount{Account: account}
+		b.accounts[account] = billing
+	}
+	if billing.CustomerID != customerID {
+		delete(b.customers, billing.CustomerID)
+		*billing = BillingAccount{Account: account, CustomerID: customerID, Tier: billing.Tier}
+	}
+	billing.UpdatedAt = now
+	b.customers[customerID] = account
+	return *billing, nil
+}
+
+// setTier sets account's tier, creating the account without a customer if
+// it has none, and returns the tier it had
+func (b *billingRegistry) setTier(account, tier string, now time.Time) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	billing, ok := b.accounts[account]
+	if !ok {
+		billing = &BillingAccount{Account: account}
+		b.accounts[account] = billing
+	}
+	previous := billing.Tier
+	billing.Tier = tier
+	billing.UpdatedAt = now
+	return previous
+}
+
+// applySubscription records a subscription event for the account linked
+// to the subscription's customer. It returns the account before and after
+// the change, and false when no account has the customer or the event is
+// older than the last one applied.
+func (b *billingRegistry) applySubscription(event stripe.Event, subscription stripe.Subscription, tier string, now time.Time) (before, after BillingAccount, applied bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	billing, ok := b.accounts[b.customers[subscription.Customer]]
+	created := time.Unix(event.Created, 0)
+	if !ok || created.Before(billing.lastEventAt) {
+		return BillingAccount{}, BillingAccount{}, false
+	}
+
+	before = *billing
+	billing.SubscriptionID = subscription.ID
+	billing.Status = subscription.Status
+	billing.Tier = tier
+	billing.CurrentPeriodEnd = nil
+	if subscription.CurrentPeriodEnd != 0 {
+		end := time.Unix(subscription.CurrentPeriodEnd, 0).UTC()
+		billing.CurrentPeriodEnd = &end
+	}
+	billing.UpdatedAt = now
+	billing.lastEventAt = created
+	return before, *billing, true
+}
+
+// list returns every billing account ordered by account
+func (b *billingRegistry) list() []BillingAccount {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	accounts := make([]BillingAccount, 0, len(b.accounts))
+	for _, billing := range b.accounts {
+		accounts = append(accounts, *billing)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Account < accounts[j].Account })
+	return accounts
+}
+
+// tierOf returns the tier user is on: their own, or else their
+// organization's, or else the default tier
+func (s *Server) tierOf(user *User) string {
+	if user.Tier != "" {
+		return user.Tier
+	}
+	if billing, ok := s.billing.get("org:" + userOrganization(user)); ok && billing.Tier != "" {
+		return billing.Tier
+	}
+	return s.config.DefaultTier
+}
+
+// tierLimits returns what accounts on tier may use. Tiers without limits
+// configured get the server-wide ones.
+func (s *Server) tierLimits(tier string) TierLimits {
+	limits := s.config.Tiers[tier]
+	if limits.AccessTokens == 0 {
+		limits.AccessTokens = maxAccessTokens
+	}
+	if limits.DailyQuota == 0 {
+		limits.DailyQuota = s.config.QuotaDailyLimit
+	}
+	if limits.MonthlyQuota == 0 {
+		limits.MonthlyQuota = s.config.QuotaMonthlyLimit
+	}
+	return limits
+}
+
+// tierForPrices returns the tier the first of prices that has one pays
+// for, or "" when none does
+func (s *Server) tierForPrices(prices []string) string {
+	for _, price := range prices {
+		if tier, ok := s.config.StripePriceTiers[price]; ok {
+			return tier
+		}
+	}
+	return ""
+}
+
+// tierMiddleware holds users to the limits of their tier on the routes
+// that create what a tier limits: more access tokens than it allows are
+// refused. Quotas are applied by quotaMiddleware.
+func (s *Server) tierMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil || r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if template, err := route.GetPathTemplate(); err != nil || template != "/api/tokens" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, err := s.authHandler.sessionUser(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tier := s.tierOf(user)
+		if limit := s.tierLimits(tier).AccessTokens; len(user.AccessTokens) >= limit {
+			s.logger.Printf("[DEBUG] %s has the %d access tokens the %s tier allows", user.Username, limit, tier)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(Response{
+				Success: false,
+				Message: localize(r, "Your plan allows at most %d access tokens", limit),
+				Data:    map[string]interface{}{"tier": tier, "limit": limit},
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// BillingStatus is a user's tier, what it allows and the billing account
+// paying for it, if any
+type BillingStatus struct {
+	Tier    string          `json:"tier"`
+	Limits  TierLimits      `json:"limits"`
+	Account *BillingAccount `json:"account,omitempty"`
+}
+
+// billingStatus describes user's tier and where it comes from
+func (s *Server) billingStatus(user *User) BillingStatus {
+	status := BillingStatus{Tier: s.tierOf(user)}
+	status.Limits = s.tierLimits(status.Tier)
+	for _, account := range []string{"user:" + user.ID, "org:" + userOrganization(user)} {
+		if billing, ok := s.billing.get(account); ok && billing.Tier == status.Tier {
+			status.Account = &billing
+			break
+		}
+	}
+	return status
+}
+
+// BillingHandler returns the session user's tier and its limits
+func (s *Server) BillingHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Billing request received")
+
+	user := contextUser(r)
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: localize(r, "Billing retrieved successfully"),
+		Data:    s.billingStatus(user),
+	})
+}
+
+// BillingCustomerHandler links the session user to a Stripe customer,
+// creating one the first time, so a checkout can start a subscription for
+// them
+func (s *Server) BillingCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Billing customer request received")
+
+	user := contextUser(r)
+	if s.stripe == nil {
+		http.Error(w, localize(r, "Billing is not configured"), http.StatusServiceUnavailable)
+		return
+	}
+
+	account := "user:" + user.ID
+	billing, ok := s.billing.get(account)
+	if !ok || billing.CustomerID == "" {
+		customer, err := s.stripe.CreateCustomer(r.Context(), stripe.CustomerParams{
+			Email:    user.Email,
+			Name:     user.DisplayName,
+			Metadata: map[string]string{"account": account, "username": user.Username},
+		})
+		if err != nil {
+			s.logger.Printf("[DEBUG] Failed to create Stripe customer for %s: %v", user.Username, err)
+			http.Error(w, localize(r, "Billing is temporarily unavailable"), http.StatusBadGateway)
+			return
+		}
+		if billing, err = s.billing.link(account, customer.ID, s.authHandler.clock.Now()); err != nil {
+			s.writeBillingError(w, r, err)
+			return
+		}
+		s.logger.Printf("[DEBUG] Linked %s to Stripe customer %s", user.Username, customer.ID)
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: localize(r, "Billing account ready"),
+		Data:    billing,
+	})
+}
+
+// writeBillingError maps a billing error to a response
+func (s *Server) writeBillingError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errBillingAccountInvalid):
+		http.Error(w, localize(r, "Billing accounts are user:<id> or org:<domain>"), http.StatusBadRequest)
+	case errors.Is(err, errBillingCustomerTaken):
+		http.Error(w, localize(r, "The customer is linked to another account"), http.StatusConflict)
+	case errors.Is(err, ErrUserNotFound):
+		http.Error(w, localize(r, "User not found"), http.StatusNotFound)
+	default:
+		s.logger.Printf("[DEBUG] Billing failed: %v", err)
+		writeUserUpdateError(w, r, err)
+	}
+}
+
+// setUserTier stores tier on the user account names, when it is a user's
+func (s *Server) setUserTier(r *http.Request, account, tier string) error {
+	id, ok := billingAccountUser(account)
+	if !ok {
+		return nil
+	}
+	user, err := s.authHandler.users.Get(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if user.Tier == tier {
+		return nil
+	}
+	user.Tier = tier
+	user.UpdatedAt = s.authHandler.clock.Now()
+	return s.authHandler.users.Update(r.Context(), user)
+}
+
+// recordTierChange audits an account moving to another tier; by is the
+// admin who moved it, or "" for a subscription change
+func (s *Server) recordTierChange(r *http.Request, by, account, previous, tier, reason string) {
+	if previous == tier {
+		return
+	}
+	s.audit.Record(AuditEvent{
+		Type:    AuditTierChanged,
+		UserID:  by,
+		IP:      clientIP(r),
+		Details: map[string]string{"account": account, "tier": tier, "previous": previous, "reason": reason},
+	})
+	s.logger.Printf("[DEBUG] %s moved from tier %q to %q (%s)", account, previous, tier, reason)
+}
+
+// StripeWebhookHandler receives subscription events from Stripe and moves
+// the linked account to the tier its subscription pays for, or back to
+// the default when it lapses. Failures answer 500 so Stripe retries.
+func (s *Server) StripeWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Stripe webhook received")
+
+	if s.config.StripeWebhookSecret == "" {
+		http.Error(w, localize(r, "Billing is not configured"), http.StatusServiceUnavailable)
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxStripeWebhookSize))
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	event, err := stripe.ParseWebhook(payload, r.Header.Get("Stripe-Signature"), s.config.StripeWebhookSecret, stripeWebhookTolerance, s.authHandler.clock.Now())
+	if err != nil {
+		s.logger.Printf("[DEBUG] Rejected Stripe webhook: %v", err)
+		http.Error(w, localize(r, "Invalid webhook signature"), http.StatusBadRequest)
+		return
+	}
+
+	if slices.Contains([]string{stripeSubscriptionCreated, stripeSubscriptionUpdated, stripeSubscriptionDeleted}, event.Type) {
+		var subscription stripe.Subscription
+		if err := json.Unmarshal(event.Data.Object, &subscription); err != nil || subscription.Customer == "" {
+			s.logger.Printf("[DEBUG] Stripe event %s has no subscription: %v", event.ID, err)
+			http.Error(w, localize(r, "Invalid request body"), http.StatusBadRequest)
+			return
+		}
+		tier := ""
+		if event.Type != stripeSubscriptionDeleted && subscription.Entitled() {
+			tier = s.tierForPrices(subscription.PriceIDs())
+		}
+
+		before, after, applied := s.billing.applySubscription(event, subscription, tier, s.authHandler.clock.Now())
+		if !applied {
+			s.logger.Printf("[DEBUG] Ignoring Stripe event %s for customer %s: unknown customer or stale event", event.ID, subscription.Customer)
+		} else {
+			if err := s.setUserTier(r, after.Account, tier); err != nil {
+				s.logger.Printf("[DEBUG] Failed to set the tier of %s: %v", after.Account, err)
+				http.Error(w, localize(r, "Internal server error"), http.StatusInternalServerError)
+				return
+			}
+			s.recordTierChange(r, "", after.Account, before.Tier, after.Tier, "subscription_"+subscription.Status)
+		}
+	}
+
+	json.NewEncoder(w).Encode(Response{Success: true, Message: "Event received"})
+}
+
+// BillingAccountRequest links an account to an existing Stripe customer
+// and, or alternatively, puts it on a tier, as for accounts invoiced
+// outside Stripe. An empty Tier returns the account to its default.
+type BillingAccountRequest struct {
+	CustomerID string  `json:"customerId,omitempty"`
+	Tier       *string `json:"tier,omitempty"`
+}
+
+// AdminBillingAccountsHandler lists the billing accounts
+func (s *Server) AdminBillingAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Billing accounts request received")
+
+	if _, ok := s.authHandler.requireAdmin(w, r); !ok {
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: localize(r, "Billing accounts retrieved successfully"),
+		Data:    s.billing.list(),
+	})
+}
+
+// AdminBillingAccountHandler links a user or organization to a Stripe
+// customer or sets its tier
+func (s *Server) AdminBillingAccountHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Billing account request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	account := mux.Vars(r)["account"]
+	if !validBillingAccount(account) {
+		s.writeBillingError(w, r, errBillingAccountInvalid)
+		return
+	}
+	var req BillingAccountRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+	req.CustomerID = strings.TrimSpace(req.CustomerID)
+	if req.CustomerID == "" && req.Tier == nil {
+		http.Error(w, localize(r, "A customer ID or a tier is required"), http.StatusBadRequest)
+		return
+	}
+	if req.Tier != nil && *req.Tier != "" {
+		if _, ok := s.config.Tiers[*req.Tier]; !ok && *req.Tier != s.config.DefaultTier {
+			http.Error(w, localize(r, "Unknown tier: %s", *req.Tier), http.StatusBadRequest)
+			return
+		}
+	}
+	if id, ok := billingAccountUser(account); ok {
+		if _, err := s.authHandler.users.Get(r.Context(), id); err != nil {
+			s.writeBillingError(w, r, err)
+			return
+		}
+	}
+
+	now := s.authHandler.clock.Now()
+	if req.CustomerID != "" {
+		if _, err := s.billing.link(account, req.CustomerID, now); err != nil {
+			s.writeBillingError(w, r, err)
+			return
+		}
+	}
+	if req.Tier != nil {
+		previous := s.billing.setTier(account, *req.Tier, now)
+		if err := s.setUserTier(r, account, *req.Tier); err != nil {
+			s.billing.setTier(account, previous, now)
+			s.writeBillingError(w, r, err)
+			return
+		}
+		s.recordTierChange(r, admin.ID, account, previous, *req.Tier, "admin")
+	}
+
+	billing, _ := s.billing.get(account)
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: localize(r, "Billing account updated"),
+		Data:    billing,
+	})
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"auth-server/pkg/blobstore"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// BlobHandler serves a blob of the disk store to whoever holds a signed
+// URL for it. S3 signed URLs point to the bucket, so with that store there
+// is nothing to serve here. Blobs are served sandboxed and unsniffed,
+// since their content came from users.
+func (h *AuthHandler) BlobHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Blob download request received")
+
+	disk, ok := h.blobs.(*blobstore.Disk)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	key := mux.Vars(r)["key"]
+	now := h.clock.Now()
+	if err := disk.Verify(key, r.URL.Query(), now); err != nil {
+		h.logger.Printf("[DEBUG] Refused blob download of %s: %v", key, err)
+		http.Error(w, localize(r, "Download link is invalid or has expired"), http.StatusForbidden)
+		return
+	}
+
+	content, info, err := disk.Open(r.Context(), key)
+	if errors.Is(err, blobstore.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to open blob %s: %v", key, err)
+		http.Error(w, localize(r, "File storage is unavailable"), http.StatusServiceUnavailable)
+		return
+	}
+	defer content.Close()
+
+	expires, _ := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(time.Unix(expires, 0).Sub(now).Seconds())))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("ETag", `"`+key+`"`)
+	// Disk blobs are files, which ServeContent can serve ranges of
+	http.ServeContent(w, r, "", info.CreatedAt, content.(io.ReadSeeker))
+}
+
+// purgeOrphanedBlobs deletes the blobs no user refers to any more, such as
+// replaced avatars, once they are older than Config.BlobGCGrace, and
+// returns how many it deleted
+func (h *AuthHandler) purgeOrphanedBlobs(now time.Time) int {
+	ctx := context.Background()
+	users, err := h.users.List(ctx)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to list users to collect blobs: %v", err)
+		return 0
+	}
+
+	referenced := make(map[string]bool)
+	for _, user := range users {
+		if user.AvatarBlob != "" {
+			referenced[user.AvatarBlob] = true
+		}
+	}
+	deleted, err := blobstore.Collect(ctx, h.blobs, func(key string) bool { return referenced[key] }, now.Add(-h.config.BlobGCGrace))
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to collect orphaned blobs: %v", err)
+	}
+	return deleted
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// suspicionWindow is how long an address's failed logins count towards its
+// suspicion score
+const suspicionWindow = time.Hour
+
+// IPBlock is a temporary block on logins from an address that looked like
+// it was guessing passwords
+type IPBlock struct {
+	IP        string    `json:"ip"`
+	Score     int       `json:"score"`
+	Accounts  int       `json:"accounts"`
+	BlockedAt time.Time `json:"blockedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// SuspiciousIP is an address with recent failed logins that is not blocked
+type SuspiciousIP struct {
+	IP          string    `json:"ip"`
+	Score       int       `json:"score"`
+	Failures    int       `json:"failures"`
+	Accounts    int       `json:"accounts"`
+	LastFailure time.Time `json:"lastFailure"`
+}
+
+// ipSuspicion tracks one address's recent failed logins
+type ipSuspicion struct {
+	failures int
+	accounts map[string]bool
+	last     time.Time
+}
+
+// score weighs failures against many accounts more heavily than failures
+// against one, since that is what credential stuffing looks like
+func (s *ipSuspicion) score() int {
+	return s.failures + 2*(len(s.accounts)-1)
+}
+
+// bruteForceGuard scores addresses by their failed logins and blocks those
+// whose score reaches Config.IPBlockScore for Config.IPBlockDuration
+type bruteForceGuard struct {
+	blockScore    int
+	blockDuration time.Duration
+
+	mutex   sync.Mutex
+	suspect map[string]*ipSuspicion
+	blocks  map[string]IPBlock
+}
+
+func newBruteForceGuard(cfg Config) *bruteForceGuard {
+	return &bruteForceGuard{
+		blockScore:    cfg.IPBlockScore,
+		blockDuration: cfg.IPBlockDuration,
+		suspect:       make(map[string]*ipSuspicion),
+		blocks:        make(map[string]IPBlock),
+	}
+}
+
+// recordFailure adds a failed login for username from ip. It returns the
+// new block when this failure got the address blocked.
+func (g *bruteForceGuard) recordFailure(ip, username string, now time.Time) (IPBlock, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	suspicion := g.suspect[ip]
+	if suspicion == nil || now.Sub(suspicion.last) > suspicionWindow {
+		suspicion = &ipSuspicion{accounts: make(map[string]bool)}
+		g.suspect[ip] = suspicion
+	}
+	suspicion.failures++
+	suspicion.accounts[username] = true
+	suspicion.last = now
+
+	if g.blockScore <= 0 || suspicion.score() < g.blockScore {
+		return IPBlock{}, false
+	}
+	if block, ok := g.blocks[ip]; ok && now.Before(block.ExpiresAt) {
+		return IPBlock{}, false
+	}
+
+	block := IPBlock{
+		IP:        ip,
+		Score:     suspicion.score(),
+		Accounts:  len(suspicion.accounts),
+		BlockedAt: now,
+		ExpiresAt: now.Add(g.blockDuration),
+	}
+	g.blocks[ip] = block
+	// Start scoring afresh once the block ends
+	delete(g.suspect, ip)
+	return block, true
+}
+
+// blocked returns the block on ip, if any
+func (g *bruteForceGuard) blocked(ip string, now time.Time) (IPBlock, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	block, ok := g.blocks[ip]
+	if !ok || !now.Before(block.ExpiresAt) {
+		return IPBlock{}, false
+	}
+	return block, true
+}
+
+// unblock lifts the block on ip, reporting whether there was one
+func (g *bruteForceGuard) unblock(ip string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	_, ok := g.blocks[ip]
+	delete(g.blocks, ip)
+	delete(g.suspect, ip)
+	return ok
+}
+
+// snapshot returns the current blocks and suspicious addresses, highest
+// score first
+func (g *bruteForceGuard) snapshot(now time.Time) ([]IPBlock, []SuspiciousIP) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	blocks := []IPBlock{}
+	for _, block := range g.blocks {
+		if now.Before(block.ExpiresAt) {
+			blocks = append(blocks, block)
+		}
+	}
+	suspects := []SuspiciousIP{}
+	for ip, suspicion := range g.suspect {
+		if now.Sub(suspicion.last) <= suspicionWindow {
+			suspects = append(suspects, SuspiciousIP{
+				IP:          ip,
+				Score:       suspicion.score(),
+				Failures:    suspicion.failures,
+				Accounts:    len(suspicion.accounts),
+				LastFailure: suspicion.last,
+			})
+		}
+	}
+
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Score > blocks[j].Score })
+	sort.Slice(suspects, func(i, j int) bool { return suspects[i].Score > suspects[j].Score })
+	return blocks, suspects
+}
+
+// Purge removes expired blocks and scores, returning how many were removed
+func (g *bruteForceGuard) Purge(now time.Time) int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	purged := 0
+	for ip, block := range g.blocks {
+		if !now.Before(block.ExpiresAt) {
+			delete(g.blocks, ip)
+			purged++
+		}
+	}
+	for ip, suspicion := range g.suspect {
+		if now.Sub(suspicion.last) > suspicionWindow {
+			delete(g.suspect, ip)
+			purged++
+		}
+	}
+	return purged
+}
+
+// loginBackoff is how long to hold a login attempt that has failed
+// failures times recently: nothing below Config.LoginBackoffThreshold, then
+// doubling from Config.LoginBackoffBase up to Config.LoginBackoffMax
+func (h *AuthHandler) loginBackoff(failures int) time.Duration {
+	if h.config.LoginBackoffBase <= 0 || failures < h.config.LoginBackoffThreshold {
+		return 0
+	}
+	delay := h.config.LoginBackoffBase
+	for i := h.config.LoginBackoffThreshold; i < failures && delay < h.config.LoginBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > h.config.LoginBackoffMax {
+		delay = h.config.LoginBackoffMax
+	}
+	return delay
+}
+
+// tarpit holds a login attempt for its backoff delay. It returns false if
+// the request was cancelled meanwhile.
+func (h *AuthHandler) tarpit(ctx context.Context, failureKeys []string) bool {
+	delay := h.loginBackoff(h.loginFailures.Max(failureKeys...))
+	if delay == 0 {
+		return true
+	}
+	h.logger.Printf("[DEBUG] Delaying login attempt by %s after repeated failures", delay)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// recordLoginFailure counts a failed password or second factor for the
+// account and address, blocking the address if its score gets too high
+func (h *AuthHandler) recordLoginFailure(username, ip string) {
+	h.loginFailures.Add(loginFailureKeys(username, ip)...)
+
+	block, blocked := h.bruteForce.recordFailure(ip, username, h.clock.Now())
+	if !blocked {
+		return
+	}
+	h.logger.Printf("[DEBUG] Blocking logins from %s until %s (score %d)", ip, block.ExpiresAt.Format(time.RFC3339), block.Score)
+	h.audit.Record(AuditEvent{
+		Type: AuditIPBlocked,
+		IP:   ip,
+		Details: map[string]string{
+			"score":     strconv.Itoa(block.Score),
+			"accounts":  strconv.Itoa(block.Accounts),
+			"expiresAt": block.ExpiresAt.Format(time.RFC3339),
+		},
+	})
+}
+
+// writeIPBlocked refuses a login from a blocked address
+func writeIPBlocked(w http.ResponseWriter, r *http.Request, block IPBlock) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(block.ExpiresAt).Seconds())+1))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(Response{
+		Success: false,
+		Message: localize(r, "Too many failed login attempts from your network, please try again later"),
+	})
+}
+
+// BlockedIPsHandler lists blocked and suspicious addresses for admins
+func (s *Server) BlockedIPsHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Blocked IPs request received")
+
+	if _, ok := s.authHandler.requireAdmin(w, r); !ok {
+		return
+	}
+
+	blocks, suspects := s.authHandler.bruteForce.snapshot(s.authHandler.clock.Now())
+	response := Response{
+		Success: true,
+		Message: "Blocked IPs retrieved successfully",
+		Data: map[string]interface{}{
+			"blocked":    blocks,
+			"suspicious": suspects,
+		},
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// BlockedIPDeleteHandler lifts a block before it expires
+func (s *Server) BlockedIPDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Blocked IP delete request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	ip := mux.Vars(r)["ip"]
+	if !s.authHandler.bruteForce.unblock(ip) {
+		http.Error(w, "Blocked IP not found", http.StatusNotFound)
+		return
+	}
+
+	s.audit.Record(AuditEvent{
+		Type:    AuditIPUnblocked,
+		UserID:  admin.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"ip": ip},
+	})
+
+	response := Response{
+		Success: true,
+		Message: "IP unblocked successfully",
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"auth-server/pkg/captcha"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginFailureWindow is how long failed login attempts are remembered
+const loginFailureWindow = 15 * time.Minute
+
+// failureCounter counts recent failures per key, forgetting them once no
+// new failure has been seen for the window
+type failureCounter struct {
+	mutex   sync.Mutex
+	window  time.Duration
+	entries map[string]*failureEntry
+}
+
+type failureEntry struct {
+	count int
+	last  time.Time
+}
+
+func newFailureCounter(window time.Duration) *failureCounter {
+	return &failureCounter{
+		window:  window,
+		entries: make(map[string]*failureEntry),
+	}
+}
+
+// Add records a failure for each key
+func (c *failureCounter) Add(keys ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		entry, ok := c.entries[key]
+		if !ok || now.Sub(entry.last) > c.window {
+			entry = &failureEntry{}
+			c.entries[key] = entry
+		}
+		entry.count++
+		entry.last = now
+	}
+}
+
+// Max returns the highest current failure count among keys
+func (c *failureCounter) Max(keys ...string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	highest := 0
+	for _, key := range keys {
+		entry, ok := c.entries[key]
+		if !ok {
+			continue
+		}
+		if now.Sub(entry.last) > c.window {
+			delete(c.entries, key)
+			continue
+		}
+		if entry.count > highest {
+			highest = entry.count
+		}
+	}
+	return highest
+}
+
+// Status returns the highest current count among keys, like Max, and how
+// long until that count is forgotten
+func (c *failureCounter) Status(keys ...string) (count int, reset time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		entry, ok := c.entries[key]
+		if !ok || now.Sub(entry.last) > c.window {
+			continue
+		}
+		if entry.count > count {
+			count = entry.count
+			reset = entry.last.Add(c.window).Sub(now)
+		}
+	}
+	return count, reset
+}
+
+// Reset forgets the failures recorded for each key
+func (c *failureCounter) Reset(keys ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, key := range keys {
+		delete(c.entries, key)
+	}
+}
+
+// Purge forgets every key whose window has passed and returns how many
+// were removed. Keys that are never checked again would otherwise linger.
+func (c *failureCounter) Purge(now time.Time) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	purged := 0
+	for key, entry := range c.entries {
+		if now.Sub(entry.last) > c.window {
+			delete(c.entries, key)
+			purged++
+		}
+	}
+	return purged
+}
+
+// Over returns the keys with the given prefix that currently have at least
+// min failures, with the prefix removed
+func (c *failureCounter) Over(prefix string, min int) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	var keys []string
+	for key, entry := range c.entries {
+		if strings.HasPrefix(key, prefix) && entry.count >= min && now.Sub(entry.last) <= c.window {
+			keys = append(keys, strings.TrimPrefix(key, prefix))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// loginFailureKeys returns the counter keys for a login attempt, tracking
+// both the targeted account and the client address
+func loginFailureKeys(username, ip string) []string {
+	return []string{"user:" + username, "ip:" + ip}
+}
+
+// newCaptchaFromConfig returns the configured CAPTCHA verifier, or nil when
+// CAPTCHA checks are disabled
+func newCaptchaFromConfig(cfg Config) captcha.Verifier {
+	if cfg.CaptchaProvider == "" {
+		return nil
+	}
+
+	verifier, err := captcha.New(cfg.CaptchaProvider, cfg.CaptchaSecret)
+	if err != nil {
+		cfg.Logger.Printf("[DEBUG] CAPTCHA disabled: %v", err)
+		return nil
+	}
+
+	if cfg.CaptchaProvider == "bypass" {
+		cfg.Logger.Printf("[DEBUG] CAPTCHA bypass mode enabled, do not use in production")
+	}
+	return verifier
+}
@@ -0,0 +1,408 @@
+//go:build chaos
+
+package server
+
+import (
+	"auth-server/pkg/mailer"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Chaos mode is only compiled into builds made with -tags chaos. It lets
+// admins inject faults into chosen endpoints through /api/internal/chaos to
+// check how clients retry and how the server copes.
+
+// errInjectedFault is returned by stores and mailers a fault was injected into
+var errInjectedFault = errors.New("injected fault")
+
+// Fault is a failure injected into requests to one endpoint
+type Fault struct {
+	ID string `json:"id"`
+	// Endpoint is a route template such as /api/users/{id}, a request
+	// path, or "*" for every endpoint
+	Endpoint string `json:"endpoint"`
+	// Method limits the fault to one HTTP method when set
+	Method string `json:"method,omitempty"`
+	// Percent is the share of matching requests the fault applies to
+	Percent int `json:"percent"`
+	// LatencyMs delays the request before it is handled
+	LatencyMs int `json:"latencyMs,omitempty"`
+	// Status answers the request with this status instead of handling it
+	Status int `json:"status,omitempty"`
+	// StoreError makes user store calls fail while handling the request
+	StoreError bool `json:"storeError,omitempty"`
+	// MailerError makes emails sent while handling the request fail
+	MailerError bool `json:"mailerError,omitempty"`
+}
+
+// FaultRequest adds a fault; Percent defaults to 100
+type FaultRequest struct {
+	Endpoint    string `json:"endpoint"`
+	Method      string `json:"method"`
+	Percent     *int   `json:"percent"`
+	LatencyMs   int    `json:"latencyMs"`
+	Status      int    `json:"status"`
+	StoreError  bool   `json:"storeError"`
+	MailerError bool   `json:"mailerError"`
+}
+
+// faultInjector holds the active faults
+type faultInjector struct {
+	mutex  sync.RWMutex
+	faults []Fault
+	nextID int
+}
+
+func (f *faultInjector) add(fault Fault) Fault {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.nextID++
+	fault.ID = "fault_" + strconv.Itoa(f.nextID)
+	f.faults = append(f.faults, fault)
+	return fault
+}
+
+func (f *faultInjector) remove(id string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for i, fault := range f.faults {
+		if fault.ID == id {
+			f.faults = append(f.faults[:i], f.faults[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (f *faultInjector) clear() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.faults = nil
+}
+
+func (f *faultInjector) list() []Fault {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return append([]Fault{}, f.faults...)
+}
+
+// match returns the faults that apply to r, rolling each one's Percent
+func (f *faultInjector) match(r *http.Request) []Fault {
+	template := r.URL.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		if t, err := route.GetPathTemplate(); err == nil {
+			template = t
+		}
+	}
+
+	var matched []Fault
+	for _, fault := range f.list() {
+		if fault.Endpoint != "*" && fault.Endpoint != template && fault.Endpoint != r.URL.Path {
+			continue
+		}
+		if fault.Method != "" && fault.Method != r.Method {
+			continue
+		}
+		if fault.Percent < 100 && rand.IntN(100) >= fault.Percent {
+			continue
+		}
+		matched = append(matched, fault)
+	}
+	return matched
+}
+
+// injectedFaults is the context key for the faults applied to a request
+type injectedFaults struct{}
+
+// faultsFrom returns the faults applied to the request ctx belongs to
+func faultsFrom(ctx context.Context) (storeError, mailerError bool) {
+	faults, _ := ctx.Value(injectedFaults{}).([]Fault)
+	for _, fault := range faults {
+		storeError = storeError || fault.StoreError
+		mailerError = mailerError || fault.MailerError
+	}
+	return storeError, mailerError
+}
+
+// faultyUserStore fails calls made for requests with a store fault
+type faultyUserStore struct {
+	UserStore
+}
+
+func (s *faultyUserStore) check(ctx context.Context) error {
+	if storeError, _ := faultsFrom(ctx); storeError {
+		return errInjectedFault
+	}
+	return nil
+}
+
+func (s *faultyUserStore) Create(ctx context.Context, user *User) error {
+	if err := s.check(ctx); err != nil {
+		return err
+	}
+	return s.UserStore.Create(ctx, user)
+}
+
+func (s *faultyUserStore) Get(ctx context.Context, id string) (*User, error) {
+	if err := s.check(ctx); err != nil {
+		return nil, err
+	}
+	return s.UserStore.Get(ctx, id)
+}
+
+func (s *faultyUserStore) GetByUsername(ctx context.Context, username string) (*User, error) {
+	if err := s.check(ctx); err != nil {
+		return nil, err
+	}
+	return s.UserStore.GetByUsername(ctx, username)
+}
+
+func (s *faultyUserStore) GetByEmail(ctx context.Context, email string) (*User, error) {
+	if err := s.check(ctx); err != nil {
+		return nil, err
+	}
+	return s.UserStore.GetByEmail(ctx, email)
+}
+
+func (s *faultyUserStore) Update(ctx context.Context, user *User) error {
+	if err := s.check(ctx); err != nil {
+		return err
+	}
+	return s.UserStore.Update(ctx, user)
+}
+
+func (s *faultyUserStore) List(ctx context.Context) ([]*User, error) {
+	if err := s.check(ctx); err != nil {
+		return nil, err
+	}
+	return s.UserStore.List(ctx)
+}
+
+func (s *faultyUserStore) Delete(ctx context.Context, id string) error {
+	if err := s.check(ctx); err != nil {
+		return err
+	}
+	return s.UserStore.Delete(ctx, id)
+}
+
+// faultyMailer fails sends made for requests with a mailer fault
+type faultyMailer struct {
+	mailer.Mailer
+}
+
+func (m *faultyMailer) Send(ctx context.Context, msg mailer.Message) error {
+	if _, mailerError := faultsFrom(ctx); mailerError {
+		return errInjectedFault
+	}
+	return m.Mailer.Send(ctx, msg)
+}
+
+// installChaos wraps the user store and mailer so faults can reach them,
+// and adds the fault API and the middleware that applies faults
+func (s *Server) installChaos() {
+	s.logger.Printf("[DEBUG] Chaos mode is compiled in: faults can be injected through /api/internal/chaos")
+
+	injector := &faultInjector{}
+	// Store faults go under search indexing, PII encryption and alerting,
+	// where the real storage would fail
+	store := &s.authHandler.users
+	if searchable, ok := (*store).(*searchableUserStore); ok {
+		store = &searchable.next
+	}
+	if encrypted, ok := (*store).(*encryptedUserStore); ok {
+		store = &encrypted.next
+	}
+	if alerting, ok := (*store).(*alertingUserStore); ok {
+		store = &alerting.next
+	}
+	*store = &faultyUserStore{UserStore: *store}
+	s.authHandler.mailer = &faultyMailer{Mailer: s.authHandler.mailer}
+
+	s.authenticated.HandleFunc("/api/internal/chaos", s.chaosHandler(injector)).Methods("GET", "POST", "DELETE")
+	s.authenticated.HandleFunc("/api/internal/chaos/{id}", s.chaosDeleteHandler(injector)).Methods("DELETE")
+	s.router.Use(s.chaosMiddleware(injector))
+}
+
+// chaosMiddleware applies the faults for each request. The fault API itself
+// is never faulted, so faults can always be removed.
+func (s *Server) chaosMiddleware(injector *faultInjector) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, _ := route.GetPathTemplate(); template == "/api/internal/chaos" || template == "/api/internal/chaos/{id}" {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			faults := injector.match(r)
+			if len(faults) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			for _, fault := range faults {
+				if fault.LatencyMs > 0 {
+					s.logger.Printf("[DEBUG] Injecting %dms latency into %s %s", fault.LatencyMs, r.Method, r.URL.Path)
+					select {
+					case <-time.After(time.Duration(fault.LatencyMs) * time.Millisecond):
+					case <-r.Context().Done():
+						return
+					}
+				}
+			}
+			for _, fault := range faults {
+				if fault.Status != 0 {
+					s.logger.Printf("[DEBUG] Injecting status %d into %s %s", fault.Status, r.Method, r.URL.Path)
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(fault.Status)
+					json.NewEncoder(w).Encode(Response{
+						Success: false,
+						Message: "Injected fault",
+						Data:    map[string]string{"fault": fault.ID},
+					})
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), injectedFaults{}, faults)))
+		})
+	}
+}
+
+// chaosHandler lists faults on GET, adds one on POST and removes them all
+// on DELETE
+func (s *Server) chaosHandler(injector *faultInjector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.logger.Printf("[DEBUG] Chaos request received")
+
+		admin, ok := s.authHandler.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			response := Response{
+				Success: true,
+				Message: "Faults retrieved successfully",
+				Data:    injector.list(),
+			}
+
+			json.NewEncoder(w).Encode(response)
+
+		case http.MethodPost:
+			var req FaultRequest
+			if err := decodeJSON(w, r, &req); err != nil {
+				s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+				writeBodyError(w, r, err)
+				return
+			}
+
+			fault := Fault{
+				Endpoint:    req.Endpoint,
+				Method:      req.Method,
+				Percent:     100,
+				LatencyMs:   req.LatencyMs,
+				Status:      req.Status,
+				StoreError:  req.StoreError,
+				MailerError: req.MailerError,
+			}
+			if req.Percent != nil {
+				fault.Percent = *req.Percent
+			}
+			switch {
+			case fault.Endpoint == "":
+				http.Error(w, "endpoint is required", http.StatusBadRequest)
+				return
+			case fault.Percent < 0 || fault.Percent > 100:
+				http.Error(w, "percent must be between 0 and 100", http.StatusBadRequest)
+				return
+			case fault.LatencyMs < 0:
+				http.Error(w, "latencyMs must not be negative", http.StatusBadRequest)
+				return
+			case fault.Status != 0 && (fault.Status < 400 || fault.Status > 599):
+				http.Error(w, "status must be an error status", http.StatusBadRequest)
+				return
+			case fault.LatencyMs == 0 && fault.Status == 0 && !fault.StoreError && !fault.MailerError:
+				http.Error(w, "A fault needs latencyMs, status, storeError or mailerError", http.StatusBadRequest)
+				return
+			}
+
+			fault = injector.add(fault)
+			s.logger.Printf("[DEBUG] Fault %s added for %s by %s", fault.ID, fault.Endpoint, admin.Username)
+			s.audit.Record(AuditEvent{
+				Type:   AuditChaosChanged,
+				UserID: admin.ID,
+				IP:     clientIP(r),
+				Details: map[string]string{
+					"change":   "added",
+					"fault":    fault.ID,
+					"endpoint": fault.Endpoint,
+				},
+			})
+
+			response := Response{
+				Success: true,
+				Message: "Fault added successfully",
+				Data:    fault,
+			}
+
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(response)
+
+		case http.MethodDelete:
+			injector.clear()
+			s.logger.Printf("[DEBUG] Faults cleared by %s", admin.Username)
+			s.audit.Record(AuditEvent{
+				Type:    AuditChaosChanged,
+				UserID:  admin.ID,
+				IP:      clientIP(r),
+				Details: map[string]string{"change": "cleared"},
+			})
+
+			json.NewEncoder(w).Encode(Response{Success: true, Message: "Faults cleared successfully"})
+
+		default:
+			s.logger.Printf("[DEBUG] Invalid method: %s", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// chaosDeleteHandler removes one fault by ID
+func (s *Server) chaosDeleteHandler(injector *faultInjector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.logger.Printf("[DEBUG] Chaos delete request received")
+
+		admin, ok := s.authHandler.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+		if !injector.remove(id) {
+			http.Error(w, "Fault not found", http.StatusNotFound)
+			return
+		}
+		s.logger.Printf("[DEBUG] Fault %s removed by %s", id, admin.Username)
+		s.audit.Record(AuditEvent{
+			Type:    AuditChaosChanged,
+			UserID:  admin.ID,
+			IP:      clientIP(r),
+			Details: map[string]string{"change": "removed", "fault": id},
+		})
+
+		json.NewEncoder(w).Encode(Response{Success: true, Message: "Fault removed successfully"})
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !chaos
+
+package server
+
+// installChaos does nothing unless the server is built with -tags chaos,
+// so production builds cannot have faults injected
+func (s *Server) installChaos() {}
@@ -0,0 +1,113 @@
+//go:build chaos
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run with: go test -tags chaos ./pkg/server
+func TestChaosFaults(t *testing.T) {
+	server := newTestServer(t)
+	sent := make(recordingMailer, 10)
+	server.authHandler.mailer = &faultyMailer{Mailer: sent}
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	userCookies := registerAndLogin(t, server, "bob", "bob@example.com", "password123")
+
+	send := func(method, path, body string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	addFault := func(body string) Fault {
+		w := send("POST", "/api/internal/chaos", body, adminCookies)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected the fault to be added, got %d: %s", w.Code, w.Body.String())
+		}
+		var response struct {
+			Data Fault `json:"data"`
+		}
+		json.NewDecoder(w.Body).Decode(&response)
+		return response.Data
+	}
+
+	if w := send("POST", "/api/internal/chaos", `{"endpoint":"/api/profile","status":503}`, userCookies); w.Code != http.StatusForbidden {
+		t.Errorf("Expected non-admins to be refused, got %d", w.Code)
+	}
+	if w := send("POST", "/api/internal/chaos", `{"endpoint":"/api/profile"}`, adminCookies); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a fault without an effect to be rejected, got %d", w.Code)
+	}
+
+	// Injected status, only for the chosen method
+	fault := addFault(`{"endpoint":"/api/profile","method":"GET","status":503}`)
+	if w := send("GET", "/api/profile", "", userCookies); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the injected status, got %d", w.Code)
+	}
+	if w := send("GET", "/api/health", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected other endpoints to be unaffected, got %d", w.Code)
+	}
+	if w := send("DELETE", "/api/internal/chaos/"+fault.ID, "", adminCookies); w.Code != http.StatusOK {
+		t.Fatalf("Expected the fault to be removed, got %d", w.Code)
+	}
+	if w := send("GET", "/api/profile", "", userCookies); w.Code != http.StatusOK {
+		t.Errorf("Expected the profile once the fault is removed, got %d", w.Code)
+	}
+
+	// Latency
+	addFault(`{"endpoint":"/api/health","latencyMs":50}`)
+	start := time.Now()
+	send("GET", "/api/health", "", nil)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the request to be delayed, took %v", elapsed)
+	}
+
+	// Store errors, matched by route template
+	addFault(`{"endpoint":"/api/login","storeError":true}`)
+	if w := send("POST", "/api/login", `{"username":"bob","password":"password123"}`, nil); w.Code == http.StatusOK {
+		t.Errorf("Expected the login to fail with the store down")
+	}
+
+	// Mailer errors
+	addFault(`{"endpoint":"/api/password-reset/request","mailerError":true}`)
+	send("POST", "/api/password-reset/request", `{"email":"bob@example.com"}`, nil)
+	select {
+	case msg := <-sent:
+		t.Errorf("Expected the email to fail, got %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if w := send("DELETE", "/api/internal/chaos", "", adminCookies); w.Code != http.StatusOK {
+		t.Fatalf("Expected the faults to be cleared, got %d", w.Code)
+	}
+	if w := send("POST", "/api/login", `{"username":"bob","password":"password123"}`, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the login once the faults are cleared, got %d", w.Code)
+	}
+	send("POST", "/api/password-reset/request", `{"email":"bob@example.com"}`, nil)
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Error("Expected the email once the faults are cleared")
+	}
+
+	changes := 0
+	for _, event := range server.audit.Recent(0) {
+		if event.Type == AuditChaosChanged {
+			changes++
+		}
+	}
+	if changes != 6 {
+		t.Errorf("Expected 6 audited fault changes, got %d", changes)
+	}
+}
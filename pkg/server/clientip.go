@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// clientIPKey is the context key under which the resolved client IP is stored
+type clientIPKey struct{}
+
+// realIPMiddleware resolves the originating client address, honoring
+// forwarding headers from trusted proxies and from peers on a unix socket,
+// and stores it on the request context for clientIP
+func (s *Server) realIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := s.ipResolver.ClientIP(r)
+		if local, _ := r.Context().Value(localConnKey{}).(bool); local {
+			// A local proxy forwards the client's address; a local
+			// process connecting directly is reported as loopback
+			ip = "127.0.0.1"
+			if forwarded, ok := s.ipResolver.LocalClientIP(r); ok {
+				ip = forwarded
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
+
+// clientIP returns the IP address of the client that sent r. Behind a
+// trusted proxy this is the address resolved by realIPMiddleware; otherwise
+// it is the direct peer address.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
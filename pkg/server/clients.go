@@ -0,0 +1,246 @@
+package server
+
+import (
+	"auth-server/pkg/ids"
+	"auth-server/pkg/randutil"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// OAuthClient is a machine client allowed to obtain service tokens with the
+// client_credentials grant, or user tokens with the device grant
+type OAuthClient struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+
+	// SecretHash is the SHA-256 of the client secret. Secrets are random
+	// and high-entropy, so a slow password hash is not needed.
+	SecretHash []byte `json:"-"`
+}
+
+// allowsScope reports whether the client may request scope
+func (c *OAuthClient) allowsScope(scope string) bool {
+	for _, allowed := range c.Scopes {
+		if allowed == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientRequest represents a request to register a machine client
+type ClientRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// clientRegistry stores machine clients in memory
+type clientRegistry struct {
+	mutex   sync.RWMutex
+	clients map[string]*OAuthClient
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{clients: make(map[string]*OAuthClient)}
+}
+
+// create registers a client and returns it with its plaintext secret,
+// which is not stored and cannot be retrieved later
+func (c *clientRegistry) create(name string, scopes []string) (*OAuthClient, string, error) {
+	secret, err := randutil.Base64(32)
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.Sum256([]byte(secret))
+
+	client := &OAuthClient{
+		ID:         generateID(ids.PrefixClient),
+		Name:       name,
+		Scopes:     scopes,
+		Created:    time.Now(),
+		SecretHash: hash[:],
+	}
+
+	c.mutex.Lock()
+	c.clients[client.ID] = client
+	c.mutex.Unlock()
+
+	return client, secret, nil
+}
+
+// authenticate returns the client when id and secret match a registered client
+func (c *clientRegistry) authenticate(id, secret string) (*OAuthClient, bool) {
+	c.mutex.RLock()
+	client, ok := c.clients[id]
+	c.mutex.RUnlock()
+
+	hash := sha256.Sum256([]byte(secret))
+	if !ok || subtle.ConstantTimeCompare(hash[:], client.SecretHash) != 1 {
+		return nil, false
+	}
+	return client, true
+}
+
+// get returns the client registered as id
+func (c *clientRegistry) get(id string) (*OAuthClient, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	client, ok := c.clients[id]
+	return client, ok
+}
+
+// list returns every client ordered by ID, which is creation order
+func (c *clientRegistry) list() []*OAuthClient {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	clients := make([]*OAuthClient, 0, len(c.clients))
+	for _, client := range c.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
+}
+
+// remove deletes a client, reporting whether it existed
+func (c *clientRegistry) remove(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, ok := c.clients[id]
+	delete(c.clients, id)
+	return ok
+}
+
+// validScope reports whether scope is a valid OAuth2 scope token (RFC 6749 section 3.3)
+func validScope(scope string) bool {
+	if scope == "" {
+		return false
+	}
+	for _, c := range scope {
+		if c < 0x21 || c > 0x7e || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// ClientsHandler lists machine clients on GET and registers one on POST
+func (s *Server) ClientsHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] OAuth clients request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		response := Response{
+			Success: true,
+			Message: "Clients retrieved successfully",
+			Data:    s.clients.list(),
+		}
+
+		json.NewEncoder(w).Encode(response)
+
+	case http.MethodPost:
+		var req ClientRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+			writeBodyError(w, r, err)
+			return
+		}
+
+		if req.Name == "" || len(req.Scopes) == 0 {
+			s.logger.Printf("[DEBUG] Missing required fields")
+			http.Error(w, "Name and at least one scope are required", http.StatusBadRequest)
+			return
+		}
+		for _, scope := range req.Scopes {
+			if !validScope(scope) {
+				s.logger.Printf("[DEBUG] Invalid scope: %q", scope)
+				http.Error(w, fmt.Sprintf("Invalid scope %q", scope), http.StatusBadRequest)
+				return
+			}
+		}
+
+		client, secret, err := s.clients.create(req.Name, req.Scopes)
+		if err != nil {
+			s.logger.Printf("[DEBUG] Failed to create client: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		s.audit.Record(AuditEvent{
+			Type:   AuditClientChanged,
+			UserID: admin.ID,
+			IP:     clientIP(r),
+			Details: map[string]string{
+				"change": "created",
+				"client": client.ID,
+				"scopes": strings.Join(client.Scopes, " "),
+			},
+		})
+
+		response := Response{
+			Success: true,
+			Message: "Client registered successfully. Store the secret now, it will not be shown again.",
+			Data: map[string]interface{}{
+				"client":       client,
+				"clientSecret": secret,
+			},
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(response)
+
+	default:
+		s.logger.Printf("[DEBUG] Invalid method: %s", r.Method)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ClientDeleteHandler removes a machine client by ID. Tokens already issued
+// to it stay valid until they expire.
+func (s *Server) ClientDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] OAuth client delete request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if !s.clients.remove(id) {
+		s.logger.Printf("[DEBUG] Client not found: %s", id)
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	s.audit.Record(AuditEvent{
+		Type:    AuditClientChanged,
+		UserID:  admin.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"change": "removed", "client": id},
+	})
+
+	response := Response{
+		Success: true,
+		Message: "Client removed successfully",
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
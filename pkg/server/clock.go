@@ -0,0 +1,46 @@
+package server
+
+import "time"
+
+// Clock tells AuthHandler the time, so tests can freeze it to check expiry
+// logic
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the real time and the default Clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// IDGenerator creates the IDs AuthHandler gives users, sessions and
+// events, so tests can make them predictable
+type IDGenerator interface {
+	// NewID returns a unique ID carrying a type prefix such as ids.PrefixUser
+	NewID(prefix string) string
+}
+
+// ulidGenerator creates prefixed ULIDs and is the default IDGenerator
+type ulidGenerator struct{}
+
+func (ulidGenerator) NewID(prefix string) string {
+	return generateID(prefix)
+}
+
+// SetClock replaces the clock the server reads the time from. It must be
+// called before the server starts handling requests.
+//
+// Deprecated: pass WithClock to New instead.
+func (s *Server) SetClock(clock Clock) {
+	s.authHandler.clock = clock
+}
+
+// SetIDGenerator replaces how the server creates IDs. It must be called
+// before the server starts handling requests.
+//
+// Deprecated: pass WithIDGenerator to New instead.
+func (s *Server) SetIDGenerator(generator IDGenerator) {
+	s.authHandler.idGenerator = generator
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// versionConflictMessage is returned when a user update loses a race with
+// another update
+const versionConflictMessage = "The account was changed by another request, reload it and try again"
+
+// userETag is the entity tag of a user's profile. It changes whenever the
+// store bumps the user's version.
+func userETag(user *User) string {
+	return fmt.Sprintf(`"%s.%d"`, user.ID, user.Version)
+}
+
+// ifMatch reports whether the request's If-Match precondition holds for
+// user. Requests without If-Match always pass; weak tags never match
+// because If-Match uses strong comparison.
+func ifMatch(r *http.Request, user *User) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+
+	current := userETag(user)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == current {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch writes a 412 response carrying the current ETag and returns
+// false when the If-Match precondition fails
+func (h *AuthHandler) checkIfMatch(w http.ResponseWriter, r *http.Request, user *User) bool {
+	if ifMatch(r, user) {
+		return true
+	}
+
+	h.logger.Printf("[DEBUG] If-Match %s does not match %s", r.Header.Get("If-Match"), userETag(user))
+	w.Header().Set("ETag", userETag(user))
+	http.Error(w, localize(r, versionConflictMessage), http.StatusPreconditionFailed)
+	return false
+}
+
+// ifNoneMatch reports whether the request's If-None-Match header names
+// user's current ETag. It uses weak comparison, as RFC 9110 requires for
+// If-None-Match.
+func ifNoneMatch(r *http.Request, user *User) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	current := userETag(user)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == current {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotModified sets the validators for a read of user and, when the
+// client already holds the current version, writes 304 Not Modified and
+// returns true so the handler can skip building the body. Clients are
+// asked to revalidate on every use, since the response is only fresh as
+// long as the user is unchanged.
+func (h *AuthHandler) checkNotModified(w http.ResponseWriter, r *http.Request, user *User) bool {
+	w.Header().Set("ETag", userETag(user))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if !ifNoneMatch(r, user) {
+		return false
+	}
+
+	h.logger.Printf("[DEBUG] %s not modified for user: %s", r.URL.Path, user.Username)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// writeUserUpdateError writes the response for a failed user update. A
+// version conflict on a request that carried If-Match means its
+// precondition no longer holds, so it gets 412 rather than 409.
+func writeUserUpdateError(w http.ResponseWriter, r *http.Request, err error) {
+	status, message := storeErrorStatus(err)
+	if status == http.StatusConflict && r.Header.Get("If-Match") != "" {
+		status = http.StatusPreconditionFailed
+	}
+	http.Error(w, localize(r, message), status)
+}
@@ -0,0 +1,1403 @@
+package server
+
+import (
+	"auth-server/pkg/blobstore"
+	"auth-server/pkg/cryptoutil"
+	"auth-server/pkg/ipacl"
+	"auth-server/pkg/kerberos"
+	"auth-server/pkg/mailer"
+	"auth-server/pkg/randutil"
+	"auth-server/pkg/secrets"
+	"auth-server/pkg/siem"
+	"auth-server/pkg/sms"
+	"auth-server/pkg/stripe"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds server settings loaded from the environment
+type Config struct {
+	// Addr is where Run listens: a TCP host:port, unix:/path/to/socket, or
+	// systemd for a socket passed by systemd socket activation
+	// (systemd:name picks one by its FileDescriptorName)
+	Addr string
+	// SocketMode and SocketGroup set the permissions of a unix socket, so
+	// only a local reverse proxy can connect to it
+	SocketMode  os.FileMode
+	SocketGroup string
+
+	// HTTP2Cleartext serves HTTP/2 without TLS (h2c, with prior knowledge)
+	// alongside HTTP/1.1, for internal deployments behind a proxy or mesh
+	// that terminates TLS
+	HTTP2Cleartext bool
+	// HTTP2MaxConcurrentStreams caps the streams open on one HTTP/2
+	// connection, 0 for Go's default of 250
+	HTTP2MaxConcurrentStreams int
+	// MaxConnections caps the connections served at once; more wait to be
+	// accepted. 0 means no limit.
+	MaxConnections int
+	// KeepAlives turns HTTP keep-alives on. IdleTimeout closes idle
+	// keep-alive connections and TCPKeepAlive is the TCP keep-alive probe
+	// period, 0 for Go's default.
+	KeepAlives   bool
+	IdleTimeout  time.Duration
+	TCPKeepAlive time.Duration
+	// ReadHeaderTimeout bounds reading request headers and MaxHeaderBytes
+	// their size
+	ReadHeaderTimeout time.Duration
+	MaxHeaderBytes    int
+	// MTLSAddr is a second TCP address, served over TLS only to callers
+	// with a client certificate signed by a CA in MTLSClientCAFile, for
+	// internal services that cannot use bearer tokens. Off when empty.
+	MTLSAddr         string
+	MTLSCertFile     string
+	MTLSKeyFile      string
+	MTLSClientCAFile string
+	// MTLSServiceAccounts maps client certificate identities (a URI SAN
+	// such as a SPIFFE ID, a DNS SAN or the subject CN) to the service
+	// account whose scopes the caller gets
+	MTLSServiceAccounts map[string]CertificateAccount
+	// PublicURL is the externally visible base URL used in emailed links
+	PublicURL string
+	// BasePath is the path prefix the server is reached under behind a
+	// gateway, such as /auth, or empty at the root. It is the path of
+	// PublicURL unless BASE_PATH sets it. Requests may arrive with or
+	// without it; cookies and the frontend's links are scoped to it.
+	BasePath string
+	// HostedPages enables the server-rendered /login, /register,
+	// /reset-password and /device pages
+	HostedPages bool
+	// GraphQLEnabled serves a GraphQL facade over the API at /graphql.
+	// GraphQLMaxDepth and GraphQLMaxComplexity cap how deeply an
+	// operation may nest fields and how many it may select.
+	GraphQLEnabled       bool
+	GraphQLMaxDepth      int
+	GraphQLMaxComplexity int
+	// WebSocketOrigins are the browser origins, besides PublicURL's, whose
+	// pages may open the session status socket
+	WebSocketOrigins []string
+	// Branding customises the hosted pages
+	Branding Branding
+	// StaticDir serves the frontend from disk instead of the copy embedded
+	// in the binary, so edits show up without a rebuild
+	StaticDir string
+
+	// MasterKey is the root key per-user data encryption keys are derived from
+	MasterKey []byte
+	// PIIKey wraps the data keys that encrypt email addresses and phone
+	// numbers at rest; it is derived from MasterKey when unset.
+	// PIIKeyHex and PIIKeyFile give it hex-encoded, directly or in a file.
+	// PIIKeyWrapper replaces it with an external key service such as a KMS.
+	PIIKey        []byte
+	PIIKeyHex     string
+	PIIKeyFile    string
+	PIIKeyWrapper cryptoutil.KeyWrapper
+
+	// GenericRegisterResponse hides whether an email is already registered
+	// by answering duplicate-email registrations like successful ones
+	GenericRegisterResponse bool
+
+	// AdminBootstrapToken lets a signed-in user make themselves the first
+	// admin through POST /api/admin/bootstrap while there is none. It
+	// should be long and random, and can be removed once an admin exists.
+	AdminBootstrapToken string
+
+	// RolePermissions defines roles by the admin permissions they have,
+	// adding to or replacing the built-in support role
+	RolePermissions map[string][]string
+
+	// PolicyModelFile is a Casbin-style model for admin permission
+	// decisions, replacing the built-in role-based model
+	PolicyModelFile string
+
+	// PolicyFile holds policy rules applied on top of the built-in ones
+	// for the configured roles. Rules changed through the admin API are
+	// written back to it, and it is reread every PolicyReloadInterval
+	// when it changes.
+	PolicyFile           string
+	PolicyReloadInterval time.Duration
+
+	// AccessRulesFile holds attribute-based access rules, which refuse
+	// requests based on the user's attributes such as a verified email
+	// address or the account's age. It is kept and reread like PolicyFile.
+	AccessRulesFile string
+
+	// ProvisioningRulesFile holds the rules that set up, or refuse, the
+	// accounts created for users arriving from an SSO connection or proxy:
+	// their role and organization. It is kept and reread like PolicyFile.
+	ProvisioningRulesFile string
+
+	// EmailTemplatesDir holds overrides of the built-in email templates as
+	// <locale>/<name>.tmpl, such as en/password_reset.tmpl. Overrides made
+	// through the admin API are saved there.
+	EmailTemplatesDir string
+
+	// ACLAllow and ACLDeny are global network access rules applied at startup
+	ACLAllow []netip.Prefix
+	ACLDeny  []netip.Prefix
+
+	// TrustedProxies are the ranges whose Forwarded and X-Forwarded-For
+	// headers are believed when determining the client IP
+	TrustedProxies []netip.Prefix
+
+	// TrustedHeaderAuth signs in users an SSO proxy in front of the server,
+	// such as oauth2-proxy or Pomerium, names in the TrustedHeaderUser and
+	// TrustedHeaderEmail headers, creating accounts as needed. The headers
+	// are only believed from peers in TrustedHeaderProxies or on the unix
+	// socket. Accounts are linked to the proxy's user as an identity of
+	// TrustedHeaderProvider. The comma-separated groups in
+	// TrustedHeaderGroups are available to provisioning rules.
+	TrustedHeaderAuth     bool
+	TrustedHeaderProxies  []netip.Prefix
+	TrustedHeaderUser     string
+	TrustedHeaderEmail    string
+	TrustedHeaderGroups   string
+	TrustedHeaderProvider string
+
+	// KerberosKeytab is the keytab holding the keys of the service
+	// principal, such as HTTP/intranet.corp.example@CORP.EXAMPLE, that
+	// enables Kerberos sign-in through SPNEGO. Principals sign in to the
+	// account they are linked to as an identity, or those of
+	// KerberosUsernameRealms to the account with their name, for realms
+	// whose directory also manages the usernames here.
+	KerberosKeytab         string
+	KerberosUsernameRealms []string
+	// KerberosMaxSkew is how far the client's clock may be from ours
+	KerberosMaxSkew time.Duration
+
+	// SSOMaxSkew is how far the clock of an organization's identity
+	// provider may be from ours when checking its assertions and tokens
+	SSOMaxSkew time.Duration
+
+	// GeoIPDatabase is the path to a MaxMind .mmdb file; location-based
+	// login policy is disabled when empty
+	GeoIPDatabase string
+	// GeoAllowedCountries restricts logins to these ISO country codes
+	GeoAllowedCountries []string
+	// ImpossibleTravelSpeedKmh is the travel speed between consecutive
+	// logins above which the user is notified
+	ImpossibleTravelSpeedKmh float64
+
+	// CaptchaProvider selects the CAPTCHA service (recaptcha, hcaptcha,
+	// turnstile or bypass); CAPTCHA checks are disabled when empty
+	CaptchaProvider string
+	CaptchaSecret   string
+	// CaptchaLoginThreshold is the number of recent failed logins for an
+	// account or IP after which login requires a CAPTCHA
+	CaptchaLoginThreshold int
+
+	// RiskWeights scores each login risk signal (see risk.go) and
+	// RiskThreshold is the score at which a correct password also needs an
+	// emailed code; 0 turns the challenge off
+	RiskWeights   map[string]int
+	RiskThreshold int
+	// RiskVelocityLimit is how many login attempts an account or IP may
+	// make in an hour before the velocity signal fires
+	RiskVelocityLimit int
+	// RiskProviderTimeout bounds each call to a risk provider, and
+	// RiskProviderFailClosed denies requests when a provider fails rather
+	// than ignoring it
+	RiskProviderTimeout    time.Duration
+	RiskProviderFailClosed bool
+
+	// SignupVelocityLimits caps registrations per client IP and per device
+	// per hour and per day (see signupreview.go); limits left out are off
+	SignupVelocityLimits map[string]int
+	// SignupVelocityAction is what happens to a registration over a limit:
+	// it is held for review, or blocked
+	SignupVelocityAction string
+
+	// LoginBackoffThreshold is the number of recent failed logins for an
+	// account or IP after which each attempt is delayed, starting at
+	// LoginBackoffBase and doubling per failure up to LoginBackoffMax
+	LoginBackoffThreshold int
+	LoginBackoffBase      time.Duration
+	LoginBackoffMax       time.Duration
+	// IPBlockScore is the suspicion score at which an IP is blocked from
+	// logging in for IPBlockDuration. Each failed login from the IP in the
+	// last hour scores 1, and each additional account tried scores 2 more.
+	IPBlockScore    int
+	IPBlockDuration time.Duration
+
+	// PasswordHashConcurrency caps how many bcrypt hashes run at once.
+	// Logins beyond it wait up to PasswordHashQueueTimeout for a turn and
+	// are refused with 503 after that.
+	PasswordHashConcurrency  int
+	PasswordHashQueueTimeout time.Duration
+	// PasswordHasher replaces the bcrypt hasher, and with it peppers and
+	// the concurrency cap, for embedding applications
+	PasswordHasher Hasher
+
+	// UserStore replaces the in-memory user store, for embedding
+	// applications. The cache, PII encryption and search index are layered
+	// on top of it as on the built-in store.
+	UserStore UserStore
+	// SessionManager replaces the in-memory store of server-side sessions
+	SessionManager SessionManager
+	// Clock and IDGenerator replace the system clock and the ULID
+	// generator, as for simulations and tests
+	Clock       Clock
+	IDGenerator IDGenerator
+	// AuditLogOutput receives the audit log lines otherwise written to
+	// stderr
+	AuditLogOutput io.Writer
+	// Logger receives the [DEBUG] diagnostics otherwise written to
+	// stderr. LoadConfig runs before it can be set, so it still reports
+	// bad settings to stderr.
+	Logger *log.Logger
+	// UserCacheSize is how many users are kept in an in-process LRU cache
+	// in front of the user store, 0 to disable it. Cached users are
+	// dropped on every write and after UserCacheTTL, which bounds how stale
+	// a read can be when other instances share the store.
+	UserCacheSize int
+	UserCacheTTL  time.Duration
+
+	// AccessTokenTTL is how long personal access tokens last unless
+	// created with an expiry, which may be at most AccessTokenMaxTTL away
+	AccessTokenTTL    time.Duration
+	AccessTokenMaxTTL time.Duration
+
+	// StalePasswordAge is how old a password must be for the security
+	// overview and posture report to count it as stale
+	StalePasswordAge time.Duration
+	// DormantAccountAge is how long since the last sign-in, or since
+	// registration for users who never signed in, before the posture report
+	// flags an account as dormant
+	DormantAccountAge time.Duration
+	// DormancyNotify emails the owners of accounts once they are found
+	// dormant
+	DormancyNotify bool
+	// DormancyDeactivateAfter and DormancyDeleteAfter are how long an
+	// account may be inactive before the dormancy policy suspends it, and
+	// deletes it; zero leaves accounts alone
+	DormancyDeactivateAfter time.Duration
+	DormancyDeleteAfter     time.Duration
+
+	// MaintenanceFile is where the maintenance mode setting is saved so it
+	// survives restarts; it is kept in memory only when empty
+	MaintenanceFile string
+
+	// FeatureFlags overrides the built-in feature flags at startup, from
+	// FEATURE_FLAGS entries like "beta_endpoints=on", "registration_open=off"
+	// or "beta_endpoints=25%". Values are rollout percentages.
+	FeatureFlags map[string]int
+
+	// EmailBlockedDomainsFile is a file of disposable email domains, one per
+	// line, that may not be used for accounts; a built-in list is used when empty
+	EmailBlockedDomainsFile string
+	// EmailAllowedDomains, when set, restricts account emails to these domains
+	EmailAllowedDomains []string
+
+	// UsernameReservedFile is a file of reserved usernames and
+	// UsernameBlockedPatternsFile one of regular expressions usernames may
+	// not match, one per line; built-in lists are used when empty
+	UsernameReservedFile        string
+	UsernameBlockedPatternsFile string
+
+	// SessionTTL is how long a login session stays valid
+	SessionTTL time.Duration
+	// RememberMe lets logins ask for a long-lived cookie that signs the
+	// browser in again once its session ends, for RememberMeTTL after
+	// the password was entered
+	RememberMe    bool
+	RememberMeTTL time.Duration
+	// SessionCookieName names the session cookie, so several instances can
+	// share a domain
+	SessionCookieName string
+	// SessionKeys lists the key pairs that sign and encrypt session
+	// cookies, newest first (see parseCookieKeys). Random keys are used
+	// when empty; the session_secret secret takes precedence.
+	SessionKeys string
+	// SessionMode is SessionModeServer or SessionModeStateless. Stateless
+	// sessions let several replicas share users' sessions, and need the
+	// same MasterKey and SessionKeys on each and RedisURL for revocations
+	// to reach them all.
+	SessionMode string
+	// RedisURL is the Redis server stateless sessions share revocations
+	// through, e.g. redis://:password@redis:6379/0
+	RedisURL string
+	// PasswordResetTTL is how long an emailed password reset link works
+	PasswordResetTTL time.Duration
+	// MergeGracePeriod is how long an account merge can be undone
+	MergeGracePeriod time.Duration
+	// SuspensionAppealContact is where suspended users are told to appeal,
+	// such as an email address or URL
+	SuspensionAppealContact string
+	// SecurityNotifications says which security change notices are emailed
+	// to users, by notice name. All are on unless SECURITY_NOTIFICATIONS
+	// turns them off.
+	SecurityNotifications map[string]bool
+	// DeletedUserRetention is how long deleted accounts are kept, and can
+	// be restored, before they are purged
+	DeletedUserRetention time.Duration
+	// UsernameChangeCooldown is how long a user must wait between username
+	// changes
+	UsernameChangeCooldown time.Duration
+	// UsernameReservationPeriod is how long a username someone gave up
+	// stays reserved for them
+	UsernameReservationPeriod time.Duration
+	// MagicLinkTTL is how long an emailed sign-in link works
+	MagicLinkTTL time.Duration
+	// MagicLinkRateLimit is how many sign-in links may be requested per
+	// email and per client IP in 15 minutes
+	MagicLinkRateLimit int
+	// GCInterval is how often expired sessions and other stale state are purged
+	GCInterval time.Duration
+	// SLIWindow is the span the auth_sli_* metrics are computed over
+	SLIWindow time.Duration
+
+	// RequestTimeout is the deadline put on each request's context
+	RequestTimeout time.Duration
+	// EndpointTimeouts overrides RequestTimeout per route path template,
+	// e.g. "/api/login"; zero disables the deadline for that route
+	EndpointTimeouts map[string]time.Duration
+	// TermsVersion and PrivacyVersion are the current versions of the
+	// terms of service and privacy policy users must accept; acceptance is
+	// not tracked for a document without a version
+	TermsVersion   string
+	TermsURL       string
+	PrivacyVersion string
+	PrivacyURL     string
+
+	// StepUpPolicies sets the authentication strength a route requires,
+	// keyed by path template with an optional method prefix, e.g.
+	// "DELETE /api/admin/users/{id}". A key ending in "/*" covers every
+	// route below it.
+	StepUpPolicies map[string]StepUpPolicy
+
+	// QuotaDailyLimit and QuotaMonthlyLimit cap the requests each user, API
+	// client or anonymous IP may make to QuotaRoutes per UTC day and month;
+	// zero means unlimited
+	QuotaDailyLimit   int
+	QuotaMonthlyLimit int
+	// QuotaOverrides replaces the limits for particular callers, keyed by
+	// "user:<id>", "client:<id>" or "ip:<address>"
+	QuotaOverrides map[string]QuotaLimits
+	// Tiers are the limits of each account tier, which override
+	// QuotaDailyLimit, QuotaMonthlyLimit and, below its maximum of 50, the
+	// access token cap for users on it. Accounts are on DefaultTier until
+	// a subscription or an admin puts them on another.
+	Tiers       map[string]TierLimits
+	DefaultTier string
+	// QuotaRoutes are the metered path templates; "/*" at the end covers
+	// everything below a path
+	QuotaRoutes []string
+	// UsageAggregateInterval is how often the requests and bytes metered
+	// per API key and endpoint are added to the hourly usage records, which
+	// are kept for UsageRetention
+	UsageAggregateInterval time.Duration
+	UsageRetention         time.Duration
+	// IdempotencyTTL is how long responses to POSTs with an Idempotency-Key
+	// are kept for replay
+	IdempotencyTTL time.Duration
+
+	// TokenIssuer is the iss claim of tokens this server signs
+	TokenIssuer string
+	// ClientTokenTTL is how long client_credentials access tokens are valid
+	ClientTokenTTL time.Duration
+	// DeviceCodeTTL is how long a device has for its user to approve it,
+	// polling no more often than every DevicePollInterval
+	DeviceCodeTTL      time.Duration
+	DevicePollInterval time.Duration
+	// DeviceVerificationURL is the page devices send users to for entering
+	// their code, the hosted /device page unless a frontend provides one
+	DeviceVerificationURL string
+
+	// SigningKeyRotation is how often the token signing key is rotated
+	SigningKeyRotation time.Duration
+	// SigningKeyGracePeriod is how long a retired signing key stays in the
+	// JWKS; it should exceed the longest token lifetime plus JWKS cache time
+	SigningKeyGracePeriod time.Duration
+
+	// HookWebhookURL receives auth flow hooks as signed JSON POSTs; webhook
+	// hooks are disabled when empty
+	HookWebhookURL    string
+	HookWebhookSecret string
+	// HookWebhookEvents limits which hooks are sent; all are sent when empty
+	HookWebhookEvents  []string
+	HookWebhookTimeout time.Duration
+
+	// StripeSecretKey lets users be linked to new Stripe customers, and
+	// StripeWebhookSecret verifies the subscription events Stripe sends to
+	// /api/billing/stripe/webhook; StripeAPIURL replaces the Stripe API,
+	// as for testing. StripePriceTiers maps the price IDs subscriptions
+	// are for to the tier they pay for.
+	StripeSecretKey     string
+	StripeWebhookSecret string
+	StripeAPIURL        string
+	StripePriceTiers    map[string]string
+
+	// BlobStore chooses where uploaded files such as avatars are kept:
+	// "disk" under BlobDir, "s3" in BlobS3Bucket, or nowhere when empty,
+	// which disables uploads. BlobS3Endpoint replaces the AWS endpoint for
+	// S3-compatible services. Downloads go through signed URLs valid for
+	// BlobURLTTL, and unreferenced blobs older than BlobGCGrace are
+	// deleted.
+	BlobStore             string
+	BlobDir               string
+	BlobS3Bucket          string
+	BlobS3Region          string
+	BlobS3Endpoint        string
+	BlobS3Prefix          string
+	BlobS3AccessKeyID     string
+	BlobS3SecretAccessKey string
+	BlobURLTTL            time.Duration
+	BlobGCGrace           time.Duration
+
+	// AlertSlackWebhookURL and AlertWebhookURL receive admin alerts, such
+	// as an admin account being created, as a Slack incoming webhook and
+	// as JSON POSTs signed with AlertWebhookSecret; alerts are disabled
+	// when both are empty
+	AlertSlackWebhookURL string
+	AlertWebhookURL      string
+	AlertWebhookSecret   string
+	// AlertRoutes sends each alert type to the listed channels, "slack"
+	// and "webhook"; types without a route go to every channel
+	AlertRoutes map[string][]string
+	// AlertFailedLoginThreshold failed logins across all users within
+	// AlertFailedLoginWindow raise a failed_logins alert
+	AlertFailedLoginThreshold int
+	AlertFailedLoginWindow    time.Duration
+	// AlertCooldown is the least time between two failed_logins or two
+	// store_error alerts
+	AlertCooldown time.Duration
+
+	// KafkaBrokers and KafkaTopic configure the Kafka event sink, which is
+	// enabled when brokers are set
+	KafkaBrokers []string
+	KafkaTopic   string
+	// NATSURL and NATSSubjectPrefix configure the NATS event sink, which is
+	// enabled when the URL is set
+	NATSURL           string
+	NATSSubjectPrefix string
+
+	// SMTP settings for outgoing mail; mail is logged to stderr when
+	// SMTPAddr is empty
+	SMTPAddr     string
+	SMTPFrom     string
+	SMTPUsername string
+	SMTPPassword string
+	// SMTPTimeout bounds delivery of a single message
+	SMTPTimeout time.Duration
+	// Mailer replaces the SMTP and stderr mailers, for embedding
+	// applications
+	Mailer mailer.Mailer
+
+	// OutboxFile is where emails and webhooks are kept until delivered, so
+	// they survive restarts
+	OutboxFile string
+	// OutboxInterval is how often messages due a retry are sent
+	OutboxInterval time.Duration
+	// OutboxMaxAttempts is how many times a message is tried before it is
+	// dead-lettered
+	OutboxMaxAttempts int
+	// OutboxDeadLetterRetention is how long dead letters are kept for
+	// admins to redeliver
+	OutboxDeadLetterRetention time.Duration
+
+	// AuditSinkURL is the SIEM collector audit events are shipped to, such
+	// as udp://siem:514, tcp://siem:601 or tls://siem:6514. Events are only
+	// kept in memory when empty.
+	AuditSinkURL string
+	// AuditSinkFormat is how events are written: syslog (RFC 5424
+	// structured data), cef or json
+	AuditSinkFormat string
+	// AuditSinkBuffer is how many events wait for a slow collector before
+	// the oldest are dropped
+	AuditSinkBuffer int
+
+	// SMSProvider selects how text messages are sent: "twilio", or
+	// messages are logged to stderr when empty
+	SMSProvider string
+	// Twilio credentials; SMSProviderURL points at a Twilio-compatible API
+	TwilioAccountSID string
+	TwilioAuthToken  string
+	SMSFrom          string
+	SMSProviderURL   string
+	// SMSSender replaces SMSProvider with another provider, for embedding
+	// applications
+	SMSSender sms.Sender
+	// SMSTimeout bounds delivery of a single message
+	SMSTimeout time.Duration
+	// SMSRateLimit is how many codes may be texted to one number per hour
+	SMSRateLimit int
+	// SMSDailyCap limits the total number of texts per UTC day to bound
+	// provider costs
+	SMSDailyCap int
+
+	// SecretsBackend selects where the session secret, token signing key
+	// and master key are loaded from: "vault", or the built-in defaults
+	// when empty. See secrets.go for the secret names.
+	SecretsBackend string
+	// SecretSource replaces SecretsBackend with another store, such as a
+	// cloud secret manager, for embedding applications
+	SecretSource secrets.Source
+	// Vault settings. VaultTokenFile is read on every request so a token
+	// renewed by a Vault agent is picked up.
+	VaultAddr       string
+	VaultToken      string
+	VaultTokenFile  string
+	VaultKVMount    string
+	VaultSecretPath string
+	// VaultTransitKey names a transit key that wraps the PII data keys in
+	// place of PIIKey
+	VaultTransitKey   string
+	VaultTransitMount string
+	// SecretsRefreshInterval is how often secrets are fetched again to pick
+	// up rotations
+	SecretsRefreshInterval time.Duration
+}
+
+// LoadConfig reads configuration from environment variables, falling back to
+// development defaults when they are unset
+func LoadConfig() Config {
+	cfg := Config{}
+
+	cfg.Addr = os.Getenv("LISTEN_ADDR")
+	if cfg.Addr == "" {
+		cfg.Addr = ":8080"
+	}
+	cfg.SocketMode = 0o660
+	if value := os.Getenv("LISTEN_SOCKET_MODE"); value != "" {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode > 0o777 {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Invalid LISTEN_SOCKET_MODE %q, using default\n", value)
+		} else {
+			cfg.SocketMode = os.FileMode(mode)
+		}
+	}
+	cfg.SocketGroup = os.Getenv("LISTEN_SOCKET_GROUP")
+	cfg.HTTP2Cleartext = os.Getenv("HTTP2_CLEARTEXT") == "true"
+	cfg.HTTP2MaxConcurrentStreams = parsePositiveInt("HTTP2_MAX_CONCURRENT_STREAMS", 0)
+	cfg.MaxConnections = parsePositiveInt("MAX_CONNECTIONS", 0)
+	cfg.KeepAlives = os.Getenv("HTTP_KEEP_ALIVES") != "false"
+	cfg.IdleTimeout = parseDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute)
+	cfg.TCPKeepAlive = parseDuration("TCP_KEEP_ALIVE", 0)
+	cfg.ReadHeaderTimeout = parseDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second)
+	cfg.MaxHeaderBytes = parsePositiveInt("HTTP_MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)
+	cfg.MTLSAddr = os.Getenv("MTLS_ADDR")
+	cfg.MTLSCertFile = os.Getenv("MTLS_CERT_FILE")
+	cfg.MTLSKeyFile = os.Getenv("MTLS_KEY_FILE")
+	cfg.MTLSClientCAFile = os.Getenv("MTLS_CLIENT_CA_FILE")
+	cfg.MTLSServiceAccounts = parseServiceAccounts(os.Getenv("MTLS_SERVICE_ACCOUNTS"))
+	cfg.PublicURL = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if cfg.PublicURL == "" {
+		switch {
+		case !isTCPAddr(cfg.Addr):
+			// Behind a local proxy, which should set PUBLIC_URL
+			cfg.PublicURL = "http://localhost"
+		case strings.HasPrefix(cfg.Addr, ":"):
+			cfg.PublicURL = "http://localhost" + cfg.Addr
+		default:
+			cfg.PublicURL = "http://" + cfg.Addr
+		}
+	}
+	cfg.BasePath = os.Getenv("BASE_PATH")
+	if cfg.BasePath == "" {
+		if u, err := url.Parse(cfg.PublicURL); err == nil {
+			cfg.BasePath = u.Path
+		}
+	}
+	cfg.BasePath = strings.TrimSuffix(cfg.BasePath, "/")
+	if cfg.BasePath != "" && !strings.HasPrefix(cfg.BasePath, "/") {
+		cfg.BasePath = "/" + cfg.BasePath
+	}
+	cfg.StaticDir = os.Getenv("STATIC_DIR")
+
+	cfg.HostedPages = os.Getenv("HOSTED_PAGES") == "true"
+	cfg.GraphQLEnabled = os.Getenv("GRAPHQL_ENABLED") == "true"
+	cfg.GraphQLMaxDepth = parsePositiveInt("GRAPHQL_MAX_DEPTH", 5)
+	cfg.GraphQLMaxComplexity = parsePositiveInt("GRAPHQL_MAX_COMPLEXITY", 50)
+	cfg.WebSocketOrigins = splitList(os.Getenv("WEBSOCKET_ORIGINS"))
+	cfg.Branding = loadBranding()
+
+	if value := os.Getenv("ENCRYPTION_MASTER_KEY"); value != "" {
+		key, err := hex.DecodeString(value)
+		if err != nil || len(key) < 32 {
+			fmt.Fprintf(os.Stderr, "[DEBUG] ENCRYPTION_MASTER_KEY must be at least 32 hex-encoded bytes, ignoring it\n")
+		} else {
+			cfg.MasterKey = key
+		}
+	}
+
+	if cfg.MasterKey == nil {
+		// Without a configured key, ciphertexts will not survive a restart
+		fmt.Fprintf(os.Stderr, "[DEBUG] No ENCRYPTION_MASTER_KEY set, generating an ephemeral master key\n")
+		cfg.MasterKey, _ = randutil.Bytes(32)
+	}
+
+	cfg.PIIKeyHex = os.Getenv("PII_ENCRYPTION_KEY")
+	cfg.PIIKeyFile = os.Getenv("PII_ENCRYPTION_KEY_FILE")
+
+	cfg.GenericRegisterResponse = os.Getenv("GENERIC_REGISTER_RESPONSE") == "true"
+	cfg.AdminBootstrapToken = os.Getenv("ADMIN_BOOTSTRAP_TOKEN")
+	cfg.RolePermissions = parseRolePermissions(os.Getenv("ROLE_PERMISSIONS"))
+	cfg.PolicyModelFile = os.Getenv("POLICY_MODEL_FILE")
+	cfg.PolicyFile = os.Getenv("POLICY_FILE")
+	cfg.PolicyReloadInterval = parseDuration("POLICY_RELOAD_INTERVAL", 30*time.Second)
+	cfg.AccessRulesFile = os.Getenv("ACCESS_RULES_FILE")
+	cfg.ProvisioningRulesFile = os.Getenv("PROVISIONING_RULES_FILE")
+	cfg.EmailTemplatesDir = os.Getenv("EMAIL_TEMPLATES_DIR")
+	cfg.ACLAllow = parseCIDRList("ACL_ALLOW")
+	cfg.ACLDeny = parseCIDRList("ACL_DENY")
+	cfg.TrustedProxies = parseCIDRList("TRUSTED_PROXIES")
+	cfg.TrustedHeaderAuth = os.Getenv("TRUSTED_HEADER_AUTH") == "true"
+	cfg.TrustedHeaderProxies = parseCIDRList("TRUSTED_HEADER_PROXIES")
+	cfg.TrustedHeaderUser = os.Getenv("TRUSTED_HEADER_USER")
+	if cfg.TrustedHeaderUser == "" {
+		cfg.TrustedHeaderUser = "X-Auth-Request-User"
+	}
+	cfg.TrustedHeaderEmail = os.Getenv("TRUSTED_HEADER_EMAIL")
+	if cfg.TrustedHeaderEmail == "" {
+		cfg.TrustedHeaderEmail = "X-Auth-Request-Email"
+	}
+	cfg.TrustedHeaderGroups = os.Getenv("TRUSTED_HEADER_GROUPS")
+	if cfg.TrustedHeaderGroups == "" {
+		cfg.TrustedHeaderGroups = "X-Auth-Request-Groups"
+	}
+	cfg.TrustedHeaderProvider = os.Getenv("TRUSTED_HEADER_PROVIDER")
+	if cfg.TrustedHeaderProvider == "" {
+		cfg.TrustedHeaderProvider = "sso-proxy"
+	}
+	cfg.KerberosKeytab = os.Getenv("KERBEROS_KEYTAB")
+	cfg.KerberosUsernameRealms = splitList(os.Getenv("KERBEROS_USERNAME_REALMS"))
+	cfg.KerberosMaxSkew = parseDuration("KERBEROS_MAX_SKEW", kerberos.DefaultMaxSkew)
+	cfg.SSOMaxSkew = parseDuration("SSO_MAX_SKEW", 2*time.Minute)
+
+	cfg.GeoIPDatabase = os.Getenv("GEOIP_DATABASE")
+	cfg.GeoAllowedCountries = splitList(os.Getenv("GEOIP_ALLOWED_COUNTRIES"))
+	cfg.ImpossibleTravelSpeedKmh = 1000
+	if value := os.Getenv("IMPOSSIBLE_TRAVEL_SPEED_KMH"); value != "" {
+		speed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Invalid IMPOSSIBLE_TRAVEL_SPEED_KMH %q, using default\n", value)
+		} else {
+			cfg.ImpossibleTravelSpeedKmh = speed
+		}
+	}
+
+	cfg.CaptchaProvider = os.Getenv("CAPTCHA_PROVIDER")
+	cfg.CaptchaSecret = os.Getenv("CAPTCHA_SECRET")
+	cfg.CaptchaLoginThreshold = 3
+	if value := os.Getenv("CAPTCHA_LOGIN_THRESHOLD"); value != "" {
+		threshold, err := strconv.Atoi(value)
+		if err != nil || threshold < 0 {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Invalid CAPTCHA_LOGIN_THRESHOLD %q, using default\n", value)
+		} else {
+			cfg.CaptchaLoginThreshold = threshold
+		}
+	}
+
+	cfg.RiskWeights = parseRiskRules(os.Getenv("RISK_RULES"))
+	cfg.RiskThreshold = 50
+	if value := os.Getenv("RISK_THRESHOLD"); value != "" {
+		threshold, err := strconv.Atoi(value)
+		if err != nil || threshold < 0 {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Invalid RISK_THRESHOLD %q, using default\n", value)
+		} else {
+			cfg.RiskThreshold = threshold
+		}
+	}
+	cfg.RiskVelocityLimit = parsePositiveInt("RISK_VELOCITY_LIMIT", 10)
+	cfg.RiskProviderTimeout = parseDuration("RISK_PROVIDER_TIMEOUT", 2*time.Second)
+	cfg.RiskProviderFailClosed = os.Getenv("RISK_PROVIDER_FAIL_CLOSED") == "true"
+
+	cfg.SignupVelocityLimits = parseSignupVelocityLimits(os.Getenv("SIGNUP_VELOCITY_LIMITS"))
+	switch action := os.Getenv("SIGNUP_VELOCITY_ACTION"); action {
+	case "", SignupActionReview:
+		cfg.SignupVelocityAction = SignupActionReview
+	case SignupActionBlock:
+		cfg.SignupVelocityAction = SignupActionBlock
+	default:
+		fmt.Fprintf(os.Stderr, "[DEBUG] Invalid SIGNUP_VELOCITY_ACTION %q, holding sign-ups for review\n", action)
+		cfg.SignupVelocityAction = SignupActionReview
+	}
+
+	cfg.LoginBackoffThreshold = parsePositiveInt("LOGIN_BACKOFF_THRESHOLD", 5)
+	cfg.LoginBackoffBase = parseDuration("LOGIN_BACKOFF_BASE", time.Second)
+	cfg.LoginBackoffMax = parseDuration("LOGIN_BACKOFF_MAX", 30*time.Second)
+	cfg.IPBlockScore = parsePositiveInt("IP_BLOCK_SCORE", 30)
+	cfg.IPBlockDuration = parseDuration("IP_BLOCK_DURATION", 30*time.Minute)
+	cfg.PasswordHashConcurrency = parsePositiveInt("PASSWORD_HASH_CONCURRENCY", runtime.NumCPU())
+	cfg.PasswordHashQueueTimeout = parseDuration("PASSWORD_HASH_QUEUE_TIMEOUT", 2*time.Second)
+	cfg.UserCacheSize = 1000
+	if value := os.Getenv("USER_CACHE_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Invalid USER_CACHE_SIZE %q, using default\n", value)
+		} else {
+			cfg.UserCacheSize = size
+		}
+	}
+	cfg.UserCacheTTL = parseDuration("USER_CACHE_TTL", 30*time.Second)
+	cfg.AccessTokenTTL = parseDuration("ACCESS_TOKEN_TTL", 30*24*time.Hour)
+	cfg.AccessTokenMaxTTL = parseDuration("ACCESS_TOKEN_MAX_TTL", 365*24*time.Hour)
+	cfg.StalePasswordAge = parseDuration("STALE_PASSWORD_AGE", 180*24*time.Hour)
+	cfg.DormantAccountAge = parseDuration("DORMANT_ACCOUNT_AGE", 90*24*time.Hour)
+	cfg.DormancyNotify = os.Getenv("DORMANCY_NOTIFY") == "true"
+	cfg.DormancyDeactivateAfter = parseDuration("DORMANCY_DEACTIVATE_AFTER", 0)
+	cfg.DormancyDeleteAfter = parseDuration("DORMANCY_DELETE_AFTER", 0)
+	cfg.MaintenanceFile = os.Getenv("MAINTENANCE_FILE")
+	if cfg.MaintenanceFile == "" {
+		cfg.MaintenanceFile = "maintenance.json"
+	}
+	cfg.FeatureFlags = parseFeatureFlags(os.Getenv("FEATURE_FLAGS"))
+
+	cfg.EmailBlockedDomainsFile = os.Getenv("EMAIL_BLOCKED_DOMAINS_FILE")
+	cfg.EmailAllowedDomains = splitList(os.Getenv("EMAIL_ALLOWED_DOMAINS"))
+	cfg.UsernameReservedFile = os.Getenv("USERNAME_RESERVED_FILE")
+	cfg.UsernameBlockedPatternsFile = os.Getenv("USERNAME_BLOCKED_PATTERNS_FILE")
+
+	cfg.SessionTTL = parseDuration("SESSION_TTL", 24*time.Hour)
+	cfg.RememberMe = os.Getenv("REMEMBER_ME") == "true"
+	cfg.RememberMeTTL = parseDuration("REMEMBER_ME_TTL", 30*24*time.Hour)
+	cfg.SessionCookieName = os.Getenv("SESSION_COOKIE_NAME")
+	cfg.SessionKeys = os.Getenv("SESSION_KEYS")
+	if cfg.SessionCookieName == "" {
+		cfg.SessionCookieName = defaultSessionCookieName
+	}
+	switch mode := os.Getenv("SESSION_MODE"); mode {
+	case "", SessionModeServer:
+		cfg.SessionMode = SessionModeServer
+	case SessionModeStateless:
+		cfg.SessionMode = SessionModeStateless
+	default:
+		fmt.Fprintf(os.Stderr, "[DEBUG] Invalid SESSION_MODE %q, keeping sessions on the server\n", mode)
+		cfg.SessionMode = SessionModeServer
+	}
+	cfg.RedisURL = os.Getenv("REDIS_URL")
+	cfg.PasswordResetTTL = parseDuration("PASSWORD_RESET_TTL", time.Hour)
+	cfg.MergeGracePeriod = parseDuration("MERGE_GRACE_PERIOD", 30*24*time.Hour)
+	cfg.SuspensionAppealContact = os.Getenv("SUSPENSION_APPEAL_CONTACT")
+	cfg.SecurityNotifications = parseSecurityNotifications(os.Getenv("SECURITY_NOTIFICATIONS"))
+	cfg.DeletedUserRetention = parseDuration("DELETED_USER_RETENTION", 30*24*time.Hour)
+	cfg.UsernameChangeCooldown = parseDuration("USERNAME_CHANGE_COOLDOWN", 30*24*time.Hour)
+	cfg.UsernameReservationPeriod = parseDuration("USERNAME_RESERVATION_PERIOD", 90*24*time.Hour)
+	cfg.MagicLinkTTL = parseDuration("MAGIC_LINK_TTL", 15*time.Minute)
+	cfg.MagicLinkRateLimit = parsePositiveInt("MAGIC_LINK_RATE_LIMIT", 5)
+	cfg.GCInterval = parseDuration("GC_INTERVAL", 10*time.Minute)
+	cfg.SLIWindow = parseDuration("SLI_WINDOW", 5*time.Minute)
+
+	cfg.RequestTimeout = parseDuration("REQUEST_TIMEOUT", 30*time.Second)
+	cfg.EndpointTimeouts = parseEndpointTimeouts(os.Getenv("ENDPOINT_TIMEOUTS"))
+	cfg.TermsVersion = os.Getenv("TERMS_VERSION")
+	cfg.TermsURL = os.Getenv("TERMS_URL")
+	cfg.PrivacyVersion = os.Getenv("PRIVACY_VERSION")
+	cfg.PrivacyURL = os.Getenv("PRIVACY_URL")
+
+	cfg.StepUpPolicies = parseStepUpPolicies(os.Getenv("STEP_UP_POLICIES"))
+
+	cfg.QuotaDailyLimit = parsePositiveInt("QUOTA_DAILY_LIMIT", 0)
+	cfg.QuotaMonthlyLimit = parsePositiveInt("QUOTA_MONTHLY_LIMIT", 0)
+	cfg.QuotaOverrides = parseQuotaOverrides(os.Getenv("QUOTA_OVERRIDES"))
+	cfg.Tiers = parseTiers(os.Getenv("TIERS"))
+	cfg.DefaultTier = os.Getenv("DEFAULT_TIER")
+	if cfg.DefaultTier == "" {
+		cfg.DefaultTier = "free"
+	}
+	cfg.QuotaRoutes = splitList(os.Getenv("QUOTA_ROUTES"))
+	if len(cfg.QuotaRoutes) == 0 {
+		cfg.QuotaRoutes = defaultQuotaRoutes
+	}
+	cfg.UsageAggregateInterval = parseDuration("USAGE_AGGREGATE_INTERVAL", time.Hour)
+	cfg.UsageRetention = parseDuration("USAGE_RETENTION", 90*24*time.Hour)
+	cfg.IdempotencyTTL = parseDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+
+	cfg.TokenIssuer = os.Getenv("TOKEN_ISSUER")
+	if cfg.TokenIssuer == "" {
+		cfg.TokenIssuer = "auth-server"
+	}
+	cfg.ClientTokenTTL = parseDuration("CLIENT_TOKEN_TTL", time.Hour)
+	cfg.DeviceCodeTTL = parseDuration("DEVICE_CODE_TTL", 10*time.Minute)
+	cfg.DevicePollInterval = parseDuration("DEVICE_POLL_INTERVAL", 5*time.Second)
+	cfg.DeviceVerificationURL = os.Getenv("DEVICE_VERIFICATION_URL")
+	cfg.SigningKeyRotation = parseDuration("SIGNING_KEY_ROTATION", 24*time.Hour)
+	cfg.SigningKeyGracePeriod = parseDuration("SIGNING_KEY_GRACE_PERIOD", 2*cfg.ClientTokenTTL)
+
+	cfg.HookWebhookURL = os.Getenv("HOOK_WEBHOOK_URL")
+	cfg.HookWebhookSecret = os.Getenv("HOOK_WEBHOOK_SECRET")
+	cfg.HookWebhookEvents = splitList(os.Getenv("HOOK_WEBHOOK_EVENTS"))
+	cfg.HookWebhookTimeout = parseDuration("HOOK_WEBHOOK_TIMEOUT", 5*time.Second)
+
+	cfg.StripeSecretKey = os.Getenv("STRIPE_SECRET_KEY")
+	cfg.StripeWebhookSecret = os.Getenv("STRIPE_WEBHOOK_SECRET")
+	cfg.StripeAPIURL = os.Getenv("STRIPE_API_URL")
+	cfg.StripePriceTiers = parseStripePriceTiers(os.Getenv("STRIPE_PRICE_TIERS"))
+
+	cfg.BlobStore = os.Getenv("BLOB_STORE")
+	cfg.BlobDir = os.Getenv("BLOB_DIR")
+	if cfg.BlobDir == "" {
+		cfg.BlobDir = "blobs"
+	}
+	cfg.BlobS3Bucket = os.Getenv("BLOB_S3_BUCKET")
+	cfg.BlobS3Region = os.Getenv("BLOB_S3_REGION")
+	if cfg.BlobS3Region == "" {
+		cfg.BlobS3Region = "us-east-1"
+	}
+	cfg.BlobS3Endpoint = os.Getenv("BLOB_S3_ENDPOINT")
+	cfg.BlobS3Prefix = os.Getenv("BLOB_S3_PREFIX")
+	cfg.BlobS3AccessKeyID = os.Getenv("BLOB_S3_ACCESS_KEY_ID")
+	cfg.BlobS3SecretAccessKey = os.Getenv("BLOB_S3_SECRET_ACCESS_KEY")
+	cfg.BlobURLTTL = parseDuration("BLOB_URL_TTL", 15*time.Minute)
+	cfg.BlobGCGrace = parseDuration("BLOB_GC_GRACE", time.Hour)
+
+	cfg.AlertSlackWebhookURL = os.Getenv("ALERT_SLACK_WEBHOOK_URL")
+	cfg.AlertWebhookURL = os.Getenv("ALERT_WEBHOOK_URL")
+	cfg.AlertWebhookSecret = os.Getenv("ALERT_WEBHOOK_SECRET")
+	cfg.AlertRoutes = parseAlertRoutes(os.Getenv("ALERT_ROUTES"))
+	cfg.AlertFailedLoginThreshold = parsePositiveInt("ALERT_FAILED_LOGIN_THRESHOLD", 50)
+	cfg.AlertFailedLoginWindow = parseDuration("ALERT_FAILED_LOGIN_WINDOW", 5*time.Minute)
+	cfg.AlertCooldown = parseDuration("ALERT_COOLDOWN", 15*time.Minute)
+
+	cfg.KafkaBrokers = splitList(os.Getenv("KAFKA_BROKERS"))
+	cfg.KafkaTopic = os.Getenv("KAFKA_TOPIC")
+	if cfg.KafkaTopic == "" {
+		cfg.KafkaTopic = "auth-events"
+	}
+	cfg.NATSURL = os.Getenv("NATS_URL")
+	cfg.NATSSubjectPrefix = os.Getenv("NATS_SUBJECT_PREFIX")
+	if cfg.NATSSubjectPrefix == "" {
+		cfg.NATSSubjectPrefix = "auth.events"
+	}
+
+	cfg.SMTPAddr = os.Getenv("SMTP_ADDR")
+	cfg.SMTPFrom = os.Getenv("SMTP_FROM")
+	if cfg.SMTPFrom == "" {
+		cfg.SMTPFrom = "no-reply@localhost"
+	}
+	cfg.SMTPUsername = os.Getenv("SMTP_USERNAME")
+	cfg.SMTPPassword = os.Getenv("SMTP_PASSWORD")
+	cfg.SMTPTimeout = parseDuration("SMTP_TIMEOUT", 30*time.Second)
+
+	cfg.OutboxFile = os.Getenv("OUTBOX_FILE")
+	if cfg.OutboxFile == "" {
+		cfg.OutboxFile = "outbox.json"
+	}
+	cfg.OutboxInterval = parseDuration("OUTBOX_INTERVAL", 10*time.Second)
+	cfg.OutboxMaxAttempts = parsePositiveInt("OUTBOX_MAX_ATTEMPTS", 8)
+	cfg.OutboxDeadLetterRetention = parseDuration("OUTBOX_DEAD_LETTER_RETENTION", 7*24*time.Hour)
+
+	cfg.AuditSinkURL = os.Getenv("AUDIT_SINK_URL")
+	cfg.AuditSinkFormat = strings.ToLower(os.Getenv("AUDIT_SINK_FORMAT"))
+	if cfg.AuditSinkFormat == "" {
+		cfg.AuditSinkFormat = siem.FormatSyslog
+	}
+	cfg.AuditSinkBuffer = parsePositiveInt("AUDIT_SINK_BUFFER", 1000)
+
+	cfg.SMSProvider = os.Getenv("SMS_PROVIDER")
+	cfg.TwilioAccountSID = os.Getenv("TWILIO_ACCOUNT_SID")
+	cfg.TwilioAuthToken = os.Getenv("TWILIO_AUTH_TOKEN")
+	cfg.SMSFrom = os.Getenv("SMS_FROM")
+	cfg.SMSProviderURL = os.Getenv("SMS_PROVIDER_URL")
+	cfg.SMSTimeout = parseDuration("SMS_TIMEOUT", 10*time.Second)
+	cfg.SMSRateLimit = parsePositiveInt("SMS_RATE_LIMIT", 5)
+	cfg.SMSDailyCap = parsePositiveInt("SMS_DAILY_CAP", 1000)
+
+	cfg.SecretsBackend = os.Getenv("SECRETS_BACKEND")
+	cfg.VaultAddr = os.Getenv("VAULT_ADDR")
+	cfg.VaultToken = os.Getenv("VAULT_TOKEN")
+	cfg.VaultTokenFile = os.Getenv("VAULT_TOKEN_FILE")
+	cfg.VaultKVMount = os.Getenv("VAULT_KV_MOUNT")
+	cfg.VaultSecretPath = os.Getenv("VAULT_SECRET_PATH")
+	if cfg.VaultSecretPath == "" {
+		cfg.VaultSecretPath = "auth-server"
+	}
+	cfg.VaultTransitKey = os.Getenv("VAULT_TRANSIT_KEY")
+	cfg.VaultTransitMount = os.Getenv("VAULT_TRANSIT_MOUNT")
+	cfg.SecretsRefreshInterval = parseDuration("SECRETS_REFRESH_INTERVAL", 15*time.Minute)
+
+	return cfg
+}
+
+// parseFeatureFlags parses FEATURE_FLAGS entries of the form name=on,
+// name=off or name=N%, skipping invalid ones
+func parseFeatureFlags(value string) map[string]int {
+	flags := make(map[string]int)
+	for _, item := range splitList(value) {
+		name, setting, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid FEATURE_FLAGS entry %q\n", item)
+			continue
+		}
+		switch setting = strings.ToLower(strings.TrimSpace(setting)); setting {
+		case "on", "true":
+			flags[name] = 100
+		case "off", "false":
+			flags[name] = 0
+		default:
+			rollout, err := strconv.Atoi(strings.TrimSuffix(setting, "%"))
+			if err != nil || rollout < 0 || rollout > 100 {
+				fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid FEATURE_FLAGS entry %q\n", item)
+				continue
+			}
+			flags[name] = rollout
+		}
+	}
+	return flags
+}
+
+// parseSecurityNotifications parses SECURITY_NOTIFICATIONS entries of the
+// form notice=on or notice=off, such as "api_key_created=off". Notices not
+// listed stay on; invalid entries are skipped.
+func parseSecurityNotifications(value string) map[string]bool {
+	notices := make(map[string]bool, len(securityNotices))
+	for _, notice := range securityNotices {
+		notices[notice] = true
+	}
+	for _, item := range splitList(value) {
+		name, setting, _ := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if _, known := notices[name]; !known {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid SECURITY_NOTIFICATIONS entry %q\n", item)
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(setting)) {
+		case "on", "true":
+			notices[name] = true
+		case "off", "false":
+			notices[name] = false
+		default:
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid SECURITY_NOTIFICATIONS entry %q\n", item)
+		}
+	}
+	return notices
+}
+
+// splitList splits a comma-separated value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseCIDRList parses a comma-separated list of CIDR ranges from an
+// environment variable, skipping invalid entries
+func parseCIDRList(name string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, item := range splitList(os.Getenv(name)) {
+		prefix, err := ipacl.ParseCIDR(item)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid %s entry %q: %v\n", name, item, err)
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// parseDuration reads a positive duration such as "30m" from an environment
+// variable, returning fallback when it is unset or invalid
+func parseDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Invalid %s %q, using default\n", name, value)
+		return fallback
+	}
+	return duration
+}
+
+// parsePositiveInt reads a positive integer from an environment variable,
+// returning fallback when it is unset or invalid
+func parsePositiveInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Invalid %s %q, using default\n", name, value)
+		return fallback
+	}
+	return n
+}
+
+// parseEndpointTimeouts parses ENDPOINT_TIMEOUTS, a comma-separated list of
+// path=duration pairs such as "/api/login=5s,/api/hash=2m", on top of the
+// defaults. The audit event stream has no deadline by default since it is
+// long-lived.
+func parseEndpointTimeouts(value string) map[string]time.Duration {
+	timeouts := map[string]time.Duration{
+		"/api/admin/events/stream": 0,
+	}
+	for _, item := range splitList(value) {
+		path, raw, ok := strings.Cut(item, "=")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid ENDPOINT_TIMEOUTS entry %q\n", item)
+			continue
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil || duration < 0 {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid ENDPOINT_TIMEOUTS entry %q\n", item)
+			continue
+		}
+		timeouts[strings.TrimSpace(path)] = duration
+	}
+	return timeouts
+}
+
+// parseTiers parses TIERS, a comma-separated list of tier=limits entries
+// with limits separated by "+", such as
+// "free=tokens:5+daily:100,pro=tokens:50+daily:10000+monthly:200000".
+// The limits are "tokens", "daily" and "monthly"; one left out keeps the
+// server-wide limit.
+func parseTiers(value string) map[string]TierLimits {
+	tiers := make(map[string]TierLimits)
+	for _, item := range splitList(value) {
+		tier, list, _ := strings.Cut(item, "=")
+		tier = strings.TrimSpace(tier)
+		var limits TierLimits
+		valid := tier != ""
+		for _, limit := range strings.Split(list, "+") {
+			name, raw, _ := strings.Cut(strings.TrimSpace(limit), ":")
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				valid = false
+				break
+			}
+			switch name {
+			case "tokens":
+				limits.AccessTokens = n
+			case "daily":
+				limits.DailyQuota = n
+			case "monthly":
+				limits.MonthlyQuota = n
+			default:
+				valid = false
+			}
+		}
+		if !valid {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid TIERS entry %q\n", item)
+			continue
+		}
+		tiers[tier] = limits
+	}
+	return tiers
+}
+
+// parseStripePriceTiers parses STRIPE_PRICE_TIERS, a comma-separated list
+// of price=tier entries such as "price_1Pro=pro,price_1ProYearly=pro"
+func parseStripePriceTiers(value string) map[string]string {
+	prices := make(map[string]string)
+	for _, item := range splitList(value) {
+		price, tier, _ := strings.Cut(item, "=")
+		price, tier = strings.TrimSpace(price), strings.TrimSpace(tier)
+		if price == "" || tier == "" {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid STRIPE_PRICE_TIERS entry %q\n", item)
+			continue
+		}
+		prices[price] = tier
+	}
+	return prices
+}
+
+// newBlobStoreFromConfig returns the blob store BLOB_STORE chooses, or nil
+// when it is unset. Signed disk URLs point to /api/blobs and are signed
+// with a key derived from the master key.
+func newBlobStoreFromConfig(cfg Config) (blobstore.Store, error) {
+	switch cfg.BlobStore {
+	case "":
+		return nil, nil
+	case "disk":
+		key, err := cryptoutil.DeriveKey(cfg.MasterKey, "blob-urls")
+		if err != nil {
+			return nil, err
+		}
+		return blobstore.NewDisk(cfg.BlobDir, cfg.PublicURL+"/api/blobs", key)
+	case "s3":
+		if cfg.BlobS3Bucket == "" {
+			return nil, errors.New("BLOB_S3_BUCKET is required for the s3 blob store")
+		}
+		return &blobstore.S3{
+			Bucket:          cfg.BlobS3Bucket,
+			Region:          cfg.BlobS3Region,
+			Prefix:          cfg.BlobS3Prefix,
+			AccessKeyID:     cfg.BlobS3AccessKeyID,
+			SecretAccessKey: cfg.BlobS3SecretAccessKey,
+			Endpoint:        cfg.BlobS3Endpoint,
+			Client:          &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown BLOB_STORE %q", cfg.BlobStore)
+}
+
+// newStripeClientFromConfig returns nil unless a Stripe secret key is set
+func newStripeClientFromConfig(cfg Config) *stripe.Client {
+	if cfg.StripeSecretKey == "" {
+		return nil
+	}
+	return &stripe.Client{SecretKey: cfg.StripeSecretKey, BaseURL: cfg.StripeAPIURL, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// parseAlertRoutes parses ALERT_ROUTES, a comma-separated list of
+// alert=channels entries with channels separated by "+", such as
+// "admin_created=slack+webhook,store_error=webhook". An entry with no
+// channels, like "failed_logins=", turns the alert off.
+func parseAlertRoutes(value string) map[string][]string {
+	routes := make(map[string][]string)
+	for _, item := range splitList(value) {
+		alert, list, ok := strings.Cut(item, "=")
+		alert = strings.TrimSpace(alert)
+		channels := []string{}
+		for _, channel := range strings.Split(list, "+") {
+			if channel = strings.TrimSpace(channel); channel != "" {
+				channels = append(channels, channel)
+			}
+		}
+		if !ok || !slices.Contains(alertTypes, alert) ||
+			slices.ContainsFunc(channels, func(channel string) bool { return channel != AlertChannelSlack && channel != AlertChannelWebhook }) {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid ALERT_ROUTES entry %q\n", item)
+			continue
+		}
+		routes[alert] = channels
+	}
+	return routes
+}
+
+// parseStepUpPolicies parses STEP_UP_POLICIES, a comma-separated list of
+// route=requirements pairs such as
+// "/api/admin/*=2fa,DELETE /api/admin/users/{id}=2fa+reauth:5m". The
+// requirements are "password", "2fa" and "reauth:<max age>", joined with
+// "+".
+func parseStepUpPolicies(value string) map[string]StepUpPolicy {
+	policies := make(map[string]StepUpPolicy)
+	for _, item := range splitList(value) {
+		route, raw, ok := strings.Cut(item, "=")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid STEP_UP_POLICIES entry %q\n", item)
+			continue
+		}
+
+		var policy StepUpPolicy
+		valid := true
+		for _, requirement := range strings.Split(raw, "+") {
+			requirement = strings.TrimSpace(requirement)
+			switch {
+			case requirement == "password":
+			case requirement == "2fa":
+				policy.MultiFactor = true
+			case strings.HasPrefix(requirement, "reauth:"):
+				duration, err := time.ParseDuration(strings.TrimPrefix(requirement, "reauth:"))
+				if err != nil || duration <= 0 {
+					valid = false
+				}
+				policy.MaxAge = duration
+			default:
+				valid = false
+			}
+		}
+		if !valid {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid STEP_UP_POLICIES entry %q\n", item)
+			continue
+		}
+		policies[strings.Join(strings.Fields(route), " ")] = policy
+	}
+	return policies
+}
+
+// parseQuotaOverrides parses QUOTA_OVERRIDES, a comma-separated list of
+// caller=daily/monthly pairs such as "client:reports=10000/200000". A zero
+// limit is unlimited.
+func parseQuotaOverrides(value string) map[string]QuotaLimits {
+	overrides := make(map[string]QuotaLimits)
+	for _, item := range splitList(value) {
+		caller, raw, _ := strings.Cut(item, "=")
+		daily, monthly, _ := strings.Cut(raw, "/")
+		limits, err := parseQuotaLimits(daily, monthly)
+		if err != nil || !strings.Contains(caller, ":") {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid QUOTA_OVERRIDES entry %q\n", item)
+			continue
+		}
+		overrides[strings.TrimSpace(caller)] = limits
+	}
+	return overrides
+}
+
+func parseQuotaLimits(daily, monthly string) (QuotaLimits, error) {
+	dailyLimit, err := strconv.Atoi(strings.TrimSpace(daily))
+	if err != nil || dailyLimit < 0 {
+		return QuotaLimits{}, fmt.Errorf("invalid daily limit %q", daily)
+	}
+	monthlyLimit, err := strconv.Atoi(strings.TrimSpace(monthly))
+	if err != nil || monthlyLimit < 0 {
+		return QuotaLimits{}, fmt.Errorf("invalid monthly limit %q", monthly)
+	}
+	return QuotaLimits{Daily: dailyLimit, Monthly: monthlyLimit}, nil
+}
+
+// parseSignupVelocityLimits parses SIGNUP_VELOCITY_LIMITS, a comma-separated
+// list of limit=count pairs such as "ip_hour=5,device_day=3". Limits left
+// out or set to 0 are off.
+func parseSignupVelocityLimits(value string) map[string]int {
+	limits := make(map[string]int)
+	for _, item := range splitList(value) {
+		name, raw, _ := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		limit, err := strconv.Atoi(strings.TrimSpace(raw))
+		if !slices.Contains(signupVelocityLimits, name) || err != nil || limit < 0 {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid SIGNUP_VELOCITY_LIMITS entry %q, limits are %s\n", item, strings.Join(signupVelocityLimits, ", "))
+			continue
+		}
+		limits[name] = limit
+	}
+	return limits
+}
+
+// parseRiskRules parses RISK_RULES, a comma-separated list of signal=weight
+// pairs such as "new_ip=20,velocity=50", on top of defaultRiskWeights. A
+// weight of 0 turns a signal off.
+func parseRiskRules(value string) map[string]int {
+	weights := make(map[string]int, len(defaultRiskWeights))
+	for signal, weight := range defaultRiskWeights {
+		weights[signal] = weight
+	}
+	for _, item := range splitList(value) {
+		signal, raw, _ := strings.Cut(item, "=")
+		signal = strings.TrimSpace(signal)
+		weight, err := strconv.Atoi(strings.TrimSpace(raw))
+		if _, known := defaultRiskWeights[signal]; !known || err != nil || weight < 0 {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid RISK_RULES entry %q, signals are %s\n", item, strings.Join(riskSignals(), ", "))
+			continue
+		}
+		weights[signal] = weight
+	}
+	return weights
+}
+
+// parseServiceAccounts parses MTLS_SERVICE_ACCOUNTS, a comma-separated list
+// of identity=account:scopes entries with the scopes joined by "+", such as
+// "spiffe://corp/ns/billing/sa/api=billing:users:read". The identity is cut
+// at its last "=", so it may contain one.
+func parseServiceAccounts(value string) map[string]CertificateAccount {
+	accounts := make(map[string]CertificateAccount)
+	for _, item := range splitList(value) {
+		i := strings.LastIndex(item, "=")
+		if i <= 0 {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid MTLS_SERVICE_ACCOUNTS entry %q\n", item)
+			continue
+		}
+		name, scopes, _ := strings.Cut(item[i+1:], ":")
+		account := CertificateAccount{Name: strings.TrimSpace(name)}
+		for _, scope := range strings.Split(scopes, "+") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				account.Scopes = append(account.Scopes, scope)
+			}
+		}
+		if account.Name == "" || len(account.Scopes) == 0 || slices.ContainsFunc(account.Scopes, func(scope string) bool { return !validScope(scope) }) {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid MTLS_SERVICE_ACCOUNTS entry %q\n", item)
+			continue
+		}
+		accounts[strings.TrimSpace(item[:i])] = account
+	}
+	return accounts
+}
+
+// parseRolePermissions parses a comma-separated list of role=permissions
+// entries, with permissions separated by "+", e.g.
+// "auditor=audit:read+users:read". The admin and user roles cannot be
+// redefined.
+func parseRolePermissions(value string) map[string][]string {
+	roles := make(map[string][]string)
+	for _, item := range splitList(value) {
+		role, list, _ := strings.Cut(item, "=")
+		role = strings.TrimSpace(role)
+		var granted []string
+		for _, permission := range strings.Split(list, "+") {
+			if permission = strings.TrimSpace(permission); permission != "" {
+				granted = append(granted, permission)
+			}
+		}
+		if role == "" || role == RoleAdmin || role == RoleUser || len(granted) == 0 ||
+			slices.ContainsFunc(granted, func(permission string) bool { return !slices.Contains(permissions, permission) }) {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid ROLE_PERMISSIONS entry %q\n", item)
+			continue
+		}
+		roles[role] = granted
+	}
+	return roles
+}
+
+// newMailerFromConfig returns an SMTP mailer when SMTP is configured and a
+// mailer that logs to stderr otherwise
+func newMailerFromConfig(cfg Config) mailer.Mailer {
+	if cfg.Mailer != nil {
+		return cfg.Mailer
+	}
+	if cfg.SMTPAddr == "" {
+		return &mailer.LogMailer{Out: os.Stderr}
+	}
+	return &mailer.SMTPMailer{
+		Addr:     cfg.SMTPAddr,
+		From:     cfg.SMTPFrom,
+		Username: cfg.SMTPUsername,
+		Password: cfg.SMTPPassword,
+	}
+}
+
+// newSMSSenderFromConfig returns the configured SMS provider, or a sender
+// that logs to stderr when none is configured
+func newSMSSenderFromConfig(cfg Config) sms.Sender {
+	if cfg.SMSSender != nil {
+		return cfg.SMSSender
+	}
+	switch cfg.SMSProvider {
+	case "":
+		return &sms.LogSender{Out: os.Stderr}
+	case "twilio":
+		return &sms.TwilioSender{
+			AccountSID: cfg.TwilioAccountSID,
+			AuthToken:  cfg.TwilioAuthToken,
+			From:       cfg.SMSFrom,
+			BaseURL:    cfg.SMSProviderURL,
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "[DEBUG] Unknown SMS_PROVIDER %q, logging messages instead\n", cfg.SMSProvider)
+		return &sms.LogSender{Out: os.Stderr}
+	}
+}
+
+// vaultFromConfig returns the Vault connection settings
+func vaultFromConfig(cfg Config) secrets.Vault {
+	return secrets.Vault{Addr: cfg.VaultAddr, Token: cfg.VaultToken, TokenFile: cfg.VaultTokenFile}
+}
+
+// newSecretSourceFromConfig returns the configured secrets backend, or nil
+// when secrets come from the built-in defaults
+func newSecretSourceFromConfig(cfg Config) (secrets.Source, error) {
+	if cfg.SecretSource != nil {
+		return cfg.SecretSource, nil
+	}
+	switch cfg.SecretsBackend {
+	case "":
+		return nil, nil
+	case "vault":
+		if cfg.VaultAddr == "" {
+			return nil, errors.New("SECRETS_BACKEND=vault requires VAULT_ADDR")
+		}
+		return &secrets.VaultKV{Vault: vaultFromConfig(cfg), Mount: cfg.VaultKVMount, Path: cfg.VaultSecretPath}, nil
+	default:
+		return nil, fmt.Errorf("unknown SECRETS_BACKEND %q", cfg.SecretsBackend)
+	}
+}
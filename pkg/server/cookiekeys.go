@@ -0,0 +1,123 @@
+package server
+
+import (
+	"auth-server/pkg/randutil"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// Session cookies are authenticated with HMAC-SHA256 and encrypted with
+// AES-256, so keys must be at least this long
+const (
+	cookieHashKeyLength  = 32
+	cookieBlockKeyLength = 32
+)
+
+// CookieKeyPair authenticates and encrypts session cookies
+type CookieKeyPair struct {
+	HashKey  []byte
+	BlockKey []byte
+}
+
+// equal reports whether p and other hold the same keys
+func (p CookieKeyPair) equal(other CookieKeyPair) bool {
+	return bytes.Equal(p.HashKey, other.HashKey) && bytes.Equal(p.BlockKey, other.BlockKey)
+}
+
+// parseCookieKeys parses session cookie key pairs as given in SESSION_KEYS
+// or the session_secret secret: a hex hash key and a hex block key joined
+// by a colon, pairs separated by commas, newest first. New cookies use the
+// first pair and the rest only decode cookies from before a rotation. It
+// fails on any key that is too short rather than weaken the cookies.
+func parseCookieKeys(value string) ([]CookieKeyPair, error) {
+	var keys []CookieKeyPair
+	for _, entry := range splitList(value) {
+		hashHex, blockHex, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, errors.New("session keys must be hash:block pairs")
+		}
+		hashKey, err := hex.DecodeString(strings.TrimSpace(hashHex))
+		if err != nil || len(hashKey) < cookieHashKeyLength {
+			return nil, fmt.Errorf("session hash keys must be at least %d hex-encoded bytes", cookieHashKeyLength)
+		}
+		blockKey, err := hex.DecodeString(strings.TrimSpace(blockHex))
+		if err != nil || len(blockKey) != cookieBlockKeyLength {
+			return nil, fmt.Errorf("session block keys must be %d hex-encoded bytes", cookieBlockKeyLength)
+		}
+		keys = append(keys, CookieKeyPair{HashKey: hashKey, BlockKey: blockKey})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no session keys given")
+	}
+	return keys, nil
+}
+
+// cookieKeysFromConfig returns the key pairs in Config.SessionKeys, or a
+// random pair when none are set
+func cookieKeysFromConfig(cfg Config) ([]CookieKeyPair, error) {
+	if cfg.SessionKeys != "" {
+		keys, err := parseCookieKeys(cfg.SessionKeys)
+		if err != nil {
+			return nil, fmt.Errorf("SESSION_KEYS: %w", err)
+		}
+		return keys, nil
+	}
+
+	// Without configured keys, session cookies will not survive a restart
+	cfg.Logger.Printf("[DEBUG] No SESSION_KEYS set, generating ephemeral session keys")
+	hashKey, err := randutil.Bytes(cookieHashKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	blockKey, err := randutil.Bytes(cookieBlockKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	return []CookieKeyPair{{HashKey: hashKey, BlockKey: blockKey}}, nil
+}
+
+// newCookieStore creates a session cookie store that signs and encrypts
+// with keys, whose cookies are sent only to paths under basePath and are
+// out of reach of scripts
+func newCookieStore(basePath string, keys []CookieKeyPair) *sessions.CookieStore {
+	keyPairs := make([][]byte, 0, 2*len(keys))
+	for _, key := range keys {
+		keyPairs = append(keyPairs, key.HashKey, key.BlockKey)
+	}
+	store := sessions.NewCookieStore(keyPairs...)
+	store.Options.Path = cookiePath(basePath)
+	store.Options.HttpOnly = true
+	return store
+}
+
+// cookiePath is the cookie Path attribute covering basePath
+func cookiePath(basePath string) string {
+	if basePath == "" {
+		return "/"
+	}
+	return basePath
+}
+
+// rotateCookieKeys protects new session cookies with keys while still
+// accepting cookies made with the previous current pair
+func (h *AuthHandler) rotateCookieKeys(keys []CookieKeyPair) {
+	h.cookieMutex.Lock()
+	defer h.cookieMutex.Unlock()
+
+	previous := h.cookieKeys[0]
+	rotated := append([]CookieKeyPair(nil), keys...)
+	known := false
+	for _, key := range rotated {
+		known = known || key.equal(previous)
+	}
+	if !known {
+		rotated = append(rotated, previous)
+	}
+	h.cookies = newCookieStore(h.config.BasePath, rotated)
+	h.cookieKeys = rotated
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"auth-server/pkg/cryptoutil"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// HashRequest represents a hash or HMAC request with a JSON body
+type HashRequest struct {
+	Algorithm string `json:"algorithm"`
+	Input     string `json:"input"`
+}
+
+// EncryptRequest represents a request to encrypt text with the user's data key
+type EncryptRequest struct {
+	Plaintext string `json:"plaintext"`
+}
+
+// DecryptRequest represents a request to decrypt a base64 ciphertext
+type DecryptRequest struct {
+	Ciphertext string `json:"ciphertext"`
+}
+
+// defaultHashAlgorithm is used when a request does not name an algorithm
+const defaultHashAlgorithm = "sha256"
+
+// HashHandler hashes either a JSON {"algorithm", "input"} body or, for any
+// other content type, the raw request body streamed with ?algorithm=
+func (s *Server) HashHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Hash request received")
+
+	algorithm, input, err := readHashInput(w, r)
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	digest, n, err := cryptoutil.HashReader(algorithm, input)
+	if err != nil {
+		s.logger.Printf("[DEBUG] Hashing failed: %v", err)
+		writeHashError(w, err)
+		return
+	}
+
+	writeDigest(w, "Input hashed successfully", algorithm, digest, n)
+	s.logger.Printf("[DEBUG] Hashed %d bytes with %s", n, algorithm)
+}
+
+// HMACHandler computes an HMAC keyed with the session user's API secret,
+// accepting the same body formats as hashHandler
+func (s *Server) HMACHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] HMAC request received")
+
+	user := contextUser(r)
+
+	algorithm, input, err := readHashInput(w, r)
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	mac, n, err := cryptoutil.HMACReader(algorithm, user.APISecret, input)
+	if err != nil {
+		s.logger.Printf("[DEBUG] HMAC failed: %v", err)
+		writeHashError(w, err)
+		return
+	}
+
+	writeDigest(w, "HMAC computed successfully", algorithm, mac, n)
+	s.logger.Printf("[DEBUG] HMAC of %d bytes with %s for user: %s", n, algorithm, user.Username)
+}
+
+// readHashInput returns the algorithm and a reader over the data to hash.
+// JSON bodies are decoded; anything else is streamed as-is.
+func readHashInput(w http.ResponseWriter, r *http.Request) (string, io.Reader, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		algorithm := r.URL.Query().Get("algorithm")
+		if algorithm == "" {
+			algorithm = defaultHashAlgorithm
+		}
+		return algorithm, r.Body, nil
+	}
+
+	var req HashRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		return "", nil, err
+	}
+	if req.Algorithm == "" {
+		req.Algorithm = defaultHashAlgorithm
+	}
+	return req.Algorithm, strings.NewReader(req.Input), nil
+}
+
+// writeHashError maps a cryptoutil error to an HTTP error response
+func writeHashError(w http.ResponseWriter, err error) {
+	if errors.Is(err, cryptoutil.ErrUnknownAlgorithm) {
+		message := fmt.Sprintf("Unknown algorithm, supported algorithms: %s", strings.Join(cryptoutil.HashAlgorithms(), ", "))
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "Failed to read input", http.StatusBadRequest)
+}
+
+// writeDigest writes a successful hash or HMAC response
+func writeDigest(w http.ResponseWriter, message, algorithm string, digest []byte, n int64) {
+	response := Response{
+		Success: true,
+		Message: message,
+		Data: map[string]interface{}{
+			"algorithm": strings.ToLower(algorithm),
+			"digest":    hex.EncodeToString(digest),
+			"bytes":     n,
+		},
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// EncryptHandler encrypts text with AES-256-GCM under the session user's data key
+func (s *Server) EncryptHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Encrypt request received")
+
+	user := contextUser(r)
+
+	var req EncryptRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if req.Plaintext == "" {
+		s.logger.Printf("[DEBUG] Empty plaintext provided")
+		http.Error(w, "Plaintext is required", http.StatusBadRequest)
+		return
+	}
+
+	key, err := s.userDataKey(user)
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to derive data key: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	ciphertext, err := cryptoutil.Encrypt(key, []byte(req.Plaintext), []byte(user.ID))
+	if err != nil {
+		s.logger.Printf("[DEBUG] Encryption failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := Response{
+		Success: true,
+		Message: "Text encrypted successfully",
+		Data:    map[string]string{"ciphertext": base64.StdEncoding.EncodeToString(ciphertext)},
+	}
+
+	json.NewEncoder(w).Encode(response)
+	s.logger.Printf("[DEBUG] Encryption successful for user: %s", user.Username)
+}
+
+// DecryptHandler decrypts a ciphertext produced by encryptHandler for the same user
+func (s *Server) DecryptHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Decrypt request received")
+
+	user := contextUser(r)
+
+	var req DecryptRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(req.Ciphertext)
+	if err != nil || len(ciphertext) == 0 {
+		s.logger.Printf("[DEBUG] Ciphertext is not valid base64")
+		http.Error(w, "Ciphertext must be non-empty base64", http.StatusBadRequest)
+		return
+	}
+
+	key, err := s.userDataKey(user)
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to derive data key: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	plaintext, err := cryptoutil.Decrypt(key, ciphertext, []byte(user.ID))
+	if err != nil {
+		s.logger.Printf("[DEBUG] Decryption failed for user %s: %v", user.Username, err)
+		if errors.Is(err, cryptoutil.ErrUnsupportedVersion) {
+			http.Error(w, "Unsupported ciphertext version", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Invalid ciphertext", http.StatusBadRequest)
+		return
+	}
+
+	response := Response{
+		Success: true,
+		Message: "Text decrypted successfully",
+		Data:    map[string]string{"plaintext": string(plaintext)},
+	}
+
+	json.NewEncoder(w).Encode(response)
+	s.logger.Printf("[DEBUG] Decryption successful for user: %s", user.Username)
+}
+
+// userDataKey derives the user's data encryption key from the master key.
+// The user ID is also bound as additional data, so a ciphertext cannot be
+// replayed against another account.
+func (s *Server) userDataKey(user *User) ([]byte, error) {
+	return cryptoutil.DeriveKey(s.config.MasterKey, "user-data-key:"+user.ID)
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// securityOverviewWindow is the period the security overview counts
+// failed logins over
+const securityOverviewWindow = 24 * time.Hour
+
+// securityOverviewEvents is how many recent suspicious events the security
+// overview includes
+const securityOverviewEvents = 20
+
+// suspiciousAuditEvents are the audit event types the security overview
+// reports as suspicious
+var suspiciousAuditEvents = map[string]bool{
+	AuditLoginBlocked:         true,
+	AuditImpossibleTravel:     true,
+	AuditMagicLinkOtherDevice: true,
+	AuditRecoveryCodeUsed:     true,
+	AuditIPBlocked:            true,
+}
+
+// SecurityOverview summarizes the security posture of the user base
+type SecurityOverview struct {
+	GeneratedAt time.Time `json:"generatedAt"`
+	// FailedLogins counts failed logins in the last 24 hours still held by
+	// the audit log
+	FailedLogins int `json:"failedLogins24h"`
+	// LockedAccounts are the usernames whose logins are currently delayed
+	// after repeated failures
+	LockedAccounts []string `json:"lockedAccounts"`
+	BlockedIPs     int      `json:"blockedIps"`
+	Users          int      `json:"users"`
+	// UsersWithoutTwoFactor lists accounts with no second factor
+	UsersWithoutTwoFactor []string `json:"usersWithoutTwoFactor"`
+	// StalePasswords lists accounts whose password is older than
+	// Config.StalePasswordAge
+	StalePasswords   []string     `json:"stalePasswords"`
+	ActiveSessions   int          `json:"activeSessions"`
+	SuspiciousEvents []AuditEvent `json:"suspiciousEvents"`
+}
+
+// SecurityOverviewHandler gathers the figures for the admin security
+// dashboard in one response
+func (s *Server) SecurityOverviewHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Security overview request received")
+
+	if _, ok := s.authHandler.requireAdmin(w, r); !ok {
+		return
+	}
+
+	users, err := s.authHandler.users.List(r.Context())
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to list users: %v", err)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	now := s.authHandler.clock.Now()
+	activeSessions, err := s.authHandler.sessions.Count(r.Context(), now)
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to count sessions: %v", err)
+		writeStoreError(w, r, err)
+		return
+	}
+	blocks, _ := s.authHandler.bruteForce.snapshot(now)
+	overview := SecurityOverview{
+		GeneratedAt:           now,
+		LockedAccounts:        s.authHandler.loginFailures.Over("user:", s.config.LoginBackoffThreshold),
+		BlockedIPs:            len(blocks),
+		Users:                 len(users),
+		UsersWithoutTwoFactor: []string{},
+		StalePasswords:        []string{},
+		ActiveSessions:        activeSessions,
+		SuspiciousEvents:      []AuditEvent{},
+	}
+	if overview.LockedAccounts == nil {
+		overview.LockedAccounts = []string{}
+	}
+
+	for _, user := range users {
+		if !user.HasTwoFactor() {
+			overview.UsersWithoutTwoFactor = append(overview.UsersWithoutTwoFactor, user.Username)
+		}
+		if user.PasswordExpired(s.config.StalePasswordAge, now) {
+			overview.StalePasswords = append(overview.StalePasswords, user.Username)
+		}
+	}
+
+	sort.Strings(overview.UsersWithoutTwoFactor)
+	sort.Strings(overview.StalePasswords)
+
+	for _, event := range s.audit.Recent(0) {
+		if now.Sub(event.Time) > securityOverviewWindow {
+			continue
+		}
+		if event.Type == AuditLoginFailed {
+			overview.FailedLogins++
+		}
+		if suspiciousAuditEvents[event.Type] && len(overview.SuspiciousEvents) < securityOverviewEvents {
+			overview.SuspiciousEvents = append(overview.SuspiciousEvents, event)
+		}
+	}
+
+	response := Response{
+		Success: true,
+		Message: "Security overview retrieved successfully",
+		Data:    overview,
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// maxJSONBodySize bounds JSON request bodies
+const maxJSONBodySize = 1 << 20
+
+// bodyError describes why a request body was rejected. The message is a
+// translatable format for args.
+type bodyError struct {
+	status  int
+	message string
+	args    []interface{}
+}
+
+func (e *bodyError) Error() string {
+	return fmt.Sprintf(e.message, e.args...)
+}
+
+// decodeJSON decodes a JSON request body into v. The request must be sent
+// as application/json, the body must fit in maxJSONBodySize and hold a
+// single object, and fields that v does not have are rejected. Errors are
+// *bodyError and say where the body went wrong; report them with
+// bodyErrorStatus or writeBodyError.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return &bodyError{status: http.StatusUnsupportedMediaType, message: "Content-Type must be application/json"}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJSONBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return &bodyError{status: http.StatusRequestEntityTooLarge, message: "Request body must not be larger than %d bytes", args: []interface{}{maxJSONBodySize}}
+		}
+		return &bodyError{status: http.StatusBadRequest, message: "Invalid request body"}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return jsonBodyError(body, err)
+	}
+	if decoder.More() {
+		line, column := jsonPosition(body, decoder.InputOffset())
+		return &bodyError{status: http.StatusBadRequest, message: "Unexpected data after the JSON object at line %d, column %d", args: []interface{}{line, column}}
+	}
+	return nil
+}
+
+// jsonBodyError turns a decoding error into a bodyError that names the
+// position or field at fault
+func jsonBodyError(body []byte, err error) *bodyError {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.Is(err, io.EOF):
+		return &bodyError{status: http.StatusBadRequest, message: "Request body is empty"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		line, column := jsonPosition(body, int64(len(body)))
+		return &bodyError{status: http.StatusBadRequest, message: "Request body ends unexpectedly at line %d, column %d", args: []interface{}{line, column}}
+	case errors.As(err, &syntaxErr):
+		line, column := jsonPosition(body, syntaxErr.Offset-1)
+		return &bodyError{status: http.StatusBadRequest, message: "Invalid JSON at line %d, column %d", args: []interface{}{line, column}}
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return &bodyError{status: http.StatusBadRequest, message: "Request body must be a JSON %s", args: []interface{}{jsonKind(typeErr.Type)}}
+		}
+		return &bodyError{status: http.StatusBadRequest, message: "Field %q must be a JSON %s, not %s", args: []interface{}{typeErr.Field, jsonKind(typeErr.Type), typeErr.Value}}
+	}
+
+	// DisallowUnknownFields has no error type of its own
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return &bodyError{status: http.StatusBadRequest, message: "Unknown field %s", args: []interface{}{field}}
+	}
+	return &bodyError{status: http.StatusBadRequest, message: "Invalid request body"}
+}
+
+// jsonKind names the JSON type that decodes into t
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Pointer:
+		return jsonKind(t.Elem())
+	default:
+		return "number"
+	}
+}
+
+// jsonPosition returns the 1-based line and column of the byte at offset
+func jsonPosition(body []byte, offset int64) (line, column int) {
+	offset = max(0, min(offset, int64(len(body))))
+	before := body[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// bodyErrorStatus returns the status and localized message for an error
+// from decodeJSON
+func bodyErrorStatus(r *http.Request, err error) (int, string) {
+	var bodyErr *bodyError
+	if !errors.As(err, &bodyErr) {
+		return http.StatusBadRequest, localize(r, "Invalid request body")
+	}
+	return bodyErr.status, localize(r, bodyErr.message, bodyErr.args...)
+}
+
+// writeBodyError reports an error from decodeJSON as plain text
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	status, message := bodyErrorStatus(r, err)
+	http.Error(w, message, status)
+}
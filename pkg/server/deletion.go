@@ -0,0 +1,295 @@
+package server
+
+import (
+	"auth-server/pkg/events"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errAccountDeleted = errors.New("account has been deleted")
+	errNotDeleted     = errors.New("account has not been deleted")
+	errRetentionOver  = errors.New("retention period has passed")
+)
+
+// DeleteAccountRequest confirms the deletion of the session user's account
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// AdminDeleteUserRequest is the optional body of an admin deletion
+type AdminDeleteUserRequest struct {
+	Reason string `json:"reason"`
+}
+
+// DeletedUser describes a deleted account that has not been purged yet
+type DeletedUser struct {
+	User     User            `json:"user"`
+	Deletion AccountDeletion `json:"deletion"`
+	PurgeAt  time.Time       `json:"purgeAt"`
+}
+
+// deleteAccount marks user deleted and signs them out everywhere
+func (h *AuthHandler) deleteAccount(ctx context.Context, user *User, by, reason string) error {
+	if user.Deletion != nil {
+		return errAccountDeleted
+	}
+
+	now := h.clock.Now()
+	user.Deletion = &AccountDeletion{At: now, By: by, Reason: reason}
+	user.UpdatedAt = now
+	if err := h.users.Update(ctx, user); err != nil {
+		user.Deletion = nil
+		return err
+	}
+
+	if _, err := h.revokeUserSessions(ctx, user.ID); err != nil {
+		h.logger.Printf("[DEBUG] Failed to revoke sessions of deleted account %s: %v", user.ID, err)
+	}
+	h.publishEvent(events.TypeUserDeleted, user.ID, map[string]string{"username": user.Username})
+	return nil
+}
+
+// restoreAccount undoes the deletion of user within the retention period
+func (h *AuthHandler) restoreAccount(ctx context.Context, user *User) error {
+	if user.Deletion == nil {
+		return errNotDeleted
+	}
+	now := h.clock.Now()
+	if !now.Before(user.Deletion.At.Add(h.config.DeletedUserRetention)) {
+		return errRetentionOver
+	}
+
+	deletion := user.Deletion
+	user.Deletion = nil
+	user.UpdatedAt = now
+	if err := h.users.Update(ctx, user); err != nil {
+		user.Deletion = deletion
+		return err
+	}
+	h.publishEvent(events.TypeUserRestored, user.ID, map[string]string{"username": user.Username})
+	return nil
+}
+
+// purgeDeletedUsers removes the accounts whose retention period has passed
+// and returns how many it removed
+func (h *AuthHandler) purgeDeletedUsers(now time.Time) int {
+	ctx := context.Background()
+	users, err := h.users.List(ctx)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to list users to purge: %v", err)
+		return 0
+	}
+
+	purged := 0
+	for _, user := range users {
+		if user.Deletion == nil || now.Before(user.Deletion.At.Add(h.config.DeletedUserRetention)) {
+			continue
+		}
+		if err := h.users.Delete(ctx, user.ID); err != nil {
+			h.logger.Printf("[DEBUG] Failed to purge deleted account %s: %v", user.ID, err)
+			continue
+		}
+		h.audit.Record(AuditEvent{
+			Type:    AuditAccountPurged,
+			UserID:  user.ID,
+			Details: map[string]string{"deletedAt": user.Deletion.At.Format(time.RFC3339)},
+		})
+		purged++
+	}
+	return purged
+}
+
+// writeDeletionError writes the response for an error from deleteAccount
+// or restoreAccount
+func writeDeletionError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errAccountDeleted):
+		http.Error(w, localize(r, "The account has already been deleted"), http.StatusConflict)
+	case errors.Is(err, errNotDeleted):
+		http.Error(w, localize(r, "The account has not been deleted"), http.StatusConflict)
+	case errors.Is(err, errRetentionOver):
+		http.Error(w, localize(r, "The account can no longer be restored"), http.StatusConflict)
+	case errors.Is(err, ErrUserNotFound):
+		http.Error(w, localize(r, "User not found"), http.StatusNotFound)
+	default:
+		writeUserUpdateError(w, r, err)
+	}
+}
+
+// AccountDeleteHandler deletes the session user's account after checking
+// their password, when they have one. The account can be restored by an
+// admin until it is purged.
+func (h *AuthHandler) AccountDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Account deletion request received")
+
+	user := contextUser(r)
+
+	var req DeleteAccountRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(w, r, &req); err != nil {
+			h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+			writeBodyError(w, r, err)
+			return
+		}
+	}
+
+	if user.Password != "" {
+		if err := h.hasher.Compare(r.Context(), user.Password, req.Password); err != nil {
+			if h.passwordUnavailable(w, r, err) {
+				return
+			}
+			h.logger.Printf("[DEBUG] Invalid password for account deletion: %s", user.Username)
+			http.Error(w, localize(r, "Invalid current password"), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if err := h.deleteAccount(r.Context(), user, user.ID, ""); err != nil {
+		h.logger.Printf("[DEBUG] Failed to delete account %s: %v", user.Username, err)
+		writeDeletionError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:   AuditAccountDeleted,
+		UserID: user.ID,
+		IP:     clientIP(r),
+	})
+
+	session, _ := h.cookieStore().Get(r, h.config.SessionCookieName)
+	session.Values["session_id"] = ""
+	session.Options.MaxAge = -1
+	session.Save(r, w)
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Your account has been deleted"),
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Account deleted: %s", user.Username)
+}
+
+// AdminUserDeleteHandler lets admins delete an account, with an optional
+// reason kept on the tombstone
+func (h *AuthHandler) AdminUserDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Admin account deletion request received")
+
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req AdminDeleteUserRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(w, r, &req); err != nil {
+			h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+			writeBodyError(w, r, err)
+			return
+		}
+	}
+
+	user, err := h.users.Get(r.Context(), mux.Vars(r)["id"])
+	if err == nil {
+		err = h.deleteAccount(r.Context(), user, admin.ID, req.Reason)
+	}
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to delete account %s: %v", mux.Vars(r)["id"], err)
+		writeDeletionError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditAccountDeleted,
+		UserID:  admin.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"target": user.ID, "reason": req.Reason},
+	})
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Account deleted"),
+		Data:    h.deletedUser(user),
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// AdminUserRestoreHandler lets admins restore a deleted account before it
+// is purged. The user signs in again, since their sessions were revoked.
+func (h *AuthHandler) AdminUserRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Admin account restore request received")
+
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := h.users.Get(r.Context(), mux.Vars(r)["id"])
+	if err == nil {
+		err = h.restoreAccount(r.Context(), user)
+	}
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to restore account %s: %v", mux.Vars(r)["id"], err)
+		writeDeletionError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditAccountRestored,
+		UserID:  admin.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"target": user.ID},
+	})
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Account restored"),
+		Data:    user.Sanitized(),
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// AdminDeletedUsersHandler lists the deleted accounts that have not been
+// purged yet, oldest deletion first
+func (h *AuthHandler) AdminDeletedUsersHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Deleted accounts request received")
+
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	users, err := h.users.List(r.Context())
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to list users: %v", err)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	deleted := []DeletedUser{}
+	for _, user := range users {
+		if user.Deletion != nil {
+			deleted = append(deleted, h.deletedUser(user))
+		}
+	}
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i].Deletion.At.Before(deleted[j].Deletion.At) })
+
+	json.NewEncoder(w).Encode(Response{Success: true, Data: deleted})
+}
+
+// deletedUser describes a deleted user for admins
+func (h *AuthHandler) deletedUser(user *User) DeletedUser {
+	return DeletedUser{
+		User:     user.Sanitized(),
+		Deletion: *user.Deletion,
+		PurgeAt:  user.Deletion.At.Add(h.config.DeletedUserRetention),
+	}
+}
@@ -0,0 +1,503 @@
+package server
+
+import (
+	"auth-server/pkg/randutil"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deviceCodeGrantType is the token grant_type devices poll with (RFC 8628
+// section 3.4)
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+const (
+	// userCodeAlphabet has no vowels, so codes never spell words, and no
+	// characters that are easily confused (RFC 8628 section 6.1)
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+	// deviceSlowDownStep is added to a device's polling interval each time
+	// it polls too fast
+	deviceSlowDownStep = 5 * time.Second
+)
+
+var (
+	errDeviceCodeInvalid  = errors.New("unknown device or user code")
+	errDeviceCodeExpired  = errors.New("device code expired")
+	errDeviceCodeUsed     = errors.New("device code already decided")
+	errDeviceAccessDenied = errors.New("device authorization denied")
+	errDevicePending      = errors.New("device authorization pending")
+	errDeviceSlowDown     = errors.New("device polling too fast")
+)
+
+// deviceStatus is where a device authorization stands
+type deviceStatus int
+
+const (
+	devicePending deviceStatus = iota
+	deviceApproved
+	deviceDenied
+)
+
+// deviceAuthorization is a device waiting for a user to approve it
+type deviceAuthorization struct {
+	userCode   string
+	clientID   string
+	clientName string
+	scopes     []string
+	expiresAt  time.Time
+	interval   time.Duration
+	lastPoll   time.Time
+	status     deviceStatus
+	userID     string
+}
+
+// DeviceAuthorizationInfo describes a pending device authorization to the
+// user asked to approve it
+type DeviceAuthorizationInfo struct {
+	UserCode   string    `json:"userCode"`
+	ClientID   string    `json:"clientId"`
+	ClientName string    `json:"clientName"`
+	Scopes     []string  `json:"scopes"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// DeviceVerifyRequest approves or denies the device showing UserCode
+type DeviceVerifyRequest struct {
+	UserCode string `json:"userCode"`
+	Approve  bool   `json:"approve"`
+}
+
+// DeviceAuthorizationResponse answers a device authorization request (RFC
+// 8628 section 3.2)
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// deviceAuthorizationStore keeps device authorizations in memory, by the
+// hash of the device code and by user code
+type deviceAuthorizationStore struct {
+	mutex    sync.Mutex
+	byDevice map[string]*deviceAuthorization
+	byUser   map[string]string // user code -> device code hash
+}
+
+func newDeviceAuthorizationStore() *deviceAuthorizationStore {
+	return &deviceAuthorizationStore{
+		byDevice: make(map[string]*deviceAuthorization),
+		byUser:   make(map[string]string),
+	}
+}
+
+// create starts an authorization for client and returns its device code
+// and user code
+func (s *deviceAuthorizationStore) create(client *OAuthClient, scopes []string, ttl, interval time.Duration, now time.Time) (string, string, error) {
+	deviceCode, err := randutil.Base64(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var userCode string
+	for userCode == "" {
+		if userCode, err = newUserCode(); err != nil {
+			return "", "", err
+		}
+		if _, taken := s.byUser[userCode]; taken {
+			userCode = ""
+		}
+	}
+
+	hash := hashDeviceCode(deviceCode)
+	s.byDevice[hash] = &deviceAuthorization{
+		userCode:   userCode,
+		clientID:   client.ID,
+		clientName: client.Name,
+		scopes:     slices.Clone(scopes),
+		expiresAt:  now.Add(ttl),
+		interval:   interval,
+		status:     devicePending,
+	}
+	s.byUser[userCode] = hash
+	return deviceCode, userCode, nil
+}
+
+// lookup returns the pending authorization showing userCode
+func (s *deviceAuthorizationStore) lookup(userCode string, now time.Time) (DeviceAuthorizationInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	auth, err := s.pendingLocked(userCode, now)
+	if err != nil {
+		return DeviceAuthorizationInfo{}, err
+	}
+	return DeviceAuthorizationInfo{
+		UserCode:   formatUserCode(auth.userCode),
+		ClientID:   auth.clientID,
+		ClientName: auth.clientName,
+		Scopes:     slices.Clone(auth.scopes),
+		ExpiresAt:  auth.expiresAt,
+	}, nil
+}
+
+// decide records userID's answer for the authorization showing userCode
+func (s *deviceAuthorizationStore) decide(userCode, userID string, approve bool, now time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	auth, err := s.pendingLocked(userCode, now)
+	if err != nil {
+		return err
+	}
+	auth.userID = userID
+	auth.status = deviceDenied
+	if approve {
+		auth.status = deviceApproved
+	}
+	return nil
+}
+
+func (s *deviceAuthorizationStore) pendingLocked(userCode string, now time.Time) (*deviceAuthorization, error) {
+	auth, ok := s.byDevice[s.byUser[normalizeUserCode(userCode)]]
+	if !ok || !now.Before(auth.expiresAt) {
+		return nil, errDeviceCodeInvalid
+	}
+	if auth.status != devicePending {
+		return nil, errDeviceCodeUsed
+	}
+	return auth, nil
+}
+
+// poll checks on the authorization for deviceCode on behalf of clientID.
+// An approved authorization is returned once and then forgotten; until
+// then poll fails with why the device has to keep waiting or give up.
+func (s *deviceAuthorizationStore) poll(deviceCode, clientID string, now time.Time) (deviceAuthorization, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	hash := hashDeviceCode(deviceCode)
+	auth, ok := s.byDevice[hash]
+	if !ok || auth.clientID != clientID {
+		return deviceAuthorization{}, errDeviceCodeInvalid
+	}
+	if !now.Before(auth.expiresAt) {
+		return deviceAuthorization{}, errDeviceCodeExpired
+	}
+
+	switch auth.status {
+	case deviceApproved:
+		delete(s.byDevice, hash)
+		delete(s.byUser, auth.userCode)
+		return *auth, nil
+	case deviceDenied:
+		return deviceAuthorization{}, errDeviceAccessDenied
+	}
+
+	tooSoon := !auth.lastPoll.IsZero() && now.Sub(auth.lastPoll) < auth.interval
+	auth.lastPoll = now
+	if tooSoon {
+		auth.interval += deviceSlowDownStep
+		return deviceAuthorization{}, errDeviceSlowDown
+	}
+	return deviceAuthorization{}, errDevicePending
+}
+
+// Purge drops expired authorizations and returns how many were removed
+func (s *deviceAuthorizationStore) Purge(now time.Time) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	purged := 0
+	for hash, auth := range s.byDevice {
+		if !now.Before(auth.expiresAt) {
+			delete(s.byDevice, hash)
+			delete(s.byUser, auth.userCode)
+			purged++
+		}
+	}
+	return purged
+}
+
+// hashDeviceCode is the form device codes are stored in
+func hashDeviceCode(deviceCode string) string {
+	sum := sha256.Sum256([]byte(deviceCode))
+	return hex.EncodeToString(sum[:])
+}
+
+// newUserCode returns a random user code from userCodeAlphabet
+func newUserCode() (string, error) {
+	b, err := randutil.Bytes(userCodeLength)
+	if err != nil {
+		return "", err
+	}
+	code := make([]byte, userCodeLength)
+	for i := range b {
+		// The modulo bias is negligible for a code that lives minutes
+		code[i] = userCodeAlphabet[int(b[i])%len(userCodeAlphabet)]
+	}
+	return string(code), nil
+}
+
+// normalizeUserCode accepts a user code typed in any case, with or without
+// the dash and spaces
+func normalizeUserCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// formatUserCode splits a user code in two halves for reading out
+func formatUserCode(code string) string {
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// deviceClient returns the client a device request is for. Devices are
+// public clients, so a client_id is enough; a client that does send its
+// secret must send the right one.
+func (s *Server) deviceClient(r *http.Request) (*OAuthClient, bool) {
+	clientID, clientSecret, basic := r.BasicAuth()
+	if !basic {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	if clientSecret != "" {
+		return s.clients.authenticate(clientID, clientSecret)
+	}
+	return s.clients.get(clientID)
+}
+
+// verificationURI is where users enter the code a device shows
+func (s *Server) verificationURI() string {
+	if s.config.DeviceVerificationURL != "" {
+		return s.config.DeviceVerificationURL
+	}
+	return s.config.PublicURL + "/device"
+}
+
+// DeviceAuthorizationHandler starts the device authorization grant (RFC
+// 8628) for CLI tools and TVs: it returns a device code to poll /oauth/token
+// with and a user code the user enters on the verification page. Scopes
+// are personal access token scopes the client is registered for, and the
+// device ends up with a personal access token of the approving user.
+func (s *Server) DeviceAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Device authorization request received")
+
+	if err := r.ParseForm(); err != nil {
+		s.logger.Printf("[DEBUG] Failed to parse device authorization request: %v", err)
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Request body must be form encoded")
+		return
+	}
+
+	client, ok := s.deviceClient(r)
+	if !ok {
+		s.logger.Printf("[DEBUG] Unknown device client: %s", r.PostForm.Get("client_id"))
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	// An omitted scope asks for every token scope the client is registered for
+	scopes := strings.Fields(r.PostForm.Get("scope"))
+	if len(scopes) == 0 {
+		for _, scope := range client.Scopes {
+			if checkScopes([]string{scope}) == nil {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	for _, scope := range scopes {
+		if !client.allowsScope(scope) {
+			s.logger.Printf("[DEBUG] Client %s requested unregistered scope %q", client.ID, scope)
+			writeOAuthError(w, http.StatusBadRequest, "invalid_scope", fmt.Sprintf("Scope %q is not allowed for this client", scope))
+			return
+		}
+	}
+	if err := checkScopes(scopes); err != nil {
+		s.logger.Printf("[DEBUG] Client %s requested invalid device scopes %v: %v", client.ID, scopes, err)
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "Devices can only be granted personal access token scopes")
+		return
+	}
+
+	deviceCode, userCode, err := s.devices.create(client, scopes, s.config.DeviceCodeTTL, s.config.DevicePollInterval, s.authHandler.clock.Now())
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to create device authorization: %v", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to start device authorization")
+		return
+	}
+
+	verificationURI := s.verificationURI()
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(DeviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                formatUserCode(userCode),
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?user_code=" + url.QueryEscape(formatUserCode(userCode)),
+		ExpiresIn:               int(s.config.DeviceCodeTTL.Seconds()),
+		Interval:                int(s.config.DevicePollInterval.Seconds()),
+	})
+	s.logger.Printf("[DEBUG] Device authorization started for client: %s", client.ID)
+}
+
+// deviceCodeGrant answers a device polling /oauth/token. Once the user has
+// approved, the device gets a personal access token named after the client,
+// which the user can revoke like any other.
+func (s *Server) deviceCodeGrant(w http.ResponseWriter, r *http.Request) {
+	client, ok := s.deviceClient(r)
+	if !ok {
+		s.logger.Printf("[DEBUG] Unknown device client: %s", r.PostForm.Get("client_id"))
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	now := s.authHandler.clock.Now()
+	auth, err := s.devices.poll(r.PostForm.Get("device_code"), client.ID, now)
+	switch {
+	case errors.Is(err, errDevicePending):
+		writeOAuthError(w, http.StatusBadRequest, "authorization_pending", "The user has not yet approved the device")
+		return
+	case errors.Is(err, errDeviceSlowDown):
+		writeOAuthError(w, http.StatusBadRequest, "slow_down", "Polling too fast, increase the interval")
+		return
+	case errors.Is(err, errDeviceAccessDenied):
+		writeOAuthError(w, http.StatusBadRequest, "access_denied", "The user denied the device")
+		return
+	case errors.Is(err, errDeviceCodeExpired):
+		writeOAuthError(w, http.StatusBadRequest, "expired_token", "The device code has expired")
+		return
+	case err != nil:
+		s.logger.Printf("[DEBUG] Device code rejected for client %s: %v", client.ID, err)
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid device code")
+		return
+	}
+
+	h := s.authHandler
+	user, err := h.users.Get(r.Context(), auth.userID)
+	if err != nil {
+		s.logger.Printf("[DEBUG] Approving user %s unavailable for device: %v", auth.userID, err)
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The approving account is no longer available")
+		return
+	}
+	if len(user.AccessTokens) >= maxAccessTokens {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The approving account has too many access tokens")
+		return
+	}
+
+	token, created, err := h.newAccessToken(user, "Device: "+auth.clientName, auth.scopes, now.Add(h.config.AccessTokenTTL), now)
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to generate device access token: %v", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to issue token")
+		return
+	}
+	user.AccessTokens = append(slices.Clone(user.AccessTokens), created)
+	user.UpdatedAt = now
+	if err := h.users.Update(r.Context(), user); err != nil {
+		s.logger.Printf("[DEBUG] Failed to store device access token for %s: %v", user.Username, err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to issue token")
+		return
+	}
+
+	s.audit.Record(AuditEvent{
+		Type:   AuditAccessTokenCreated,
+		UserID: user.ID,
+		IP:     clientIP(r),
+		Details: map[string]string{
+			"token":     created.ID,
+			"scopes":    strings.Join(created.Scopes, ","),
+			"expiresAt": created.ExpiresAt.Format(time.RFC3339),
+			"client":    client.ID,
+			"grant":     "device_code",
+		},
+	})
+	h.notifySecurityChange(r, user, NoticeAPIKeyCreated, "")
+
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(created.ExpiresAt.Sub(now).Seconds()),
+		Scope:       strings.Join(created.Scopes, " "),
+	})
+	s.logger.Printf("[DEBUG] Device access token %s issued to %s for client %s", created.ID, user.Username, client.ID)
+}
+
+// DeviceVerifyHandler shows the signed-in user which client and scopes a
+// user code stands for on GET, and records their approval or denial on POST
+func (s *Server) DeviceVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Device verification request received")
+
+	h := s.authHandler
+	user := contextUser(r)
+
+	now := h.clock.Now()
+	if r.Method == http.MethodGet {
+		info, err := s.devices.lookup(r.URL.Query().Get("user_code"), now)
+		if err != nil {
+			writeDeviceCodeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(Response{Success: true, Message: "Device authorization retrieved successfully", Data: info})
+		return
+	}
+
+	var req DeviceVerifyRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	info, err := s.devices.lookup(req.UserCode, now)
+	if err != nil {
+		writeDeviceCodeError(w, r, err)
+		return
+	}
+	if req.Approve && grantsAdminScope(info.Scopes) && user.Role != RoleAdmin {
+		http.Error(w, localize(r, "Only admins can grant admin scopes"), http.StatusForbidden)
+		return
+	}
+	if err := s.devices.decide(req.UserCode, user.ID, req.Approve, now); err != nil {
+		writeDeviceCodeError(w, r, err)
+		return
+	}
+
+	decision, message := "denied", "Device denied"
+	if req.Approve {
+		decision, message = "approved", "Device approved. You can return to your device."
+	}
+	s.audit.Record(AuditEvent{
+		Type:    AuditDeviceAuthorized,
+		UserID:  user.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"client": info.ClientID, "scopes": strings.Join(info.Scopes, ","), "decision": decision},
+	})
+
+	json.NewEncoder(w).Encode(Response{Success: true, Message: localize(r, message)})
+	s.logger.Printf("[DEBUG] Device for client %s %s by %s", info.ClientID, decision, user.Username)
+}
+
+// deviceCodeError is the status and message for a user code that cannot
+// be decided on
+func deviceCodeError(r *http.Request, err error) (int, string) {
+	if errors.Is(err, errDeviceCodeUsed) {
+		return http.StatusConflict, localize(r, "This code has already been used")
+	}
+	return http.StatusNotFound, localize(r, "Invalid or expired code")
+}
+
+// writeDeviceCodeError answers a user code that cannot be decided on
+func writeDeviceCodeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, message := deviceCodeError(r, err)
+	http.Error(w, message, status)
+}
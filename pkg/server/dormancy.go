@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// dormancyActor is who the dormancy policy acts as, in place of a user ID
+const dormancyActor = "system"
+
+// dormancyDeactivationReason is shown to users deactivated for inactivity
+const dormancyDeactivationReason = "This account was deactivated after a long period of inactivity. Contact support to reactivate it."
+
+// enforceDormancy moves inactive accounts through the dormancy policy and
+// returns how many it acted on. Accounts inactive for
+// Config.DormantAccountAge are flagged, and their owners emailed when
+// Config.DormancyNotify is set; after Config.DormancyDeactivateAfter they
+// are suspended, and after Config.DormancyDeleteAfter deleted, to be purged
+// once the deleted account retention passes. Zero durations turn a stage
+// off. Admins are never deactivated or deleted, so nobody is left to
+// reactivate the others.
+func (h *AuthHandler) enforceDormancy(now time.Time) int {
+	if h.config.DormantAccountAge <= 0 && h.config.DormancyDeactivateAfter <= 0 && h.config.DormancyDeleteAfter <= 0 {
+		return 0
+	}
+
+	ctx := context.Background()
+	users, err := h.users.List(ctx)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to list users for the dormancy policy: %v", err)
+		return 0
+	}
+
+	acted := 0
+	for _, user := range users {
+		if user.Deletion != nil || user.Merge != nil {
+			continue
+		}
+		inactive := now.Sub(user.LastActive())
+		var err error
+		switch {
+		case reached(inactive, h.config.DormancyDeleteAfter) && user.Role != RoleAdmin:
+			err = h.deleteDormant(ctx, user, inactive)
+		case reached(inactive, h.config.DormancyDeactivateAfter) && user.Role != RoleAdmin:
+			// Leave accounts an admin has suspended as they are
+			if (user.Dormancy != nil && user.Dormancy.DeactivatedAt != nil) || user.Suspension.ActiveAt(now) {
+				continue
+			}
+			err = h.deactivateDormant(ctx, user, inactive, now)
+		case reached(inactive, h.config.DormantAccountAge):
+			if user.Dormancy != nil && user.Dormancy.FlaggedAt != nil {
+				continue
+			}
+			err = h.flagDormant(ctx, user, inactive, now)
+		default:
+			continue
+		}
+		if err != nil {
+			h.logger.Printf("[DEBUG] Dormancy policy failed for %s: %v", user.ID, err)
+			continue
+		}
+		acted++
+	}
+	return acted
+}
+
+// reached reports whether inactive has reached a stage's threshold, for
+// stages that are on
+func reached(inactive, threshold time.Duration) bool {
+	return threshold > 0 && inactive >= threshold
+}
+
+// inactiveDays renders an inactivity period for audit details
+func inactiveDays(inactive time.Duration) string {
+	return strconv.Itoa(int(inactive / (24 * time.Hour)))
+}
+
+// flagDormant marks user dormant and, if configured, tells them when the
+// account will be deactivated or deleted
+func (h *AuthHandler) flagDormant(ctx context.Context, user *User, inactive time.Duration, now time.Time) error {
+	previous := user.Dormancy
+	dormancy := AccountDormancy{FlaggedAt: &now}
+	if previous != nil {
+		dormancy.ReactivatedAt = previous.ReactivatedAt
+	}
+	if h.config.DormancyNotify {
+		dormancy.NotifiedAt = &now
+	}
+	user.Dormancy = &dormancy
+	user.UpdatedAt = now
+	if err := h.users.Update(ctx, user); err != nil {
+		user.Dormancy = previous
+		return err
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditAccountDormant,
+		UserID:  user.ID,
+		Details: map[string]string{"inactiveDays": inactiveDays(inactive), "notified": strconv.FormatBool(h.config.DormancyNotify)},
+	})
+	if h.config.DormancyNotify {
+		h.notifyDormant(ctx, user, now)
+	}
+	return nil
+}
+
+// notifyDormant emails user that their account is inactive, with the date
+// of the next step if there is one
+func (h *AuthHandler) notifyDormant(ctx context.Context, user *User, now time.Time) {
+	data := map[string]string{
+		"Username":   user.Username,
+		"LastActive": user.LastActive().Format(time.DateOnly),
+		"Link":       h.config.PublicURL + h.config.BasePath + "/",
+	}
+	if user.Role != RoleAdmin {
+		if after := h.config.DormancyDeactivateAfter; after > 0 {
+			data["DeactivateAt"] = user.LastActive().Add(after).Format(time.DateOnly)
+		} else if after := h.config.DormancyDeleteAfter; after > 0 {
+			data["DeleteAt"] = user.LastActive().Add(after).Format(time.DateOnly)
+		}
+	}
+	h.sendEmail(ctx, user, user.Locale, "dormant_account", data)
+}
+
+// deactivateDormant suspends user for inactivity
+func (h *AuthHandler) deactivateDormant(ctx context.Context, user *User, inactive time.Duration, now time.Time) error {
+	previous := user.Dormancy
+	dormancy := AccountDormancy{DeactivatedAt: &now}
+	if previous != nil {
+		dormancy = *previous
+		dormancy.DeactivatedAt = &now
+	}
+	user.Dormancy = &dormancy
+	if err := h.suspendAccount(ctx, user, dormancyActor, SuspendUserRequest{Reason: dormancyDeactivationReason}); err != nil {
+		user.Dormancy = previous
+		return err
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditAccountDeactivated,
+		UserID:  user.ID,
+		Details: map[string]string{"inactiveDays": inactiveDays(inactive)},
+	})
+	return nil
+}
+
+// deleteDormant deletes user for inactivity
+func (h *AuthHandler) deleteDormant(ctx context.Context, user *User, inactive time.Duration) error {
+	if err := h.deleteAccount(ctx, user, dormancyActor, "inactive account"); err != nil {
+		return err
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditAccountDeleted,
+		UserID:  user.ID,
+		Details: map[string]string{"by": dormancyActor, "reason": "inactive account", "inactiveDays": inactiveDays(inactive)},
+	})
+	return nil
+}
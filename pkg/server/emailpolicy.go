@@ -0,0 +1,103 @@
+package server
+
+import (
+	"auth-server/pkg/emailpolicy"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EmailPolicyRequest represents an update to the email domain policy. Lists
+// left out of the request are not changed.
+type EmailPolicyRequest struct {
+	BlockedDomains *[]string `json:"blockedDomains"`
+	AllowedDomains *[]string `json:"allowedDomains"`
+}
+
+// newEmailPolicyFromConfig builds the email domain policy, loading blocked
+// domains from the configured file or falling back to the built-in list
+func newEmailPolicyFromConfig(cfg Config) *emailpolicy.Policy {
+	blocked := emailpolicy.DefaultBlockedDomains
+
+	if cfg.EmailBlockedDomainsFile != "" {
+		file, err := os.Open(cfg.EmailBlockedDomainsFile)
+		if err != nil {
+			cfg.Logger.Printf("[DEBUG] Failed to open blocked email domains file %s, using built-in list: %v", cfg.EmailBlockedDomainsFile, err)
+		} else {
+			defer file.Close()
+			domains, err := emailpolicy.LoadDomainList(file)
+			if err != nil {
+				cfg.Logger.Printf("[DEBUG] Failed to read blocked email domains file %s, using built-in list: %v", cfg.EmailBlockedDomainsFile, err)
+			} else {
+				blocked = domains
+			}
+		}
+	}
+
+	return emailpolicy.New(blocked, cfg.EmailAllowedDomains)
+}
+
+// emailPolicyMessage returns the client-facing message for an email policy error
+func emailPolicyMessage(err error) string {
+	switch {
+	case errors.Is(err, emailpolicy.ErrInvalidEmail):
+		return "Invalid email address"
+	case errors.Is(err, emailpolicy.ErrDomainNotAllowed):
+		return "Email addresses at this domain are not allowed"
+	default:
+		return "Disposable email addresses are not allowed"
+	}
+}
+
+// EmailPolicyHandler lets admins view (GET) and replace (PUT) the blocked
+// and allowed email domain lists
+func (s *Server) EmailPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Email policy request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	policy := s.authHandler.emailPolicy
+
+	if r.Method == http.MethodPut {
+		var req EmailPolicyRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+			writeBodyError(w, r, err)
+			return
+		}
+
+		if req.BlockedDomains != nil {
+			policy.SetBlocked(*req.BlockedDomains)
+		}
+		if req.AllowedDomains != nil {
+			policy.SetAllowed(*req.AllowedDomains)
+		}
+
+		s.audit.Record(AuditEvent{
+			Type:   AuditEmailPolicyChanged,
+			UserID: admin.ID,
+			IP:     clientIP(r),
+			Details: map[string]string{
+				"blockedDomains": strconv.Itoa(len(policy.Blocked())),
+				"allowedDomains": strings.Join(policy.Allowed(), ","),
+			},
+		})
+	}
+
+	response := Response{
+		Success: true,
+		Message: "Email policy retrieved successfully",
+		Data: map[string]interface{}{
+			"blockedDomains": policy.Blocked(),
+			"allowedDomains": policy.Allowed(),
+		},
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,426 @@
+package server
+
+import (
+	"auth-server/pkg/i18n"
+	"auth-server/pkg/mailer"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxEmailTemplateSize bounds an email template override
+const maxEmailTemplateSize = 64 << 10
+
+var (
+	errEmailTemplateNotFound = errors.New("email template not found")
+	errEmailTemplateInvalid  = errors.New("invalid email template")
+)
+
+// emailTemplateSample is example data for the named email template, with
+// every field its sender can fill in. Overrides are checked against it, so
+// a template using a field no email has is refused, and previewed with it.
+func emailTemplateSample(publicURL, name string) map[string]interface{} {
+	now := time.Date(2026, time.March, 14, 9, 30, 0, 0, time.UTC)
+	sample := map[string]interface{}{"Username": "jane"}
+	switch name {
+	case "dormant_account":
+		sample["LastActive"] = now.AddDate(0, -6, 0).Format(time.DateOnly)
+		sample["Link"] = publicURL + "/"
+		sample["DeactivateAt"] = now.AddDate(0, 1, 0).Format(time.DateOnly)
+		sample["DeleteAt"] = ""
+	case "impossible_travel":
+		sample["Country"] = "JP"
+		sample["IP"] = "203.0.113.7"
+		sample["Time"] = now.Format(time.RFC1123)
+		sample["PreviousCountry"] = "DE"
+		sample["PreviousIP"] = "198.51.100.23"
+		sample["PreviousTime"] = now.Add(-time.Hour).Format(time.RFC1123)
+	case "login_challenge":
+		sample["Code"] = "482915"
+		sample["IP"] = "203.0.113.7"
+		sample["Minutes"] = int(smsCodeTTL.Minutes())
+	case "magic_link":
+		sample["Link"] = publicURL + "/api/login/magic-link/verify?token=example"
+		sample["TTL"] = (15 * time.Minute).String()
+		sample["IP"] = "203.0.113.7"
+		sample["Device"] = "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0"
+		sample["Time"] = now.Format(time.RFC1123)
+	case "new_login":
+		sample["IP"] = "203.0.113.7"
+		sample["Country"] = "DE"
+		sample["Time"] = now.Format(time.RFC1123)
+	case "password_reset":
+		sample["Link"] = publicURL + "/reset-password?token=example"
+		sample["TTL"] = time.Hour.String()
+	case "security_change":
+		sample["Change"] = "password_changed"
+		sample["Time"] = now.Format(time.RFC1123)
+		sample["IP"] = "203.0.113.7"
+		sample["Device"] = "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0"
+		sample["Link"] = publicURL + "/reset-password?token=example"
+		sample["TTL"] = time.Hour.String()
+	}
+	return sample
+}
+
+// emailTemplateOverride is an operator's version of a built-in template
+type emailTemplateOverride struct {
+	source    string
+	tmpl      *template.Template
+	updatedAt time.Time
+}
+
+// emailTemplateStore holds operators' overrides of the built-in email
+// templates by locale and name. With a directory they are loaded from and
+// saved to <dir>/<locale>/<name>.tmpl, the layout of the built-in ones.
+type emailTemplateStore struct {
+	dir       string
+	publicURL string
+
+	mutex     sync.RWMutex
+	overrides map[string]*emailTemplateOverride
+}
+
+// newEmailTemplateStore loads the overrides in dir, or starts without
+// any, kept in memory, when dir is empty. An invalid override is an
+// error, so a typo cannot silently break an email.
+func newEmailTemplateStore(dir, publicURL string, logger *log.Logger) (*emailTemplateStore, error) {
+	s := &emailTemplateStore{dir: dir, publicURL: publicURL, overrides: make(map[string]*emailTemplateOverride)}
+	if dir == "" {
+		return s, nil
+	}
+	for _, locale := range translations.Locales() {
+		for _, name := range translations.EmailNames() {
+			path := filepath.Join(dir, locale, name+".tmpl")
+			info, err := os.Stat(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			source, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			tmpl, err := s.parse(locale, name, string(source))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			s.overrides[locale+"/"+name] = &emailTemplateOverride{source: string(source), tmpl: tmpl, updatedAt: info.ModTime()}
+		}
+	}
+	logger.Printf("[DEBUG] Loaded %d email template overrides from %s", len(s.overrides), dir)
+	return s, nil
+}
+
+// known reports whether there is a built-in email template name in a
+// supported locale
+func (s *emailTemplateStore) known(locale, name string) bool {
+	return translations.Supports(locale) && slices.Contains(translations.EmailNames(), name)
+}
+
+// parse checks an override of the named template: it must define the
+// subject and body and only use fields the email has
+func (s *emailTemplateStore) parse(locale, name, source string) (*template.Template, error) {
+	if len(source) > maxEmailTemplateSize {
+		return nil, fmt.Errorf("%w: larger than %d bytes", errEmailTemplateInvalid, maxEmailTemplateSize)
+	}
+	tmpl, err := i18n.ParseEmail(locale+"/"+name, source, emailTemplateSample(s.publicURL, name))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errEmailTemplateInvalid, err)
+	}
+	return tmpl, nil
+}
+
+// get returns the override of the named template in locale, if any
+func (s *emailTemplateStore) get(locale, name string) *emailTemplateOverride {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.overrides[locale+"/"+name]
+}
+
+// set replaces the named template in locale with source, saving it to the
+// directory when there is one
+func (s *emailTemplateStore) set(locale, name, source string, now time.Time) error {
+	if !s.known(locale, name) {
+		return errEmailTemplateNotFound
+	}
+	tmpl, err := s.parse(locale, name, source)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.dir != "" {
+		if err := os.MkdirAll(filepath.Join(s.dir, locale), 0o755); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(s.dir, locale, name+".tmpl"), []byte(source)); err != nil {
+			return err
+		}
+	}
+	s.overrides[locale+"/"+name] = &emailTemplateOverride{source: source, tmpl: tmpl, updatedAt: now}
+	return nil
+}
+
+// reset removes the override of the named template in locale, reporting
+// whether there was one
+func (s *emailTemplateStore) reset(locale, name string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.overrides[locale+"/"+name]; !ok {
+		return false, nil
+	}
+	if s.dir != "" {
+		if err := os.Remove(filepath.Join(s.dir, locale, name+".tmpl")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+	}
+	delete(s.overrides, locale+"/"+name)
+	return true, nil
+}
+
+// render renders the named email for locale. An override for the locale
+// comes first, then the built-in translation, and then the English
+// override and built-in template.
+func (s *emailTemplateStore) render(locale, name string, data interface{}) (subject, body string, err error) {
+	for _, candidate := range []string{locale, i18n.DefaultLocale} {
+		if override := s.get(candidate, name); override != nil {
+			return i18n.RenderEmail(override.tmpl, data)
+		}
+		if translations.HasEmail(candidate, name) {
+			return translations.Email(candidate, name, data)
+		}
+	}
+	return translations.Email(locale, name, data)
+}
+
+// EmailTemplateInfo lists an email template in a locale
+type EmailTemplateInfo struct {
+	Name       string     `json:"name"`
+	Locale     string     `json:"locale"`
+	Overridden bool       `json:"overridden"`
+	UpdatedAt  *time.Time `json:"updatedAt,omitempty"`
+}
+
+// EmailTemplate is an email template with the built-in version it
+// overrides and the fields it can use
+type EmailTemplate struct {
+	EmailTemplateInfo
+	Source  string   `json:"source"`
+	Default string   `json:"default"`
+	Fields  []string `json:"fields"`
+}
+
+// EmailTemplateRequest overrides an email template. Source is in Go's
+// text/template syntax and defines "subject" and "body".
+type EmailTemplateRequest struct {
+	Source string `json:"source"`
+}
+
+// EmailTemplatePreviewRequest renders an email template with example
+// data: Source when given, or else the template in use. With Send the
+// result is also mailed to the admin asking.
+type EmailTemplatePreviewRequest struct {
+	Source string `json:"source"`
+	Send   bool   `json:"send"`
+}
+
+// EmailTemplatePreview is a rendered email template
+type EmailTemplatePreview struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	SentTo  string `json:"sentTo,omitempty"`
+}
+
+// describe returns the named template in locale as it is used
+func (s *emailTemplateStore) describe(locale, name string) EmailTemplate {
+	described := EmailTemplate{EmailTemplateInfo: EmailTemplateInfo{Name: name, Locale: locale}}
+	described.Default, _ = translations.EmailSource(locale, name)
+	described.Source = described.Default
+	if override := s.get(locale, name); override != nil {
+		described.Overridden = true
+		described.UpdatedAt = &override.updatedAt
+		described.Source = override.source
+	}
+	described.Fields = slices.Sorted(maps.Keys(emailTemplateSample(s.publicURL, name)))
+	return described
+}
+
+// writeEmailTemplateError maps an email template store error to a response
+func (s *Server) writeEmailTemplateError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errEmailTemplateNotFound):
+		http.Error(w, localize(r, "Email template not found"), http.StatusNotFound)
+	case errors.Is(err, errEmailTemplateInvalid):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		s.logger.Printf("[DEBUG] Email template store failed: %v", err)
+		http.Error(w, localize(r, "Internal server error"), http.StatusInternalServerError)
+	}
+}
+
+// EmailTemplatesHandler lists the email templates of every locale and
+// whether operators have overridden them
+func (s *Server) EmailTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Email templates request received")
+
+	if _, ok := s.authHandler.requireAdmin(w, r); !ok {
+		return
+	}
+
+	templates := s.authHandler.emailTemplates
+	var list []EmailTemplateInfo
+	for _, name := range translations.EmailNames() {
+		for _, locale := range translations.Locales() {
+			list = append(list, templates.describe(locale, name).EmailTemplateInfo)
+		}
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: localize(r, "Email templates retrieved successfully"),
+		Data:    list,
+	})
+}
+
+// EmailTemplateHandler returns an email template on GET, overrides it on
+// PUT and restores the built-in version on DELETE
+func (s *Server) EmailTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Email template request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	templates := s.authHandler.emailTemplates
+	locale, name := mux.Vars(r)["locale"], mux.Vars(r)["name"]
+	if !templates.known(locale, name) {
+		s.writeEmailTemplateError(w, r, errEmailTemplateNotFound)
+		return
+	}
+
+	message := localize(r, "Email template retrieved successfully")
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var req EmailTemplateRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+			writeBodyError(w, r, err)
+			return
+		}
+		if err := templates.set(locale, name, req.Source, s.authHandler.clock.Now()); err != nil {
+			s.writeEmailTemplateError(w, r, err)
+			return
+		}
+		s.recordEmailTemplateChange(r, admin, locale, name, "overridden")
+		message = localize(r, "Email template updated successfully")
+
+	case http.MethodDelete:
+		reset, err := templates.reset(locale, name)
+		if err != nil {
+			s.writeEmailTemplateError(w, r, err)
+			return
+		}
+		if reset {
+			s.recordEmailTemplateChange(r, admin, locale, name, "reset")
+		}
+		message = localize(r, "Email template reset to the default")
+
+	default:
+		s.logger.Printf("[DEBUG] Invalid method: %s", r.Method)
+		http.Error(w, localize(r, "Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: message,
+		Data:    templates.describe(locale, name),
+	})
+}
+
+// recordEmailTemplateChange audits an override being set or removed
+func (s *Server) recordEmailTemplateChange(r *http.Request, admin *User, locale, name, change string) {
+	s.audit.Record(AuditEvent{
+		Type:    AuditEmailTemplateChanged,
+		UserID:  admin.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"template": name, "locale": locale, "change": change},
+	})
+	s.logger.Printf("[DEBUG] Email template %s/%s %s by %s", locale, name, change, admin.Username)
+}
+
+// EmailTemplatePreviewHandler renders an email template, or a draft of
+// one, with example data, and on request mails it to the admin so they
+// can see it in a real mail client
+func (s *Server) EmailTemplatePreviewHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Email template preview request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	templates := s.authHandler.emailTemplates
+	locale, name := mux.Vars(r)["locale"], mux.Vars(r)["name"]
+	if !templates.known(locale, name) {
+		s.writeEmailTemplateError(w, r, errEmailTemplateNotFound)
+		return
+	}
+
+	var req EmailTemplatePreviewRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	sample := emailTemplateSample(s.config.PublicURL, name)
+	var preview EmailTemplatePreview
+	var err error
+	if strings.TrimSpace(req.Source) != "" {
+		var tmpl *template.Template
+		if tmpl, err = templates.parse(locale, name, req.Source); err == nil {
+			preview.Subject, preview.Body, err = i18n.RenderEmail(tmpl, sample)
+		}
+	} else {
+		preview.Subject, preview.Body, err = templates.render(locale, name, sample)
+	}
+	if err != nil {
+		s.writeEmailTemplateError(w, r, err)
+		return
+	}
+
+	if req.Send {
+		s.authHandler.enqueue(r.Context(), OutboxMessage{
+			Kind:  OutboxKindEmail,
+			Label: "email_template_test",
+			Email: &mailer.Message{To: admin.Email, Subject: preview.Subject, Body: preview.Body},
+		})
+		preview.SentTo = admin.Email
+		s.logger.Printf("[DEBUG] Test %s/%s email queued for %s", locale, name, admin.Username)
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: localize(r, "Email template rendered"),
+		Data:    preview,
+	})
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"auth-server/pkg/events"
+	"auth-server/pkg/ids"
+)
+
+// eventBufferSize is how many domain events may wait for delivery before
+// new ones are dropped
+const eventBufferSize = 1024
+
+// newEventBusFromConfig starts the event bus with the Kafka and NATS sinks
+// that are configured. With no sinks, events only reach in-process subscribers.
+func newEventBusFromConfig(cfg Config) *events.Bus {
+	var sinks []events.Sink
+
+	if len(cfg.KafkaBrokers) > 0 {
+		sinks = append(sinks, events.NewKafkaSink(cfg.KafkaBrokers, cfg.KafkaTopic))
+		cfg.Logger.Printf("[DEBUG] Publishing events to Kafka topic %s", cfg.KafkaTopic)
+	}
+
+	if cfg.NATSURL != "" {
+		sink, err := events.NewNATSSink(cfg.NATSURL, cfg.NATSSubjectPrefix)
+		if err != nil {
+			cfg.Logger.Printf("[DEBUG] Failed to connect to NATS at %s, NATS events disabled: %v", cfg.NATSURL, err)
+		} else {
+			sinks = append(sinks, sink)
+			cfg.Logger.Printf("[DEBUG] Publishing events to NATS subjects %s.*", cfg.NATSSubjectPrefix)
+		}
+	}
+
+	return events.NewBus(eventBufferSize, cfg.Logger.Writer(), sinks...)
+}
+
+// publishEvent emits a domain event about userID onto the event bus
+func (h *AuthHandler) publishEvent(eventType, userID string, data map[string]string) {
+	h.events.Publish(events.Event{
+		ID:     h.idGenerator.NewID(ids.PrefixEvent),
+		Type:   eventType,
+		UserID: userID,
+		Data:   data,
+	})
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"auth-server/pkg/sessionstore"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// AccountExport is the personal data held about a user, as returned by the
+// GDPR data export
+type AccountExport struct {
+	ExportedAt  time.Time               `json:"exportedAt"`
+	Profile     User                    `json:"profile"`
+	Preferences NotificationPreferences `json:"preferences"`
+	Consents    []ConsentRecord         `json:"consents"`
+	Identities  []Identity              `json:"identities"`
+	Usernames   []UsernameChange        `json:"formerUsernames"`
+	Sessions    []sessionstore.Session  `json:"sessions"`
+	AuditEvents []AuditEvent            `json:"auditEvents"`
+}
+
+// AccountExportHandler returns a download of everything the server stores
+// about the session user. Secrets such as the password hash and API secret
+// are left out.
+func (h *AuthHandler) AccountExportHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Account export request received")
+
+	user := contextUser(r)
+
+	now := h.clock.Now()
+	sessions, err := h.sessions.ForUser(r.Context(), user.ID, now)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to list sessions for export: %v", err)
+		writeStoreError(w, r, err)
+		return
+	}
+	export := AccountExport{
+		ExportedAt:  now,
+		Profile:     user.Sanitized(),
+		Preferences: user.Preferences,
+		Consents:    append([]ConsentRecord{}, user.Consents...),
+		Identities:  append([]Identity{}, user.Identities...),
+		Usernames:   append([]UsernameChange{}, user.UsernameHistory...),
+		Sessions:    sessions,
+		AuditEvents: []AuditEvent{},
+	}
+	for _, event := range h.audit.Recent(0) {
+		if event.UserID == user.ID {
+			export.AuditEvents = append(export.AuditEvents, event)
+		}
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:   AuditAccountExported,
+		UserID: user.ID,
+		IP:     clientIP(r),
+	})
+
+	w.Header().Set("Content-Disposition", `attachment; filename="account-export.json"`)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(export)
+	h.logger.Printf("[DEBUG] Account exported for user: %s", user.Username)
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"auth-server/pkg/emailpolicy"
+	"auth-server/pkg/flags"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Built-in feature flags
+const (
+	// FlagRegistrationOpen lets new accounts register. Tenants in its
+	// list can still register while it is rolled out to nobody else.
+	FlagRegistrationOpen = "registration_open"
+	// FlagRequireEmailVerification is reserved for requiring a verified
+	// email address before login
+	FlagRequireEmailVerification = "require_email_verification"
+	// FlagBetaEndpoints guards routes wrapped with RequireFlag
+	FlagBetaEndpoints = "beta_endpoints"
+)
+
+// defaultFlags are the built-in flags and their settings before
+// FEATURE_FLAGS or the admin API change them
+var defaultFlags = []flags.Flag{
+	{Name: FlagRegistrationOpen, Description: "New accounts can register", Enabled: true, Rollout: 100},
+	{Name: FlagRequireEmailVerification, Description: "Require a verified email address before login"},
+	{Name: FlagBetaEndpoints, Description: "Beta API endpoints are available"},
+}
+
+// FlagRequest changes a feature flag; omitted fields keep their current
+// values
+type FlagRequest struct {
+	Enabled *bool     `json:"enabled"`
+	Rollout *int      `json:"rollout"`
+	Users   *[]string `json:"users"`
+	Tenants *[]string `json:"tenants"`
+}
+
+// newFlagsFromConfig defines the built-in flags and applies FEATURE_FLAGS
+func newFlagsFromConfig(cfg Config) *flags.Set {
+	set := flags.NewSet(defaultFlags...)
+	for name, rollout := range cfg.FeatureFlags {
+		flag, err := set.Get(name)
+		if err != nil {
+			cfg.Logger.Printf("[DEBUG] Ignoring FEATURE_FLAGS setting for unknown flag %q", name)
+			continue
+		}
+		flag.Enabled = rollout > 0
+		flag.Rollout = rollout
+		set.Update(flag)
+	}
+	return set
+}
+
+// tenantOf returns the tenant an email address belongs to: its domain
+func tenantOf(email string) string {
+	domain, err := emailpolicy.Domain(email)
+	if err != nil {
+		return ""
+	}
+	return domain
+}
+
+// flagSubject returns who flags are evaluated for on r: the session user
+// and their tenant, or nobody
+func (h *AuthHandler) flagSubject(r *http.Request) flags.Subject {
+	user, err := h.sessionUser(r)
+	if err != nil {
+		return flags.Subject{}
+	}
+	return flags.Subject{UserID: user.ID, Tenant: userOrganization(user)}
+}
+
+// DefineFlag adds a feature flag for an embedding application. Defining a
+// flag that exists keeps its current settings.
+func (s *Server) DefineFlag(flag flags.Flag) {
+	s.authHandler.flags.Define(flag)
+}
+
+// FlagEnabled reports whether a feature flag is on for the caller of r
+func (s *Server) FlagEnabled(name string, r *http.Request) bool {
+	return s.authHandler.flags.Enabled(name, s.authHandler.flagSubject(r))
+}
+
+// RequireFlag only calls next when the flag is on for the caller, and
+// answers 404 otherwise so unreleased routes stay hidden
+func (s *Server) RequireFlag(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.FlagEnabled(name, r) {
+			s.logger.Printf("[DEBUG] Flag %s is off for %s", name, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// FlagsHandler tells the caller which flags are on for them
+func (s *Server) FlagsHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Flags request received")
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Flags retrieved successfully"),
+		Data:    s.authHandler.flags.Evaluate(s.authHandler.flagSubject(r)),
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// AdminFlagsHandler lists every flag with its settings
+func (s *Server) AdminFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Admin flags request received")
+
+	if _, ok := s.authHandler.requireAdmin(w, r); !ok {
+		return
+	}
+
+	response := Response{
+		Success: true,
+		Message: "Flags retrieved successfully",
+		Data:    s.authHandler.flags.List(),
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// AdminFlagUpdateHandler changes a flag's settings
+func (s *Server) AdminFlagUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Flag update request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	flag, err := s.authHandler.flags.Get(mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, "Flag not found", http.StatusNotFound)
+		return
+	}
+
+	var req FlagRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+	if req.Enabled != nil {
+		flag.Enabled = *req.Enabled
+	}
+	if req.Rollout != nil {
+		flag.Rollout = *req.Rollout
+	}
+	if req.Users != nil {
+		flag.Users = *req.Users
+	}
+	if req.Tenants != nil {
+		flag.Tenants = *req.Tenants
+	}
+
+	flag, err = s.authHandler.flags.Update(flag)
+	if errors.Is(err, flags.ErrInvalidRollout) {
+		http.Error(w, "Rollout must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Flag not found", http.StatusNotFound)
+		return
+	}
+	s.logger.Printf("[DEBUG] Flag %s updated by %s", flag.Name, admin.Username)
+
+	s.audit.Record(AuditEvent{
+		Type:   AuditFlagChanged,
+		UserID: admin.ID,
+		IP:     clientIP(r),
+		Details: map[string]string{
+			"flag":    flag.Name,
+			"enabled": strconv.FormatBool(flag.Enabled),
+			"rollout": strconv.Itoa(flag.Rollout),
+			"users":   strings.Join(flag.Users, ","),
+			"tenants": strings.Join(flag.Tenants, ","),
+		},
+	})
+
+	response := Response{
+		Success: true,
+		Message: "Flag updated successfully",
+		Data:    flag,
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
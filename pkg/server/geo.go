@@ -0,0 +1,204 @@
+package server
+
+import (
+	"auth-server/pkg/geoip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GeoPolicyRequest represents an update to the country login restrictions
+type GeoPolicyRequest struct {
+	AllowedCountries []string `json:"allowedCountries"`
+}
+
+// geoPolicy applies location-based login rules. All checks are skipped
+// when no GeoIP database is configured.
+type geoPolicy struct {
+	locator           geoip.Locator
+	maxTravelSpeedKmh float64
+
+	mutex            sync.RWMutex
+	allowedCountries []string // empty means every country is allowed
+}
+
+// newGeoPolicyFromConfig opens the configured GeoIP database, if any
+func newGeoPolicyFromConfig(cfg Config) *geoPolicy {
+	policy := &geoPolicy{
+		maxTravelSpeedKmh: cfg.ImpossibleTravelSpeedKmh,
+		allowedCountries:  normalizeCountries(cfg.GeoAllowedCountries),
+	}
+
+	if cfg.GeoIPDatabase != "" {
+		locator, err := geoip.OpenMaxMind(cfg.GeoIPDatabase)
+		if err != nil {
+			cfg.Logger.Printf("[DEBUG] Failed to open GeoIP database %s, location policy disabled: %v", cfg.GeoIPDatabase, err)
+		} else {
+			policy.locator = locator
+		}
+	}
+
+	return policy
+}
+
+// evaluate looks up ip and reports whether logging in from it is allowed.
+// Loopback and private addresses are never restricted. Public addresses
+// with no known country are refused while a country restriction is active.
+func (p *geoPolicy) evaluate(ip string) (geoip.Location, bool, bool) {
+	if p.locator == nil {
+		return geoip.Location{}, false, true
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() {
+		return geoip.Location{}, false, true
+	}
+
+	location, err := p.locator.Lookup(addr)
+	located := err == nil
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if len(p.allowedCountries) == 0 {
+		return location, located, true
+	}
+	if !located {
+		return location, false, false
+	}
+	for _, country := range p.allowedCountries {
+		if country == location.Country {
+			return location, true, true
+		}
+	}
+	return location, true, false
+}
+
+// travelSpeedKmh returns the speed implied by moving between two login
+// locations, or 0 when it cannot be determined
+func travelSpeedKmh(from *geoip.Location, fromTime time.Time, to geoip.Location, toTime time.Time) float64 {
+	if from == nil || !from.HasCoordinates || !to.HasCoordinates {
+		return 0
+	}
+
+	distance := geoip.DistanceKm(*from, to)
+	hours := toTime.Sub(fromTime).Hours()
+	if hours <= 0 {
+		// Simultaneous logins from distinct places are treated as a minute apart
+		hours = 1.0 / 60
+	}
+	return distance / hours
+}
+
+// checkImpossibleTravel compares a login with the user's previous one and
+// raises an audit event and email notification when the implied travel
+// speed exceeds the configured maximum
+func (h *AuthHandler) checkImpossibleTravel(r *http.Request, user *User, ip string, location geoip.Location, now time.Time) {
+	if user.LastLoginAt == nil || h.geo.maxTravelSpeedKmh <= 0 {
+		return
+	}
+
+	speed := travelSpeedKmh(user.LastLoginLocation, *user.LastLoginAt, location, now)
+	if speed <= h.geo.maxTravelSpeedKmh {
+		return
+	}
+
+	previousCountry := user.LastLoginLocation.Country
+	h.audit.Record(AuditEvent{
+		Type:   AuditImpossibleTravel,
+		UserID: user.ID,
+		IP:     ip,
+		Details: map[string]string{
+			"country":         location.Country,
+			"previousCountry": previousCountry,
+			"previousIp":      user.LastLoginIP,
+			"speedKmh":        fmt.Sprintf("%.0f", speed),
+		},
+	})
+
+	h.notify(r, user, NotifySecurityAlert, "impossible_travel", map[string]string{
+		"Username":        user.Username,
+		"Country":         location.Country,
+		"IP":              ip,
+		"Time":            now.Format(time.RFC1123),
+		"PreviousCountry": previousCountry,
+		"PreviousIP":      user.LastLoginIP,
+		"PreviousTime":    user.LastLoginAt.Format(time.RFC1123),
+	})
+}
+
+// GeoPolicyHandler returns the country login restrictions on GET and
+// replaces them on PUT
+func (s *Server) GeoPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Geo policy request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	policy := s.authHandler.geo
+
+	if r.Method == http.MethodPut {
+		var req GeoPolicyRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+			writeBodyError(w, r, err)
+			return
+		}
+
+		countries := normalizeCountries(req.AllowedCountries)
+		for _, country := range countries {
+			if len(country) != 2 {
+				s.logger.Printf("[DEBUG] Invalid country code: %s", country)
+				http.Error(w, "Countries must be ISO 3166-1 alpha-2 codes", http.StatusBadRequest)
+				return
+			}
+		}
+
+		policy.mutex.Lock()
+		policy.allowedCountries = countries
+		policy.mutex.Unlock()
+
+		s.audit.Record(AuditEvent{
+			Type:    AuditGeoPolicyChanged,
+			UserID:  admin.ID,
+			IP:      clientIP(r),
+			Details: map[string]string{"allowedCountries": strings.Join(countries, ",")},
+		})
+	}
+
+	policy.mutex.RLock()
+	data := map[string]interface{}{
+		"enabled":           policy.locator != nil,
+		"allowedCountries":  append([]string{}, policy.allowedCountries...),
+		"maxTravelSpeedKmh": policy.maxTravelSpeedKmh,
+	}
+	policy.mutex.RUnlock()
+
+	response := Response{
+		Success: true,
+		Message: "Geo policy retrieved successfully",
+		Data:    data,
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// normalizeCountries upper-cases and de-duplicates country codes
+func normalizeCountries(countries []string) []string {
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, country := range countries {
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if country != "" && !seen[country] {
+			seen[country] = true
+			normalized = append(normalized, country)
+		}
+	}
+	return normalized
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"auth-server/pkg/graphql"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// graphqlCall is the HTTP exchange a GraphQL operation runs in, which
+// resolvers need to find the session and to pass on cookies
+type graphqlCall struct {
+	w http.ResponseWriter
+	r *http.Request
+}
+
+// graphqlCallKey is the context key for graphqlCall
+type graphqlCallKey struct{}
+
+func graphqlCallFrom(ctx context.Context) graphqlCall {
+	call, _ := ctx.Value(graphqlCallKey{}).(graphqlCall)
+	return call
+}
+
+// graphqlUser are the fields of a user, named as in the REST API
+var graphqlUser = &graphql.Object{
+	Name: "User",
+	Fields: map[string]*graphql.FieldDef{
+		"id":                  {},
+		"username":            {},
+		"email":               {},
+		"role":                {},
+		"created":             {},
+		"organization":        {},
+		"tier":                {},
+		"updatedAt":           {},
+		"lastLoginAt":         {},
+		"passwordChangedAt":   {},
+		"emailVerifiedAt":     {},
+		"locale":              {},
+		"displayName":         {},
+		"avatarUrl":           {},
+		"bio":                 {},
+		"phone":               {},
+		"twoFactorEnabled":    {},
+		"smsTwoFactorEnabled": {},
+	},
+}
+
+// graphqlPublicProfile is what anyone can see of a user
+var graphqlPublicProfile = &graphql.Object{
+	Name: "PublicProfile",
+	Fields: map[string]*graphql.FieldDef{
+		"username":    {},
+		"displayName": {},
+		"avatarUrl":   {},
+		"bio":         {},
+	},
+}
+
+// graphqlAuthPayload is the outcome of a mutation: the REST endpoint's
+// status and message, the user it returned and, for logins, what else is
+// needed to sign in
+var graphqlAuthPayload = &graphql.Object{
+	Name: "AuthPayload",
+	Fields: map[string]*graphql.FieldDef{
+		"success":           {},
+		"status":            {},
+		"message":           {},
+		"user":              {Type: graphqlUser},
+		"accessToken":       {},
+		"twoFactorRequired": {},
+		"captchaRequired":   {},
+	},
+}
+
+// newGraphQLSchema returns the schema of the GraphQL facade. Queries read
+// the session and the user store; mutations run the REST endpoints.
+func (s *Server) newGraphQLSchema() *graphql.Schema {
+	return &graphql.Schema{
+		Query: &graphql.Object{
+			Name: "Query",
+			Fields: map[string]*graphql.FieldDef{
+				"viewer": {Type: graphqlUser, Resolve: s.resolveViewer},
+				"profile": {
+					Type:    graphqlPublicProfile,
+					Args:    map[string]graphql.ArgDef{"username": {Type: graphql.String, Required: true}},
+					Resolve: s.resolveProfile,
+				},
+			},
+		},
+		Mutation: &graphql.Object{
+			Name: "Mutation",
+			Fields: map[string]*graphql.FieldDef{
+				"login": {
+					Type: graphqlAuthPayload,
+					Args: map[string]graphql.ArgDef{
+						"username":     {Type: graphql.String, Required: true},
+						"password":     {Type: graphql.String, Required: true},
+						"totpCode":     {Type: graphql.String},
+						"smsCode":      {Type: graphql.String},
+						"recoveryCode": {Type: graphql.String},
+						"captchaToken": {Type: graphql.String},
+						"acceptTerms":  {Type: graphql.Boolean},
+						"transport":    {Type: graphql.String},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return s.graphqlSubmit(p.Context, "/api/login", p.Args)
+					},
+				},
+				"register": {
+					Type: graphqlAuthPayload,
+					Args: map[string]graphql.ArgDef{
+						"username":     {Type: graphql.String, Required: true},
+						"email":        {Type: graphql.String, Required: true},
+						"password":     {Type: graphql.String, Required: true},
+						"captchaToken": {Type: graphql.String},
+						"locale":       {Type: graphql.String},
+						"acceptTerms":  {Type: graphql.Boolean},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return s.graphqlSubmit(p.Context, "/api/register", p.Args)
+					},
+				},
+				"changePassword": {
+					Type: graphqlAuthPayload,
+					Args: map[string]graphql.ArgDef{
+						"currentPassword": {Type: graphql.String, Required: true},
+						"newPassword":     {Type: graphql.String, Required: true},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return s.graphqlSubmit(p.Context, "/api/change-password", p.Args)
+					},
+				},
+			},
+		},
+	}
+}
+
+// graphqlValue converts v to the form resolvers return, with the field
+// names of its JSON encoding
+func graphqlValue(v interface{}) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var value map[string]interface{}
+	return value, json.Unmarshal(encoded, &value)
+}
+
+// graphqlStoreError is the error a field reports for a failed store or
+// session lookup, with the message the REST API would answer
+func graphqlStoreError(r *http.Request, err error) error {
+	_, message := storeErrorStatus(err)
+	return errors.New(localize(r, message))
+}
+
+// resolveViewer returns the session user, or null without a session
+func (s *Server) resolveViewer(p graphql.ResolveParams) (interface{}, error) {
+	r := graphqlCallFrom(p.Context).r
+	user, err := s.authHandler.sessionUser(r)
+	if isContextError(err) || errors.Is(err, errSessionsUnavailable) {
+		return nil, graphqlStoreError(r, err)
+	}
+	if err != nil {
+		return nil, nil
+	}
+	return graphqlValue(user.Sanitized())
+}
+
+// resolveProfile returns a user's public profile, following usernames
+// they gave up, or null when it is not public
+func (s *Server) resolveProfile(p graphql.ResolveParams) (interface{}, error) {
+	username := p.Args["username"].(string)
+	user, err := s.authHandler.users.GetByUsername(p.Context, username)
+	if errors.Is(err, ErrUserNotFound) {
+		user, err = s.authHandler.userByFormerUsername(p.Context, username)
+	}
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		s.logger.Printf("[DEBUG] User lookup failed: %v", err)
+		return nil, graphqlStoreError(graphqlCallFrom(p.Context).r, err)
+	}
+	profile, public := publicProfile(user)
+	if !public {
+		return nil, nil
+	}
+	return graphqlValue(profile)
+}
+
+// graphqlSubmit runs a mutation through the router as a JSON POST to path,
+// so it passes the same middleware, handler checks, hooks and audit
+// logging as the REST call, and passes on the cookies it sets
+func (s *Server) graphqlSubmit(ctx context.Context, path string, args map[string]interface{}) (interface{}, error) {
+	call := graphqlCallFrom(ctx)
+	payload, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+
+	req := call.r.Clone(ctx)
+	req.Method = http.MethodPost
+	req.URL.Path, req.URL.RawPath, req.URL.RawQuery = path, "", ""
+	req.RequestURI = req.URL.RequestURI()
+	req.Body = io.NopCloser(bytes.NewReader(payload))
+	req.ContentLength = int64(len(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Del("Idempotency-Key")
+
+	capture := newCaptureWriter()
+	s.router.ServeHTTP(capture, req)
+	result := capture.result()
+	for _, cookie := range result.header.Values("Set-Cookie") {
+		call.w.Header().Add("Set-Cookie", cookie)
+	}
+
+	success := result.status >= 200 && result.status < 300
+	answer := map[string]interface{}{
+		"success": success,
+		"status":  result.status,
+		"message": result.message,
+	}
+	data, _ := result.data.(map[string]interface{})
+	if session, ok := data["user"].(map[string]interface{}); ok {
+		answer["user"] = session
+		answer["accessToken"] = data["access_token"]
+	} else if success && data["username"] != nil {
+		answer["user"] = data
+	}
+	answer["twoFactorRequired"] = data["twoFactorRequired"] == true
+	answer["captchaRequired"] = data["captchaRequired"] == true
+	return answer, nil
+}
+
+// GraphQLHandler answers GraphQL requests: queries as GET with query,
+// operationName and variables parameters or as JSON POSTs, and mutations
+// as JSON POSTs only, so a link cannot change anything. Responses are
+// GraphQL results rather than the REST API's envelope. Operations deeper
+// or more complex than Config.GraphQLMaxDepth and
+// Config.GraphQLMaxComplexity are refused.
+func (s *Server) GraphQLHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] GraphQL request received")
+
+	var req graphql.Request
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		req.Query = query.Get("query")
+		req.OperationName = query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				http.Error(w, localize(r, "Invalid GraphQL variables"), http.StatusBadRequest)
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := decodeJSON(w, r, &req); err != nil {
+			s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+			writeBodyError(w, r, err)
+			return
+		}
+	default:
+		s.logger.Printf("[DEBUG] Invalid method: %s", r.Method)
+		http.Error(w, localize(r, "Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		http.Error(w, localize(r, "A GraphQL query is required"), http.StatusBadRequest)
+		return
+	}
+
+	var result *graphql.Result
+	doc, err := graphql.Parse(req.Query)
+	if err == nil {
+		var op *graphql.Operation
+		if op, err = doc.Operation(req.OperationName); err == nil {
+			if r.Method == http.MethodGet && op.Type != graphql.Query {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, localize(r, "Mutations must be sent as POST requests"), http.StatusMethodNotAllowed)
+				return
+			}
+			ctx := context.WithValue(r.Context(), graphqlCallKey{}, graphqlCall{w: w, r: r})
+			result = s.graphql.Execute(ctx, doc, op, req.Variables, graphql.Limits{
+				MaxDepth:      s.config.GraphQLMaxDepth,
+				MaxComplexity: s.config.GraphQLMaxComplexity,
+			})
+		}
+	}
+	if err != nil {
+		s.logger.Printf("[DEBUG] Invalid GraphQL request: %v", err)
+		result = graphql.ErrorResult(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// graphqlRoutes registers the GraphQL endpoint when it is enabled
+func (s *Server) graphqlRoutes() {
+	if !s.config.GraphQLEnabled {
+		return
+	}
+	s.graphql = s.newGraphQLSchema()
+	s.router.HandleFunc("/graphql", s.GraphQLHandler).Methods("GET", "POST")
+	s.logger.Printf("[DEBUG] GraphQL endpoint registered")
+}
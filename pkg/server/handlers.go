@@ -0,0 +1,395 @@
+package server
+
+import (
+	"auth-server/pkg/base64util"
+	"auth-server/pkg/randutil"
+	"auth-server/pkg/transforms"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Base64EncodeHandler handles base64 encoding requests
+func (s *Server) Base64EncodeHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Base64 encode request received")
+
+	var req struct {
+		Text string `json:"text"`
+	}
+
+	if err := decodeJSON(w, r, &req); err != nil {
+		s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if req.Text == "" {
+		s.logger.Printf("[DEBUG] Empty text provided")
+		http.Error(w, "Text is required", http.StatusBadRequest)
+		return
+	}
+
+	encoder := base64util.NewEncoder()
+	encoded, err := encoder.Encode(req.Text)
+	if err != nil {
+		s.logger.Printf("[DEBUG] Encoding failed: %v", err)
+		http.Error(w, "Encoding failed", http.StatusInternalServerError)
+		return
+	}
+
+	response := Response{
+		Success: true,
+		Message: "Text encoded successfully",
+		Data: map[string]interface{}{
+			"original": req.Text,
+			"encoded":  encoded,
+		},
+	}
+
+	s.logger.Printf("[DEBUG] Base64 encoding successful for text: %s", req.Text)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Base64DecodeHandler handles base64 decoding requests
+func (s *Server) Base64DecodeHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Base64 decode request received")
+
+	var req struct {
+		Text string `json:"text"`
+	}
+
+	if err := decodeJSON(w, r, &req); err != nil {
+		s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if req.Text == "" {
+		s.logger.Printf("[DEBUG] Empty text provided")
+		http.Error(w, "Text is required", http.StatusBadRequest)
+		return
+	}
+
+	encoder := base64util.NewEncoder()
+	data := map[string]interface{}{
+		"original": req.Text,
+	}
+
+	// Accept pasted data URIs as well as bare base64
+	if encoder.IsDataURI(req.Text) {
+		mimeType, decoded, err := encoder.ParseDataURI(req.Text)
+		if err != nil {
+			s.logger.Printf("[DEBUG] Data URI decoding failed: %v", err)
+			http.Error(w, "Invalid data URI", http.StatusBadRequest)
+			return
+		}
+		data["decoded"] = string(decoded)
+		data["mimeType"] = mimeType
+	} else {
+		decoded, err := encoder.Decode(req.Text)
+		if err != nil {
+			s.logger.Printf("[DEBUG] Decoding failed: %v", err)
+			http.Error(w, "Invalid base64 text", http.StatusBadRequest)
+			return
+		}
+		data["decoded"] = decoded
+	}
+
+	response := Response{
+		Success: true,
+		Message: "Text decoded successfully",
+		Data:    data,
+	}
+
+	s.logger.Printf("[DEBUG] Base64 decoding successful for text: %s", req.Text)
+	json.NewEncoder(w).Encode(response)
+}
+
+// maxEncodeFileSize limits the size of files accepted by the file encode endpoint
+const maxEncodeFileSize = 10 << 20 // 10 MB
+
+// Base64EncodeFileHandler encodes an uploaded multipart file to base64,
+// returning either raw base64 or a data URI with the detected MIME type
+func (s *Server) Base64EncodeFileHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Base64 file encode request received")
+
+	// Leave headroom for multipart boundaries and other form fields
+	r.Body = http.MaxBytesReader(w, r.Body, maxEncodeFileSize+(1<<20))
+	if err := r.ParseMultipartForm(maxEncodeFileSize); err != nil {
+		s.logger.Printf("[DEBUG] Failed to parse multipart form: %v", err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid multipart form", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = "raw"
+	}
+	if format != "raw" && format != "datauri" {
+		s.logger.Printf("[DEBUG] Invalid format: %s", format)
+		http.Error(w, "Format must be \"raw\" or \"datauri\"", http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		s.logger.Printf("[DEBUG] Missing file field: %v", err)
+		http.Error(w, "File is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxEncodeFileSize {
+		s.logger.Printf("[DEBUG] File too large: %d bytes", header.Size)
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Sniff the MIME type from the first 512 bytes, falling back to the
+	// client-supplied type when the content is not recognised
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(file, sniff)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		s.logger.Printf("[DEBUG] Failed to read uploaded file: %v", err)
+		http.Error(w, "Failed to read file", http.StatusBadRequest)
+		return
+	}
+	sniff = sniff[:n]
+
+	mimeType := http.DetectContentType(sniff)
+	if mimeType == "application/octet-stream" {
+		if declared := header.Header.Get("Content-Type"); declared != "" {
+			mimeType = declared
+		}
+	}
+
+	var encoded strings.Builder
+	encoder := base64util.NewEncoder()
+	if format == "datauri" {
+		encoded.WriteString(encoder.DataURIPrefix(mimeType))
+	}
+
+	size, err := encoder.EncodeStream(io.MultiReader(bytes.NewReader(sniff), file), &encoded)
+	if err != nil {
+		s.logger.Printf("[DEBUG] File encoding failed: %v", err)
+		http.Error(w, "Encoding failed", http.StatusBadRequest)
+		return
+	}
+
+	response := Response{
+		Success: true,
+		Message: "File encoded successfully",
+		Data: map[string]interface{}{
+			"filename": header.Filename,
+			"mimeType": mimeType,
+			"size":     size,
+			"format":   format,
+			"encoded":  encoded.String(),
+		},
+	}
+
+	s.logger.Printf("[DEBUG] Base64 file encoding successful for %s (%d bytes)", header.Filename, size)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Base64EncodeStreamHandler encodes a raw request body to base64, streaming
+// the result back so large payloads are never fully buffered in memory
+func (s *Server) Base64EncodeStreamHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Base64 stream encode request received")
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	out := &trackingWriter{w: w}
+
+	encoder := base64util.NewEncoder()
+	n, err := encoder.EncodeStream(r.Body, out)
+	if err != nil {
+		s.logger.Printf("[DEBUG] Stream encoding failed after %d bytes: %v", n, err)
+		streamError(w, out, "Encoding failed", http.StatusBadRequest)
+		return
+	}
+
+	s.logger.Printf("[DEBUG] Base64 stream encoding successful for %d bytes", n)
+}
+
+// Base64DecodeStreamHandler decodes a raw base64 request body, streaming the
+// decoded bytes back so large payloads are never fully buffered in memory
+func (s *Server) Base64DecodeStreamHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Base64 stream decode request received")
+
+	encoder := base64util.NewEncoder()
+	body := bufio.NewReader(r.Body)
+
+	// A data URI body is decoded like bare base64. Its MIME type is not
+	// echoed, since the caller could choose one the browser would render
+	// on this origin.
+	if _, _, err := encoder.ReadDataURIHeader(body); err != nil {
+		s.logger.Printf("[DEBUG] Invalid data URI header: %v", err)
+		http.Error(w, "Invalid data URI", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", "attachment")
+	out := &trackingWriter{w: w}
+
+	n, err := encoder.DecodeStream(body, out)
+	if err != nil {
+		s.logger.Printf("[DEBUG] Stream decoding failed after %d bytes: %v", n, err)
+		streamError(w, out, "Invalid base64 text", http.StatusBadRequest)
+		return
+	}
+
+	s.logger.Printf("[DEBUG] Base64 stream decoding successful, %d bytes written", n)
+}
+
+// trackingWriter records whether any bytes have reached the client, which
+// decides whether a streaming handler can still report an error status
+type trackingWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		t.written = true
+	}
+	return t.w.Write(p)
+}
+
+// streamError reports a failure in a streaming handler. If output has already
+// been sent the status can no longer change, so the connection is aborted to
+// make the truncation visible to the client.
+func streamError(w http.ResponseWriter, out *trackingWriter, message string, status int) {
+	if out.written {
+		panic(http.ErrAbortHandler)
+	}
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Disposition")
+	http.Error(w, message, status)
+}
+
+// TransformHandler runs text through any registered codec (base64, base32, hex, url)
+func (s *Server) TransformHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Transform request received")
+
+	var req TransformRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	output, err := transforms.Transform(req.Codec, req.Direction, req.Input)
+	if err != nil {
+		s.logger.Printf("[DEBUG] Transform failed for codec %q: %v", req.Codec, err)
+		message := err.Error()
+		if errors.Is(err, transforms.ErrUnknownCodec) {
+			message = fmt.Sprintf("Unknown codec, supported codecs: %s", strings.Join(transforms.Names(), ", "))
+		}
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	response := Response{
+		Success: true,
+		Message: "Text transformed successfully",
+		Data: map[string]interface{}{
+			"codec":     strings.ToLower(req.Codec),
+			"direction": strings.ToLower(req.Direction),
+			"input":     req.Input,
+			"output":    output,
+		},
+	}
+
+	s.logger.Printf("[DEBUG] Transform successful: codec=%s direction=%s", req.Codec, req.Direction)
+	json.NewEncoder(w).Encode(response)
+}
+
+// RandomHandler returns cryptographically secure random values formatted as
+// hex, base64 (URL-safe, unpadded) or a v4 UUID
+func (s *Server) RandomHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Random request received")
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "hex"
+	}
+
+	size := 32
+	if value := r.URL.Query().Get("bytes"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			s.logger.Printf("[DEBUG] Invalid bytes parameter: %s", value)
+			http.Error(w, "bytes must be an integer", http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+
+	var value string
+	var err error
+	switch format {
+	case "hex":
+		value, err = randutil.Hex(size)
+	case "base64":
+		value, err = randutil.Base64(size)
+	case "uuid":
+		size = 16
+		value, err = randutil.UUID()
+	default:
+		s.logger.Printf("[DEBUG] Invalid format: %s", format)
+		http.Error(w, "Format must be hex, base64 or uuid", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		s.logger.Printf("[DEBUG] Random generation failed: %v", err)
+		if errors.Is(err, randutil.ErrInvalidLength) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := Response{
+		Success: true,
+		Message: "Random value generated successfully",
+		Data: map[string]interface{}{
+			"format": format,
+			"bytes":  size,
+			"value":  value,
+		},
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HealthHandler provides a health check endpoint
+func (s *Server) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	response := Response{
+		Success: true,
+		Message: "Server is healthy",
+		Data: map[string]interface{}{
+			"timestamp": time.Now().Format(time.RFC3339),
+			"status":    "running",
+		},
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
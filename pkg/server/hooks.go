@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// HookError rejects an auth flow from a pre hook with a client-facing
+// status and message
+type HookError struct {
+	Status  int
+	Message string
+}
+
+func (e *HookError) Error() string {
+	return e.Message
+}
+
+// Reject returns an error that makes a pre hook abort the flow with status
+// and message
+func Reject(status int, message string) error {
+	return &HookError{Status: status, Message: message}
+}
+
+// Hook callback signatures. Pre hooks run before the action and abort it by
+// returning an error; post hooks run after it succeeds and should return
+// quickly, since they run on the request goroutine.
+type (
+	PreRegisterHook        func(ctx context.Context, req RegisterRequest) error
+	PostRegisterHook       func(ctx context.Context, user User)
+	PreLoginHook           func(ctx context.Context, username, ip string) error
+	PostLoginHook          func(ctx context.Context, user User)
+	PostPasswordChangeHook func(ctx context.Context, user User)
+)
+
+// Hooks holds custom logic registered for the auth flows. Register hooks
+// through Server.Hooks before the server starts handling requests.
+type Hooks struct {
+	mutex              sync.RWMutex
+	preRegister        []PreRegisterHook
+	postRegister       []PostRegisterHook
+	preLogin           []PreLoginHook
+	postLogin          []PostLoginHook
+	postPasswordChange []PostPasswordChangeHook
+}
+
+// PreRegister adds a hook run before an account is created, e.g. for
+// custom validation
+func (h *Hooks) PreRegister(fn PreRegisterHook) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.preRegister = append(h.preRegister, fn)
+}
+
+// PostRegister adds a hook run after an account is created
+func (h *Hooks) PostRegister(fn PostRegisterHook) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.postRegister = append(h.postRegister, fn)
+}
+
+// PreLogin adds a hook run before credentials are checked
+func (h *Hooks) PreLogin(fn PreLoginHook) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.preLogin = append(h.preLogin, fn)
+}
+
+// PostLogin adds a hook run after a successful login
+func (h *Hooks) PostLogin(fn PostLoginHook) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.postLogin = append(h.postLogin, fn)
+}
+
+// PostPasswordChange adds a hook run after a user changes their password
+func (h *Hooks) PostPasswordChange(fn PostPasswordChangeHook) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.postPasswordChange = append(h.postPasswordChange, fn)
+}
+
+func (h *Hooks) runPreRegister(ctx context.Context, req RegisterRequest) error {
+	h.mutex.RLock()
+	hooks := h.preRegister
+	h.mutex.RUnlock()
+
+	for _, fn := range hooks {
+		if err := fn(ctx, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Hooks) runPostRegister(ctx context.Context, user User) {
+	h.mutex.RLock()
+	hooks := h.postRegister
+	h.mutex.RUnlock()
+
+	for _, fn := range hooks {
+		fn(ctx, user)
+	}
+}
+
+func (h *Hooks) runPreLogin(ctx context.Context, username, ip string) error {
+	h.mutex.RLock()
+	hooks := h.preLogin
+	h.mutex.RUnlock()
+
+	for _, fn := range hooks {
+		if err := fn(ctx, username, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Hooks) runPostLogin(ctx context.Context, user User) {
+	h.mutex.RLock()
+	hooks := h.postLogin
+	h.mutex.RUnlock()
+
+	for _, fn := range hooks {
+		fn(ctx, user)
+	}
+}
+
+func (h *Hooks) runPostPasswordChange(ctx context.Context, user User) {
+	h.mutex.RLock()
+	hooks := h.postPasswordChange
+	h.mutex.RUnlock()
+
+	for _, fn := range hooks {
+		fn(ctx, user)
+	}
+}
+
+// hookRejection maps a pre hook error to the status and message returned
+// to the client. Errors other than HookError hide their details.
+func (h *AuthHandler) hookRejection(err error) (int, string) {
+	var hookErr *HookError
+	if errors.As(err, &hookErr) {
+		return hookErr.Status, hookErr.Message
+	}
+	h.logger.Printf("[DEBUG] Pre hook failed: %v", err)
+	return http.StatusForbidden, "Request rejected"
+}
+
+// Hooks returns the server's hook registry
+func (s *Server) Hooks() *Hooks {
+	return s.authHandler.hooks
+}
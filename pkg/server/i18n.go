@@ -0,0 +1,118 @@
+package server
+
+import (
+	"auth-server/pkg/i18n"
+	"auth-server/pkg/mailer"
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// translations holds the message catalogs and email templates
+var translations = i18n.Default()
+
+// localeKey is the request context key for the negotiated locale
+type localeKey struct{}
+
+// localeMiddleware picks the language for each response: the session
+// user's saved preference, then the Accept-Language header
+func (s *Server) localeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locale := translations.Negotiate(r.Header.Get("Accept-Language"))
+		if user, err := s.authHandler.sessionUser(r); err == nil && user.Locale != "" {
+			locale = user.Locale
+		}
+
+		w.Header().Set("Content-Language", locale)
+		w.Header().Add("Vary", "Accept-Language")
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), localeKey{}, locale)))
+	})
+}
+
+// requestLocale returns the locale chosen for r, negotiating it from the
+// headers when the middleware has not run
+func requestLocale(r *http.Request) string {
+	if locale, ok := r.Context().Value(localeKey{}).(string); ok {
+		return locale
+	}
+	return translations.Negotiate(r.Header.Get("Accept-Language"))
+}
+
+// localize translates msg into the request's language, formatting it with
+// args when any are given
+func localize(r *http.Request, msg string, args ...interface{}) string {
+	if len(args) > 0 {
+		return translations.Sprintf(requestLocale(r), msg, args...)
+	}
+	return translations.T(requestLocale(r), msg)
+}
+
+// userLocale returns the language to email user in: their preference, or
+// the language of the current request
+func userLocale(user *User, r *http.Request) string {
+	if user.Locale != "" {
+		return user.Locale
+	}
+	return requestLocale(r)
+}
+
+// sendEmail renders a localized email template for user, or the
+// operator's override of it, and queues it in the outbox, which sends it
+// in the background so the request is not delayed by the mail server and
+// retries it should sending fail
+func (h *AuthHandler) sendEmail(ctx context.Context, user *User, locale, template string, data interface{}) {
+	subject, body, err := h.emailTemplates.render(locale, template, data)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to render %s email: %v", template, err)
+		return
+	}
+	h.enqueue(ctx, OutboxMessage{
+		Kind:  OutboxKindEmail,
+		Label: template,
+		Email: &mailer.Message{To: user.Email, Subject: subject, Body: body},
+	})
+}
+
+// ChangeLocaleHandler saves the session user's preferred language for API
+// messages and emails
+func (h *AuthHandler) ChangeLocaleHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Locale change request received")
+
+	user := contextUser(r)
+
+	var req ChangeLocaleRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if req.Locale == "" {
+		http.Error(w, localize(r, "Locale is required"), http.StatusBadRequest)
+		return
+	}
+	if !translations.Supports(req.Locale) {
+		h.logger.Printf("[DEBUG] Unsupported locale: %s", req.Locale)
+		http.Error(w, localize(r, "Unsupported locale"), http.StatusBadRequest)
+		return
+	}
+
+	user.Locale = req.Locale
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to store locale for %s: %v", user.Username, err)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	// Answer in the newly chosen language
+	response := Response{
+		Success: true,
+		Message: translations.T(user.Locale, "Locale updated successfully"),
+		Data:    map[string]interface{}{"locale": user.Locale, "supported": translations.Locales()},
+	}
+
+	w.Header().Set("Content-Language", user.Locale)
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Locale set to %s for user: %s", user.Locale, user.Username)
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Idempotency-Key handling. A POST carrying the header has its response
+// stored for Config.IdempotencyTTL; retries with the same key and body get
+// the stored response instead of running the handler again.
+const (
+	idempotencyHeader         = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+
+	// Requests and responses larger than this are not cached, so the
+	// streaming endpoints are unaffected
+	maxIdempotentBodySize = 1 << 20
+)
+
+// idempotencyStore remembers responses by scoped key
+type idempotencyStore struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[string]*idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	requestHash string
+	done        bool // false while the first request is still running
+	status      int
+	header      http.Header
+	body        []byte
+	expiresAt   time.Time
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		ttl:     ttl,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// begin claims key for a request. It returns the stored entry when the key
+// is already known, or nil when the caller should run the request.
+func (s *idempotencyStore) begin(key, requestHash string, now time.Time) *idempotencyEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if entry, ok := s.entries[key]; ok && now.Before(entry.expiresAt) {
+		copied := *entry
+		return &copied
+	}
+	s.entries[key] = &idempotencyEntry{requestHash: requestHash, expiresAt: now.Add(s.ttl)}
+	return nil
+}
+
+// finish stores the response for a claimed key
+func (s *idempotencyStore) finish(key string, status int, header http.Header, body []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if entry, ok := s.entries[key]; ok {
+		entry.done = true
+		entry.status = status
+		entry.header = header
+		entry.body = body
+	}
+}
+
+// release forgets a claimed key so the request can be retried
+func (s *idempotencyStore) release(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.entries, key)
+}
+
+// Purge removes expired entries and returns how many were removed
+func (s *idempotencyStore) Purge(now time.Time) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	purged := 0
+	for key, entry := range s.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(s.entries, key)
+			purged++
+		}
+	}
+	return purged
+}
+
+// idempotencyMiddleware replays the stored response for a repeated
+// Idempotency-Key. Keys are scoped to the route and the caller's
+// credentials, and reusing a key with a different body is rejected.
+// Server errors are not stored so the client can retry them.
+func (s *Server) idempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, localize(r, "Idempotency-Key is too long"), http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBodySize+1))
+		if err != nil {
+			http.Error(w, localize(r, "Invalid request body"), http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxIdempotentBodySize {
+			// Too large to hash and replay; run it as a normal request
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scopedKey := idempotencyScope(r, s.config.SessionCookieName, key)
+		requestHash := hashIdempotentRequest(r, body)
+
+		if entry := s.idempotency.begin(scopedKey, requestHash, s.authHandler.clock.Now()); entry != nil {
+			switch {
+			case entry.requestHash != requestHash:
+				s.logger.Printf("[DEBUG] Idempotency key reused with a different request: %s", r.URL.Path)
+				http.Error(w, localize(r, "Idempotency-Key was already used for a different request"), http.StatusUnprocessableEntity)
+			case !entry.done:
+				http.Error(w, localize(r, "A request with this Idempotency-Key is still in progress"), http.StatusConflict)
+			default:
+				s.logger.Printf("[DEBUG] Replaying stored response for idempotency key on %s", r.URL.Path)
+				for name, values := range entry.header {
+					w.Header()[name] = values
+				}
+				w.Header().Set(idempotencyReplayedHeader, "true")
+				w.WriteHeader(entry.status)
+				w.Write(entry.body)
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status >= 500 || recorder.overflow {
+			s.idempotency.release(scopedKey)
+			return
+		}
+		s.idempotency.finish(scopedKey, recorder.status, w.Header().Clone(), recorder.body.Bytes())
+	})
+}
+
+// idempotencyScope binds a key to the route and to whoever sent it, so one
+// caller cannot replay another's responses
+func idempotencyScope(r *http.Request, cookieName, key string) string {
+	h := sha256.New()
+	for _, part := range []string{r.URL.Path, r.Header.Get("Authorization"), sessionCookieValue(r, cookieName), key} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashIdempotentRequest fingerprints the request a key was first used with
+func hashIdempotentRequest(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.URL.RawQuery))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sessionCookieValue returns the raw session cookie, if any
+func sessionCookieValue(r *http.Request, name string) string {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	overflow    bool
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	rec.wroteHeader = true
+	if !rec.overflow {
+		if rec.body.Len()+len(p) > maxIdempotentBodySize {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// Flush keeps streaming handlers working behind the recorder
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"auth-server/pkg/ids"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// passwordIdentityID stands for the password in the identities API, so it
+// can be removed like a linked identity
+const passwordIdentityID = "password"
+
+// ErrIdentityConflict is returned when an external identity is linked to
+// another account, or its email belongs to an account it is not linked to
+var ErrIdentityConflict = errors.New("identity belongs to another account")
+
+// errIdentityNotFound is returned when the user has no sign-in method with
+// the given ID
+var errIdentityNotFound = errors.New("identity not found")
+
+// errLastSignInMethod is returned when removing a sign-in method would
+// leave the account with none
+var errLastSignInMethod = errors.New("cannot remove the last sign-in method")
+
+// IdentitiesResponse lists the ways a user can sign in
+type IdentitiesResponse struct {
+	Password   bool       `json:"password"`
+	Identities []Identity `json:"identities"`
+}
+
+// userByIdentity returns the user an external identity is linked to. The
+// store has no index of identities, so every user is checked.
+func (h *AuthHandler) userByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	users, err := h.users.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if user.FindIdentity(provider, subject) >= 0 {
+			return user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// UserForIdentity finds the account to sign in to with an external
+// identity, for embedding applications that run their own OAuth flows. It
+// returns ErrUserNotFound when the identity is unknown and no account has
+// its email, in which case a new account may be created. When an account
+// has the email but is not linked to the identity it returns
+// ErrIdentityConflict: the user must sign in to that account some other
+// way and link the identity with LinkIdentity, so a provider vouching for
+// an email is never enough to take over the account.
+func (s *Server) UserForIdentity(ctx context.Context, provider, subject, email string) (User, error) {
+	user, err := s.authHandler.userByIdentity(ctx, provider, subject)
+	if err == nil {
+		return user.Sanitized(), nil
+	}
+	if !errors.Is(err, ErrUserNotFound) || email == "" {
+		return User{}, err
+	}
+
+	if _, err := s.authHandler.users.GetByEmail(ctx, strings.ToLower(email)); err == nil {
+		s.logger.Printf("[DEBUG] %s identity matches the email of an account it is not linked to", provider)
+		return User{}, ErrIdentityConflict
+	} else if !errors.Is(err, ErrUserNotFound) {
+		return User{}, err
+	}
+	return User{}, ErrUserNotFound
+}
+
+// LinkIdentity links an external identity to the user with the given ID
+// and returns it with its ID set. Linking an identity the user already has
+// returns it unchanged; an identity linked to another user is refused with
+// ErrIdentityConflict.
+func (s *Server) LinkIdentity(ctx context.Context, userID string, identity Identity) (Identity, error) {
+	h := s.authHandler
+	if identity.Provider == "" || identity.Subject == "" {
+		return Identity{}, errors.New("identity needs a provider and subject")
+	}
+
+	owner, err := h.userByIdentity(ctx, identity.Provider, identity.Subject)
+	if err == nil && owner.ID != userID {
+		return Identity{}, ErrIdentityConflict
+	} else if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return Identity{}, err
+	}
+
+	user, err := h.users.Get(ctx, userID)
+	if err != nil {
+		return Identity{}, err
+	}
+	if i := user.FindIdentity(identity.Provider, identity.Subject); i >= 0 {
+		return user.Identities[i], nil
+	}
+	identity.ID = h.idGenerator.NewID(ids.PrefixIdentity)
+	identity.LinkedAt = h.clock.Now()
+	user.Identities = append(append([]Identity{}, user.Identities...), identity)
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(ctx, user); err != nil {
+		return Identity{}, err
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditIdentityLinked,
+		UserID:  user.ID,
+		Details: map[string]string{"provider": identity.Provider, "identity": identity.ID},
+	})
+	return identity, nil
+}
+
+// IdentitiesHandler lists the session user's sign-in methods: whether they
+// have a password, and their linked identities
+func (h *AuthHandler) IdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Identities request received")
+
+	user := contextUser(r)
+
+	response := Response{
+		Success: true,
+		Data: IdentitiesResponse{
+			Password:   user.Password != "",
+			Identities: append([]Identity{}, user.Identities...),
+		},
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// IdentityDeleteHandler unlinks one of the session user's identities, or
+// removes their password when the ID is "password". The last way to sign
+// in can never be removed.
+func (h *AuthHandler) IdentityDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Identity unlink request received")
+
+	user := contextUser(r)
+
+	id := mux.Vars(r)["id"]
+	provider, err := removeSignInMethod(user, id)
+	if errors.Is(err, errIdentityNotFound) {
+		h.logger.Printf("[DEBUG] Identity not found for %s: %s", user.Username, id)
+		http.Error(w, localize(r, "Identity not found"), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errLastSignInMethod) {
+		h.logger.Printf("[DEBUG] Refusing to remove the last sign-in method of %s", user.Username)
+		http.Error(w, localize(r, "You cannot remove your only way to sign in"), http.StatusConflict)
+		return
+	}
+
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to unlink identity for %s: %v", user.Username, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditIdentityUnlinked,
+		UserID:  user.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"provider": provider, "identity": id},
+	})
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Sign-in method removed"),
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Removed %s sign-in for user: %s", provider, user.Username)
+}
+
+// removeSignInMethod removes the password or the identity with the given
+// ID from user and returns the provider removed
+func removeSignInMethod(user *User, id string) (string, error) {
+	if id == passwordIdentityID {
+		if user.Password == "" {
+			return "", errIdentityNotFound
+		}
+		if user.SignInMethods() <= 1 {
+			return "", errLastSignInMethod
+		}
+		user.Password = ""
+		return passwordIdentityID, nil
+	}
+
+	for i, identity := range user.Identities {
+		if identity.ID != id {
+			continue
+		}
+		if user.SignInMethods() <= 1 {
+			return "", errLastSignInMethod
+		}
+		remaining := make([]Identity, 0, len(user.Identities)-1)
+		remaining = append(remaining, user.Identities[:i]...)
+		user.Identities = append(remaining, user.Identities[i+1:]...)
+		return identity.Provider, nil
+	}
+	return "", errIdentityNotFound
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jwksMaxAge is how long relying parties may cache the key set. New keys are
+// published a full rotation interval before they sign, so this only needs to
+// be shorter than the rotation interval.
+const jwksMaxAge = 5 * time.Minute
+
+// rotateSigningKey rotates the token signing keys and records it in the
+// audit log. userID is empty for scheduled rotations.
+func (s *Server) rotateSigningKey(userID, ip string) error {
+	current, err := s.tokenKeys.Rotate(time.Now())
+	if err != nil {
+		return err
+	}
+
+	s.audit.Record(AuditEvent{
+		Type:    AuditSigningKeyRotated,
+		UserID:  userID,
+		IP:      ip,
+		Details: map[string]string{"kid": current.ID},
+	})
+	return nil
+}
+
+// startKeyRotation rotates the signing keys every SigningKeyRotation until
+// the returned stop function is called. Keys from the secrets backend are
+// rotated there instead.
+func (s *Server) startKeyRotation() (stop func()) {
+	ticker := time.NewTicker(s.config.SigningKeyRotation)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ticker.C:
+				if s.signingKeyManaged() {
+					continue
+				}
+				if err := s.rotateSigningKey("", ""); err != nil {
+					s.logger.Printf("[DEBUG] Scheduled signing key rotation failed: %v", err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// JWKSHandler publishes the public signing keys as a JSON Web Key Set
+func (s *Server) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	json.NewEncoder(w).Encode(s.tokenKeys.JWKS())
+}
+
+// SigningKeysHandler lists signing key metadata on GET and rotates the keys
+// immediately on POST
+func (s *Server) SigningKeysHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Signing keys request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	message := "Signing keys retrieved successfully"
+	if r.Method == http.MethodPost {
+		if s.signingKeyManaged() {
+			s.logger.Printf("[DEBUG] Refusing to rotate signing keys managed by the secrets backend")
+			http.Error(w, "Signing keys are managed by the secrets backend", http.StatusConflict)
+			return
+		}
+		if err := s.rotateSigningKey(admin.ID, clientIP(r)); err != nil {
+			s.logger.Printf("[DEBUG] Signing key rotation failed: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		message = "Signing keys rotated successfully"
+	}
+
+	response := Response{
+		Success: true,
+		Message: message,
+		Data: map[string]interface{}{
+			"keys":               s.tokenKeys.Keys(),
+			"rotationInterval":   s.config.SigningKeyRotation.String(),
+			"retiredGracePeriod": s.config.SigningKeyGracePeriod.String(),
+		},
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
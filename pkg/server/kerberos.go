@@ -0,0 +1,181 @@
+package server
+
+import (
+	"auth-server/pkg/kerberos"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// kerberosProvider is the identity provider Kerberos principals are linked
+// as, with the principal written as name@REALM as the subject
+const kerberosProvider = "kerberos"
+
+// newKerberosAcceptor loads the keytab holding the service principal's
+// keys, usually HTTP/host@REALM
+func newKerberosAcceptor(cfg Config, h *AuthHandler) (*kerberos.Acceptor, error) {
+	data, err := os.ReadFile(cfg.KerberosKeytab)
+	if err != nil {
+		return nil, fmt.Errorf("reading keytab: %w", err)
+	}
+	keytab, err := kerberos.ParseKeytab(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.KerberosKeytab, err)
+	}
+	if len(keytab.Entries) == 0 {
+		return nil, fmt.Errorf("no keys in %s", cfg.KerberosKeytab)
+	}
+	acceptor := kerberos.NewAcceptor(keytab)
+	acceptor.MaxSkew = cfg.KerberosMaxSkew
+	acceptor.Now = func() time.Time { return h.clock.Now() }
+	return acceptor, nil
+}
+
+// userForPrincipal returns the account a Kerberos principal signs in to:
+// the one it is linked to as an identity, or for a user principal of one
+// of Config.KerberosUsernameRealms, the account with its name
+func (s *Server) userForPrincipal(ctx context.Context, principal kerberos.Principal) (*User, error) {
+	h := s.authHandler
+	user, err := h.userByIdentity(ctx, kerberosProvider, principal.String())
+	if !errors.Is(err, ErrUserNotFound) {
+		return user, err
+	}
+	if len(principal.Components) != 1 || !slices.Contains(s.config.KerberosUsernameRealms, principal.Realm) {
+		return nil, ErrUserNotFound
+	}
+	return h.users.GetByUsername(ctx, principal.Components[0])
+}
+
+// KerberosLoginHandler signs in a user with the Kerberos ticket their
+// browser or client sends through SPNEGO, answering requests without one
+// with a Negotiate challenge. Like LoginHandler the session is a cookie,
+// or returned in the body when the transport query parameter is "bearer".
+func (s *Server) KerberosLoginHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Kerberos login request received")
+	h := s.authHandler
+
+	transport := r.URL.Query().Get("transport")
+	if !validSessionTransport(transport) {
+		s.logger.Printf("[DEBUG] Invalid session transport: %s", transport)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Transport must be cookie or bearer"),
+		})
+		return
+	}
+
+	ip := clientIP(r)
+	if block, blocked := h.bruteForce.blocked(ip, h.clock.Now()); blocked {
+		s.logger.Printf("[DEBUG] Kerberos login refused from blocked address %s", ip)
+		writeIPBlocked(w, r, block)
+		return
+	}
+
+	encoded, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Negotiate ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Negotiate")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Kerberos authentication required"),
+		})
+		return
+	}
+
+	// A failed ticket is not challenged again, so browsers do not retry it
+	token, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	var principal kerberos.Principal
+	var reply []byte
+	if err == nil {
+		principal, reply, err = s.kerberos.Accept(token)
+	}
+	if err != nil {
+		s.logger.Printf("[DEBUG] Kerberos ticket rejected: %v", err)
+		h.audit.Record(AuditEvent{
+			Type:    AuditLoginFailed,
+			IP:      ip,
+			Details: map[string]string{"method": "kerberos", "reason": err.Error()},
+		})
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Kerberos authentication failed"),
+		})
+		return
+	}
+
+	user, err := s.userForPrincipal(r.Context(), principal)
+	if errors.Is(err, ErrUserNotFound) {
+		s.logger.Printf("[DEBUG] No account for Kerberos principal %s", principal)
+		h.audit.Record(AuditEvent{
+			Type:    AuditLoginFailed,
+			IP:      ip,
+			Details: map[string]string{"method": "kerberos", "principal": principal.String(), "reason": "no account"},
+		})
+		http.Error(w, localize(r, "No account is linked to your Kerberos principal"), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to find account for %s: %v", principal, err)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if user.HasTwoFactor() {
+		s.logger.Printf("[DEBUG] Kerberos login refused for two-factor account: %s", user.Username)
+		http.Error(w, localize(r, "Sign in with your password and authentication code"), http.StatusForbidden)
+		return
+	}
+
+	if len(pendingDocuments(user, h.legalDocuments())) > 0 {
+		s.logger.Printf("[DEBUG] Kerberos login refused pending terms acceptance: %s", user.Username)
+		http.Error(w, localize(r, "Sign in with your password to accept the updated terms"), http.StatusForbidden)
+		return
+	}
+
+	if err := h.hooks.runPreLogin(r.Context(), user.Username, ip); err != nil {
+		status, message := s.authHandler.hookRejection(err)
+		s.logger.Printf("[DEBUG] Kerberos login rejected by pre-login hook: %s", message)
+		http.Error(w, localize(r, message), status)
+		return
+	}
+
+	bearer, ok := h.completeLogin(w, r, user, ip, "kerberos", false, transport)
+	if !ok {
+		return
+	}
+	if reply != nil {
+		w.Header().Set("WWW-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString(reply))
+	}
+
+	if bearer == "" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, h.config.BasePath+"/", http.StatusSeeOther)
+		return
+	}
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Login successful"),
+		Data:    user.Sanitized(),
+	}
+	if bearer != "" {
+		response.Data = SessionTokenResponse{
+			User:        user.Sanitized(),
+			AccessToken: bearer,
+			TokenType:   "Bearer",
+			ExpiresIn:   int(h.config.SessionTTL.Seconds()),
+		}
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	json.NewEncoder(w).Encode(response)
+	s.logger.Printf("[DEBUG] User logged in with Kerberos as %s: %s", principal, user.Username)
+}
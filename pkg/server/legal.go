@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Legal document names
+const (
+	DocumentTerms   = "terms"
+	DocumentPrivacy = "privacy"
+)
+
+// LegalDocument is a versioned document users must accept, such as the
+// terms of service. Changing the version asks every user to accept it
+// again at their next login.
+type LegalDocument struct {
+	Name    string `json:"name"`
+	Title   string `json:"title"`
+	Version string `json:"version"`
+	URL     string `json:"url,omitempty"`
+}
+
+// legalDocuments returns the documents configured with a version. None
+// means acceptance is not tracked.
+func (h *AuthHandler) legalDocuments() []LegalDocument {
+	var documents []LegalDocument
+	if h.config.TermsVersion != "" {
+		documents = append(documents, LegalDocument{
+			Name:    DocumentTerms,
+			Title:   "Terms of Service",
+			Version: h.config.TermsVersion,
+			URL:     h.config.TermsURL,
+		})
+	}
+	if h.config.PrivacyVersion != "" {
+		documents = append(documents, LegalDocument{
+			Name:    DocumentPrivacy,
+			Title:   "Privacy Policy",
+			Version: h.config.PrivacyVersion,
+			URL:     h.config.PrivacyURL,
+		})
+	}
+	return documents
+}
+
+// pendingDocuments returns the documents whose current version u has not
+// accepted
+func pendingDocuments(u *User, documents []LegalDocument) []LegalDocument {
+	var pending []LegalDocument
+	for _, document := range documents {
+		accepted := false
+		for _, consent := range u.Consents {
+			if consent.Document == document.Name && consent.Version == document.Version {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			pending = append(pending, document)
+		}
+	}
+	return pending
+}
+
+// acceptDocuments adds consent records for documents to the user. The
+// caller must store the user afterwards.
+func (h *AuthHandler) acceptDocuments(r *http.Request, user *User, documents []LegalDocument, now time.Time) {
+	// Build a new slice; the store's copy shares the old one
+	consents := make([]ConsentRecord, 0, len(user.Consents)+len(documents))
+	consents = append(consents, user.Consents...)
+	details := make(map[string]string)
+	for _, document := range documents {
+		consents = append(consents, ConsentRecord{
+			Document:   document.Name,
+			Version:    document.Version,
+			AcceptedAt: now,
+			IP:         clientIP(r),
+		})
+		details[document.Name] = document.Version
+	}
+	user.Consents = consents
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditTermsAccepted,
+		UserID:  user.ID,
+		IP:      clientIP(r),
+		Details: details,
+	})
+}
+
+// localizedDocuments translates the document titles for the response
+func localizedDocuments(r *http.Request, documents []LegalDocument) []LegalDocument {
+	localized := make([]LegalDocument, len(documents))
+	for i, document := range documents {
+		document.Title = localize(r, document.Title)
+		localized[i] = document
+	}
+	return localized
+}
+
+// writeTermsRequired answers a registration or login that has to accept
+// documents before it can continue
+func writeTermsRequired(w http.ResponseWriter, r *http.Request, status int, documents []LegalDocument) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Response{
+		Success: false,
+		Message: localize(r, "You must accept the terms of service and privacy policy to continue"),
+		Data: map[string]interface{}{
+			"termsRequired": true,
+			"documents":     localizedDocuments(r, documents),
+		},
+	})
+}
+
+// LegalDocumentsHandler lists the current versions of the legal documents
+// users must accept
+func (h *AuthHandler) LegalDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Legal documents request received")
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Legal documents retrieved successfully"),
+		Data:    localizedDocuments(r, h.legalDocuments()),
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	unixAddrPrefix    = "unix:"
+	systemdAddrPrefix = "systemd"
+)
+
+// listenFDsStart is the first file descriptor systemd passes, SD_LISTEN_FDS_START
+var listenFDsStart = 3
+
+// isTCPAddr reports whether addr is a TCP host:port rather than a unix
+// socket or a systemd socket
+func isTCPAddr(addr string) bool {
+	return !strings.HasPrefix(addr, unixAddrPrefix) && addr != systemdAddrPrefix && !strings.HasPrefix(addr, systemdAddrPrefix+":")
+}
+
+// listen opens the listener Config.Addr describes, limited to
+// Config.MaxConnections connections at once
+func (s *Server) listen() (net.Listener, error) {
+	listener, err := s.openListener()
+	if err != nil || s.config.MaxConnections == 0 {
+		return listener, err
+	}
+	return &limitListener{
+		Listener: listener,
+		slots:    make(chan struct{}, s.config.MaxConnections),
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+func (s *Server) openListener() (net.Listener, error) {
+	addr := s.config.Addr
+	if path, ok := strings.CutPrefix(addr, unixAddrPrefix); ok {
+		return listenUnix(path, s.config.SocketMode, s.config.SocketGroup)
+	}
+	if addr == systemdAddrPrefix {
+		return systemdListener("")
+	}
+	if name, ok := strings.CutPrefix(addr, systemdAddrPrefix+":"); ok {
+		return systemdListener(name)
+	}
+	listenConfig := net.ListenConfig{KeepAlive: s.config.TCPKeepAlive}
+	return listenConfig.Listen(context.Background(), "tcp", addr)
+}
+
+// listenMTLS opens the TCP listener for Config.MTLSAddr. TLS is layered on
+// by the server serving it.
+func (s *Server) listenMTLS() (net.Listener, error) {
+	listenConfig := net.ListenConfig{KeepAlive: s.config.TCPKeepAlive}
+	return listenConfig.Listen(context.Background(), "tcp", s.config.MTLSAddr)
+}
+
+// newHTTPServer creates the server Run serves on, tuned by Config
+func (s *Server) newHTTPServer() *http.Server {
+	httpServer := &http.Server{
+		Handler:           s.Handler(),
+		ConnContext:       markLocalConn,
+		IdleTimeout:       s.config.IdleTimeout,
+		ReadHeaderTimeout: s.config.ReadHeaderTimeout,
+		MaxHeaderBytes:    s.config.MaxHeaderBytes,
+		HTTP2:             &http.HTTP2Config{MaxConcurrentStreams: s.config.HTTP2MaxConcurrentStreams},
+	}
+	if s.config.HTTP2Cleartext {
+		httpServer.Protocols = new(http.Protocols)
+		httpServer.Protocols.SetHTTP1(true)
+		httpServer.Protocols.SetUnencryptedHTTP2(true)
+	}
+	httpServer.SetKeepAlivesEnabled(s.config.KeepAlives)
+	httpServer.RegisterOnShutdown(s.sessionStatus.shutdown)
+	httpServer.RegisterOnShutdown(s.auditStreams.shutdown)
+	return httpServer
+}
+
+// limitListener stops accepting connections while every slot is taken by
+// an open one. Connections beyond the limit wait in the listen backlog.
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+// Close also wakes an Accept waiting for a slot
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// limitedConn gives its slot back the first time it is closed
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// listenUnix listens on a unix socket at path with the given permissions,
+// replacing a socket left behind by a previous run. The socket is removed
+// when the listener is closed.
+func listenUnix(path string, mode os.FileMode, group string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if group != "" {
+		gid, err := lookupGroup(group)
+		if err == nil {
+			err = os.Chown(path, -1, gid)
+		}
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("setting socket group: %w", err)
+		}
+	}
+	return listener, nil
+}
+
+// lookupGroup resolves a group name or numeric ID
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	found, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(found.Gid)
+}
+
+// systemdListener returns a socket passed with systemd socket activation:
+// the one named name in LISTEN_FDNAMES, or the only one when name is empty.
+// The activation variables are cleared so child processes do not take
+// them as their own.
+func systemdListener(name string) (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid != os.Getpid() || count < 1 {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+
+	index := 0
+	if name != "" {
+		index = -1
+		for i, fdName := range names {
+			if fdName == name && i < count {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+		}
+	} else if count > 1 {
+		return nil, fmt.Errorf("systemd passed %d sockets, choose one with LISTEN_ADDR=systemd:name", count)
+	}
+
+	// FileListener duplicates the descriptor, so the original is closed
+	file := os.NewFile(uintptr(listenFDsStart+index), "systemd:"+name)
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// localConnKey is the context key marking requests received over a unix
+// socket
+type localConnKey struct{}
+
+// markLocalConn is the http.Server ConnContext hook. Only processes allowed
+// by the socket's permissions can connect over a unix socket, so such a
+// peer is trusted as a proxy.
+func markLocalConn(ctx context.Context, conn net.Conn) context.Context {
+	if conn.LocalAddr().Network() == "unix" {
+		return context.WithValue(ctx, localConnKey{}, true)
+	}
+	return ctx
+}
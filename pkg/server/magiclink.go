@@ -0,0 +1,297 @@
+package server
+
+import (
+	"auth-server/pkg/cryptoutil"
+	"auth-server/pkg/randutil"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// magicLinkMessage is returned for every magic link request so it cannot
+// reveal which emails are registered
+const magicLinkMessage = "If an account exists for that email, a sign-in link has been sent. Open it on this device to sign in."
+
+// magicLinkRateWindow is the window Config.MagicLinkRateLimit applies to
+const magicLinkRateWindow = 15 * time.Minute
+
+var (
+	errMagicLinkInvalid = errors.New("invalid magic link")
+	errMagicLinkExpired = errors.New("magic link expired")
+	errMagicLinkUsed    = errors.New("magic link already used")
+)
+
+// magicLinkClaims are signed into a magic link token. The requesting
+// client is included so the sign-in can be flagged when the link is opened
+// somewhere else.
+type magicLinkClaims struct {
+	UserID    string `json:"uid"`
+	Nonce     string `json:"n"`
+	ExpiresAt int64  `json:"exp"`
+	IP        string `json:"ip"`
+	Agent     string `json:"ua"` // truncated hash of the User-Agent
+	IssuedAt  int64  `json:"iat"`
+}
+
+// magicLinkStore signs magic link tokens and remembers used ones until they
+// expire, so each link works once
+type magicLinkStore struct {
+	mutex sync.Mutex
+	key   []byte
+	ttl   time.Duration
+	used  map[string]time.Time // nonce -> expiry
+}
+
+// newMagicLinkStore derives the signing key from the master key, so links
+// survive a restart when ENCRYPTION_MASTER_KEY is set
+func newMagicLinkStore(cfg Config) *magicLinkStore {
+	key, err := cryptoutil.DeriveKey(cfg.MasterKey, "magic-link")
+	if err != nil {
+		cfg.Logger.Printf("[DEBUG] Failed to derive magic link key, using an ephemeral key: %v", err)
+		key, _ = randutil.Bytes(32)
+	}
+	return &magicLinkStore{key: key, ttl: cfg.MagicLinkTTL, used: make(map[string]time.Time)}
+}
+
+// issue returns a signed token for userID requested by r
+func (s *magicLinkStore) issue(userID string, r *http.Request, now time.Time) (string, error) {
+	nonce, err := randutil.Hex(16)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(magicLinkClaims{
+		UserID:    userID,
+		Nonce:     nonce,
+		ExpiresAt: now.Add(s.ttl).Unix(),
+		IP:        clientIP(r),
+		Agent:     agentFingerprint(r),
+		IssuedAt:  now.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + s.sign(encoded), nil
+}
+
+// consume verifies a token and marks it used
+func (s *magicLinkStore) consume(token string, now time.Time) (magicLinkClaims, error) {
+	var claims magicLinkClaims
+
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(encoded))) {
+		return claims, errMagicLinkInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(payload, &claims) != nil || claims.Nonce == "" {
+		return claims, errMagicLinkInvalid
+	}
+
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	if !now.Before(expiresAt) {
+		return claims, errMagicLinkExpired
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, used := s.used[claims.Nonce]; used {
+		return claims, errMagicLinkUsed
+	}
+	s.used[claims.Nonce] = expiresAt
+	return claims, nil
+}
+
+func (s *magicLinkStore) sign(encoded string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Purge forgets used tokens that have expired anyway and returns how many
+// were removed
+func (s *magicLinkStore) Purge(now time.Time) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	purged := 0
+	for nonce, expiresAt := range s.used {
+		if !now.Before(expiresAt) {
+			delete(s.used, nonce)
+			purged++
+		}
+	}
+	return purged
+}
+
+// agentFingerprint shortens the User-Agent to a hash for comparison
+func agentFingerprint(r *http.Request) string {
+	sum := sha256.Sum256([]byte(r.UserAgent()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// MagicLinkRequestHandler emails a single-use sign-in link. The response is
+// the same whether or not the email belongs to an account, and requests
+// are limited per email and per client IP.
+func (h *AuthHandler) MagicLinkRequestHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Magic link request received")
+
+	var req MagicLinkRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if req.Email == "" {
+		h.logger.Printf("[DEBUG] Missing required fields")
+		http.Error(w, localize(r, "Email is required"), http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	rateKeys := []string{"email:" + strings.ToLower(req.Email), "ip:" + ip}
+	if count, reset := h.magicLinkRequests.Status(rateKeys...); count >= h.config.MagicLinkRateLimit {
+		h.logger.Printf("[DEBUG] Magic link rate limit reached for %s from %s", req.Email, ip)
+		setRateLimitHeaders(w, h.config.MagicLinkRateLimit, 0, reset)
+		http.Error(w, localize(r, "Too many sign-in link requests, please try again later"), http.StatusTooManyRequests)
+		return
+	}
+	h.magicLinkRequests.Add(rateKeys...)
+	count, reset := h.magicLinkRequests.Status(rateKeys...)
+	setRateLimitHeaders(w, h.config.MagicLinkRateLimit, h.config.MagicLinkRateLimit-count, reset)
+
+	user, err := h.users.GetByEmail(r.Context(), req.Email)
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		h.logger.Printf("[DEBUG] Magic link requested for unknown email: %s", req.Email)
+	case err != nil:
+		h.logger.Printf("[DEBUG] User lookup failed: %v", err)
+		writeStoreError(w, r, err)
+		return
+	case user.HasTwoFactor():
+		// A link alone would bypass the second factor
+		h.logger.Printf("[DEBUG] Magic link not sent to two-factor account: %s", user.Username)
+	default:
+		now := h.clock.Now()
+		token, err := h.magicLinks.issue(user.ID, r, now)
+		if err != nil {
+			h.logger.Printf("[DEBUG] Failed to generate magic link: %v", err)
+			http.Error(w, localize(r, "Internal server error"), http.StatusInternalServerError)
+			return
+		}
+		h.sendEmail(r.Context(), user, userLocale(user, r), "magic_link", map[string]string{
+			"Username": user.Username,
+			"Link":     h.config.PublicURL + "/api/login/magic-link/verify?token=" + url.QueryEscape(token),
+			"TTL":      h.config.MagicLinkTTL.String(),
+			"IP":       ip,
+			"Device":   r.UserAgent(),
+			"Time":     now.Format(time.RFC1123),
+		})
+		h.audit.Record(AuditEvent{
+			Type:   AuditMagicLinkRequested,
+			UserID: user.ID,
+			IP:     ip,
+		})
+	}
+
+	response := Response{
+		Success: true,
+		Message: localize(r, magicLinkMessage),
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// MagicLinkVerifyHandler signs the user in with a magic link token. A
+// browser following the emailed link is redirected to the app; API clients
+// get JSON. When the link is opened on a different device or network than
+// the one that requested it, the response says so.
+func (h *AuthHandler) MagicLinkVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Magic link verification received")
+
+	claims, err := h.magicLinks.consume(r.URL.Query().Get("token"), h.clock.Now())
+	if err != nil {
+		h.logger.Printf("[DEBUG] Magic link rejected: %v", err)
+		http.Error(w, localize(r, "Invalid or expired sign-in link"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.users.Get(r.Context(), claims.UserID)
+	if err != nil {
+		h.logger.Printf("[DEBUG] User lookup failed: %v", err)
+		if errors.Is(err, ErrUserNotFound) {
+			http.Error(w, localize(r, "Invalid or expired sign-in link"), http.StatusBadRequest)
+			return
+		}
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if user.HasTwoFactor() {
+		h.logger.Printf("[DEBUG] Magic link refused for two-factor account: %s", user.Username)
+		http.Error(w, localize(r, "Sign in with your password and authentication code"), http.StatusForbidden)
+		return
+	}
+
+	if len(pendingDocuments(user, h.legalDocuments())) > 0 {
+		h.logger.Printf("[DEBUG] Magic link refused pending terms acceptance: %s", user.Username)
+		http.Error(w, localize(r, "Sign in with your password to accept the updated terms"), http.StatusForbidden)
+		return
+	}
+
+	ip := clientIP(r)
+	if err := h.hooks.runPreLogin(r.Context(), user.Username, ip); err != nil {
+		status, message := h.hookRejection(err)
+		h.logger.Printf("[DEBUG] Magic link login rejected by pre-login hook: %s", message)
+		http.Error(w, localize(r, message), status)
+		return
+	}
+
+	sameDevice := claims.IP == ip && claims.Agent == agentFingerprint(r)
+	if !sameDevice {
+		h.audit.Record(AuditEvent{
+			Type:    AuditMagicLinkOtherDevice,
+			UserID:  user.ID,
+			IP:      ip,
+			Details: map[string]string{"requestedIp": claims.IP},
+		})
+	}
+
+	if _, ok := h.completeLogin(w, r, user, ip, "magic_link", false, SessionTransportCookie); !ok {
+		return
+	}
+
+	message := localize(r, "Login successful")
+	if !sameDevice {
+		message = localize(r, "Signed in. This link was requested from a different device or network. If that was not you, change your password.")
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, h.config.BasePath+"/", http.StatusSeeOther)
+		return
+	}
+
+	response := Response{
+		Success: true,
+		Message: message,
+		Data: map[string]interface{}{
+			"user":        user.Sanitized(),
+			"sameDevice":  sameDevice,
+			"requestedAt": time.Unix(claims.IssuedAt, 0).UTC(),
+			"requestedIp": claims.IP,
+		},
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] User logged in with magic link: %s", user.Username)
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultMaintenanceRetryAfter is the Retry-After sent during maintenance
+// when the admin did not choose one
+const defaultMaintenanceRetryAfter = 5 * time.Minute
+
+// MaintenanceState is the maintenance mode setting, saved to
+// Config.MaintenanceFile so it survives restarts
+type MaintenanceState struct {
+	Enabled bool `json:"enabled"`
+	// Message replaces the default message in refused responses
+	Message string `json:"message,omitempty"`
+	// AllowAdmins lets admins log in and use the API during maintenance
+	AllowAdmins bool `json:"allowAdmins"`
+	// RetryAfter is the Retry-After sent to refused clients, in seconds
+	RetryAfter int        `json:"retryAfter"`
+	Since      *time.Time `json:"since,omitempty"`
+	EnabledBy  string     `json:"enabledBy,omitempty"`
+}
+
+// MaintenanceRequest changes the maintenance setting; omitted fields keep
+// their current values
+type MaintenanceRequest struct {
+	Enabled     *bool   `json:"enabled"`
+	Message     *string `json:"message"`
+	AllowAdmins *bool   `json:"allowAdmins"`
+	RetryAfter  *int    `json:"retryAfter"`
+}
+
+// maintenanceMode holds the current setting and saves changes to path
+type maintenanceMode struct {
+	path string
+
+	mutex sync.RWMutex
+	state MaintenanceState
+}
+
+// newMaintenanceMode restores the setting saved at path, if any
+func newMaintenanceMode(path string, logger *log.Logger) (*maintenanceMode, error) {
+	m := &maintenanceMode{path: path}
+	if path == "" {
+		return m, nil
+	}
+
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading maintenance state: %w", err)
+	}
+	if err := json.Unmarshal(contents, &m.state); err != nil {
+		return nil, fmt.Errorf("parsing maintenance state %s: %w", path, err)
+	}
+	if m.state.Enabled {
+		logger.Printf("[DEBUG] Maintenance mode is enabled, restored from %s", path)
+	}
+	return m, nil
+}
+
+// get returns the current setting
+func (m *maintenanceMode) get() MaintenanceState {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.state
+}
+
+// set saves and applies a new setting
+func (m *maintenanceMode) set(state MaintenanceState) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.path != "" {
+		contents, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(m.path, contents); err != nil {
+			return fmt.Errorf("saving maintenance state: %w", err)
+		}
+	}
+
+	m.state = state
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with contents through a
+// temporary file and a rename, so readers and crashes never see it half
+// written. The file is only readable by its owner.
+func writeFileAtomic(path string, contents []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(contents); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// maintenanceExempt reports whether a route stays available during
+// maintenance: the health check, and the maintenance setting itself so an
+// admin can always turn it off
+func maintenanceExempt(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/api/health", "/api/admin/maintenance":
+		return true
+	}
+	return false
+}
+
+// writeMaintenance refuses a request during maintenance
+func writeMaintenance(w http.ResponseWriter, r *http.Request, state MaintenanceState) {
+	retryAfter := state.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = int(defaultMaintenanceRetryAfter.Seconds())
+	}
+	message := state.Message
+	if message == "" {
+		message = localize(r, "The service is down for maintenance, please try again later")
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(Response{
+		Success: false,
+		Message: message,
+		Data: map[string]interface{}{
+			"maintenance": true,
+			"retryAfter":  retryAfter,
+		},
+	})
+}
+
+// maintenanceMiddleware refuses requests with 503 while maintenance mode
+// is on. When admins are allowed, logins get through so LoginHandler can
+// admit admins only, as do requests from admin sessions.
+func (s *Server) maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := s.authHandler.maintenance.get()
+		if !state.Enabled || maintenanceExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if state.AllowAdmins {
+			if r.URL.Path == "/api/login" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if user, err := s.authHandler.sessionUser(r); err == nil && user.Role == RoleAdmin {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		s.logger.Printf("[DEBUG] Refusing %s %s during maintenance", r.Method, r.URL.Path)
+		writeMaintenance(w, r, state)
+	})
+}
+
+// MaintenanceHandler shows or changes maintenance mode
+func (s *Server) MaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Maintenance request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var req MaintenanceRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+			writeBodyError(w, r, err)
+			return
+		}
+		if req.RetryAfter != nil && *req.RetryAfter <= 0 {
+			http.Error(w, "retryAfter must be a positive number of seconds", http.StatusBadRequest)
+			return
+		}
+
+		state := s.authHandler.maintenance.get()
+		wasEnabled := state.Enabled
+		if req.Enabled != nil {
+			state.Enabled = *req.Enabled
+		}
+		if req.Message != nil {
+			state.Message = *req.Message
+		}
+		if req.AllowAdmins != nil {
+			state.AllowAdmins = *req.AllowAdmins
+		}
+		if req.RetryAfter != nil {
+			state.RetryAfter = *req.RetryAfter
+		}
+		if state.RetryAfter == 0 {
+			state.RetryAfter = int(defaultMaintenanceRetryAfter.Seconds())
+		}
+		if state.Enabled && !wasEnabled {
+			now := s.authHandler.clock.Now()
+			state.Since = &now
+			state.EnabledBy = admin.Username
+		}
+		if !state.Enabled {
+			state.Since = nil
+			state.EnabledBy = ""
+		}
+
+		if err := s.authHandler.maintenance.set(state); err != nil {
+			s.logger.Printf("[DEBUG] Failed to save maintenance state: %v", err)
+			http.Error(w, "Failed to save maintenance state", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Printf("[DEBUG] Maintenance mode set to %t by %s", state.Enabled, admin.Username)
+
+		s.audit.Record(AuditEvent{
+			Type:   AuditMaintenanceChanged,
+			UserID: admin.ID,
+			IP:     clientIP(r),
+			Details: map[string]string{
+				"enabled":     strconv.FormatBool(state.Enabled),
+				"allowAdmins": strconv.FormatBool(state.AllowAdmins),
+			},
+		})
+	}
+
+	response := Response{
+		Success: true,
+		Message: "Maintenance mode retrieved successfully",
+		Data:    s.authHandler.maintenance.get(),
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,402 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errMergeSameAccount = errors.New("cannot merge an account into itself")
+	errAlreadyMerged    = errors.New("account has been merged")
+	errNotMerged        = errors.New("account has not been merged")
+	errMergeExpired     = errors.New("merge grace period has passed")
+)
+
+// MergeRequest asks to merge another account the caller can sign in to
+// into their session account. Code, SMSCode or RecoveryCode is required
+// when the other account has two-factor authentication.
+type MergeRequest struct {
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	Code         string `json:"code,omitempty"`
+	SMSCode      string `json:"smsCode,omitempty"`
+	RecoveryCode string `json:"recoveryCode,omitempty"`
+}
+
+// AdminMergeRequest asks to merge the source account into the target
+type AdminMergeRequest struct {
+	SourceID string `json:"sourceId"`
+	TargetID string `json:"targetId"`
+}
+
+// UnmergeRequest names the merged account to restore
+type UnmergeRequest struct {
+	Username string `json:"username"`
+}
+
+// MergeResponse describes a completed merge
+type MergeResponse struct {
+	SourceID   string    `json:"sourceId"`
+	TargetID   string    `json:"targetId"`
+	Identities int       `json:"identities"`
+	Sessions   int       `json:"sessions"`
+	UndoUntil  time.Time `json:"undoUntil"`
+}
+
+// mergeAccounts merges source into target. Source's linked identities
+// move to target, along with its phone number and locale where target has
+// none, and source's sessions are signed in to target. Source can no
+// longer sign in but is kept, so the merge can be undone. Passwords, second
+// factors and legal consents stay with each account.
+func (h *AuthHandler) mergeAccounts(ctx context.Context, source, target *User) (MergeResponse, error) {
+	if source.ID == target.ID {
+		return MergeResponse{}, errMergeSameAccount
+	}
+	if source.Merge != nil || target.Merge != nil {
+		return MergeResponse{}, errAlreadyMerged
+	}
+	if source.Deletion != nil || target.Deletion != nil {
+		return MergeResponse{}, errAccountDeleted
+	}
+
+	now := h.clock.Now()
+	merge := &AccountMerge{Into: target.ID, At: now, Identities: source.Identities}
+	if target.Phone == "" && source.Phone != "" {
+		merge.PhoneMoved = true
+	}
+	if target.Locale == "" && source.Locale != "" {
+		merge.Locale = source.Locale
+	}
+
+	// Take the identities from source first, so no identity is ever linked
+	// to both accounts
+	source.Merge = merge
+	source.Identities = nil
+	source.UpdatedAt = now
+	if err := h.users.Update(ctx, source); err != nil {
+		return MergeResponse{}, err
+	}
+
+	target.Identities = append(append([]Identity{}, target.Identities...), merge.Identities...)
+	if merge.PhoneMoved {
+		target.Phone = source.Phone
+	}
+	if merge.Locale != "" {
+		target.Locale = merge.Locale
+	}
+	target.UpdatedAt = now
+	if err := h.users.Update(ctx, target); err != nil {
+		source.Merge = nil
+		source.Identities = merge.Identities
+		if restoreErr := h.users.Update(ctx, source); restoreErr != nil {
+			h.logger.Printf("[DEBUG] Failed to restore %s after a failed merge: %v", source.Username, restoreErr)
+		}
+		return MergeResponse{}, err
+	}
+
+	return MergeResponse{
+		SourceID:   source.ID,
+		TargetID:   target.ID,
+		Identities: len(merge.Identities),
+		Sessions:   h.moveSessions(ctx, source.ID, target.ID),
+		UndoUntil:  now.Add(h.config.MergeGracePeriod),
+	}, nil
+}
+
+// moveSessions signs the sessions of one user in to another and returns
+// how many moved. Stateless sessions cannot be changed, so they are
+// revoked instead and their holders sign in again.
+func (h *AuthHandler) moveSessions(ctx context.Context, fromID, toID string) int {
+	if h.stateless != nil {
+		if _, err := h.revokeUserSessions(ctx, fromID); err != nil {
+			h.logger.Printf("[DEBUG] Failed to revoke sessions of merged account %s: %v", fromID, err)
+		}
+		return 0
+	}
+
+	sessions, err := h.sessions.ForUser(ctx, fromID, h.clock.Now())
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to list sessions of merged account %s: %v", fromID, err)
+		return 0
+	}
+	moved := 0
+	for _, session := range sessions {
+		session.UserID = toID
+		replaced, err := h.sessions.Replace(ctx, session)
+		if err != nil {
+			h.logger.Printf("[DEBUG] Failed to move session %s of merged account %s: %v", session.ID, fromID, err)
+			continue
+		}
+		if replaced {
+			moved++
+		}
+	}
+	return moved
+}
+
+// unmergeAccount undoes the merge of source, taking back what moved to the
+// surviving account unless that has changed since, and returns the
+// surviving account. Sessions stay with it.
+func (h *AuthHandler) unmergeAccount(ctx context.Context, source *User) (*User, error) {
+	merge := source.Merge
+	if merge == nil {
+		return nil, errNotMerged
+	}
+	now := h.clock.Now()
+	if !now.Before(merge.At.Add(h.config.MergeGracePeriod)) {
+		return nil, errMergeExpired
+	}
+
+	target, err := h.users.Get(ctx, merge.Into)
+	if err != nil {
+		return nil, err
+	}
+	moved := make(map[string]bool, len(merge.Identities))
+	for _, identity := range merge.Identities {
+		moved[identity.ID] = true
+	}
+	var kept, restored []Identity
+	for _, identity := range target.Identities {
+		if moved[identity.ID] {
+			restored = append(restored, identity)
+		} else {
+			kept = append(kept, identity)
+		}
+	}
+	target.Identities = kept
+	// A phone number the surviving account now uses as a second factor
+	// stays, rather than weakening its login
+	if merge.PhoneMoved && target.Phone == source.Phone && !target.SMSTwoFactorEnabled {
+		target.Phone = ""
+	}
+	if merge.Locale != "" && target.Locale == merge.Locale {
+		target.Locale = ""
+	}
+	if target.SignInMethods() == 0 {
+		return nil, errLastSignInMethod
+	}
+	target.UpdatedAt = now
+	if err := h.users.Update(ctx, target); err != nil {
+		return nil, err
+	}
+
+	source.Merge = nil
+	source.Identities = restored
+	source.UpdatedAt = now
+	if err := h.users.Update(ctx, source); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// writeMergeError writes the response for a merge or unmerge that failed
+func writeMergeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errMergeSameAccount):
+		http.Error(w, localize(r, "An account cannot be merged into itself"), http.StatusBadRequest)
+	case errors.Is(err, errAlreadyMerged):
+		http.Error(w, localize(r, "One of the accounts has already been merged"), http.StatusConflict)
+	case errors.Is(err, errNotMerged):
+		http.Error(w, localize(r, "The account has not been merged"), http.StatusConflict)
+	case errors.Is(err, errMergeExpired):
+		http.Error(w, localize(r, "The merge can no longer be undone"), http.StatusConflict)
+	case errors.Is(err, errLastSignInMethod):
+		http.Error(w, localize(r, "Undoing the merge would leave the surviving account without a way to sign in"), http.StatusConflict)
+	case errors.Is(err, errAccountDeleted):
+		http.Error(w, localize(r, "One of the accounts has been deleted"), http.StatusConflict)
+	case errors.Is(err, ErrUserNotFound):
+		http.Error(w, localize(r, "User not found"), http.StatusNotFound)
+	default:
+		writeStoreError(w, r, err)
+	}
+}
+
+// recordMerge audits a merge and writes its response
+func (h *AuthHandler) recordMerge(w http.ResponseWriter, r *http.Request, actor string, result MergeResponse) {
+	h.audit.Record(AuditEvent{
+		Type:   AuditAccountMerged,
+		UserID: actor,
+		IP:     clientIP(r),
+		Details: map[string]string{
+			"source":     result.SourceID,
+			"target":     result.TargetID,
+			"identities": fmt.Sprint(result.Identities),
+			"sessions":   fmt.Sprint(result.Sessions),
+		},
+	})
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Accounts merged"),
+		Data:    result,
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Merged account %s into %s", result.SourceID, result.TargetID)
+}
+
+// recordUnmerge audits an undone merge and writes its response
+func (h *AuthHandler) recordUnmerge(w http.ResponseWriter, r *http.Request, actor string, source, target *User) {
+	h.audit.Record(AuditEvent{
+		Type:    AuditAccountUnmerged,
+		UserID:  actor,
+		IP:      clientIP(r),
+		Details: map[string]string{"source": source.ID, "target": target.ID},
+	})
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Merge undone"),
+		Data:    source.Sanitized(),
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Undid merge of %s into %s", source.ID, target.ID)
+}
+
+// AccountMergeHandler merges another account into the session user's,
+// once the caller has proven they can sign in to it
+func (h *AuthHandler) AccountMergeHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Account merge request received")
+
+	target := contextUser(r)
+
+	var req MergeRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	// Check the other account's credentials like a login would, without
+	// revealing whether it exists
+	ip := clientIP(r)
+	source, err := h.users.GetByUsername(r.Context(), req.Username)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		h.logger.Printf("[DEBUG] User lookup failed: %v", err)
+		writeStoreError(w, r, err)
+		return
+	}
+	passwordHash := h.dummyPasswordHash()
+	if source != nil {
+		passwordHash = source.Password
+	}
+	if err := h.hasher.Compare(r.Context(), passwordHash, req.Password); err != nil || source == nil {
+		if h.passwordUnavailable(w, r, err) {
+			return
+		}
+		h.logger.Printf("[DEBUG] Invalid credentials for account to merge: %s", req.Username)
+		h.recordLoginFailure(req.Username, ip)
+		http.Error(w, localize(r, "Invalid credentials"), http.StatusUnauthorized)
+		return
+	}
+	if source.HasTwoFactor() {
+		codes := secondFactorCodes{TOTP: req.Code, SMS: req.SMSCode, Recovery: req.RecoveryCode}
+		if _, ok := h.verifySecondFactor(source, codes, h.clock.Now()); !ok {
+			h.logger.Printf("[DEBUG] Invalid second factor for account to merge: %s", source.Username)
+			h.recordLoginFailure(req.Username, ip)
+			http.Error(w, localize(r, "Invalid two-factor authentication code"), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	result, err := h.mergeAccounts(r.Context(), source, target)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to merge %s into %s: %v", source.Username, target.Username, err)
+		writeMergeError(w, r, err)
+		return
+	}
+	h.recordMerge(w, r, target.ID, result)
+}
+
+// AccountUnmergeHandler undoes the merge of another account into the
+// session user's within the grace period
+func (h *AuthHandler) AccountUnmergeHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Account unmerge request received")
+
+	user := contextUser(r)
+
+	var req UnmergeRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	source, err := h.users.GetByUsername(r.Context(), req.Username)
+	if err == nil && (source.Merge == nil || source.Merge.Into != user.ID) {
+		// Only the surviving account may undo its own merges
+		err = ErrUserNotFound
+	}
+	if err == nil {
+		_, err = h.unmergeAccount(r.Context(), source)
+	}
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to undo merge of %s: %v", req.Username, err)
+		writeMergeError(w, r, err)
+		return
+	}
+	h.recordUnmerge(w, r, user.ID, source, user)
+}
+
+// AdminMergeHandler merges one account into another on an admin's behalf
+func (h *AuthHandler) AdminMergeHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Admin account merge request received")
+
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req AdminMergeRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	source, err := h.users.Get(r.Context(), req.SourceID)
+	var target *User
+	if err == nil {
+		target, err = h.users.Get(r.Context(), req.TargetID)
+	}
+	var result MergeResponse
+	if err == nil {
+		result, err = h.mergeAccounts(r.Context(), source, target)
+	}
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to merge %s into %s: %v", req.SourceID, req.TargetID, err)
+		writeMergeError(w, r, err)
+		return
+	}
+	h.recordMerge(w, r, admin.ID, result)
+}
+
+// AdminUnmergeHandler undoes the merge of the account with the given ID
+// within the grace period
+func (h *AuthHandler) AdminUnmergeHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Admin account unmerge request received")
+
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	source, err := h.users.Get(r.Context(), mux.Vars(r)["id"])
+	var target *User
+	if err == nil {
+		target, err = h.unmergeAccount(r.Context(), source)
+	}
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to undo merge of %s: %v", mux.Vars(r)["id"], err)
+		writeMergeError(w, r, err)
+		return
+	}
+	h.recordUnmerge(w, r, admin.ID, source, target)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// recoveryMiddleware answers 500 when a handler panics instead of leaving
+// the client with a dropped connection. A panic after the response has
+// started can no longer change its status, so the connection is aborted
+// as streamError does. http.ErrAbortHandler is passed on untouched, since
+// handlers raise it on purpose.
+func (s *Server) recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			s.logger.Printf("[DEBUG] Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			if sw.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(w, localize(r, "Internal server error"), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// requestLogMiddleware logs every request once it has been answered, with
+// its status and how long it took
+func (s *Server) requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		s.logger.Printf("[DEBUG] %s %s %d %s", r.Method, r.URL.Path, sw.status, time.Since(start).Round(time.Microsecond))
+	})
+}
+
+// jsonMiddleware makes application/json the Content-Type of API responses
+// whose handler did not choose one, so handlers answering with Response
+// need not set it
+func (s *Server) jsonMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAPIPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&jsonWriter{statusWriter{ResponseWriter: w}}, r)
+	})
+}
+
+// jsonWriter sets the default Content-Type when the status is written, the
+// last moment a handler can still set its own. The statusWriter tells
+// whether it has been, and passes Flush and Hijack through.
+type jsonWriter struct {
+	statusWriter
+}
+
+func (jw *jsonWriter) WriteHeader(status int) {
+	if jw.status == 0 {
+		// A Content-Type set to nil turns off sniffing and counts as chosen
+		_, chosen := jw.Header()["Content-Type"]
+		if !chosen && status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified {
+			jw.Header().Set("Content-Type", "application/json")
+		}
+	}
+	jw.statusWriter.WriteHeader(status)
+}
+
+func (jw *jsonWriter) Write(p []byte) (int, error) {
+	if jw.status == 0 {
+		jw.WriteHeader(http.StatusOK)
+	}
+	return jw.statusWriter.Write(p)
+}
+
+// methodNotAllowedHandler answers requests for a route registered with
+// other methods, which the router checks so handlers need not. The
+// router's middleware does not run for these, so the language comes from
+// Accept-Language alone.
+func (s *Server) methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Invalid method: %s %s", r.Method, r.URL.Path)
+	if allowed := s.allowedMethods(r); len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+	}
+	http.Error(w, localize(r, "Method not allowed"), http.StatusMethodNotAllowed)
+}
+
+// allowedMethods lists the methods the routes matching r's path accept
+func (s *Server) allowedMethods(r *http.Request) []string {
+	var allowed []string
+	probe := r.Clone(r.Context())
+	s.router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			probe.Method = method
+			if !slices.Contains(allowed, method) && route.Match(probe, &mux.RouteMatch{}) {
+				allowed = append(allowed, method)
+			}
+		}
+		return nil
+	})
+	return allowed
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"auth-server/pkg/account"
+	v1 "auth-server/pkg/api/v1"
+)
+
+// The user account and the records kept on it are defined in package
+// account, so applications implementing UserStore need not import the
+// server
+type (
+	User                    = account.User
+	NotificationPreferences = account.NotificationPreferences
+	ProfileVisibility       = account.ProfileVisibility
+	LoginFingerprint        = account.LoginFingerprint
+	PersonalAccessToken     = account.PersonalAccessToken
+	RememberedDevice        = account.RememberedDevice
+	ConsentRecord           = account.ConsentRecord
+	Identity                = account.Identity
+	UsernameChange          = account.UsernameChange
+	AccountSuspension       = account.AccountSuspension
+	SignupReview            = account.SignupReview
+	AccountDormancy         = account.AccountDormancy
+	AccountDeletion         = account.AccountDeletion
+	AccountMerge            = account.AccountMerge
+)
+
+// userOrganization returns u's tenant: Organization, or else the domain
+// of the email address
+func userOrganization(u *User) string {
+	if u.Organization != "" {
+		return u.Organization
+	}
+	return tenantOf(u.Email)
+}
+
+// User roles
+const (
+	RoleUser    = "user"
+	RoleAdmin   = "admin"
+	RoleSupport = "support"
+)
+
+// The request and response bodies are defined in package v1, the first
+// version of the API
+type (
+	LoginRequest                = v1.LoginRequest
+	RegisterRequest             = v1.RegisterRequest
+	ChangePasswordRequest       = v1.ChangePasswordRequest
+	ChangeEmailRequest          = v1.ChangeEmailRequest
+	ChangeUsernameRequest       = v1.ChangeUsernameRequest
+	UpdateProfileRequest        = v1.UpdateProfileRequest
+	TwoFactorSetupRequest       = v1.TwoFactorSetupRequest
+	TwoFactorEnableRequest      = v1.TwoFactorEnableRequest
+	TwoFactorDisableRequest     = v1.TwoFactorDisableRequest
+	ReauthRequest               = v1.ReauthRequest
+	PhoneRequest                = v1.PhoneRequest
+	PhoneVerifyRequest          = v1.PhoneVerifyRequest
+	RecoveryCodesRequest        = v1.RecoveryCodesRequest
+	ChangeLocaleRequest         = v1.ChangeLocaleRequest
+	MagicLinkRequest            = v1.MagicLinkRequest
+	PasswordResetRequest        = v1.PasswordResetRequest
+	PasswordResetConfirmRequest = v1.PasswordResetConfirmRequest
+	TransformRequest            = v1.TransformRequest
+	Response                    = v1.Response
+)
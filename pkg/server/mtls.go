@@ -0,0 +1,93 @@
+package server
+
+import (
+	"auth-server/pkg/jwt"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// CertificateAccount is an internal caller, configured in
+// MTLS_SERVICE_ACCOUNTS, that authenticates on the mTLS listener with a
+// client certificate instead of a bearer token
+type CertificateAccount struct {
+	Name   string
+	Scopes []string
+}
+
+// claims stands in for a service token, so handlers behind RequireScope
+// see certificate callers the same way as token callers
+func (a CertificateAccount) claims(issuer, identity string) jwt.Claims {
+	return jwt.Claims{
+		Issuer:   issuer,
+		Subject:  identity,
+		Scope:    strings.Join(a.Scopes, " "),
+		ClientID: a.Name,
+	}
+}
+
+// newMTLSConfig loads the server certificate and the CAs client
+// certificates must chain to for the mTLS listener
+func newMTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.MTLSCertFile == "" || cfg.MTLSKeyFile == "" || cfg.MTLSClientCAFile == "" {
+		return nil, errors.New("MTLS_CERT_FILE, MTLS_KEY_FILE and MTLS_CLIENT_CA_FILE are required")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.MTLSCertFile, cfg.MTLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading server certificate: %w", err)
+	}
+	caPEM, err := os.ReadFile(cfg.MTLSClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CAs: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", cfg.MTLSClientCAFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// clientCertificate returns the verified certificate r's connection was
+// authenticated with, if any
+func clientCertificate(r *http.Request) (*x509.Certificate, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return nil, false
+	}
+	return r.TLS.PeerCertificates[0], true
+}
+
+// certificateIdentities lists the names a certificate can be mapped by,
+// most specific first: URI SANs such as SPIFFE IDs, DNS SANs, then the
+// subject common name
+func certificateIdentities(cert *x509.Certificate) []string {
+	var identities []string
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	identities = append(identities, cert.DNSNames...)
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	return identities
+}
+
+// serviceAccountFor returns the service account the first mapped identity
+// of cert belongs to, with that identity
+func (s *Server) serviceAccountFor(cert *x509.Certificate) (CertificateAccount, string, bool) {
+	for _, identity := range certificateIdentities(cert) {
+		if account, ok := s.config.MTLSServiceAccounts[identity]; ok {
+			return account, identity, true
+		}
+	}
+	return CertificateAccount{}, "", false
+}
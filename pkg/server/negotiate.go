@@ -0,0 +1,255 @@
+package server
+
+import (
+	"auth-server/pkg/msgpack"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ResponseEncoder renders a decoded JSON response body, made of
+// map[string]interface{}, []interface{}, string, json.Number, bool and
+// nil values, in another format
+type ResponseEncoder func(w io.Writer, v interface{}) error
+
+// responseEncoders holds the alternative response formats keyed by media
+// type. JSON is the default and is never re-encoded.
+var responseEncoders = map[string]ResponseEncoder{
+	"application/xml":         encodeXMLResponse,
+	"text/xml":                encodeXMLResponse,
+	"application/msgpack":     encodeMsgpackResponse,
+	"application/x-msgpack":   encodeMsgpackResponse,
+	"application/vnd.msgpack": encodeMsgpackResponse,
+}
+
+// RegisterResponseEncoder adds a response format for clients that ask for
+// mediaType in their Accept header. It must be called before the server
+// starts handling requests.
+func RegisterResponseEncoder(mediaType string, encoder ResponseEncoder) {
+	responseEncoders[strings.ToLower(mediaType)] = encoder
+}
+
+// negotiateFormat picks the response media type for an Accept header. It
+// returns "" for JSON, which is also the answer when nothing else matches.
+func negotiateFormat(accept string) string {
+	type candidate struct {
+		mediaType string
+		quality   float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if value, ok := params["q"]; ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		if quality <= 0 {
+			continue
+		}
+		candidates = append(candidates, candidate{mediaType: mediaType, quality: quality})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].quality > candidates[j].quality })
+
+	for _, c := range candidates {
+		switch c.mediaType {
+		case "application/json", "application/*", "*/*":
+			return ""
+		}
+		if _, ok := responseEncoders[c.mediaType]; ok {
+			return c.mediaType
+		}
+	}
+	return ""
+}
+
+// formatMiddleware renders JSON responses in the format the client's
+// Accept header prefers, so handlers only ever write JSON. Other responses,
+// such as streams and plain text errors, pass through unchanged.
+func (s *Server) formatMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		mediaType := negotiateFormat(r.Header.Get("Accept"))
+		if mediaType == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		fw := &formatWriter{ResponseWriter: w}
+		next.ServeHTTP(fw, r)
+		if !fw.buffering {
+			return
+		}
+
+		w.Header().Del("Content-Length")
+		var body interface{}
+		decoder := json.NewDecoder(&fw.body)
+		decoder.UseNumber()
+		var encoded bytes.Buffer
+		if err := decoder.Decode(&body); err != nil {
+			s.logger.Printf("[DEBUG] Response is not valid JSON, sending it unchanged: %v", err)
+			w.WriteHeader(fw.status)
+			w.Write(fw.body.Bytes())
+			return
+		}
+		if err := responseEncoders[mediaType](&encoded, body); err != nil {
+			s.logger.Printf("[DEBUG] Failed to encode response as %s: %v", mediaType, err)
+			w.Header().Del("Content-Type")
+			http.Error(w, localize(r, "Failed to encode response"), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", mediaType)
+		w.WriteHeader(fw.status)
+		w.Write(encoded.Bytes())
+	})
+}
+
+// formatWriter holds back JSON responses for formatMiddleware to
+// re-encode. The decision is made when the status is written, from the
+// Content-Type the handler set; anything else is written straight through.
+type formatWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buffering   bool
+	body        bytes.Buffer
+}
+
+func (fw *formatWriter) WriteHeader(status int) {
+	if fw.wroteHeader {
+		return
+	}
+	fw.wroteHeader = true
+	fw.status = status
+
+	mediaType, _, _ := mime.ParseMediaType(fw.Header().Get("Content-Type"))
+	fw.buffering = mediaType == "application/json"
+	if !fw.buffering {
+		fw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (fw *formatWriter) Write(p []byte) (int, error) {
+	if !fw.wroteHeader {
+		fw.WriteHeader(http.StatusOK)
+	}
+	if fw.buffering {
+		return fw.body.Write(p)
+	}
+	return fw.ResponseWriter.Write(p)
+}
+
+// Flush keeps streaming handlers working behind the writer
+func (fw *formatWriter) Flush() {
+	if fw.buffering {
+		return
+	}
+	if flusher, ok := fw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets WebSocket handlers take over the connection behind the
+// writer
+func (fw *formatWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := fw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+// encodeMsgpackResponse renders a response as MessagePack
+func encodeMsgpackResponse(w io.Writer, v interface{}) error {
+	return msgpack.NewEncoder(w).Encode(v)
+}
+
+// encodeXMLResponse renders a response as XML under a <response> element.
+// Object fields become child elements, array entries become <item>
+// elements, and keys that are not valid element names are written as
+// <entry key="...">.
+func encodeXMLResponse(w io.Writer, v interface{}) error {
+	encoder := xml.NewEncoder(w)
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	if err := encodeXMLValue(encoder, xml.StartElement{Name: xml.Name{Local: "response"}}, v); err != nil {
+		return err
+	}
+	return encoder.Flush()
+}
+
+func encodeXMLValue(encoder *xml.Encoder, start xml.StartElement, v interface{}) error {
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case nil:
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			child := xml.StartElement{Name: xml.Name{Local: key}}
+			if !validXMLName(key) {
+				child = xml.StartElement{
+					Name: xml.Name{Local: "entry"},
+					Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}},
+				}
+			}
+			if err := encodeXMLValue(encoder, child, v[key]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := encodeXMLValue(encoder, xml.StartElement{Name: xml.Name{Local: "item"}}, item); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := encoder.EncodeToken(xml.CharData(fmt.Sprint(v))); err != nil {
+			return err
+		}
+	}
+
+	return encoder.EncodeToken(start.End())
+}
+
+// validXMLName reports whether name can be used as an element name as is.
+// It is stricter than XML requires, allowing ASCII letters, digits, '_',
+// '-' and '.', and never a leading digit, '-', '.' or "xml".
+func validXMLName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case i > 0 && (c >= '0' && c <= '9' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"auth-server/pkg/ids"
+	"auth-server/pkg/jwt"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ScopeUsersRead allows service clients to look up user accounts
+const ScopeUsersRead = "users:read"
+
+// TokenResponse is the OAuth2 access token response (RFC 6749 section 5.1)
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// serviceClaimsKey is the context key for verified service token claims
+type serviceClaimsKey struct{}
+
+// serviceClaims returns the service token claims stored by requireScope
+func serviceClaims(r *http.Request) (jwt.Claims, bool) {
+	claims, ok := r.Context().Value(serviceClaimsKey{}).(jwt.Claims)
+	return claims, ok
+}
+
+// writeOAuthError writes an OAuth2 error response (RFC 6749 section 5.2)
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// TokenHandler implements the OAuth2 client_credentials grant, and the
+// device_code grant devices poll with. Clients, and service accounts with
+// one of their keys, authenticate with HTTP Basic auth or client_id and
+// client_secret form fields.
+func (s *Server) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Token request received")
+
+	if err := r.ParseForm(); err != nil {
+		s.logger.Printf("[DEBUG] Failed to parse token request: %v", err)
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Request body must be form encoded")
+		return
+	}
+
+	grantType := r.PostForm.Get("grant_type")
+	if grantType == deviceCodeGrantType {
+		s.deviceCodeGrant(w, r)
+		return
+	}
+	if grantType != "client_credentials" {
+		s.logger.Printf("[DEBUG] Unsupported grant type: %q", grantType)
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only the client_credentials and device_code grants are supported")
+		return
+	}
+
+	clientID, clientSecret, basic := r.BasicAuth()
+	if !basic {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+
+	now := time.Now()
+	claims := jwt.Claims{
+		Issuer:    s.config.TokenIssuer,
+		Subject:   clientID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(s.config.ClientTokenTTL).Unix(),
+		ID:        generateID(ids.PrefixToken),
+		ClientID:  clientID,
+	}
+	details := map[string]string{"client": clientID}
+	var allowed []string
+	authenticated := false
+	if isServiceAccountID(clientID) {
+		var account *ServiceAccount
+		var keyID string
+		if account, keyID, authenticated = s.serviceAccounts.authenticate(clientID, clientSecret, clientIP(r), s.authHandler.clock.Now()); authenticated {
+			allowed = account.Scopes
+			claims.Organization = account.Organization
+			details = map[string]string{"serviceAccount": account.ID, "key": keyID}
+		}
+	} else {
+		var client *OAuthClient
+		if client, authenticated = s.clients.authenticate(clientID, clientSecret); authenticated {
+			allowed = client.Scopes
+		}
+	}
+	if !authenticated {
+		s.logger.Printf("[DEBUG] Client authentication failed: %s", clientID)
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="auth-server"`)
+		}
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	// An omitted scope grants everything the client is registered for
+	scopes := strings.Fields(r.PostForm.Get("scope"))
+	if len(scopes) == 0 {
+		scopes = allowed
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(allowed, scope) {
+			s.logger.Printf("[DEBUG] Client %s requested unregistered scope %q", clientID, scope)
+			writeOAuthError(w, http.StatusBadRequest, "invalid_scope", fmt.Sprintf("Scope %q is not allowed for this client", scope))
+			return
+		}
+	}
+	claims.Scope = strings.Join(scopes, " ")
+
+	token, err := s.tokenKeys.Sign(claims)
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to sign token: %v", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Failed to issue token")
+		return
+	}
+
+	details["scope"] = claims.Scope
+	details["jti"] = claims.ID
+	s.audit.Record(AuditEvent{
+		Type:    AuditTokenIssued,
+		IP:      clientIP(r),
+		Details: details,
+	})
+
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(s.config.ClientTokenTTL.Seconds()),
+		Scope:       claims.Scope,
+	})
+	s.logger.Printf("[DEBUG] Token issued to client: %s", clientID)
+}
+
+// verifyServiceToken checks a bearer token's signature, expiry and issuer
+func (s *Server) verifyServiceToken(token string) (jwt.Claims, error) {
+	claims, err := jwt.Verify(token, s.tokenKeys.KeyFunc, time.Now())
+	if err != nil {
+		return jwt.Claims{}, err
+	}
+	if claims.Issuer != s.config.TokenIssuer {
+		return jwt.Claims{}, errors.New("unexpected token issuer")
+	}
+	return claims, nil
+}
+
+// clientActive reports whether the client a service token was issued to
+// may still use it: an enabled service account, or a registered OAuth
+// client that has not been deleted
+func (s *Server) clientActive(clientID string) bool {
+	if isServiceAccountID(clientID) {
+		return s.serviceAccounts.active(clientID)
+	}
+	_, ok := s.clients.get(clientID)
+	return ok
+}
+
+// serviceCaller authenticates a service caller: by its client certificate
+// on the mTLS listener, where tokens are not looked at, or else by its
+// service token. It answers the request itself when that fails.
+func (s *Server) serviceCaller(w http.ResponseWriter, r *http.Request) (jwt.Claims, bool) {
+	if cert, ok := clientCertificate(r); ok {
+		account, identity, ok := s.serviceAccountFor(cert)
+		if !ok {
+			s.logger.Printf("[DEBUG] Client certificate %s is not mapped to a service account", cert.Subject)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return jwt.Claims{}, false
+		}
+		return account.claims(s.config.TokenIssuer, identity), true
+	}
+
+	header := r.Header.Get("Authorization")
+	token, found := strings.CutPrefix(header, "Bearer ")
+	if !found || token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="auth-server"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return jwt.Claims{}, false
+	}
+
+	claims, err := s.verifyServiceToken(token)
+	if err == nil && !s.clientActive(claims.ClientID) {
+		err = fmt.Errorf("client %s disabled or deleted", claims.ClientID)
+	}
+	if err != nil {
+		s.logger.Printf("[DEBUG] Service token rejected: %v", err)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="auth-server", error="invalid_token"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return jwt.Claims{}, false
+	}
+	return claims, true
+}
+
+// RequireScope only calls next for service callers that were granted
+// scope, whether by a service token or by the service account of their
+// client certificate. The caller's claims are stored in the request context.
+func (s *Server) RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := s.serviceCaller(w, r)
+		if !ok {
+			return
+		}
+
+		if !claims.HasScope(scope) {
+			s.logger.Printf("[DEBUG] Client %s lacks scope %s", claims.ClientID, scope)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="auth-server", error="insufficient_scope", scope=%q`, scope))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), serviceClaimsKey{}, claims)))
+	}
+}
+
+// InternalUserHandler returns a user account to service clients holding
+// the users:read scope
+func (s *Server) InternalUserHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Internal user lookup request received")
+
+	id := mux.Vars(r)["id"]
+	user, err := s.authHandler.users.Get(r.Context(), id)
+	if errors.Is(err, ErrUserNotFound) {
+		s.logger.Printf("[DEBUG] User not found: %s", id)
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Printf("[DEBUG] User lookup failed: %v", err)
+		writeStoreError(w, r, err)
+		return
+	}
+	claims, _ := serviceClaims(r)
+	// Callers limited to an organization cannot tell its users from others
+	if claims.Organization != "" && userOrganization(user) != claims.Organization {
+		s.logger.Printf("[DEBUG] User %s is outside organization %s of client %s", id, claims.Organization, claims.ClientID)
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if s.authHandler.checkNotModified(w, r, user) {
+		return
+	}
+	s.logger.Printf("[DEBUG] User %s looked up by client: %s", id, claims.ClientID)
+
+	response := Response{
+		Success: true,
+		Message: "User retrieved successfully",
+		Data:    user.Sanitized(),
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
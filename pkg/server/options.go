@@ -0,0 +1,72 @@
+package server
+
+import (
+	"auth-server/pkg/mailer"
+	"auth-server/pkg/sms"
+	"io"
+	"log"
+	"os"
+)
+
+// Option changes the Config New builds a server from. The With options
+// replace a dependency New would otherwise build from the settings, so an
+// application can wire in its own backends without changing main.go:
+//
+//	srv, err := server.New(server.LoadConfig(),
+//		server.WithStore(users),
+//		server.WithSessionManager(sessions),
+//	)
+type Option func(*Config)
+
+// WithStore keeps users in store (see Config.UserStore)
+func WithStore(store UserStore) Option {
+	return func(cfg *Config) { cfg.UserStore = store }
+}
+
+// WithSessionManager keeps server-side sessions in sessions
+func WithSessionManager(sessions SessionManager) Option {
+	return func(cfg *Config) { cfg.SessionManager = sessions }
+}
+
+// WithMailer sends email through m instead of SMTP
+func WithMailer(m mailer.Mailer) Option {
+	return func(cfg *Config) { cfg.Mailer = m }
+}
+
+// WithSMSSender sends text messages through sender
+func WithSMSSender(sender sms.Sender) Option {
+	return func(cfg *Config) { cfg.SMSSender = sender }
+}
+
+// WithPasswordHasher hashes and checks passwords with hasher instead of
+// bcrypt
+func WithPasswordHasher(hasher Hasher) Option {
+	return func(cfg *Config) { cfg.PasswordHasher = hasher }
+}
+
+// WithClock reads the time from clock
+func WithClock(clock Clock) Option {
+	return func(cfg *Config) { cfg.Clock = clock }
+}
+
+// WithIDGenerator creates IDs with generator
+func WithIDGenerator(generator IDGenerator) Option {
+	return func(cfg *Config) { cfg.IDGenerator = generator }
+}
+
+// WithAuditOutput writes the audit log lines to w instead of stderr; pass
+// io.Discard to drop them
+func WithAuditOutput(w io.Writer) Option {
+	return func(cfg *Config) { cfg.AuditLogOutput = w }
+}
+
+// WithLogger writes the [DEBUG] diagnostics to logger instead of stderr
+func WithLogger(logger *log.Logger) Option {
+	return func(cfg *Config) { cfg.Logger = logger }
+}
+
+// newStderrLogger is the default Logger. It writes the lines as they are,
+// without the date the log package would add.
+func newStderrLogger() *log.Logger {
+	return log.New(os.Stderr, "", 0)
+}
@@ -0,0 +1,504 @@
+package server
+
+import (
+	"auth-server/pkg/ids"
+	"auth-server/pkg/mailer"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of outbox message
+const (
+	OutboxKindEmail   = "email"
+	OutboxKindWebhook = "webhook"
+	OutboxKindAlert   = "alert"
+)
+
+// Retries back off exponentially from outboxRetryBase up to outboxRetryMax
+const (
+	outboxRetryBase = 30 * time.Second
+	outboxRetryMax  = time.Hour
+)
+
+var (
+	errOutboxMessageNotFound = errors.New("outbox message not found")
+	errOutboxMessageInFlight = errors.New("outbox message is being delivered")
+	errWebhooksDisabled      = errors.New("webhooks are not configured")
+)
+
+// OutboxMessage is an email, webhook or admin alert waiting to be
+// delivered. It stays in the outbox until delivery succeeds, so a message
+// the process dies while sending is sent again after a restart: delivery
+// is at least once.
+type OutboxMessage struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Label names the message in logs: the email template, the hook or
+	// the alert type
+	Label string          `json:"label"`
+	Email *mailer.Message `json:"email,omitempty"`
+	// Webhook is the payload of hooks and alerts
+	Webhook *OutboxWebhook `json:"webhook,omitempty"`
+
+	CreatedAt     time.Time `json:"createdAt"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	LastError     string    `json:"lastError,omitempty"`
+	// DeadAt is set once the message ran out of attempts. Dead letters are
+	// only retried when an admin redelivers them.
+	DeadAt *time.Time `json:"deadAt,omitempty"`
+}
+
+// OutboxWebhook is a webhook payload, signed when it is sent
+type OutboxWebhook struct {
+	URL  string          `json:"url"`
+	Body json.RawMessage `json:"body"`
+}
+
+// OutboxEntry describes an outbox message to admins. Email bodies are left
+// out, since they can hold sign-in and reset links.
+type OutboxEntry struct {
+	ID            string     `json:"id"`
+	Kind          string     `json:"kind"`
+	Label         string     `json:"label"`
+	Recipient     string     `json:"recipient"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"nextAttemptAt"`
+	LastError     string     `json:"lastError,omitempty"`
+	DeadAt        *time.Time `json:"deadAt,omitempty"`
+}
+
+func (m OutboxMessage) entry() OutboxEntry {
+	entry := OutboxEntry{
+		ID:            m.ID,
+		Kind:          m.Kind,
+		Label:         m.Label,
+		CreatedAt:     m.CreatedAt,
+		Attempts:      m.Attempts,
+		NextAttemptAt: m.NextAttemptAt,
+		LastError:     m.LastError,
+		DeadAt:        m.DeadAt,
+	}
+	switch {
+	case m.Email != nil:
+		entry.Recipient = m.Email.To
+	case m.Webhook != nil:
+		entry.Recipient = m.Webhook.URL
+	}
+	return entry
+}
+
+// outbox holds undelivered messages and saves them to path after every
+// change, so they survive restarts. Messages being delivered are claimed
+// so the dispatcher and a first attempt never send one twice at once.
+// Webhooks to a paused endpoint wait in the outbox until it is resumed.
+type outbox struct {
+	path      string
+	retention time.Duration // how long dead letters are kept
+	logger    *log.Logger
+
+	mutex    sync.Mutex
+	messages map[string]*OutboxMessage
+	claimed  map[string]bool
+	paused   map[string]time.Time // webhook URL to when it was paused
+}
+
+// savedOutbox is the outbox file
+type savedOutbox struct {
+	Messages []*OutboxMessage     `json:"messages"`
+	Paused   map[string]time.Time `json:"paused,omitempty"`
+}
+
+// newOutbox restores the messages saved at path, if any. Without a path
+// messages are only kept in memory.
+func newOutbox(path string, retention time.Duration, logger *log.Logger) (*outbox, error) {
+	o := &outbox{
+		path:      path,
+		retention: retention,
+		logger:    logger,
+		messages:  make(map[string]*OutboxMessage),
+		claimed:   make(map[string]bool),
+		paused:    make(map[string]time.Time),
+	}
+	if path == "" {
+		return o, nil
+	}
+
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading outbox: %w", err)
+	}
+	var saved savedOutbox
+	if err := json.Unmarshal(contents, &saved); err != nil {
+		return nil, fmt.Errorf("parsing outbox %s: %w", path, err)
+	}
+	for _, msg := range saved.Messages {
+		o.messages[msg.ID] = msg
+	}
+	for url, since := range saved.Paused {
+		o.paused[url] = since
+	}
+	if len(saved.Messages) > 0 {
+		o.logger.Printf("[DEBUG] Restored %d undelivered messages from %s", len(saved.Messages), path)
+	}
+	return o, nil
+}
+
+// save writes the outbox to its file. The caller holds the lock.
+func (o *outbox) save() error {
+	if o.path == "" {
+		return nil
+	}
+	saved := savedOutbox{Messages: make([]*OutboxMessage, 0, len(o.messages)), Paused: o.paused}
+	for _, msg := range o.messages {
+		saved.Messages = append(saved.Messages, msg)
+	}
+	sort.Slice(saved.Messages, func(i, j int) bool { return saved.Messages[i].ID < saved.Messages[j].ID })
+	contents, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(o.path, contents); err != nil {
+		return fmt.Errorf("saving outbox: %w", err)
+	}
+	return nil
+}
+
+// add stores msg and, unless it is for a paused endpoint, claims it for
+// its first attempt to follow. It reports whether msg was claimed.
+func (o *outbox) add(msg OutboxMessage) (bool, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.messages[msg.ID] = &msg
+	claimed := !o.isPaused(msg)
+	o.claimed[msg.ID] = claimed
+	return claimed, o.save()
+}
+
+// isPaused reports whether msg is a webhook to a paused endpoint. The
+// caller holds the lock.
+func (o *outbox) isPaused(msg OutboxMessage) bool {
+	if msg.Webhook == nil {
+		return false
+	}
+	_, paused := o.paused[msg.Webhook.URL]
+	return paused
+}
+
+// claimDue claims and returns the live messages due an attempt at now
+func (o *outbox) claimDue(now time.Time) []OutboxMessage {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	var due []OutboxMessage
+	for id, msg := range o.messages {
+		if o.claimed[id] || msg.DeadAt != nil || now.Before(msg.NextAttemptAt) || o.isPaused(*msg) {
+			continue
+		}
+		o.claimed[id] = true
+		due = append(due, *msg)
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+	return due
+}
+
+// delivered removes a delivered message
+func (o *outbox) delivered(id string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	delete(o.messages, id)
+	delete(o.claimed, id)
+	return o.save()
+}
+
+// failed records a failed attempt and releases the message, scheduling a
+// retry or, after maxAttempts, dead-lettering it. It reports whether the
+// message is now dead.
+func (o *outbox) failed(id string, cause error, now time.Time, maxAttempts int) (bool, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	delete(o.claimed, id)
+	msg, ok := o.messages[id]
+	if !ok {
+		return false, nil
+	}
+	msg.Attempts++
+	msg.LastError = cause.Error()
+	if msg.Attempts >= maxAttempts {
+		msg.DeadAt = &now
+	} else {
+		backoff := outboxRetryBase << (msg.Attempts - 1)
+		if backoff > outboxRetryMax || backoff <= 0 {
+			backoff = outboxRetryMax
+		}
+		msg.NextAttemptAt = now.Add(backoff)
+	}
+	return msg.DeadAt != nil, o.save()
+}
+
+// redeliver brings a message back for another round of attempts and claims
+// it for the first
+func (o *outbox) redeliver(id string, now time.Time) (OutboxMessage, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	msg, ok := o.messages[id]
+	if !ok {
+		return OutboxMessage{}, errOutboxMessageNotFound
+	}
+	if o.claimed[id] {
+		return OutboxMessage{}, errOutboxMessageInFlight
+	}
+	msg.Attempts = 0
+	msg.DeadAt = nil
+	msg.NextAttemptAt = now
+	o.claimed[id] = true
+	return *msg, o.save()
+}
+
+// list returns every message, oldest first
+func (o *outbox) list() []OutboxMessage {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	messages := make([]OutboxMessage, 0, len(o.messages))
+	for _, msg := range o.messages {
+		messages = append(messages, *msg)
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages
+}
+
+// pause holds back the webhooks to url until it is resumed
+func (o *outbox) pause(url string, now time.Time) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if _, ok := o.paused[url]; ok {
+		return nil
+	}
+	o.paused[url] = now
+	return o.save()
+}
+
+// resume lets the webhooks to url go out again, reporting whether it was
+// paused. Those that fell due meanwhile go out with the next dispatch.
+func (o *outbox) resume(url string) (bool, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if _, ok := o.paused[url]; !ok {
+		return false, nil
+	}
+	delete(o.paused, url)
+	return true, o.save()
+}
+
+// pausedEndpoints returns the paused webhook URLs and when they were paused
+func (o *outbox) pausedEndpoints() map[string]time.Time {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	paused := make(map[string]time.Time, len(o.paused))
+	for url, since := range o.paused {
+		paused[url] = since
+	}
+	return paused
+}
+
+// Purge removes the dead letters older than the retention period and
+// returns how many it removed
+func (o *outbox) Purge(now time.Time) int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	purged := 0
+	for id, msg := range o.messages {
+		if msg.DeadAt != nil && now.Sub(*msg.DeadAt) >= o.retention {
+			delete(o.messages, id)
+			purged++
+		}
+	}
+	if purged > 0 {
+		if err := o.save(); err != nil {
+			o.logger.Printf("[DEBUG] Failed to save outbox after purge: %v", err)
+		}
+	}
+	return purged
+}
+
+// enqueue stores msg in the outbox and makes its first attempt in the
+// background, unless its endpoint is paused. Should the outbox fail to save
+// it, the attempt is still made. It returns msg as stored.
+func (h *AuthHandler) enqueue(ctx context.Context, msg OutboxMessage) OutboxMessage {
+	now := h.clock.Now()
+	msg.ID = h.idGenerator.NewID(ids.PrefixMessage)
+	msg.CreatedAt = now
+	msg.NextAttemptAt = now
+	claimed, err := h.outbox.add(msg)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to store %s %s in the outbox: %v", msg.Kind, msg.Label, err)
+	}
+	if claimed {
+		go h.deliver(context.WithoutCancel(ctx), msg)
+	}
+	return msg
+}
+
+// deliver makes one attempt at a claimed message and records the outcome
+func (h *AuthHandler) deliver(ctx context.Context, msg OutboxMessage) {
+	var err error
+	switch msg.Kind {
+	case OutboxKindEmail:
+		sendCtx, cancel := context.WithTimeout(ctx, h.config.SMTPTimeout)
+		err = h.mailer.Send(sendCtx, *msg.Email)
+		cancel()
+		h.slo.observeMail(err)
+	case OutboxKindWebhook:
+		if h.webhooks == nil {
+			err = errWebhooksDisabled
+		} else {
+			err = h.webhooks.send(ctx, msg)
+		}
+	case OutboxKindAlert:
+		if h.alerts == nil {
+			err = errAlertsDisabled
+		} else {
+			err = h.alerts.send(ctx, msg)
+		}
+	default:
+		err = fmt.Errorf("unknown message kind %q", msg.Kind)
+	}
+
+	if err == nil {
+		if err := h.outbox.delivered(msg.ID); err != nil {
+			h.logger.Printf("[DEBUG] Failed to remove delivered message %s from the outbox: %v", msg.ID, err)
+		}
+		return
+	}
+
+	h.logger.Printf("[DEBUG] Failed to deliver %s %s (%s): %v", msg.Kind, msg.Label, msg.ID, err)
+	dead, saveErr := h.outbox.failed(msg.ID, err, h.clock.Now(), h.config.OutboxMaxAttempts)
+	if saveErr != nil {
+		h.logger.Printf("[DEBUG] Failed to save outbox: %v", saveErr)
+	}
+	if dead {
+		h.logger.Printf("[DEBUG] Message %s dead-lettered after %d attempts", msg.ID, h.config.OutboxMaxAttempts)
+	}
+}
+
+// dispatchOutbox attempts every message due at now, one after another, and
+// returns how many it attempted
+func (h *AuthHandler) dispatchOutbox(now time.Time) int {
+	due := h.outbox.claimDue(now)
+	for _, msg := range due {
+		h.deliver(context.Background(), msg)
+	}
+	return len(due)
+}
+
+// startOutbox dispatches due messages every Config.OutboxInterval until
+// the returned stop function is called
+func (h *AuthHandler) startOutbox() (stop func()) {
+	ticker := time.NewTicker(h.config.OutboxInterval)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ticker.C:
+				h.dispatchOutbox(h.clock.Now())
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// AdminOutboxHandler lists the undelivered messages, oldest first.
+// ?status=pending lists those still being retried and ?status=dead the
+// dead letters.
+func (h *AuthHandler) AdminOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Outbox request received")
+
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status != "" && status != "pending" && status != "dead" {
+		http.Error(w, localize(r, "Invalid status"), http.StatusBadRequest)
+		return
+	}
+
+	entries := []OutboxEntry{}
+	for _, msg := range h.outbox.list() {
+		if (status == "pending" && msg.DeadAt != nil) || (status == "dead" && msg.DeadAt == nil) {
+			continue
+		}
+		entries = append(entries, msg.entry())
+	}
+
+	json.NewEncoder(w).Encode(Response{Success: true, Data: entries})
+}
+
+// AdminOutboxRedeliverHandler retries an undelivered message now, with a
+// fresh set of attempts. Dead letters go back to being retried.
+func (h *AuthHandler) AdminOutboxRedeliverHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Outbox redelivery request received")
+
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	msg, err := h.outbox.redeliver(mux.Vars(r)["id"], h.clock.Now())
+	switch {
+	case errors.Is(err, errOutboxMessageNotFound):
+		http.Error(w, localize(r, "Message not found"), http.StatusNotFound)
+		return
+	case errors.Is(err, errOutboxMessageInFlight):
+		http.Error(w, localize(r, "The message is being delivered"), http.StatusConflict)
+		return
+	case err != nil:
+		// The message is claimed, so it must be attempted anyway
+		h.logger.Printf("[DEBUG] Failed to save outbox: %v", err)
+	}
+	go h.deliver(context.WithoutCancel(r.Context()), msg)
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditOutboxRedelivered,
+		UserID:  admin.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"message": msg.ID, "kind": msg.Kind, "label": msg.Label},
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: localize(r, "Message queued for delivery"),
+		Data:    msg.entry(),
+	})
+}
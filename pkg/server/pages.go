@@ -0,0 +1,486 @@
+package server
+
+import (
+	"auth-server/pkg/randutil"
+	"auth-server/pkg/totp"
+	"bytes"
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+//go:embed templates/*.html
+var pageTemplates embed.FS
+
+// pageCSRFCookie holds the double-submit token that page forms must echo
+const pageCSRFCookie = "page-csrf"
+
+// Branding customises the look of the hosted pages
+type Branding struct {
+	Name            string
+	LogoURL         string
+	PrimaryColor    string
+	BackgroundColor string
+	FooterLinks     []FooterLink
+}
+
+// FooterLink is a link shown at the bottom of every hosted page
+type FooterLink struct {
+	Label string
+	URL   string
+}
+
+var cssColorPattern = regexp.MustCompile(`^#(?:[0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// loadBranding reads the BRAND_* environment variables. BRAND_FOOTER_LINKS
+// is a comma-separated list of label=url pairs.
+func loadBranding() Branding {
+	branding := Branding{
+		Name:            os.Getenv("BRAND_NAME"),
+		LogoURL:         os.Getenv("BRAND_LOGO_URL"),
+		PrimaryColor:    brandColor("BRAND_PRIMARY_COLOR", "#2563eb"),
+		BackgroundColor: brandColor("BRAND_BACKGROUND_COLOR", "#f3f4f6"),
+	}
+	if branding.Name == "" {
+		branding.Name = "Go Auth Server"
+	}
+
+	for _, item := range splitList(os.Getenv("BRAND_FOOTER_LINKS")) {
+		label, link, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(label) == "" {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Ignoring invalid BRAND_FOOTER_LINKS entry %q\n", item)
+			continue
+		}
+		branding.FooterLinks = append(branding.FooterLinks, FooterLink{
+			Label: strings.TrimSpace(label),
+			URL:   strings.TrimSpace(link),
+		})
+	}
+	return branding
+}
+
+// brandColor reads a #rgb or #rrggbb color, returning fallback when it is
+// unset or invalid
+func brandColor(name, fallback string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	if !cssColorPattern.MatchString(value) {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Invalid %s %q, using default\n", name, value)
+		return fallback
+	}
+	return value
+}
+
+// pageData is passed to every page template
+type pageData struct {
+	Brand     Branding
+	Locale    string
+	BasePath  string
+	Title     string
+	Error     string
+	Notice    string
+	CSRFToken string
+	ReturnTo  string
+	Username  string
+	Email     string
+	Token     string
+	UserCode  string
+	// Device is the device authorization the user is asked to decide on
+	Device *DeviceAuthorizationInfo
+	// Documents are the legal documents the form asks the user to accept
+	Documents []LegalDocument
+	// RememberMe offers to keep the user signed in on this device
+	RememberMe bool
+}
+
+// T translates a template label into the page's language
+func (d pageData) T(msg string) string {
+	return translations.T(d.Locale, msg)
+}
+
+// pageRenderer renders the hosted page templates, each combined with the
+// shared layout
+type pageRenderer struct {
+	branding Branding
+	basePath string
+	pages    map[string]*template.Template
+	logger   *log.Logger
+}
+
+func newPageRenderer(branding Branding, basePath string, logger *log.Logger) (*pageRenderer, error) {
+	renderer := &pageRenderer{branding: branding, basePath: basePath, pages: make(map[string]*template.Template), logger: logger}
+	for _, name := range []string{"login", "register", "reset_password", "device"} {
+		page, err := template.ParseFS(pageTemplates, "templates/layout.html", "templates/"+name+".html")
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s page template: %w", name, err)
+		}
+		renderer.pages[name] = page
+	}
+	return renderer, nil
+}
+
+func (p *pageRenderer) render(w http.ResponseWriter, r *http.Request, status int, name string, data pageData) {
+	data.Brand = p.branding
+	data.BasePath = p.basePath
+	data.Locale = requestLocale(r)
+
+	var buf bytes.Buffer
+	if err := p.pages[name].ExecuteTemplate(&buf, "layout", data); err != nil {
+		p.logger.Printf("[DEBUG] Failed to render %s page: %v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// pageRoutes registers the hosted pages when they are enabled
+func (s *Server) pageRoutes() error {
+	if !s.config.HostedPages {
+		return nil
+	}
+
+	renderer, err := newPageRenderer(s.config.Branding, s.config.BasePath, s.logger)
+	if err != nil {
+		return err
+	}
+	s.pages = renderer
+
+	s.router.HandleFunc("/login", s.LoginPageHandler).Methods("GET", "POST")
+	s.router.HandleFunc("/register", s.RegisterPageHandler).Methods("GET", "POST")
+	s.router.HandleFunc("/reset-password", s.ResetPasswordPageHandler).Methods("GET", "POST")
+	s.router.HandleFunc("/device", s.DevicePageHandler).Methods("GET", "POST")
+	s.logger.Printf("[DEBUG] Hosted pages registered")
+	return nil
+}
+
+// LoginPageHandler renders the hosted login form and signs the user in on
+// submit, redirecting to the return_to path
+func (s *Server) LoginPageHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Login page request received")
+
+	data := pageData{
+		Title:      localize(r, "Sign in"),
+		CSRFToken:  pageCSRFToken(w, r, s.config.BasePath),
+		ReturnTo:   localReturnTo(r.FormValue("return_to")),
+		Documents:  s.authHandler.legalDocuments(),
+		RememberMe: s.config.RememberMe,
+	}
+	if data.ReturnTo == "/" {
+		// The frontend's home is under the base path
+		data.ReturnTo = s.config.BasePath + "/"
+	}
+	if r.Method != http.MethodPost {
+		switch r.URL.Query().Get("notice") {
+		case "registered":
+			data.Notice = localize(r, "Your account has been created. You can now sign in.")
+		case "reset":
+			data.Notice = localize(r, "Your password has been reset. Sign in with your new password.")
+		}
+		s.pages.render(w, r, http.StatusOK, "login", data)
+		return
+	}
+
+	if !validPageCSRF(r) {
+		data.Error = localize(r, "Your session expired, please try again.")
+		s.pages.render(w, r, http.StatusForbidden, "login", data)
+		return
+	}
+
+	data.Username = r.PostFormValue("username")
+	req := LoginRequest{
+		Username:     data.Username,
+		Password:     r.PostFormValue("password"),
+		CaptchaToken: r.PostFormValue("captcha_token"),
+		AcceptTerms:  r.PostFormValue("accept_terms") != "",
+		RememberMe:   r.PostFormValue("remember_me") != "",
+	}
+	// One field takes an authenticator, texted or recovery code
+	if code := strings.TrimSpace(r.PostFormValue("code")); code != "" {
+		if isTOTPCode(code) {
+			req.TOTPCode = code
+			req.SMSCode = code
+		} else {
+			req.RecoveryCode = code
+		}
+	}
+	result := s.submitPage(r, s.authHandler.LoginHandler, req)
+	if result.status != http.StatusOK {
+		data.Error = result.message
+		s.pages.render(w, r, result.status, "login", data)
+		return
+	}
+
+	// Keep the session cookie the login handler set
+	for _, cookie := range result.header.Values("Set-Cookie") {
+		w.Header().Add("Set-Cookie", cookie)
+	}
+	http.Redirect(w, r, data.ReturnTo, http.StatusSeeOther)
+}
+
+// RegisterPageHandler renders the hosted registration form and creates the
+// account on submit, then sends the user to the login page
+func (s *Server) RegisterPageHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Register page request received")
+
+	data := pageData{
+		Title:     localize(r, "Create account"),
+		CSRFToken: pageCSRFToken(w, r, s.config.BasePath),
+		Documents: s.authHandler.legalDocuments(),
+	}
+	if r.Method != http.MethodPost {
+		s.pages.render(w, r, http.StatusOK, "register", data)
+		return
+	}
+
+	if !validPageCSRF(r) {
+		data.Error = localize(r, "Your session expired, please try again.")
+		s.pages.render(w, r, http.StatusForbidden, "register", data)
+		return
+	}
+
+	data.Username, data.Email = r.PostFormValue("username"), r.PostFormValue("email")
+	if r.PostFormValue("password") != r.PostFormValue("confirm_password") {
+		data.Error = localize(r, "Passwords do not match")
+		s.pages.render(w, r, http.StatusBadRequest, "register", data)
+		return
+	}
+
+	result := s.submitPage(r, s.authHandler.RegisterHandler, RegisterRequest{
+		Username:     data.Username,
+		Email:        data.Email,
+		Password:     r.PostFormValue("password"),
+		CaptchaToken: r.PostFormValue("captcha_token"),
+		AcceptTerms:  r.PostFormValue("accept_terms") != "",
+	})
+	if result.status != http.StatusCreated {
+		data.Error = result.message
+		s.pages.render(w, r, result.status, "register", data)
+		return
+	}
+
+	http.Redirect(w, r, s.config.BasePath+"/login?notice=registered", http.StatusSeeOther)
+}
+
+// ResetPasswordPageHandler asks for an email to send a reset link to, or,
+// when opened from that link, for the new password
+func (s *Server) ResetPasswordPageHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Reset password page request received")
+
+	data := pageData{Title: localize(r, "Reset password"), CSRFToken: pageCSRFToken(w, r, s.config.BasePath), Token: r.FormValue("token")}
+	if r.Method != http.MethodPost {
+		s.pages.render(w, r, http.StatusOK, "reset_password", data)
+		return
+	}
+
+	if !validPageCSRF(r) {
+		data.Error = localize(r, "Your session expired, please try again.")
+		s.pages.render(w, r, http.StatusForbidden, "reset_password", data)
+		return
+	}
+
+	// Without a token this is a request for a reset link
+	if data.Token == "" {
+		data.Email = r.PostFormValue("email")
+		result := s.submitPage(r, s.authHandler.PasswordResetRequestHandler, PasswordResetRequest{Email: data.Email})
+		if result.status != http.StatusOK {
+			data.Error = result.message
+		} else {
+			data.Notice = result.message
+		}
+		s.pages.render(w, r, result.status, "reset_password", data)
+		return
+	}
+
+	if r.PostFormValue("new_password") != r.PostFormValue("confirm_password") {
+		data.Error = localize(r, "Passwords do not match")
+		s.pages.render(w, r, http.StatusBadRequest, "reset_password", data)
+		return
+	}
+
+	result := s.submitPage(r, s.authHandler.PasswordResetConfirmHandler, PasswordResetConfirmRequest{
+		Token:       data.Token,
+		NewPassword: r.PostFormValue("new_password"),
+	})
+	if result.status != http.StatusOK {
+		data.Error = result.message
+		s.pages.render(w, r, result.status, "reset_password", data)
+		return
+	}
+
+	http.Redirect(w, r, s.config.BasePath+"/login?notice=reset", http.StatusSeeOther)
+}
+
+// DevicePageHandler is the verification page of the device grant: the
+// signed-in user enters the code their device shows, then approves or
+// denies it. Visitors without a session are sent to sign in first.
+func (s *Server) DevicePageHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Device page request received")
+
+	userCode := strings.TrimSpace(r.FormValue("user_code"))
+	if _, err := s.authHandler.sessionUser(r); err != nil {
+		returnTo := s.config.BasePath + "/device"
+		if userCode != "" {
+			returnTo += "?user_code=" + url.QueryEscape(userCode)
+		}
+		http.Redirect(w, r, s.config.BasePath+"/login?return_to="+url.QueryEscape(returnTo), http.StatusSeeOther)
+		return
+	}
+
+	data := pageData{Title: localize(r, "Connect a device"), CSRFToken: pageCSRFToken(w, r, s.config.BasePath), UserCode: userCode}
+	if r.Method == http.MethodPost {
+		if !validPageCSRF(r) {
+			data.Error = localize(r, "Your session expired, please try again.")
+			s.pages.render(w, r, http.StatusForbidden, "device", data)
+			return
+		}
+
+		if decision := r.PostFormValue("decision"); decision != "" {
+			result := s.submitPage(r, s.DeviceVerifyHandler, DeviceVerifyRequest{UserCode: userCode, Approve: decision == "approve"})
+			if result.status != http.StatusOK {
+				data.Error = result.message
+			} else {
+				data.Notice = result.message
+			}
+			s.pages.render(w, r, result.status, "device", data)
+			return
+		}
+	}
+
+	status := http.StatusOK
+	if userCode != "" {
+		info, err := s.devices.lookup(userCode, s.authHandler.clock.Now())
+		if err != nil {
+			status, data.Error = deviceCodeError(r, err)
+		} else {
+			data.Device = &info
+		}
+	}
+	s.pages.render(w, r, status, "device", data)
+}
+
+// pageResult is the outcome of running an API handler for a page form
+type pageResult struct {
+	status  int
+	header  http.Header
+	message string
+	data    interface{}
+}
+
+// submitPage runs an API handler with body encoded as its JSON request, so
+// page forms go through exactly the same checks, hooks and audit logging as
+// API clients
+func (s *Server) submitPage(r *http.Request, handler http.HandlerFunc, body interface{}) pageResult {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return pageResult{status: http.StatusInternalServerError, message: "Internal server error"}
+	}
+
+	req := r.Clone(r.Context())
+	req.Method = http.MethodPost
+	req.Body = io.NopCloser(bytes.NewReader(payload))
+	req.ContentLength = int64(len(payload))
+	req.Header.Set("Content-Type", "application/json")
+
+	capture := newCaptureWriter()
+	handler(capture, req)
+	return capture.result()
+}
+
+// captureWriter buffers a handler's response for submitPage
+type captureWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newCaptureWriter() *captureWriter {
+	return &captureWriter{header: make(http.Header), status: http.StatusOK}
+}
+
+func (c *captureWriter) Header() http.Header         { return c.header }
+func (c *captureWriter) Write(p []byte) (int, error) { return c.body.Write(p) }
+func (c *captureWriter) WriteHeader(status int)      { c.status = status }
+
+// result reads the captured response
+func (c *captureWriter) result() pageResult {
+	result := pageResult{status: c.status, header: c.header}
+	var response Response
+	if err := json.Unmarshal(c.body.Bytes(), &response); err == nil && response.Message != "" {
+		result.message = response.Message
+		result.data = response.Data
+	} else {
+		// Handlers using http.Error answer in plain text
+		result.message = strings.TrimSpace(c.body.String())
+	}
+	return result
+}
+
+// pageCSRFToken returns the form token for r, setting a new cookie scoped
+// to basePath when the client does not have one yet
+func pageCSRFToken(w http.ResponseWriter, r *http.Request, basePath string) string {
+	if cookie, err := r.Cookie(pageCSRFCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	token, _ := randutil.Hex(16)
+	http.SetCookie(w, &http.Cookie{
+		Name:     pageCSRFCookie,
+		Value:    token,
+		Path:     cookiePath(basePath),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// validPageCSRF checks that the submitted form token matches the cookie
+func validPageCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(pageCSRFCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.PostFormValue("csrf_token"))) == 1
+}
+
+// localReturnTo returns target if it is a path on this site, and "/"
+// otherwise, so the login page cannot be used as an open redirect
+func localReturnTo(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	if u, err := url.Parse(target); err != nil || u.Host != "" || u.Scheme != "" {
+		return "/"
+	}
+	return target
+}
+
+// isTOTPCode reports whether a code typed into the login page is an
+// authenticator or texted code rather than a recovery code
+func isTOTPCode(code string) bool {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totp.Digits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"auth-server/pkg/events"
+	"auth-server/pkg/randutil"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// passwordResetMessage is returned for every reset request so it cannot
+// reveal which emails are registered
+const passwordResetMessage = "If an account exists for that email, a password reset link has been sent."
+
+// resetTokenStore holds outstanding password reset tokens. Only a hash of
+// each token is kept, and a user has at most one working token: issuing a
+// new one invalidates the previous link.
+type resetTokenStore struct {
+	mutex  sync.Mutex
+	ttl    time.Duration
+	tokens map[string]resetToken // keyed by hex SHA-256 of the token
+}
+
+type resetToken struct {
+	userID    string
+	expiresAt time.Time
+}
+
+func newResetTokenStore(ttl time.Duration) *resetTokenStore {
+	return &resetTokenStore{
+		ttl:    ttl,
+		tokens: make(map[string]resetToken),
+	}
+}
+
+// issue creates a token for userID that expires after the store's TTL
+func (s *resetTokenStore) issue(userID string, now time.Time) (string, error) {
+	token, err := randutil.Hex(32)
+	if err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, existing := range s.tokens {
+		if existing.userID == userID {
+			delete(s.tokens, key)
+		}
+	}
+	s.tokens[hashResetToken(token)] = resetToken{userID: userID, expiresAt: now.Add(s.ttl)}
+	return token, nil
+}
+
+// consume returns the user a valid token was issued for and invalidates it
+func (s *resetTokenStore) consume(token string, now time.Time) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := hashResetToken(token)
+	entry, ok := s.tokens[key]
+	if !ok {
+		return "", false
+	}
+	delete(s.tokens, key)
+	if !now.Before(entry.expiresAt) {
+		return "", false
+	}
+	return entry.userID, true
+}
+
+// Purge removes expired tokens and returns how many were removed
+func (s *resetTokenStore) Purge(now time.Time) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	purged := 0
+	for key, entry := range s.tokens {
+		if !now.Before(entry.expiresAt) {
+			delete(s.tokens, key)
+			purged++
+		}
+	}
+	return purged
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// PasswordResetRequestHandler emails a password reset link. The response is
+// the same whether or not the email belongs to an account.
+func (h *AuthHandler) PasswordResetRequestHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Password reset request received")
+
+	var req PasswordResetRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if req.Email == "" {
+		h.logger.Printf("[DEBUG] Missing required fields")
+		http.Error(w, localize(r, "Email is required"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.users.GetByEmail(r.Context(), req.Email)
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		h.logger.Printf("[DEBUG] Password reset requested for unknown email: %s", req.Email)
+	case err != nil:
+		h.logger.Printf("[DEBUG] User lookup failed: %v", err)
+		writeStoreError(w, r, err)
+		return
+	default:
+		token, err := h.resetTokens.issue(user.ID, h.clock.Now())
+		if err != nil {
+			h.logger.Printf("[DEBUG] Failed to generate reset token: %v", err)
+			http.Error(w, localize(r, "Internal server error"), http.StatusInternalServerError)
+			return
+		}
+		h.sendPasswordResetEmail(r, user, token)
+		h.audit.Record(AuditEvent{
+			Type:   AuditPasswordResetRequested,
+			UserID: user.ID,
+			IP:     clientIP(r),
+		})
+	}
+
+	response := Response{
+		Success: true,
+		Message: localize(r, passwordResetMessage),
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// PasswordResetConfirmHandler sets a new password using a reset token and
+// signs the user out everywhere
+func (h *AuthHandler) PasswordResetConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Password reset confirmation received")
+
+	var req PasswordResetConfirmRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if req.Token == "" || req.NewPassword == "" {
+		h.logger.Printf("[DEBUG] Missing required fields")
+		http.Error(w, localize(r, "Token and new password are required"), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.NewPassword) < minPasswordLength {
+		h.logger.Printf("[DEBUG] New password too short")
+		http.Error(w, localize(r, "New password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := h.resetTokens.consume(req.Token, h.clock.Now())
+	if !ok {
+		h.logger.Printf("[DEBUG] Invalid or expired reset token")
+		http.Error(w, localize(r, "Invalid or expired reset token"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.users.Get(r.Context(), userID)
+	if err != nil {
+		h.logger.Printf("[DEBUG] User lookup failed: %v", err)
+		if errors.Is(err, ErrUserNotFound) {
+			http.Error(w, localize(r, "Invalid or expired reset token"), http.StatusBadRequest)
+			return
+		}
+		writeStoreError(w, r, err)
+		return
+	}
+
+	hashedPassword, err := h.hasher.Hash(r.Context(), req.NewPassword)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to hash new password: %v", err)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	now := h.clock.Now()
+	user.Password = hashedPassword
+	user.PasswordChangedAt = now
+	user.EmailVerifiedAt = &now
+	user.UpdatedAt = now
+	user.RememberedDevices = nil
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to store new password for %s: %v", user.Username, err)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	// Whoever could use the old password may still hold a session
+	revoked, err := h.revokeUserSessions(r.Context(), user.ID)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to revoke sessions of %s: %v", user.Username, err)
+	}
+	for _, session := range revoked {
+		h.publishEvent(events.TypeSessionRevoked, user.ID, map[string]string{
+			"sessionId": session.ID,
+			"reason":    "password_reset",
+		})
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:   AuditPasswordReset,
+		UserID: user.ID,
+		IP:     clientIP(r),
+	})
+	h.publishEvent(events.TypePasswordChanged, user.ID, map[string]string{"reason": "reset"})
+	h.hooks.runPostPasswordChange(r.Context(), user.Sanitized())
+	h.notifySecurityChange(r, user, NoticePasswordChanged, "")
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Password reset successfully. Please login with your new password."),
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Password reset for user: %s", user.Username)
+}
+
+// sendPasswordResetEmail mails the reset link in the user's language
+func (h *AuthHandler) sendPasswordResetEmail(r *http.Request, user *User, token string) {
+	h.sendEmail(r.Context(), user, userLocale(user, r), "password_reset", map[string]string{
+		"Username": user.Username,
+		"Link":     h.config.PublicURL + "/reset-password?token=" + url.QueryEscape(token),
+		"TTL":      h.config.PasswordResetTTL.String(),
+	})
+}
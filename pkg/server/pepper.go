@@ -0,0 +1,253 @@
+package server
+
+import (
+	"auth-server/pkg/account"
+	"auth-server/pkg/metrics"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// pepperSecretPrefix names the pepper secrets in the secrets backend:
+// password_pepper_v1, password_pepper_v2 and so on. The highest version
+// hashes new passwords; older versions are kept to verify existing hashes
+// until their users next log in.
+const pepperSecretPrefix = "password_pepper_v"
+
+// pepperHashPrefix marks a stored hash as peppered. The full format is
+//
+//	$pepper$<version>$<bcrypt hash>
+//
+// Hashes without the prefix are plain bcrypt hashes from before a pepper
+// was configured.
+const pepperHashPrefix = "$pepper$"
+
+// errUnknownPepper is returned for hashes made with a pepper version the
+// server no longer has
+var errUnknownPepper = errors.New("password hashed with an unknown pepper version")
+
+// errPasswordHashBusy is returned when every password hashing slot stayed
+// taken for the whole queue timeout
+var errPasswordHashBusy = errors.New("password hashing is saturated")
+
+// Hasher hashes and checks passwords; see account.Hasher
+type Hasher = account.Hasher
+
+// passwordHasher is the built-in Hasher. It hashes passwords with bcrypt,
+// first mixing in a server-side pepper with HMAC-SHA256 when one is
+// configured, so a leaked user database cannot be brute forced without the
+// pepper as well.
+//
+// bcrypt is deliberately slow, so only Config.PasswordHashConcurrency
+// hashes run at once and the rest wait their turn for up to
+// Config.PasswordHashQueueTimeout. A login storm then gets 503s instead of
+// starving every other request of CPU.
+type passwordHasher struct {
+	mutex   sync.RWMutex
+	peppers map[int][]byte
+	current int // 0 when no pepper is configured
+
+	slots        chan struct{}
+	queueTimeout time.Duration
+	queued       atomic.Int64
+	metrics      *metrics.Registry // nil until the server sets it
+}
+
+func newPasswordHasher(cfg Config) *passwordHasher {
+	return &passwordHasher{
+		peppers:      make(map[int][]byte),
+		slots:        make(chan struct{}, cfg.PasswordHashConcurrency),
+		queueTimeout: cfg.PasswordHashQueueTimeout,
+	}
+}
+
+// acquire waits for a hashing slot. It gives up with errPasswordHashBusy
+// after the queue timeout, or with the context's error.
+func (p *passwordHasher) acquire(ctx context.Context) error {
+	select {
+	case p.slots <- struct{}{}:
+		p.observe()
+		return nil
+	default:
+	}
+
+	p.queued.Add(1)
+	p.observe()
+	defer func() {
+		p.queued.Add(-1)
+		p.observe()
+	}()
+
+	timer := time.NewTimer(p.queueTimeout)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		if p.metrics != nil {
+			p.metrics.Counter("auth_password_hash_rejected_total", "Password hashes refused because every slot stayed busy.").Inc()
+		}
+		return errPasswordHashBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *passwordHasher) release() {
+	<-p.slots
+	p.observe()
+}
+
+// passwordUnavailable writes the response when a password could not be
+// checked at all, because hashing was saturated or the request ran out of
+// time, and reports whether it did. Other errors mean a wrong password.
+func (h *AuthHandler) passwordUnavailable(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, errPasswordHashBusy) && !isContextError(err) {
+		return false
+	}
+	h.logger.Printf("[DEBUG] Password check unavailable: %v", err)
+	writeStoreError(w, r, err)
+	return true
+}
+
+// setBusyRetryAfter asks clients refused by saturated hashing to retry
+// shortly
+func setBusyRetryAfter(w http.ResponseWriter, err error) {
+	if errors.Is(err, errPasswordHashBusy) {
+		w.Header().Set("Retry-After", "1")
+	}
+}
+
+// observe publishes how saturated hashing is
+func (p *passwordHasher) observe() {
+	if p.metrics == nil {
+		return
+	}
+	inFlight := len(p.slots)
+	p.metrics.Gauge("auth_password_hash_in_flight", "Password hashes running now.").Set(float64(inFlight))
+	p.metrics.Gauge("auth_password_hash_queued", "Password hashes waiting for a slot.").Set(float64(p.queued.Load()))
+	p.metrics.Gauge("auth_password_hash_saturation", "Share of password hashing slots in use, from 0 to 1.").Set(float64(inFlight) / float64(cap(p.slots)))
+}
+
+// setPepper adds or replaces a pepper version from a secret. Names that are
+// not pepper secrets are ignored.
+func (p *passwordHasher) setPepper(name, value string) error {
+	if !strings.HasPrefix(name, pepperSecretPrefix) {
+		return nil
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(name, pepperSecretPrefix))
+	if err != nil || version < 1 {
+		return fmt.Errorf("invalid pepper secret name %q", name)
+	}
+	if value == "" {
+		return fmt.Errorf("pepper %s is empty", name)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.peppers[version] = []byte(value)
+	if version > p.current {
+		p.current = version
+	}
+	return nil
+}
+
+// prehash mixes the pepper into the password. The base64 HMAC stays under
+// bcrypt's 72 byte limit and contains no NUL bytes.
+func prehash(pepper []byte, password string) []byte {
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(password))
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(sha256.Size))
+	base64.StdEncoding.Encode(encoded, mac.Sum(nil))
+	return encoded
+}
+
+// splitHash returns the pepper version of a stored hash, 0 for none, and
+// the bcrypt hash
+func splitHash(stored string) (int, string, error) {
+	if !strings.HasPrefix(stored, pepperHashPrefix) {
+		return 0, stored, nil
+	}
+	rest := strings.TrimPrefix(stored, pepperHashPrefix)
+	end := strings.IndexByte(rest, '$')
+	if end < 0 {
+		return 0, "", bcrypt.ErrHashTooShort
+	}
+	version, err := strconv.Atoi(rest[:end])
+	if err != nil || version < 1 {
+		return 0, "", bcrypt.ErrHashTooShort
+	}
+	return version, rest[end+1:], nil
+}
+
+// Hash hashes a password with the current pepper
+func (p *passwordHasher) Hash(ctx context.Context, password string) (string, error) {
+	if err := p.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer p.release()
+
+	p.mutex.RLock()
+	version, pepper := p.current, p.peppers[p.current]
+	p.mutex.RUnlock()
+
+	if version == 0 {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hashed), err
+	}
+	hashed, err := bcrypt.GenerateFromPassword(prehash(pepper, password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return pepperHashPrefix + strconv.Itoa(version) + "$" + string(hashed), nil
+}
+
+// Compare checks a password against a stored hash made with any known
+// pepper version, or with none. It returns nil on a match.
+func (p *passwordHasher) Compare(ctx context.Context, stored, password string) error {
+	version, hashed, err := splitHash(stored)
+	if err != nil {
+		return err
+	}
+	if err := p.acquire(ctx); err != nil {
+		return err
+	}
+	defer p.release()
+
+	if version == 0 {
+		return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+	}
+
+	p.mutex.RLock()
+	pepper, ok := p.peppers[version]
+	p.mutex.RUnlock()
+	if !ok {
+		return errUnknownPepper
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hashed), prehash(pepper, password))
+}
+
+// NeedsRehash reports whether a stored hash was made with an older pepper
+// version, or none, and should be replaced the next time the password is
+// known
+func (p *passwordHasher) NeedsRehash(stored string) bool {
+	version, _, err := splitHash(stored)
+	if err != nil {
+		return false
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return version != p.current
+}
@@ -0,0 +1,358 @@
+package server
+
+import (
+	"auth-server/pkg/events"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Admin permissions. The admin role has all of them; other roles are given
+// a subset so staff can do their job without being able to delete users.
+const (
+	PermissionUsersRead      = "users:read"
+	PermissionUsersSuspend   = "users:suspend"
+	PermissionUsersManage    = "users:manage"
+	PermissionRolesManage    = "roles:manage"
+	PermissionWebhooksManage = "webhooks:manage"
+	PermissionAuditRead      = "audit:read"
+	PermissionClientsManage  = "clients:manage"
+	PermissionSettingsManage = "settings:manage"
+	PermissionBillingManage  = "billing:manage"
+)
+
+// permissions are the permissions roles can be given
+var permissions = []string{
+	PermissionUsersRead,
+	PermissionUsersSuspend,
+	PermissionUsersManage,
+	PermissionRolesManage,
+	PermissionWebhooksManage,
+	PermissionAuditRead,
+	PermissionClientsManage,
+	PermissionSettingsManage,
+	PermissionBillingManage,
+}
+
+// builtinRoles are the permissions of the roles every server has, granted
+// through built-in policy rules. Config.RolePermissions may add roles and
+// change the support role, but not the admin and user roles.
+var builtinRoles = map[string][]string{
+	RoleAdmin:   permissions,
+	RoleSupport: {PermissionUsersRead, PermissionUsersSuspend, PermissionAuditRead},
+	RoleUser:    nil,
+}
+
+// adminRoutes maps the admin routes, by method and path template, to the
+// permission each needs. Admin routes missing here, such as the chaos
+// controls, are left to the admin role.
+var adminRoutes = map[string]string{
+	"GET /api/admin/billing/accounts":                         PermissionBillingManage,
+	"PUT /api/admin/billing/accounts/{account}":               PermissionBillingManage,
+	"GET /api/admin/users/search":                             PermissionUsersRead,
+	"GET /api/admin/users/deleted":                            PermissionUsersRead,
+	"GET /api/admin/signups/review":                           PermissionUsersRead,
+	"POST /api/admin/users/{id}/suspend":                      PermissionUsersSuspend,
+	"POST /api/admin/users/{id}/unsuspend":                    PermissionUsersSuspend,
+	"DELETE /api/admin/users/{id}":                            PermissionUsersManage,
+	"POST /api/admin/users/{id}/restore":                      PermissionUsersManage,
+	"POST /api/admin/users/merge":                             PermissionUsersManage,
+	"POST /api/admin/users/{id}/unmerge":                      PermissionUsersManage,
+	"POST /api/admin/signups/review/{id}/approve":             PermissionUsersManage,
+	"POST /api/admin/signups/review/{id}/reject":              PermissionUsersManage,
+	"PUT /api/admin/users/{id}/role":                          PermissionRolesManage,
+	"GET /api/admin/policy":                                   PermissionRolesManage,
+	"PUT /api/admin/policy":                                   PermissionRolesManage,
+	"POST /api/admin/policy/reload":                           PermissionRolesManage,
+	"POST /api/admin/policy/enforce":                          PermissionRolesManage,
+	"GET /api/admin/access-rules":                             PermissionSettingsManage,
+	"PUT /api/admin/access-rules":                             PermissionSettingsManage,
+	"POST /api/admin/access-rules/reload":                     PermissionSettingsManage,
+	"GET /api/admin/provisioning-rules":                       PermissionSettingsManage,
+	"PUT /api/admin/provisioning-rules":                       PermissionSettingsManage,
+	"GET /api/admin/email-templates":                          PermissionSettingsManage,
+	"GET /api/admin/email-templates/{locale}/{name}":          PermissionSettingsManage,
+	"PUT /api/admin/email-templates/{locale}/{name}":          PermissionSettingsManage,
+	"DELETE /api/admin/email-templates/{locale}/{name}":       PermissionSettingsManage,
+	"POST /api/admin/email-templates/{locale}/{name}/preview": PermissionSettingsManage,
+	"POST /api/admin/provisioning-rules/reload":               PermissionSettingsManage,
+	"GET /api/admin/outbox":                                   PermissionWebhooksManage,
+	"POST /api/admin/outbox/{id}/redeliver":                   PermissionWebhooksManage,
+	"GET /api/admin/webhooks/deliveries":                      PermissionWebhooksManage,
+	"GET /api/admin/webhooks/deliveries/{id}":                 PermissionWebhooksManage,
+	"POST /api/admin/webhooks/deliveries/{id}/replay":         PermissionWebhooksManage,
+	"GET /api/admin/webhooks/endpoints":                       PermissionWebhooksManage,
+	"PUT /api/admin/webhooks/endpoints":                       PermissionWebhooksManage,
+	"GET /api/admin/events/stream":                            PermissionAuditRead,
+	"GET /api/admin/security":                                 PermissionAuditRead,
+	"GET /api/admin/reports/security-posture":                 PermissionAuditRead,
+	"GET /api/admin/reports/usage":                            PermissionAuditRead,
+	"GET /api/admin/service-accounts/{id}/audit":              PermissionAuditRead,
+	"GET /api/admin/clients":                                  PermissionClientsManage,
+	"POST /api/admin/clients":                                 PermissionClientsManage,
+	"DELETE /api/admin/clients/{id}":                          PermissionClientsManage,
+	"GET /api/admin/service-accounts":                         PermissionClientsManage,
+	"POST /api/admin/service-accounts":                        PermissionClientsManage,
+	"GET /api/admin/service-accounts/{id}":                    PermissionClientsManage,
+	"PATCH /api/admin/service-accounts/{id}":                  PermissionClientsManage,
+	"DELETE /api/admin/service-accounts/{id}":                 PermissionClientsManage,
+	"POST /api/admin/service-accounts/{id}/keys":              PermissionClientsManage,
+	"DELETE /api/admin/service-accounts/{id}/keys/{keyId}":    PermissionClientsManage,
+	"GET /api/admin/signing-keys":                             PermissionClientsManage,
+	"POST /api/admin/signing-keys":                            PermissionClientsManage,
+	"GET /api/admin/acl":                                      PermissionSettingsManage,
+	"POST /api/admin/acl":                                     PermissionSettingsManage,
+	"DELETE /api/admin/acl/{id}":                              PermissionSettingsManage,
+	"GET /api/admin/geo-policy":                               PermissionSettingsManage,
+	"PUT /api/admin/geo-policy":                               PermissionSettingsManage,
+	"GET /api/admin/email-policy":                             PermissionSettingsManage,
+	"PUT /api/admin/email-policy":                             PermissionSettingsManage,
+	"GET /api/admin/username-policy":                          PermissionSettingsManage,
+	"PUT /api/admin/username-policy":                          PermissionSettingsManage,
+	"POST /api/admin/gc":                                      PermissionSettingsManage,
+	"GET /api/admin/blocked-ips":                              PermissionSettingsManage,
+	"DELETE /api/admin/blocked-ips/{ip}":                      PermissionSettingsManage,
+	"GET /api/admin/maintenance":                              PermissionSettingsManage,
+	"PUT /api/admin/maintenance":                              PermissionSettingsManage,
+	"GET /api/admin/flags":                                    PermissionSettingsManage,
+	"PUT /api/admin/flags/{name}":                             PermissionSettingsManage,
+	"GET /api/admin/sso/connections":                          PermissionSettingsManage,
+	"POST /api/admin/sso/connections":                         PermissionSettingsManage,
+	"GET /api/admin/sso/connections/{id}":                     PermissionSettingsManage,
+	"PATCH /api/admin/sso/connections/{id}":                   PermissionSettingsManage,
+	"DELETE /api/admin/sso/connections/{id}":                  PermissionSettingsManage,
+	"PUT /api/admin/sso/connections/{id}/metadata":            PermissionSettingsManage,
+}
+
+// errAssignOwnRole is returned when an admin tries to change their own role
+var errAssignOwnRole = errors.New("cannot change own role")
+
+// errAssignAdminRole is returned when someone other than an admin tries to
+// make a user an admin or change an admin's role
+var errAssignAdminRole = errors.New("only admins can grant or revoke the admin role")
+
+// RoleRequest assigns a user a role
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+// routePermission returns the permission the request's route needs, or ""
+// when it is not in adminRoutes
+func routePermission(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return adminRoutes[r.Method+" "+template]
+}
+
+// roleExists reports whether role is built in, configured or mentioned by
+// the policy rules
+func (h *AuthHandler) roleExists(role string) bool {
+	if _, ok := builtinRoles[role]; ok {
+		return true
+	}
+	if _, ok := h.config.RolePermissions[role]; ok {
+		return true
+	}
+	return slices.Contains(h.policy.enforcer.Subjects(), role)
+}
+
+// permits reports whether the policy grants user's role permission. Only
+// the admin role is permitted an empty permission, which stands for routes
+// that are not in adminRoutes.
+func (h *AuthHandler) permits(user *User, permission string) bool {
+	if permission == "" {
+		return user.Role == RoleAdmin
+	}
+	return h.policy.allows(user, permission, h.clock.Now())
+}
+
+// permissionMiddleware refuses admin routes to session users whose role
+// lacks the permission adminRoutes lists for them. Requests without a
+// session are passed on for the handler to reject.
+func (s *Server) permissionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		permission := routePermission(r)
+		if permission == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := s.authHandler
+		user, err := h.sessionUser(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !h.permits(user, permission) {
+			s.logger.Printf("[DEBUG] %s denied %s for role %s", user.Username, permission, user.Role)
+			http.Error(w, localize(r, "Forbidden"), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminRoleHandler lets admins assign a user one of the configured roles.
+// Nobody can change their own role, so the last admin cannot lock everyone
+// out by accident, and only admins can grant or revoke the admin role.
+func (h *AuthHandler) AdminRoleHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Role assignment request received")
+
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req RoleRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	req.Role = strings.TrimSpace(req.Role)
+	if req.Role == "" || !h.roleExists(req.Role) {
+		http.Error(w, localize(r, "Unknown role: %s", req.Role), http.StatusBadRequest)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	user, err := h.users.Get(r.Context(), id)
+	var previous string
+	if err == nil {
+		previous = user.Role
+		err = h.assignRole(r.Context(), user, admin, req.Role)
+	}
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		http.Error(w, localize(r, "User not found"), http.StatusNotFound)
+		return
+	case errors.Is(err, errAssignOwnRole):
+		http.Error(w, localize(r, "You cannot change your own role"), http.StatusBadRequest)
+		return
+	case errors.Is(err, errAssignAdminRole):
+		http.Error(w, localize(r, "Only admins can grant or revoke the admin role"), http.StatusForbidden)
+		return
+	case err != nil:
+		h.logger.Printf("[DEBUG] Failed to assign role to %s: %v", id, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditRoleChanged,
+		UserID:  admin.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"target": user.ID, "role": req.Role, "previous": previous},
+	})
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Role updated"),
+		Data:    user.Sanitized(),
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Role of %s changed from %s to %s", user.Username, previous, req.Role)
+}
+
+// assignRole gives user role, leaving it unchanged on failure
+func (h *AuthHandler) assignRole(ctx context.Context, user, by *User, role string) error {
+	if user.ID == by.ID {
+		return errAssignOwnRole
+	}
+	if (role == RoleAdmin || user.Role == RoleAdmin) && by.Role != RoleAdmin {
+		return errAssignAdminRole
+	}
+	previous := user.Role
+	user.Role = role
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(ctx, user); err != nil {
+		user.Role = previous
+		return err
+	}
+	h.publishEvent(events.TypeRoleChanged, user.ID, map[string]string{"role": role, "previous": previous})
+	return nil
+}
+
+// AdminBootstrapRequest is the body of POST /api/admin/bootstrap
+type AdminBootstrapRequest struct {
+	Token string `json:"token"`
+}
+
+// AdminBootstrapHandler makes the session user an admin when they present
+// Config.AdminBootstrapToken, so a new deployment gets its first admin
+// from whoever holds the token rather than whoever registers first. The
+// token only works while nobody is an admin, so one left in the
+// environment cannot be used to take the server over later; from then on
+// admins appoint each other through AdminRoleHandler.
+func (h *AuthHandler) AdminBootstrapHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Admin bootstrap request received")
+
+	if h.config.AdminBootstrapToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	user := contextUser(r)
+
+	var req AdminBootstrapRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(h.config.AdminBootstrapToken)) != 1 {
+		h.logger.Printf("[DEBUG] Invalid admin bootstrap token from %s", user.Username)
+		http.Error(w, localize(r, "Invalid bootstrap token"), http.StatusForbidden)
+		return
+	}
+
+	// Checking for an admin and granting the role happen under one lock,
+	// so two requests racing with the token cannot both succeed
+	h.bootstrapMutex.Lock()
+	defer h.bootstrapMutex.Unlock()
+
+	users, err := h.users.List(r.Context())
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to list users for admin bootstrap: %v", err)
+		http.Error(w, localize(r, "Internal server error"), http.StatusInternalServerError)
+		return
+	}
+	if slices.ContainsFunc(users, func(u *User) bool { return u.Role == RoleAdmin }) {
+		http.Error(w, localize(r, "An admin already exists"), http.StatusConflict)
+		return
+	}
+
+	previous := user.Role
+	user.Role = RoleAdmin
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to make %s an admin: %v", user.ID, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+	h.publishEvent(events.TypeRoleChanged, user.ID, map[string]string{"role": RoleAdmin, "previous": previous})
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditRoleChanged,
+		UserID:  user.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"target": user.ID, "role": RoleAdmin, "previous": previous, "via": "bootstrap"},
+	})
+
+	json.NewEncoder(w).Encode(Response{Success: true, Message: localize(r, "You are now an admin"), Data: user.Sanitized()})
+	h.logger.Printf("[DEBUG] %s bootstrapped as the first admin", user.Username)
+}
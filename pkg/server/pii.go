@@ -0,0 +1,197 @@
+package server
+
+import (
+	"auth-server/pkg/cryptoutil"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// encryptedUserStore encrypts personal data before it reaches the
+// underlying store, using envelope encryption so the master key can live
+// in a KMS. At rest Email holds a blind index of the address instead of
+// the address itself, so the underlying store's email lookups and
+// uniqueness checks keep working; the address is in EncryptedEmail.
+type encryptedUserStore struct {
+	next     UserStore
+	wrapper  cryptoutil.KeyWrapper
+	indexKey []byte
+	logger   *log.Logger
+}
+
+// newEncryptedUserStore wraps next using Config.PIIKeyWrapper when set,
+// and otherwise a local key from PII_ENCRYPTION_KEY or derived from the
+// master key
+func newEncryptedUserStore(next UserStore, cfg Config) (*encryptedUserStore, error) {
+	indexKey, err := cryptoutil.DeriveKey(cfg.MasterKey, "pii-blind-index")
+	if err != nil {
+		return nil, err
+	}
+
+	wrapper := cfg.PIIKeyWrapper
+	if wrapper == nil {
+		key, err := piiKeyFromConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			if key, err = cryptoutil.DeriveKey(cfg.MasterKey, "pii-key-wrapping"); err != nil {
+				return nil, err
+			}
+		}
+		wrapper = &cryptoutil.LocalKeyWrapper{Key: key}
+	}
+	return &encryptedUserStore{next: next, wrapper: wrapper, indexKey: indexKey, logger: cfg.Logger}, nil
+}
+
+// piiKeyFromConfig returns Config.PIIKey or the key PIIKeyHex or
+// PIIKeyFile holds, or nil when none is set. A key that is set but cannot
+// be read is an error rather than a reason to derive one.
+func piiKeyFromConfig(cfg Config) ([]byte, error) {
+	if cfg.PIIKey != nil {
+		if len(cfg.PIIKey) != cryptoutil.KeySize {
+			return nil, fmt.Errorf("the PII key must be %d bytes", cryptoutil.KeySize)
+		}
+		return cfg.PIIKey, nil
+	}
+	value, name := cfg.PIIKeyHex, "PII_ENCRYPTION_KEY"
+	if value == "" && cfg.PIIKeyFile != "" {
+		contents, err := os.ReadFile(cfg.PIIKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("PII_ENCRYPTION_KEY_FILE: %w", err)
+		}
+		value, name = strings.TrimSpace(string(contents)), "PII_ENCRYPTION_KEY_FILE"
+	}
+	if value == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(value)
+	if err != nil || len(key) != cryptoutil.KeySize {
+		return nil, fmt.Errorf("%s must be %d hex-encoded bytes", name, cryptoutil.KeySize)
+	}
+	return key, nil
+}
+
+// emailIndex is the blind index stored in place of an email address
+func (s *encryptedUserStore) emailIndex(email string) string {
+	mac := hmac.New(sha256.New, s.indexKey)
+	mac.Write([]byte(email))
+	return "idx:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal returns a copy of user with its personal data encrypted
+func (s *encryptedUserStore) seal(ctx context.Context, user *User) (*User, error) {
+	sealed := *user
+	encryptedEmail, err := cryptoutil.SealEnvelope(ctx, s.wrapper, []byte(user.Email), []byte(user.ID+"|email"))
+	if err != nil {
+		return nil, fmt.Errorf("encrypting email: %w", err)
+	}
+	sealed.Email = s.emailIndex(user.Email)
+	sealed.EncryptedEmail = encryptedEmail
+
+	sealed.EncryptedPhone = nil
+	if user.Phone != "" {
+		encryptedPhone, err := cryptoutil.SealEnvelope(ctx, s.wrapper, []byte(user.Phone), []byte(user.ID+"|phone"))
+		if err != nil {
+			return nil, fmt.Errorf("encrypting phone: %w", err)
+		}
+		sealed.Phone = ""
+		sealed.EncryptedPhone = encryptedPhone
+	}
+	return &sealed, nil
+}
+
+// open decrypts the personal data of a user read from the underlying
+// store in place. Users stored before encryption was enabled are left as
+// they are.
+func (s *encryptedUserStore) open(ctx context.Context, user *User) error {
+	if user.EncryptedEmail != nil {
+		email, err := cryptoutil.OpenEnvelope(ctx, s.wrapper, user.EncryptedEmail, []byte(user.ID+"|email"))
+		if err != nil {
+			return fmt.Errorf("decrypting email: %w", err)
+		}
+		user.Email = string(email)
+	}
+	if user.EncryptedPhone != nil {
+		phone, err := cryptoutil.OpenEnvelope(ctx, s.wrapper, user.EncryptedPhone, []byte(user.ID+"|phone"))
+		if err != nil {
+			return fmt.Errorf("decrypting phone: %w", err)
+		}
+		user.Phone = string(phone)
+	}
+	user.EncryptedEmail, user.EncryptedPhone = nil, nil
+	return nil
+}
+
+func (s *encryptedUserStore) Create(ctx context.Context, user *User) error {
+	sealed, err := s.seal(ctx, user)
+	if err != nil {
+		return err
+	}
+	if err := s.next.Create(ctx, sealed); err != nil {
+		return err
+	}
+	user.Version = sealed.Version
+	return nil
+}
+
+func (s *encryptedUserStore) Get(ctx context.Context, id string) (*User, error) {
+	user, err := s.next.Get(ctx, id)
+	return s.opened(ctx, user, err)
+}
+
+func (s *encryptedUserStore) GetByUsername(ctx context.Context, username string) (*User, error) {
+	user, err := s.next.GetByUsername(ctx, username)
+	return s.opened(ctx, user, err)
+}
+
+func (s *encryptedUserStore) GetByEmail(ctx context.Context, email string) (*User, error) {
+	user, err := s.next.GetByEmail(ctx, s.emailIndex(email))
+	return s.opened(ctx, user, err)
+}
+
+// opened decrypts the result of a lookup on the underlying store
+func (s *encryptedUserStore) opened(ctx context.Context, user *User, err error) (*User, error) {
+	if err != nil {
+		return nil, err
+	}
+	if err := s.open(ctx, user); err != nil {
+		s.logger.Printf("[DEBUG] Failed to decrypt user %s: %v", user.ID, err)
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *encryptedUserStore) Update(ctx context.Context, user *User) error {
+	sealed, err := s.seal(ctx, user)
+	if err != nil {
+		return err
+	}
+	if err := s.next.Update(ctx, sealed); err != nil {
+		return err
+	}
+	user.Version = sealed.Version
+	return nil
+}
+
+func (s *encryptedUserStore) List(ctx context.Context) ([]*User, error) {
+	users, err := s.next.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if err := s.open(ctx, user); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+func (s *encryptedUserStore) Delete(ctx context.Context, id string) error {
+	return s.next.Delete(ctx, id)
+}
@@ -0,0 +1,412 @@
+package server
+
+import (
+	"auth-server/pkg/policy"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admin permissions are decided by a policy engine. A permission such as
+// "users:suspend" is checked as the request (role, "users", "suspend"),
+// so with the default model a rule "p, support, users, suspend" grants it
+// and "g, lead, support" gives the lead role everything support has.
+
+// PolicyRequest replaces the stored policy rules
+type PolicyRequest struct {
+	Rules []string `json:"rules"`
+}
+
+// PolicyEnforceRequest asks how the policy decides a request
+type PolicyEnforceRequest struct {
+	Subject string `json:"subject"`
+	Object  string `json:"object"`
+	Action  string `json:"action"`
+}
+
+// PolicyDecision is the answer to a PolicyEnforceRequest, with the rule
+// that decided it
+type PolicyDecision struct {
+	Allowed bool   `json:"allowed"`
+	Rule    string `json:"rule,omitempty"`
+}
+
+// errNoPolicyFile is returned when reloading an engine that has no file
+var errNoPolicyFile = errors.New("no policy file configured")
+
+// policyEngine holds the enforcer for admin permissions. Its rules are
+// the built-in ones for the configured roles followed by the stored ones,
+// which are kept in Config.PolicyFile when it is set and reread when the
+// file changes.
+type policyEngine struct {
+	enforcer *policy.Enforcer
+	builtin  []policy.Rule
+	path     string
+	interval time.Duration
+	logger   *log.Logger
+
+	mutex   sync.Mutex
+	stored  []policy.Rule
+	modTime time.Time
+}
+
+// newPolicyEngine creates an engine for model with the builtin rules,
+// loading the stored rules from path when it is set
+func newPolicyEngine(model *policy.Model, builtin []policy.Rule, path string, interval time.Duration, logger *log.Logger) (*policyEngine, error) {
+	enforcer, err := policy.NewEnforcer(model, builtin)
+	if err != nil {
+		return nil, err
+	}
+	engine := &policyEngine{enforcer: enforcer, builtin: builtin, path: path, interval: interval, logger: logger}
+	if path != "" {
+		if _, err := engine.reload(true); err != nil {
+			return nil, err
+		}
+	}
+	return engine, nil
+}
+
+// newBuiltinPolicy returns an engine with the default model and only the
+// built-in rules, kept in memory
+func newBuiltinPolicy(cfg Config) *policyEngine {
+	model, _ := policy.ParseModel(policy.DefaultModel)
+	engine, _ := newPolicyEngine(model, builtinPolicyRules(cfg), "", cfg.PolicyReloadInterval, cfg.Logger)
+	return engine
+}
+
+// newPolicyEngineFromConfig loads the model from Config.PolicyModelFile
+// and the rules from Config.PolicyFile, when they are set
+func newPolicyEngineFromConfig(cfg Config) (*policyEngine, error) {
+	model, _ := policy.ParseModel(policy.DefaultModel)
+	builtin := builtinPolicyRules(cfg)
+	if cfg.PolicyModelFile != "" {
+		text, err := os.ReadFile(cfg.PolicyModelFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading model: %w", err)
+		}
+		if model, err = policy.ParseModel(string(text)); err != nil {
+			return nil, fmt.Errorf("%s: %w", cfg.PolicyModelFile, err)
+		}
+		if len(model.Request) != 3 {
+			return nil, fmt.Errorf("%s: requests must be subject, object and action", cfg.PolicyModelFile)
+		}
+		// The built-in rules are written for the default model; a model
+		// with other policy fields must grant the roles itself
+		builtin = slices.DeleteFunc(builtin, func(rule policy.Rule) bool {
+			_, err := policy.NewEnforcer(model, []policy.Rule{rule})
+			return err != nil
+		})
+	}
+	return newPolicyEngine(model, builtin, cfg.PolicyFile, cfg.PolicyReloadInterval, cfg.Logger)
+}
+
+// builtinPolicyRules grants the admin role everything and the other roles
+// of builtinRoles and Config.RolePermissions their permissions
+func builtinPolicyRules(cfg Config) []policy.Rule {
+	rules := []policy.Rule{{Type: "p", Values: []string{RoleAdmin, "*", "*", "allow"}}}
+	roles := make(map[string][]string)
+	for role, granted := range builtinRoles {
+		if role != RoleAdmin {
+			roles[role] = granted
+		}
+	}
+	for role, granted := range cfg.RolePermissions {
+		roles[role] = granted
+	}
+	for _, role := range slices.Sorted(maps.Keys(roles)) {
+		for _, permission := range roles[role] {
+			object, action, _ := strings.Cut(permission, ":")
+			rules = append(rules, policy.Rule{Type: "p", Values: []string{role, object, action, "allow"}})
+		}
+	}
+	return rules
+}
+
+// allows reports whether the policy grants user's role permission. The
+// user's attributes are available to models that use them.
+func (e *policyEngine) allows(user *User, permission string, now time.Time) bool {
+	object, action, _ := strings.Cut(permission, ":")
+	return e.enforcer.EnforceAttributes(map[string]policy.Attributes{"sub": userAttributes(user, now)}, user.Role, object, action)
+}
+
+// rules returns the stored rules
+func (e *policyEngine) rules() []policy.Rule {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return slices.Clone(e.stored)
+}
+
+// reload rereads the policy file when it changed since it was last read,
+// or always when force is set. It reports whether the rules changed; on
+// failure the previous rules stay in effect.
+func (e *policyEngine) reload(force bool) (bool, error) {
+	if e.path == "" {
+		return false, errNoPolicyFile
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return false, fmt.Errorf("reading policy: %w", err)
+	}
+	if !force && info.ModTime().Equal(e.modTime) {
+		return false, nil
+	}
+	file, err := os.Open(e.path)
+	if err != nil {
+		return false, fmt.Errorf("reading policy: %w", err)
+	}
+	defer file.Close()
+	stored, err := policy.LoadRules(file)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", e.path, err)
+	}
+	if err := e.enforcer.SetRules(append(slices.Clone(e.builtin), stored...)); err != nil {
+		return false, fmt.Errorf("%s: %w", e.path, err)
+	}
+	e.stored = stored
+	e.modTime = info.ModTime()
+	return true, nil
+}
+
+// replace makes rules the stored rules, writing them to the policy file
+// when there is one
+func (e *policyEngine) replace(rules []policy.Rule) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	previous := e.enforcer.Rules()
+	if err := e.enforcer.SetRules(append(slices.Clone(e.builtin), rules...)); err != nil {
+		return err
+	}
+	if e.path != "" {
+		if err := e.write(rules); err != nil {
+			e.enforcer.SetRules(previous)
+			return err
+		}
+	}
+	e.stored = rules
+	return nil
+}
+
+// write replaces the policy file with rules through a temporary file, so
+// a reload never reads it half written. The caller holds the mutex.
+func (e *policyEngine) write(rules []policy.Rule) error {
+	var buf bytes.Buffer
+	for _, rule := range rules {
+		fmt.Fprintln(&buf, rule)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(e.path), ".policy-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), e.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(e.path); err == nil {
+		e.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// start rereads the policy file every interval until the returned stop
+// function is called
+func (e *policyEngine) start() (stop func()) {
+	ticker := time.NewTicker(e.interval)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ticker.C:
+				changed, err := e.reload(false)
+				if err != nil {
+					e.logger.Printf("[DEBUG] Policy reload failed, keeping previous rules: %v", err)
+				} else if changed {
+					e.logger.Printf("[DEBUG] Policy reloaded from %s", e.path)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// writePolicy responds with the model and rules
+func (e *policyEngine) writePolicy(w http.ResponseWriter, r *http.Request, message string) {
+	builtin := make([]string, len(e.builtin))
+	for i, rule := range e.builtin {
+		builtin[i] = rule.String()
+	}
+	stored := e.rules()
+	rules := make([]string, len(stored))
+	for i, rule := range stored {
+		rules[i] = rule.String()
+	}
+
+	response := Response{
+		Success: true,
+		Message: localize(r, message),
+		Data: map[string]interface{}{
+			"model":   e.enforcer.Model().String(),
+			"builtin": builtin,
+			"rules":   rules,
+			"file":    e.path,
+		},
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// PolicyHandler lets admins view (GET) the policy model and rules, and
+// replace (PUT) the stored rules. The built-in rules for the configured
+// roles always apply and cannot be changed here.
+func (s *Server) PolicyHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Policy request received")
+	s.servePolicy(w, r, s.authHandler.policy, "permissions")
+}
+
+// servePolicy shows or replaces the stored rules of engine, named in the
+// audit log by name
+func (s *Server) servePolicy(w http.ResponseWriter, r *http.Request, engine *policyEngine, name string) {
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		engine.writePolicy(w, r, "Policy retrieved successfully")
+		return
+	}
+
+	var req PolicyRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	rules := make([]policy.Rule, 0, len(req.Rules))
+	for _, line := range req.Rules {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		rule, err := policy.ParseRule(line)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rules = append(rules, rule)
+	}
+	if _, err := policy.NewEnforcer(engine.enforcer.Model(), rules); err != nil {
+		s.logger.Printf("[DEBUG] Rejected policy update: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := engine.replace(rules); err != nil {
+		s.logger.Printf("[DEBUG] Failed to store policy: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.audit.Record(AuditEvent{
+		Type:    AuditPolicyChanged,
+		UserID:  admin.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"policy": name, "rules": strconv.Itoa(len(rules))},
+	})
+	engine.writePolicy(w, r, "Policy updated")
+}
+
+// PolicyReloadHandler lets admins reread the policy file now rather than
+// waiting for the next check
+func (s *Server) PolicyReloadHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Policy reload request received")
+	s.reloadPolicy(w, r, s.authHandler.policy, "permissions")
+}
+
+// reloadPolicy rereads engine's file, named in the audit log by name
+func (s *Server) reloadPolicy(w http.ResponseWriter, r *http.Request, engine *policyEngine, name string) {
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := engine.reload(true); err != nil {
+		s.logger.Printf("[DEBUG] Policy reload failed: %v", err)
+		if errors.Is(err, errNoPolicyFile) {
+			http.Error(w, localize(r, "No policy file is configured"), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	s.audit.Record(AuditEvent{
+		Type:    AuditPolicyChanged,
+		UserID:  admin.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"policy": name, "rules": strconv.Itoa(len(engine.rules())), "source": "reload"},
+	})
+	engine.writePolicy(w, r, "Policy reloaded")
+}
+
+// PolicyEnforceHandler lets admins ask how the policy decides a request,
+// to try out rules before relying on them
+func (s *Server) PolicyEnforceHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Policy enforce request received")
+
+	if _, ok := s.authHandler.requireAdmin(w, r); !ok {
+		return
+	}
+
+	var req PolicyEnforceRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	allowed, rule := s.authHandler.policy.enforcer.Explain(req.Subject, req.Object, req.Action)
+	decision := PolicyDecision{Allowed: allowed}
+	if rule != nil {
+		decision.Rule = rule.String()
+	}
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Policy decision"),
+		Data:    decision,
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
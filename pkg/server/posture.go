@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Security posture flags
+const (
+	PostureNoTwoFactor     = "no_2fa"
+	PostureStalePassword   = "stale_password"
+	PostureUnverifiedEmail = "unverified_email"
+	PostureDormant         = "dormant"
+)
+
+// postureFlags are all the flags, in the order reports list them
+var postureFlags = []string{PostureNoTwoFactor, PostureStalePassword, PostureUnverifiedEmail, PostureDormant}
+
+// SecurityPostureEntry is one user with at least one weakness
+type SecurityPostureEntry struct {
+	UserID            string     `json:"userId"`
+	Username          string     `json:"username"`
+	Email             string     `json:"email"`
+	Flags             []string   `json:"flags"`
+	LastLoginAt       *time.Time `json:"lastLoginAt,omitempty"`
+	PasswordChangedAt time.Time  `json:"passwordChangedAt"`
+}
+
+// SecurityPostureReport lists the users with weak security posture
+type SecurityPostureReport struct {
+	GeneratedAt time.Time `json:"generatedAt"`
+	Users       int       `json:"users"`
+	// Counts is how many users have each flag
+	Counts  map[string]int         `json:"counts"`
+	Entries []SecurityPostureEntry `json:"entries"`
+}
+
+// postureFlagsFor returns the weaknesses of user at now
+func (s *Server) postureFlagsFor(user *User, now time.Time) []string {
+	flags := []string{}
+	if !user.HasTwoFactor() {
+		flags = append(flags, PostureNoTwoFactor)
+	}
+	if user.PasswordExpired(s.config.StalePasswordAge, now) {
+		flags = append(flags, PostureStalePassword)
+	}
+	if user.EmailVerifiedAt == nil {
+		flags = append(flags, PostureUnverifiedEmail)
+	}
+	if s.config.DormantAccountAge > 0 && now.Sub(user.LastActive()) > s.config.DormantAccountAge {
+		flags = append(flags, PostureDormant)
+	}
+	return flags
+}
+
+// SecurityPostureHandler reports, per user, the weaknesses a security
+// campaign might target: no second factor, a password older than
+// Config.StalePasswordAge, an email address never verified and no sign-in
+// for Config.DormantAccountAge. Users with none are left out, as are
+// deleted and merged accounts. ?flag= (repeatable or comma-separated) keeps
+// users with any of those flags, and ?format=csv downloads the report as
+// CSV, one user per row.
+func (s *Server) SecurityPostureHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Security posture report request received")
+
+	if _, ok := s.authHandler.requireAdmin(w, r); !ok {
+		return
+	}
+
+	wanted := make(map[string]bool)
+	for _, value := range r.URL.Query()["flag"] {
+		for _, flag := range splitList(value) {
+			if !slices.Contains(postureFlags, flag) {
+				http.Error(w, localize(r, "Unknown posture flag"), http.StatusBadRequest)
+				return
+			}
+			wanted[flag] = true
+		}
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, localize(r, "Unsupported report format"), http.StatusBadRequest)
+		return
+	}
+
+	users, err := s.authHandler.users.List(r.Context())
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to list users: %v", err)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	now := s.authHandler.clock.Now()
+	report := SecurityPostureReport{
+		GeneratedAt: now,
+		Counts:      make(map[string]int),
+		Entries:     []SecurityPostureEntry{},
+	}
+	for _, flag := range postureFlags {
+		report.Counts[flag] = 0
+	}
+	for _, user := range users {
+		if user.Deletion != nil || user.Merge != nil {
+			continue
+		}
+		report.Users++
+
+		flags := s.postureFlagsFor(user, now)
+		for _, flag := range flags {
+			report.Counts[flag]++
+		}
+		if len(flags) == 0 || !anyFlag(flags, wanted) {
+			continue
+		}
+		report.Entries = append(report.Entries, SecurityPostureEntry{
+			UserID:            user.ID,
+			Username:          user.Username,
+			Email:             user.Email,
+			Flags:             flags,
+			LastLoginAt:       user.LastLoginAt,
+			PasswordChangedAt: user.PasswordChangedAt,
+		})
+	}
+	sort.Slice(report.Entries, func(i, j int) bool {
+		return report.Entries[i].Username < report.Entries[j].Username
+	})
+
+	if format == "csv" {
+		writePostureCSV(w, report)
+		return
+	}
+
+	response := Response{
+		Success: true,
+		Data:    report,
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// anyFlag reports whether flags has one of wanted, or wanted is empty
+func anyFlag(flags []string, wanted map[string]bool) bool {
+	if len(wanted) == 0 {
+		return true
+	}
+	for _, flag := range flags {
+		if wanted[flag] {
+			return true
+		}
+	}
+	return false
+}
+
+// writePostureCSV writes the report as a CSV download with a yes/no column
+// per flag, which mail merge and spreadsheet tools handle better than a
+// list
+func writePostureCSV(w http.ResponseWriter, report SecurityPostureReport) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="security-posture-%s.csv"`, report.GeneratedAt.Format("2006-01-02")))
+
+	out := csv.NewWriter(w)
+	header := []string{"user_id", "username", "email", "last_login_at", "password_changed_at"}
+	out.Write(append(header, postureFlags...))
+	for _, entry := range report.Entries {
+		lastLogin := ""
+		if entry.LastLoginAt != nil {
+			lastLogin = entry.LastLoginAt.UTC().Format(time.RFC3339)
+		}
+		row := []string{
+			entry.UserID,
+			csvSafe(entry.Username),
+			csvSafe(entry.Email),
+			lastLogin,
+			entry.PasswordChangedAt.UTC().Format(time.RFC3339),
+		}
+		for _, flag := range postureFlags {
+			if slices.Contains(entry.Flags, flag) {
+				row = append(row, "yes")
+			} else {
+				row = append(row, "no")
+			}
+		}
+		out.Write(row)
+	}
+	out.Flush()
+}
+
+// csvSafe keeps user-controlled text from being read as a formula when the
+// CSV is opened in a spreadsheet
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"auth-server/pkg/account"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultNotificationPreferences are given to new accounts
+func defaultNotificationPreferences() NotificationPreferences {
+	return NotificationPreferences{SecurityAlerts: true}
+}
+
+// Notification kinds, each governed by one preference
+const (
+	NotifyNewLogin       = account.NotifyNewLogin
+	NotifySecurityAlert  = account.NotifySecurityAlert
+	NotifyProductUpdates = account.NotifyProductUpdates
+)
+
+// notify emails user the template unless they have turned off kind
+func (h *AuthHandler) notify(r *http.Request, user *User, kind, template string, data interface{}) {
+	if !user.Preferences.Allows(kind) {
+		h.logger.Printf("[DEBUG] Skipping %s email for %s: %s notifications are off", template, user.Username, kind)
+		return
+	}
+	h.sendEmail(r.Context(), user, userLocale(user, r), template, data)
+}
+
+// notifyNewLogin tells user about a successful sign-in if they asked to be
+func (h *AuthHandler) notifyNewLogin(r *http.Request, user *User, ip, country string, now time.Time) {
+	if country == "" {
+		country = "unknown"
+	}
+	h.notify(r, user, NotifyNewLogin, "new_login", map[string]string{
+		"Username": user.Username,
+		"IP":       ip,
+		"Country":  country,
+		"Time":     now.Format(time.RFC1123),
+	})
+}
+
+// PreferencesHandler returns the session user's notification preferences
+// on GET and replaces them on PUT. Fields missing from a PUT body keep
+// their current value.
+func (h *AuthHandler) PreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Preferences request received")
+
+	user := contextUser(r)
+
+	if r.Method == http.MethodGet && h.checkNotModified(w, r, user) {
+		return
+	}
+
+	message := "Preferences retrieved successfully"
+	if r.Method == http.MethodPut {
+		if !h.checkIfMatch(w, r, user) {
+			return
+		}
+
+		preferences := user.Preferences
+		if err := decodeJSON(w, r, &preferences); err != nil {
+			h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+			writeBodyError(w, r, err)
+			return
+		}
+
+		user.Preferences = preferences
+		user.UpdatedAt = h.clock.Now()
+		if err := h.users.Update(r.Context(), user); err != nil {
+			h.logger.Printf("[DEBUG] Failed to store preferences for %s: %v", user.Username, err)
+			writeUserUpdateError(w, r, err)
+			return
+		}
+
+		h.audit.Record(AuditEvent{
+			Type:   AuditPreferencesChanged,
+			UserID: user.ID,
+			IP:     clientIP(r),
+			Details: map[string]string{
+				"newLoginEmail":  fmt.Sprint(preferences.NewLoginEmail),
+				"securityAlerts": fmt.Sprint(preferences.SecurityAlerts),
+				"productUpdates": fmt.Sprint(preferences.ProductUpdates),
+				"publicProfile":  fmt.Sprint(preferences.Profile.Public),
+			},
+		})
+		message = "Preferences updated successfully"
+	}
+
+	response := Response{
+		Success: true,
+		Message: localize(r, message),
+		Data:    user.Preferences,
+	}
+
+	w.Header().Set("ETag", userETag(user))
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Preferences served for user: %s", user.Username)
+}
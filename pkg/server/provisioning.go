@@ -0,0 +1,133 @@
+package server
+
+import (
+	"auth-server/pkg/policy"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// provisioningModel decides how the account of a user arriving from an
+// external identity provider is set up. The request is the user, whose
+// attributes conditions read as r.sub.<name>, and the provider. The first
+// rule whose provider pattern and condition match decides: deny refuses
+// the account, and allow creates it with the rule's role and
+// organization, "*" keeping the default. So the rules
+//
+//	p, r.sub.domain == "contractors.example", sso:*, *, *, deny
+//	p, "listMatch(r.sub.groups, 'it-admins')", sso:*, support, *, allow
+//	p, r.sub.domain == "corp-eu.example", *, *, corp.example, allow
+//
+// refuse contractors, make IT admins support staff, and put users of a
+// subsidiary's domain in the parent organization. Without a matching
+// rule the account gets the defaults.
+const provisioningModel = `[request_definition]
+r = sub, obj
+
+[policy_definition]
+p = sub_rule, obj, role, org, eft
+
+[policy_effect]
+e = priority(p.eft) || deny
+
+[matchers]
+m = keyMatch(r.obj, p.obj) && eval(p.sub_rule)
+`
+
+// errProvisioningDenied is returned when a provisioning rule refuses a user
+var errProvisioningDenied = errors.New("refused by provisioning rule")
+
+// newProvisioningRules loads the provisioning rules kept in path, or
+// starts without any, kept in memory, when path is empty
+func newProvisioningRules(path string, interval time.Duration, logger *log.Logger) (*policyEngine, error) {
+	model, err := policy.ParseModel(provisioningModel)
+	if err != nil {
+		return nil, err
+	}
+	return newPolicyEngine(model, nil, path, interval, logger)
+}
+
+// externalUser is a user an external identity provider vouches for, as
+// provisioning rules see them. Organization is the tenant the provider
+// serves, when it serves one.
+type externalUser struct {
+	Provider     string
+	Subject      string
+	Email        string
+	Username     string
+	Organization string
+	Groups       []string
+}
+
+// attributes are what provisioning rule conditions can use:
+//
+//	provider, subject  the identity provider and its name for the user
+//	email, domain      the email address and its domain
+//	username           the username the account would get
+//	organization       the tenant of the SSO connection, when any
+//	groups             the provider's groups, comma-separated for listMatch
+func (u externalUser) attributes() policy.Attributes {
+	return policy.Attributes{
+		"provider":     u.Provider,
+		"subject":      u.Subject,
+		"email":        u.Email,
+		"domain":       tenantOf(u.Email),
+		"username":     u.Username,
+		"organization": u.Organization,
+		"groups":       strings.Join(u.Groups, ","),
+	}
+}
+
+// applyProvisioningRules sets up user, about to be created for external,
+// as the first matching provisioning rule says. A user at a domain other
+// than their organization's is put in the organization. The rule, if any,
+// is returned for the audit log.
+func (h *AuthHandler) applyProvisioningRules(user *User, external externalUser) (string, error) {
+	if external.Organization != "" && external.Organization != tenantOf(user.Email) {
+		user.Organization = external.Organization
+	}
+
+	attributes := map[string]policy.Attributes{"sub": external.attributes()}
+	allowed, rule := h.provisioningRules.enforcer.ExplainAttributes(attributes, external.Username, external.Provider)
+	if rule == nil {
+		return "", nil
+	}
+	if !allowed {
+		h.logger.Printf("[DEBUG] Provisioning of %s from %s refused by rule %q", external.Username, external.Provider, rule)
+		return rule.String(), errProvisioningDenied
+	}
+
+	// Roles given to the username in the configuration win
+	role, organization := rule.Values[2], rule.Values[3]
+	if role != "*" && user.Role == RoleUser {
+		if !h.roleExists(role) {
+			h.logger.Printf("[DEBUG] Provisioning rule %q gives unknown role %q", rule, role)
+			return rule.String(), errProvisioningDenied
+		}
+		user.Role = role
+	}
+	if organization != "*" {
+		user.Organization = organization
+		if organization == tenantOf(user.Email) {
+			user.Organization = ""
+		}
+	}
+	return rule.String(), nil
+}
+
+// ProvisioningRulesHandler lets admins view (GET) and replace (PUT) the
+// provisioning rules, which set up or refuse accounts created for users
+// of SSO connections and proxies
+func (s *Server) ProvisioningRulesHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Provisioning rules request received")
+	s.servePolicy(w, r, s.authHandler.provisioningRules, "provisioning_rules")
+}
+
+// ProvisioningRulesReloadHandler lets admins reread the provisioning
+// rules file now
+func (s *Server) ProvisioningRulesReloadHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Provisioning rules reload request received")
+	s.reloadPolicy(w, r, s.authHandler.provisioningRules, "provisioning_rules")
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxDisplayNameLength = 64
+	maxBioLength         = 500
+	maxAvatarURLLength   = 2048
+
+	// publicProfileMaxAge is how long shared caches may serve a public
+	// profile without revalidating
+	publicProfileMaxAge = 5 * time.Minute
+)
+
+// PublicProfile is what anyone can see of a user who made their profile
+// public
+type PublicProfile struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName,omitempty"`
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+}
+
+// publicProfile returns the part of u's profile they chose to show, and
+// false when their profile is not public
+func publicProfile(u *User) (PublicProfile, bool) {
+	visibility := u.Preferences.Profile
+	if !visibility.Public || u.Merge != nil || u.Deletion != nil {
+		return PublicProfile{}, false
+	}
+
+	profile := PublicProfile{Username: u.Username}
+	if visibility.DisplayName {
+		profile.DisplayName = u.DisplayName
+	}
+	if visibility.Avatar {
+		profile.AvatarURL = u.AvatarURL
+	}
+	if visibility.Bio {
+		profile.Bio = u.Bio
+	}
+	return profile, true
+}
+
+// publicProfileETag is the entity tag of a public profile. It is derived
+// from the content rather than the user's version so it reveals nothing
+// beyond the profile and survives changes to hidden fields.
+func publicProfileETag(profile PublicProfile) string {
+	encoded, _ := json.Marshal(profile)
+	sum := sha256.Sum256(encoded)
+	return `"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// applyProfileFields validates the display name, avatar and bio of a
+// profile update and sets them on user. It returns the client-facing
+// message for the first invalid field, or "".
+func applyProfileFields(user *User, req UpdateProfileRequest) string {
+	if req.DisplayName != nil {
+		name := strings.TrimSpace(*req.DisplayName)
+		if utf8.RuneCountInString(name) > maxDisplayNameLength {
+			return "Display name is too long"
+		}
+		user.DisplayName = name
+	}
+	if req.AvatarURL != nil {
+		avatar := strings.TrimSpace(*req.AvatarURL)
+		if avatar != "" {
+			u, err := url.Parse(avatar)
+			if err != nil || u.Scheme != "https" || u.Host == "" || len(avatar) > maxAvatarURLLength {
+				return "Avatar must be an https URL"
+			}
+		}
+		user.AvatarURL = avatar
+		user.AvatarBlob = ""
+	}
+	if req.Bio != nil {
+		bio := strings.TrimSpace(*req.Bio)
+		if utf8.RuneCountInString(bio) > maxBioLength {
+			return "Bio is too long"
+		}
+		user.Bio = bio
+	}
+	return ""
+}
+
+// PublicProfileHandler returns the public profile of the user with the
+// given username. It needs no session and may be cached by shared caches.
+// Usernames given up within the reservation period redirect to the
+// current one. Missing users and private profiles get the same 404 so the
+// endpoint does not reveal which usernames exist.
+func (h *AuthHandler) PublicProfileHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Public profile request received")
+
+	username := mux.Vars(r)["username"]
+	user, err := h.users.GetByUsername(r.Context(), username)
+	renamed := false
+	if errors.Is(err, ErrUserNotFound) {
+		user, err = h.userByFormerUsername(r.Context(), username)
+		renamed = true
+	}
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		h.logger.Printf("[DEBUG] User lookup failed: %v", err)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	var profile PublicProfile
+	public := false
+	if err == nil {
+		profile, public = publicProfile(user)
+	}
+	if !public {
+		h.logger.Printf("[DEBUG] No public profile for: %s", username)
+		http.Error(w, localize(r, "Profile not found"), http.StatusNotFound)
+		return
+	}
+
+	// Not a permanent redirect: the old name is free again once its
+	// reservation lapses
+	if renamed {
+		h.logger.Printf("[DEBUG] Redirecting former username %s to %s", username, user.Username)
+		http.Redirect(w, r, h.config.BasePath+"/api/users/"+url.PathEscape(user.Username)+"/public", http.StatusFound)
+		return
+	}
+
+	etag := publicProfileETag(profile)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(publicProfileMaxAge.Seconds())))
+	w.Header().Set("Vary", "Accept-Language")
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Profile retrieved successfully"),
+		Data:    profile,
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultQuotaRoutes are metered when QUOTA_ROUTES is not set: the utility
+// endpoints, which do work on behalf of the caller
+var defaultQuotaRoutes = []string{
+	"/api/base64/*",
+	"/api/transform",
+	"/api/hash",
+	"/api/hmac",
+	"/api/encrypt",
+	"/api/decrypt",
+	"/api/random",
+}
+
+// QuotaLimits caps requests to the metered routes per UTC day and month;
+// zero means unlimited
+type QuotaLimits struct {
+	Daily   int
+	Monthly int
+}
+
+// QuotaPeriod is a caller's usage over one quota period
+type QuotaPeriod struct {
+	// Limit is zero when the period is unlimited, and Remaining is then
+	// omitted
+	Limit     int       `json:"limit"`
+	Used      int       `json:"used"`
+	Remaining *int      `json:"remaining,omitempty"`
+	ResetsAt  time.Time `json:"resetsAt"`
+}
+
+func newQuotaPeriod(limit, used int, resetsAt time.Time) QuotaPeriod {
+	period := QuotaPeriod{Limit: limit, Used: used, ResetsAt: resetsAt}
+	if limit > 0 {
+		remaining := limit - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		period.Remaining = &remaining
+	}
+	return period
+}
+
+// exhausted reports whether another request would exceed the limit
+func (p QuotaPeriod) exhausted() bool {
+	return p.Limit > 0 && p.Used >= p.Limit
+}
+
+// quotaUsage counts one caller's requests in the current day and month
+type quotaUsage struct {
+	day     string
+	daily   int
+	month   string
+	monthly int
+}
+
+// roll starts new periods once the day or month has changed
+func (u *quotaUsage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); u.day != day {
+		u.day, u.daily = day, 0
+	}
+	if month := now.Format("2006-01"); u.month != month {
+		u.month, u.monthly = month, 0
+	}
+}
+
+// quotaTracker counts requests per caller. Callers are keyed "user:<id>",
+// "client:<id>" or "ip:<address>".
+type quotaTracker struct {
+	mutex sync.Mutex
+	usage map[string]*quotaUsage
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{usage: make(map[string]*quotaUsage)}
+}
+
+// quotaResets returns when the day and month containing now end
+func quotaResets(now time.Time) (day, month time.Time) {
+	year, m, d := now.Date()
+	return time.Date(year, m, d+1, 0, 0, 0, 0, time.UTC), time.Date(year, m+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// take counts a request for caller unless it would exceed limits. It
+// returns the usage afterwards and whether the request was allowed.
+func (t *quotaTracker) take(caller string, limits QuotaLimits, now time.Time) (daily, monthly QuotaPeriod, ok bool) {
+	now = now.UTC()
+	dayReset, monthReset := quotaResets(now)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	usage := t.usage[caller]
+	if usage == nil {
+		usage = &quotaUsage{}
+		t.usage[caller] = usage
+	}
+	usage.roll(now)
+
+	daily = newQuotaPeriod(limits.Daily, usage.daily, dayReset)
+	monthly = newQuotaPeriod(limits.Monthly, usage.monthly, monthReset)
+	if daily.exhausted() || monthly.exhausted() {
+		return daily, monthly, false
+	}
+
+	usage.daily++
+	usage.monthly++
+	return newQuotaPeriod(limits.Daily, usage.daily, dayReset), newQuotaPeriod(limits.Monthly, usage.monthly, monthReset), true
+}
+
+// peek returns caller's usage without counting a request
+func (t *quotaTracker) peek(caller string, limits QuotaLimits, now time.Time) (daily, monthly QuotaPeriod) {
+	now = now.UTC()
+	dayReset, monthReset := quotaResets(now)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var usage quotaUsage
+	if existing := t.usage[caller]; existing != nil {
+		usage = *existing
+	}
+	usage.roll(now)
+	return newQuotaPeriod(limits.Daily, usage.daily, dayReset), newQuotaPeriod(limits.Monthly, usage.monthly, monthReset)
+}
+
+// Purge drops callers with no requests this month, returning how many were
+// removed
+func (t *quotaTracker) Purge(now time.Time) int {
+	month := now.UTC().Format("2006-01")
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	purged := 0
+	for caller, usage := range t.usage {
+		if usage.month != month {
+			delete(t.usage, caller)
+			purged++
+		}
+	}
+	return purged
+}
+
+// quotaRouteMatches reports whether a route template is one of the metered
+// routes, which may end in "/*" to cover everything below a path
+func quotaRouteMatches(routes []string, template string) bool {
+	for _, route := range routes {
+		if prefix, ok := strings.CutSuffix(route, "/*"); ok {
+			if strings.HasPrefix(template, prefix+"/") {
+				return true
+			}
+		} else if route == template {
+			return true
+		}
+	}
+	return false
+}
+
+// quotaCaller identifies who a request counts against: the service account
+// of a client certificate, the API client for a valid bearer token, the
+// user for a session, or else the client IP
+func (s *Server) quotaCaller(r *http.Request) string {
+	if cert, ok := clientCertificate(r); ok {
+		if account, _, ok := s.serviceAccountFor(cert); ok {
+			return "client:" + account.Name
+		}
+	}
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		if claims, err := s.verifyServiceToken(token); err == nil {
+			return "client:" + claims.ClientID
+		}
+	}
+	if record, err := s.authHandler.sessionRecord(r); err == nil {
+		return "user:" + record.UserID
+	}
+	return "ip:" + clientIP(r)
+}
+
+// quotaLimitsFor returns the caller's override, the limits of a user's
+// tier when tiers are configured, or else the default limits
+func (s *Server) quotaLimitsFor(ctx context.Context, caller string) QuotaLimits {
+	if limits, ok := s.config.QuotaOverrides[caller]; ok {
+		return limits
+	}
+	if id, ok := strings.CutPrefix(caller, "user:"); ok && len(s.config.Tiers) > 0 {
+		if user, err := s.authHandler.users.Get(ctx, id); err == nil {
+			limits := s.tierLimits(s.tierOf(user))
+			return QuotaLimits{Daily: limits.DailyQuota, Monthly: limits.MonthlyQuota}
+		}
+	}
+	return QuotaLimits{Daily: s.config.QuotaDailyLimit, Monthly: s.config.QuotaMonthlyLimit}
+}
+
+// setQuotaHeaders describes the caller's remaining quota on a response.
+// The RateLimit headers describe whichever period has less remaining.
+func setQuotaHeaders(w http.ResponseWriter, daily, monthly QuotaPeriod) {
+	var tightest *QuotaPeriod
+	if daily.Remaining != nil {
+		w.Header().Set("X-Quota-Limit-Day", strconv.Itoa(daily.Limit))
+		w.Header().Set("X-Quota-Remaining-Day", strconv.Itoa(*daily.Remaining))
+		tightest = &daily
+	}
+	if monthly.Remaining != nil {
+		w.Header().Set("X-Quota-Limit-Month", strconv.Itoa(monthly.Limit))
+		w.Header().Set("X-Quota-Remaining-Month", strconv.Itoa(*monthly.Remaining))
+		if tightest == nil || *monthly.Remaining < *tightest.Remaining {
+			tightest = &monthly
+		}
+	}
+	if tightest != nil {
+		setRateLimitHeaders(w, tightest.Limit, *tightest.Remaining, time.Until(tightest.ResetsAt))
+	}
+}
+
+// quotaMiddleware counts requests to the metered routes against the
+// caller's daily and monthly quotas and refuses them with 429 once either
+// is used up
+func (s *Server) quotaMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		template, err := route.GetPathTemplate()
+		if err != nil || !quotaRouteMatches(s.config.QuotaRoutes, template) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		caller := s.quotaCaller(r)
+		daily, monthly, ok := s.quotas.take(caller, s.quotaLimitsFor(r.Context(), caller), time.Now())
+		setQuotaHeaders(w, daily, monthly)
+		if ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		exceeded, period := daily, "day"
+		if monthly.exhausted() {
+			exceeded, period = monthly, "month"
+		}
+		s.logger.Printf("[DEBUG] Quota exceeded for %s (%s limit %d)", caller, period, exceeded.Limit)
+		kind, _, _ := strings.Cut(caller, ":")
+		s.metrics.Counter("auth_quota_exceeded_total", "Requests refused because the caller's quota was used up.", "caller", kind).Inc()
+
+		// The exhausted period decides when to retry, even if the other
+		// has less remaining
+		w.Header().Set("X-Quota-Reset", strconv.FormatInt(exceeded.ResetsAt.Unix(), 10))
+		setRateLimitHeaders(w, exceeded.Limit, 0, time.Until(exceeded.ResetsAt))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Request quota exceeded"),
+			Data: map[string]interface{}{
+				"period":   period,
+				"limit":    exceeded.Limit,
+				"resetsAt": exceeded.ResetsAt,
+			},
+		})
+	})
+}
+
+// UsageHandler reports the caller's quota on the metered routes and the
+// requests and bytes metered for their API keys, per key and endpoint
+func (s *Server) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Usage request received")
+
+	caller := s.quotaCaller(r)
+	metered, ok := s.meteredUsage(r, caller)
+	if !ok {
+		http.Error(w, localize(r, "Invalid report range"), http.StatusBadRequest)
+		return
+	}
+	daily, monthly := s.quotas.peek(caller, s.quotaLimitsFor(r.Context(), caller), time.Now())
+	setQuotaHeaders(w, daily, monthly)
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Usage retrieved successfully"),
+		Data: map[string]interface{}{
+			"caller":  caller,
+			"daily":   daily,
+			"monthly": monthly,
+			"routes":  s.config.QuotaRoutes,
+			"metered": metered,
+		},
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// setRateLimitHeaders describes a rate limit with the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers from the IETF
+// RateLimit header fields draft, so clients can slow down before they are
+// refused. reset is how long until the remaining count goes back up. When
+// nothing remains, Retry-After is set to the same time.
+func setRateLimitHeaders(w http.ResponseWriter, limit, remaining int, reset time.Duration) {
+	if remaining < 0 {
+		remaining = 0
+	}
+	seconds := int((reset + time.Second - 1) / time.Second)
+	if seconds < 0 {
+		seconds = 0
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds))
+	if remaining == 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+}
@@ -0,0 +1,436 @@
+package server
+
+import (
+	"auth-server/pkg/events"
+	"auth-server/pkg/ids"
+	"auth-server/pkg/randutil"
+	"auth-server/pkg/sessionstore"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// rememberMeCookie holds a remembered device's user, series and current
+// token as "user.series.token"
+const rememberMeCookie = "remember_me"
+
+// maxRememberedDevices caps how many devices a user may have remembered;
+// the least recently used is forgotten to make room
+const maxRememberedDevices = 20
+
+// rememberMeRotationGrace is how long a device's previous token is still
+// accepted after it was rotated. Requests a browser sends at once all
+// carry the same cookie; the first rotates it and the others would
+// otherwise look like a replay.
+const rememberMeRotationGrace = 30 * time.Second
+
+// errRememberMeTheft is returned for a remember me cookie whose series is
+// known but whose token is not the current one
+var errRememberMeTheft = errors.New("remember me token reused")
+
+// parseRememberMeCookie splits a remember me cookie into the user ID,
+// series and token
+func parseRememberMeCookie(value string) (userID, series, token string, ok bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+// setRememberMeCookie hands the browser the cookie for device with token,
+// or removes it when device is nil
+func (h *AuthHandler) setRememberMeCookie(w http.ResponseWriter, userID string, device *RememberedDevice, token string) {
+	cookie := &http.Cookie{
+		Name:     rememberMeCookie,
+		Path:     cookiePath(h.config.BasePath),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.config.PublicURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if device != nil {
+		cookie.Value = userID + "." + device.ID + "." + token
+		cookie.MaxAge = int(device.ExpiresAt.Sub(h.clock.Now()).Seconds())
+	}
+	http.SetCookie(w, cookie)
+}
+
+// newRememberMeToken returns a fresh token and the hash stored for it
+func newRememberMeToken() (string, string, error) {
+	token, err := randutil.Hex(32)
+	if err != nil {
+		return "", "", err
+	}
+	return token, hashAccessToken(token), nil
+}
+
+// rememberDevice remembers the browser of a user who just logged in with
+// their password and sets its cookie. A failure only costs the user the
+// remembering, so it is logged rather than refusing the login.
+func (h *AuthHandler) rememberDevice(w http.ResponseWriter, r *http.Request, user *User, multiFactor bool) {
+	token, hash, err := newRememberMeToken()
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to generate remember me token: %v", err)
+		return
+	}
+
+	now := h.clock.Now()
+	ip := clientIP(r)
+	device := RememberedDevice{
+		ID:              h.idGenerator.NewID(ids.PrefixDevice),
+		Device:          noticeDevice(r),
+		CreatedAt:       now,
+		ExpiresAt:       now.Add(h.config.RememberMeTTL),
+		LastUsedAt:      now,
+		LastUsedIP:      ip,
+		AuthenticatedAt: now,
+		MultiFactor:     multiFactor,
+		Fingerprint:     agentFingerprint(r),
+		TokenHash:       hash,
+	}
+
+	devices := slices.DeleteFunc(slices.Clone(user.RememberedDevices), func(d RememberedDevice) bool {
+		return !now.Before(d.ExpiresAt)
+	})
+	if len(devices) >= maxRememberedDevices {
+		oldest := slices.IndexFunc(devices, func(d RememberedDevice) bool {
+			return !slices.ContainsFunc(devices, func(other RememberedDevice) bool { return other.LastUsedAt.Before(d.LastUsedAt) })
+		})
+		devices = slices.Delete(devices, oldest, oldest+1)
+	}
+	user.RememberedDevices = append(devices, device)
+	user.UpdatedAt = now
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to remember device of %s: %v", user.Username, err)
+		return
+	}
+	h.setRememberMeCookie(w, user.ID, &device, token)
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditDeviceRemembered,
+		UserID:  user.ID,
+		IP:      ip,
+		Details: map[string]string{"device": device.ID},
+	})
+}
+
+// redeemRememberMe checks a remember me cookie and replaces the device's
+// token, returning the user, the device as updated and the new token. The
+// token replaced within rememberMeRotationGrace is accepted too but not
+// rotated again, and returns no new token. A cookie for an unknown,
+// expired or differently bound device returns errNoSession; a superseded
+// token returns errRememberMeTheft after every device and session of the
+// user has been revoked.
+func (h *AuthHandler) redeemRememberMe(r *http.Request, value string) (*User, RememberedDevice, string, error) {
+	user, device, next, err := h.tryRedeemRememberMe(r, value)
+	if errors.Is(err, ErrVersionConflict) {
+		// A request with the same cookie may have rotated the token
+		// first, which makes it the previous one
+		return h.tryRedeemRememberMe(r, value)
+	}
+	return user, device, next, err
+}
+
+func (h *AuthHandler) tryRedeemRememberMe(r *http.Request, value string) (*User, RememberedDevice, string, error) {
+	userID, series, token, ok := parseRememberMeCookie(value)
+	if !ok {
+		return nil, RememberedDevice{}, "", errNoSession
+	}
+	user, err := h.users.Get(r.Context(), userID)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, RememberedDevice{}, "", errNoSession
+	}
+	if err != nil {
+		return nil, RememberedDevice{}, "", err
+	}
+
+	now := h.clock.Now()
+	i := slices.IndexFunc(user.RememberedDevices, func(d RememberedDevice) bool { return d.ID == series })
+	if i < 0 || !now.Before(user.RememberedDevices[i].ExpiresAt) {
+		return nil, RememberedDevice{}, "", errNoSession
+	}
+	device := user.RememberedDevices[i]
+
+	presented := []byte(hashAccessToken(token))
+	current := subtle.ConstantTimeCompare(presented, []byte(device.TokenHash)) == 1
+	previous := !current && device.PreviousTokenHash != "" && now.Before(device.RotatedAt.Add(rememberMeRotationGrace)) &&
+		subtle.ConstantTimeCompare(presented, []byte(device.PreviousTokenHash)) == 1
+	if !current && !previous {
+		h.revokeRememberedUser(r, user, device.ID)
+		return nil, RememberedDevice{}, "", errRememberMeTheft
+	}
+	if device.Fingerprint != agentFingerprint(r) {
+		h.logger.Printf("[DEBUG] Remember me cookie of %s presented by another user agent", user.Username)
+		h.forgetDevice(r.Context(), user, device.ID)
+		return nil, RememberedDevice{}, "", errNoSession
+	}
+	if previous {
+		// The request that rotated the token hands the browser the
+		// new one
+		return user, device, "", nil
+	}
+
+	next, hash, err := newRememberMeToken()
+	if err != nil {
+		return nil, RememberedDevice{}, "", err
+	}
+	device.PreviousTokenHash = device.TokenHash
+	device.RotatedAt = now
+	device.TokenHash = hash
+	device.LastUsedAt = now
+	device.LastUsedIP = clientIP(r)
+	user.RememberedDevices = slices.Clone(user.RememberedDevices)
+	user.RememberedDevices[i] = device
+	if err := h.users.Update(r.Context(), user); err != nil {
+		return nil, RememberedDevice{}, "", err
+	}
+	return user, device, next, nil
+}
+
+// revokeRememberedUser answers the reuse of a remember me token: the
+// thief or the victim holds a copy, and there is no telling which, so
+// every remembered device and session of the user is revoked
+func (h *AuthHandler) revokeRememberedUser(r *http.Request, user *User, series string) {
+	ip := clientIP(r)
+	h.logger.Printf("[DEBUG] Remember me token of %s reused, revoking every session", user.Username)
+
+	user.RememberedDevices = nil
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to forget remembered devices of %s: %v", user.Username, err)
+	}
+	revoked, err := h.revokeUserSessions(r.Context(), user.ID)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to revoke sessions of %s: %v", user.Username, err)
+	}
+	for _, session := range revoked {
+		h.publishEvent(events.TypeSessionRevoked, user.ID, map[string]string{
+			"sessionId": session.ID,
+			"reason":    "remember_me_theft",
+		})
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditRememberMeTheft,
+		UserID:  user.ID,
+		IP:      ip,
+		Details: map[string]string{"device": series, "sessions": fmt.Sprint(len(revoked))},
+	})
+}
+
+// forgetDevice drops one remembered device of user, if it is still there
+func (h *AuthHandler) forgetDevice(ctx context.Context, user *User, id string) bool {
+	i := slices.IndexFunc(user.RememberedDevices, func(d RememberedDevice) bool { return d.ID == id })
+	if i < 0 {
+		return false
+	}
+	user.RememberedDevices = slices.Delete(slices.Clone(user.RememberedDevices), i, i+1)
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(ctx, user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to forget remembered device %s: %v", id, err)
+		return false
+	}
+	return true
+}
+
+// forgetRequestDevice forgets the device whose remember me cookie r
+// carries and removes the cookie, as on logout
+func (h *AuthHandler) forgetRequestDevice(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(rememberMeCookie)
+	if err != nil {
+		return
+	}
+	h.setRememberMeCookie(w, "", nil, "")
+	userID, series, token, ok := parseRememberMeCookie(cookie.Value)
+	if !ok {
+		return
+	}
+	user, err := h.users.Get(r.Context(), userID)
+	if err != nil {
+		return
+	}
+	// Only the holder of the current token may forget the device
+	i := slices.IndexFunc(user.RememberedDevices, func(d RememberedDevice) bool { return d.ID == series })
+	if i < 0 || subtle.ConstantTimeCompare([]byte(hashAccessToken(token)), []byte(user.RememberedDevices[i].TokenHash)) != 1 {
+		return
+	}
+	if h.forgetDevice(r.Context(), user, series) {
+		h.audit.Record(AuditEvent{
+			Type:    AuditDeviceForgotten,
+			UserID:  user.ID,
+			IP:      clientIP(r),
+			Details: map[string]string{"device": series, "reason": "logout"},
+		})
+	}
+}
+
+// rememberMeMiddleware signs a remembered browser in again once its
+// session has ended, rotating the device's token, and hands the request on
+// with the new session. The session keeps the time and second factor of
+// the password login the device was remembered at, and the location
+// policy and new login notices of that login are not repeated.
+func (s *Server) rememberMeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(rememberMeCookie)
+		if !s.config.RememberMe || err != nil || cookie.Value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, bearer := bearerToken(r); bearer {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := s.authHandler
+		if _, err := h.sessionRecord(r); !errors.Is(err, errNoSession) {
+			// Signed in, or the session store cannot tell; either way
+			// the device's token is left alone
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, device, token, err := h.redeemRememberMe(r, cookie.Value)
+		if errors.Is(err, errNoSession) || errors.Is(err, errRememberMeTheft) {
+			h.setRememberMeCookie(w, "", nil, "")
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			s.logger.Printf("[DEBUG] Failed to redeem remember me cookie: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if user.Deletion != nil || user.Merge != nil || user.SignupReview != nil || user.Suspension.ActiveAt(h.clock.Now()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := h.clock.Now()
+		ip := clientIP(r)
+		record := sessionstore.Session{
+			ID:              h.idGenerator.NewID(ids.PrefixSession),
+			UserID:          user.ID,
+			IP:              ip,
+			CreatedAt:       now,
+			ExpiresAt:       now.Add(h.config.SessionTTL),
+			AuthenticatedAt: device.AuthenticatedAt,
+			MultiFactor:     device.MultiFactor,
+		}
+		if device.ExpiresAt.Before(record.ExpiresAt) {
+			record.ExpiresAt = device.ExpiresAt
+		}
+		sessionToken, err := h.issueSession(r.Context(), record)
+		if err == nil {
+			// The cookie transport also stores the session in the
+			// request's cached cookie session, so handlers further on
+			// see the user
+			_, err = h.handOverSession(w, r, sessionToken, int(record.ExpiresAt.Sub(now).Seconds()), SessionTransportCookie)
+		}
+		if err != nil {
+			s.logger.Printf("[DEBUG] Failed to issue remembered session for %s: %v", user.Username, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if token != "" {
+			h.setRememberMeCookie(w, user.ID, &device, token)
+		}
+
+		h.audit.Record(AuditEvent{
+			Type:    AuditLoginSucceeded,
+			UserID:  user.ID,
+			IP:      ip,
+			Details: map[string]string{"method": "remember_me", "device": device.ID},
+		})
+		h.publishEvent(events.TypeLoginSucceeded, user.ID, map[string]string{
+			"sessionId": record.ID,
+			"ip":        ip,
+			"method":    "remember_me",
+		})
+		s.logger.Printf("[DEBUG] Signed in %s on remembered device %s", user.Username, device.ID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RememberedDevicesHandler lists the session user's remembered devices
+func (h *AuthHandler) RememberedDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Remembered devices request received")
+
+	user := contextUser(r)
+
+	now := h.clock.Now()
+	devices := []RememberedDevice{}
+	for _, device := range user.RememberedDevices {
+		if now.Before(device.ExpiresAt) {
+			devices = append(devices, device)
+		}
+	}
+	json.NewEncoder(w).Encode(Response{Success: true, Data: devices})
+}
+
+// RememberedDeviceDeleteHandler forgets one of the session user's
+// remembered devices, so its cookie no longer signs it in
+func (h *AuthHandler) RememberedDeviceDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Remembered device removal request received")
+
+	user := contextUser(r)
+
+	id := mux.Vars(r)["id"]
+	i := slices.IndexFunc(user.RememberedDevices, func(d RememberedDevice) bool { return d.ID == id })
+	if i < 0 {
+		http.Error(w, localize(r, "Remembered device not found"), http.StatusNotFound)
+		return
+	}
+	user.RememberedDevices = slices.Delete(slices.Clone(user.RememberedDevices), i, i+1)
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to forget remembered device %s: %v", id, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditDeviceForgotten,
+		UserID:  user.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"device": id},
+	})
+
+	json.NewEncoder(w).Encode(Response{Success: true, Message: localize(r, "Remembered device removed")})
+}
+
+// purgeExpiredRememberedDevices drops expired remembered devices and
+// returns how many it dropped
+func (h *AuthHandler) purgeExpiredRememberedDevices(now time.Time) int {
+	ctx := context.Background()
+	users, err := h.users.List(ctx)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to list users to purge remembered devices: %v", err)
+		return 0
+	}
+
+	purged := 0
+	for _, user := range users {
+		kept := slices.DeleteFunc(slices.Clone(user.RememberedDevices), func(device RememberedDevice) bool {
+			return !now.Before(device.ExpiresAt)
+		})
+		if len(kept) == len(user.RememberedDevices) {
+			continue
+		}
+		dropped := len(user.RememberedDevices) - len(kept)
+		user.RememberedDevices = kept
+		if err := h.users.Update(ctx, user); err != nil {
+			h.logger.Printf("[DEBUG] Failed to purge remembered devices of %s: %v", user.ID, err)
+			continue
+		}
+		purged += dropped
+	}
+	return purged
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Login risk signals, the names RISK_RULES assigns weights to
+const (
+	// RiskNewIP fires for an address the account has not recently signed
+	// in from
+	RiskNewIP = "new_ip"
+	// RiskNewDevice fires for a User-Agent the account has not recently
+	// signed in with
+	RiskNewDevice = "new_device"
+	// RiskOddHour fires for a time of day far from all recent sign-ins
+	RiskOddHour = "odd_hour"
+	// RiskVelocity fires when the account or address has made more than
+	// Config.RiskVelocityLimit login attempts in the last hour
+	RiskVelocity = "velocity"
+)
+
+// defaultRiskWeights score a login from a new device on a new network as
+// just enough to challenge
+var defaultRiskWeights = map[string]int{
+	RiskNewIP:     20,
+	RiskNewDevice: 30,
+	RiskOddHour:   15,
+	RiskVelocity:  40,
+}
+
+const (
+	// loginHistorySize is how many recent logins risk is scored against
+	loginHistorySize = 10
+	// riskMinHistory is how many logins an account needs before the new
+	// address, new device and odd hour signals apply, so first logins are
+	// not all challenged
+	riskMinHistory = 3
+	// riskHourTolerance is how far, in hours, a login may be from the
+	// nearest earlier one before it is at an odd hour
+	riskHourTolerance = 2
+	// riskVelocityWindow is the window Config.RiskVelocityLimit applies to
+	riskVelocityWindow = time.Hour
+
+	// smsPurposeRiskChallenge marks the emailed codes of risk challenges in
+	// smsCodes, which holds one-time codes whatever carries them
+	smsPurposeRiskChallenge = "risk_challenge"
+)
+
+// loginRisk is the score of a login and the signals behind it
+type loginRisk struct {
+	Score   int
+	Signals []string
+	// Challenged is set when a risk provider asked for the challenge,
+	// whatever the score
+	Challenged bool
+}
+
+// assessLoginRisk scores a login attempt whose password was correct
+func (h *AuthHandler) assessLoginRisk(r *http.Request, user *User, ip string, attemptKeys []string, now time.Time) loginRisk {
+	var risk loginRisk
+	add := func(signal string) {
+		if weight := h.config.RiskWeights[signal]; weight > 0 {
+			risk.Score += weight
+			risk.Signals = append(risk.Signals, signal)
+		}
+	}
+
+	if history := user.RecentLogins; len(history) >= riskMinHistory {
+		device := agentFingerprint(r)
+		knownIP, knownDevice, usualHour := false, false, false
+		for _, login := range history {
+			knownIP = knownIP || login.IP == ip
+			knownDevice = knownDevice || login.Device == device
+			usualHour = usualHour || hourDistance(login.At, now) <= riskHourTolerance
+		}
+		if !knownIP {
+			add(RiskNewIP)
+		}
+		if !knownDevice {
+			add(RiskNewDevice)
+		}
+		if !usualHour {
+			add(RiskOddHour)
+		}
+	}
+	if h.loginAttempts.Max(attemptKeys...) > h.config.RiskVelocityLimit {
+		add(RiskVelocity)
+	}
+	return risk
+}
+
+// hourDistance is how many hours apart the times of day of a and b are, in
+// UTC, going around the clock
+func hourDistance(a, b time.Time) int {
+	distance := a.UTC().Hour() - b.UTC().Hour()
+	if distance < 0 {
+		distance = -distance
+	}
+	return min(distance, 24-distance)
+}
+
+// rememberLogin returns history with a new login added, keeping the most
+// recent loginHistorySize. It returns a new slice since copies of a user
+// share the old one.
+func rememberLogin(history []LoginFingerprint, login LoginFingerprint) []LoginFingerprint {
+	start := max(0, len(history)+1-loginHistorySize)
+	remembered := make([]LoginFingerprint, 0, loginHistorySize)
+	remembered = append(remembered, history[start:]...)
+	return append(remembered, login)
+}
+
+// challengeRiskyLogin asks for an emailed code when a login scores at or
+// above the risk threshold or a risk provider challenged it. Accounts with two-factor authentication have
+// already given a second factor, so only accounts without it are
+// challenged. It writes the response and returns false while the login
+// may not continue.
+func (h *AuthHandler) challengeRiskyLogin(w http.ResponseWriter, r *http.Request, user *User, req LoginRequest, ip string, risk loginRisk) bool {
+	scored := h.config.RiskThreshold > 0 && risk.Score >= h.config.RiskThreshold
+	if !(scored || risk.Challenged) || user.HasTwoFactor() {
+		return true
+	}
+
+	details := map[string]string{
+		"score":   strconv.Itoa(risk.Score),
+		"signals": strings.Join(risk.Signals, ","),
+	}
+
+	if req.EmailCode == "" {
+		h.logger.Printf("[DEBUG] Risky login challenged for user: %s (score %d: %v)", user.Username, risk.Score, risk.Signals)
+		code, err := h.smsCodes.issue(user.ID, smsPurposeRiskChallenge, user.Email, h.clock.Now())
+		if err != nil {
+			h.logger.Printf("[DEBUG] Failed to create login challenge code for %s: %v", user.Username, err)
+			writeStoreError(w, r, err)
+			return false
+		}
+		h.sendEmail(r.Context(), user, userLocale(user, r), "login_challenge", map[string]interface{}{
+			"Username": user.Username,
+			"Code":     code,
+			"IP":       ip,
+			"Minutes":  int(smsCodeTTL.Minutes()),
+		})
+		h.audit.Record(AuditEvent{
+			Type:    AuditLoginChallenged,
+			UserID:  user.ID,
+			IP:      ip,
+			Details: details,
+		})
+
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "This sign-in looks unusual, enter the code we emailed you to continue"),
+			Data: map[string]interface{}{
+				"challengeRequired": true,
+				"methods":           []string{"email"},
+			},
+		})
+		return false
+	}
+
+	if _, ok := h.smsCodes.verify(user.ID, smsPurposeRiskChallenge, req.EmailCode, h.clock.Now()); !ok {
+		h.logger.Printf("[DEBUG] Invalid login challenge code for user: %s", user.Username)
+		h.recordLoginFailure(req.Username, ip)
+		details["username"] = req.Username
+		details["reason"] = "invalid challenge code"
+		h.audit.Record(AuditEvent{
+			Type:    AuditLoginFailed,
+			UserID:  user.ID,
+			IP:      ip,
+			Details: details,
+		})
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Invalid or expired code"),
+			Data:    map[string]bool{"challengeRequired": true},
+		})
+		return false
+	}
+	return true
+}
+
+// riskSignals returns the names of the risk signals, sorted
+func riskSignals() []string {
+	signals := make([]string, 0, len(defaultRiskWeights))
+	for signal := range defaultRiskWeights {
+		signals = append(signals, signal)
+	}
+	sort.Strings(signals)
+	return signals
+}
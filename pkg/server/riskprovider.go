@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Flows a RiskProvider is consulted on
+const (
+	RiskFlowRegister = "register"
+	RiskFlowLogin    = "login"
+)
+
+// RiskAction is a RiskProvider's verdict on a request
+type RiskAction string
+
+const (
+	// RiskAllow lets the request continue as usual
+	RiskAllow RiskAction = "allow"
+	// RiskChallenge asks for more proof: a login needs an emailed code
+	// and a registration is held for an admin to review
+	RiskChallenge RiskAction = "challenge"
+	// RiskDeny refuses the request
+	RiskDeny RiskAction = "deny"
+)
+
+// RiskRequest describes the registration or login being assessed
+type RiskRequest struct {
+	Flow      string // RiskFlowRegister or RiskFlowLogin
+	IP        string
+	Email     string
+	Username  string
+	UserID    string // set for logins, once the password checked out
+	Device    string // fingerprint of the client device
+	UserAgent string
+}
+
+// RiskDecision is a RiskProvider's answer. Reason is recorded in the audit
+// log, never shown to the client.
+type RiskDecision struct {
+	Action RiskAction
+	Reason string
+}
+
+// RiskProvider assesses registrations and logins, e.g. by asking an
+// internal fraud service or a reputation API about the address, email and
+// device. Register providers with Server.AddRiskProvider.
+type RiskProvider interface {
+	Assess(ctx context.Context, req RiskRequest) (RiskDecision, error)
+}
+
+// RiskProviderFunc adapts a function to the RiskProvider interface
+type RiskProviderFunc func(ctx context.Context, req RiskRequest) (RiskDecision, error)
+
+func (f RiskProviderFunc) Assess(ctx context.Context, req RiskRequest) (RiskDecision, error) {
+	return f(ctx, req)
+}
+
+// AddRiskProvider adds a provider consulted on every registration and
+// login. It must be called before the server starts handling requests.
+func (s *Server) AddRiskProvider(provider RiskProvider) {
+	s.authHandler.riskProviders = append(s.authHandler.riskProviders, provider)
+}
+
+// assessRisk asks every provider about req, stopping at the first denial.
+// A challenge from any provider stands unless another denies. A provider
+// that fails or runs out of time denies when Config.RiskProviderFailClosed
+// is set and is skipped otherwise.
+func (h *AuthHandler) assessRisk(ctx context.Context, req RiskRequest) RiskDecision {
+	verdict := RiskDecision{Action: RiskAllow}
+	var reasons []string
+	for _, provider := range h.riskProviders {
+		assessCtx, cancel := context.WithTimeout(ctx, h.config.RiskProviderTimeout)
+		decision, err := provider.Assess(assessCtx, req)
+		cancel()
+
+		if err != nil {
+			h.logger.Printf("[DEBUG] Risk provider failed on %s for %s: %v", req.Flow, req.IP, err)
+			if !h.config.RiskProviderFailClosed {
+				continue
+			}
+			decision = RiskDecision{Action: RiskDeny, Reason: "risk provider unavailable"}
+		}
+
+		switch decision.Action {
+		case RiskDeny:
+			return decision
+		case RiskChallenge:
+			verdict.Action = RiskChallenge
+			if decision.Reason != "" {
+				reasons = append(reasons, decision.Reason)
+			}
+		}
+	}
+	verdict.Reason = strings.Join(reasons, "; ")
+	return verdict
+}
+
+// writeRiskDenied refuses a request a risk provider denied, without saying
+// why
+func writeRiskDenied(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(Response{
+		Success: false,
+		Message: localize(r, "Request rejected"),
+	})
+}
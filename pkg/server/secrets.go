@@ -0,0 +1,257 @@
+package server
+
+import (
+	"auth-server/pkg/jwt"
+	"auth-server/pkg/secrets"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secrets read from the secrets backend, along with the password peppers
+// described in pepper.go. Any other names are available to embedding
+// applications through Server.Secret, e.g. database credentials.
+const (
+	// secretSession holds the session cookie key pairs, in the format of
+	// SESSION_KEYS. A new value takes effect immediately; cookies made
+	// with the previous current pair stay valid.
+	secretSession = "session_secret"
+	// secretSigningKey is a PEM encoded P-256 key that signs access
+	// tokens. It replaces scheduled key rotation; a new value becomes the
+	// current key and the previous one is retired.
+	secretSigningKey = "jwt_signing_key"
+	// secretMasterKey is the hex encoded Config.MasterKey. It is only read
+	// at startup since data encrypted under the old key would be lost.
+	secretMasterKey = "master_key"
+)
+
+// secretFetchTimeout bounds a single fetch from the secrets backend
+const secretFetchTimeout = 30 * time.Second
+
+// secretManager keeps the latest values from a secrets backend and tells
+// subscribers when they change
+type secretManager struct {
+	source   secrets.Source
+	interval time.Duration
+	logger   *log.Logger
+
+	mutex  sync.RWMutex
+	values map[string]string
+	hooks  []func(name, value string)
+}
+
+// newSecretManager loads the secrets once. It returns nil when no backend
+// is configured.
+func newSecretManager(cfg Config) (*secretManager, error) {
+	source, err := newSecretSourceFromConfig(cfg)
+	if err != nil || source == nil {
+		return nil, err
+	}
+
+	m := &secretManager{source: source, interval: cfg.SecretsRefreshInterval, logger: cfg.Logger}
+	if err := m.refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	cfg.Logger.Printf("[DEBUG] Loaded %d secrets from the secrets backend", len(m.values))
+	return m, nil
+}
+
+// get returns the value of a secret, or "" when the backend has none
+func (m *secretManager) get(name string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.values[name]
+}
+
+// snapshot returns a copy of every secret
+func (m *secretManager) snapshot() map[string]string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	values := make(map[string]string, len(m.values))
+	for name, value := range m.values {
+		values[name] = value
+	}
+	return values
+}
+
+// onChange registers fn to be called with each secret whose value changes
+// on a later refresh
+func (m *secretManager) onChange(fn func(name, value string)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.hooks = append(m.hooks, fn)
+}
+
+// refresh fetches the secrets and notifies subscribers of changed values.
+// Secrets missing from the backend keep their last value.
+func (m *secretManager) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, secretFetchTimeout)
+	defer cancel()
+	fetched, err := m.source.Fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching secrets: %w", err)
+	}
+
+	m.mutex.Lock()
+	values := make(map[string]string, len(fetched))
+	for name, value := range m.values {
+		values[name] = value
+	}
+	var changed []string
+	for name, value := range fetched {
+		if values[name] != value {
+			values[name] = value
+			changed = append(changed, name)
+		}
+	}
+	m.values = values
+	hooks := m.hooks
+	m.mutex.Unlock()
+
+	for _, name := range changed {
+		for _, hook := range hooks {
+			hook(name, values[name])
+		}
+	}
+	return nil
+}
+
+// start refreshes the secrets every interval until the returned stop
+// function is called. Failed refreshes keep the previous values.
+func (m *secretManager) start() (stop func()) {
+	ticker := time.NewTicker(m.interval)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ticker.C:
+				if err := m.refresh(context.Background()); err != nil {
+					m.logger.Printf("[DEBUG] Secret refresh failed, keeping previous values: %v", err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// masterKey decodes the master key from the secrets backend, or
+// returns nil when the backend has none
+func (m *secretManager) masterKey() ([]byte, error) {
+	value := m.get(secretMasterKey)
+	if value == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(value)
+	if err != nil || len(key) < 32 {
+		return nil, fmt.Errorf("%s must be at least 32 hex-encoded bytes", secretMasterKey)
+	}
+	return key, nil
+}
+
+// installSigningKey makes the PEM encoded key the current token signing key
+func (s *Server) installSigningKey(value string) error {
+	private, err := jwt.ParsePrivateKey([]byte(value))
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", secretSigningKey, err)
+	}
+	before := s.currentSigningKeyID()
+	current, err := s.tokenKeys.Install(private, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if current.ID != before {
+		s.audit.Record(AuditEvent{
+			Type:    AuditSigningKeyRotated,
+			Details: map[string]string{"kid": current.ID, "source": "secrets backend"},
+		})
+	}
+	return nil
+}
+
+// currentSigningKeyID returns the ID of the key signing new tokens
+func (s *Server) currentSigningKeyID() string {
+	for _, key := range s.tokenKeys.Keys() {
+		if key.State == jwt.KeyStateCurrent {
+			return key.ID
+		}
+	}
+	return ""
+}
+
+// signingKeyManaged reports whether the secrets backend provides the token
+// signing key, in which case the server must not rotate it itself
+func (s *Server) signingKeyManaged() bool {
+	return s.secrets != nil && s.secrets.get(secretSigningKey) != ""
+}
+
+// applySecret puts a changed secret into effect
+func (s *Server) applySecret(name, value string) {
+	switch name {
+	case secretSession:
+		keys, err := parseCookieKeys(value)
+		if err != nil {
+			s.logger.Printf("[DEBUG] Rejected rotated session keys, keeping the current ones: %v", err)
+			return
+		}
+		s.authHandler.rotateCookieKeys(keys)
+		s.logger.Printf("[DEBUG] Session keys rotated")
+		s.audit.Record(AuditEvent{
+			Type:    AuditSecretRotated,
+			Details: map[string]string{"name": name},
+		})
+	case secretSigningKey:
+		if err := s.installSigningKey(value); err != nil {
+			s.logger.Printf("[DEBUG] Failed to install rotated signing key: %v", err)
+		}
+	case secretMasterKey:
+		s.logger.Printf("[DEBUG] %s changed; restart the server to use it", secretMasterKey)
+	default:
+		if !strings.HasPrefix(name, pepperSecretPrefix) {
+			return
+		}
+		if err := s.authHandler.passwords.setPepper(name, value); err != nil {
+			s.logger.Printf("[DEBUG] Failed to install password pepper: %v", err)
+			return
+		}
+		s.logger.Printf("[DEBUG] Password pepper %s installed", name)
+		s.audit.Record(AuditEvent{
+			Type:    AuditSecretRotated,
+			Details: map[string]string{"name": name},
+		})
+	}
+}
+
+// Secret returns the current value of a secret from the secrets backend,
+// or "" when there is no backend or it has no such secret. Embedding
+// applications can use it for their own credentials, such as a database
+// password, together with OnSecretChange.
+func (s *Server) Secret(name string) string {
+	if s.secrets == nil {
+		return ""
+	}
+	return s.secrets.get(name)
+}
+
+// OnSecretChange registers fn to be called when a periodic refresh finds a
+// new value for a secret. It does nothing when there is no backend.
+func (s *Server) OnSecretChange(fn func(name, value string)) {
+	if s.secrets != nil {
+		s.secrets.onChange(fn)
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Security change notices, the names SECURITY_NOTIFICATIONS lists
+const (
+	NoticePasswordChanged   = "password_changed"
+	NoticeTwoFactorDisabled = "two_factor_disabled"
+	NoticeEmailChanged      = "email_changed"
+	NoticeAPIKeyCreated     = "api_key_created"
+)
+
+// securityNotices are all the security change notices, each sent unless
+// SECURITY_NOTIFICATIONS leaves it out
+var securityNotices = []string{
+	NoticePasswordChanged,
+	NoticeTwoFactorDisabled,
+	NoticeEmailChanged,
+	NoticeAPIKeyCreated,
+}
+
+// maxNoticeDeviceLength bounds the User-Agent quoted in a notice
+const maxNoticeDeviceLength = 120
+
+// noticeDevice is how r's User-Agent is quoted to the user, shortened to
+// maxNoticeDeviceLength
+func noticeDevice(r *http.Request) string {
+	device := r.UserAgent()
+	if len(device) > maxNoticeDeviceLength {
+		device = device[:maxNoticeDeviceLength] + "..."
+	}
+	if device == "" {
+		device = "unknown"
+	}
+	return device
+}
+
+// notifySecurityChange emails user that notice happened to their account,
+// when the policy in Config.SecurityNotifications has it on. It goes out
+// whatever the user's notification preferences, since whoever made the
+// change may have turned those off too. The email says when, from where and
+// from which device, and carries a password reset link so the owner can
+// take the account back; changing the password signs out every session.
+// to overrides the recipient, for notices that must reach an address the
+// account no longer has.
+func (h *AuthHandler) notifySecurityChange(r *http.Request, user *User, notice, to string) {
+	if !h.config.SecurityNotifications[notice] {
+		h.logger.Printf("[DEBUG] Skipping %s notice for %s: turned off by policy", notice, user.Username)
+		return
+	}
+
+	now := h.clock.Now()
+	token, err := h.resetTokens.issue(user.ID, now)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to create secure-account link for %s: %v", user.Username, err)
+		return
+	}
+
+	device := noticeDevice(r)
+
+	recipient := *user
+	if to != "" {
+		recipient.Email = to
+	}
+	h.sendEmail(r.Context(), &recipient, userLocale(user, r), "security_change", map[string]string{
+		"Username": user.Username,
+		"Change":   notice,
+		"Time":     now.Format(time.RFC1123),
+		"IP":       clientIP(r),
+		"Device":   device,
+		"Link":     h.config.PublicURL + "/reset-password?token=" + url.QueryEscape(token),
+		"TTL":      h.config.PasswordResetTTL.String(),
+	})
+}
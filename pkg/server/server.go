@@ -0,0 +1,921 @@
+// Package server implements the authentication HTTP server. It can run on
+// its own through Run or be embedded in a larger application via Handler.
+package server
+
+import (
+	"auth-server/pkg/graphql"
+	"auth-server/pkg/ipacl"
+	"auth-server/pkg/jwt"
+	"auth-server/pkg/kerberos"
+	"auth-server/pkg/metrics"
+	"auth-server/pkg/realip"
+	"auth-server/pkg/secrets"
+	"auth-server/pkg/stripe"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// shutdownTimeout bounds how long Run waits for in-flight requests once its
+// context is cancelled
+const shutdownTimeout = 10 * time.Second
+
+// Server is the authentication server. Create one with New, add any extra
+// routes through Router, then call Run or mount Handler in another server.
+type Server struct {
+	config          Config
+	logger          *log.Logger
+	authHandler     *AuthHandler
+	acl             *ipacl.List
+	ipResolver      *realip.Resolver
+	audit           *AuditLog
+	metrics         *metrics.Registry
+	gc              *collector
+	clients         *clientRegistry
+	serviceAccounts *serviceAccountRegistry
+	ssoConnections  *ssoConnectionRegistry
+	ssoLogins       *ssoLoginStore
+	ssoAssertions   *ssoAssertionCache
+	ssoClient       *http.Client
+	devices         *deviceAuthorizationStore
+	tokenKeys       *jwt.KeySet
+	idempotency     *idempotencyStore
+	quotas          *quotaTracker
+	usage           *usageMeter
+	sessionStatus   *sessionWatchers
+	auditStreams    *auditStreams
+	billing         *billingRegistry
+	stripe          *stripe.Client     // nil unless STRIPE_SECRET_KEY is set
+	pages           *pageRenderer      // nil unless hosted pages are enabled
+	graphql         *graphql.Schema    // nil unless the GraphQL endpoint is enabled
+	secrets         *secretManager     // nil unless a secrets backend is configured
+	auditSink       *auditSink         // nil unless AUDIT_SINK_URL is set
+	mtls            *tls.Config        // nil unless MTLS_ADDR is set
+	kerberos        *kerberos.Acceptor // nil unless KERBEROS_KEYTAB is set
+	router          *mux.Router
+	authenticated   *mux.Router // the routes sessionMiddleware guards
+	staticOnce      sync.Once
+	mutex           sync.RWMutex
+}
+
+// New creates a server from cfg, usually obtained from LoadConfig, after
+// applying opts to it
+func New(cfg Config, opts ...Option) (*Server, error) {
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = newStderrLogger()
+	}
+	audit := NewAuditLog(1000)
+	audit.out = cfg.AuditLogOutput
+	registry := metrics.NewRegistry()
+
+	manager, err := newSecretManager(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("loading secrets: %w", err)
+	}
+	var cookieKeys []CookieKeyPair
+	if manager != nil {
+		masterKey, err := manager.masterKey()
+		if err != nil {
+			return nil, err
+		}
+		if masterKey != nil {
+			cfg.MasterKey = masterKey
+		}
+		if value := manager.get(secretSession); value != "" {
+			if cookieKeys, err = parseCookieKeys(value); err != nil {
+				return nil, fmt.Errorf("%s: %w", secretSession, err)
+			}
+		}
+	}
+	if cookieKeys == nil {
+		if cookieKeys, err = cookieKeysFromConfig(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PIIKeyWrapper == nil && cfg.VaultTransitKey != "" {
+		cfg.PIIKeyWrapper = &secrets.VaultTransit{Vault: vaultFromConfig(cfg), Mount: cfg.VaultTransitMount, Key: cfg.VaultTransitKey}
+	}
+	authHandler, err := NewAuthHandler(cookieKeys, cfg, audit)
+	if err != nil {
+		return nil, err
+	}
+	authHandler.passwords.metrics = registry
+	authHandler.slo = newSLOMetrics(registry, cfg.SLIWindow, func() time.Time { return authHandler.clock.Now() },
+		sessionBackend(authHandler.stateless), mailerBackend(cfg))
+	if authHandler.userCache != nil {
+		authHandler.userCache.metrics = registry
+	}
+	if authHandler.maintenance, err = newMaintenanceMode(cfg.MaintenanceFile, cfg.Logger); err != nil {
+		return nil, err
+	}
+	if authHandler.outbox, err = newOutbox(cfg.OutboxFile, cfg.OutboxDeadLetterRetention, cfg.Logger); err != nil {
+		return nil, err
+	}
+	if authHandler.blobs, err = newBlobStoreFromConfig(cfg); err != nil {
+		return nil, fmt.Errorf("blob store: %w", err)
+	}
+	if manager != nil {
+		for name, value := range manager.snapshot() {
+			if err := authHandler.passwords.setPepper(name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sink, err := newAuditSinkFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if sink != nil {
+		sink.metrics = registry
+	}
+
+	gc := newCollector(cfg.GCInterval, registry, cfg.Logger)
+	gc.register("sessions", authHandler.purgeExpiredSessions)
+	if authHandler.stateless != nil {
+		if revoked, ok := authHandler.stateless.revoked.(*memoryRevocations); ok {
+			gc.register("session_revocations", revoked.Purge)
+		}
+	}
+	gc.register("login_failures", authHandler.loginFailures.Purge)
+	gc.register("login_attempts", authHandler.loginAttempts.Purge)
+	gc.register("deleted_users", authHandler.purgeDeletedUsers)
+	gc.register("dormant_accounts", authHandler.enforceDormancy)
+	gc.register("signup_velocity", authHandler.signupVelocity.Purge)
+	gc.register("access_tokens", authHandler.purgeExpiredAccessTokens)
+	gc.register("remembered_devices", authHandler.purgeExpiredRememberedDevices)
+	gc.register("ip_blocks", authHandler.bruteForce.Purge)
+	gc.register("password_reset_tokens", authHandler.resetTokens.Purge)
+	gc.register("magic_links", authHandler.magicLinks.Purge)
+	gc.register("magic_link_requests", authHandler.magicLinkRequests.Purge)
+	gc.register("sms_codes", authHandler.smsCodes.Purge)
+	gc.register("sms_rate_limits", authHandler.smsLimiter.perNumber.Purge)
+	gc.register("outbox_dead_letters", authHandler.outbox.Purge)
+	if authHandler.blobs != nil {
+		gc.register("blobs", authHandler.purgeOrphanedBlobs)
+	}
+
+	// Tokens signed with ephemeral keys stop verifying after a restart
+	tokenKeys, err := jwt.NewKeySet(cfg.SigningKeyGracePeriod)
+	if err != nil {
+		return nil, fmt.Errorf("generating token signing keys: %w", err)
+	}
+	gc.register("signing_keys", tokenKeys.Prune)
+
+	s := &Server{
+		config:          cfg,
+		logger:          cfg.Logger,
+		authHandler:     authHandler,
+		acl:             newACLFromConfig(cfg),
+		ipResolver:      realip.NewResolver(cfg.TrustedProxies),
+		audit:           audit,
+		metrics:         registry,
+		gc:              gc,
+		clients:         newClientRegistry(),
+		serviceAccounts: newServiceAccountRegistry(),
+		ssoConnections:  newSSOConnectionRegistry(),
+		ssoLogins:       newSSOLoginStore(),
+		ssoAssertions:   newSSOAssertionCache(),
+		ssoClient:       &http.Client{Timeout: 10 * time.Second},
+		devices:         newDeviceAuthorizationStore(),
+		tokenKeys:       tokenKeys,
+		idempotency:     newIdempotencyStore(cfg.IdempotencyTTL),
+		quotas:          newQuotaTracker(),
+		usage:           newUsageMeter(cfg.UsageAggregateInterval, cfg.UsageRetention, cfg.Logger),
+		sessionStatus:   newSessionWatchers(),
+		auditStreams:    newAuditStreams(),
+		billing:         newBillingRegistry(),
+		stripe:          newStripeClientFromConfig(cfg),
+		router:          mux.NewRouter(),
+		secrets:         manager,
+		auditSink:       sink,
+	}
+	if cfg.MTLSAddr != "" {
+		if s.mtls, err = newMTLSConfig(cfg); err != nil {
+			return nil, fmt.Errorf("mTLS listener: %w", err)
+		}
+	}
+	if cfg.PolicyFile != "" || cfg.PolicyModelFile != "" {
+		if authHandler.policy, err = newPolicyEngineFromConfig(cfg); err != nil {
+			return nil, fmt.Errorf("policy: %w", err)
+		}
+	}
+	if cfg.AccessRulesFile != "" {
+		if authHandler.accessRules, err = newAccessRules(cfg.AccessRulesFile, cfg.PolicyReloadInterval, cfg.Logger); err != nil {
+			return nil, fmt.Errorf("access rules: %w", err)
+		}
+	}
+	if cfg.ProvisioningRulesFile != "" {
+		if authHandler.provisioningRules, err = newProvisioningRules(cfg.ProvisioningRulesFile, cfg.PolicyReloadInterval, cfg.Logger); err != nil {
+			return nil, fmt.Errorf("provisioning rules: %w", err)
+		}
+	}
+	if cfg.EmailTemplatesDir != "" {
+		if authHandler.emailTemplates, err = newEmailTemplateStore(cfg.EmailTemplatesDir, cfg.PublicURL, cfg.Logger); err != nil {
+			return nil, fmt.Errorf("email templates: %w", err)
+		}
+	}
+	if cfg.KerberosKeytab != "" {
+		if s.kerberos, err = newKerberosAcceptor(cfg, authHandler); err != nil {
+			return nil, fmt.Errorf("kerberos: %w", err)
+		}
+	}
+	authHandler.events.Subscribe(s.sessionStatus.observe)
+	gc.register("idempotency_keys", s.idempotency.Purge)
+	gc.register("quota_usage", s.quotas.Purge)
+	gc.register("usage_records", s.usage.Purge)
+	gc.register("device_authorizations", s.devices.Purge)
+	gc.register("sso_logins", s.ssoLogins.Purge)
+	gc.register("sso_assertions", s.ssoAssertions.Purge)
+	if manager != nil {
+		if value := manager.get(secretSigningKey); value != "" {
+			if err := s.installSigningKey(value); err != nil {
+				return nil, err
+			}
+		}
+		manager.onChange(s.applySecret)
+	}
+	s.routes()
+	if err := s.pageRoutes(); err != nil {
+		return nil, err
+	}
+	s.graphqlRoutes()
+	return s, nil
+}
+
+// routes registers every API route and the middleware applied to them
+func (s *Server) routes() {
+	router := s.router
+
+	// Routes declare their methods, so handlers need not check them
+	router.MethodNotAllowedHandler = http.HandlerFunc(s.methodNotAllowedHandler)
+
+	// Routes for signed-in users go on authenticated, whose handlers take
+	// the session user from the request context instead of looking it up
+	authenticated := router.NewRoute().Subrouter()
+	authenticated.Use(s.sessionMiddleware)
+	s.authenticated = authenticated
+
+	router.HandleFunc("/api/register", s.RegisterHandler).Methods("POST")
+	router.HandleFunc("/api/login", s.LoginHandler).Methods("POST")
+	router.HandleFunc("/api/login/magic-link", s.MagicLinkRequestHandler).Methods("POST")
+	router.HandleFunc("/api/login/magic-link/verify", s.MagicLinkVerifyHandler).Methods("GET")
+	if s.kerberos != nil {
+		router.HandleFunc("/api/login/kerberos", s.KerberosLoginHandler).Methods("GET")
+	}
+	router.HandleFunc("/api/login/sso", s.SSOLoginHandler).Methods("GET", "POST")
+	router.HandleFunc("/api/login/sso/{id}/oidc/callback", s.SSOCallbackHandler).Methods("GET")
+	router.HandleFunc("/api/login/sso/{id}/saml/acs", s.SSOAssertionHandler).Methods("POST")
+	router.HandleFunc("/api/login/sso/{id}/saml/metadata", s.SSOServiceProviderMetadataHandler).Methods("GET")
+	router.HandleFunc("/api/logout", s.LogoutHandler).Methods("POST")
+	authenticated.HandleFunc("/api/profile", s.ProfileHandler).Methods("GET")
+	router.HandleFunc("/api/ws", s.SessionStatusHandler).Methods("GET")
+	authenticated.HandleFunc("/api/profile", s.UpdateProfileHandler).Methods("PATCH")
+	authenticated.HandleFunc("/api/profile/avatar", s.AvatarUploadHandler).Methods("PUT")
+	authenticated.HandleFunc("/api/profile/avatar", s.AvatarDeleteHandler).Methods("DELETE")
+	router.HandleFunc("/api/avatars/{key}", s.AvatarHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/api/blobs/{key}", s.BlobHandler).Methods("GET", "HEAD")
+	authenticated.HandleFunc("/api/preferences", s.PreferencesHandler).Methods("GET", "PUT")
+	authenticated.HandleFunc("/api/account/export", s.AccountExportHandler).Methods("GET")
+	authenticated.HandleFunc("/api/account", s.AccountDeleteHandler).Methods("DELETE")
+	authenticated.HandleFunc("/api/identities", s.IdentitiesHandler).Methods("GET")
+	authenticated.HandleFunc("/api/identities/{id}", s.IdentityDeleteHandler).Methods("DELETE")
+	authenticated.HandleFunc("/api/account/merge", s.AccountMergeHandler).Methods("POST")
+	authenticated.HandleFunc("/api/account/merge/undo", s.AccountUnmergeHandler).Methods("POST")
+	authenticated.HandleFunc("/api/2fa", s.TwoFactorStatusHandler).Methods("GET")
+	authenticated.HandleFunc("/api/2fa/setup", s.TwoFactorSetupHandler).Methods("POST")
+	authenticated.HandleFunc("/api/2fa/enable", s.TwoFactorEnableHandler).Methods("POST")
+	authenticated.HandleFunc("/api/2fa/disable", s.TwoFactorDisableHandler).Methods("POST")
+	authenticated.HandleFunc("/api/2fa/recovery-codes", s.RecoveryCodesHandler).Methods("POST")
+	authenticated.HandleFunc("/api/2fa/sms/enable", s.SMSTwoFactorEnableHandler).Methods("POST")
+	authenticated.HandleFunc("/api/2fa/sms/disable", s.SMSTwoFactorDisableHandler).Methods("POST")
+	authenticated.HandleFunc("/api/2fa/sms/send", s.SMSCodeHandler).Methods("POST")
+	authenticated.HandleFunc("/api/phone", s.PhoneHandler).Methods("POST")
+	authenticated.HandleFunc("/api/phone/verify", s.PhoneVerifyHandler).Methods("POST")
+	router.HandleFunc("/api/reauth", s.ReauthHandler).Methods("POST")
+	router.HandleFunc("/api/legal", s.LegalDocumentsHandler).Methods("GET")
+	authenticated.HandleFunc("/api/change-password", s.ChangePasswordHandler).Methods("POST")
+	authenticated.HandleFunc("/api/change-email", s.ChangeEmailHandler).Methods("POST")
+	authenticated.HandleFunc("/api/change-username", s.ChangeUsernameHandler).Methods("POST")
+	router.HandleFunc("/api/users/{username}/public", s.PublicProfileHandler).Methods("GET")
+	authenticated.HandleFunc("/api/change-locale", s.ChangeLocaleHandler).Methods("POST")
+	authenticated.HandleFunc("/api/api-secret", s.APISecretHandler).Methods("GET", "POST")
+	authenticated.HandleFunc("/api/tokens", s.AccessTokensHandler).Methods("GET", "POST")
+	authenticated.HandleFunc("/api/tokens/{id}", s.AccessTokenDeleteHandler).Methods("DELETE")
+	authenticated.HandleFunc("/api/remembered-devices", s.RememberedDevicesHandler).Methods("GET")
+	authenticated.HandleFunc("/api/remembered-devices/{id}", s.RememberedDeviceDeleteHandler).Methods("DELETE")
+	router.HandleFunc("/api/password-reset/request", s.PasswordResetRequestHandler).Methods("POST")
+	router.HandleFunc("/api/password-reset/confirm", s.PasswordResetConfirmHandler).Methods("POST")
+	router.HandleFunc("/api/base64/encode", s.Base64EncodeHandler).Methods("POST")
+	router.HandleFunc("/api/base64/decode", s.Base64DecodeHandler).Methods("POST")
+	router.HandleFunc("/api/base64/encode-file", s.Base64EncodeFileHandler).Methods("POST")
+	router.HandleFunc("/api/base64/encode/stream", s.Base64EncodeStreamHandler).Methods("POST")
+	router.HandleFunc("/api/base64/decode/stream", s.Base64DecodeStreamHandler).Methods("POST")
+	router.HandleFunc("/api/transform", s.TransformHandler).Methods("POST")
+	router.HandleFunc("/api/hash", s.HashHandler).Methods("POST")
+	authenticated.HandleFunc("/api/hmac", s.HMACHandler).Methods("POST")
+	authenticated.HandleFunc("/api/encrypt", s.EncryptHandler).Methods("POST")
+	authenticated.HandleFunc("/api/decrypt", s.DecryptHandler).Methods("POST")
+	router.HandleFunc("/api/random", s.RandomHandler).Methods("GET")
+	router.HandleFunc("/api/usage", s.UsageHandler).Methods("GET")
+	authenticated.HandleFunc("/api/billing", s.BillingHandler).Methods("GET")
+	authenticated.HandleFunc("/api/billing/customer", s.BillingCustomerHandler).Methods("POST")
+	router.HandleFunc("/api/billing/stripe/webhook", s.StripeWebhookHandler).Methods("POST")
+	router.HandleFunc("/api/flags", s.FlagsHandler).Methods("GET")
+	router.HandleFunc("/api/health", s.HealthHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/acl", s.ACLRulesHandler).Methods("GET", "POST")
+	authenticated.HandleFunc("/api/admin/acl/{id}", s.ACLRuleDeleteHandler).Methods("DELETE")
+	authenticated.HandleFunc("/api/admin/geo-policy", s.GeoPolicyHandler).Methods("GET", "PUT")
+	authenticated.HandleFunc("/api/admin/email-policy", s.EmailPolicyHandler).Methods("GET", "PUT")
+	authenticated.HandleFunc("/api/admin/username-policy", s.UsernamePolicyHandler).Methods("GET", "PUT")
+	authenticated.HandleFunc("/api/admin/gc", s.GCHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/blocked-ips", s.BlockedIPsHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/blocked-ips/{ip}", s.BlockedIPDeleteHandler).Methods("DELETE")
+	authenticated.HandleFunc("/api/admin/security", s.SecurityOverviewHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/reports/security-posture", s.SecurityPostureHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/reports/usage", s.UsageReportHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/maintenance", s.MaintenanceHandler).Methods("GET", "PUT")
+	authenticated.HandleFunc("/api/admin/flags", s.AdminFlagsHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/flags/{name}", s.AdminFlagUpdateHandler).Methods("PUT")
+	authenticated.HandleFunc("/api/admin/events/stream", s.AuditStreamHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/outbox", s.AdminOutboxHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/outbox/{id}/redeliver", s.AdminOutboxRedeliverHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/webhooks/deliveries", s.AdminWebhookDeliveriesHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/webhooks/deliveries/{id}", s.AdminWebhookDeliveryHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/webhooks/deliveries/{id}/replay", s.AdminWebhookReplayHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/webhooks/endpoints", s.AdminWebhookEndpointsHandler).Methods("GET", "PUT")
+	authenticated.HandleFunc("/api/admin/clients", s.ClientsHandler).Methods("GET", "POST")
+	authenticated.HandleFunc("/api/admin/clients/{id}", s.ClientDeleteHandler).Methods("DELETE")
+	authenticated.HandleFunc("/api/admin/service-accounts", s.ServiceAccountsHandler).Methods("GET", "POST")
+	authenticated.HandleFunc("/api/admin/service-accounts/{id}", s.ServiceAccountHandler).Methods("GET", "PATCH", "DELETE")
+	authenticated.HandleFunc("/api/admin/service-accounts/{id}/keys", s.ServiceAccountKeysHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/service-accounts/{id}/keys/{keyId}", s.ServiceAccountKeyDeleteHandler).Methods("DELETE")
+	authenticated.HandleFunc("/api/admin/service-accounts/{id}/audit", s.ServiceAccountAuditHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/sso/connections", s.SSOConnectionsHandler).Methods("GET", "POST")
+	authenticated.HandleFunc("/api/admin/sso/connections/{id}", s.SSOConnectionHandler).Methods("GET", "PATCH", "DELETE")
+	authenticated.HandleFunc("/api/admin/sso/connections/{id}/metadata", s.SSOMetadataHandler).Methods("PUT")
+	authenticated.HandleFunc("/api/admin/users/search", s.AdminUserSearchHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/signups/review", s.AdminSignupReviewsHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/signups/review/{id}/approve", s.AdminSignupApproveHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/signups/review/{id}/reject", s.AdminSignupRejectHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/users/deleted", s.AdminDeletedUsersHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/users/{id}", s.AdminUserDeleteHandler).Methods("DELETE")
+	authenticated.HandleFunc("/api/admin/users/{id}/restore", s.AdminUserRestoreHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/users/{id}/suspend", s.AdminSuspendHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/users/{id}/unsuspend", s.AdminUnsuspendHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/users/merge", s.AdminMergeHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/users/{id}/unmerge", s.AdminUnmergeHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/users/{id}/role", s.AdminRoleHandler).Methods("PUT")
+	authenticated.HandleFunc("/api/admin/bootstrap", s.AdminBootstrapHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/policy", s.PolicyHandler).Methods("GET", "PUT")
+	authenticated.HandleFunc("/api/admin/policy/reload", s.PolicyReloadHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/policy/enforce", s.PolicyEnforceHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/access-rules", s.AccessRulesHandler).Methods("GET", "PUT")
+	authenticated.HandleFunc("/api/admin/access-rules/reload", s.AccessRulesReloadHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/provisioning-rules", s.ProvisioningRulesHandler).Methods("GET", "PUT")
+	authenticated.HandleFunc("/api/admin/provisioning-rules/reload", s.ProvisioningRulesReloadHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/email-templates", s.EmailTemplatesHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/email-templates/{locale}/{name}", s.EmailTemplateHandler).Methods("GET", "PUT", "DELETE")
+	authenticated.HandleFunc("/api/admin/email-templates/{locale}/{name}/preview", s.EmailTemplatePreviewHandler).Methods("POST")
+	authenticated.HandleFunc("/api/admin/billing/accounts", s.AdminBillingAccountsHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/billing/accounts/{account}", s.AdminBillingAccountHandler).Methods("PUT")
+	router.HandleFunc("/oauth/token", s.TokenHandler).Methods("POST")
+	router.HandleFunc("/api/oauth/device/code", s.DeviceAuthorizationHandler).Methods("POST")
+	authenticated.HandleFunc("/api/oauth/device/verify", s.DeviceVerifyHandler).Methods("GET", "POST")
+	router.HandleFunc("/.well-known/jwks.json", s.JWKSHandler).Methods("GET")
+	authenticated.HandleFunc("/api/admin/signing-keys", s.SigningKeysHandler).Methods("GET", "POST")
+	router.HandleFunc("/api/internal/users/{id}", s.RequireScope(ScopeUsersRead, s.InternalUserHandler)).Methods("GET")
+	router.HandleFunc("/metrics", s.MetricsHandler).Methods("GET")
+	s.logger.Printf("[DEBUG] All API routes registered")
+
+	// Turn panics into 500s around everything, and log each request once
+	// it has been answered
+	router.Use(s.recoveryMiddleware)
+	router.Use(s.requestLogMiddleware)
+
+	// Time auth routes around the middleware below, so their latency is
+	// what clients see. Wrong methods are answered by the router before
+	// any middleware runs, so they are not timed.
+	router.Use(s.sloMiddleware)
+
+	// Resolve the real client IP first so access rules, rate limits and
+	// audit logs see the original client rather than the load balancer
+	router.Use(s.realIPMiddleware)
+
+	// Render JSON responses as XML or MessagePack when the client asks,
+	// around everything else so rejections are converted too
+	router.Use(s.formatMiddleware)
+
+	// Label API responses as JSON unless the handler chose another type,
+	// inside formatMiddleware, which decides by it
+	router.Use(s.jsonMiddleware)
+
+	// Enforce network access rules on every route
+	router.Use(s.aclMiddleware)
+
+	// Put a deadline on every request's context
+	router.Use(s.timeoutMiddleware)
+
+	// Choose the response language once the deadline is in place, since
+	// it may look up the session user
+	router.Use(s.localeMiddleware)
+
+	// Refuse requests during maintenance once the response language is known
+	router.Use(s.maintenanceMiddleware)
+
+	// Sign in users vouched for by an SSO proxy before anything looks at
+	// the session
+	router.Use(s.trustedHeaderMiddleware)
+
+	// Sign remembered browsers in again once their session has ended
+	router.Use(s.rememberMeMiddleware)
+
+	// Demand stronger authentication where a step-up policy applies
+	router.Use(s.stepUpMiddleware)
+
+	// Authenticate personal access tokens for the routes their scopes
+	// cover, after step-up policies, which apply to sessions only
+	router.Use(s.accessTokenMiddleware)
+
+	// Meter requests by API key once access tokens are known, counting
+	// those the checks below refuse too
+	router.Use(s.usageMiddleware)
+
+	// Check admin permissions once access tokens have been resolved to
+	// their user
+	router.Use(s.permissionMiddleware)
+
+	// Apply attribute-based access rules to the session user
+	router.Use(s.accessRulesMiddleware)
+
+	// Hold users to what their tier allows, then count requests to the
+	// metered routes against the caller's quota, which also depends on it
+	router.Use(s.tierMiddleware)
+	router.Use(s.quotaMiddleware)
+
+	// Replay stored responses for retried POSTs last, so a replay still
+	// passes the access rules and is in the client's language
+	router.Use(s.idempotencyMiddleware)
+
+	// Fault injection, only in builds made with -tags chaos
+	s.installChaos()
+}
+
+// Router returns the server's router so embedding applications can register
+// extra routes. Routes added here get the same client IP and access rule
+// middleware as the built-in API.
+func (s *Server) Router() *mux.Router {
+	return s.router
+}
+
+// Handler returns the complete HTTP handler. The frontend fallback is added
+// on first call, after any routes registered through Router.
+func (s *Server) Handler() http.Handler {
+	s.staticOnce.Do(func() {
+		// Serve the frontend, with client-side routes falling back to
+		// index.html. API paths are left to the router, so a wrong method
+		// there is a 405 and an unknown route a 404. That check comes first:
+		// mux forgets an earlier route's method mismatch as soon as any
+		// matcher of a later route succeeds.
+		frontend := func(r *http.Request, _ *mux.RouteMatch) bool { return !isAPIPath(r.URL.Path) }
+		s.router.MatcherFunc(frontend).PathPrefix("/").Methods("GET", "HEAD").Handler(&spaHandler{files: s.staticFiles(), basePath: s.config.BasePath, logger: s.logger})
+		s.logger.Printf("[DEBUG] Static file handler registered")
+	})
+	if s.config.BasePath == "" {
+		return s.router
+	}
+	return stripBasePath(s.config.BasePath, s.router)
+}
+
+// stripBasePath removes basePath from request paths before next routes
+// them. Gateways differ in whether they strip the prefix themselves, so
+// paths without it are passed through unchanged.
+func stripBasePath(basePath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, basePath)
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if rest == "" {
+			rest = "/"
+		}
+
+		stripped := r.Clone(r.Context())
+		stripped.URL.Path = rest
+		stripped.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, basePath)
+		next.ServeHTTP(w, stripped)
+	})
+}
+
+// Run starts background jobs and serves HTTP on Config.Addr, and on
+// Config.MTLSAddr when set, until ctx is cancelled, then shuts down
+// gracefully
+func (s *Server) Run(ctx context.Context) (err error) {
+	// Deferred first so the bus closes after every background job below
+	// has stopped and can no longer publish
+	defer func() {
+		if closeErr := s.authHandler.events.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	stopGC := s.gc.start()
+	defer stopGC()
+	stopRotation := s.startKeyRotation()
+	defer stopRotation()
+	stopOutbox := s.authHandler.startOutbox()
+	defer stopOutbox()
+	stopUsage := s.usage.start()
+	defer stopUsage()
+	if s.secrets != nil {
+		stopSecrets := s.secrets.start()
+		defer stopSecrets()
+	}
+	if s.authHandler.policy.path != "" {
+		stopPolicy := s.authHandler.policy.start()
+		defer stopPolicy()
+	}
+	if s.authHandler.accessRules.path != "" {
+		stopAccessRules := s.authHandler.accessRules.start()
+		defer stopAccessRules()
+	}
+	if s.authHandler.provisioningRules.path != "" {
+		stopProvisioningRules := s.authHandler.provisioningRules.start()
+		defer stopProvisioningRules()
+	}
+	if s.auditSink != nil {
+		stopSink := s.auditSink.start(s.audit)
+		defer stopSink()
+	}
+	if s.authHandler.alerts != nil {
+		stopAlerts := s.authHandler.alerts.start(s.audit)
+		defer stopAlerts()
+	}
+
+	listener, err := s.listen()
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", s.config.Addr, err)
+	}
+	httpServer := s.newHTTPServer()
+	servers := []*http.Server{httpServer}
+
+	errs := make(chan error, 2)
+	go func() {
+		s.logger.Printf("[DEBUG] Server starting on %s", listener.Addr())
+		errs <- httpServer.Serve(listener)
+	}()
+
+	if s.mtls != nil {
+		mtlsListener, err := s.listenMTLS()
+		if err != nil {
+			httpServer.Close()
+			return fmt.Errorf("listening on %s: %w", s.config.MTLSAddr, err)
+		}
+		mtlsServer := s.newHTTPServer()
+		mtlsServer.TLSConfig = s.mtls.Clone()
+		servers = append(servers, mtlsServer)
+		go func() {
+			s.logger.Printf("[DEBUG] mTLS listener starting on %s", mtlsListener.Addr())
+			errs <- mtlsServer.ServeTLS(mtlsListener, "", "")
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		for _, server := range servers {
+			server.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	s.logger.Printf("[DEBUG] Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if shutdownErr := server.Shutdown(shutdownCtx); err == nil {
+			err = shutdownErr
+		}
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return err
+}
+
+// RegisterHandler delegates to AuthHandler
+func (s *Server) RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.RegisterHandler(w, r)
+}
+
+// LoginHandler delegates to AuthHandler
+func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.LoginHandler(w, r)
+}
+
+// LogoutHandler delegates to AuthHandler
+func (s *Server) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.LogoutHandler(w, r)
+}
+
+// ProfileHandler delegates to AuthHandler
+func (s *Server) ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.ProfileHandler(w, r)
+}
+
+// UpdateProfileHandler delegates to AuthHandler
+func (s *Server) UpdateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.UpdateProfileHandler(w, r)
+}
+
+// AvatarUploadHandler delegates to AuthHandler
+func (s *Server) AvatarUploadHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AvatarUploadHandler(w, r)
+}
+
+// AvatarDeleteHandler delegates to AuthHandler
+func (s *Server) AvatarDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AvatarDeleteHandler(w, r)
+}
+
+// AvatarHandler delegates to AuthHandler
+func (s *Server) AvatarHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AvatarHandler(w, r)
+}
+
+// BlobHandler delegates to AuthHandler
+func (s *Server) BlobHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.BlobHandler(w, r)
+}
+
+// PreferencesHandler delegates to AuthHandler
+func (s *Server) PreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.PreferencesHandler(w, r)
+}
+
+// AccountExportHandler delegates to AuthHandler
+func (s *Server) AccountExportHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AccountExportHandler(w, r)
+}
+
+// IdentitiesHandler delegates to AuthHandler
+func (s *Server) IdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.IdentitiesHandler(w, r)
+}
+
+// IdentityDeleteHandler delegates to AuthHandler
+func (s *Server) IdentityDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.IdentityDeleteHandler(w, r)
+}
+
+// AccountMergeHandler delegates to AuthHandler
+func (s *Server) AccountMergeHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AccountMergeHandler(w, r)
+}
+
+// AccountUnmergeHandler delegates to AuthHandler
+func (s *Server) AccountUnmergeHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AccountUnmergeHandler(w, r)
+}
+
+// AdminUserSearchHandler delegates to AuthHandler
+func (s *Server) AdminUserSearchHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminUserSearchHandler(w, r)
+}
+
+// AccountDeleteHandler delegates to AuthHandler
+func (s *Server) AccountDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AccountDeleteHandler(w, r)
+}
+
+// AdminDeletedUsersHandler delegates to AuthHandler
+func (s *Server) AdminDeletedUsersHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminDeletedUsersHandler(w, r)
+}
+
+// AdminUserDeleteHandler delegates to AuthHandler
+func (s *Server) AdminUserDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminUserDeleteHandler(w, r)
+}
+
+// AdminUserRestoreHandler delegates to AuthHandler
+func (s *Server) AdminUserRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminUserRestoreHandler(w, r)
+}
+
+// AdminSuspendHandler delegates to AuthHandler
+func (s *Server) AdminSuspendHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminSuspendHandler(w, r)
+}
+
+// AdminUnsuspendHandler delegates to AuthHandler
+func (s *Server) AdminUnsuspendHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminUnsuspendHandler(w, r)
+}
+
+// AdminMergeHandler delegates to AuthHandler
+func (s *Server) AdminMergeHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminMergeHandler(w, r)
+}
+
+// AdminUnmergeHandler delegates to AuthHandler
+func (s *Server) AdminUnmergeHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminUnmergeHandler(w, r)
+}
+
+// AdminRoleHandler delegates to AuthHandler
+func (s *Server) AdminRoleHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminRoleHandler(w, r)
+}
+
+// AdminBootstrapHandler delegates to AuthHandler
+func (s *Server) AdminBootstrapHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminBootstrapHandler(w, r)
+}
+
+// TwoFactorStatusHandler delegates to AuthHandler
+func (s *Server) TwoFactorStatusHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.TwoFactorStatusHandler(w, r)
+}
+
+// TwoFactorSetupHandler delegates to AuthHandler
+func (s *Server) TwoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.TwoFactorSetupHandler(w, r)
+}
+
+// TwoFactorEnableHandler delegates to AuthHandler
+func (s *Server) TwoFactorEnableHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.TwoFactorEnableHandler(w, r)
+}
+
+// TwoFactorDisableHandler delegates to AuthHandler
+func (s *Server) TwoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.TwoFactorDisableHandler(w, r)
+}
+
+// RecoveryCodesHandler delegates to AuthHandler
+func (s *Server) RecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.RecoveryCodesHandler(w, r)
+}
+
+// SMSTwoFactorEnableHandler delegates to AuthHandler
+func (s *Server) SMSTwoFactorEnableHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.SMSTwoFactorEnableHandler(w, r)
+}
+
+// SMSTwoFactorDisableHandler delegates to AuthHandler
+func (s *Server) SMSTwoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.SMSTwoFactorDisableHandler(w, r)
+}
+
+// SMSCodeHandler delegates to AuthHandler
+func (s *Server) SMSCodeHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.SMSCodeHandler(w, r)
+}
+
+// LegalDocumentsHandler delegates to AuthHandler
+func (s *Server) LegalDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.LegalDocumentsHandler(w, r)
+}
+
+// ReauthHandler delegates to AuthHandler
+func (s *Server) ReauthHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.ReauthHandler(w, r)
+}
+
+// PhoneHandler delegates to AuthHandler
+func (s *Server) PhoneHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.PhoneHandler(w, r)
+}
+
+// PhoneVerifyHandler delegates to AuthHandler
+func (s *Server) PhoneVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.PhoneVerifyHandler(w, r)
+}
+
+// MagicLinkRequestHandler delegates to AuthHandler
+func (s *Server) MagicLinkRequestHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.MagicLinkRequestHandler(w, r)
+}
+
+// MagicLinkVerifyHandler delegates to AuthHandler
+func (s *Server) MagicLinkVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.MagicLinkVerifyHandler(w, r)
+}
+
+// ChangePasswordHandler delegates to AuthHandler
+func (s *Server) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.ChangePasswordHandler(w, r)
+}
+
+// ChangeEmailHandler delegates to AuthHandler
+func (s *Server) ChangeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.ChangeEmailHandler(w, r)
+}
+
+// ChangeUsernameHandler delegates to AuthHandler
+func (s *Server) ChangeUsernameHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.ChangeUsernameHandler(w, r)
+}
+
+// PublicProfileHandler delegates to AuthHandler
+func (s *Server) PublicProfileHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.PublicProfileHandler(w, r)
+}
+
+// ChangeLocaleHandler delegates to AuthHandler
+func (s *Server) ChangeLocaleHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.ChangeLocaleHandler(w, r)
+}
+
+// APISecretHandler delegates to AuthHandler
+func (s *Server) APISecretHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.APISecretHandler(w, r)
+}
+
+// PasswordResetRequestHandler delegates to AuthHandler
+func (s *Server) PasswordResetRequestHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.PasswordResetRequestHandler(w, r)
+}
+
+// PasswordResetConfirmHandler delegates to AuthHandler
+func (s *Server) PasswordResetConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.PasswordResetConfirmHandler(w, r)
+}
+
+// AdminOutboxHandler delegates to AuthHandler
+func (s *Server) AdminOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminOutboxHandler(w, r)
+}
+
+// AdminOutboxRedeliverHandler delegates to AuthHandler
+func (s *Server) AdminOutboxRedeliverHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminOutboxRedeliverHandler(w, r)
+}
+
+// AdminWebhookDeliveriesHandler delegates to AuthHandler
+func (s *Server) AdminWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminWebhookDeliveriesHandler(w, r)
+}
+
+// AdminWebhookDeliveryHandler delegates to AuthHandler
+func (s *Server) AdminWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminWebhookDeliveryHandler(w, r)
+}
+
+// AdminWebhookReplayHandler delegates to AuthHandler
+func (s *Server) AdminWebhookReplayHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminWebhookReplayHandler(w, r)
+}
+
+// AdminWebhookEndpointsHandler delegates to AuthHandler
+func (s *Server) AdminWebhookEndpointsHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminWebhookEndpointsHandler(w, r)
+}
+
+// AdminSignupReviewsHandler delegates to AuthHandler
+func (s *Server) AdminSignupReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminSignupReviewsHandler(w, r)
+}
+
+// AdminSignupApproveHandler delegates to AuthHandler
+func (s *Server) AdminSignupApproveHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminSignupApproveHandler(w, r)
+}
+
+// AdminSignupRejectHandler delegates to AuthHandler
+func (s *Server) AdminSignupRejectHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AdminSignupRejectHandler(w, r)
+}
+
+// AccessTokensHandler delegates to AuthHandler
+func (s *Server) AccessTokensHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AccessTokensHandler(w, r)
+}
+
+// AccessTokenDeleteHandler delegates to AuthHandler
+func (s *Server) AccessTokenDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.AccessTokenDeleteHandler(w, r)
+}
+
+// RememberedDevicesHandler delegates to AuthHandler
+func (s *Server) RememberedDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.RememberedDevicesHandler(w, r)
+}
+
+// RememberedDeviceDeleteHandler delegates to AuthHandler
+func (s *Server) RememberedDeviceDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	s.authHandler.RememberedDeviceDeleteHandler(w, r)
+}
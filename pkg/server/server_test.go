@@ -0,0 +1,9705 @@
+package server
+
+import (
+	"auth-server/pkg/authmiddleware"
+	"auth-server/pkg/blobstore"
+	"auth-server/pkg/captcha"
+	"auth-server/pkg/cryptoutil"
+	"auth-server/pkg/events"
+	"auth-server/pkg/flags"
+	"auth-server/pkg/geoip"
+	"auth-server/pkg/ids"
+	"auth-server/pkg/jwt"
+	"auth-server/pkg/kerberos"
+	"auth-server/pkg/mailer"
+	"auth-server/pkg/realip"
+	"auth-server/pkg/sessionstore"
+	"auth-server/pkg/siem"
+	"auth-server/pkg/sms"
+	"auth-server/pkg/stripe"
+	"auth-server/pkg/totp"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestServer creates a server from the environment's configuration
+func newTestServer(t testing.TB, opts ...Option) *Server {
+	t.Helper()
+
+	cfg := LoadConfig()
+	cfg.OutboxFile = filepath.Join(t.TempDir(), "outbox.json")
+	server, err := New(cfg, opts...)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	return server
+}
+
+func TestNew(t *testing.T) {
+	server := newTestServer(t)
+
+	if server.authHandler == nil {
+		t.Error("Expected authHandler to be initialized")
+	}
+	if server.authHandler != nil && server.authHandler.users == nil {
+		t.Error("Expected user store to be initialized")
+	}
+}
+
+func TestRegisterHandler(t *testing.T) {
+	server := newTestServer(t)
+
+	tests := []struct {
+		name            string
+		request         RegisterRequest
+		expectedStatus  int
+		expectedSuccess bool
+	}{
+		{
+			name: "Valid registration",
+			request: RegisterRequest{
+				Username: "testuser",
+				Email:    "test@example.com",
+				Password: "password123",
+			},
+			expectedStatus:  http.StatusCreated,
+			expectedSuccess: true,
+		},
+		{
+			name: "Missing username",
+			request: RegisterRequest{
+				Email:    "test@example.com",
+				Password: "password123",
+			},
+			expectedStatus:  http.StatusBadRequest,
+			expectedSuccess: false,
+		},
+		{
+			name: "Missing email",
+			request: RegisterRequest{
+				Username: "testuser",
+				Password: "password123",
+			},
+			expectedStatus:  http.StatusBadRequest,
+			expectedSuccess: false,
+		},
+		{
+			name: "Missing password",
+			request: RegisterRequest{
+				Username: "testuser",
+				Email:    "test@example.com",
+			},
+			expectedStatus:  http.StatusBadRequest,
+			expectedSuccess: false,
+		},
+		{
+			name: "Password too short",
+			request: RegisterRequest{
+				Username: "testuser",
+				Email:    "test@example.com",
+				Password: "123",
+			},
+			expectedStatus:  http.StatusBadRequest,
+			expectedSuccess: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.request)
+			req := httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			server.RegisterHandler(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.expectedSuccess {
+				var response Response
+				json.Unmarshal(w.Body.Bytes(), &response)
+
+				if !response.Success {
+					t.Errorf("Expected success response, got: %v", response)
+				}
+
+				users := listUsers(t, server)
+				if len(users) != 1 {
+					t.Errorf("Expected 1 user, got %d", len(users))
+				}
+
+				for _, user := range users {
+					if !ids.HasPrefix(user.ID, ids.PrefixUser) {
+						t.Errorf("Expected user ID with %q prefix, got %q", ids.PrefixUser, user.ID)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterHandlerDuplicateUser(t *testing.T) {
+	server := newTestServer(t)
+
+	// Register first user
+	user1 := RegisterRequest{
+		Username: "testuser",
+		Email:    "test@example.com",
+		Password: "password123",
+	}
+
+	body1, _ := json.Marshal(user1)
+	req1 := httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(body1))
+	req1.Header.Set("Content-Type", "application/json")
+
+	w1 := httptest.NewRecorder()
+	server.RegisterHandler(w1, req1)
+
+	if w1.Code != http.StatusCreated {
+		t.Errorf("Expected first registration to succeed, got status %d", w1.Code)
+	}
+
+	// Try to register duplicate username
+	user2 := RegisterRequest{
+		Username: "testuser",
+		Email:    "different@example.com",
+		Password: "password456",
+	}
+
+	body2, _ := json.Marshal(user2)
+	req2 := httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(body2))
+	req2.Header.Set("Content-Type", "application/json")
+
+	w2 := httptest.NewRecorder()
+	server.RegisterHandler(w2, req2)
+
+	if w2.Code != http.StatusConflict {
+		t.Errorf("Expected duplicate username to fail, got status %d", w2.Code)
+	}
+
+	// Try to register duplicate email
+	user3 := RegisterRequest{
+		Username: "differentuser",
+		Email:    "test@example.com",
+		Password: "password789",
+	}
+
+	body3, _ := json.Marshal(user3)
+	req3 := httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(body3))
+	req3.Header.Set("Content-Type", "application/json")
+
+	w3 := httptest.NewRecorder()
+	server.RegisterHandler(w3, req3)
+
+	if w3.Code != http.StatusConflict {
+		t.Errorf("Expected duplicate email to fail, got status %d", w3.Code)
+	}
+
+	// Should still only have 1 user
+	if users := listUsers(t, server); len(users) != 1 {
+		t.Errorf("Expected 1 user after duplicate attempts, got %d", len(users))
+	}
+}
+
+func TestRegisterHandlerGenericResponse(t *testing.T) {
+	server := newTestServer(t)
+	server.authHandler.config.GenericRegisterResponse = true
+
+	register := func(request RegisterRequest) (int, Response) {
+		body, _ := json.Marshal(request)
+		req := httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		server.RegisterHandler(w, req)
+
+		var response Response
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	firstStatus, first := register(RegisterRequest{Username: "testuser", Email: "test@example.com", Password: "password123"})
+	dupStatus, dup := register(RegisterRequest{Username: "otheruser", Email: "test@example.com", Password: "password456"})
+
+	if firstStatus != dupStatus || first.Message != dup.Message || first.Success != dup.Success {
+		t.Errorf("Expected identical responses for new and taken emails, got %d %v and %d %v", firstStatus, first, dupStatus, dup)
+	}
+
+	if users := listUsers(t, server); len(users) != 1 {
+		t.Errorf("Expected duplicate email not to create a user, got %d users", len(users))
+	}
+}
+
+func TestLoginHandler(t *testing.T) {
+	server := newTestServer(t)
+
+	// First register a user
+	registerReq := RegisterRequest{
+		Username: "testuser",
+		Email:    "test@example.com",
+		Password: "password123",
+	}
+
+	registerBody, _ := json.Marshal(registerReq)
+	registerHTTPReq := httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(registerBody))
+	registerHTTPReq.Header.Set("Content-Type", "application/json")
+
+	registerW := httptest.NewRecorder()
+	server.RegisterHandler(registerW, registerHTTPReq)
+
+	tests := []struct {
+		name            string
+		request         LoginRequest
+		expectedStatus  int
+		expectedSuccess bool
+	}{
+		{
+			name: "Valid login",
+			request: LoginRequest{
+				Username: "testuser",
+				Password: "password123",
+			},
+			expectedStatus:  http.StatusOK,
+			expectedSuccess: true,
+		},
+		{
+			name: "Invalid username",
+			request: LoginRequest{
+				Username: "nonexistent",
+				Password: "password123",
+			},
+			expectedStatus:  http.StatusUnauthorized,
+			expectedSuccess: false,
+		},
+		{
+			name: "Invalid password",
+			request: LoginRequest{
+				Username: "testuser",
+				Password: "wrongpassword",
+			},
+			expectedStatus:  http.StatusUnauthorized,
+			expectedSuccess: false,
+		},
+		{
+			name: "Missing username",
+			request: LoginRequest{
+				Password: "password123",
+			},
+			expectedStatus:  http.StatusBadRequest,
+			expectedSuccess: false,
+		},
+		{
+			name: "Missing password",
+			request: LoginRequest{
+				Username: "testuser",
+			},
+			expectedStatus:  http.StatusBadRequest,
+			expectedSuccess: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.request)
+			req := httptest.NewRequest("POST", "/api/login", bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			server.LoginHandler(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.expectedSuccess {
+				var response Response
+				json.Unmarshal(w.Body.Bytes(), &response)
+
+				if !response.Success {
+					t.Errorf("Expected success response, got: %v", response)
+				}
+
+				// Check that user data is returned
+				if response.Data == nil {
+					t.Error("Expected user data in response")
+				}
+			}
+		})
+	}
+}
+
+func TestProfileHandler(t *testing.T) {
+	server := newTestServer(t)
+
+	// First register and login a user to get a session
+	registerReq := RegisterRequest{
+		Username: "testuser",
+		Email:    "test@example.com",
+		Password: "password123",
+	}
+
+	registerBody, _ := json.Marshal(registerReq)
+	registerHTTPReq := httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(registerBody))
+	registerHTTPReq.Header.Set("Content-Type", "application/json")
+
+	registerW := httptest.NewRecorder()
+	server.RegisterHandler(registerW, registerHTTPReq)
+
+	// Login to create a session
+	loginReq := LoginRequest{
+		Username: "testuser",
+		Password: "password123",
+	}
+
+	loginBody, _ := json.Marshal(loginReq)
+	loginHTTPReq := httptest.NewRequest("POST", "/api/login", bytes.NewBuffer(loginBody))
+	loginHTTPReq.Header.Set("Content-Type", "application/json")
+
+	loginW := httptest.NewRecorder()
+	server.LoginHandler(loginW, loginHTTPReq)
+
+	// Extract cookies from login response
+	cookies := loginW.Result().Cookies()
+
+	tests := []struct {
+		name            string
+		cookies         []*http.Cookie
+		expectedStatus  int
+		expectedSuccess bool
+	}{
+		{
+			name:            "Valid session",
+			cookies:         cookies,
+			expectedStatus:  http.StatusOK,
+			expectedSuccess: true,
+		},
+		{
+			name:            "No cookies",
+			cookies:         []*http.Cookie{},
+			expectedStatus:  http.StatusUnauthorized,
+			expectedSuccess: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/profile", nil)
+
+			// Add cookies if they exist
+			for _, cookie := range tt.cookies {
+				req.AddCookie(cookie)
+			}
+
+			w := httptest.NewRecorder()
+			server.Router().ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.expectedSuccess {
+				var response Response
+				json.Unmarshal(w.Body.Bytes(), &response)
+
+				if !response.Success {
+					t.Errorf("Expected success response, got: %v", response)
+				}
+
+				if response.Data == nil {
+					t.Error("Expected user data in response")
+				}
+			}
+		})
+	}
+}
+
+func TestAccountTimestamps(t *testing.T) {
+	server := newTestServer(t)
+
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	user := findUser(t, server, "testuser")
+
+	if user.LastLoginAt == nil || user.LastLoginIP == "" {
+		t.Errorf("Expected login to record LastLoginAt and LastLoginIP, got %v %q", user.LastLoginAt, user.LastLoginIP)
+	}
+	if user.PasswordChangedAt.IsZero() || user.UpdatedAt.IsZero() {
+		t.Error("Expected registration to set PasswordChangedAt and UpdatedAt")
+	}
+
+	registeredAt := user.PasswordChangedAt
+
+	body, _ := json.Marshal(ChangePasswordRequest{CurrentPassword: "password123", NewPassword: "newpassword456"})
+	req := httptest.NewRequest("POST", "/api/change-password", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	server.Router().ServeHTTP(httptest.NewRecorder(), req)
+
+	user = findUser(t, server, "testuser")
+	if !user.PasswordChangedAt.After(registeredAt) {
+		t.Error("Expected password change to update PasswordChangedAt")
+	}
+
+	if user.PasswordExpired(0, time.Now().Add(1000*time.Hour)) {
+		t.Error("Expected a zero max age to never expire passwords")
+	}
+	if !user.PasswordExpired(time.Hour, time.Now().Add(2*time.Hour)) {
+		t.Error("Expected password older than max age to be expired")
+	}
+}
+
+func TestLogoutHandler(t *testing.T) {
+	server := newTestServer(t)
+
+	// First register and login a user to get a session
+	registerReq := RegisterRequest{
+		Username: "testuser",
+		Email:    "test@example.com",
+		Password: "password123",
+	}
+
+	registerBody, _ := json.Marshal(registerReq)
+	registerHTTPReq := httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(registerBody))
+	registerHTTPReq.Header.Set("Content-Type", "application/json")
+
+	registerW := httptest.NewRecorder()
+	server.RegisterHandler(registerW, registerHTTPReq)
+
+	// Login to create a session
+	loginReq := LoginRequest{
+		Username: "testuser",
+		Password: "password123",
+	}
+
+	loginBody, _ := json.Marshal(loginReq)
+	loginHTTPReq := httptest.NewRequest("POST", "/api/login", bytes.NewBuffer(loginBody))
+	loginHTTPReq.Header.Set("Content-Type", "application/json")
+
+	loginW := httptest.NewRecorder()
+	server.LoginHandler(loginW, loginHTTPReq)
+
+	// Extract cookies from login response
+	cookies := loginW.Result().Cookies()
+
+	// Test logout
+	req := httptest.NewRequest("POST", "/api/logout", nil)
+
+	// Add cookies
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	server.LogoutHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var response Response
+	json.Unmarshal(w.Body.Bytes(), &response)
+
+	if !response.Success {
+		t.Errorf("Expected success response, got: %v", response)
+	}
+}
+
+func TestChangePasswordHandler(t *testing.T) {
+	server := newTestServer(t)
+
+	// First register and login a user to get a session
+	registerReq := RegisterRequest{
+		Username: "testuser",
+		Email:    "test@example.com",
+		Password: "password123",
+	}
+
+	registerBody, _ := json.Marshal(registerReq)
+	registerHTTPReq := httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(registerBody))
+	registerHTTPReq.Header.Set("Content-Type", "application/json")
+
+	registerW := httptest.NewRecorder()
+	server.RegisterHandler(registerW, registerHTTPReq)
+
+	// Login to create a session
+	loginReq := LoginRequest{
+		Username: "testuser",
+		Password: "password123",
+	}
+
+	loginBody, _ := json.Marshal(loginReq)
+	loginHTTPReq := httptest.NewRequest("POST", "/api/login", bytes.NewBuffer(loginBody))
+	loginHTTPReq.Header.Set("Content-Type", "application/json")
+
+	loginW := httptest.NewRecorder()
+	server.LoginHandler(loginW, loginHTTPReq)
+
+	// Extract cookies from login response
+	cookies := loginW.Result().Cookies()
+
+	tests := []struct {
+		name            string
+		request         ChangePasswordRequest
+		cookies         []*http.Cookie
+		expectedStatus  int
+		expectedSuccess bool
+	}{
+		{
+			name: "Valid password change",
+			request: ChangePasswordRequest{
+				CurrentPassword: "password123",
+				NewPassword:     "newpassword456",
+			},
+			cookies:         cookies,
+			expectedStatus:  http.StatusOK,
+			expectedSuccess: true,
+		},
+		{
+			name: "Wrong current password",
+			request: ChangePasswordRequest{
+				CurrentPassword: "wrongpassword",
+				NewPassword:     "newpassword456",
+			},
+			cookies:         cookies,
+			expectedStatus:  http.StatusUnauthorized,
+			expectedSuccess: false,
+		},
+		{
+			name: "New password too short",
+			request: ChangePasswordRequest{
+				CurrentPassword: "password123",
+				NewPassword:     "123",
+			},
+			cookies:         cookies,
+			expectedStatus:  http.StatusBadRequest,
+			expectedSuccess: false,
+		},
+		{
+			name: "No session",
+			request: ChangePasswordRequest{
+				CurrentPassword: "password123",
+				NewPassword:     "newpassword456",
+			},
+			cookies:         []*http.Cookie{},
+			expectedStatus:  http.StatusUnauthorized,
+			expectedSuccess: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.request)
+			req := httptest.NewRequest("POST", "/api/change-password", bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+
+			// Add cookies if they exist
+			for _, cookie := range tt.cookies {
+				req.AddCookie(cookie)
+			}
+
+			w := httptest.NewRecorder()
+			server.Router().ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.expectedSuccess {
+				var response Response
+				json.Unmarshal(w.Body.Bytes(), &response)
+
+				if !response.Success {
+					t.Errorf("Expected success response, got: %v", response)
+				}
+
+				// Verify the password was actually changed
+				if tt.name == "Valid password change" {
+					// Try to login with new password
+					newLoginReq := LoginRequest{
+						Username: "testuser",
+						Password: "newpassword456",
+					}
+
+					newLoginBody, _ := json.Marshal(newLoginReq)
+					newLoginHTTPReq := httptest.NewRequest("POST", "/api/login", bytes.NewBuffer(newLoginBody))
+					newLoginHTTPReq.Header.Set("Content-Type", "application/json")
+
+					newLoginW := httptest.NewRecorder()
+					server.LoginHandler(newLoginW, newLoginHTTPReq)
+
+					if newLoginW.Code != http.StatusOK {
+						t.Error("Expected to be able to login with new password after change")
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBase64StreamHandlers(t *testing.T) {
+	server := newTestServer(t)
+
+	payload := bytes.Repeat([]byte("streaming payload \x00\xff "), 4096)
+
+	encodeReq := httptest.NewRequest("POST", "/api/base64/encode/stream", bytes.NewReader(payload))
+	encodeW := httptest.NewRecorder()
+	server.Base64EncodeStreamHandler(encodeW, encodeReq)
+
+	if encodeW.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, encodeW.Code)
+	}
+
+	expected := base64.StdEncoding.EncodeToString(payload)
+	if encodeW.Body.String() != expected {
+		t.Error("Expected streamed encoding to match standard base64 encoding")
+	}
+
+	decodeReq := httptest.NewRequest("POST", "/api/base64/decode/stream", strings.NewReader(expected))
+	decodeW := httptest.NewRecorder()
+	server.Base64DecodeStreamHandler(decodeW, decodeReq)
+
+	if decodeW.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, decodeW.Code)
+	}
+
+	if !bytes.Equal(decodeW.Body.Bytes(), payload) {
+		t.Error("Expected streamed decoding to round-trip the original payload")
+	}
+
+	invalidReq := httptest.NewRequest("POST", "/api/base64/decode/stream", strings.NewReader("not*base64"))
+	invalidW := httptest.NewRecorder()
+	server.Base64DecodeStreamHandler(invalidW, invalidReq)
+
+	if invalidW.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid input, got %d", http.StatusBadRequest, invalidW.Code)
+	}
+
+	emptyReq := httptest.NewRequest("POST", "/api/base64/encode/stream", strings.NewReader(""))
+	emptyW := httptest.NewRecorder()
+	server.Base64EncodeStreamHandler(emptyW, emptyReq)
+
+	if emptyW.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for empty input, got %d", http.StatusBadRequest, emptyW.Code)
+	}
+}
+
+func TestBase64DecodeDataURI(t *testing.T) {
+	server := newTestServer(t)
+
+	body, _ := json.Marshal(map[string]string{"text": "data:text/plain;charset=utf-8;base64,aGVsbG8="})
+	req := httptest.NewRequest("POST", "/api/base64/decode", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	server.Base64DecodeHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var response Response
+	json.Unmarshal(w.Body.Bytes(), &response)
+
+	data, ok := response.Data.(map[string]interface{})
+	if !ok {
+		t.Fatal("Expected decode data to be a map")
+	}
+	if data["decoded"] != "hello" {
+		t.Errorf("Expected decoded 'hello', got %v", data["decoded"])
+	}
+	if data["mimeType"] != "text/plain;charset=utf-8" {
+		t.Errorf("Expected mimeType 'text/plain;charset=utf-8', got %v", data["mimeType"])
+	}
+
+	streamReq := httptest.NewRequest("POST", "/api/base64/decode/stream", strings.NewReader("data:image/png;base64,iVBORw0KGgo="))
+	streamW := httptest.NewRecorder()
+	server.Base64DecodeStreamHandler(streamW, streamReq)
+
+	if streamW.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, streamW.Code)
+	}
+	if contentType := streamW.Header().Get("Content-Type"); contentType != "application/octet-stream" {
+		t.Errorf("Expected Content-Type application/octet-stream, got %s", contentType)
+	}
+	if streamW.Body.String() != "\x89PNG\r\n\x1a\n" {
+		t.Errorf("Expected PNG signature, got %q", streamW.Body.String())
+	}
+
+	// A caller-chosen MIME type must not be served as a page on this origin
+	htmlReq := httptest.NewRequest("POST", "/api/base64/decode/stream", strings.NewReader("data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg=="))
+	htmlW := httptest.NewRecorder()
+	server.Base64DecodeStreamHandler(htmlW, htmlReq)
+
+	if contentType := htmlW.Header().Get("Content-Type"); contentType != "application/octet-stream" {
+		t.Errorf("Expected Content-Type application/octet-stream, got %s", contentType)
+	}
+	if htmlW.Header().Get("X-Content-Type-Options") != "nosniff" || htmlW.Header().Get("Content-Disposition") != "attachment" {
+		t.Errorf("Expected nosniff and attachment headers, got %v", htmlW.Header())
+	}
+}
+
+func TestBase64EncodeFileHandler(t *testing.T) {
+	server := newTestServer(t)
+
+	png := []byte("\x89PNG\r\n\x1a\nfake image data")
+
+	newUpload := func(format string, content []byte) *http.Request {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		if format != "" {
+			writer.WriteField("format", format)
+		}
+		if content != nil {
+			part, _ := writer.CreateFormFile("file", "image.png")
+			part.Write(content)
+		}
+		writer.Close()
+
+		req := httptest.NewRequest("POST", "/api/base64/encode-file", &body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		return req
+	}
+
+	tests := []struct {
+		name           string
+		request        *http.Request
+		expectedStatus int
+		expectedOutput string
+	}{
+		{"Raw output", newUpload("", png), http.StatusOK, base64.StdEncoding.EncodeToString(png)},
+		{"Data URI output", newUpload("datauri", png), http.StatusOK, "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)},
+		{"Invalid format", newUpload("yaml", png), http.StatusBadRequest, ""},
+		{"Missing file", newUpload("raw", nil), http.StatusBadRequest, ""},
+		{"File too large", newUpload("raw", make([]byte, maxEncodeFileSize+1)), http.StatusRequestEntityTooLarge, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			server.Base64EncodeFileHandler(w, tt.request)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.expectedStatus == http.StatusOK {
+				var response Response
+				json.Unmarshal(w.Body.Bytes(), &response)
+
+				data, ok := response.Data.(map[string]interface{})
+				if !ok {
+					t.Fatal("Expected file data to be a map")
+				}
+				if data["encoded"] != tt.expectedOutput {
+					t.Errorf("Expected encoded %q, got %v", tt.expectedOutput, data["encoded"])
+				}
+				if data["mimeType"] != "image/png" {
+					t.Errorf("Expected mimeType image/png, got %v", data["mimeType"])
+				}
+			}
+		})
+	}
+}
+
+func TestTransformHandler(t *testing.T) {
+	server := newTestServer(t)
+
+	tests := []struct {
+		name           string
+		request        TransformRequest
+		expectedStatus int
+		expectedOutput string
+	}{
+		{"Base32 encode", TransformRequest{Codec: "base32", Direction: "encode", Input: "hello"}, http.StatusOK, "NBSWY3DP"},
+		{"Hex decode", TransformRequest{Codec: "hex", Direction: "decode", Input: "68656c6c6f"}, http.StatusOK, "hello"},
+		{"URL encode", TransformRequest{Codec: "url", Direction: "encode", Input: "a b&c"}, http.StatusOK, "a%20b%26c"},
+		{"Base64 decode", TransformRequest{Codec: "BASE64", Direction: "decode", Input: "aGVsbG8="}, http.StatusOK, "hello"},
+		{"Unknown codec", TransformRequest{Codec: "rot13", Direction: "encode", Input: "hello"}, http.StatusBadRequest, ""},
+		{"Unknown direction", TransformRequest{Codec: "hex", Direction: "sideways", Input: "hello"}, http.StatusBadRequest, ""},
+		{"Invalid input", TransformRequest{Codec: "hex", Direction: "decode", Input: "zz"}, http.StatusBadRequest, ""},
+		{"Empty input", TransformRequest{Codec: "hex", Direction: "encode"}, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.request)
+			req := httptest.NewRequest("POST", "/api/transform", bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			server.TransformHandler(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.expectedStatus == http.StatusOK {
+				var response Response
+				json.Unmarshal(w.Body.Bytes(), &response)
+
+				data, ok := response.Data.(map[string]interface{})
+				if !ok {
+					t.Fatal("Expected transform data to be a map")
+				}
+				if data["output"] != tt.expectedOutput {
+					t.Errorf("Expected output %q, got %v", tt.expectedOutput, data["output"])
+				}
+			}
+		})
+	}
+}
+
+// jsonRequest builds a request with a JSON body
+func jsonRequest(method, path string, body []byte) *http.Request {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// userSessions returns the server-side sessions of the user
+func userSessions(t *testing.T, server *Server, userID string) []sessionstore.Session {
+	t.Helper()
+	sessions, err := server.authHandler.sessions.ForUser(context.Background(), userID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sessions
+}
+
+// registerAndLogin creates a user and returns the session cookies from logging in
+func registerAndLogin(t *testing.T, server *Server, username, email, password string) []*http.Cookie {
+	t.Helper()
+
+	registerBody, _ := json.Marshal(RegisterRequest{Username: username, Email: email, Password: password})
+	registerReq := httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(registerBody))
+	registerReq.Header.Set("Content-Type", "application/json")
+	server.RegisterHandler(httptest.NewRecorder(), registerReq)
+
+	loginBody, _ := json.Marshal(LoginRequest{Username: username, Password: password})
+	loginReq := httptest.NewRequest("POST", "/api/login", bytes.NewBuffer(loginBody))
+	loginReq.Header.Set("Content-Type", "application/json")
+	loginW := httptest.NewRecorder()
+	server.LoginHandler(loginW, loginReq)
+
+	if loginW.Code != http.StatusOK {
+		t.Fatalf("Expected login to succeed, got status %d", loginW.Code)
+	}
+
+	return loginW.Result().Cookies()
+}
+
+// registerAdmin creates an admin account directly in the store, as an
+// operator would seed one, and logs it in. Admin usernames are reserved,
+// so they cannot be registered through the API.
+func registerAdmin(t *testing.T, server *Server, username, email, password string) []*http.Cookie {
+	t.Helper()
+
+	h := server.authHandler
+	hashed, err := h.hasher.Hash(context.Background(), password)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	now := h.clock.Now()
+	admin := &User{
+		ID:                h.idGenerator.NewID(ids.PrefixUser),
+		Username:          username,
+		Email:             email,
+		Password:          hashed,
+		Role:              RoleAdmin,
+		Created:           now,
+		UpdatedAt:         now,
+		PasswordChangedAt: now,
+		APISecret:         generateAPISecret(),
+		Locale:            "en",
+		Preferences:       defaultNotificationPreferences(),
+	}
+	if err := h.users.Create(context.Background(), admin); err != nil {
+		t.Fatalf("Failed to create admin %s: %v", username, err)
+	}
+
+	loginBody, _ := json.Marshal(LoginRequest{Username: username, Password: password})
+	loginReq := httptest.NewRequest("POST", "/api/login", bytes.NewBuffer(loginBody))
+	loginReq.Header.Set("Content-Type", "application/json")
+	loginW := httptest.NewRecorder()
+	server.LoginHandler(loginW, loginReq)
+	if loginW.Code != http.StatusOK {
+		t.Fatalf("Expected login to succeed, got status %d", loginW.Code)
+	}
+	return loginW.Result().Cookies()
+}
+
+// listUsers returns every user in the server's store
+func listUsers(t *testing.T, server *Server) []*User {
+	t.Helper()
+
+	users, err := server.authHandler.users.List(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to list users: %v", err)
+	}
+	return users
+}
+
+// findUser returns the stored user with the given username
+func findUser(t *testing.T, server *Server, username string) *User {
+	t.Helper()
+
+	user, err := server.authHandler.users.GetByUsername(context.Background(), username)
+	if err != nil {
+		t.Fatalf("Failed to find user %s: %v", username, err)
+	}
+	return user
+}
+
+func TestHashAndHMACHandlers(t *testing.T) {
+	server := newTestServer(t)
+
+	// JSON body
+	body, _ := json.Marshal(HashRequest{Algorithm: "sha256", Input: "hello"})
+	req := httptest.NewRequest("POST", "/api/hash", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	server.HashHandler(w, req)
+
+	var response Response
+	json.Unmarshal(w.Body.Bytes(), &response)
+	data, _ := response.Data.(map[string]interface{})
+	if w.Code != http.StatusOK || data["digest"] != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("Unexpected sha256 result: status %d, data %v", w.Code, data)
+	}
+
+	// Raw streamed body
+	req = httptest.NewRequest("POST", "/api/hash?algorithm=blake2b-256", strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w = httptest.NewRecorder()
+	server.HashHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d for raw body, got %d", http.StatusOK, w.Code)
+	}
+
+	// Unknown algorithm
+	req = httptest.NewRequest("POST", "/api/hash?algorithm=md5", strings.NewReader("hello"))
+	w = httptest.NewRecorder()
+	server.HashHandler(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for unknown algorithm, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// HMAC requires a session
+	req = httptest.NewRequest("POST", "/api/hmac", strings.NewReader("hello"))
+	w = httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without session, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	req = httptest.NewRequest("POST", "/api/hmac?algorithm=sha512", strings.NewReader("hello"))
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d with session, got %d", http.StatusOK, w.Code)
+	}
+
+	user := findUser(t, server, "testuser")
+	mac := hmac.New(sha512.New, user.APISecret)
+	mac.Write([]byte("hello"))
+
+	json.Unmarshal(w.Body.Bytes(), &response)
+	data, _ = response.Data.(map[string]interface{})
+	if data["digest"] != hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("Expected HMAC keyed with the user's API secret, got %v", data["digest"])
+	}
+}
+
+func TestEncryptDecryptHandlers(t *testing.T) {
+	server := newTestServer(t)
+
+	aliceCookies := registerAndLogin(t, server, "alice", "alice@example.com", "password123")
+	bobCookies := registerAndLogin(t, server, "bob", "bob@example.com", "password123")
+
+	call := func(path string, payload interface{}, cookies []*http.Cookie) (*httptest.ResponseRecorder, map[string]interface{}) {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest("POST", path, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+
+		var response Response
+		json.Unmarshal(w.Body.Bytes(), &response)
+		data, _ := response.Data.(map[string]interface{})
+		return w, data
+	}
+
+	w, data := call("/api/encrypt", EncryptRequest{Plaintext: "secret message"}, aliceCookies)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	ciphertext, _ := data["ciphertext"].(string)
+
+	w, data = call("/api/decrypt", DecryptRequest{Ciphertext: ciphertext}, aliceCookies)
+	if w.Code != http.StatusOK || data["plaintext"] != "secret message" {
+		t.Errorf("Expected round trip for owner, got status %d, data %v", w.Code, data)
+	}
+
+	w, _ = call("/api/decrypt", DecryptRequest{Ciphertext: ciphertext}, bobCookies)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected another user's ciphertext to be rejected, got status %d", w.Code)
+	}
+
+	w, _ = call("/api/encrypt", EncryptRequest{Plaintext: "secret message"}, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without session, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestRandomHandler(t *testing.T) {
+	server := newTestServer(t)
+
+	tests := []struct {
+		query          string
+		expectedStatus int
+		expectedLength int
+	}{
+		{"", http.StatusOK, 64},
+		{"?format=hex&bytes=8", http.StatusOK, 16},
+		{"?format=base64&bytes=30", http.StatusOK, 40},
+		{"?format=uuid", http.StatusOK, 36},
+		{"?format=hex&bytes=0", http.StatusBadRequest, 0},
+		{"?format=hex&bytes=4096", http.StatusBadRequest, 0},
+		{"?format=hex&bytes=lots", http.StatusBadRequest, 0},
+		{"?format=octal", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/random"+tt.query, nil)
+			w := httptest.NewRecorder()
+			server.RandomHandler(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			if tt.expectedStatus == http.StatusOK {
+				var response Response
+				json.Unmarshal(w.Body.Bytes(), &response)
+				data, _ := response.Data.(map[string]interface{})
+				value, _ := data["value"].(string)
+				if len(value) != tt.expectedLength {
+					t.Errorf("Expected value of length %d, got %q", tt.expectedLength, value)
+				}
+			}
+		})
+	}
+}
+
+func TestACLMiddlewareAndAdminAPI(t *testing.T) {
+	server := newTestServer(t)
+
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	userCookies := registerAndLogin(t, server, "regular", "regular@example.com", "password123")
+
+	addRule := func(cookies []*http.Cookie, rule ACLRuleRequest) int {
+		body, _ := json.Marshal(rule)
+		req := httptest.NewRequest("POST", "/api/admin/acl", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if status := addRule(userCookies, ACLRuleRequest{Action: "deny", CIDR: "10.0.0.0/8"}); status != http.StatusForbidden {
+		t.Errorf("Expected non-admin to be forbidden, got %d", status)
+	}
+	if status := addRule(adminCookies, ACLRuleRequest{Action: "block", CIDR: "10.0.0.0/8"}); status != http.StatusBadRequest {
+		t.Errorf("Expected invalid action to be rejected, got %d", status)
+	}
+	if status := addRule(adminCookies, ACLRuleRequest{Action: "deny", CIDR: "10.0.0.0/8"}); status != http.StatusCreated {
+		t.Errorf("Expected deny rule to be added, got %d", status)
+	}
+	if status := addRule(adminCookies, ACLRuleRequest{Action: "allow", CIDR: "192.168.1.0/24", Path: "/api/admin"}); status != http.StatusCreated {
+		t.Errorf("Expected allow rule to be added, got %d", status)
+	}
+
+	handler := server.aclMiddleware(http.HandlerFunc(server.HealthHandler))
+
+	tests := []struct {
+		remoteAddr     string
+		path           string
+		expectedStatus int
+	}{
+		{"10.1.2.3:5000", "/api/health", http.StatusForbidden},
+		{"203.0.113.9:5000", "/api/health", http.StatusOK},
+		{"203.0.113.9:5000", "/api/admin/acl", http.StatusForbidden},
+		{"192.168.1.20:5000", "/api/admin/acl", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.RemoteAddr = tt.remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tt.expectedStatus {
+			t.Errorf("%s %s: expected status %d, got %d", tt.remoteAddr, tt.path, tt.expectedStatus, w.Code)
+		}
+	}
+
+	denied := 0
+	for _, event := range server.audit.Recent(0) {
+		if event.Type == AuditAccessDenied {
+			denied++
+		}
+	}
+	if denied != 2 {
+		t.Errorf("Expected 2 access denied audit events, got %d", denied)
+	}
+}
+
+func TestRealIPMiddleware(t *testing.T) {
+	server := newTestServer(t)
+	server.ipResolver = realip.NewResolver([]netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expectedIP string
+	}{
+		{"Direct client", "203.0.113.5:4000", nil, "203.0.113.5"},
+		{"Untrusted peer ignores headers", "203.0.113.5:4000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.5"},
+		{"Trusted proxy", "10.0.0.1:4000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"Spoofed leftmost entry", "10.0.0.1:4000", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"Forwarded header", "10.0.0.1:4000", map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711", for=198.51.100.7;proto=https`}, "198.51.100.7"},
+		{"Forwarded IPv6 client", "[2001:db8::1]:4000", map[string]string{"Forwarded": `for="[2001:db9::17]:4711"`}, "2001:db9::17"},
+		{"Unknown hop", "10.0.0.1:4000", map[string]string{"Forwarded": "for=unknown"}, "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			handler := server.realIPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = clientIP(r)
+			}))
+
+			req := httptest.NewRequest("GET", "/api/health", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if seen != tt.expectedIP {
+				t.Errorf("Expected client IP %s, got %s", tt.expectedIP, seen)
+			}
+		})
+	}
+}
+
+// fakeLocator maps IP addresses to fixed locations
+type fakeLocator map[string]geoip.Location
+
+func (f fakeLocator) Lookup(addr netip.Addr) (geoip.Location, error) {
+	location, ok := f[addr.String()]
+	if !ok {
+		return geoip.Location{}, geoip.ErrNotFound
+	}
+	return location, nil
+}
+
+// recordingMailer captures sent messages on a channel
+type recordingMailer chan mailer.Message
+
+func (m recordingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m <- msg
+	return nil
+}
+
+func TestGeoLoginPolicy(t *testing.T) {
+	server := newTestServer(t)
+	sent := make(recordingMailer, 10)
+	server.authHandler.mailer = sent
+	server.authHandler.geo.locator = fakeLocator{
+		"192.0.2.1":    {Country: "US", Latitude: 40.7, Longitude: -74.0, HasCoordinates: true},
+		"198.51.100.1": {Country: "AU", Latitude: -33.9, Longitude: 151.2, HasCoordinates: true},
+	}
+
+	registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	user := findUser(t, server, "testuser")
+	if user.LastLoginCountry != "US" {
+		t.Errorf("Expected login to be tagged with country US, got %q", user.LastLoginCountry)
+	}
+
+	login := func(remoteAddr string) int {
+		body, _ := json.Marshal(LoginRequest{Username: "testuser", Password: "password123"})
+		req := httptest.NewRequest("POST", "/api/login", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		server.LoginHandler(w, req)
+		return w.Code
+	}
+
+	// Sydney minutes after New York
+	if status := login("198.51.100.1:5000"); status != http.StatusOK {
+		t.Fatalf("Expected login from AU to succeed, got %d", status)
+	}
+
+	select {
+	case msg := <-sent:
+		if msg.To != "test@example.com" {
+			t.Errorf("Expected notification to the user's email, got %q", msg.To)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected an impossible travel notification")
+	}
+
+	server.authHandler.geo.allowedCountries = []string{"US"}
+
+	if status := login("198.51.100.1:5000"); status != http.StatusForbidden {
+		t.Errorf("Expected login from a disallowed country to be forbidden, got %d", status)
+	}
+	if status := login("203.0.113.50:5000"); status != http.StatusForbidden {
+		t.Errorf("Expected login from an unknown country to be forbidden, got %d", status)
+	}
+	if status := login("10.0.0.5:5000"); status != http.StatusOK {
+		t.Errorf("Expected login from a private address to bypass the geo policy, got %d", status)
+	}
+}
+
+func TestCaptchaEnforcement(t *testing.T) {
+	server := newTestServer(t)
+	server.authHandler.captcha = captcha.Bypass{}
+	server.authHandler.config.CaptchaLoginThreshold = 2
+
+	register := func(token string) int {
+		body, _ := json.Marshal(RegisterRequest{Username: "testuser", Email: "test@example.com", Password: "password123", CaptchaToken: token})
+		req := httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		server.RegisterHandler(w, req)
+		return w.Code
+	}
+
+	if status := register(""); status != http.StatusBadRequest {
+		t.Errorf("Expected registration without CAPTCHA to fail, got %d", status)
+	}
+	if status := register("token"); status != http.StatusCreated {
+		t.Errorf("Expected registration with CAPTCHA to succeed, got %d", status)
+	}
+
+	login := func(password, token string) int {
+		body, _ := json.Marshal(LoginRequest{Username: "testuser", Password: password, CaptchaToken: token})
+		req := httptest.NewRequest("POST", "/api/login", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		server.LoginHandler(w, req)
+		return w.Code
+	}
+
+	if status := login("password123", ""); status != http.StatusOK {
+		t.Errorf("Expected login without prior failures to skip CAPTCHA, got %d", status)
+	}
+
+	login("wrongpassword", "")
+	login("wrongpassword", "")
+
+	if status := login("password123", ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected CAPTCHA to be required after repeated failures, got %d", status)
+	}
+	if status := login("password123", "token"); status != http.StatusOK {
+		t.Errorf("Expected login with CAPTCHA to succeed, got %d", status)
+	}
+	if status := login("password123", ""); status != http.StatusOK {
+		t.Errorf("Expected successful login to reset the failure count, got %d", status)
+	}
+}
+
+func TestEmailDomainPolicy(t *testing.T) {
+	server := newTestServer(t)
+
+	register := func(username, email string) int {
+		body, _ := json.Marshal(RegisterRequest{Username: username, Email: email, Password: "password123"})
+		req := httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		server.RegisterHandler(w, req)
+		return w.Code
+	}
+
+	if status := register("throwaway", "someone@mailinator.com"); status != http.StatusBadRequest {
+		t.Errorf("Expected disposable domain to be rejected, got %d", status)
+	}
+	if status := register("subdomain", "someone@inbox.mailinator.com"); status != http.StatusBadRequest {
+		t.Errorf("Expected disposable subdomain to be rejected, got %d", status)
+	}
+	if status := register("malformed", "not-an-email"); status != http.StatusBadRequest {
+		t.Errorf("Expected malformed email to be rejected, got %d", status)
+	}
+
+	server.authHandler.emailPolicy.SetAllowed([]string{"corp.example"})
+	if status := register("outsider", "outsider@example.com"); status != http.StatusBadRequest {
+		t.Errorf("Expected domain outside the allowlist to be rejected, got %d", status)
+	}
+	cookies := registerAndLogin(t, server, "employee", "employee@corp.example", "password123")
+
+	changeEmail := func(newEmail string) int {
+		body, _ := json.Marshal(ChangeEmailRequest{CurrentPassword: "password123", NewEmail: newEmail})
+		req := httptest.NewRequest("POST", "/api/change-email", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if status := changeEmail("employee@gmail.com"); status != http.StatusBadRequest {
+		t.Errorf("Expected email change outside the allowlist to be rejected, got %d", status)
+	}
+	if status := changeEmail("employee@eu.corp.example"); status != http.StatusOK {
+		t.Errorf("Expected email change within the allowlist to succeed, got %d", status)
+	}
+}
+
+func TestSessionExpiryAndGarbageCollection(t *testing.T) {
+	server := newTestServer(t)
+
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	userCookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	profileStatus := func(cookies []*http.Cookie) int {
+		req := httptest.NewRequest("GET", "/api/profile", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if status := profileStatus(userCookies); status != http.StatusOK {
+		t.Fatalf("Expected live session to be accepted, got %d", status)
+	}
+
+	// Expire the user's session server-side
+	user := findUser(t, server, "testuser")
+	for _, session := range userSessions(t, server, user.ID) {
+		session.ExpiresAt = time.Now().Add(-time.Minute)
+		if err := server.authHandler.sessions.Put(context.Background(), session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if status := profileStatus(userCookies); status != http.StatusUnauthorized {
+		t.Errorf("Expected expired session to be rejected, got %d", status)
+	}
+
+	req := httptest.NewRequest("POST", "/api/admin/gc", nil)
+	for _, cookie := range adminCookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected admin GC trigger to succeed, got %d", w.Code)
+	}
+
+	var response struct {
+		Data struct {
+			Purged map[string]int `json:"purged"`
+		} `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&response)
+	if response.Data.Purged["sessions"] != 1 {
+		t.Errorf("Expected 1 purged session, got %d", response.Data.Purged["sessions"])
+	}
+
+	metricsW := httptest.NewRecorder()
+	server.MetricsHandler(metricsW, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(metricsW.Body.String(), `auth_gc_purged_total{kind="sessions"} 1`) {
+		t.Errorf("Expected purged sessions metric, got:\n%s", metricsW.Body.String())
+	}
+
+	// Logging out revokes the session even if the cookie is replayed
+	logoutReq := httptest.NewRequest("POST", "/api/logout", nil)
+	for _, cookie := range adminCookies {
+		logoutReq.AddCookie(cookie)
+	}
+	server.LogoutHandler(httptest.NewRecorder(), logoutReq)
+
+	if status := profileStatus(adminCookies); status != http.StatusUnauthorized {
+		t.Errorf("Expected logged out session to be rejected, got %d", status)
+	}
+}
+
+func TestDomainEvents(t *testing.T) {
+	server := newTestServer(t)
+
+	received := make(chan events.Event, 10)
+	server.authHandler.events.Subscribe(func(event events.Event) {
+		received <- event
+	})
+
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	body, _ := json.Marshal(ChangePasswordRequest{CurrentPassword: "password123", NewPassword: "newpassword123"})
+	req := httptest.NewRequest("POST", "/api/change-password", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	server.Router().ServeHTTP(httptest.NewRecorder(), req)
+
+	logoutReq := httptest.NewRequest("POST", "/api/logout", nil)
+	for _, cookie := range cookies {
+		logoutReq.AddCookie(cookie)
+	}
+	server.LogoutHandler(httptest.NewRecorder(), logoutReq)
+
+	expected := []string{
+		events.TypeUserRegistered,
+		events.TypeLoginSucceeded,
+		events.TypePasswordChanged,
+		events.TypeSessionRevoked,
+	}
+	for _, eventType := range expected {
+		select {
+		case event := <-received:
+			if event.Type != eventType {
+				t.Errorf("Expected event %s, got %s", eventType, event.Type)
+			}
+			if !ids.HasPrefix(event.ID, ids.PrefixEvent) || event.UserID == "" {
+				t.Errorf("Expected event %s to carry an event ID and user ID, got %+v", eventType, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for event %s", eventType)
+		}
+	}
+}
+
+func TestAuditEventStream(t *testing.T) {
+	server := newTestServer(t)
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	ts := httptest.NewServer(server.Router())
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/api/admin/events/stream?type="+AuditLoginSucceeded, nil)
+	for _, cookie := range adminCookies {
+		req.AddCookie(cookie)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %q", resp.Header.Get("Content-Type"))
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	if line, _ := reader.ReadString('\n'); line != ": connected\n" {
+		t.Fatalf("Expected connected comment, got %q", line)
+	}
+
+	login := func(password string) {
+		body, _ := json.Marshal(LoginRequest{Username: "testuser", Password: password})
+		req := httptest.NewRequest("POST", "/api/login", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		server.LoginHandler(httptest.NewRecorder(), req)
+	}
+	login("wrongpassword")
+	login("password123")
+
+	var lines []string
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event: %v", err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	if lines[0] != "event: "+AuditLoginSucceeded {
+		t.Errorf("Expected filtered stream to skip failed logins, got %q", lines[0])
+	}
+
+	var event AuditEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &event); err != nil {
+		t.Fatalf("Failed to decode event data %q: %v", lines[1], err)
+	}
+	if event.Type != AuditLoginSucceeded || event.UserID == "" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	server := newTestServer(t)
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+
+	createClient := func(scopes ...string) (string, string) {
+		body, _ := json.Marshal(ClientRequest{Name: "billing", Scopes: scopes})
+		req := httptest.NewRequest("POST", "/api/admin/clients", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range adminCookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected client to be created, got %d", w.Code)
+		}
+
+		var response struct {
+			Data struct {
+				Client       OAuthClient `json:"client"`
+				ClientSecret string      `json:"clientSecret"`
+			} `json:"data"`
+		}
+		json.NewDecoder(w.Body).Decode(&response)
+		return response.Data.Client.ID, response.Data.ClientSecret
+	}
+
+	requestToken := func(clientID, secret, scope string) (*httptest.ResponseRecorder, TokenResponse) {
+		form := url.Values{"grant_type": {"client_credentials"}, "scope": {scope}}
+		req := httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(clientID, secret)
+		w := httptest.NewRecorder()
+		server.TokenHandler(w, req)
+
+		var token TokenResponse
+		json.Unmarshal(w.Body.Bytes(), &token)
+		return w, token
+	}
+
+	readerID, readerSecret := createClient(ScopeUsersRead)
+	otherID, otherSecret := createClient("reports:write")
+
+	if w, _ := requestToken(readerID, "wrong-secret", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected wrong secret to be rejected, got %d", w.Code)
+	}
+	if w, _ := requestToken(readerID, readerSecret, "admin"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected unregistered scope to be rejected, got %d", w.Code)
+	}
+
+	w, readerToken := requestToken(readerID, readerSecret, "")
+	if w.Code != http.StatusOK || readerToken.TokenType != "Bearer" || readerToken.Scope != ScopeUsersRead {
+		t.Fatalf("Expected token to be issued, got %d %+v", w.Code, readerToken)
+	}
+	_, otherToken := requestToken(otherID, otherSecret, "")
+
+	userID := listUsers(t, server)[0].ID
+
+	handler := server.RequireScope(ScopeUsersRead, server.InternalUserHandler)
+	lookup := func(token string) int {
+		req := httptest.NewRequest("GET", "/api/internal/users/"+userID, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": userID})
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+
+	if status := lookup(""); status != http.StatusUnauthorized {
+		t.Errorf("Expected missing token to be rejected, got %d", status)
+	}
+	if status := lookup(readerToken.AccessToken + "x"); status != http.StatusUnauthorized {
+		t.Errorf("Expected tampered token to be rejected, got %d", status)
+	}
+	if status := lookup(otherToken.AccessToken); status != http.StatusForbidden {
+		t.Errorf("Expected token without users:read to be forbidden, got %d", status)
+	}
+	if status := lookup(readerToken.AccessToken); status != http.StatusOK {
+		t.Errorf("Expected scoped token to be accepted, got %d", status)
+	}
+
+	// Deleting the client revokes the tokens issued to it
+	req := httptest.NewRequest("DELETE", "/api/admin/clients/"+readerID, nil)
+	for _, cookie := range adminCookies {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the client to be deleted, got %d", w.Code)
+	}
+	if status := lookup(readerToken.AccessToken); status != http.StatusUnauthorized {
+		t.Errorf("Expected the token of a deleted client to be rejected, got %d", status)
+	}
+}
+
+func TestJWKSAndKeyRotation(t *testing.T) {
+	server := newTestServer(t)
+
+	fetchKIDs := func() map[string]bool {
+		w := httptest.NewRecorder()
+		server.JWKSHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+
+		var set jwt.JWKS
+		if err := json.NewDecoder(w.Body).Decode(&set); err != nil {
+			t.Fatalf("Failed to decode JWKS: %v", err)
+		}
+		kids := make(map[string]bool)
+		for _, key := range set.Keys {
+			if key.Kty != "EC" || key.Crv != "P-256" || key.Alg != jwt.AlgES256 {
+				t.Errorf("Unexpected JWK: %+v", key)
+			}
+			kids[key.Kid] = true
+		}
+		return kids
+	}
+
+	signedKID := func(token string) string {
+		segment, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+		var header jwt.Header
+		json.Unmarshal(segment, &header)
+		return header.Kid
+	}
+
+	claims := jwt.Claims{Issuer: server.config.TokenIssuer, ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	oldToken, _ := server.tokenKeys.Sign(claims)
+	before := fetchKIDs()
+	if len(before) != 2 || !before[signedKID(oldToken)] {
+		t.Fatalf("Expected current and next keys to be published, got %v", before)
+	}
+
+	if err := server.rotateSigningKey("", ""); err != nil {
+		t.Fatalf("Rotation failed: %v", err)
+	}
+
+	newToken, _ := server.tokenKeys.Sign(claims)
+	if signedKID(newToken) == signedKID(oldToken) {
+		t.Fatal("Expected rotation to change the signing key")
+	}
+	if !before[signedKID(newToken)] {
+		t.Error("Expected the new signing key to be published before it was used")
+	}
+
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		if _, err := server.verifyServiceToken(token); err != nil {
+			t.Errorf("Expected %s token to verify during the grace period: %v", name, err)
+		}
+	}
+
+	if pruned := server.tokenKeys.Prune(time.Now().Add(server.config.SigningKeyGracePeriod + time.Minute)); pruned != 1 {
+		t.Errorf("Expected the retired key to be pruned after the grace period, pruned %d", pruned)
+	}
+	if _, err := server.verifyServiceToken(oldToken); err == nil {
+		t.Error("Expected token from a pruned key to be rejected")
+	}
+}
+
+func TestAuthMiddlewarePackage(t *testing.T) {
+	server := newTestServer(t)
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	authServer := httptest.NewServer(server.Router())
+	defer authServer.Close()
+
+	auth := authmiddleware.New(authmiddleware.Config{
+		BaseURL:         authServer.URL,
+		Issuer:          server.config.TokenIssuer,
+		SessionCacheTTL: time.Minute,
+	})
+
+	whoami := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := authmiddleware.UserFromContext(r.Context())
+		w.Write([]byte(user.Username + "|" + user.ID))
+	})
+
+	call := func(handler http.Handler, cookies []*http.Cookie, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/protected", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	sessionOnly := auth.RequireSession(whoami)
+	if w := call(sessionOnly, nil, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected request without a session to be rejected, got %d", w.Code)
+	}
+	if w := call(sessionOnly, cookies, ""); w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "testuser|") {
+		t.Errorf("Expected session user in context, got %d %q", w.Code, w.Body.String())
+	}
+
+	adminOnly := auth.RequireSession(authmiddleware.RequireRole(RoleAdmin)(whoami))
+	if w := call(adminOnly, cookies, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected non-admin to be forbidden, got %d", w.Code)
+	}
+
+	token, _ := server.tokenKeys.Sign(jwt.Claims{
+		Issuer:    server.config.TokenIssuer,
+		Subject:   "cli_billing",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Scope:     ScopeUsersRead,
+	})
+
+	if w := call(auth.RequireToken(ScopeUsersRead)(whoami), nil, token); w.Code != http.StatusOK || w.Body.String() != "|cli_billing" {
+		t.Errorf("Expected token subject in context, got %d %q", w.Code, w.Body.String())
+	}
+	if w := call(auth.RequireToken("users:write")(whoami), nil, token); w.Code != http.StatusForbidden {
+		t.Errorf("Expected token without scope to be forbidden, got %d", w.Code)
+	}
+	if w := call(auth.RequireToken()(whoami), nil, token+"x"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected tampered token to be rejected, got %d", w.Code)
+	}
+}
+
+func TestEmbeddedRoutes(t *testing.T) {
+	server := newTestServer(t)
+	server.Router().HandleFunc("/app/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}).Methods("GET")
+
+	handler := server.Handler()
+
+	tests := []struct {
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"/app/hello", http.StatusOK, "hello"},
+		{"/api/health", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+		if w.Code != tt.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.path, tt.expectedStatus, w.Code)
+		}
+		if tt.expectedBody != "" && w.Body.String() != tt.expectedBody {
+			t.Errorf("%s: expected body %q, got %q", tt.path, tt.expectedBody, w.Body.String())
+		}
+	}
+
+	// Extra routes are covered by the same access rules as the API
+	server.acl.Add("deny", netip.MustParsePrefix("192.0.2.0/24"), "")
+	req := httptest.NewRequest("GET", "/app/hello", nil)
+	req.RemoteAddr = "192.0.2.10:5000"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected denied client to be refused on an embedded route, got %d", w.Code)
+	}
+}
+
+func TestAuthFlowHooks(t *testing.T) {
+	server := newTestServer(t)
+
+	var called []string
+	server.Hooks().PreRegister(func(ctx context.Context, req RegisterRequest) error {
+		if strings.HasPrefix(req.Username, "bot") {
+			return Reject(http.StatusUnprocessableEntity, "Bots are not welcome")
+		}
+		return nil
+	})
+	server.Hooks().PostRegister(func(ctx context.Context, user User) {
+		called = append(called, "post_register:"+user.Username)
+	})
+	server.Hooks().PostLogin(func(ctx context.Context, user User) {
+		called = append(called, "post_login:"+user.Username)
+	})
+
+	body, _ := json.Marshal(RegisterRequest{Username: "bot42", Email: "bot@example.com", Password: "password123"})
+	req := httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	server.RegisterHandler(w, req)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "Bots are not welcome") {
+		t.Errorf("Expected pre-register hook to reject, got %d %s", w.Code, w.Body.String())
+	}
+
+	// External hooks receive signed payloads and can veto logins
+	var signatureValid bool
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("hook-secret"))
+		mac.Write(payload)
+		signatureValid = r.Header.Get("X-Hook-Signature") == "sha256="+hex.EncodeToString(mac.Sum(nil))
+
+		if strings.Contains(string(payload), `"username":"blocked"`) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"message":"Account locked by HR"}`))
+		}
+	}))
+	defer hookServer.Close()
+
+	cfg := server.config
+	cfg.HookWebhookURL = hookServer.URL
+	cfg.HookWebhookSecret = "hook-secret"
+	cfg.HookWebhookEvents = []string{HookPreLogin}
+	registerWebhookHooks(server.Hooks(), cfg, server.authHandler.enqueue)
+
+	registerAndLogin(t, server, "alice", "alice@example.com", "password123")
+	if !signatureValid {
+		t.Error("Expected webhook payload to carry a valid signature")
+	}
+
+	loginBody, _ := json.Marshal(LoginRequest{Username: "blocked", Password: "password123"})
+	w = httptest.NewRecorder()
+	server.LoginHandler(w, jsonRequest("POST", "/api/login", loginBody))
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "Account locked by HR") {
+		t.Errorf("Expected webhook pre-login hook to reject, got %d %s", w.Code, w.Body.String())
+	}
+
+	expected := []string{"post_register:alice", "post_login:alice"}
+	if strings.Join(called, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected post hooks %v, got %v", expected, called)
+	}
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	server := newTestServer(t)
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	profile := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/profile", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := profile(); w.Code != http.StatusOK {
+		t.Fatalf("Expected profile within the default timeout, got %d", w.Code)
+	}
+
+	// A deadline that has passed by the time the store is queried
+	server.config.EndpointTimeouts = map[string]time.Duration{"/api/profile": time.Nanosecond}
+	if w := profile(); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d once the deadline passed, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	// Zero disables the deadline for the route
+	server.config.RequestTimeout = time.Nanosecond
+	server.config.EndpointTimeouts = map[string]time.Duration{"/api/profile": 0}
+	if w := profile(); w.Code != http.StatusOK {
+		t.Errorf("Expected a route with a zero timeout to have no deadline, got %d", w.Code)
+	}
+
+	// Login gives up without counting a failure
+	server.config.EndpointTimeouts = nil
+	body, _ := json.Marshal(LoginRequest{Username: "testuser", Password: "wrong-password"})
+	req := httptest.NewRequest("POST", "/api/login", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected timed out login to return %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if got := server.authHandler.loginFailures.Max(loginFailureKeys("testuser", clientIP(req))...); got != 0 {
+		t.Errorf("Expected timed out login not to count as a failure, got %d", got)
+	}
+}
+
+func TestParseEndpointTimeouts(t *testing.T) {
+	timeouts := parseEndpointTimeouts("/api/login=5s, /api/hash=2m,bogus,/api/random=soon")
+
+	want := map[string]time.Duration{
+		"/api/admin/events/stream": 0,
+		"/api/login":               5 * time.Second,
+		"/api/hash":                2 * time.Minute,
+	}
+	if len(timeouts) != len(want) {
+		t.Fatalf("Expected %d timeouts, got %v", len(want), timeouts)
+	}
+	for path, duration := range want {
+		if got, ok := timeouts[path]; !ok || got != duration {
+			t.Errorf("Expected %s timeout %s, got %s (present: %t)", path, duration, got, ok)
+		}
+	}
+}
+
+func TestMemoryUserStoreHonoursContext(t *testing.T) {
+	store := NewMemoryUserStore()
+	user := &User{ID: "usr_1", Username: "testuser", Email: "test@example.com"}
+	if err := store.Create(context.Background(), user); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	if _, err := store.GetByEmail(context.Background(), "other@example.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.Get(ctx, "usr_1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancelled lookup to fail with context.Canceled, got %v", err)
+	}
+	if err := store.Update(ctx, user); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancelled update to fail with context.Canceled, got %v", err)
+	}
+}
+
+func TestFrontendServing(t *testing.T) {
+	server := newTestServer(t)
+	handler := server.Handler()
+
+	get := func(target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	index := get("/", nil)
+	if index.Code != http.StatusOK || !strings.Contains(index.Body.String(), "<html") {
+		t.Fatalf("Expected embedded index.html at /, got %d", index.Code)
+	}
+	if got := index.Header().Get("Cache-Control"); got != cacheIndex {
+		t.Errorf("Expected index Cache-Control %q, got %q", cacheIndex, got)
+	}
+
+	// Client-side routes load the app
+	route := get("/account/settings", nil)
+	if route.Code != http.StatusOK || route.Body.String() != index.Body.String() {
+		t.Errorf("Expected index.html for a client-side route, got %d", route.Code)
+	}
+
+	for _, target := range []string{"/api/does-not-exist", "/oauth/nope", "/js/missing.js"} {
+		if w := get(target, nil); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d", target, w.Code)
+		}
+	}
+
+	asset := get("/js/app.js?v=2", nil)
+	if asset.Code != http.StatusOK {
+		t.Fatalf("Expected asset to be served, got %d", asset.Code)
+	}
+	if got := asset.Header().Get("Cache-Control"); got != cacheVersioned {
+		t.Errorf("Expected versioned asset Cache-Control %q, got %q", cacheVersioned, got)
+	}
+	if got := get("/js/app.js", nil).Header().Get("Cache-Control"); got != cacheAsset {
+		t.Errorf("Expected unversioned asset Cache-Control %q, got %q", cacheAsset, got)
+	}
+
+	etag := asset.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag on assets")
+	}
+	if w := get("/js/app.js?v=2", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching ETag, got %d", w.Code)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	server := newTestServer(t)
+	sent := make(recordingMailer, 10)
+	server.authHandler.mailer = sent
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	requestReset := func(email string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(PasswordResetRequest{Email: email})
+		w := httptest.NewRecorder()
+		server.PasswordResetRequestHandler(w, jsonRequest("POST", "/api/password-reset/request", body))
+		return w
+	}
+	confirm := func(token, password string) int {
+		body, _ := json.Marshal(PasswordResetConfirmRequest{Token: token, NewPassword: password})
+		w := httptest.NewRecorder()
+		server.PasswordResetConfirmHandler(w, jsonRequest("POST", "/api/password-reset/confirm", body))
+		return w.Code
+	}
+
+	// Unknown emails get the same answer and no mail
+	unknown := requestReset("nobody@example.com")
+	known := requestReset("test@example.com")
+	if unknown.Code != http.StatusOK || known.Code != http.StatusOK || unknown.Body.String() != known.Body.String() {
+		t.Fatalf("Expected identical responses for known and unknown emails, got %d %q and %d %q",
+			known.Code, known.Body.String(), unknown.Code, unknown.Body.String())
+	}
+
+	var msg mailer.Message
+	select {
+	case msg = <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a password reset email")
+	}
+	if msg.To != "test@example.com" {
+		t.Errorf("Expected reset email to test@example.com, got %s", msg.To)
+	}
+	match := regexp.MustCompile(`/reset-password\?token=([0-9a-f]+)`).FindStringSubmatch(msg.Body)
+	if match == nil {
+		t.Fatalf("Expected a reset link in the email, got %q", msg.Body)
+	}
+	token := match[1]
+
+	if code := confirm("not-a-token", "newpassword123"); code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid token to be rejected, got %d", code)
+	}
+	if code := confirm(token, "short"); code != http.StatusBadRequest {
+		t.Errorf("Expected a short password to be rejected, got %d", code)
+	}
+	if code := confirm(token, "newpassword123"); code != http.StatusOK {
+		t.Fatalf("Expected reset to succeed, got %d", code)
+	}
+	if code := confirm(token, "anotherpassword"); code != http.StatusBadRequest {
+		t.Errorf("Expected a used token to be rejected, got %d", code)
+	}
+
+	// Existing sessions are signed out
+	req := httptest.NewRequest("GET", "/api/profile", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected sessions to be revoked after a reset, got %d", w.Code)
+	}
+
+	registerAndLogin(t, server, "testuser", "test@example.com", "newpassword123")
+
+	// Tokens expire
+	user := findUser(t, server, "testuser")
+	expired, _ := server.authHandler.resetTokens.issue(user.ID, time.Now().Add(-2*server.config.PasswordResetTTL))
+	if code := confirm(expired, "newpassword456"); code != http.StatusBadRequest {
+		t.Errorf("Expected an expired token to be rejected, got %d", code)
+	}
+}
+
+func TestHostedPages(t *testing.T) {
+	cfg := LoadConfig()
+	cfg.OutboxFile = filepath.Join(t.TempDir(), "outbox.json")
+	cfg.HostedPages = true
+	cfg.Branding = Branding{
+		Name:         "Example Corp",
+		PrimaryColor: "#ff0000",
+		FooterLinks:  []FooterLink{{Label: "Privacy", URL: "https://example.com/privacy"}},
+	}
+	server, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	handler := server.Handler()
+
+	page := httptest.NewRecorder()
+	handler.ServeHTTP(page, httptest.NewRequest("GET", "/login", nil))
+	if page.Code != http.StatusOK || !strings.Contains(page.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected the login page, got %d %s", page.Code, page.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{"Example Corp", "#ff0000", "https://example.com/privacy", `name="csrf_token"`} {
+		if !strings.Contains(page.Body.String(), want) {
+			t.Errorf("Expected login page to contain %q", want)
+		}
+	}
+
+	var csrf *http.Cookie
+	for _, cookie := range page.Result().Cookies() {
+		if cookie.Name == pageCSRFCookie {
+			csrf = cookie
+		}
+	}
+	if csrf == nil {
+		t.Fatal("Expected the page to set a CSRF cookie")
+	}
+
+	post := func(target string, form url.Values, withCSRF bool) *httptest.ResponseRecorder {
+		if withCSRF {
+			form.Set("csrf_token", csrf.Value)
+		}
+		req := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(csrf)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("/login", url.Values{"username": {"pageuser"}, "password": {"password123"}}, false); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a form without the CSRF token to be rejected, got %d", w.Code)
+	}
+
+	register := post("/register", url.Values{
+		"username":         {"pageuser"},
+		"email":            {"page@example.com"},
+		"password":         {"password123"},
+		"confirm_password": {"password123"},
+	}, true)
+	if register.Code != http.StatusSeeOther || register.Header().Get("Location") != "/login?notice=registered" {
+		t.Fatalf("Expected registration to redirect to login, got %d %q", register.Code, register.Header().Get("Location"))
+	}
+
+	duplicate := post("/register", url.Values{
+		"username":         {"pageuser"},
+		"email":            {"other@example.com"},
+		"password":         {"password123"},
+		"confirm_password": {"password123"},
+	}, true)
+	if duplicate.Code != http.StatusConflict || !strings.Contains(duplicate.Body.String(), "Username already exists") {
+		t.Errorf("Expected the register page to show the conflict, got %d", duplicate.Code)
+	}
+
+	failed := post("/login", url.Values{"username": {"pageuser"}, "password": {"wrongpassword"}}, true)
+	if failed.Code != http.StatusUnauthorized || !strings.Contains(failed.Body.String(), "Invalid credentials") {
+		t.Errorf("Expected the login page to show the error, got %d", failed.Code)
+	}
+
+	// Off-site return_to targets are ignored
+	login := post("/login", url.Values{
+		"username":  {"pageuser"},
+		"password":  {"password123"},
+		"return_to": {"//evil.example.com/"},
+	}, true)
+	if login.Code != http.StatusSeeOther || login.Header().Get("Location") != "/" {
+		t.Fatalf("Expected login to redirect to /, got %d %q", login.Code, login.Header().Get("Location"))
+	}
+	hasSession := false
+	for _, cookie := range login.Result().Cookies() {
+		if cookie.Name == "user-session" {
+			hasSession = true
+		}
+	}
+	if !hasSession {
+		t.Error("Expected the login page to set the session cookie")
+	}
+
+	reset := post("/reset-password", url.Values{"email": {"page@example.com"}}, true)
+	if reset.Code != http.StatusOK || !strings.Contains(reset.Body.String(), "reset link has been sent") {
+		t.Errorf("Expected the reset page to confirm the request, got %d", reset.Code)
+	}
+}
+
+func TestLocalReturnTo(t *testing.T) {
+	tests := map[string]string{
+		"":                         "/",
+		"/account":                 "/account",
+		"/account?tab=security":    "/account?tab=security",
+		"//evil.example.com":       "/",
+		"/\\evil.example.com":      "/",
+		"https://evil.example.com": "/",
+	}
+	for target, want := range tests {
+		if got := localReturnTo(target); got != want {
+			t.Errorf("localReturnTo(%q) = %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestLocaleNegotiation(t *testing.T) {
+	tests := map[string]string{
+		"":                          "en",
+		"de":                        "de",
+		"es-MX,es;q=0.9,en;q=0.8":   "es",
+		"fr-FR, de;q=0.7, en;q=0.5": "de",
+		"en;q=0.1, es;q=0.9":        "es",
+		"fr, *;q=0.5":               "en",
+		"de;q=0":                    "en",
+	}
+	for header, want := range tests {
+		if got := translations.Negotiate(header); got != want {
+			t.Errorf("Negotiate(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestLocalizedMessages(t *testing.T) {
+	server := newTestServer(t)
+	sent := make(recordingMailer, 10)
+	server.authHandler.mailer = sent
+	handler := server.Router()
+
+	registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	body, _ := json.Marshal(LoginRequest{Username: "testuser", Password: "wrong-password"})
+	req := httptest.NewRequest("POST", "/api/login", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Language", "de-DE,de;q=0.9")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var response Response
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Message != "Ungültige Zugangsdaten" {
+		t.Errorf("Expected a German error message, got %q", response.Message)
+	}
+	if w.Header().Get("Content-Language") != "de" {
+		t.Errorf("Expected Content-Language de, got %q", w.Header().Get("Content-Language"))
+	}
+
+	// Formatted messages keep their arguments
+	body, _ = json.Marshal(RegisterRequest{Username: "other", Email: "other@example.com", Password: "123"})
+	req = httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Language", "es")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if want := fmt.Sprintf("La contraseña debe tener al menos %d caracteres", minPasswordLength); response.Message != want {
+		t.Errorf("Expected %q, got %q", want, response.Message)
+	}
+
+	// Registering records the negotiated language
+	body, _ = json.Marshal(RegisterRequest{Username: "hans", Email: "hans@example.com", Password: "password123"})
+	req = httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Language", "de")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if locale := findUser(t, server, "hans").Locale; locale != "de" {
+		t.Errorf("Expected registration to store locale de, got %q", locale)
+	}
+
+	// Emails follow the user's preference rather than the request
+	body, _ = json.Marshal(PasswordResetRequest{Email: "hans@example.com"})
+	req = httptest.NewRequest("POST", "/api/password-reset/request", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Language", "es")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	select {
+	case msg := <-sent:
+		if msg.Subject != "Setze dein Passwort zurück" || !strings.Contains(msg.Body, "Hallo hans") {
+			t.Errorf("Expected a German reset email, got %q: %q", msg.Subject, msg.Body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a password reset email")
+	}
+}
+
+func TestChangeLocaleHandler(t *testing.T) {
+	server := newTestServer(t)
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+	handler := server.Router()
+
+	changeLocale := func(locale string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(ChangeLocaleRequest{Locale: locale})
+		req := httptest.NewRequest("POST", "/api/change-locale", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := changeLocale("fr"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unsupported locale to be rejected, got %d", w.Code)
+	}
+
+	w := changeLocale("es")
+	var response Response
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusOK || response.Message != "Idioma actualizado correctamente" {
+		t.Fatalf("Expected the locale change to be confirmed in Spanish, got %d %q", w.Code, response.Message)
+	}
+
+	// The saved preference wins over Accept-Language for signed in users
+	req := httptest.NewRequest("GET", "/api/profile", nil)
+	req.Header.Set("Accept-Language", "de")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Message != "Perfil obtenido correctamente" {
+		t.Errorf("Expected the profile message in Spanish, got %q", response.Message)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	clock := &frozenClock{now: time.Now()}
+	server := newTestServer(t, WithClock(clock))
+
+	register := func(key string, req RegisterRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(req)
+		r := httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(body))
+		r.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+
+	alice := RegisterRequest{Username: "alice", Email: "alice@example.com", Password: "password123"}
+	first := register("key-1", alice)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("Expected registration to succeed, got %d: %s", first.Code, first.Body.String())
+	}
+
+	// A retry with the same key gets the original result, not a conflict
+	retry := register("key-1", alice)
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() {
+		t.Errorf("Expected replay of %d %q, got %d %q", first.Code, first.Body.String(), retry.Code, retry.Body.String())
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("Expected replayed response to be marked")
+	}
+	if users := listUsers(t, server); len(users) != 1 {
+		t.Errorf("Expected 1 user after retry, got %d", len(users))
+	}
+
+	// Without a key the duplicate is reported as usual
+	if w := register("", alice); w.Code != http.StatusConflict {
+		t.Errorf("Expected duplicate registration without a key to conflict, got %d", w.Code)
+	}
+
+	// Reusing a key for a different request is rejected
+	bob := RegisterRequest{Username: "bob", Email: "bob@example.com", Password: "password123"}
+	if w := register("key-1", bob); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected key reuse with a different body to return %d, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+
+	if w := register(strings.Repeat("k", 256), bob); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected overlong key to be rejected, got %d", w.Code)
+	}
+
+	// Keys expire by the server's clock, can then be used again and are
+	// purged
+	clock.Advance(server.config.IdempotencyTTL)
+	if w := register("key-1", bob); w.Code != http.StatusCreated {
+		t.Errorf("Expected expired key to be reusable, got %d", w.Code)
+	}
+	if purged := server.idempotency.Purge(clock.Now().Add(server.config.IdempotencyTTL)); purged != 1 {
+		t.Errorf("Expected 1 purged key, got %d", purged)
+	}
+}
+
+func TestOptimisticConcurrency(t *testing.T) {
+	server := newTestServer(t)
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	send := func(method, path, ifMatch string, body interface{}) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			encoded, _ := json.Marshal(body)
+			reader = bytes.NewBuffer(encoded)
+		}
+		req := httptest.NewRequest(method, path, reader)
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	etag := send("GET", "/api/profile", "", nil).Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected profile to carry an ETag")
+	}
+
+	locale := "de"
+	w := send("PATCH", "/api/profile", etag, UpdateProfileRequest{Locale: &locale})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected update with current ETag to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	newETag := w.Header().Get("ETag")
+	if newETag == "" || newETag == etag {
+		t.Errorf("Expected update to change the ETag, got %q", newETag)
+	}
+
+	// A client still holding the old ETag must not overwrite the change
+	username := "renamed"
+	if w := send("PATCH", "/api/profile", etag, UpdateProfileRequest{Username: &username}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected stale If-Match to return %d, got %d", http.StatusPreconditionFailed, w.Code)
+	} else if w.Header().Get("ETag") != newETag {
+		t.Errorf("Expected 412 to report the current ETag %q, got %q", newETag, w.Header().Get("ETag"))
+	}
+	if user := findUser(t, server, "testuser"); user.Locale != "de" {
+		t.Errorf("Expected rejected update to leave the profile alone, got locale %q", user.Locale)
+	}
+
+	stalePassword := ChangePasswordRequest{CurrentPassword: "password123", NewPassword: "newpassword456"}
+	if w := send("POST", "/api/change-password", etag, stalePassword); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected stale If-Match on password change to return %d, got %d", http.StatusPreconditionFailed, w.Code)
+	}
+	if w := send("POST", "/api/change-password", newETag, stalePassword); w.Code != http.StatusOK {
+		t.Errorf("Expected password change with current ETag to succeed, got %d", w.Code)
+	}
+
+	// If-Match is optional
+	if w := send("PATCH", "/api/profile", "", UpdateProfileRequest{Username: &username}); w.Code != http.StatusOK {
+		t.Errorf("Expected update without If-Match to succeed, got %d", w.Code)
+	}
+
+	// The store rejects writes based on an outdated read
+	ctx := context.Background()
+	first := findUser(t, server, "renamed")
+	second := findUser(t, server, "renamed")
+	first.Locale = "es"
+	if err := server.authHandler.users.Update(ctx, first); err != nil {
+		t.Fatalf("Failed to update user: %v", err)
+	}
+	second.Locale = "en"
+	if err := server.authHandler.users.Update(ctx, second); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected ErrVersionConflict for a stale write, got %v", err)
+	}
+}
+
+func TestNotificationPreferences(t *testing.T) {
+	server := newTestServer(t)
+	sent := make(recordingMailer, 10)
+	server.authHandler.mailer = sent
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	preferences := func(method string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/preferences", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) NotificationPreferences {
+		var response struct {
+			Data NotificationPreferences `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.Data
+	}
+
+	w := preferences("GET", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected preferences, got %d", w.Code)
+	}
+	if got := decode(w); got != defaultNotificationPreferences() {
+		t.Errorf("Expected default preferences, got %+v", got)
+	}
+
+	// The first login sent nothing since new login emails are off by default
+	select {
+	case msg := <-sent:
+		t.Errorf("Expected no email, got %q", msg.Subject)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Fields left out of a PUT keep their value
+	w = preferences("PUT", `{"newLoginEmail": true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected preferences update, got %d: %s", w.Code, w.Body.String())
+	}
+	want := NotificationPreferences{NewLoginEmail: true, SecurityAlerts: true}
+	if got := decode(w); got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+
+	registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+	select {
+	case msg := <-sent:
+		if msg.To != "test@example.com" || msg.Subject != "New sign-in to your account" {
+			t.Errorf("Expected new login email to test@example.com, got %q to %s", msg.Subject, msg.To)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected a new login email once enabled")
+	}
+
+	if w := preferences("PUT", `not json`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid body to be rejected, got %d", w.Code)
+	}
+
+	// The GDPR export includes the preferences
+	req := httptest.NewRequest("GET", "/api/account/export", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected account export, got %d", w.Code)
+	}
+	var export AccountExport
+	if err := json.Unmarshal(w.Body.Bytes(), &export); err != nil {
+		t.Fatalf("Failed to decode export: %v", err)
+	}
+	if export.Preferences != want || export.Profile.Username != "testuser" {
+		t.Errorf("Expected export with profile and preferences %+v, got %+v", want, export)
+	}
+	if len(export.Sessions) == 0 || len(export.AuditEvents) == 0 {
+		t.Errorf("Expected export to include sessions and audit events, got %d and %d", len(export.Sessions), len(export.AuditEvents))
+	}
+	if strings.Contains(w.Body.String(), "$2a$") {
+		t.Error("Expected export to leave out the password hash")
+	}
+}
+
+func TestTwoFactorAndRecoveryCodes(t *testing.T) {
+	// RFC 6238 test vector for SHA-1, truncated to 6 digits
+	if code, _ := totp.Code("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", totp.Step(time.Unix(59, 0))); code != "287082" {
+		t.Errorf("Expected RFC 6238 code 287082, got %s", code)
+	}
+
+	server := newTestServer(t)
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	post := func(path string, body interface{}) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		req := httptest.NewRequest("POST", path, bytes.NewBuffer(encoded))
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	login := func(req LoginRequest) *httptest.ResponseRecorder {
+		req.Username, req.Password = "testuser", "password123"
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		server.LoginHandler(w, jsonRequest("POST", "/api/login", body))
+		return w
+	}
+	recoveryCodes := func(w *httptest.ResponseRecorder) []string {
+		var response struct {
+			Data struct {
+				RecoveryCodes []string `json:"recoveryCodes"`
+			} `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.Data.RecoveryCodes
+	}
+
+	if w := post("/api/2fa/setup", TwoFactorSetupRequest{Password: "wrong"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected setup with a wrong password to fail, got %d", w.Code)
+	}
+	w := post("/api/2fa/setup", TwoFactorSetupRequest{Password: "password123"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected setup to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var setup struct {
+		Data map[string]string `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &setup)
+	secret := setup.Data["secret"]
+	if secret == "" || !strings.HasPrefix(setup.Data["uri"], "otpauth://totp/") {
+		t.Fatalf("Expected a secret and otpauth URI, got %v", setup.Data)
+	}
+
+	// Until enrollment is confirmed, login needs no code
+	if w := login(LoginRequest{}); w.Code != http.StatusOK {
+		t.Errorf("Expected login before enrollment is confirmed to succeed, got %d", w.Code)
+	}
+
+	if w := post("/api/2fa/enable", TwoFactorEnableRequest{Code: "000000"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a wrong code to be rejected, got %d", w.Code)
+	}
+	step := totp.Step(time.Now())
+	code, _ := totp.Code(secret, step)
+	w = post("/api/2fa/enable", TwoFactorEnableRequest{Code: code})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected enable to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	codes := recoveryCodes(w)
+	if len(codes) != 10 {
+		t.Fatalf("Expected 10 recovery codes, got %d", len(codes))
+	}
+	for _, hash := range findUser(t, server, "testuser").RecoveryCodes {
+		for _, code := range codes {
+			if hash == code {
+				t.Fatal("Expected recovery codes to be stored hashed")
+			}
+		}
+	}
+
+	w = login(LoginRequest{})
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "twoFactorRequired") {
+		t.Errorf("Expected login without a code to ask for one, got %d: %s", w.Code, w.Body.String())
+	}
+	// The code used to enable cannot be replayed
+	if w := login(LoginRequest{TOTPCode: code}); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a reused TOTP code to be rejected, got %d", w.Code)
+	}
+	next, _ := totp.Code(secret, step+1)
+	if w := login(LoginRequest{TOTPCode: next}); w.Code != http.StatusOK {
+		t.Errorf("Expected login with a fresh TOTP code to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Recovery codes work once, in any case and without the dash
+	typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	if w := login(LoginRequest{RecoveryCode: typed}); w.Code != http.StatusOK {
+		t.Errorf("Expected login with a recovery code to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := login(LoginRequest{RecoveryCode: codes[0]}); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a used recovery code to be rejected, got %d", w.Code)
+	}
+	if remaining := len(findUser(t, server, "testuser").RecoveryCodes); remaining != 9 {
+		t.Errorf("Expected 9 recovery codes left, got %d", remaining)
+	}
+
+	// Regenerating invalidates the old set; the download is a text file
+	req := httptest.NewRequest("POST", "/api/2fa/recovery-codes?download=1", strings.NewReader(`{"password":"password123"}`))
+	req.Header.Set("Content-Type", "application/json")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment") {
+		t.Fatalf("Expected recovery codes download, got %d %q", w.Code, w.Header().Get("Content-Disposition"))
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	downloaded := lines[len(lines)-1]
+	if w := login(LoginRequest{RecoveryCode: codes[1]}); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an old recovery code to stop working after regeneration, got %d", w.Code)
+	}
+	if remaining := len(findUser(t, server, "testuser").RecoveryCodes); remaining != 10 {
+		t.Errorf("Expected a fresh set of 10 recovery codes, got %d", remaining)
+	}
+
+	if w := post("/api/2fa/disable", TwoFactorDisableRequest{Password: "password123", RecoveryCode: downloaded}); w.Code != http.StatusOK {
+		t.Fatalf("Expected disable to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := login(LoginRequest{}); w.Code != http.StatusOK {
+		t.Errorf("Expected login without a code after disabling, got %d", w.Code)
+	}
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	server := newTestServer(t)
+	sent := make(recordingMailer, 10)
+	server.authHandler.mailer = sent
+	registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	requestLink := func(email, remoteAddr string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(MagicLinkRequest{Email: email})
+		req := httptest.NewRequest("POST", "/api/login/magic-link", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("User-Agent", "test-browser")
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	verify := func(token, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/login/magic-link/verify?token="+url.QueryEscape(token), nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("User-Agent", "test-browser")
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	nextToken := func() string {
+		t.Helper()
+		select {
+		case msg := <-sent:
+			match := regexp.MustCompile(`/api/login/magic-link/verify\?token=(\S+)`).FindStringSubmatch(msg.Body)
+			if match == nil {
+				t.Fatalf("Expected a sign-in link in the email, got %q", msg.Body)
+			}
+			token, _ := url.QueryUnescape(match[1])
+			return token
+		case <-time.After(time.Second):
+			t.Fatal("Expected a magic link email")
+		}
+		return ""
+	}
+
+	// Unknown emails get the same answer and no mail
+	unknown := requestLink("nobody@example.com", "192.0.2.10:1234")
+	known := requestLink("test@example.com", "192.0.2.10:1234")
+	if known.Code != http.StatusOK || unknown.Body.String() != known.Body.String() {
+		t.Fatalf("Expected identical responses for known and unknown emails, got %q and %q", known.Body.String(), unknown.Body.String())
+	}
+	token := nextToken()
+
+	if w := verify(token+"x", "192.0.2.10:1234"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a tampered link to be rejected, got %d", w.Code)
+	}
+
+	w := verify(token, "192.0.2.10:1234")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected magic link login to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(w.Result().Cookies()) == 0 {
+		t.Error("Expected magic link login to set a session cookie")
+	}
+	if !strings.Contains(w.Body.String(), `"sameDevice":true`) {
+		t.Errorf("Expected the requesting device to be recognised, got %s", w.Body.String())
+	}
+	if w := verify(token, "192.0.2.10:1234"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a used link to be rejected, got %d", w.Code)
+	}
+
+	// Opening the link elsewhere still works but is flagged
+	requestLink("test@example.com", "192.0.2.10:1234")
+	w = verify(nextToken(), "198.51.100.7:1234")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"sameDevice":false`) {
+		t.Errorf("Expected sign-in from another device to be flagged, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Expired links are rejected
+	server.authHandler.magicLinks.ttl = -time.Minute
+	requestLink("test@example.com", "192.0.2.10:1234")
+	if w := verify(nextToken(), "192.0.2.10:1234"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an expired link to be rejected, got %d", w.Code)
+	}
+
+	// Requests are limited per email, whatever the client IP
+	var limited *httptest.ResponseRecorder
+	for i := 0; i < server.config.MagicLinkRateLimit; i++ {
+		limited = requestLink("test@example.com", fmt.Sprintf("203.0.113.%d:1234", i+1))
+	}
+	if limited.Code != http.StatusTooManyRequests || limited.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected requests over the limit to get %d with Retry-After, got %d", http.StatusTooManyRequests, limited.Code)
+	}
+}
+
+type recordingSMS chan string
+
+func (s recordingSMS) Send(ctx context.Context, to, body string) error {
+	s <- to + " " + body
+	return nil
+}
+
+func TestSMSTwoFactor(t *testing.T) {
+	if number, err := sms.NormalizeNumber("+1 (415) 555-0100"); err != nil || number != "+14155550100" {
+		t.Errorf("Expected +14155550100, got %q, %v", number, err)
+	}
+	if _, err := sms.NormalizeNumber("4155550100"); err == nil {
+		t.Error("Expected a number without a country code to be rejected")
+	}
+
+	// Several wrong codes are tried below; keep the login backoff short
+	t.Setenv("LOGIN_BACKOFF_BASE", "1ms")
+	server := newTestServer(t)
+	texts := make(recordingSMS, 20)
+	server.authHandler.sms = texts
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	post := func(path string, body interface{}) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		req := httptest.NewRequest("POST", path, bytes.NewBuffer(encoded))
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	login := func(req LoginRequest) *httptest.ResponseRecorder {
+		req.Username, req.Password = "testuser", "password123"
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		server.LoginHandler(w, jsonRequest("POST", "/api/login", body))
+		return w
+	}
+	nextCode := func(number string) string {
+		t.Helper()
+		select {
+		case text := <-texts:
+			if !strings.HasPrefix(text, number+" ") {
+				t.Fatalf("Expected a text to %s, got %q", number, text)
+			}
+			return regexp.MustCompile(`\b\d{6}\b`).FindString(text)
+		case <-time.After(time.Second):
+			t.Fatal("Expected a text message")
+		}
+		return ""
+	}
+
+	if w := post("/api/2fa/sms/enable", TwoFactorSetupRequest{Password: "password123"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected SMS codes to need a verified phone, got %d", w.Code)
+	}
+
+	if w := post("/api/phone", PhoneRequest{Phone: "555-0100", Password: "password123"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid number to be rejected, got %d", w.Code)
+	}
+	if w := post("/api/phone", PhoneRequest{Phone: "+14155550100", Password: "password123"}); w.Code != http.StatusOK {
+		t.Fatalf("Expected a verification code to be sent, got %d: %s", w.Code, w.Body.String())
+	}
+	code := nextCode("+14155550100")
+	if w := post("/api/phone/verify", PhoneVerifyRequest{Code: "000000"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a wrong code to be rejected, got %d", w.Code)
+	}
+	if w := post("/api/phone/verify", PhoneVerifyRequest{Code: code}); w.Code != http.StatusOK {
+		t.Fatalf("Expected the phone to be verified, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := post("/api/phone/verify", PhoneVerifyRequest{Code: code}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a used code to be rejected, got %d", w.Code)
+	}
+	if user := findUser(t, server, "testuser"); user.Phone != "+14155550100" {
+		t.Fatalf("Expected the verified phone to be stored, got %q", user.Phone)
+	}
+
+	w := post("/api/2fa/sms/enable", TwoFactorSetupRequest{Password: "password123"})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "recoveryCodes") {
+		t.Fatalf("Expected SMS codes to be enabled with recovery codes, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Without a code, login texts one and asks for it
+	w = login(LoginRequest{})
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), `"smsSent":true`) {
+		t.Fatalf("Expected login to text a code, got %d: %s", w.Code, w.Body.String())
+	}
+	code = nextCode("+14155550100")
+	if w := login(LoginRequest{SMSCode: "000000"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong SMS code to be rejected, got %d", w.Code)
+	}
+	if w := login(LoginRequest{SMSCode: code}); w.Code != http.StatusOK {
+		t.Fatalf("Expected login with the texted code to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := login(LoginRequest{SMSCode: code}); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a used SMS code to be rejected, got %d", w.Code)
+	}
+
+	// Codes are burned after too many wrong guesses
+	login(LoginRequest{})
+	code = nextCode("+14155550100")
+	for i := 0; i < smsCodeMaxAttempts; i++ {
+		login(LoginRequest{SMSCode: "000000"})
+	}
+	if w := login(LoginRequest{SMSCode: code}); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a code to stop working after repeated wrong guesses, got %d", w.Code)
+	}
+	server.authHandler.loginFailures.Reset(loginFailureKeys("testuser", "192.0.2.1")...)
+
+	// Each number only gets so many texts per hour
+	server.authHandler.smsLimiter.perNumber.Reset("+14155550100")
+	for i := 0; i < server.config.SMSRateLimit; i++ {
+		if w := post("/api/2fa/sms/send", nil); w.Code != http.StatusOK {
+			t.Fatalf("Expected code %d to be sent, got %d: %s", i+1, w.Code, w.Body.String())
+		}
+		nextCode("+14155550100")
+	}
+	w = post("/api/2fa/sms/send", nil)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the per-number limit to apply, got %d", w.Code)
+	}
+
+	// The daily cap applies across all numbers
+	server.authHandler.smsLimiter.perNumber.Reset("+14155550100")
+	server.authHandler.smsLimiter.dailyCap = server.authHandler.smsLimiter.sent
+	if w := post("/api/2fa/sms/send", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the daily cap to apply, got %d", w.Code)
+	}
+	server.authHandler.smsLimiter.dailyCap = 0
+
+	if w := post("/api/2fa/sms/send", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected a code to be sent, got %d", w.Code)
+	}
+	code = nextCode("+14155550100")
+	if w := post("/api/2fa/sms/disable", TwoFactorDisableRequest{Password: "password123", SMSCode: code}); w.Code != http.StatusOK {
+		t.Fatalf("Expected SMS codes to be disabled, got %d: %s", w.Code, w.Body.String())
+	}
+	if user := findUser(t, server, "testuser"); user.HasTwoFactor() || len(user.RecoveryCodes) != 0 {
+		t.Error("Expected two-factor authentication and recovery codes to be off")
+	}
+	if w := login(LoginRequest{}); w.Code != http.StatusOK {
+		t.Errorf("Expected login without a code to succeed again, got %d", w.Code)
+	}
+}
+
+func TestStepUpPolicies(t *testing.T) {
+	policies := parseStepUpPolicies("/api/admin/*=2fa, DELETE /api/admin/acl/{id}=2fa+reauth:5m, PATCH /api/profile=reauth:5m, /api/bad=sometimes")
+	if _, ok := policies["/api/bad"]; ok {
+		t.Error("Expected an invalid requirement to be ignored")
+	}
+	if policy, _ := stepUpPolicyFor(policies, "DELETE", "/api/admin/acl/{id}"); !policy.MultiFactor || policy.MaxAge != 5*time.Minute {
+		t.Errorf("Expected the method-specific policy to apply, got %+v", policy)
+	}
+	if policy, ok := stepUpPolicyFor(policies, "GET", "/api/admin/acl"); !ok || !policy.MultiFactor || policy.MaxAge != 0 {
+		t.Errorf("Expected the prefix policy to apply, got %+v", policy)
+	}
+	if _, ok := stepUpPolicyFor(policies, "GET", "/api/profile"); ok {
+		t.Error("Expected no policy for reading the profile")
+	}
+
+	server := newTestServer(t)
+	server.config.StepUpPolicies = policies
+	// The test renames the user twice in a row
+	server.authHandler.config.UsernameChangeCooldown = 0
+	cookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(encoded))
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("GET", "/api/profile", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected reading the profile to need only a session, got %d", w.Code)
+	}
+	w := do("GET", "/api/admin/acl", nil)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), `"stepUpRequired":true`) {
+		t.Fatalf("Expected admin routes to require two-factor authentication, got %d: %s", w.Code, w.Body.String())
+	}
+
+	name := "renamed"
+	if w := do("PATCH", "/api/profile", UpdateProfileRequest{Username: &name}); w.Code != http.StatusOK {
+		t.Fatalf("Expected a fresh login to satisfy the re-auth policy, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Once the login is old, the password must be entered again
+	user := findUser(t, server, "renamed")
+	for _, session := range userSessions(t, server, user.ID) {
+		session.AuthenticatedAt = time.Now().Add(-10 * time.Minute)
+		if _, err := server.authHandler.sessions.Replace(context.Background(), session); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name = "chief"
+	if w := do("PATCH", "/api/profile", UpdateProfileRequest{Username: &name}); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected an old login to need re-authentication, got %d", w.Code)
+	}
+	if w := do("POST", "/api/reauth", ReauthRequest{Password: "wrong"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected re-authentication with a wrong password to fail, got %d", w.Code)
+	}
+	w = do("POST", "/api/reauth", ReauthRequest{Password: "password123"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected re-authentication to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	cookies = w.Result().Cookies()
+	if w := do("PATCH", "/api/profile", UpdateProfileRequest{Username: &name}); w.Code != http.StatusOK {
+		t.Fatalf("Expected the update to succeed after re-authentication, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Enabling two-factor does not upgrade the existing session
+	w = do("POST", "/api/2fa/setup", TwoFactorSetupRequest{Password: "password123"})
+	var setup struct {
+		Data map[string]string `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &setup)
+	code, _ := totp.Code(setup.Data["secret"], totp.Step(time.Now()))
+	w = do("POST", "/api/2fa/enable", TwoFactorEnableRequest{Code: code})
+	var enabled struct {
+		Data struct {
+			RecoveryCodes []string `json:"recoveryCodes"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &enabled)
+	if len(enabled.Data.RecoveryCodes) == 0 {
+		t.Fatalf("Expected two-factor to be enabled, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/api/admin/acl", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the password-only session to still be refused, got %d", w.Code)
+	}
+
+	w = do("POST", "/api/reauth", ReauthRequest{Password: "password123", RecoveryCode: enabled.Data.RecoveryCodes[0]})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"multiFactor":true`) {
+		t.Fatalf("Expected re-authentication with a second factor to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	cookies = w.Result().Cookies()
+	if w := do("GET", "/api/admin/acl", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the multi-factor session to reach admin routes, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTermsAcceptance(t *testing.T) {
+	server := newTestServer(t)
+	server.authHandler.config.TermsVersion = "2024-01"
+	server.authHandler.config.PrivacyVersion = "3"
+
+	register := func(accept bool) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(RegisterRequest{Username: "testuser", Email: "test@example.com", Password: "password123", AcceptTerms: accept})
+		req := httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "192.0.2.10:1234"
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	login := func(accept bool) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(LoginRequest{Username: "testuser", Password: "password123", AcceptTerms: accept})
+		w := httptest.NewRecorder()
+		server.LoginHandler(w, jsonRequest("POST", "/api/login", body))
+		return w
+	}
+
+	w := register(false)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"termsRequired":true`) {
+		t.Fatalf("Expected registration without accepting the terms to fail, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := register(true); w.Code != http.StatusCreated {
+		t.Fatalf("Expected registration to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	user := findUser(t, server, "testuser")
+	if len(user.Consents) != 2 || user.Consents[0].Version != "2024-01" || user.Consents[0].IP != "192.0.2.10" {
+		t.Fatalf("Expected acceptance of both documents to be recorded, got %+v", user.Consents)
+	}
+
+	if w := login(false); w.Code != http.StatusOK {
+		t.Errorf("Expected login with accepted terms to succeed, got %d", w.Code)
+	}
+
+	// A new version has to be accepted before logging in
+	server.authHandler.config.TermsVersion = "2024-06"
+	w = login(false)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), `"version":"2024-06"`) || strings.Contains(w.Body.String(), `"name":"privacy"`) {
+		t.Fatalf("Expected only the updated terms to be required, got %d: %s", w.Code, w.Body.String())
+	}
+	w = login(true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected login accepting the new terms to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The full history is in the data export
+	req := httptest.NewRequest("GET", "/api/account/export", nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	var export AccountExport
+	json.Unmarshal(w.Body.Bytes(), &export)
+	if len(export.Consents) != 3 || export.Consents[2].Version != "2024-06" {
+		t.Errorf("Expected three consent records in the export, got %+v", export.Consents)
+	}
+}
+
+func TestPIIEncryptionAtRest(t *testing.T) {
+	server := newTestServer(t)
+	registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	// Encryption sits under the search index
+	store, ok := server.authHandler.userSearch.next.(*encryptedUserStore)
+	if !ok {
+		t.Fatalf("Expected the user store to encrypt PII, got %T", server.authHandler.userSearch.next)
+	}
+
+	user := findUser(t, server, "testuser")
+	user.Phone = "+14155550100"
+	if err := store.Update(context.Background(), user); err != nil {
+		t.Fatalf("Failed to update user: %v", err)
+	}
+
+	stored, err := store.next.Get(context.Background(), user.ID)
+	if err != nil {
+		t.Fatalf("Failed to read the stored user: %v", err)
+	}
+	if strings.Contains(stored.Email, "test@example.com") || stored.Phone != "" || len(stored.EncryptedEmail) == 0 || len(stored.EncryptedPhone) == 0 {
+		t.Errorf("Expected email and phone to be encrypted at rest, got email %q phone %q", stored.Email, stored.Phone)
+	}
+
+	// Lookups and uniqueness checks still work through the blind index
+	found, err := store.GetByEmail(context.Background(), "test@example.com")
+	if err != nil || found.ID != user.ID || found.Email != "test@example.com" || found.Phone != "+14155550100" {
+		t.Fatalf("Expected lookup by email to return the decrypted user, got %+v, %v", found, err)
+	}
+	body, _ := json.Marshal(RegisterRequest{Username: "other", Email: "test@example.com", Password: "password123"})
+	w := httptest.NewRecorder()
+	server.RegisterHandler(w, jsonRequest("POST", "/api/register", body))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected a duplicate email to be rejected, got %d", w.Code)
+	}
+
+	// Ciphertexts are bound to their user and field
+	wrapper := &cryptoutil.LocalKeyWrapper{Key: make([]byte, cryptoutil.KeySize)}
+	envelope, err := cryptoutil.SealEnvelope(context.Background(), wrapper, []byte("secret"), []byte("a"))
+	if err != nil {
+		t.Fatalf("Failed to seal envelope: %v", err)
+	}
+	if plaintext, err := cryptoutil.OpenEnvelope(context.Background(), wrapper, envelope, []byte("a")); err != nil || string(plaintext) != "secret" {
+		t.Errorf("Expected envelope to open, got %q, %v", plaintext, err)
+	}
+	if _, err := cryptoutil.OpenEnvelope(context.Background(), wrapper, envelope, []byte("b")); err == nil {
+		t.Error("Expected envelope with different additional data to fail")
+	}
+}
+
+func TestPIIKeyMisconfigured(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "pii.key")
+	os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0o600)
+	badFile := filepath.Join(dir, "bad.key")
+	os.WriteFile(badFile, []byte("not hex"), 0o600)
+
+	cfg := LoadConfig()
+	cfg.OutboxFile = filepath.Join(dir, "outbox.json")
+
+	// A key that is set but unusable must not leave PII in plaintext
+	for name, change := range map[string]func(*Config){
+		"short master key": func(cfg *Config) { cfg.MasterKey = []byte("short") },
+		"short key":        func(cfg *Config) { cfg.PIIKey = []byte("short") },
+		"malformed key":    func(cfg *Config) { cfg.PIIKeyHex = "zz" },
+		"short hex key":    func(cfg *Config) { cfg.PIIKeyHex = strings.Repeat("ab", 16) },
+		"missing file":     func(cfg *Config) { cfg.PIIKeyFile = filepath.Join(dir, "missing.key") },
+		"malformed file":   func(cfg *Config) { cfg.PIIKeyFile = badFile },
+	} {
+		broken := cfg
+		change(&broken)
+		if _, err := New(broken); err == nil {
+			t.Errorf("%s: expected New to fail", name)
+		}
+	}
+
+	cfg.PIIKeyFile = keyFile
+	if _, err := New(cfg); err != nil {
+		t.Errorf("Expected a key read from a file to be accepted, got %v", err)
+	}
+}
+
+// fakeVault serves the parts of the Vault API the secrets backend uses
+type fakeVault struct {
+	mutex     sync.Mutex
+	values    map[string]interface{}
+	token     string
+	wrapped   int
+	unwrapped int
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if r.Header.Get("X-Vault-Token") != v.token {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+		return
+	}
+
+	var in map[string]string
+	json.NewDecoder(r.Body).Decode(&in)
+	switch r.URL.Path {
+	case "/v1/secret/data/auth-server":
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": v.values}})
+	case "/v1/transit/encrypt/pii":
+		v.wrapped++
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"ciphertext": "vault:v1:" + in["plaintext"]}})
+	case "/v1/transit/decrypt/pii":
+		v.unwrapped++
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"plaintext": strings.TrimPrefix(in["ciphertext"], "vault:v1:")}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (v *fakeVault) set(name string, value interface{}) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.values[name] = value
+}
+
+func TestSecretsBackend(t *testing.T) {
+	pemKey := func(key *ecdsa.PrivateKey) string {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatalf("Failed to marshal key: %v", err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	}
+	key1, _ := jwt.GenerateKey()
+	key2, _ := jwt.GenerateKey()
+
+	vault := &fakeVault{
+		token: "test-token",
+		values: map[string]interface{}{
+			"session_secret":  strings.Repeat("11", 32) + ":" + strings.Repeat("22", 32),
+			"jwt_signing_key": pemKey(key1),
+			"master_key":      strings.Repeat("ab", 32),
+			"db_password":     "hunter2",
+		},
+	}
+	vaultServer := httptest.NewServer(vault)
+	defer vaultServer.Close()
+
+	t.Setenv("SECRETS_BACKEND", "vault")
+	t.Setenv("VAULT_ADDR", vaultServer.URL)
+	t.Setenv("VAULT_TOKEN", "test-token")
+	t.Setenv("VAULT_TRANSIT_KEY", "pii")
+	server := newTestServer(t)
+	router := server.Router()
+
+	if !bytes.Equal(server.config.MasterKey, bytes.Repeat([]byte{0xab}, 32)) {
+		t.Error("Expected the master key from the secrets backend")
+	}
+	if got := server.Secret("db_password"); got != "hunter2" {
+		t.Errorf("Expected other secrets to be available to embedders, got %q", got)
+	}
+
+	// Tokens are signed with the key from the backend
+	token, err := server.tokenKeys.Sign(jwt.Claims{Subject: "client", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	verifyWith := func(key *ecdsa.PrivateKey) jwt.KeyFunc {
+		return func(kid string) (*ecdsa.PublicKey, error) { return &key.PublicKey, nil }
+	}
+	if _, err := jwt.Verify(token, verifyWith(key1), time.Now()); err != nil {
+		t.Errorf("Expected token to be signed with the backend key: %v", err)
+	}
+	firstKid := server.currentSigningKeyID()
+
+	// Personal data keys are wrapped by the transit engine
+	cookies := registerAdmin(t, server, "vaultuser", "vault@example.com", "password123")
+	if vault.wrapped == 0 || vault.unwrapped == 0 {
+		t.Error("Expected data keys to be wrapped with the transit key")
+	}
+
+	profile := func(cookies []*http.Cookie) int {
+		req := httptest.NewRequest("GET", "/api/profile", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The server does not rotate keys the backend manages
+	rotateReq := httptest.NewRequest("POST", "/api/admin/signing-keys", nil)
+	for _, cookie := range cookies {
+		rotateReq.AddCookie(cookie)
+	}
+	rotateW := httptest.NewRecorder()
+	router.ServeHTTP(rotateW, rotateReq)
+	if rotateW.Code != http.StatusConflict {
+		t.Errorf("Expected manual rotation to be refused, got %d", rotateW.Code)
+	}
+
+	// Rotate the secrets in the backend and refresh
+	var changes []string
+	server.OnSecretChange(func(name, value string) { changes = append(changes, name) })
+	vault.set("session_secret", strings.Repeat("33", 32)+":"+strings.Repeat("44", 32))
+	vault.set("jwt_signing_key", pemKey(key2))
+	if err := server.secrets.refresh(context.Background()); err != nil {
+		t.Fatalf("Failed to refresh secrets: %v", err)
+	}
+	if len(changes) != 2 {
+		t.Errorf("Expected two changed secrets, got %v", changes)
+	}
+
+	if profile(cookies) != http.StatusOK {
+		t.Error("Expected cookies signed with the previous session secret to stay valid")
+	}
+	newCookies := registerAndLogin(t, server, "vaultuser2", "vault2@example.com", "password123")
+	if profile(newCookies) != http.StatusOK {
+		t.Error("Expected cookies signed with the new session secret to be valid")
+	}
+
+	token, _ = server.tokenKeys.Sign(jwt.Claims{Subject: "client", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	if _, err := jwt.Verify(token, verifyWith(key2), time.Now()); err != nil {
+		t.Errorf("Expected token to be signed with the rotated key: %v", err)
+	}
+	if _, err := server.tokenKeys.KeyFunc(firstKid); err != nil {
+		t.Errorf("Expected the previous key to remain published while retired: %v", err)
+	}
+
+	rotated := 0
+	for _, event := range server.audit.Recent(0) {
+		if event.Type == AuditSecretRotated || event.Type == AuditSigningKeyRotated {
+			rotated++
+		}
+	}
+	// Including the signing key installed at startup
+	if rotated != 3 {
+		t.Errorf("Expected the rotations to be audited, got %d events", rotated)
+	}
+
+	// A failed refresh keeps the previous values
+	vault.mutex.Lock()
+	vault.token = "revoked"
+	vault.mutex.Unlock()
+	if err := server.secrets.refresh(context.Background()); err == nil {
+		t.Error("Expected refresh with a revoked token to fail")
+	}
+	if server.Secret("session_secret") != strings.Repeat("33", 32)+":"+strings.Repeat("44", 32) {
+		t.Error("Expected the previous values to be kept after a failed refresh")
+	}
+
+	// The server does not start without its secrets
+	if _, err := New(LoadConfig()); err == nil {
+		t.Error("Expected New to fail when the secrets backend rejects it")
+	}
+}
+
+func TestPasswordPepper(t *testing.T) {
+	vault := &fakeVault{
+		token:  "test-token",
+		values: map[string]interface{}{"password_pepper_v1": "first-pepper"},
+	}
+	vaultServer := httptest.NewServer(vault)
+	defer vaultServer.Close()
+
+	t.Setenv("SECRETS_BACKEND", "vault")
+	t.Setenv("VAULT_ADDR", vaultServer.URL)
+	t.Setenv("VAULT_TOKEN", "test-token")
+	server := newTestServer(t)
+
+	login := func(password string) int {
+		body, _ := json.Marshal(LoginRequest{Username: "pepperuser", Password: password})
+		req := httptest.NewRequest("POST", "/api/login", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		server.LoginHandler(w, req)
+		return w.Code
+	}
+
+	registerAndLogin(t, server, "pepperuser", "pepper@example.com", "password123")
+	user := findUser(t, server, "pepperuser")
+	if !strings.HasPrefix(user.Password, "$pepper$1$") {
+		t.Fatalf("Expected a hash with pepper version 1, got %q", user.Password)
+	}
+	inner := strings.TrimPrefix(user.Password, "$pepper$1$")
+	if bcrypt.CompareHashAndPassword([]byte(inner), []byte("password123")) == nil {
+		t.Error("Expected the stored hash not to verify without the pepper")
+	}
+	if login("wrong-password") != http.StatusUnauthorized {
+		t.Error("Expected a wrong password to be rejected")
+	}
+
+	// Hashes from before the pepper was configured still verify and are
+	// upgraded at login
+	legacy, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	user.Password = string(legacy)
+	if err := server.authHandler.users.Update(context.Background(), user); err != nil {
+		t.Fatalf("Failed to store legacy hash: %v", err)
+	}
+	if login("password123") != http.StatusOK {
+		t.Fatal("Expected login with a legacy hash to succeed")
+	}
+	if user = findUser(t, server, "pepperuser"); !strings.HasPrefix(user.Password, "$pepper$1$") {
+		t.Errorf("Expected the legacy hash to be upgraded, got %q", user.Password)
+	}
+	server.authHandler.loginFailures.Reset(loginFailureKeys("pepperuser", "192.0.2.1")...)
+
+	// A new pepper version hashes new passwords while the old one keeps
+	// verifying existing hashes until the next login
+	vault.set("password_pepper_v2", "second-pepper")
+	if err := server.secrets.refresh(context.Background()); err != nil {
+		t.Fatalf("Failed to refresh secrets: %v", err)
+	}
+	if login("password123") != http.StatusOK {
+		t.Fatal("Expected login with a version 1 hash to succeed after rotation")
+	}
+	if user = findUser(t, server, "pepperuser"); !strings.HasPrefix(user.Password, "$pepper$2$") {
+		t.Errorf("Expected the hash to move to pepper version 2, got %q", user.Password)
+	}
+	if login("password123") != http.StatusOK {
+		t.Error("Expected login with the rehashed password to succeed")
+	}
+
+	// A hash made with a pepper the server does not have never verifies
+	if err := server.authHandler.passwords.Compare(context.Background(), "$pepper$9$"+inner, "password123"); !errors.Is(err, errUnknownPepper) {
+		t.Errorf("Expected errUnknownPepper, got %v", err)
+	}
+}
+
+func TestSessionRotation(t *testing.T) {
+	t.Setenv("SESSION_COOKIE_NAME", "auth-b")
+	server := newTestServer(t)
+
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+	if len(cookies) != 1 || cookies[0].Name != "auth-b" {
+		t.Fatalf("Expected the configured cookie name, got %v", cookies)
+	}
+
+	send := func(method, path string, body interface{}, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(encoded))
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	record := func(cookies []*http.Cookie) (sessionstore.Session, error) {
+		req := httptest.NewRequest("GET", "/api/profile", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		return server.authHandler.sessionRecord(req)
+	}
+	profile := func(cookies []*http.Cookie) int {
+		return send("GET", "/api/profile", nil, cookies).Code
+	}
+
+	if profile(cookies) != http.StatusOK {
+		t.Fatal("Expected the session cookie to work")
+	}
+	renamed := []*http.Cookie{{Name: "user-session", Value: cookies[0].Value}}
+	if profile(renamed) != http.StatusUnauthorized {
+		t.Error("Expected a cookie under the default name to be ignored")
+	}
+
+	// Logging in again replaces the session the request carried
+	w := send("POST", "/api/login", LoginRequest{Username: "testuser", Password: "password123"}, cookies)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected login to succeed, got %d", w.Code)
+	}
+	loginCookies := w.Result().Cookies()
+	if profile(cookies) != http.StatusUnauthorized {
+		t.Error("Expected the session from before login to be revoked")
+	}
+	if profile(loginCookies) != http.StatusOK {
+		t.Error("Expected the new session to work")
+	}
+
+	// Re-authenticating moves the session to a new ID
+	before, _ := record(loginCookies)
+	w = send("POST", "/api/reauth", ReauthRequest{Password: "password123"}, loginCookies)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected re-authentication to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	reauthCookies := w.Result().Cookies()
+	after, err := record(reauthCookies)
+	if err != nil || after.ID == before.ID || !after.CreatedAt.Equal(before.CreatedAt) {
+		t.Errorf("Expected the same session under a new ID, got %+v (was %+v)", after, before)
+	}
+	if profile(loginCookies) != http.StatusUnauthorized {
+		t.Error("Expected the session ID from before re-authentication to stop working")
+	}
+	if profile(reauthCookies) != http.StatusOK {
+		t.Error("Expected the rotated session to work")
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	t.Setenv("QUOTA_DAILY_LIMIT", "2")
+	t.Setenv("QUOTA_OVERRIDES", "ip:192.0.2.99=0/3, client:reports=5/0, bad")
+	server := newTestServer(t)
+	if len(server.config.QuotaOverrides) != 2 {
+		t.Errorf("Expected the invalid override to be ignored, got %v", server.config.QuotaOverrides)
+	}
+
+	hash := func(remoteAddr string, setup func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/hash", strings.NewReader(`{"input":"hello","algorithm":"sha256"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = remoteAddr
+		if setup != nil {
+			setup(req)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	for i, remaining := range []string{"1", "0"} {
+		w := hash("192.0.2.1:1234", nil)
+		if w.Code != http.StatusOK || w.Header().Get("X-Quota-Remaining-Day") != remaining || w.Header().Get("X-Quota-Limit-Day") != "2" {
+			t.Fatalf("Request %d: expected success with %s left, got %d %v", i, remaining, w.Code, w.Header())
+		}
+	}
+	w := hash("192.0.2.1:1234", nil)
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), `"period":"day"`) {
+		t.Fatalf("Expected the daily quota to be enforced, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Retry-After") == "" || w.Header().Get("X-Quota-Reset") == "" {
+		t.Errorf("Expected reset headers on a refused request, got %v", w.Header())
+	}
+
+	// Users are counted separately from their IP address
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+	withCookies := func(req *http.Request) {
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+	}
+	if w := hash("192.0.2.1:1234", withCookies); w.Code != http.StatusOK {
+		t.Errorf("Expected the user's own quota to apply, got %d", w.Code)
+	}
+
+	// API clients get their own counters and overrides
+	token, _ := server.tokenKeys.Sign(jwt.Claims{
+		Issuer:    server.config.TokenIssuer,
+		ClientID:  "reports",
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	})
+	withToken := func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	for i := 0; i < 5; i++ {
+		if w := hash("192.0.2.1:1234", withToken); w.Code != http.StatusOK {
+			t.Fatalf("Expected the client override to allow request %d, got %d", i, w.Code)
+		}
+	}
+	if w := hash("192.0.2.1:1234", withToken); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the client override to be enforced, got %d", w.Code)
+	}
+
+	// Monthly limits apply even without a daily one
+	for i := 0; i < 3; i++ {
+		if w := hash("192.0.2.99:1234", nil); w.Code != http.StatusOK || w.Header().Get("X-Quota-Limit-Day") != "" {
+			t.Fatalf("Expected request %d to pass with no daily limit, got %d %v", i, w.Code, w.Header())
+		}
+	}
+	if w := hash("192.0.2.99:1234", nil); w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), `"period":"month"`) {
+		t.Errorf("Expected the monthly quota to be enforced, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Routes that are not metered are not counted
+	req := httptest.NewRequest("GET", "/api/profile", nil)
+	withCookies(req)
+	profile := httptest.NewRecorder()
+	server.Router().ServeHTTP(profile, req)
+	if profile.Header().Get("X-Quota-Remaining-Day") != "" {
+		t.Error("Expected no quota headers on unmetered routes")
+	}
+
+	req = httptest.NewRequest("GET", "/api/usage", nil)
+	withCookies(req)
+	usageW := httptest.NewRecorder()
+	server.Router().ServeHTTP(usageW, req)
+	var usage struct {
+		Data struct {
+			Caller string      `json:"caller"`
+			Daily  QuotaPeriod `json:"daily"`
+		} `json:"data"`
+	}
+	json.Unmarshal(usageW.Body.Bytes(), &usage)
+	if usageW.Code != http.StatusOK || !strings.HasPrefix(usage.Data.Caller, "user:") || usage.Data.Daily.Used != 1 || *usage.Data.Daily.Remaining != 1 {
+		t.Errorf("Expected the user's usage, got %d: %s", usageW.Code, usageW.Body.String())
+	}
+
+	// Counters start again the next day and are purged the next month
+	tomorrow := time.Now().UTC().Add(24 * time.Hour)
+	if daily, _, ok := server.quotas.take("ip:192.0.2.1", QuotaLimits{Daily: 2}, tomorrow); !ok || daily.Used != 1 {
+		t.Errorf("Expected the daily count to reset, got %+v", daily)
+	}
+	if purged := server.quotas.Purge(time.Now().AddDate(0, 2, 0)); purged != 4 {
+		t.Errorf("Expected every counter to be purged, got %d", purged)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	t.Setenv("QUOTA_DAILY_LIMIT", "10")
+	t.Setenv("QUOTA_MONTHLY_LIMIT", "3")
+	server := newTestServer(t)
+
+	requestLink := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/login/magic-link", strings.NewReader(`{"email":"nobody@example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	limit := server.config.MagicLinkRateLimit
+	for i := 1; i <= limit; i++ {
+		w := requestLink()
+		if w.Header().Get("RateLimit-Limit") != strconv.Itoa(limit) || w.Header().Get("RateLimit-Remaining") != strconv.Itoa(limit-i) {
+			t.Fatalf("Request %d: unexpected rate limit headers %v", i, w.Header())
+		}
+	}
+	w := requestLink()
+	reset, err := strconv.Atoi(w.Header().Get("RateLimit-Reset"))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("RateLimit-Remaining") != "0" || err != nil || reset <= 0 || reset > 3600 {
+		t.Fatalf("Expected a refused request to say when to retry, got %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("Retry-After") != w.Header().Get("RateLimit-Reset") {
+		t.Errorf("Expected Retry-After to match RateLimit-Reset, got %v", w.Header())
+	}
+
+	// Quotas report the period with the least remaining
+	req := httptest.NewRequest("GET", "/api/random?bytes=8", nil)
+	random := httptest.NewRecorder()
+	server.Router().ServeHTTP(random, req)
+	if random.Header().Get("RateLimit-Limit") != "3" || random.Header().Get("RateLimit-Remaining") != "2" {
+		t.Errorf("Expected the monthly quota in the rate limit headers, got %v", random.Header())
+	}
+}
+
+func TestLoginBruteForceProtection(t *testing.T) {
+	t.Setenv("LOGIN_BACKOFF_THRESHOLD", "2")
+	t.Setenv("LOGIN_BACKOFF_BASE", "1ms")
+	t.Setenv("LOGIN_BACKOFF_MAX", "4ms")
+	t.Setenv("IP_BLOCK_SCORE", "8")
+	server := newTestServer(t)
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+
+	// Delays start at the threshold and double up to the maximum
+	for failures, want := range []time.Duration{0, 0, time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 4 * time.Millisecond} {
+		if got := server.authHandler.loginBackoff(failures); got != want {
+			t.Errorf("Expected a %s delay after %d failures, got %s", want, failures, got)
+		}
+	}
+
+	login := func(username, password string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"username":%q,"password":%q}`, username, password)
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "203.0.113.7:4000"
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	// Guessing across several accounts scores 1 per failure plus 2 per
+	// extra account, so the fourth failure reaches 8
+	for i, username := range []string{"alice", "bob", "carol"} {
+		if w := login(username, "guess"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Attempt %d: expected %d, got %d", i+1, http.StatusUnauthorized, w.Code)
+		}
+	}
+	listBlocked := func() map[string]interface{} {
+		req := httptest.NewRequest("GET", "/api/admin/blocked-ips", nil)
+		for _, cookie := range adminCookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected blocked IPs to be listed, got %d", w.Code)
+		}
+		var response Response
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.Data.(map[string]interface{})
+	}
+	suspicious := listBlocked()["suspicious"].([]interface{})
+	if len(suspicious) != 1 || suspicious[0].(map[string]interface{})["score"] != float64(7) {
+		t.Fatalf("Expected the guessing address to be listed as suspicious, got %v", suspicious)
+	}
+
+	login("alice", "guess")
+	w := login("admin", "password123")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected the blocked address to be refused even with the right password, got %d %v", w.Code, w.Header())
+	}
+	blocked := listBlocked()["blocked"].([]interface{})
+	if len(blocked) != 1 || blocked[0].(map[string]interface{})["ip"] != "203.0.113.7" {
+		t.Fatalf("Expected the address to be listed as blocked, got %v", blocked)
+	}
+
+	// Other addresses are unaffected
+	if cookies := registerAndLogin(t, server, "dave", "dave@example.com", "password123"); len(cookies) == 0 {
+		t.Fatal("Expected logins from other addresses to succeed")
+	}
+
+	req := httptest.NewRequest("DELETE", "/api/admin/blocked-ips/203.0.113.7", nil)
+	for _, cookie := range adminCookies {
+		req.AddCookie(cookie)
+	}
+	unblock := httptest.NewRecorder()
+	server.Router().ServeHTTP(unblock, req)
+	if unblock.Code != http.StatusOK {
+		t.Fatalf("Expected the block to be lifted, got %d", unblock.Code)
+	}
+	if w := login("admin", "password123"); w.Code != http.StatusOK {
+		t.Errorf("Expected logins after unblocking to succeed, got %d", w.Code)
+	}
+
+	var blockedEvents, unblockedEvents int
+	for _, event := range server.audit.Recent(0) {
+		switch event.Type {
+		case AuditIPBlocked:
+			blockedEvents++
+			if event.IP != "203.0.113.7" || event.Details["score"] != "8" {
+				t.Errorf("Unexpected block event %+v", event)
+			}
+		case AuditIPUnblocked:
+			unblockedEvents++
+		}
+	}
+	if blockedEvents != 1 || unblockedEvents != 1 {
+		t.Errorf("Expected one block and one unblock in the audit log, got %d and %d", blockedEvents, unblockedEvents)
+	}
+}
+
+func TestSecurityOverview(t *testing.T) {
+	t.Setenv("LOGIN_BACKOFF_THRESHOLD", "2")
+	t.Setenv("LOGIN_BACKOFF_BASE", "1ms")
+	server := newTestServer(t)
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	userCookies := registerAndLogin(t, server, "bob", "bob@example.com", "password123")
+
+	bob := findUser(t, server, "bob")
+	bob.PasswordChangedAt = time.Now().Add(-365 * 24 * time.Hour)
+	if err := server.authHandler.users.Update(context.Background(), bob); err != nil {
+		t.Fatalf("Failed to age password: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"username":"bob","password":"wrong"}`))
+		req.Header.Set("Content-Type", "application/json")
+		server.Router().ServeHTTP(httptest.NewRecorder(), req)
+	}
+	server.audit.Record(AuditEvent{Type: AuditImpossibleTravel, UserID: bob.ID})
+	server.audit.Record(AuditEvent{Type: AuditLoginFailed, Time: time.Now().Add(-48 * time.Hour)})
+
+	overview := func(cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/admin/security", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	if w := overview(userCookies); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected non-admins to be refused, got %d", w.Code)
+	}
+
+	w := overview(adminCookies)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the overview, got %d", w.Code)
+	}
+	var response struct {
+		Data SecurityOverview `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	got := response.Data
+
+	// The failure recorded two days ago falls outside the window
+	if got.FailedLogins != 2 {
+		t.Errorf("Expected 2 failed logins, got %d", got.FailedLogins)
+	}
+	if strings.Join(got.LockedAccounts, ",") != "bob" {
+		t.Errorf("Expected bob to be locked, got %v", got.LockedAccounts)
+	}
+	if got.Users != 2 || strings.Join(got.UsersWithoutTwoFactor, ",") != "admin,bob" {
+		t.Errorf("Expected both users without two-factor, got %d %v", got.Users, got.UsersWithoutTwoFactor)
+	}
+	if strings.Join(got.StalePasswords, ",") != "bob" {
+		t.Errorf("Expected bob's password to be stale, got %v", got.StalePasswords)
+	}
+	if got.ActiveSessions != 2 {
+		t.Errorf("Expected 2 active sessions, got %d", got.ActiveSessions)
+	}
+	if len(got.SuspiciousEvents) != 1 || got.SuspiciousEvents[0].Type != AuditImpossibleTravel {
+		t.Errorf("Expected the impossible travel event, got %v", got.SuspiciousEvents)
+	}
+}
+
+func TestResponseFormats(t *testing.T) {
+	server := newTestServer(t)
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	for _, accept := range []string{"", "*/*", "application/json", "text/html, application/xml;q=0.5, application/json"} {
+		if w := get("/api/health", accept); !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			t.Errorf("Accept %q: expected JSON, got %s", accept, w.Header().Get("Content-Type"))
+		}
+	}
+
+	w := get("/api/health", "application/json;q=0.5, application/xml")
+	if w.Header().Get("Content-Type") != "application/xml" || !strings.Contains(w.Header().Get("Vary"), "Accept") {
+		t.Fatalf("Expected an XML response, got %v", w.Header())
+	}
+	var health struct {
+		XMLName xml.Name `xml:"response"`
+		Success bool     `xml:"success"`
+		Message string   `xml:"message"`
+		Status  string   `xml:"data>status"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &health); err != nil || !health.Success || health.Status != "running" {
+		t.Fatalf("Expected the health response as XML, got %v: %s", err, w.Body.String())
+	}
+
+	w = get("/api/health", "application/msgpack")
+	body := w.Body.Bytes()
+	if w.Header().Get("Content-Type") != "application/msgpack" || len(body) == 0 || body[0] != 0x83 {
+		t.Fatalf("Expected a MessagePack map of three fields, got %s % x", w.Header().Get("Content-Type"), body)
+	}
+	// Keys are sorted, so "data" comes first and "success" last
+	if !bytes.HasPrefix(body[1:], append([]byte{0xa4}, "data"...)) || !bytes.HasSuffix(body, append([]byte{0xa7}, "success\xc3"...)) {
+		t.Errorf("Unexpected MessagePack encoding % x", body)
+	}
+
+	// Plain text errors pass through unchanged
+	w = get("/api/random?bytes=abc", "application/xml")
+	if w.Code != http.StatusBadRequest || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Expected the plain text error unchanged, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	if got := negotiateFormat("application/xml;q=0.2, application/x-msgpack;q=0.8"); got != "application/x-msgpack" {
+		t.Errorf("Expected the higher quality format, got %q", got)
+	}
+	if got := negotiateFormat("image/png"); got != "" {
+		t.Errorf("Expected JSON for unsupported types, got %q", got)
+	}
+}
+
+func TestStrictJSONBodies(t *testing.T) {
+	server := newTestServer(t)
+
+	encode := func(contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/base64/encode", strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		message     string
+	}{
+		{"Valid", "application/json; charset=utf-8", `{"text":"hi"}`, http.StatusOK, ""},
+		{"Missing content type", "", `{"text":"hi"}`, http.StatusUnsupportedMediaType, "Content-Type must be application/json"},
+		{"Form content type", "application/x-www-form-urlencoded", `text=hi`, http.StatusUnsupportedMediaType, "Content-Type must be application/json"},
+		{"Unknown field", "application/json", `{"text":"hi","txet":"typo"}`, http.StatusBadRequest, `Unknown field "txet"`},
+		{"Syntax error", "application/json", "{\n  \"text\": hi\n}", http.StatusBadRequest, "Invalid JSON at line 2, column 11"},
+		{"Truncated", "application/json", `{"text":"hi"`, http.StatusBadRequest, "Request body ends unexpectedly at line 1, column 13"},
+		{"Wrong type", "application/json", `{"text":42}`, http.StatusBadRequest, `Field "text" must be a JSON string, not number`},
+		{"Not an object", "application/json", `["hi"]`, http.StatusBadRequest, "Request body must be a JSON object"},
+		{"Empty", "application/json", ``, http.StatusBadRequest, "Request body is empty"},
+		{"Trailing data", "application/json", `{"text":"hi"} {}`, http.StatusBadRequest, "Unexpected data after the JSON object at line 1, column 15"},
+		{"Too large", "application/json", `{"text":"` + strings.Repeat("a", maxJSONBodySize) + `"}`, http.StatusRequestEntityTooLarge, "Request body must not be larger than 1048576 bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := encode(tt.contentType, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("Expected %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+			if tt.message != "" && strings.TrimSpace(w.Body.String()) != tt.message {
+				t.Errorf("Expected %q, got %q", tt.message, w.Body.String())
+			}
+		})
+	}
+
+	// Handlers answering in JSON report the same errors
+	req := jsonRequest("POST", "/api/login", []byte(`{"username":"a","password":"b","remember":true}`))
+	req.Header.Set("Accept-Language", "de")
+	w := httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	var response Response
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusBadRequest || response.Message != `Unbekanntes Feld "remember"` {
+		t.Errorf("Expected a localized unknown field error, got %d %q", w.Code, response.Message)
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	t.Setenv("MAINTENANCE_FILE", filepath.Join(t.TempDir(), "maintenance.json"))
+	server := newTestServer(t)
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	userCookies := registerAndLogin(t, server, "bob", "bob@example.com", "password123")
+
+	send := func(server *Server, method, path, body string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send(server, "PUT", "/api/admin/maintenance", `{"enabled":true,"allowAdmins":true,"retryAfter":120}`, userCookies); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected non-admins to be refused, got %d", w.Code)
+	}
+	if w := send(server, "PUT", "/api/admin/maintenance", `{"enabled":true,"allowAdmins":true,"retryAfter":120}`, adminCookies); w.Code != http.StatusOK {
+		t.Fatalf("Expected maintenance mode to be enabled, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w := send(server, "GET", "/api/profile", "", userCookies)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "120" {
+		t.Errorf("Expected users to be refused during maintenance, got %d %v", w.Code, w.Header())
+	}
+	if w := send(server, "GET", "/api/health", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the health check to stay up, got %d", w.Code)
+	}
+	if w := send(server, "GET", "/api/profile", "", adminCookies); w.Code != http.StatusOK {
+		t.Errorf("Expected admins to be let through, got %d", w.Code)
+	}
+	if w := send(server, "POST", "/api/login", `{"username":"bob","password":"password123"}`, nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected user logins to be refused, got %d", w.Code)
+	}
+	if w := send(server, "POST", "/api/login", `{"username":"admin","password":"password123"}`, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected admin logins to be allowed, got %d", w.Code)
+	}
+
+	// The setting survives a restart
+	restarted := newTestServer(t)
+	state := restarted.authHandler.maintenance.get()
+	if !state.Enabled || !state.AllowAdmins || state.RetryAfter != 120 || state.EnabledBy != "admin" {
+		t.Fatalf("Expected maintenance mode to be restored, got %+v", state)
+	}
+	if w := send(restarted, "POST", "/api/register", `{"username":"carol","email":"carol@example.com","password":"password123"}`, nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected registration to be refused after the restart, got %d", w.Code)
+	}
+
+	// Without admin access, admins can still turn maintenance off
+	send(server, "PUT", "/api/admin/maintenance", `{"allowAdmins":false}`, adminCookies)
+	if w := send(server, "GET", "/api/profile", "", adminCookies); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected admins to be refused too, got %d", w.Code)
+	}
+	if w := send(server, "PUT", "/api/admin/maintenance", `{"enabled":false}`, adminCookies); w.Code != http.StatusOK {
+		t.Fatalf("Expected maintenance mode to be disabled, got %d", w.Code)
+	}
+	if w := send(server, "GET", "/api/profile", "", userCookies); w.Code != http.StatusOK {
+		t.Errorf("Expected users to be served again, got %d", w.Code)
+	}
+
+	changes := 0
+	for _, event := range server.audit.Recent(0) {
+		if event.Type == AuditMaintenanceChanged {
+			changes++
+		}
+	}
+	if changes != 3 {
+		t.Errorf("Expected 3 maintenance changes in the audit log, got %d", changes)
+	}
+}
+
+func TestFeatureFlags(t *testing.T) {
+	t.Setenv("FEATURE_FLAGS", "beta_endpoints=off,unknown=on,require_email_verification=bogus")
+	server := newTestServer(t)
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	userCookies := registerAndLogin(t, server, "bob", "bob@partner.test", "password123")
+	bob := findUser(t, server, "bob")
+
+	send := func(method, path, body string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	userFlags := func(cookies []*http.Cookie) map[string]bool {
+		w := send("GET", "/api/flags", "", cookies)
+		var response struct {
+			Data map[string]bool `json:"data"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode flags: %v", err)
+		}
+		return response.Data
+	}
+
+	if got := userFlags(userCookies); !got[FlagRegistrationOpen] || got[FlagBetaEndpoints] || got[FlagRequireEmailVerification] {
+		t.Fatalf("Expected only registration to be on by default, got %v", got)
+	}
+
+	beta := server.RequireFlag(FlagBetaEndpoints, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	callBeta := func(cookies []*http.Cookie) int {
+		req := httptest.NewRequest("GET", "/api/beta", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		beta(w, req)
+		return w.Code
+	}
+	if code := callBeta(userCookies); code != http.StatusNotFound {
+		t.Errorf("Expected the beta route to be hidden, got %d", code)
+	}
+
+	if w := send("PUT", "/api/admin/flags/beta_endpoints", `{"enabled":true}`, userCookies); w.Code != http.StatusForbidden {
+		t.Errorf("Expected non-admins to be refused, got %d", w.Code)
+	}
+	if w := send("PUT", "/api/admin/flags/beta_endpoints", `{"enabled":true,"rollout":101}`, adminCookies); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid rollout to be rejected, got %d", w.Code)
+	}
+	if w := send("PUT", "/api/admin/flags/nope", `{"enabled":true}`, adminCookies); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown flag to be rejected, got %d", w.Code)
+	}
+
+	// Turned on for bob's tenant only
+	if w := send("PUT", "/api/admin/flags/beta_endpoints", `{"enabled":true,"tenants":["partner.test"]}`, adminCookies); w.Code != http.StatusOK {
+		t.Fatalf("Expected the flag to be updated, got %d: %s", w.Code, w.Body.String())
+	}
+	if code := callBeta(userCookies); code != http.StatusNoContent {
+		t.Errorf("Expected the beta route for bob's tenant, got %d", code)
+	}
+	if code := callBeta(adminCookies); code != http.StatusNotFound {
+		t.Errorf("Expected the beta route to stay hidden from other tenants, got %d", code)
+	}
+	if code := callBeta(nil); code != http.StatusNotFound {
+		t.Errorf("Expected the beta route to stay hidden from anonymous callers, got %d", code)
+	}
+
+	// Then for a single user
+	send("PUT", "/api/admin/flags/beta_endpoints", `{"tenants":[],"users":["`+bob.ID+`"]}`, adminCookies)
+	if got := userFlags(userCookies); !got[FlagBetaEndpoints] {
+		t.Errorf("Expected the flag to be on for bob, got %v", got)
+	}
+	if got := userFlags(adminCookies); got[FlagBetaEndpoints] {
+		t.Errorf("Expected the flag to be off for admin, got %v", got)
+	}
+
+	// A partial rollout includes a stable share of users, and raising it
+	// keeps the users who already had the flag
+	half := flags.NewSet(flags.Flag{Name: "half", Enabled: true, Rollout: 50})
+	more := flags.NewSet(flags.Flag{Name: "half", Enabled: true, Rollout: 80})
+	included := 0
+	for i := 0; i < 1000; i++ {
+		subject := flags.Subject{UserID: fmt.Sprintf("user-%d", i)}
+		if half.Enabled("half", subject) {
+			included++
+			if !more.Enabled("half", subject) {
+				t.Fatalf("Expected %s to keep the flag when the rollout grows", subject.UserID)
+			}
+		}
+	}
+	if included < 400 || included > 600 {
+		t.Errorf("Expected about half the users in a 50%% rollout, got %d", included)
+	}
+
+	// Closing registration, except for one tenant
+	send("PUT", "/api/admin/flags/registration_open", `{"rollout":0,"tenants":["partner.test"]}`, adminCookies)
+	w := send("POST", "/api/register", `{"username":"carol","email":"carol@example.com","password":"password123"}`, nil)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "Registration is closed") {
+		t.Errorf("Expected registration to be closed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send("POST", "/api/register", `{"username":"dave","email":"dave@partner.test","password":"password123"}`, nil); w.Code != http.StatusCreated {
+		t.Errorf("Expected registration to stay open for the listed tenant, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var changes []AuditEvent
+	for _, event := range server.audit.Recent(0) {
+		if event.Type == AuditFlagChanged {
+			changes = append(changes, event)
+		}
+	}
+	if len(changes) != 3 || changes[2].Details["flag"] != FlagBetaEndpoints || changes[2].Details["tenants"] != "partner.test" {
+		t.Errorf("Expected the flag changes to be audited, got %+v", changes)
+	}
+
+	w = send("GET", "/api/admin/flags", "", adminCookies)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"name":"require_email_verification"`) {
+		t.Errorf("Expected the admin flag list, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// frozenClock is a Clock that only moves when told to
+type frozenClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *frozenClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *frozenClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// sequentialIDs is an IDGenerator that numbers IDs per prefix
+type sequentialIDs struct {
+	mutex sync.Mutex
+	next  map[string]int
+}
+
+func (g *sequentialIDs) NewID(prefix string) string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.next == nil {
+		g.next = make(map[string]int)
+	}
+	g.next[prefix]++
+	return fmt.Sprintf("%s_%d", prefix, g.next[prefix])
+}
+
+func TestClockAndIDInjection(t *testing.T) {
+	start := time.Date(2030, time.January, 1, 12, 0, 0, 0, time.UTC)
+	clock := &frozenClock{now: start}
+	server := newTestServer(t, WithClock(clock), WithIDGenerator(&sequentialIDs{}))
+	sent := make(recordingMailer, 10)
+	server.authHandler.mailer = sent
+
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+	user := findUser(t, server, "testuser")
+	if user.ID != "usr_1" || !user.Created.Equal(start) {
+		t.Errorf("Expected a predictable ID and creation time, got %s at %v", user.ID, user.Created)
+	}
+	profileRequest := func() *http.Request {
+		req := httptest.NewRequest("GET", "/api/profile", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+	record, err := server.authHandler.sessionRecord(profileRequest())
+	if err != nil || record.ID != "sess_1" || !record.ExpiresAt.Equal(start.Add(server.config.SessionTTL)) {
+		t.Errorf("Expected a predictable session, got %+v", record)
+	}
+
+	// Reset tokens expire on the injected clock
+	body, _ := json.Marshal(PasswordResetRequest{Email: "test@example.com"})
+	server.PasswordResetRequestHandler(httptest.NewRecorder(), jsonRequest("POST", "/api/password-reset/request", body))
+	var msg mailer.Message
+	select {
+	case msg = <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a password reset email")
+	}
+	match := regexp.MustCompile(`/reset-password\?token=([0-9a-f]+)`).FindStringSubmatch(msg.Body)
+	if match == nil {
+		t.Fatalf("Expected a reset link in the email, got %q", msg.Body)
+	}
+	clock.Advance(server.config.PasswordResetTTL + time.Minute)
+	body, _ = json.Marshal(PasswordResetConfirmRequest{Token: match[1], NewPassword: "newpassword123"})
+	w := httptest.NewRecorder()
+	server.PasswordResetConfirmHandler(w, jsonRequest("POST", "/api/password-reset/confirm", body))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected the expired token to be rejected, got %d", w.Code)
+	}
+
+	// So do sessions
+	clock.Advance(server.config.SessionTTL)
+	w = httptest.NewRecorder()
+	server.Router().ServeHTTP(w, profileRequest())
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the session to have expired, got %d", w.Code)
+	}
+}
+
+func TestPasswordHashLimit(t *testing.T) {
+	t.Setenv("PASSWORD_HASH_CONCURRENCY", "1")
+	t.Setenv("PASSWORD_HASH_QUEUE_TIMEOUT", "200ms")
+	server := newTestServer(t)
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+	hasher := server.authHandler.passwords
+
+	login := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(LoginRequest{Username: "testuser", Password: "password123"})
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, jsonRequest("POST", "/api/login", body))
+		return w
+	}
+	failedLogins := func() int {
+		count := 0
+		for _, event := range server.audit.Recent(0) {
+			if event.Type == AuditLoginFailed {
+				count++
+			}
+		}
+		return count
+	}
+
+	// With the only slot taken for longer than the queue timeout, logins
+	// are refused without counting as failures
+	if err := hasher.acquire(context.Background()); err != nil {
+		t.Fatalf("Failed to take the hashing slot: %v", err)
+	}
+	w := login()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 503 with Retry-After while hashing is saturated, got %d %v", w.Code, w.Header())
+	}
+	if failedLogins() != 0 {
+		t.Error("Expected a refused login not to count as a failure")
+	}
+
+	// Other password checks are refused the same way, not as wrong passwords
+	body, _ := json.Marshal(ChangePasswordRequest{CurrentPassword: "password123", NewPassword: "newpassword123"})
+	req := jsonRequest("POST", "/api/change-password", body)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the password change to be refused while hashing is saturated, got %d", w.Code)
+	}
+
+	// A slot freed within the timeout lets the waiting login through
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		hasher.release()
+	}()
+	if w := login(); w.Code != http.StatusOK {
+		t.Errorf("Expected the queued login to succeed, got %d", w.Code)
+	}
+
+	metricsW := httptest.NewRecorder()
+	server.MetricsHandler(metricsW, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{"auth_password_hash_rejected_total 2", "auth_password_hash_in_flight 0", "auth_password_hash_saturation 0"} {
+		if !strings.Contains(metricsW.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, metricsW.Body.String())
+		}
+	}
+}
+
+// countingUserStore counts the lookups that reach a UserStore
+type countingUserStore struct {
+	UserStore
+	lookups int
+}
+
+func (s *countingUserStore) Get(ctx context.Context, id string) (*User, error) {
+	s.lookups++
+	return s.UserStore.Get(ctx, id)
+}
+
+func (s *countingUserStore) GetByUsername(ctx context.Context, username string) (*User, error) {
+	s.lookups++
+	return s.UserStore.GetByUsername(ctx, username)
+}
+
+func TestUserCache(t *testing.T) {
+	ctx := context.Background()
+	backing := &countingUserStore{UserStore: NewMemoryUserStore()}
+	cache := newCachedUserStore(backing, Config{UserCacheSize: 2, UserCacheTTL: time.Minute})
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if err := cache.Create(ctx, &User{ID: "usr_" + name, Username: name, Email: name + "@example.com"}); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	// Reads by ID and by username share one entry
+	cache.Get(ctx, "usr_alice")
+	user, err := cache.GetByUsername(ctx, "alice")
+	if err != nil || user.ID != "usr_alice" {
+		t.Fatalf("Expected alice from the cache, got %+v %v", user, err)
+	}
+	if backing.lookups != 1 {
+		t.Errorf("Expected 1 store lookup, got %d", backing.lookups)
+	}
+
+	// Callers get copies, so changing one does not change the cache
+	user.Username = "mallory"
+	if cached, _ := cache.Get(ctx, "usr_alice"); cached.Username != "alice" {
+		t.Errorf("Expected the cached user to be unchanged, got %s", cached.Username)
+	}
+
+	// Updates invalidate, including the old username
+	user.Username = "alicia"
+	if err := cache.Update(ctx, user); err != nil {
+		t.Fatalf("Failed to update alice: %v", err)
+	}
+	if _, err := cache.GetByUsername(ctx, "alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected the old username to be gone, got %v", err)
+	}
+	if updated, _ := cache.Get(ctx, "usr_alice"); updated.Username != "alicia" || updated.Version != 2 {
+		t.Errorf("Expected the updated user, got %+v", updated)
+	}
+
+	// The least recently used user is evicted over the size limit
+	cache.Get(ctx, "usr_bob")
+	cache.Get(ctx, "usr_carol")
+	lookups := backing.lookups
+	cache.Get(ctx, "usr_carol")
+	cache.Get(ctx, "usr_bob")
+	if backing.lookups != lookups {
+		t.Errorf("Expected bob and carol to be cached, got %d more lookups", backing.lookups-lookups)
+	}
+	cache.Get(ctx, "usr_alice")
+	if backing.lookups != lookups+1 {
+		t.Errorf("Expected alice to have been evicted, got %d more lookups", backing.lookups-lookups)
+	}
+}
+
+func TestProfileNotModified(t *testing.T) {
+	server := newTestServer(t)
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/api/profile", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Header().Get("Cache-Control") != "private, no-cache" {
+		t.Fatalf("Expected a profile with validators, got %d %v", w.Code, w.Header())
+	}
+
+	for _, header := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		w = get("/api/profile", header)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+			t.Errorf("Expected 304 for If-None-Match %s, got %d %q", header, w.Code, w.Body.String())
+		}
+	}
+	if w = get("/api/preferences", etag); w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for preferences, got %d", w.Code)
+	}
+
+	// A change to the user makes the old tag stale
+	req := jsonRequest("PUT", "/api/preferences", []byte(`{"productUpdates": true}`))
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	update := httptest.NewRecorder()
+	server.Router().ServeHTTP(update, req)
+	if update.Code != http.StatusOK {
+		t.Fatalf("Failed to update preferences: %d %s", update.Code, update.Body.String())
+	}
+	w = get("/api/profile", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("Expected the changed profile with a new ETag, got %d %v", w.Code, w.Header())
+	}
+}
+
+// fakeRedis serves the few Redis commands the server uses, keeping values
+// in memory without expiry
+type fakeRedis struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	values   map[string]string
+	conns    []net.Conn
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	f := &fakeRedis{listener: listener, values: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.mutex.Lock()
+			f.conns = append(f.conns, conn)
+			f.mutex.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(f.stop)
+	return f
+}
+
+// stop closes the listener and every connection, like a server going down
+func (f *fakeRedis) stop() {
+	f.listener.Close()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		var count int
+		if _, err := fmt.Fscanf(reader, "*%d\r\n", &count); err != nil {
+			return
+		}
+		args := make([]string, count)
+		for i := range args {
+			var size int
+			if _, err := fmt.Fscanf(reader, "$%d\r\n", &size); err != nil {
+				return
+			}
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return
+			}
+			args[i] = string(data[:size])
+		}
+
+		f.mutex.Lock()
+		var reply string
+		switch strings.ToUpper(args[0]) {
+		case "SET":
+			_, exists := f.values[args[1]]
+			if exists && strings.EqualFold(args[len(args)-1], "NX") {
+				reply = "$-1\r\n"
+			} else {
+				f.values[args[1]] = args[2]
+				reply = "+OK\r\n"
+			}
+		case "MGET":
+			reply = fmt.Sprintf("*%d\r\n", len(args)-1)
+			for _, key := range args[1:] {
+				if value, ok := f.values[key]; ok {
+					reply += fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+				} else {
+					reply += "$-1\r\n"
+				}
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		f.mutex.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func TestStatelessSessions(t *testing.T) {
+	redis := startFakeRedis(t)
+	t.Setenv("SESSION_MODE", "stateless")
+	t.Setenv("REDIS_URL", "redis://"+redis.listener.Addr().String())
+	t.Setenv("ENCRYPTION_MASTER_KEY", strings.Repeat("ab", 32))
+	t.Setenv("SESSION_KEYS", strings.Repeat("cd", 32)+":"+strings.Repeat("ef", 32))
+
+	// Two replicas sharing the master and session keys, Redis and the user
+	// store
+	first := newTestServer(t)
+	second := newTestServer(t)
+	second.authHandler.users = first.authHandler.users
+	cookies := registerAndLogin(t, first, "testuser", "test@example.com", "password123")
+	if count, _ := first.authHandler.sessions.Count(context.Background(), time.Now()); count != 0 {
+		t.Errorf("Expected no sessions kept on the server, got %d", count)
+	}
+
+	send := func(server *Server, method, path string, cookies []*http.Cookie) int {
+		req := httptest.NewRequest(method, path, nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := send(second, "GET", "/api/profile", cookies); code != http.StatusOK {
+		t.Fatalf("Expected the other replica to accept the session, got %d", code)
+	}
+
+	// Logging out on one replica revokes the session on both
+	if code := send(second, "POST", "/api/logout", cookies); code != http.StatusOK {
+		t.Fatalf("Expected logout to succeed, got %d", code)
+	}
+	if code := send(first, "GET", "/api/profile", cookies); code != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked session to be refused, got %d", code)
+	}
+
+	// Revoking a user's sessions ends the ones started before, not after
+	cookies = registerAndLogin(t, first, "testuser", "test@example.com", "password123")
+	user := findUser(t, first, "testuser")
+	if _, err := second.authHandler.revokeUserSessions(context.Background(), user.ID); err != nil {
+		t.Fatalf("Failed to revoke the user's sessions: %v", err)
+	}
+	if code := send(first, "GET", "/api/profile", cookies); code != http.StatusUnauthorized {
+		t.Errorf("Expected sessions from before the revocation to be refused, got %d", code)
+	}
+	time.Sleep(time.Millisecond)
+	cookies = registerAndLogin(t, second, "testuser", "test@example.com", "password123")
+	if code := send(first, "GET", "/api/profile", cookies); code != http.StatusOK {
+		t.Errorf("Expected a new session to be accepted, got %d", code)
+	}
+
+	// Tampered tokens are refused
+	tampered := append([]*http.Cookie{}, cookies...)
+	for i, cookie := range tampered {
+		copied := *cookie
+		copied.Value = strings.ToUpper(copied.Value)
+		tampered[i] = &copied
+	}
+	if code := send(first, "GET", "/api/profile", tampered); code != http.StatusUnauthorized {
+		t.Errorf("Expected a tampered cookie to be refused, got %d", code)
+	}
+
+	// Without the revocation list no session is trusted
+	redis.stop()
+	if code := send(first, "GET", "/api/profile", cookies); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while Redis is down, got %d", code)
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.sock")
+	t.Setenv("LISTEN_ADDR", "unix:"+path)
+	t.Setenv("LISTEN_SOCKET_MODE", "600")
+	server := newTestServer(t)
+	server.Router().HandleFunc("/test/client-ip", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, clientIP(r))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run failed: %v", err)
+		}
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected the socket to be removed, got %v", err)
+		}
+	}()
+
+	var info os.FileInfo
+	for i := 0; i < 100; i++ {
+		var err error
+		if info, err = os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info == nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0o600 {
+		t.Fatalf("Expected a socket with mode 0600, got %v", info)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}}
+	get := func(forwardedFor string) string {
+		req, _ := http.NewRequest("GET", "http://auth/test/client-ip", nil)
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request over the socket failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// The local proxy is trusted to forward the client's address
+	if ip := get("203.0.113.7"); ip != "203.0.113.7" {
+		t.Errorf("Expected the forwarded client IP, got %q", ip)
+	}
+	if ip := get(""); ip != "127.0.0.1" {
+		t.Errorf("Expected loopback without forwarding headers, got %q", ip)
+	}
+}
+
+func TestPublishAfterRun(t *testing.T) {
+	t.Setenv("LISTEN_ADDR", "127.0.0.1:0")
+	server := newTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := server.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// Handlers still running after Shutdown gives up, and a collector run
+	// that outlives it, publish to a closed bus; the events are dropped
+	dropped := server.authHandler.events.Dropped()
+	registerAndLogin(t, server, "late", "late@example.com", "password123")
+	server.gc.run(time.Now().Add(365 * 24 * time.Hour))
+	if server.authHandler.events.Dropped() == dropped {
+		t.Error("Expected events published after Run to be dropped")
+	}
+	if err := server.authHandler.events.Close(); err != nil {
+		t.Errorf("Expected closing the bus again to do nothing, got %v", err)
+	}
+}
+
+func TestAuditStreamShutdown(t *testing.T) {
+	server := newTestServer(t)
+	cookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	httpServer := server.newHTTPServer()
+	go httpServer.Serve(listener)
+
+	req, _ := http.NewRequest("GET", "http://"+listener.Addr().String()+"/api/admin/events/stream", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open the stream: %v", err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	if line, _ := reader.ReadString('\n'); line != ": connected\n" {
+		t.Fatalf("Expected the stream to open, got %d %q", resp.StatusCode, line)
+	}
+
+	// Shutdown waits for open requests; the stream must end rather than
+	// hold it until its client goes away
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		t.Fatalf("Expected the stream not to hold up shutdown, got %v", err)
+	}
+	if _, err := io.ReadAll(reader); err != nil {
+		t.Errorf("Expected the stream to end cleanly, got %v", err)
+	}
+}
+
+func TestSystemdSocketActivation(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("Failed to get the listener's file: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	defer file.Close()
+
+	// Pass the socket as the second of two, as systemd would
+	previous := listenFDsStart
+	listenFDsStart = int(file.Fd()) - 1
+	defer func() { listenFDsStart = previous }()
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "2")
+	t.Setenv("LISTEN_FDNAMES", "metrics:http")
+	t.Setenv("LISTEN_ADDR", "systemd:http")
+	server := newTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run failed: %v", err)
+		}
+	}()
+
+	resp, err := http.Get("http://" + addr + "/api/health")
+	if err != nil {
+		t.Fatalf("Request to the activated socket failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 from the activated socket, got %d", resp.StatusCode)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("Expected the activation variables to be cleared")
+	}
+
+	// Without the variables there is nothing to listen on
+	if _, err := systemdListener(""); err == nil {
+		t.Errorf("Expected an error without activation variables")
+	}
+}
+
+func TestHTTPServerTuning(t *testing.T) {
+	t.Setenv("LISTEN_ADDR", "127.0.0.1:0")
+	t.Setenv("HTTP2_CLEARTEXT", "true")
+	t.Setenv("HTTP_MAX_HEADER_BYTES", "4096")
+	server := newTestServer(t)
+
+	serve := func() string {
+		listener, err := server.listen()
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		httpServer := server.newHTTPServer()
+		go httpServer.Serve(listener)
+		t.Cleanup(func() { httpServer.Close() })
+		return "http://" + listener.Addr().String()
+	}
+	url := serve()
+
+	// HTTP/2 with prior knowledge, without TLS
+	h2c := &http.Client{Transport: &http.Transport{Protocols: new(http.Protocols)}}
+	h2c.Transport.(*http.Transport).Protocols.SetUnencryptedHTTP2(true)
+	resp, err := h2c.Get(url + "/api/health")
+	if err != nil {
+		t.Fatalf("h2c request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected an HTTP/2 response, got %s %d", resp.Proto, resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", url+"/api/health", nil)
+	req.Header.Set("X-Padding", strings.Repeat("a", 8192))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected 431 for oversized headers, got %d", resp.StatusCode)
+	}
+
+	// With one connection allowed, a second client waits for the first
+	server.config.MaxConnections = 1
+	url = serve()
+	first := &http.Client{Transport: &http.Transport{}}
+	if resp, err := first.Get(url + "/api/health"); err != nil {
+		t.Fatalf("First request failed: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+	second := &http.Client{Transport: &http.Transport{}, Timeout: 200 * time.Millisecond}
+	if _, err := second.Get(url + "/api/health"); err == nil {
+		t.Errorf("Expected the second connection to wait while the first is open")
+	}
+	first.CloseIdleConnections()
+	second.Timeout = 5 * time.Second
+	if resp, err := second.Get(url + "/api/health"); err != nil {
+		t.Errorf("Expected the second client to be served once the first left: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	t.Setenv("PUBLIC_URL", "https://example.com/auth/")
+	t.Setenv("HOSTED_PAGES", "true")
+	server := newTestServer(t)
+	if server.config.BasePath != "/auth" {
+		t.Fatalf("Expected the base path from PUBLIC_URL, got %q", server.config.BasePath)
+	}
+	sent := make(recordingMailer, 10)
+	server.authHandler.mailer = sent
+	handler := server.Handler()
+
+	send := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// The gateway may pass the prefix on or strip it
+	body, _ := json.Marshal(RegisterRequest{Username: "testuser", Email: "test@example.com", Password: "password123"})
+	if w := send(jsonRequest("POST", "/auth/api/register", body)); w.Code != http.StatusCreated {
+		t.Fatalf("Expected registration under the prefix, got %d %s", w.Code, w.Body.String())
+	}
+	body, _ = json.Marshal(LoginRequest{Username: "testuser", Password: "password123"})
+	login := send(jsonRequest("POST", "/api/login", body))
+	if login.Code != http.StatusOK {
+		t.Fatalf("Expected login without the prefix, got %d", login.Code)
+	}
+	for _, cookie := range login.Result().Cookies() {
+		if cookie.Path != "/auth" {
+			t.Errorf("Expected cookie %s scoped to /auth, got %q", cookie.Name, cookie.Path)
+		}
+	}
+
+	index := send(httptest.NewRequest("GET", "/auth/", nil))
+	if index.Code != http.StatusOK || !strings.Contains(index.Body.String(), `<base href="/auth/">`) {
+		t.Errorf("Expected index.html with a base of /auth/, got %d", index.Code)
+	}
+
+	page := send(httptest.NewRequest("GET", "/auth/login", nil))
+	if !strings.Contains(page.Body.String(), `action="/auth/login"`) || !strings.Contains(page.Body.String(), `href="/auth/register"`) {
+		t.Errorf("Expected the login page's links under /auth, got %s", page.Body.String())
+	}
+	for _, cookie := range page.Result().Cookies() {
+		if cookie.Path != "/auth" {
+			t.Errorf("Expected cookie %s scoped to /auth, got %q", cookie.Name, cookie.Path)
+		}
+	}
+
+	body, _ = json.Marshal(PasswordResetRequest{Email: "test@example.com"})
+	send(jsonRequest("POST", "/auth/api/password-reset/request", body))
+	select {
+	case msg := <-sent:
+		if !strings.Contains(msg.Body, "https://example.com/auth/reset-password?token=") {
+			t.Errorf("Expected the reset link under the base URL, got %q", msg.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a password reset email")
+	}
+
+	// Only whole path segments are stripped
+	if w := send(httptest.NewRequest("GET", "/authority/api/health", nil)); w.Code == http.StatusOK && strings.Contains(w.Body.String(), "healthy") {
+		t.Errorf("Expected /authority not to be treated as the prefix")
+	}
+}
+
+func TestRiskBasedLoginChallenge(t *testing.T) {
+	server := newTestServer(t)
+	sent := make(recordingMailer, 20)
+	server.authHandler.mailer = sent
+	clock := &frozenClock{now: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)}
+	server.authHandler.clock = clock
+
+	login := func(ip, agent string, req LoginRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(req)
+		r := jsonRequest("POST", "/api/login", body)
+		r.RemoteAddr = ip + ":1234"
+		r.Header.Set("User-Agent", agent)
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+	credentials := LoginRequest{Username: "risky", Password: "password123"}
+	registerBody, _ := json.Marshal(RegisterRequest{Username: "risky", Email: "risky@example.com", Password: "password123"})
+	server.Router().ServeHTTP(httptest.NewRecorder(), jsonRequest("POST", "/api/register", registerBody))
+
+	// Without enough history nothing is new, then the usual place passes
+	for i := 0; i < 4; i++ {
+		if w := login("192.0.2.1", "Firefox", credentials); w.Code != http.StatusOK {
+			t.Fatalf("Expected usual login to succeed, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	if got := len(findUser(t, server, "risky").RecentLogins); got != 4 {
+		t.Errorf("Expected 4 remembered logins, got %d", got)
+	}
+
+	// A new address alone, or an odd hour alone, is not enough
+	if w := login("198.51.100.7", "Firefox", credentials); w.Code != http.StatusOK {
+		t.Errorf("Expected login from a new address to succeed, got %d", w.Code)
+	}
+	clock.Advance(12 * time.Hour)
+	if w := login("192.0.2.1", "Firefox", credentials); w.Code != http.StatusOK {
+		t.Errorf("Expected login at an odd hour to succeed, got %d", w.Code)
+	}
+	clock.Advance(-12 * time.Hour)
+
+	// A new device on a new network is challenged with an emailed code
+	w := login("203.0.113.9", "Chrome", credentials)
+	var response Response
+	json.NewDecoder(w.Body).Decode(&response)
+	data, _ := response.Data.(map[string]interface{})
+	if w.Code != http.StatusUnauthorized || data["challengeRequired"] != true {
+		t.Fatalf("Expected risky login to be challenged, got %d: %+v", w.Code, response)
+	}
+	var code string
+	for code == "" {
+		select {
+		case msg := <-sent:
+			if msg.Subject == "Your sign-in code" {
+				code = regexp.MustCompile(`\b\d{6}\b`).FindString(msg.Body)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected a challenge code email")
+		}
+	}
+	if events := server.audit.Recent(0); events[0].Type != AuditLoginChallenged || events[0].Details["signals"] != "new_ip,new_device" {
+		t.Errorf("Expected a login_challenged event for new_ip,new_device, got %+v", events[0])
+	}
+
+	wrong := credentials
+	wrong.EmailCode = "000000"
+	if code == wrong.EmailCode {
+		wrong.EmailCode = "111111"
+	}
+	if w := login("203.0.113.9", "Chrome", wrong); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong code to be refused, got %d", w.Code)
+	}
+	answered := credentials
+	answered.EmailCode = code
+	if w := login("203.0.113.9", "Chrome", answered); w.Code != http.StatusOK {
+		t.Fatalf("Expected the emailed code to complete the login, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := login("203.0.113.9", "Chrome", credentials); w.Code != http.StatusOK {
+		t.Errorf("Expected the new device to be known after a completed login, got %d", w.Code)
+	}
+
+	// Weights are configurable and unknown signals are ignored
+	weights := parseRiskRules("new_ip=60, bogus=5, velocity=x")
+	if weights[RiskNewIP] != 60 || weights[RiskVelocity] != defaultRiskWeights[RiskVelocity] || len(weights) != len(defaultRiskWeights) {
+		t.Errorf("Unexpected risk weights %v", weights)
+	}
+}
+
+func TestIdentityLinking(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+	cookies := registerAndLogin(t, server, "linker", "linker@example.com", "password123")
+	registerAndLogin(t, server, "other", "other@example.com", "password123")
+	user := findUser(t, server, "linker")
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+
+	// A provider asserting the email of an unlinked account cannot sign in to it
+	if _, err := server.UserForIdentity(ctx, "github", "gh-1", "Linker@example.com"); !errors.Is(err, ErrIdentityConflict) {
+		t.Errorf("Expected ErrIdentityConflict for a matching email, got %v", err)
+	}
+	if _, err := server.UserForIdentity(ctx, "github", "gh-1", "new@example.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound for an unknown identity, got %v", err)
+	}
+
+	github, err := server.LinkIdentity(ctx, user.ID, Identity{Provider: "github", Subject: "gh-1"})
+	if err != nil || !ids.HasPrefix(github.ID, ids.PrefixIdentity) {
+		t.Fatalf("Failed to link identity: %+v %v", github, err)
+	}
+	if _, err := server.LinkIdentity(ctx, findUser(t, server, "other").ID, Identity{Provider: "github", Subject: "gh-1"}); !errors.Is(err, ErrIdentityConflict) {
+		t.Errorf("Expected linking another user's identity to conflict, got %v", err)
+	}
+	if found, err := server.UserForIdentity(ctx, "github", "gh-1", "linker@example.com"); err != nil || found.ID != user.ID {
+		t.Errorf("Expected the linked identity to find its user, got %+v %v", found, err)
+	}
+
+	w := request("GET", "/api/identities")
+	var listed struct {
+		Data IdentitiesResponse `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&listed)
+	if w.Code != http.StatusOK || !listed.Data.Password || len(listed.Data.Identities) != 1 || listed.Data.Identities[0].ID != github.ID {
+		t.Fatalf("Unexpected identities %d: %+v", w.Code, listed.Data)
+	}
+
+	// The password can go while the identity remains, but not both
+	if w := request("DELETE", "/api/identities/password"); w.Code != http.StatusOK {
+		t.Fatalf("Expected removing the password to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := request("DELETE", "/api/identities/"+github.ID); w.Code != http.StatusConflict {
+		t.Errorf("Expected removing the last sign-in method to conflict, got %d", w.Code)
+	}
+	if w := request("DELETE", "/api/identities/password"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected removing a missing password to be 404, got %d", w.Code)
+	}
+
+	loginBody, _ := json.Marshal(LoginRequest{Username: "linker", Password: "password123"})
+	w = httptest.NewRecorder()
+	server.Router().ServeHTTP(w, jsonRequest("POST", "/api/login", loginBody))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected password login to fail once the password is removed, got %d", w.Code)
+	}
+	if events := server.audit.Recent(0); events[1].Type != AuditIdentityUnlinked || events[1].Details["provider"] != "password" {
+		t.Errorf("Expected an identity_unlinked event, got %+v", events[1])
+	}
+}
+
+func TestAccountMerge(t *testing.T) {
+	t.Setenv("MERGE_GRACE_PERIOD", "1h")
+	clock := &frozenClock{now: time.Now()}
+	server := newTestServer(t, WithClock(clock))
+	ctx := context.Background()
+
+	keeperCookies := registerAndLogin(t, server, "keeper", "keeper@example.com", "password123")
+	oldCookies := registerAndLogin(t, server, "oldacct", "old@example.com", "password456")
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "adminpass123")
+	old := findUser(t, server, "oldacct")
+	google, err := server.LinkIdentity(ctx, old.ID, Identity{Provider: "google", Subject: "g-1"})
+	if err != nil {
+		t.Fatalf("Failed to link identity: %v", err)
+	}
+	old = findUser(t, server, "oldacct")
+	old.Locale = "de"
+	server.authHandler.users.Update(ctx, old)
+	keeper := findUser(t, server, "keeper")
+	keeper.Locale = ""
+	server.authHandler.users.Update(ctx, keeper)
+
+	post := func(path string, body interface{}, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		r := jsonRequest("POST", path, encoded)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+
+	if w := post("/api/account/merge", MergeRequest{Username: "oldacct", Password: "wrong"}, keeperCookies); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a merge with the wrong password to be refused, got %d", w.Code)
+	}
+	w := post("/api/account/merge", MergeRequest{Username: "oldacct", Password: "password456"}, keeperCookies)
+	var merged struct {
+		Data MergeResponse `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&merged)
+	if w.Code != http.StatusOK || merged.Data.Identities != 1 || merged.Data.Sessions != 1 {
+		t.Fatalf("Unexpected merge response %d: %+v", w.Code, merged.Data)
+	}
+
+	keeper = findUser(t, server, "keeper")
+	if len(keeper.Identities) != 1 || keeper.Identities[0].ID != google.ID || keeper.Locale != "de" {
+		t.Errorf("Expected identity and locale to move to the surviving account, got %+v %q", keeper.Identities, keeper.Locale)
+	}
+	if found, err := server.UserForIdentity(ctx, "google", "g-1", ""); err != nil || found.ID != keeper.ID {
+		t.Errorf("Expected the moved identity to sign in to the surviving account, got %+v %v", found, err)
+	}
+
+	// The merged account's session now belongs to the survivor, and the
+	// merged account can no longer sign in
+	profile := httptest.NewRequest("GET", "/api/profile", nil)
+	for _, cookie := range oldCookies {
+		profile.AddCookie(cookie)
+	}
+	pw := httptest.NewRecorder()
+	server.Router().ServeHTTP(pw, profile)
+	if !strings.Contains(pw.Body.String(), `"username":"keeper"`) {
+		t.Errorf("Expected the merged account's session to be signed in to keeper, got %s", pw.Body.String())
+	}
+	if w := post("/api/login", LoginRequest{Username: "oldacct", Password: "password456"}, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected login to a merged account to be refused, got %d", w.Code)
+	}
+	if w := post("/api/account/merge", MergeRequest{Username: "oldacct", Password: "password456"}, keeperCookies); w.Code != http.StatusConflict {
+		t.Errorf("Expected merging twice to conflict, got %d", w.Code)
+	}
+
+	// Undo within the grace period gives everything back
+	if w := post("/api/account/merge/undo", UnmergeRequest{Username: "oldacct"}, keeperCookies); w.Code != http.StatusOK {
+		t.Fatalf("Expected undo to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	keeper, old = findUser(t, server, "keeper"), findUser(t, server, "oldacct")
+	if len(keeper.Identities) != 0 || keeper.Locale != "" || len(old.Identities) != 1 || old.Merge != nil {
+		t.Errorf("Expected undo to restore both accounts, got %+v and %+v", keeper, old)
+	}
+	if w := post("/api/login", LoginRequest{Username: "oldacct", Password: "password456"}, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the restored account to sign in, got %d", w.Code)
+	}
+
+	// Admins can merge by ID; once the grace period passes it is final
+	if w := post("/api/admin/users/merge", AdminMergeRequest{SourceID: old.ID, TargetID: keeper.ID}, keeperCookies); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the admin merge to need an admin, got %d", w.Code)
+	}
+	if w := post("/api/admin/users/merge", AdminMergeRequest{SourceID: old.ID, TargetID: keeper.ID}, adminCookies); w.Code != http.StatusOK {
+		t.Fatalf("Expected the admin merge to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	clock.Advance(2 * time.Hour)
+	if w := post("/api/admin/users/"+old.ID+"/unmerge", nil, adminCookies); w.Code != http.StatusConflict {
+		t.Errorf("Expected undo after the grace period to conflict, got %d", w.Code)
+	}
+	if events := server.audit.Recent(0); events[0].Type != AuditAccountMerged || events[0].Details["source"] != old.ID {
+		t.Errorf("Expected an account_merged event, got %+v", events[0])
+	}
+}
+
+func TestUsernamePolicy(t *testing.T) {
+	server := newTestServer(t)
+
+	register := func(username string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(RegisterRequest{Username: username, Email: strings.ToLower(username) + "@example.com", Password: "password123"})
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, jsonRequest("POST", "/api/register", body))
+		return w
+	}
+
+	for _, username := range []string{"admin", "Support", "ad_min01", "root", "sh1tlord"} {
+		if w := register(username); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be refused, got %d", username, w.Code)
+		}
+	}
+	if w := register("supporter"); w.Code != http.StatusCreated {
+		t.Errorf("Expected a name merely containing a reserved one to pass, got %d: %s", w.Code, w.Body.String())
+	}
+
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	userCookies := registerAndLogin(t, server, "renamer", "renamer@example.com", "password123")
+
+	send := func(method, path string, body interface{}, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		r := jsonRequest(method, path, encoded)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+
+	if w := send("PATCH", "/api/profile", map[string]string{"username": "api"}, userCookies); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected renaming to a reserved name to be refused, got %d", w.Code)
+	}
+
+	// Admins manage the lists at runtime
+	if w := send("PUT", "/api/admin/username-policy", map[string][]string{"blockedPatterns": {"("}}, adminCookies); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid pattern to be rejected, got %d", w.Code)
+	}
+	if w := send("PUT", "/api/admin/username-policy", map[string][]string{"reserved": {"billing"}, "blockedPatterns": {"^bot"}}, userCookies); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the policy to need an admin, got %d", w.Code)
+	}
+	w := send("PUT", "/api/admin/username-policy", map[string][]string{"reserved": {"billing"}, "blockedPatterns": {"^bot"}}, adminCookies)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"reserved":["billing"]`) {
+		t.Fatalf("Unexpected policy update response %d: %s", w.Code, w.Body.String())
+	}
+	if w := register("Billing-2"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected the new reserved name to be refused, got %d", w.Code)
+	}
+	if w := register("botnet"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected the new pattern to be refused, got %d", w.Code)
+	}
+	if w := register("root"); w.Code != http.StatusCreated {
+		t.Errorf("Expected root to be allowed once no longer reserved, got %d", w.Code)
+	}
+}
+
+func TestChangeUsername(t *testing.T) {
+	t.Setenv("USERNAME_CHANGE_COOLDOWN", "2h")
+	t.Setenv("USERNAME_RESERVATION_PERIOD", "10h")
+	clock := &frozenClock{now: time.Now()}
+	server := newTestServer(t, WithClock(clock))
+
+	aliceCookies := registerAndLogin(t, server, "alice", "alice@example.com", "password123")
+	bobCookies := registerAndLogin(t, server, "bob", "bob@example.com", "password123")
+
+	send := func(method, path string, body interface{}, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		r := jsonRequest(method, path, encoded)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+	rename := func(username string) *httptest.ResponseRecorder {
+		return send("POST", "/api/change-username", ChangeUsernameRequest{CurrentPassword: "password123", NewUsername: username}, aliceCookies)
+	}
+	register := func(username string) *httptest.ResponseRecorder {
+		return send("POST", "/api/register", RegisterRequest{Username: username, Email: username + "@example.net", Password: "password123"}, nil)
+	}
+
+	if w := send("POST", "/api/change-username", ChangeUsernameRequest{CurrentPassword: "wrong", NewUsername: "alice2"}, aliceCookies); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong password to be refused, got %d", w.Code)
+	}
+	if w := rename("bob"); w.Code != http.StatusConflict {
+		t.Errorf("Expected a taken username to be refused, got %d", w.Code)
+	}
+	if w := rename("alice2"); w.Code != http.StatusOK {
+		t.Fatalf("Expected the username change to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if event := server.audit.Recent(1)[0]; event.Type != AuditUsernameChanged || event.Details["from"] != "alice" || event.Details["to"] != "alice2" {
+		t.Errorf("Expected the change to be audited, got %+v", event)
+	}
+
+	w := rename("alice3")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a second change within the cooldown to get %d with Retry-After, got %d", http.StatusTooManyRequests, w.Code)
+	}
+
+	// The old name stays reserved for its owner
+	if w := send("PATCH", "/api/profile", map[string]string{"username": "alice"}, bobCookies); w.Code != http.StatusConflict {
+		t.Errorf("Expected another user to be refused the old name, got %d", w.Code)
+	}
+	if w := register("alice"); w.Code != http.StatusConflict {
+		t.Errorf("Expected registration to be refused the old name, got %d", w.Code)
+	}
+	owner, err := server.authHandler.userByFormerUsername(context.Background(), "alice")
+	if err != nil || owner.Username != "alice2" {
+		t.Errorf("Expected the old name to resolve to the renamed account, got %v, %v", owner, err)
+	}
+
+	// Profile updates follow the same rules once the cooldown passes
+	clock.Advance(3 * time.Hour)
+	if w := send("PATCH", "/api/profile", map[string]string{"username": "alice"}, aliceCookies); w.Code != http.StatusOK {
+		t.Fatalf("Expected the owner to take back their old name, got %d: %s", w.Code, w.Body.String())
+	}
+	if user := findUser(t, server, "alice"); len(user.UsernameHistory) != 2 || user.UsernameHistory[1].Username != "alice2" {
+		t.Errorf("Expected both former names in the history, got %+v", user.UsernameHistory)
+	}
+
+	clock.Advance(11 * time.Hour)
+	if w := register("alice2"); w.Code != http.StatusCreated {
+		t.Errorf("Expected the name to be free once the reservation lapses, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPublicProfile(t *testing.T) {
+	server := newTestServer(t)
+	cookies := registerAndLogin(t, server, "alice", "alice@example.com", "password123")
+
+	send := func(method, path string, body interface{}, header map[string]string) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		r := jsonRequest(method, path, encoded)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		for name, value := range header {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+	public := func(username string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/users/"+username+"/public", nil)
+		for name, value := range header {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+
+	if w := send("PATCH", "/api/profile", map[string]string{"avatarUrl": "javascript:alert(1)"}, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a non-https avatar to be refused, got %d", w.Code)
+	}
+	if w := send("PATCH", "/api/profile", map[string]string{"bio": strings.Repeat("a", maxBioLength+1)}, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an overlong bio to be refused, got %d", w.Code)
+	}
+	w := send("PATCH", "/api/profile", map[string]string{"displayName": "Alice A.", "avatarUrl": "https://cdn.example.com/a.png", "bio": "Hello"}, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the profile update to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Profiles are private until the user makes them public, and look
+	// the same as a missing user until then
+	if w := public("alice", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a private profile to be hidden, got %d", w.Code)
+	}
+	if w := public("nobody", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a missing user to get %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	w = send("PUT", "/api/preferences", map[string]interface{}{"profile": ProfileVisibility{Public: true, DisplayName: true}}, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the preferences update to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if user := findUser(t, server, "alice"); !user.Preferences.SecurityAlerts {
+		t.Error("Expected preferences missing from the update to be kept")
+	}
+
+	w = public("alice", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Cache-Control"), "public") || w.Header().Get("ETag") == "" {
+		t.Fatalf("Expected a cacheable public profile, got %d with headers %v", w.Code, w.Header())
+	}
+	var response struct {
+		Data PublicProfile `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Data != (PublicProfile{Username: "alice", DisplayName: "Alice A."}) {
+		t.Errorf("Expected only the fields made visible, got %+v", response.Data)
+	}
+	if w := public("alice", map[string]string{"If-None-Match": w.Header().Get("ETag")}); w.Code != http.StatusNotModified {
+		t.Errorf("Expected a matching If-None-Match to get %d, got %d", http.StatusNotModified, w.Code)
+	}
+
+	// A former username redirects to the current one
+	if w := send("POST", "/api/change-username", ChangeUsernameRequest{CurrentPassword: "password123", NewUsername: "alicia"}, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the username change to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	w = public("alice", nil)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/api/users/alicia/public" {
+		t.Errorf("Expected the old name to redirect, got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestAdminUserSearch(t *testing.T) {
+	server := newTestServer(t)
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	userCookies := registerAndLogin(t, server, "malice", "m@example.org", "password123")
+	registerAndLogin(t, server, "ali", "ali@example.com", "password123")
+	registerAndLogin(t, server, "alison", "alison@example.com", "password123")
+	registerAndLogin(t, server, "bob", "alicefan@example.net", "password123")
+
+	search := func(query string, cookies []*http.Cookie) (*httptest.ResponseRecorder, UserSearchResponse) {
+		r := httptest.NewRequest("GET", "/api/admin/users/search?"+query, nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		var response struct {
+			Data UserSearchResponse `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response.Data
+	}
+	usernames := func(response UserSearchResponse) []string {
+		var names []string
+		for _, result := range response.Results {
+			names = append(names, result.User.Username)
+		}
+		return names
+	}
+
+	if w, _ := search("q=ali", userCookies); w.Code != http.StatusForbidden {
+		t.Errorf("Expected search to need an admin, got %d", w.Code)
+	}
+	if w, _ := search("q=", adminCookies); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an empty query to be refused, got %d", w.Code)
+	}
+
+	// Exact, then prefix, then substring matches; username before email
+	w, response := search("q=ALI", adminCookies)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the search to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := strings.Join(usernames(response), ","); got != "ali,alison,bob,malice" || response.Total != 4 {
+		t.Errorf("Unexpected ranking %s (total %d)", got, response.Total)
+	}
+	if response.Results[2].Field != "email" || response.Results[2].Match != "prefix" {
+		t.Errorf("Expected bob to match on the email prefix, got %+v", response.Results[2])
+	}
+
+	_, page := search("q=ali&offset=1&limit=2", adminCookies)
+	if got := strings.Join(usernames(page), ","); got != "alison,bob" || page.Total != 4 {
+		t.Errorf("Unexpected page %s (total %d)", got, page.Total)
+	}
+
+	// Longer queries and later changes are found through the index
+	r := jsonRequest("PATCH", "/api/profile", []byte(`{"displayName":"Alicia Keys"}`))
+	for _, cookie := range userCookies {
+		r.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	server.Router().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the profile update to succeed, got %d", w.Code)
+	}
+	_, response = search("q=cia+ke", adminCookies)
+	if got := strings.Join(usernames(response), ","); got != "malice" || response.Results[0].Field != "displayName" {
+		t.Errorf("Expected the new display name to be found, got %s", got)
+	}
+}
+
+func TestAccountDeletionRetention(t *testing.T) {
+	t.Setenv("DELETED_USER_RETENTION", "1h")
+	clock := &frozenClock{now: time.Now()}
+	server := newTestServer(t, WithClock(clock))
+
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	userCookies := registerAndLogin(t, server, "doomed", "doomed@example.com", "password123")
+	doomed := findUser(t, server, "doomed")
+
+	send := func(method, path string, body interface{}, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		var encoded []byte
+		if body != nil {
+			encoded, _ = json.Marshal(body)
+		}
+		r := jsonRequest(method, path, encoded)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+	login := func() int {
+		return send("POST", "/api/login", LoginRequest{Username: "doomed", Password: "password123"}, nil).Code
+	}
+
+	if w := send("DELETE", "/api/account", DeleteAccountRequest{Password: "wrong"}, userCookies); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong password to be refused, got %d", w.Code)
+	}
+	if w := send("DELETE", "/api/account", DeleteAccountRequest{Password: "password123"}, userCookies); w.Code != http.StatusOK {
+		t.Fatalf("Expected the account to be deleted, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send("GET", "/api/profile", nil, userCookies); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the deleted account's session to stop working, got %d", w.Code)
+	}
+	if code := login(); code != http.StatusUnauthorized {
+		t.Errorf("Expected a deleted account to be unable to sign in, got %d", code)
+	}
+	if w := send("POST", "/api/register", RegisterRequest{Username: "doomed", Email: "other@example.com", Password: "password123"}, nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected the tombstone to keep its username, got %d", w.Code)
+	}
+
+	// Admins see the tombstone and can restore it within the window
+	w := send("GET", "/api/admin/users/deleted", nil, adminCookies)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"username":"doomed"`) || !strings.Contains(w.Body.String(), `"purgeAt"`) {
+		t.Fatalf("Expected the deleted account to be listed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send("POST", "/api/admin/users/"+doomed.ID+"/restore", nil, userCookies); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the deleted account to be unable to restore itself, got %d", w.Code)
+	}
+	if w := send("POST", "/api/admin/users/"+doomed.ID+"/restore", nil, adminCookies); w.Code != http.StatusOK {
+		t.Fatalf("Expected the account to be restored, got %d: %s", w.Code, w.Body.String())
+	}
+	if code := login(); code != http.StatusOK {
+		t.Errorf("Expected the restored account to sign in, got %d", code)
+	}
+
+	// Once the retention period passes the account is purged for good
+	w = send("DELETE", "/api/admin/users/"+doomed.ID, AdminDeleteUserRequest{Reason: "spam"}, adminCookies)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"reason":"spam"`) {
+		t.Fatalf("Expected the admin deletion to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if purged := server.gc.run(clock.Now())["deleted_users"]; purged != 0 {
+		t.Errorf("Expected nothing to be purged within the retention period, got %d", purged)
+	}
+	clock.Advance(2 * time.Hour)
+	if w := send("POST", "/api/admin/users/"+doomed.ID+"/restore", nil, adminCookies); w.Code != http.StatusConflict {
+		t.Errorf("Expected restoring after the retention period to be refused, got %d", w.Code)
+	}
+	if purged := server.gc.run(clock.Now())["deleted_users"]; purged != 1 {
+		t.Errorf("Expected the deleted account to be purged, got %d", purged)
+	}
+	if _, err := server.authHandler.users.Get(context.Background(), doomed.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected the purged account to be gone, got %v", err)
+	}
+	if event := server.audit.Recent(1)[0]; event.Type != AuditAccountPurged || event.UserID != doomed.ID {
+		t.Errorf("Expected the purge to be audited, got %+v", event)
+	}
+	if w := send("POST", "/api/register", RegisterRequest{Username: "doomed", Email: "doomed@example.com", Password: "password123"}, nil); w.Code != http.StatusCreated {
+		t.Errorf("Expected the username to be free after the purge, got %d", w.Code)
+	}
+}
+
+func TestAccountSuspension(t *testing.T) {
+	t.Setenv("SUSPENSION_APPEAL_CONTACT", "appeals@example.com")
+	clock := &frozenClock{now: time.Now()}
+	server := newTestServer(t, WithClock(clock))
+
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	admin := findUser(t, server, "admin")
+	userCookies := registerAndLogin(t, server, "troll", "troll@example.com", "password123")
+	troll := findUser(t, server, "troll")
+
+	send := func(method, path string, body interface{}, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		r := jsonRequest(method, path, encoded)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+	login := func() *httptest.ResponseRecorder {
+		return send("POST", "/api/login", LoginRequest{Username: "troll", Password: "password123"}, nil)
+	}
+
+	if w := send("POST", "/api/admin/users/"+troll.ID+"/suspend", SuspendUserRequest{}, adminCookies); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a suspension without a reason to be refused, got %d", w.Code)
+	}
+	if w := send("POST", "/api/admin/users/"+admin.ID+"/suspend", SuspendUserRequest{Reason: "oops"}, adminCookies); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected admins to be unable to suspend themselves, got %d", w.Code)
+	}
+
+	expires := clock.Now().Add(2 * time.Hour)
+	w := send("POST", "/api/admin/users/"+troll.ID+"/suspend", SuspendUserRequest{Reason: "Harassment", ExpiresAt: &expires}, adminCookies)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the suspension to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send("GET", "/api/profile", nil, userCookies); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the suspended user's sessions to be revoked, got %d", w.Code)
+	}
+
+	w = login()
+	var refused struct {
+		Data struct {
+			Error         string    `json:"error"`
+			Reason        string    `json:"reason"`
+			ExpiresAt     time.Time `json:"expiresAt"`
+			AppealContact string    `json:"appealContact"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &refused)
+	if w.Code != http.StatusForbidden || refused.Data.Error != "account_suspended" || refused.Data.Reason != "Harassment" ||
+		!refused.Data.ExpiresAt.Equal(expires) || refused.Data.AppealContact != "appeals@example.com" {
+		t.Errorf("Expected a structured account_suspended error, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := send("POST", "/api/login", LoginRequest{Username: "troll", Password: "wrong"}, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong password not to reveal the suspension, got %d", w.Code)
+	}
+
+	// Suspensions lapse on their own
+	clock.Advance(3 * time.Hour)
+	if w := login(); w.Code != http.StatusOK {
+		t.Errorf("Expected the user to sign in once the suspension expired, got %d", w.Code)
+	}
+	if w := send("POST", "/api/admin/users/"+troll.ID+"/unsuspend", nil, adminCookies); w.Code != http.StatusConflict {
+		t.Errorf("Expected lifting an expired suspension to conflict, got %d", w.Code)
+	}
+
+	// Bans last until lifted
+	if w := send("POST", "/api/admin/users/"+troll.ID+"/suspend", SuspendUserRequest{Reason: "Spam"}, adminCookies); w.Code != http.StatusOK {
+		t.Fatalf("Expected the ban to succeed, got %d", w.Code)
+	}
+	clock.Advance(20 * time.Hour)
+	if w := login(); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a ban not to expire, got %d", w.Code)
+	}
+	if w := send("POST", "/api/admin/users/"+troll.ID+"/unsuspend", nil, adminCookies); w.Code != http.StatusOK {
+		t.Fatalf("Expected the ban to be lifted, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := login(); w.Code != http.StatusOK {
+		t.Errorf("Expected the user to sign in once the ban was lifted, got %d", w.Code)
+	}
+}
+
+func TestSecurityChangeNotices(t *testing.T) {
+	server := newTestServer(t)
+	sent := make(recordingMailer, 10)
+	server.authHandler.mailer = sent
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	post := func(path string, body interface{}) int {
+		data, _ := json.Marshal(body)
+		req := jsonRequest("POST", path, data)
+		req.Header.Set("User-Agent", "NoticeTest/1.0")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w.Code
+	}
+	next := func() mailer.Message {
+		t.Helper()
+		select {
+		case msg := <-sent:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected a security notice")
+		}
+		return mailer.Message{}
+	}
+
+	// A password change is reported with where it came from and a link to
+	// take the account back
+	code := post("/api/change-password", ChangePasswordRequest{
+		CurrentPassword: "password123",
+		NewPassword:     "newpassword123",
+	})
+	if code != http.StatusOK {
+		t.Fatalf("Expected password change to succeed, got %d", code)
+	}
+	msg := next()
+	if msg.To != "test@example.com" || msg.Subject != "Your password was changed" {
+		t.Errorf("Expected a password notice to test@example.com, got %q to %s", msg.Subject, msg.To)
+	}
+	for _, want := range []string{"NoticeTest/1.0", "IP address:", "/reset-password?token="} {
+		if !strings.Contains(msg.Body, want) {
+			t.Errorf("Expected the notice to contain %q, got %q", want, msg.Body)
+		}
+	}
+
+	// An email change is reported to the old address
+	code = post("/api/change-email", ChangeEmailRequest{
+		CurrentPassword: "newpassword123",
+		NewEmail:        "new@example.com",
+	})
+	if code != http.StatusOK {
+		t.Fatalf("Expected email change to succeed, got %d", code)
+	}
+	if msg := next(); msg.To != "test@example.com" || msg.Subject != "Your email address was changed" {
+		t.Errorf("Expected an email change notice to the old address, got %q to %s", msg.Subject, msg.To)
+	}
+
+	if code := post("/api/api-secret", nil); code != http.StatusOK {
+		t.Fatalf("Expected API secret rotation to succeed, got %d", code)
+	}
+	if msg := next(); msg.To != "new@example.com" || msg.Subject != "A new API key was created" {
+		t.Errorf("Expected an API key notice to new@example.com, got %q to %s", msg.Subject, msg.To)
+	}
+
+	// Policy can turn a notice off, whatever the user's preferences
+	server.authHandler.config.SecurityNotifications[NoticeAPIKeyCreated] = false
+	if code := post("/api/api-secret", nil); code != http.StatusOK {
+		t.Fatalf("Expected API secret rotation to succeed, got %d", code)
+	}
+	select {
+	case msg := <-sent:
+		t.Errorf("Expected no notice once turned off, got %q", msg.Subject)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	notices := parseSecurityNotifications("api_key_created=off, bogus=off, email_changed=maybe")
+	if notices[NoticeAPIKeyCreated] || !notices[NoticeEmailChanged] || !notices[NoticePasswordChanged] || len(notices) != len(securityNotices) {
+		t.Errorf("Unexpected parsed notices: %v", notices)
+	}
+}
+
+// failingMailer refuses every message
+type failingMailer struct{}
+
+func (failingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	return errors.New("mail server unavailable")
+}
+
+func TestOutboxDelivery(t *testing.T) {
+	clock := &frozenClock{now: time.Now()}
+	server := newTestServer(t, WithClock(clock))
+	server.authHandler.config.OutboxMaxAttempts = 2
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	send := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		r := jsonRequest(method, path, encoded)
+		for _, cookie := range adminCookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+	// waitFor polls the outbox until check holds, since attempts run in
+	// the background
+	waitFor := func(what string, check func([]OutboxMessage) bool) []OutboxMessage {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			messages := server.authHandler.outbox.list()
+			if check(messages) {
+				return messages
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s, outbox holds %+v", what, messages)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// A failed first attempt keeps the email for a retry
+	server.authHandler.mailer = failingMailer{}
+	body, _ := json.Marshal(PasswordResetRequest{Email: "test@example.com"})
+	server.PasswordResetRequestHandler(httptest.NewRecorder(), jsonRequest("POST", "/api/password-reset/request", body))
+	messages := waitFor("the first attempt", func(m []OutboxMessage) bool { return len(m) == 1 && m[0].Attempts == 1 })
+	id := messages[0].ID
+	if messages[0].LastError != "mail server unavailable" || messages[0].DeadAt != nil {
+		t.Errorf("Expected a failed attempt awaiting retry, got %+v", messages[0])
+	}
+
+	// Retries wait for their backoff, and running out of attempts
+	// dead-letters the message
+	if n := server.authHandler.dispatchOutbox(clock.Now()); n != 0 {
+		t.Errorf("Expected no retry before the backoff passed, got %d", n)
+	}
+	clock.Advance(outboxRetryBase)
+	if n := server.authHandler.dispatchOutbox(clock.Now()); n != 1 {
+		t.Errorf("Expected the email to be retried, got %d attempts", n)
+	}
+	if messages := server.authHandler.outbox.list(); len(messages) != 1 || messages[0].DeadAt == nil {
+		t.Fatalf("Expected the email to be dead-lettered, got %+v", messages)
+	}
+
+	// The outbox survives a restart
+	restored, err := newOutbox(server.config.OutboxFile, time.Hour, server.logger)
+	if err != nil {
+		t.Fatalf("Failed to restore the outbox: %v", err)
+	}
+	if messages := restored.list(); len(messages) != 1 || messages[0].ID != id || messages[0].Email.To != "test@example.com" {
+		t.Errorf("Expected the dead letter to be restored, got %+v", messages)
+	}
+
+	// Admins see dead letters without their contents
+	w := send("GET", "/api/admin/outbox?status=dead", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), id) || !strings.Contains(w.Body.String(), "test@example.com") {
+		t.Fatalf("Expected the dead letter to be listed, got %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "reset-password") {
+		t.Errorf("Expected email bodies to be left out of the listing, got %s", w.Body.String())
+	}
+	if w := send("GET", "/api/admin/outbox?status=pending", nil); strings.Contains(w.Body.String(), id) {
+		t.Errorf("Expected dead letters to be left out of pending messages, got %s", w.Body.String())
+	}
+
+	// and can redeliver them
+	sent := make(recordingMailer, 10)
+	server.authHandler.mailer = sent
+	if w := send("POST", "/api/admin/outbox/msg_unknown/redeliver", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown message to be refused, got %d", w.Code)
+	}
+	if w := send("POST", "/api/admin/outbox/"+id+"/redeliver", nil); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected redelivery to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+	select {
+	case msg := <-sent:
+		if msg.To != "test@example.com" || !strings.Contains(msg.Body, "/reset-password?token=") {
+			t.Errorf("Expected the reset email to be redelivered, got %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the reset email to be redelivered")
+	}
+	waitFor("the delivered email to leave the outbox", func(m []OutboxMessage) bool { return len(m) == 0 })
+
+	// Post hook webhooks are retried the same way
+	var calls atomic.Int32
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer hookServer.Close()
+	cfg := server.config
+	cfg.HookWebhookURL = hookServer.URL
+	cfg.HookWebhookEvents = []string{HookPostRegister}
+	server.authHandler.webhooks = registerWebhookHooks(server.Hooks(), cfg, server.authHandler.enqueue)
+
+	registerAndLogin(t, server, "hooked", "hooked@example.com", "password123")
+	messages = waitFor("the webhook's first attempt", func(m []OutboxMessage) bool { return len(m) == 1 && m[0].Attempts == 1 })
+	if messages[0].Kind != OutboxKindWebhook || messages[0].Label != HookPostRegister {
+		t.Errorf("Expected a post_register webhook, got %+v", messages[0])
+	}
+	clock.Advance(outboxRetryBase)
+	server.authHandler.dispatchOutbox(clock.Now())
+	if messages := server.authHandler.outbox.list(); len(messages) != 0 || calls.Load() != 2 {
+		t.Errorf("Expected the webhook to be delivered on retry, got %d calls and %+v", calls.Load(), messages)
+	}
+}
+
+func TestWebhookAdmin(t *testing.T) {
+	clock := &frozenClock{now: time.Now()}
+	server := newTestServer(t, WithClock(clock))
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+
+	var failing atomic.Bool
+	var postCalls atomic.Int32
+	failing.Store(true)
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(payload), HookPostRegister) {
+			postCalls.Add(1)
+			if failing.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}
+	}))
+	defer hookServer.Close()
+	cfg := server.config
+	cfg.HookWebhookURL = hookServer.URL
+	cfg.HookWebhookEvents = []string{HookPreLogin, HookPostRegister}
+	server.authHandler.webhooks = registerWebhookHooks(server.Hooks(), cfg, server.authHandler.enqueue)
+
+	send := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		r := jsonRequest(method, path, encoded)
+		for _, cookie := range adminCookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+	deliveries := func(query string) []WebhookAttempt {
+		t.Helper()
+		w := send("GET", "/api/admin/webhooks/deliveries"+query, nil)
+		var response struct{ Data []WebhookAttempt }
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Expected deliveries, got %d: %s", w.Code, w.Body.String())
+		}
+		return response.Data
+	}
+	waitFor := func(what string, check func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !check() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	registerAndLogin(t, server, "alice", "alice@example.com", "password123")
+	waitFor("the failed post hook", func() bool {
+		messages := server.authHandler.outbox.list()
+		return len(messages) == 1 && messages[0].Attempts == 1
+	})
+
+	// Failed attempts are listed without their payload, which the single
+	// attempt shows
+	failed := deliveries("?status=failed")
+	if len(failed) != 1 || failed[0].Hook != HookPostRegister || failed[0].StatusCode != http.StatusInternalServerError || failed[0].Payload != nil {
+		t.Fatalf("Expected one failed post_register attempt without payload, got %+v", failed)
+	}
+	w := send("GET", "/api/admin/webhooks/deliveries/"+failed[0].ID, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"username":"alice"`) || !strings.Contains(w.Body.String(), failed[0].MessageID) {
+		t.Errorf("Expected the attempt with its payload and queued message, got %d: %s", w.Code, w.Body.String())
+	}
+	preLogin := deliveries("?hook=" + HookPreLogin)
+	if len(preLogin) != 1 || preLogin[0].failed() {
+		t.Fatalf("Expected one successful pre_login call, got %+v", preLogin)
+	}
+	if w := send("POST", "/api/admin/webhooks/deliveries/"+preLogin[0].ID+"/replay", nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected pre hook calls not to be replayable, got %d", w.Code)
+	}
+
+	// A paused endpoint keeps its webhooks queued
+	if w := send("PUT", "/api/admin/webhooks/endpoints", WebhookEndpointRequest{URL: hookServer.URL, Paused: true}); w.Code != http.StatusOK {
+		t.Fatalf("Expected the endpoint to be paused, got %d: %s", w.Code, w.Body.String())
+	}
+	failing.Store(false)
+	clock.Advance(outboxRetryBase)
+	if n := server.authHandler.dispatchOutbox(clock.Now()); n != 0 {
+		t.Errorf("Expected no attempts while paused, got %d", n)
+	}
+	registerAndLogin(t, server, "bob", "bob@example.com", "password123")
+	endpoints := server.authHandler.webhookEndpoints()
+	if len(endpoints) != 1 || !endpoints[0].Paused || !endpoints[0].Configured || endpoints[0].Pending != 2 || endpoints[0].LastAttempt == nil {
+		t.Fatalf("Expected the paused endpoint with two pending webhooks, got %+v", endpoints)
+	}
+
+	if w := send("PUT", "/api/admin/webhooks/endpoints", WebhookEndpointRequest{URL: hookServer.URL}); w.Code != http.StatusOK {
+		t.Fatalf("Expected the endpoint to be resumed, got %d: %s", w.Code, w.Body.String())
+	}
+	if n := server.authHandler.dispatchOutbox(clock.Now()); n != 2 || len(server.authHandler.outbox.list()) != 0 {
+		t.Errorf("Expected both webhooks to go out once resumed, got %d attempts", n)
+	}
+
+	// Delivered webhooks can be replayed
+	succeeded := deliveries("?status=succeeded&hook=" + HookPostRegister)
+	if len(succeeded) != 2 {
+		t.Fatalf("Expected two successful post_register attempts, got %+v", succeeded)
+	}
+	calls := postCalls.Load()
+	if w := send("POST", "/api/admin/webhooks/deliveries/"+succeeded[0].ID+"/replay", nil); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected the replay to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+	waitFor("the replay", func() bool {
+		return postCalls.Load() == calls+1 && len(server.authHandler.outbox.list()) == 0
+	})
+	if w := send("POST", "/api/admin/webhooks/deliveries/dlv_unknown/replay", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown delivery to be refused, got %d", w.Code)
+	}
+}
+
+func TestSLOMetrics(t *testing.T) {
+	clock := &frozenClock{now: time.Now()}
+	server := newTestServer(t, WithClock(clock))
+	registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	login := func(password string) {
+		body, _ := json.Marshal(LoginRequest{Username: "testuser", Password: password})
+		server.Router().ServeHTTP(httptest.NewRecorder(), jsonRequest("POST", "/api/login", body))
+	}
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	expect := func(metrics string, want ...string) {
+		t.Helper()
+		for _, line := range want {
+			if !strings.Contains(metrics, line) {
+				t.Errorf("Expected metrics to contain %q, got:\n%s", line, metrics)
+			}
+		}
+	}
+
+	// Nothing has gone wrong before anything happens
+	expect(scrape(),
+		`auth_sli_login_success_ratio{backend="memory"} 1`,
+		`auth_sli_mailer_failure_ratio{backend="log"} 0`,
+		`auth_sli_window_seconds 300`)
+
+	// Wrong passwords are the client's doing and leave the ratio alone
+	login("password123")
+	login("wrongpassword")
+	metrics := scrape()
+	expect(metrics,
+		`auth_login_attempts_total{backend="memory",result="success"} 1`,
+		`auth_login_attempts_total{backend="memory",result="rejected"} 1`,
+		`auth_sli_login_success_ratio{backend="memory"} 1`,
+		`auth_request_duration_seconds_bucket{route="login",backend="memory",le="+Inf"} 2`,
+		`auth_request_duration_seconds_count{route="login",backend="memory"} 2`,
+		`auth_session_store_operations_total{backend="memory",result="ok"}`,
+		`auth_sli_session_store_error_ratio{backend="memory"} 0`)
+
+	// A failed email counts against the mailer
+	server.authHandler.mailer = failingMailer{}
+	body, _ := json.Marshal(PasswordResetRequest{Email: "test@example.com"})
+	server.Router().ServeHTTP(httptest.NewRecorder(), jsonRequest("POST", "/api/password-reset/request", body))
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(scrape(), `auth_mailer_sends_total{backend="log",result="error"} 1`) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the failed send, metrics:\n%s", scrape())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	expect(scrape(), `auth_sli_mailer_failure_ratio{backend="log"} 1`)
+
+	// The ratios only cover the window
+	clock.Advance(10 * time.Minute)
+	expect(scrape(), `auth_sli_mailer_failure_ratio{backend="log"} 0`)
+}
+
+func TestAuditSink(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	messages := make(chan string, 16)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			// Messages are framed by octet counting
+			length, err := reader.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(length))
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(reader, msg); err != nil {
+				return
+			}
+			messages <- string(msg)
+		}
+	}()
+
+	t.Setenv("AUDIT_SINK_URL", "tcp://"+listener.Addr().String())
+	t.Setenv("AUDIT_SINK_FORMAT", "CEF")
+	server := newTestServer(t)
+	stop := server.auditSink.start(server.audit)
+	defer stop()
+
+	server.audit.Record(AuditEvent{Type: AuditLoginFailed, UserID: "usr_1", IP: "203.0.113.7", Details: map[string]string{"reason": "bad=password"}})
+	select {
+	case msg := <-messages:
+		for _, want := range []string{
+			"<84>1 ", // authpriv.warning
+			" auth-server - login_failed - CEF:0|auth-server|auth-server|1.0|login_failed|login failed|7|",
+			"suid=usr_1 src=203.0.113.7 reason=bad\\=password",
+		} {
+			if !strings.Contains(msg, want) {
+				t.Errorf("Expected the message to contain %q, got %q", want, msg)
+			}
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the audit event to reach the collector")
+	}
+
+	// Syslog puts the event in structured data
+	encoder := &siem.Encoder{Format: siem.FormatSyslog, Hostname: "host", AppName: "auth-server"}
+	msg, err := encoder.Encode(siem.Event{Time: time.Unix(0, 0), Type: AuditEmailChanged, UserID: "usr_1", Details: map[string]string{"note": `say "hi"]`}, Severity: siem.SeverityNotice})
+	want := `<85>1 1970-01-01T00:00:00Z host auth-server - email_changed [auth@32473 type="email_changed" user="usr_1" note="say \"hi\"\]"] email_changed`
+	if err != nil || string(msg) != want {
+		t.Errorf("Expected %q, got %q (%v)", want, msg, err)
+	}
+
+	// A full queue drops the oldest events and counts them
+	sink := &auditSink{capacity: 2, metrics: server.metrics, logger: server.logger, ready: make(chan struct{}, 1)}
+	for _, eventType := range []string{"first", "second", "third"} {
+		sink.push(AuditEvent{Type: eventType})
+	}
+	if queued := sink.take(); len(queued) != 2 || queued[0].Type != "second" {
+		t.Errorf("Expected the oldest event to be dropped, got %+v", queued)
+	}
+	metricsW := httptest.NewRecorder()
+	server.MetricsHandler(metricsW, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(metricsW.Body.String(), "auth_audit_sink_dropped_total 1") {
+		t.Errorf("Expected the dropped event to be counted, got:\n%s", metricsW.Body.String())
+	}
+}
+
+func TestSecurityPostureReport(t *testing.T) {
+	clock := &frozenClock{now: time.Now()}
+	server := newTestServer(t, WithClock(clock))
+	// The admin stays signed in while the clock moves on
+	server.authHandler.config.SessionTTL = 365 * 24 * time.Hour
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	registerAndLogin(t, server, "=cmd", "fresh@example.com", "password123")
+
+	// A user who proves their email and adds a second factor is only
+	// flagged once they stop signing in
+	registerAndLogin(t, server, "careful", "careful@example.com", "password123")
+	careful := findUser(t, server, "careful")
+	verified := clock.Now()
+	careful.EmailVerifiedAt = &verified
+	careful.TwoFactorEnabled = true
+	server.authHandler.users.Update(context.Background(), careful)
+
+	report := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/admin/reports/security-posture"+query, nil)
+		for _, cookie := range adminCookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) SecurityPostureReport {
+		t.Helper()
+		var response struct{ Data SecurityPostureReport }
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the report, got %d: %s", w.Code, w.Body.String())
+		}
+		json.NewDecoder(w.Body).Decode(&response)
+		return response.Data
+	}
+
+	got := decode(report(""))
+	if got.Users != 3 || len(got.Entries) != 2 || got.Counts[PostureNoTwoFactor] != 2 || got.Counts[PostureDormant] != 0 {
+		t.Errorf("Expected two users without 2FA and nobody dormant, got %+v", got)
+	}
+	for _, entry := range got.Entries {
+		if entry.Username == "careful" {
+			t.Errorf("Expected a user with no weaknesses to be left out, got %+v", entry)
+		}
+	}
+
+	clock.Advance(200 * 24 * time.Hour)
+	got = decode(report("?flag=dormant"))
+	if len(got.Entries) != 3 || got.Counts[PostureStalePassword] != 3 {
+		t.Errorf("Expected everyone dormant with stale passwords, got %+v", got)
+	}
+	if got.Entries[2].Username != "careful" || !slices.Equal(got.Entries[2].Flags, []string{PostureStalePassword, PostureDormant}) {
+		t.Errorf("Expected careful to be flagged stale and dormant, got %+v", got.Entries[2])
+	}
+
+	// The CSV has a column per flag and defuses formulas in usernames
+	w := report("?format=csv&flag=unverified_email")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("Expected a CSV download, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("Expected a header and two rows, got %v (%v)", rows, err)
+	}
+	if strings.Join(rows[0], ",") != "user_id,username,email,last_login_at,password_changed_at,no_2fa,stale_password,unverified_email,dormant" {
+		t.Errorf("Unexpected CSV header %v", rows[0])
+	}
+	if rows[1][1] != "'=cmd" || strings.Join(rows[1][5:], ",") != "yes,yes,yes,yes" {
+		t.Errorf("Unexpected CSV row %v", rows[1])
+	}
+
+	if w := report("?flag=bogus"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown flag to be refused, got %d", w.Code)
+	}
+}
+
+func TestDormancyPolicy(t *testing.T) {
+	t.Setenv("DORMANT_ACCOUNT_AGE", "2160h")
+	t.Setenv("DORMANCY_NOTIFY", "true")
+	t.Setenv("DORMANCY_DEACTIVATE_AFTER", "4320h")
+	t.Setenv("DORMANCY_DELETE_AFTER", "8760h")
+	clock := &frozenClock{now: time.Now()}
+	server := newTestServer(t, WithClock(clock))
+	sent := make(recordingMailer, 10)
+	server.authHandler.mailer = sent
+	server.authHandler.config.SessionTTL = 2 * 365 * 24 * time.Hour
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	registerAndLogin(t, server, "idle", "idle@example.com", "password123")
+	registerAndLogin(t, server, "active", "active@example.com", "password123")
+
+	// advance moves the clock on, keeping active signed in, and runs the
+	// scheduled tasks
+	advance := func(days int) {
+		clock.Advance(time.Duration(days) * 24 * time.Hour)
+		registerAndLogin(t, server, "active", "active@example.com", "password123")
+		server.gc.run(clock.Now())
+	}
+	auditTypes := func(userID string) []string {
+		var types []string
+		for _, event := range server.audit.Recent(0) {
+			if event.UserID == userID {
+				types = append(types, event.Type)
+			}
+		}
+		return types
+	}
+	idle := findUser(t, server, "idle")
+
+	advance(91)
+	if user := findUser(t, server, "idle"); user.Dormancy == nil || user.Dormancy.FlaggedAt == nil || user.Dormancy.NotifiedAt == nil {
+		t.Fatalf("Expected idle to be flagged and notified, got %+v", user.Dormancy)
+	}
+	if user := findUser(t, server, "active"); user.Dormancy != nil {
+		t.Errorf("Expected active not to be flagged, got %+v", user.Dormancy)
+	}
+	// Admins are warned too, but never told they will be deactivated
+	for range 2 {
+		select {
+		case msg := <-sent:
+			deactivation := strings.Contains(msg.Body, "it will be deactivated on")
+			if (msg.To == "idle@example.com") != deactivation {
+				t.Errorf("Unexpected dormancy warning %+v", msg)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for the dormancy warnings")
+		}
+	}
+	if !slices.Contains(auditTypes(idle.ID), AuditAccountDormant) {
+		t.Error("Expected the flag to be audited")
+	}
+
+	// Flagging happens once
+	server.gc.run(clock.Now())
+	select {
+	case msg := <-sent:
+		t.Errorf("Expected no second warning, got %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Deactivated accounts cannot sign in until an admin lifts it, which
+	// starts a fresh dormancy period
+	advance(90)
+	user := findUser(t, server, "idle")
+	if !user.Suspension.ActiveAt(clock.Now()) || user.Dormancy.DeactivatedAt == nil || !slices.Contains(auditTypes(idle.ID), AuditAccountDeactivated) {
+		t.Fatalf("Expected idle to be deactivated, got %+v %+v", user.Suspension, user.Dormancy)
+	}
+	if admin := findUser(t, server, "admin"); admin.Suspension != nil {
+		t.Error("Expected the admin never to be deactivated")
+	}
+	r := httptest.NewRequest("POST", "/api/admin/users/"+idle.ID+"/unsuspend", nil)
+	for _, cookie := range adminCookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	server.Router().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the deactivation to be lifted, got %d: %s", w.Code, w.Body.String())
+	}
+	advance(1)
+	if user := findUser(t, server, "idle"); user.Suspension != nil {
+		t.Errorf("Expected a reactivated account to stay active, got %+v", user.Suspension)
+	}
+
+	// Past the delete threshold the account is deleted, then purged after
+	// the deleted account retention
+	advance(365)
+	user = findUser(t, server, "idle")
+	if user.Deletion == nil || user.Deletion.By != "system" {
+		t.Fatalf("Expected idle to be deleted by the policy, got %+v", user.Deletion)
+	}
+	if admin := findUser(t, server, "admin"); admin.Deletion != nil {
+		t.Error("Expected the admin never to be deleted")
+	}
+	clock.Advance(server.config.DeletedUserRetention + time.Hour)
+	server.gc.run(clock.Now())
+	if _, err := server.authHandler.users.Get(context.Background(), idle.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected idle to be purged, got %v", err)
+	}
+}
+
+func TestSignupVelocity(t *testing.T) {
+	t.Setenv("SIGNUP_VELOCITY_LIMITS", "ip_hour=3,device_day=2")
+	clock := &frozenClock{now: time.Now()}
+	server := newTestServer(t, WithClock(clock))
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+
+	register := func(username, remoteAddr, deviceID string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(RegisterRequest{Username: username, Email: username + "@example.com", Password: "password123", DeviceID: deviceID})
+		r := jsonRequest("POST", "/api/register", body)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+	admin := func(method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		for _, cookie := range adminCookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+	login := func(username string) int {
+		body, _ := json.Marshal(LoginRequest{Username: username, Password: "password123"})
+		w := httptest.NewRecorder()
+		server.LoginHandler(w, jsonRequest("POST", "/api/login", body))
+		return w.Code
+	}
+
+	// The device limit counts one device across networks
+	register("phone1", "198.51.100.1:1234", "device-a")
+	register("phone2", "198.51.100.2:1234", "device-a")
+	if w := register("phone3", "198.51.100.3:1234", "device-a"); w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), "reviewed") {
+		t.Fatalf("Expected the third sign-up from one device to be held, got %d: %s", w.Code, w.Body.String())
+	}
+	if code := login("phone3"); code != http.StatusForbidden {
+		t.Errorf("Expected a held account not to sign in, got %d", code)
+	}
+	if code := login("phone2"); code != http.StatusOK {
+		t.Errorf("Expected an account under the limits to sign in, got %d", code)
+	}
+
+	// The queue lists what tripped
+	w := admin("GET", "/api/admin/signups/review")
+	var queue struct{ Data []PendingSignup }
+	json.NewDecoder(w.Body).Decode(&queue)
+	if w.Code != http.StatusOK || len(queue.Data) != 1 || queue.Data[0].User.Username != "phone3" || !slices.Equal(queue.Data[0].Review.Limits, []string{SignupDeviceDaily}) {
+		t.Fatalf("Expected phone3 in the review queue, got %d %+v", w.Code, queue.Data)
+	}
+	phone3 := queue.Data[0].User.ID
+	if w := admin("POST", "/api/admin/signups/review/"+phone3+"/approve"); w.Code != http.StatusOK {
+		t.Fatalf("Expected approval, got %d: %s", w.Code, w.Body.String())
+	}
+	if code := login("phone3"); code != http.StatusOK {
+		t.Errorf("Expected an approved account to sign in, got %d", code)
+	}
+	if w := admin("POST", "/api/admin/signups/review/"+phone3+"/approve"); w.Code != http.StatusConflict {
+		t.Errorf("Expected a second decision to conflict, got %d", w.Code)
+	}
+
+	// Rejected sign-ups are deleted
+	register("bot1", "203.0.113.9:1", "")
+	register("bot2", "203.0.113.9:1", "bot-2")
+	register("bot3", "203.0.113.9:1", "bot-3")
+	register("bot4", "203.0.113.9:1", "bot-4")
+	bot4 := findUser(t, server, "bot4")
+	if bot4.SignupReview == nil || !slices.Equal(bot4.SignupReview.Limits, []string{SignupIPHourly}) {
+		t.Fatalf("Expected bot4 held over the IP limit, got %+v", bot4.SignupReview)
+	}
+	if w := admin("POST", "/api/admin/signups/review/"+bot4.ID+"/reject"); w.Code != http.StatusOK {
+		t.Fatalf("Expected rejection, got %d: %s", w.Code, w.Body.String())
+	}
+	if user := findUser(t, server, "bot4"); user.Deletion == nil {
+		t.Error("Expected a rejected sign-up to be deleted")
+	}
+
+	// Limits cover their window only, and blocking refuses outright
+	clock.Advance(time.Hour)
+	register("bot5", "203.0.113.9:1", "bot-5")
+	if user := findUser(t, server, "bot5"); user.SignupReview != nil {
+		t.Errorf("Expected the hourly limit to have passed, got %+v", user.SignupReview)
+	}
+	server.authHandler.config.SignupVelocityAction = SignupActionBlock
+	if w := register("bot6", "198.51.100.9:1", "device-a"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected a blocked sign-up, got %d", w.Code)
+	}
+	if _, err := server.authHandler.users.GetByUsername(context.Background(), "bot6"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected no account for a blocked sign-up, got %v", err)
+	}
+}
+
+func TestRiskProvider(t *testing.T) {
+	server := newTestServer(t)
+	sent := make(recordingMailer, 10)
+	server.authHandler.mailer = sent
+
+	var seen []RiskRequest
+	server.AddRiskProvider(RiskProviderFunc(func(ctx context.Context, req RiskRequest) (RiskDecision, error) {
+		seen = append(seen, req)
+		switch {
+		case strings.HasPrefix(req.Username, "fraud"):
+			return RiskDecision{Action: RiskDeny, Reason: "known fraud ring"}, nil
+		case strings.HasPrefix(req.Username, "shady"):
+			return RiskDecision{Action: RiskChallenge, Reason: "poor email reputation"}, nil
+		case req.Username == "flaky":
+			return RiskDecision{}, errors.New("reputation API down")
+		}
+		return RiskDecision{Action: RiskAllow}, nil
+	}))
+
+	register := func(username string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(RegisterRequest{Username: username, Email: username + "@example.com", Password: "password123"})
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, jsonRequest("POST", "/api/register", body))
+		return w
+	}
+	login := func(username string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(LoginRequest{Username: username, Password: "password123"})
+		w := httptest.NewRecorder()
+		server.LoginHandler(w, jsonRequest("POST", "/api/login", body))
+		return w
+	}
+
+	// Denied registrations are refused without saying why
+	if w := register("fraudster"); w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), "fraud ring") {
+		t.Fatalf("Expected a denied registration to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(seen) != 1 || seen[0].Flow != RiskFlowRegister || seen[0].Email != "fraudster@example.com" || seen[0].IP == "" || seen[0].Device == "" {
+		t.Errorf("Expected the provider to see the registration, got %+v", seen)
+	}
+	if events := server.audit.Recent(0); events[0].Type != AuditSignupBlocked || events[0].Details["risk"] != "known fraud ring" {
+		t.Errorf("Expected a signup_blocked event with the reason, got %+v", events[0])
+	}
+
+	// Challenged registrations are held for review
+	if w := register("shadyuser"); w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), "reviewed") {
+		t.Fatalf("Expected a challenged registration to be held, got %d: %s", w.Code, w.Body.String())
+	}
+	if review := findUser(t, server, "shadyuser").SignupReview; review == nil || review.Risk != "poor email reputation" {
+		t.Errorf("Expected the hold to record the provider's reason, got %+v", review)
+	}
+
+	// A failing provider is skipped unless configured to fail closed
+	if w := register("flaky"); w.Code != http.StatusCreated {
+		t.Fatalf("Expected a provider failure to be ignored, got %d", w.Code)
+	}
+	if w := login("flaky"); w.Code != http.StatusOK {
+		t.Errorf("Expected login to pass a failing provider, got %d", w.Code)
+	}
+	server.authHandler.config.RiskProviderFailClosed = true
+	if w := login("flaky"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected login to be refused with the provider failing closed, got %d", w.Code)
+	}
+	server.authHandler.config.RiskProviderFailClosed = false
+
+	// Challenged logins need the emailed code even with risk scoring off
+	server.authHandler.config.RiskThreshold = 0
+	seen = nil
+	user := findUser(t, server, "flaky")
+	user.Username = "shadylogin"
+	server.authHandler.users.Update(context.Background(), user)
+	w := login("shadylogin")
+	var response Response
+	json.NewDecoder(w.Body).Decode(&response)
+	data, _ := response.Data.(map[string]interface{})
+	if w.Code != http.StatusUnauthorized || data["challengeRequired"] != true {
+		t.Fatalf("Expected a challenged login to need a code, got %d: %+v", w.Code, response)
+	}
+	if len(seen) != 1 || seen[0].Flow != RiskFlowLogin || seen[0].UserID != user.ID {
+		t.Errorf("Expected the provider to see the login, got %+v", seen)
+	}
+	select {
+	case msg := <-sent:
+		if msg.Subject != "Your sign-in code" {
+			t.Errorf("Expected a challenge code email, got %q", msg.Subject)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a challenge code email")
+	}
+}
+
+func TestSessionCookieEncryption(t *testing.T) {
+	pair := func(hash, block string) string {
+		return strings.Repeat(hash, 32) + ":" + strings.Repeat(block, 32)
+	}
+
+	// Short keys stop the server from starting
+	for _, keys := range []string{pair("1", "22"), pair("11", "2"), strings.Repeat("11", 32), "zz:zz"} {
+		t.Setenv("SESSION_KEYS", keys)
+		if _, err := New(LoadConfig()); err == nil {
+			t.Errorf("Expected New to fail with SESSION_KEYS %q", keys)
+		}
+	}
+
+	t.Setenv("SESSION_KEYS", pair("11", "22")+", "+pair("33", "44"))
+	server := newTestServer(t)
+	if got := len(server.authHandler.cookieKeys); got != 2 {
+		t.Fatalf("Expected two session key pairs, got %d", got)
+	}
+
+	profile := func(cookies []*http.Cookie) int {
+		req := httptest.NewRequest("GET", "/api/profile", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The session cookie's payload is encrypted, not just signed
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+	var value string
+	for _, cookie := range cookies {
+		if cookie.Name == server.config.SessionCookieName {
+			value = cookie.Value
+		}
+	}
+	outer, err := base64.URLEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatalf("Failed to decode session cookie: %v", err)
+	}
+	parts := bytes.SplitN(outer, []byte("|"), 3)
+	if len(parts) != 3 {
+		t.Fatalf("Unexpected session cookie format: %q", outer)
+	}
+	payload, _ := base64.URLEncoding.DecodeString(string(parts[1]))
+	if bytes.Contains(payload, []byte("session_id")) {
+		t.Error("Expected the session cookie payload to be encrypted")
+	}
+
+	// Rotation keeps the previous pair for decoding only
+	rotated, _ := parseCookieKeys(pair("55", "66"))
+	server.authHandler.rotateCookieKeys(rotated)
+	if profile(cookies) != http.StatusOK {
+		t.Error("Expected cookies from the previous keys to stay valid")
+	}
+	newCookies := registerAndLogin(t, server, "testuser2", "test2@example.com", "password123")
+	if profile(newCookies) != http.StatusOK {
+		t.Error("Expected cookies from the new keys to be valid")
+	}
+	rotated, _ = parseCookieKeys(pair("77", "88"))
+	server.authHandler.rotateCookieKeys(rotated)
+	if profile(cookies) != http.StatusUnauthorized {
+		t.Error("Expected cookies from keys rotated out twice to be refused")
+	}
+	if profile(newCookies) != http.StatusOK {
+		t.Error("Expected cookies from the previous keys to stay valid")
+	}
+}
+
+func TestSessionTransport(t *testing.T) {
+	server := newTestServer(t)
+	router := server.Router()
+	registerBody, _ := json.Marshal(RegisterRequest{Username: "nativeuser", Email: "native@example.com", Password: "password123"})
+	router.ServeHTTP(httptest.NewRecorder(), jsonRequest("POST", "/api/register", registerBody))
+
+	login := func(transport string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(LoginRequest{Username: "nativeuser", Password: "password123", Transport: transport})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, jsonRequest("POST", "/api/login", body))
+		return w
+	}
+	send := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		r := jsonRequest(method, path, encoded)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := login("carrier-pigeon"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown transport to be refused, got %d", w.Code)
+	}
+
+	// Browsers get an HttpOnly cookie and no token
+	w := login("")
+	if w.Code != http.StatusOK || len(w.Result().Cookies()) == 0 || !w.Result().Cookies()[0].HttpOnly {
+		t.Fatalf("Expected the default transport to set an HttpOnly cookie, got %d %v", w.Code, w.Result().Cookies())
+	}
+	if strings.Contains(w.Body.String(), "access_token") {
+		t.Error("Expected no token in a cookie login's response")
+	}
+
+	// Native apps get a bearer token and no cookie
+	w = login(SessionTransportBearer)
+	var response struct{ Data SessionTokenResponse }
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusOK || len(w.Result().Cookies()) != 0 || response.Data.AccessToken == "" ||
+		response.Data.TokenType != "Bearer" || response.Data.User.Username != "nativeuser" {
+		t.Fatalf("Expected a bearer login to return a token, got %d %+v", w.Code, response.Data)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Error("Expected the token response not to be cached")
+	}
+	token := response.Data.AccessToken
+	for _, session := range userSessions(t, server, response.Data.User.ID) {
+		if strings.Contains(token, session.ID) {
+			t.Error("Expected the token not to reveal the session ID")
+		}
+	}
+
+	if w := send("GET", "/api/profile", token, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the bearer token to authenticate, got %d", w.Code)
+	}
+	if w := send("GET", "/api/profile", token[:len(token)-2]+"xx", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a tampered token to be refused, got %d", w.Code)
+	}
+
+	// Re-authentication hands back a new token in place of the old one
+	w = send("POST", "/api/reauth", token, ReauthRequest{Password: "password123"})
+	var reauth struct{ Data map[string]interface{} }
+	json.NewDecoder(w.Body).Decode(&reauth)
+	rotated, _ := reauth.Data["access_token"].(string)
+	if w.Code != http.StatusOK || rotated == "" || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("Expected re-authentication to return a new token, got %d: %+v", w.Code, reauth.Data)
+	}
+	if w := send("GET", "/api/profile", token, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the old token to stop working, got %d", w.Code)
+	}
+
+	// Logging out ends the session behind the token
+	if w := send("POST", "/api/logout", rotated, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected logout to succeed, got %d", w.Code)
+	}
+	if w := send("GET", "/api/profile", rotated, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a logged out token to be refused, got %d", w.Code)
+	}
+}
+
+func TestPersonalAccessTokens(t *testing.T) {
+	clock := &frozenClock{now: time.Now()}
+	server := newTestServer(t, WithClock(clock))
+	server.authHandler.config.SessionTTL = 365 * 24 * time.Hour
+	cookies := registerAndLogin(t, server, "scripter", "scripter@example.com", "password123")
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+
+	send := func(method, path string, cookies []*http.Cookie, token string, body interface{}) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		r := jsonRequest(method, path, encoded)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+	create := func(cookies []*http.Cookie, req CreateAccessTokenRequest) (CreatedAccessToken, int) {
+		w := send("POST", "/api/tokens", cookies, "", req)
+		var response struct{ Data CreatedAccessToken }
+		json.NewDecoder(w.Body).Decode(&response)
+		return response.Data, w.Code
+	}
+
+	// Scopes must be known, and admin scopes need an admin
+	if _, code := create(cookies, CreateAccessTokenRequest{Name: "ci", Scopes: []string{"everything"}}); code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown scope to be refused, got %d", code)
+	}
+	if _, code := create(cookies, CreateAccessTokenRequest{Name: "ci", Scopes: []string{"users:*"}}); code != http.StatusForbidden {
+		t.Errorf("Expected a user to be refused admin scopes, got %d", code)
+	}
+	tooLate := clock.Now().Add(2 * 365 * 24 * time.Hour)
+	if _, code := create(cookies, CreateAccessTokenRequest{Name: "ci", Scopes: []string{ScopeProfileRead}, ExpiresAt: &tooLate}); code != http.StatusBadRequest {
+		t.Errorf("Expected an expiry past the maximum to be refused, got %d", code)
+	}
+
+	created, code := create(cookies, CreateAccessTokenRequest{Name: "ci", Scopes: []string{ScopeProfileRead, "transform:*"}})
+	if code != http.StatusCreated || !strings.HasPrefix(created.Token, "pat_") || !created.ExpiresAt.Equal(clock.Now().Add(30*24*time.Hour)) {
+		t.Fatalf("Expected a token lasting the default TTL, got %d %+v", code, created)
+	}
+	token := created.Token
+
+	// Scopes are enforced per route
+	if w := send("GET", "/api/profile", nil, token, nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "scripter") {
+		t.Errorf("Expected profile:read to read the profile, got %d", w.Code)
+	}
+	if w := send("POST", "/api/hash", nil, token, HashRequest{Algorithm: "sha256", Input: "hi"}); w.Code != http.StatusOK {
+		t.Errorf("Expected transform:* to cover hashing, got %d: %s", w.Code, w.Body.String())
+	}
+	name := "hijacked"
+	if w := send("PATCH", "/api/profile", nil, token, UpdateProfileRequest{Username: &name}); w.Code != http.StatusForbidden || !strings.Contains(w.Header().Get("WWW-Authenticate"), "insufficient_scope") {
+		t.Errorf("Expected a missing scope to be refused, got %d", w.Code)
+	}
+	if w := send("POST", "/api/change-password", nil, token, ChangePasswordRequest{CurrentPassword: "password123", NewPassword: "hijacked123"}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected session-only routes to refuse tokens, got %d", w.Code)
+	}
+	if w := send("GET", "/api/tokens", nil, token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected tokens not to manage tokens, got %d", w.Code)
+	}
+	if w := send("GET", "/api/profile", nil, token+"0", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong token to be refused, got %d", w.Code)
+	}
+
+	// Listing shows the last use but never the token
+	w := send("GET", "/api/tokens", cookies, "", nil)
+	var listed struct{ Data []PersonalAccessToken }
+	json.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode(&listed)
+	if len(listed.Data) != 1 || listed.Data[0].LastUsedAt == nil || listed.Data[0].LastUsedIP == "" || strings.Contains(w.Body.String(), token) {
+		t.Fatalf("Expected the token listed with its last use, got %s", w.Body.String())
+	}
+
+	// Admin tokens reach the admin user routes
+	adminToken, code := create(adminCookies, CreateAccessTokenRequest{Name: "ops", Scopes: []string{ScopeUsersAdmin}})
+	if code != http.StatusCreated {
+		t.Fatalf("Expected an admin to get an admin token, got %d", code)
+	}
+	if w := send("GET", "/api/admin/users/search?q=scripter", nil, adminToken.Token, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected users:admin to search users, got %d", w.Code)
+	}
+	if w := send("GET", "/api/admin/acl", nil, adminToken.Token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected other admin routes to refuse tokens, got %d", w.Code)
+	}
+
+	// Tokens stop working once revoked or expired
+	if w := send("DELETE", "/api/tokens/"+adminToken.ID, adminCookies, "", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected revocation to succeed, got %d", w.Code)
+	}
+	if w := send("GET", "/api/admin/users/search?q=scripter", nil, adminToken.Token, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a revoked token to be refused, got %d", w.Code)
+	}
+	clock.Advance(31 * 24 * time.Hour)
+	if w := send("GET", "/api/profile", nil, token, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an expired token to be refused, got %d", w.Code)
+	}
+	server.gc.run(clock.Now())
+	if tokens := findUser(t, server, "scripter").AccessTokens; len(tokens) != 0 {
+		t.Errorf("Expected expired tokens to be purged, got %d", len(tokens))
+	}
+}
+
+func TestDeviceAuthorizationGrant(t *testing.T) {
+	t.Setenv("HOSTED_PAGES", "true")
+	clock := &frozenClock{now: time.Now()}
+	server := newTestServer(t, WithClock(clock))
+	server.authHandler.config.SessionTTL = time.Hour
+	cookies := registerAndLogin(t, server, "viewer", "viewer@example.com", "password123")
+	client, _, err := server.clients.create("Living room TV", []string{ScopeProfileRead, ScopeUsersRead})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	post := func(path string, form url.Values) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		var body map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body
+	}
+	start := func() DeviceAuthorizationResponse {
+		w, _ := post("/api/oauth/device/code", url.Values{"client_id": {client.ID}})
+		var device DeviceAuthorizationResponse
+		json.Unmarshal(w.Body.Bytes(), &device)
+		if w.Code != http.StatusOK || device.DeviceCode == "" {
+			t.Fatalf("Expected a device authorization, got %d: %s", w.Code, w.Body.String())
+		}
+		return device
+	}
+	poll := func(deviceCode string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		return post("/oauth/token", url.Values{"grant_type": {deviceCodeGrantType}, "client_id": {client.ID}, "device_code": {deviceCode}})
+	}
+	verify := func(method string, cookies []*http.Cookie, req DeviceVerifyRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(req)
+		r := jsonRequest(method, "/api/oauth/device/verify?user_code="+url.QueryEscape(req.UserCode), body)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, r)
+		return w
+	}
+
+	if w, _ := post("/api/oauth/device/code", url.Values{"client_id": {"unknown"}}); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an unknown client to be refused, got %d", w.Code)
+	}
+	if _, body := post("/api/oauth/device/code", url.Values{"client_id": {client.ID}, "scope": {ScopeUsersRead}}); body["error"] != "invalid_scope" {
+		t.Errorf("Expected service scopes to be refused for devices, got %v", body)
+	}
+
+	device := start()
+	if len(device.UserCode) != 9 || device.UserCode[4] != '-' || device.Interval != 5 || device.ExpiresIn != 600 ||
+		!strings.HasSuffix(device.VerificationURIComplete, "/device?user_code="+device.UserCode) {
+		t.Errorf("Unexpected device authorization: %+v", device)
+	}
+
+	// The device waits for the user, and is told to slow down when it rushes
+	if _, body := poll(device.DeviceCode); body["error"] != "authorization_pending" {
+		t.Errorf("Expected authorization_pending, got %v", body)
+	}
+	if _, body := poll(device.DeviceCode); body["error"] != "slow_down" {
+		t.Errorf("Expected slow_down, got %v", body)
+	}
+	clock.Advance(11 * time.Second)
+	if _, body := poll(device.DeviceCode); body["error"] != "authorization_pending" {
+		t.Errorf("Expected authorization_pending after waiting out the interval, got %v", body)
+	}
+
+	// The user signs in to see and approve the device, typing the code loosely
+	typed := strings.ToLower(strings.ReplaceAll(device.UserCode, "-", ""))
+	if w := verify("GET", nil, DeviceVerifyRequest{UserCode: typed}); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected verification to need a session, got %d", w.Code)
+	}
+	if w := verify("GET", cookies, DeviceVerifyRequest{UserCode: typed}); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Living room TV") {
+		t.Errorf("Expected the device to be shown, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := verify("GET", cookies, DeviceVerifyRequest{UserCode: "BBBB-BBBB"}); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown code to be refused, got %d", w.Code)
+	}
+	if w := verify("POST", cookies, DeviceVerifyRequest{UserCode: typed, Approve: true}); w.Code != http.StatusOK {
+		t.Fatalf("Expected the device to be approved, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := verify("POST", cookies, DeviceVerifyRequest{UserCode: typed, Approve: false}); w.Code != http.StatusConflict {
+		t.Errorf("Expected a decided code to be refused, got %d", w.Code)
+	}
+
+	// The device collects a personal access token, once
+	clock.Advance(10 * time.Second)
+	w, body := poll(device.DeviceCode)
+	token, _ := body["access_token"].(string)
+	if w.Code != http.StatusOK || !strings.HasPrefix(token, accessTokenPrefix) || body["scope"] != ScopeProfileRead {
+		t.Fatalf("Expected an access token, got %d %v", w.Code, body)
+	}
+	profile := httptest.NewRequest("GET", "/api/profile", nil)
+	profile.Header.Set("Authorization", "Bearer "+token)
+	profileW := httptest.NewRecorder()
+	server.Router().ServeHTTP(profileW, profile)
+	if profileW.Code != http.StatusOK || !strings.Contains(profileW.Body.String(), "viewer") {
+		t.Errorf("Expected the device token to read the profile, got %d", profileW.Code)
+	}
+	if user := findUser(t, server, "viewer"); len(user.AccessTokens) != 1 || user.AccessTokens[0].Name != "Device: Living room TV" {
+		t.Errorf("Expected the device token to be listed with the user's tokens, got %+v", user.AccessTokens)
+	}
+	if _, body := poll(device.DeviceCode); body["error"] != "invalid_grant" {
+		t.Errorf("Expected a redeemed device code to be refused, got %v", body)
+	}
+
+	// Denied and expired devices are told to give up
+	denied := start()
+	verify("POST", cookies, DeviceVerifyRequest{UserCode: denied.UserCode})
+	if _, body := poll(denied.DeviceCode); body["error"] != "access_denied" {
+		t.Errorf("Expected access_denied, got %v", body)
+	}
+	expired := start()
+	clock.Advance(11 * time.Minute)
+	if _, body := poll(expired.DeviceCode); body["error"] != "expired_token" {
+		t.Errorf("Expected expired_token, got %v", body)
+	}
+	if purged := server.devices.Purge(clock.Now()); purged != 2 {
+		t.Errorf("Expected both expired authorizations to be purged, got %d", purged)
+	}
+
+	// The hosted page sends visitors to sign in first, then shows the device
+	page := start()
+	pageW := httptest.NewRecorder()
+	server.Handler().ServeHTTP(pageW, httptest.NewRequest("GET", "/device?user_code="+page.UserCode, nil))
+	if pageW.Code != http.StatusSeeOther || !strings.HasPrefix(pageW.Header().Get("Location"), "/login?return_to=%2Fdevice%3Fuser_code%3D") {
+		t.Errorf("Expected a redirect to sign in, got %d %q", pageW.Code, pageW.Header().Get("Location"))
+	}
+	pageReq := httptest.NewRequest("GET", "/device?user_code="+page.UserCode, nil)
+	for _, cookie := range cookies {
+		pageReq.AddCookie(cookie)
+	}
+	pageW = httptest.NewRecorder()
+	server.Handler().ServeHTTP(pageW, pageReq)
+	if pageW.Code != http.StatusOK || !strings.Contains(pageW.Body.String(), "Living room TV") || !strings.Contains(pageW.Body.String(), ScopeProfileRead) {
+		t.Errorf("Expected the page to show the device, got %d", pageW.Code)
+	}
+}
+
+func TestMTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "internal CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	caCert, _ := x509.ParseCertificate(caDER)
+	writePEM := func(name, kind string, der []byte) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600)
+		return path
+	}
+	issue := func(serial int64, template *x509.Certificate) tls.Certificate {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template.SerialNumber = big.NewInt(serial)
+		template.NotBefore, template.NotAfter = caTemplate.NotBefore, caTemplate.NotAfter
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("Failed to issue certificate: %v", err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	serverCert := issue(2, &x509.Certificate{IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	serverKey, _ := x509.MarshalECPrivateKey(serverCert.PrivateKey.(*ecdsa.PrivateKey))
+	spiffeID, _ := url.Parse("spiffe://corp/ns/billing/sa/api")
+	billing := issue(3, &x509.Certificate{URIs: []*url.URL{spiffeID}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	reports := issue(4, &x509.Certificate{Subject: pkix.Name{CommonName: "reports"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	stranger := issue(5, &x509.Certificate{Subject: pkix.Name{CommonName: "stranger"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	mtlsAddr := probe.Addr().String()
+	probe.Close()
+
+	t.Setenv("LISTEN_ADDR", "unix:"+filepath.Join(dir, "auth.sock"))
+	t.Setenv("MTLS_ADDR", mtlsAddr)
+	t.Setenv("MTLS_CERT_FILE", writePEM("server.pem", "CERTIFICATE", serverCert.Certificate[0]))
+	t.Setenv("MTLS_KEY_FILE", writePEM("server-key.pem", "EC PRIVATE KEY", serverKey))
+	t.Setenv("MTLS_CLIENT_CA_FILE", writePEM("ca.pem", "CERTIFICATE", caDER))
+	t.Setenv("MTLS_SERVICE_ACCOUNTS", "spiffe://corp/ns/billing/sa/api=billing:users:read,reports=reports:reports:write,broken")
+	server := newTestServer(t)
+	if len(server.config.MTLSServiceAccounts) != 2 || server.config.MTLSServiceAccounts["reports"].Name != "reports" {
+		t.Fatalf("Unexpected service accounts: %+v", server.config.MTLSServiceAccounts)
+	}
+	registerAndLogin(t, server, "customer", "customer@example.com", "password123")
+	userID := findUser(t, server, "customer").ID
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run failed: %v", err)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	lookup := func(certs ...tls.Certificate) (int, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		var resp *http.Response
+		var err error
+		for i := 0; i < 100; i++ {
+			if resp, err = client.Get("https://" + mtlsAddr + "/api/internal/users/" + userID); err == nil || !errors.Is(err, syscall.ECONNREFUSED) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	if code, err := lookup(billing); err != nil || code != http.StatusOK {
+		t.Errorf("Expected the billing service account to look up users, got %d %v", code, err)
+	}
+	if code, err := lookup(reports); err != nil || code != http.StatusForbidden {
+		t.Errorf("Expected a service account without users:read to be refused, got %d %v", code, err)
+	}
+	if code, err := lookup(stranger); err != nil || code != http.StatusForbidden {
+		t.Errorf("Expected an unmapped certificate to be refused, got %d %v", code, err)
+	}
+	if _, err := lookup(); err == nil {
+		t.Error("Expected a connection without a client certificate to fail")
+	}
+
+	// Bad certificate settings stop the server from starting
+	t.Setenv("MTLS_CLIENT_CA_FILE", filepath.Join(dir, "missing.pem"))
+	cfg := LoadConfig()
+	cfg.OutboxFile = filepath.Join(dir, "outbox2.json")
+	if _, err := New(cfg); err == nil {
+		t.Error("Expected New to fail without the client CAs")
+	}
+}
+
+func TestTrustedHeaderAuth(t *testing.T) {
+	t.Setenv("TRUSTED_HEADER_AUTH", "true")
+	t.Setenv("TRUSTED_HEADER_PROXIES", "10.0.0.0/8")
+	server := newTestServer(t)
+	registerAndLogin(t, server, "bob", "bob@example.com", "password123")
+
+	get := func(peer, user, email string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/profile", nil)
+		req.RemoteAddr = peer + ":41000"
+		if user != "" {
+			req.Header.Set("X-Auth-Request-User", user)
+			req.Header.Set("X-Auth-Request-Email", email)
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	// Only the allowlisted proxy is believed
+	if w := get("192.0.2.10", "alice@corp.example", "alice@corp.example", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected headers from an untrusted peer to be ignored, got %d", w.Code)
+	}
+	if w := get("10.0.0.5", "", "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the proxy without headers to be anonymous, got %d", w.Code)
+	}
+
+	// The first request provisions the account and starts a session
+	first := get("10.0.0.5", "alice@corp.example", "Alice@Corp.example", nil)
+	if first.Code != http.StatusOK || !strings.Contains(first.Body.String(), `"username":"alice"`) {
+		t.Fatalf("Expected the proxy user to be signed in, got %d: %s", first.Code, first.Body.String())
+	}
+	alice := findUser(t, server, "alice")
+	if alice.Email != "alice@corp.example" || alice.EmailVerifiedAt == nil || alice.Password != "" ||
+		len(alice.Identities) != 1 || alice.Identities[0].Provider != "sso-proxy" || alice.Identities[0].Subject != "alice@corp.example" || alice.Role != RoleUser {
+		t.Errorf("Unexpected provisioned account: %+v", alice)
+	}
+	cookies := first.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("Expected a session cookie")
+	}
+
+	// The session is reused while the proxy names the same user
+	if w := get("10.0.0.5", "alice@corp.example", "alice@corp.example", cookies); w.Code != http.StatusOK || len(w.Result().Cookies()) != 0 {
+		t.Errorf("Expected the existing session to be kept, got %d with %d cookies", w.Code, len(w.Result().Cookies()))
+	}
+	if sessions := userSessions(t, server, alice.ID); len(sessions) != 1 {
+		t.Errorf("Expected one session for the proxy user, got %d", len(sessions))
+	}
+
+	// A different proxy user replaces the session
+	switched := get("10.0.0.5", "carol", "carol@corp.example", cookies)
+	if switched.Code != http.StatusOK || !strings.Contains(switched.Body.String(), `"username":"carol"`) {
+		t.Errorf("Expected the session to switch users, got %d: %s", switched.Code, switched.Body.String())
+	}
+	if sessions := userSessions(t, server, alice.ID); len(sessions) != 0 {
+		t.Errorf("Expected the previous user's session to be revoked, got %d", len(sessions))
+	}
+
+	// Local accounts are never taken over by name or email
+	if w := get("10.0.0.5", "bob", "bob@corp.example", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a taken username to be refused, got %d", w.Code)
+	}
+	if w := get("10.0.0.5", "robert", "bob@example.com", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a local account's email to be refused, got %d", w.Code)
+	}
+	if user := findUser(t, server, "bob"); len(user.Identities) != 0 {
+		t.Errorf("Expected the local account to stay unlinked, got %+v", user.Identities)
+	}
+}
+
+func TestKerberosLogin(t *testing.T) {
+	service, _ := kerberos.ParsePrincipal("HTTP/intranet.corp.example@CORP.EXAMPLE")
+	serviceKey, err := kerberos.NewKey(kerberos.AES256CTSHMACSHA196)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keytab := &kerberos.Keytab{}
+	keytab.Add(service, 2, serviceKey)
+	path := filepath.Join(t.TempDir(), "http.keytab")
+	if err := os.WriteFile(path, keytab.Marshal(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KERBEROS_KEYTAB", path)
+	t.Setenv("KERBEROS_USERNAME_REALMS", "CORP.EXAMPLE")
+	server := newTestServer(t)
+	registerAndLogin(t, server, "alice", "alice@example.com", "password123")
+	registerAndLogin(t, server, "robert", "robert@example.com", "password123")
+
+	negotiate := func(client string, key kerberos.Key, query string) (*httptest.ResponseRecorder, []byte) {
+		principal, _ := kerberos.ParsePrincipal(client)
+		token, err := kerberos.NewInitiatorToken(service, 2, key, principal, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "/api/login/kerberos"+query, nil)
+		req.Header.Set("Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(token))
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w, token
+	}
+
+	// Clients without a ticket are challenged
+	w := httptest.NewRecorder()
+	server.Router().ServeHTTP(w, httptest.NewRequest("GET", "/api/login/kerberos", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Negotiate" {
+		t.Fatalf("Expected a Negotiate challenge, got %d %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+
+	// A principal of a username realm signs in to the account with its name
+	w, token := negotiate("alice@CORP.EXAMPLE", serviceKey, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"username":"alice"`) || len(w.Result().Cookies()) == 0 {
+		t.Fatalf("Expected alice to be signed in, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Negotiate ") {
+		t.Errorf("Expected a mutual authentication token, got %q", w.Header().Get("WWW-Authenticate"))
+	}
+
+	// The same authenticator cannot be sent twice
+	req := httptest.NewRequest("GET", "/api/login/kerberos", nil)
+	req.Header.Set("Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(token))
+	w = httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a replayed ticket to be refused, got %d", w.Code)
+	}
+
+	// Tickets for keys not in the keytab are refused
+	otherKey, _ := kerberos.NewKey(kerberos.AES256CTSHMACSHA196)
+	if w, _ := negotiate("alice@CORP.EXAMPLE", otherKey, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a ticket under another key to be refused, got %d", w.Code)
+	}
+
+	// Other realms only reach accounts the principal is linked to
+	if w, _ := negotiate("robert@PARTNER.EXAMPLE", serviceKey, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected an unlinked principal to be refused, got %d", w.Code)
+	}
+	if _, err := server.LinkIdentity(context.Background(), findUser(t, server, "robert").ID, Identity{Provider: "kerberos", Subject: "bob@PARTNER.EXAMPLE"}); err != nil {
+		t.Fatal(err)
+	}
+	w, _ = negotiate("bob@PARTNER.EXAMPLE", serviceKey, "?transport=bearer")
+	var response struct {
+		Data SessionTokenResponse `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusOK || response.Data.User.Username != "robert" || response.Data.AccessToken == "" {
+		t.Errorf("Expected the linked principal to get a bearer session for robert, got %d: %+v", w.Code, response.Data)
+	}
+}
+
+func TestServiceAccounts(t *testing.T) {
+	server := newTestServer(t)
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	registerAndLogin(t, server, "outsider", "outsider@partner.example", "password123")
+
+	admin := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		}
+		req := httptest.NewRequest(method, path, reader)
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range adminCookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	requestToken := func(id, secret string) (int, TokenResponse) {
+		form := url.Values{"grant_type": {"client_credentials"}}
+		req := httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(id, secret)
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		var token TokenResponse
+		json.Unmarshal(w.Body.Bytes(), &token)
+		return w.Code, token
+	}
+	lookup := func(token, username string) int {
+		req := httptest.NewRequest("GET", "/api/internal/users/"+findUser(t, server, username).ID, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if w := admin("POST", "/api/admin/service-accounts", ServiceAccountRequest{Name: "reports"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an account without scopes to be refused, got %d", w.Code)
+	}
+	w := admin("POST", "/api/admin/service-accounts", ServiceAccountRequest{Name: "reports", Organization: "Example.com", Scopes: []string{ScopeUsersRead}})
+	var created struct {
+		Data ServiceAccount `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	account := created.Data
+	if w.Code != http.StatusCreated || account.Organization != "example.com" || len(account.Keys) != 0 {
+		t.Fatalf("Expected the service account to be created, got %d: %+v", w.Code, account)
+	}
+
+	// It authenticates with a key, which is only shown once
+	w = admin("POST", "/api/admin/service-accounts/"+account.ID+"/keys", ServiceAccountKeyRequest{})
+	var key struct {
+		Data struct {
+			Key    ServiceAccountKey `json:"key"`
+			Secret string            `json:"secret"`
+		} `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&key)
+	if w.Code != http.StatusCreated || !strings.HasPrefix(key.Data.Secret, "svck_") {
+		t.Fatalf("Expected a key to be created, got %d", w.Code)
+	}
+	if status, _ := requestToken(account.ID, "svck_wrong"); status != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong key to be refused, got %d", status)
+	}
+	status, token := requestToken(account.ID, key.Data.Secret)
+	if status != http.StatusOK || token.Scope != ScopeUsersRead {
+		t.Fatalf("Expected a service token, got %d %+v", status, token)
+	}
+
+	// Its tokens only reach users of its organization
+	if status := lookup(token.AccessToken, "admin"); status != http.StatusOK {
+		t.Errorf("Expected a user of the organization to be found, got %d", status)
+	}
+	if status := lookup(token.AccessToken, "outsider"); status != http.StatusNotFound {
+		t.Errorf("Expected a user outside the organization to be hidden, got %d", status)
+	}
+
+	w = admin("GET", "/api/admin/service-accounts/"+account.ID, nil)
+	if !strings.Contains(w.Body.String(), `"lastUsedAt"`) || strings.Contains(w.Body.String(), key.Data.Secret) {
+		t.Errorf("Expected the key's last use and no secret, got %s", w.Body.String())
+	}
+
+	// Disabling it cuts off tokens already issued
+	if w := admin("PATCH", "/api/admin/service-accounts/"+account.ID, map[string]bool{"disabled": true}); w.Code != http.StatusOK {
+		t.Fatalf("Expected the account to be disabled, got %d", w.Code)
+	}
+	if status := lookup(token.AccessToken, "admin"); status != http.StatusUnauthorized {
+		t.Errorf("Expected a disabled account's token to be refused, got %d", status)
+	}
+	if status, _ := requestToken(account.ID, key.Data.Secret); status != http.StatusUnauthorized {
+		t.Errorf("Expected a disabled account to get no tokens, got %d", status)
+	}
+	admin("PATCH", "/api/admin/service-accounts/"+account.ID, map[string]bool{"disabled": false})
+
+	// Revoked keys no longer authenticate
+	if w := admin("DELETE", "/api/admin/service-accounts/"+account.ID+"/keys/"+key.Data.Key.ID, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the key to be revoked, got %d", w.Code)
+	}
+	if status, _ := requestToken(account.ID, key.Data.Secret); status != http.StatusUnauthorized {
+		t.Errorf("Expected a revoked key to be refused, got %d", status)
+	}
+	if w := admin("DELETE", "/api/admin/service-accounts/"+account.ID, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the account to be deleted, got %d", w.Code)
+	}
+
+	// The audit trail outlives the account
+	w = admin("GET", "/api/admin/service-accounts/"+account.ID+"/audit", nil)
+	var trail struct {
+		Data []AuditEvent `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&trail)
+	var seen []string
+	for _, event := range trail.Data {
+		seen = append(seen, event.Type+":"+event.Details["change"])
+	}
+	want := []string{
+		"service_account_changed:deleted", "service_account_changed:key_revoked",
+		"service_account_changed:updated", "service_account_changed:updated",
+		"token_issued:", "service_account_changed:key_created", "service_account_changed:created",
+	}
+	if !slices.Equal(seen, want) {
+		t.Errorf("Unexpected audit trail %v", seen)
+	}
+}
+
+func TestAdminPermissions(t *testing.T) {
+	server := newTestServer(t)
+	server.authHandler.config.RolePermissions = map[string][]string{"auditor": {PermissionAuditRead}}
+	server.authHandler.policy = newBuiltinPolicy(server.authHandler.config)
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	supportCookies := registerAndLogin(t, server, "helper", "helper@example.com", "password123")
+	registerAndLogin(t, server, "customer", "customer@example.com", "password123")
+	customer := findUser(t, server, "customer")
+	helper := findUser(t, server, "helper")
+
+	call := func(cookies []*http.Cookie, method, path string, body interface{}) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		}
+		req := httptest.NewRequest(method, path, reader)
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := call(supportCookies, "GET", "/api/admin/users/search?q=customer", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a plain user to be refused, got %d", w.Code)
+	}
+	if w := call(adminCookies, "PUT", "/api/admin/users/"+helper.ID+"/role", RoleRequest{Role: "superhero"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown role to be refused, got %d", w.Code)
+	}
+	if w := call(adminCookies, "PUT", "/api/admin/users/"+findUser(t, server, "admin").ID+"/role", RoleRequest{Role: RoleSupport}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected changing your own role to be refused, got %d", w.Code)
+	}
+	if w := call(adminCookies, "PUT", "/api/admin/users/"+helper.ID+"/role", RoleRequest{Role: RoleSupport}); w.Code != http.StatusOK {
+		t.Fatalf("Expected the support role to be assigned, got %d: %s", w.Code, w.Body.String())
+	}
+	if findUser(t, server, "helper").Role != RoleSupport {
+		t.Fatalf("Expected the role to be stored")
+	}
+
+	// Support may look users up and suspend them, but nothing more
+	if w := call(supportCookies, "GET", "/api/admin/users/search?q=customer", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected support to search users, got %d", w.Code)
+	}
+	if w := call(supportCookies, "POST", "/api/admin/users/"+customer.ID+"/suspend", SuspendUserRequest{Reason: "spam"}); w.Code != http.StatusOK {
+		t.Errorf("Expected support to suspend a user, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := call(supportCookies, "POST", "/api/admin/users/"+findUser(t, server, "admin").ID+"/suspend", SuspendUserRequest{Reason: "spam"}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected support to be unable to suspend an admin, got %d", w.Code)
+	}
+	if w := call(supportCookies, "DELETE", "/api/admin/users/"+customer.ID, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected support to be unable to delete users, got %d", w.Code)
+	}
+	if w := call(supportCookies, "GET", "/api/admin/webhooks/endpoints", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected support to be unable to manage webhooks, got %d", w.Code)
+	}
+	if w := call(supportCookies, "PUT", "/api/admin/users/"+customer.ID+"/role", RoleRequest{Role: RoleAdmin}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected support to be unable to assign roles, got %d", w.Code)
+	}
+
+	// Roles from the configuration can be assigned too
+	if w := call(adminCookies, "PUT", "/api/admin/users/"+helper.ID+"/role", RoleRequest{Role: "auditor"}); w.Code != http.StatusOK {
+		t.Fatalf("Expected a configured role to be assigned, got %d", w.Code)
+	}
+	if w := call(supportCookies, "POST", "/api/admin/users/"+customer.ID+"/unsuspend", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected an auditor to be unable to unsuspend users, got %d", w.Code)
+	}
+	if w := call(supportCookies, "GET", "/api/admin/security", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected an auditor to read the security overview, got %d", w.Code)
+	}
+	if w := call(adminCookies, "DELETE", "/api/admin/users/"+customer.ID, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected admins to keep every permission, got %d", w.Code)
+	}
+
+	var changed bool
+	for _, event := range server.authHandler.audit.Recent(0) {
+		if event.Type == AuditRoleChanged && event.Details["target"] == helper.ID && event.Details["role"] == "auditor" && event.Details["previous"] == RoleSupport {
+			changed = true
+		}
+	}
+	if !changed {
+		t.Error("Expected the role change to be audited")
+	}
+}
+
+func TestParseRolePermissions(t *testing.T) {
+	roles := parseRolePermissions("auditor=audit:read+users:read, admin=users:read, broken=users:fly, support=webhooks:manage")
+	if len(roles) != 2 || len(roles["auditor"]) != 2 || roles["support"][0] != PermissionWebhooksManage {
+		t.Errorf("Unexpected roles: %v", roles)
+	}
+}
+
+func TestPolicyEngine(t *testing.T) {
+	server := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "policy.csv")
+	os.WriteFile(path, []byte("# leads can do what support does, and manage webhooks\ng, lead, support\np, lead, webhooks, manage\n"), 0o600)
+	server.authHandler.config.PolicyFile = path
+	engine, err := newPolicyEngineFromConfig(server.authHandler.config)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	server.authHandler.policy = engine
+
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	leadCookies := registerAndLogin(t, server, "lead", "lead@example.com", "password123")
+	lead := findUser(t, server, "lead")
+
+	call := func(cookies []*http.Cookie, method, path string, body interface{}) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		}
+		req := httptest.NewRequest(method, path, reader)
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	decide := func(subject, object, action string) PolicyDecision {
+		w := call(adminCookies, "POST", "/api/admin/policy/enforce", PolicyEnforceRequest{Subject: subject, Object: object, Action: action})
+		var decision struct {
+			Data PolicyDecision `json:"data"`
+		}
+		json.NewDecoder(w.Body).Decode(&decision)
+		return decision.Data
+	}
+
+	// A role only the policy mentions can be assigned
+	if w := call(adminCookies, "PUT", "/api/admin/users/"+lead.ID+"/role", RoleRequest{Role: "lead"}); w.Code != http.StatusOK {
+		t.Fatalf("Expected the lead role to be assigned, got %d", w.Code)
+	}
+	if w := call(leadCookies, "GET", "/api/admin/users/search?q=lead", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the lead role to inherit support permissions, got %d", w.Code)
+	}
+	if w := call(leadCookies, "GET", "/api/admin/webhooks/endpoints", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the lead role to manage webhooks, got %d", w.Code)
+	}
+	if d := decide("lead", "users", "suspend"); !d.Allowed || d.Rule != "p, support, users, suspend, allow" {
+		t.Errorf("Unexpected decision: %+v", d)
+	}
+	if d := decide("lead", "users", "manage"); d.Allowed {
+		t.Errorf("Expected leads not to manage users: %+v", d)
+	}
+
+	// Rules stored through the API are written to the file
+	if w := call(adminCookies, "PUT", "/api/admin/policy", PolicyRequest{Rules: []string{"p, lead, users"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an incomplete rule to be refused, got %d", w.Code)
+	}
+	rules := []string{"g, lead, support", "p, lead, users, read, deny"}
+	if w := call(adminCookies, "PUT", "/api/admin/policy", PolicyRequest{Rules: rules}); w.Code != http.StatusOK {
+		t.Fatalf("Expected the policy to be replaced, got %d: %s", w.Code, w.Body.String())
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "p, lead, users, read, deny") {
+		t.Errorf("Expected the policy file to be rewritten, got %q", data)
+	}
+	if w := call(leadCookies, "GET", "/api/admin/users/search?q=lead", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the deny rule to win, got %d", w.Code)
+	}
+	if w := call(leadCookies, "GET", "/api/admin/webhooks/endpoints", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the removed rule to stop applying, got %d", w.Code)
+	}
+
+	// Edits to the file are picked up on reload
+	os.WriteFile(path, []byte("p, lead, webhooks, *\n"), 0o600)
+	if w := call(adminCookies, "POST", "/api/admin/policy/reload", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the policy to be reloaded, got %d", w.Code)
+	}
+	if w := call(leadCookies, "GET", "/api/admin/webhooks/endpoints", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the reloaded rule to apply, got %d", w.Code)
+	}
+	os.WriteFile(path, []byte("x, broken\n"), 0o600)
+	if w := call(adminCookies, "POST", "/api/admin/policy/reload", nil); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a broken policy file to be refused, got %d", w.Code)
+	}
+	if !engine.allows(&User{Role: "lead"}, PermissionWebhooksManage, time.Now()) {
+		t.Error("Expected the previous rules to stay in effect")
+	}
+	if w := call(leadCookies, "GET", "/api/admin/policy", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected only role managers to see the policy, got %d", w.Code)
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	server := newTestServer(t)
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	cookies := registerAndLogin(t, server, "newcomer", "newcomer@example.com", "password123")
+
+	call := func(cookies []*http.Cookie, method, path string, body interface{}) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		}
+		req := httptest.NewRequest(method, path, reader)
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	token := CreateAccessTokenRequest{Name: "ci", Scopes: []string{ScopeProfileRead}}
+
+	if w := call(adminCookies, "PUT", "/api/admin/access-rules", PolicyRequest{Rules: []string{`p, "r.sub.age_days >= ", /api/tokens, POST, deny`}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid condition to be refused, got %d", w.Code)
+	}
+	rule := `p, "r.sub.verified != true || r.sub.age_days < 7", /api/tokens, POST, deny`
+	if w := call(adminCookies, "PUT", "/api/admin/access-rules", PolicyRequest{Rules: []string{rule}}); w.Code != http.StatusOK {
+		t.Fatalf("Expected the access rule to be stored, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := call(cookies, "POST", "/api/tokens", token); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a new unverified account to be refused, got %d", w.Code)
+	}
+	if w := call(cookies, "GET", "/api/tokens", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected routes without rules to be unaffected, got %d", w.Code)
+	}
+
+	user := findUser(t, server, "newcomer")
+	verified := time.Now()
+	user.EmailVerifiedAt = &verified
+	server.authHandler.users.Update(context.Background(), user)
+	if w := call(cookies, "POST", "/api/tokens", token); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a verified but new account to be refused, got %d", w.Code)
+	}
+
+	user = findUser(t, server, "newcomer")
+	user.Created = time.Now().Add(-8 * 24 * time.Hour)
+	server.authHandler.users.Update(context.Background(), user)
+	if w := call(cookies, "POST", "/api/tokens", token); w.Code != http.StatusCreated {
+		t.Errorf("Expected a verified week-old account to create a token, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var policy struct {
+		Data struct {
+			Rules []string `json:"rules"`
+		} `json:"data"`
+	}
+	json.NewDecoder(call(adminCookies, "GET", "/api/admin/access-rules", nil).Body).Decode(&policy)
+	if len(policy.Data.Rules) != 1 || policy.Data.Rules[0] != "p, r.sub.verified != true || r.sub.age_days < 7, /api/tokens, POST, deny" {
+		t.Errorf("Expected the rule to be listed, got %q", policy.Data.Rules)
+	}
+	if w := call(cookies, "GET", "/api/admin/access-rules", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected users to be refused the access rules, got %d", w.Code)
+	}
+}
+
+func TestOrganizationSSO(t *testing.T) {
+	server := newTestServer(t)
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idp *httptest.Server
+	var nonce, email string
+	idp = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 idp.URL,
+				"authorization_endpoint": idp.URL + "/authorize",
+				"token_endpoint":         idp.URL + "/token",
+				"jwks_uri":               idp.URL + "/jwks",
+			})
+		case "/jwks":
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kty": "RSA", "kid": "k1", "use": "sig",
+				"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}}})
+		case "/token":
+			if id, secret, _ := r.BasicAuth(); id != "app" || secret != "s3cret" || r.PostFormValue("code_verifier") == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+				return
+			}
+			header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+			claims, _ := json.Marshal(map[string]interface{}{
+				"iss": idp.URL, "sub": "user-" + email, "aud": "app", "nonce": nonce,
+				"exp": time.Now().Add(time.Minute).Unix(), "email": email, "email_verified": true,
+			})
+			input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+			digest := sha256.Sum256([]byte(input))
+			signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+			json.NewEncoder(w).Encode(map[string]string{"id_token": input + "." + base64.RawURLEncoding.EncodeToString(signature)})
+		}
+	}))
+	defer idp.Close()
+
+	call := func(cookies []*http.Cookie, method, path string, body interface{}) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		}
+		req := httptest.NewRequest(method, path, reader)
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	w := call(adminCookies, "POST", "/api/admin/sso/connections", SSOConnectionRequest{
+		Organization: "example.org", Protocol: SSOProtocolOIDC, Issuer: idp.URL,
+		ClientID: "app", ClientSecret: "s3cret", JITProvisioning: true,
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected the OIDC connection to be created, got %d: %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		Data SSOConnection `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	connection := created.Data
+	if connection.RedirectURL != server.config.PublicURL+"/api/login/sso/"+connection.ID+"/oidc/callback" || strings.Contains(w.Body.String(), "s3cret") {
+		t.Errorf("Expected the redirect URL and no client secret, got %s", w.Body.String())
+	}
+	if w := call(adminCookies, "POST", "/api/admin/sso/connections", SSOConnectionRequest{
+		Organization: "example.org", Protocol: SSOProtocolSAML, Metadata: "<x/>",
+	}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected unreadable SAML metadata to be refused, got %d", w.Code)
+	}
+
+	// signIn routes the email to its provider and follows the callback
+	signIn := func(address string) *httptest.ResponseRecorder {
+		email = address
+		w := call(nil, "POST", "/api/login/sso", SSOLoginRequest{Email: address})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected %s to be routed to the provider, got %d: %s", address, w.Code, w.Body.String())
+		}
+		var started struct {
+			Data SSOLoginResponse `json:"data"`
+		}
+		json.NewDecoder(w.Body).Decode(&started)
+		target, _ := url.Parse(started.Data.RedirectURL)
+		if !strings.HasPrefix(started.Data.RedirectURL, idp.URL+"/authorize?") || target.Query().Get("code_challenge_method") != "S256" {
+			t.Fatalf("Expected an authorization request with PKCE, got %s", started.Data.RedirectURL)
+		}
+		nonce = target.Query().Get("nonce")
+		return call(w.Result().Cookies(), "GET", "/api/login/sso/"+connection.ID+"/oidc/callback?code=abc&state="+target.Query().Get("state"), nil)
+	}
+
+	if w := call(nil, "POST", "/api/login/sso", SSOLoginRequest{Email: "bob@other.org"}); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a domain without SSO to fall back, got %d", w.Code)
+	}
+
+	w = signIn("carol@example.org")
+	if w.Code != http.StatusSeeOther || len(w.Result().Cookies()) == 0 {
+		t.Fatalf("Expected the member to be signed in, got %d: %s", w.Code, w.Body.String())
+	}
+	carol := findUser(t, server, "carol")
+	if carol.Email != "carol@example.org" || len(carol.Identities) != 1 || carol.Identities[0].Provider != "sso:"+connection.ID {
+		t.Errorf("Expected carol to be provisioned with a linked identity, got %+v", carol)
+	}
+	if carol.Role != RoleUser {
+		t.Errorf("Expected a provisioned account to get the user role, got %s", carol.Role)
+	}
+	if w := signIn("carol@example.org"); w.Code != http.StatusSeeOther {
+		t.Errorf("Expected carol to sign in again, got %d", w.Code)
+	}
+	if len(listUsers(t, server)) != 2 {
+		t.Errorf("Expected carol to be provisioned once")
+	}
+
+	registerAndLogin(t, server, "dave", "dave@example.org", "password123")
+	if w := signIn("dave@example.org"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected an unverified account with the email not to be linked, got %d", w.Code)
+	}
+	dave := findUser(t, server, "dave")
+	verified := time.Now()
+	dave.EmailVerifiedAt = &verified
+	server.authHandler.users.Update(context.Background(), dave)
+	if w := signIn("dave@example.org"); w.Code != http.StatusSeeOther || len(findUser(t, server, "dave").Identities) != 1 {
+		t.Errorf("Expected the verified account to be linked, got %d", w.Code)
+	}
+
+	w = call(nil, "POST", "/api/login/sso", SSOLoginRequest{Email: "erin@example.org"})
+	var started struct {
+		Data SSOLoginResponse `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&started)
+	target, _ := url.Parse(started.Data.RedirectURL)
+	if w := call(nil, "GET", "/api/login/sso/"+connection.ID+"/oidc/callback?code=abc&state="+target.Query().Get("state"), nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a callback in another browser to be refused, got %d", w.Code)
+	}
+
+	nonce = "forged"
+	email = "erin@example.org"
+	w = call(nil, "POST", "/api/login/sso", SSOLoginRequest{Email: email})
+	json.NewDecoder(w.Body).Decode(&started)
+	target, _ = url.Parse(started.Data.RedirectURL)
+	if w := call(w.Result().Cookies(), "GET", "/api/login/sso/"+connection.ID+"/oidc/callback?code=abc&state="+target.Query().Get("state"), nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an ID token with the wrong nonce to be refused, got %d", w.Code)
+	}
+
+	if w := call(adminCookies, "PATCH", "/api/admin/sso/connections/"+connection.ID, map[string]bool{"jitProvisioning": false}); w.Code != http.StatusOK {
+		t.Fatalf("Expected the connection to be updated, got %d", w.Code)
+	}
+	if w := signIn("frank@example.org"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected no account to be provisioned without JIT provisioning, got %d", w.Code)
+	}
+
+	// A SAML connection is set up from the provider's metadata
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "idp"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	metadata := `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.net"><IDPSSODescriptor>` +
+		`<KeyDescriptor use="signing"><KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#"><X509Data><X509Certificate>` + base64.StdEncoding.EncodeToString(der) + `</X509Certificate></X509Data></KeyInfo></KeyDescriptor>` +
+		`<SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.net/sso"/></IDPSSODescriptor></EntityDescriptor>`
+	if w := call(adminCookies, "POST", "/api/admin/sso/connections", SSOConnectionRequest{Organization: "corp.example", Protocol: SSOProtocolSAML, Metadata: metadata, Domains: []string{"example.org"}}); w.Code != http.StatusConflict {
+		t.Errorf("Expected a domain routed elsewhere to be refused, got %d", w.Code)
+	}
+	w = call(adminCookies, "POST", "/api/admin/sso/connections", SSOConnectionRequest{Organization: "corp.example", Protocol: SSOProtocolSAML, Metadata: metadata})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected the SAML connection to be created, got %d: %s", w.Code, w.Body.String())
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	if created.Data.EntityID != "https://idp.example.net" || created.Data.CertificateExpiresAt == nil {
+		t.Errorf("Expected the metadata to be read, got %+v", created.Data)
+	}
+	if w := call(nil, "GET", "/api/login/sso/"+created.Data.ID+"/saml/metadata", nil); !strings.Contains(w.Body.String(), created.Data.RedirectURL) {
+		t.Errorf("Expected the service provider metadata to name the ACS URL, got %s", w.Body.String())
+	}
+
+	req := httptest.NewRequest("GET", "/api/login/sso?email=grace@corp.example", nil)
+	w = httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(location, "https://idp.example.net/sso?") || !strings.Contains(location, "SAMLRequest=") {
+		t.Fatalf("Expected a redirect with an AuthnRequest, got %d %s", w.Code, location)
+	}
+	target, _ = url.Parse(location)
+	form := url.Values{
+		"RelayState":   {target.Query().Get("RelayState")},
+		"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"><samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status></samlp:Response>`))},
+	}
+	req = httptest.NewRequest("POST", "/api/login/sso/"+created.Data.ID+"/saml/acs", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an unsigned response to be refused, got %d", w.Code)
+	}
+
+	if w := call(nil, "GET", "/api/admin/sso/connections", nil); w.Code != http.StatusUnauthorized && w.Code != http.StatusForbidden {
+		t.Errorf("Expected connections to be admin only, got %d", w.Code)
+	}
+}
+
+func TestSAMLServiceProvider(t *testing.T) {
+	server := newTestServer(t)
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+
+	call := func(cookies []*http.Cookie, method, path string, body interface{}) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		}
+		req := httptest.NewRequest(method, path, reader)
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "idp"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	metadata := `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.net"><IDPSSODescriptor>` +
+		`<KeyDescriptor use="signing"><KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#"><X509Data><X509Certificate>` + base64.StdEncoding.EncodeToString(der) + `</X509Certificate></X509Data></KeyInfo></KeyDescriptor>` +
+		`<SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.net/sso"/></IDPSSODescriptor></EntityDescriptor>`
+
+	mapping := SSOAttributeMapping{Username: "uid", DisplayName: "displayName"}
+	if w := call(adminCookies, "POST", "/api/admin/sso/connections", SSOConnectionRequest{
+		Organization: "corp.example", Protocol: SSOProtocolOIDC, Issuer: "https://idp.example.net", ClientID: "app", ClientSecret: "s3cret", AttributeMapping: mapping,
+	}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected attribute mapping to be refused for OIDC, got %d", w.Code)
+	}
+	w := call(adminCookies, "POST", "/api/admin/sso/connections", SSOConnectionRequest{
+		Organization: "corp.example", Protocol: SSOProtocolSAML, Metadata: metadata, JITProvisioning: true, AttributeMapping: mapping,
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected the SAML connection to be created, got %d: %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		Data SSOConnection `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	connection := created.Data
+
+	// respond signs an assertion in its canonical form, so its digest is
+	// over the bytes as written
+	respond := func(id, requestID string, notOnOrAfter time.Time) string {
+		inResponseTo := ""
+		if requestID != "" {
+			inResponseTo = ` InResponseTo="` + requestID + `"`
+		}
+		expiry := notOnOrAfter.UTC().Format(time.RFC3339)
+		start := `<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="` + id + `" Version="2.0"><saml:Issuer>https://idp.example.net</saml:Issuer>`
+		rest := `<saml:Subject><saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">grace@corp.example</saml:NameID>` +
+			`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer"><saml:SubjectConfirmationData` + inResponseTo + ` NotOnOrAfter="` + expiry + `" Recipient="` + connection.RedirectURL + `"></saml:SubjectConfirmationData></saml:SubjectConfirmation></saml:Subject>` +
+			`<saml:Conditions NotOnOrAfter="` + expiry + `"><saml:AudienceRestriction><saml:Audience>` + connection.SPEntityID + `</saml:Audience></saml:AudienceRestriction></saml:Conditions>` +
+			`<saml:AttributeStatement><saml:Attribute Name="uid"><saml:AttributeValue>ghopper</saml:AttributeValue></saml:Attribute>` +
+			`<saml:Attribute Name="displayName"><saml:AttributeValue>Grace Hopper</saml:AttributeValue></saml:Attribute></saml:AttributeStatement></saml:Assertion>`
+		digest := sha256.Sum256([]byte(start + rest))
+		signedInfo := `<ds:SignedInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"></ds:CanonicalizationMethod>` +
+			`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"></ds:SignatureMethod><ds:Reference URI="#` + id + `"><ds:Transforms>` +
+			`<ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"></ds:Transform><ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"></ds:Transform></ds:Transforms>` +
+			`<ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"></ds:DigestMethod><ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest[:]) + `</ds:DigestValue></ds:Reference></ds:SignedInfo>`
+		hashed := sha256.Sum256([]byte(signedInfo))
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+		assertion := start + `<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#">` + signedInfo + `<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(signature) + `</ds:SignatureValue></ds:Signature>` + rest
+		return base64.StdEncoding.EncodeToString([]byte(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="r` + id + `"` + inResponseTo + ` Version="2.0">` +
+			`<saml:Issuer>https://idp.example.net</saml:Issuer><samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>` + assertion + `</samlp:Response>`))
+	}
+	post := func(cookies []*http.Cookie, relayState, response string) *httptest.ResponseRecorder {
+		form := url.Values{"RelayState": {relayState}, "SAMLResponse": {response}}
+		req := httptest.NewRequest("POST", "/api/login/sso/"+connection.ID+"/saml/acs", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	// SP-initiated: the response answers the AuthnRequest and the mapped
+	// attributes name the new account
+	w = call(nil, "GET", "/api/login/sso?email=grace@corp.example", nil)
+	target, _ := url.Parse(w.Header().Get("Location"))
+	relayState := target.Query().Get("RelayState")
+	login, ok := server.ssoLogins.pending[relayState]
+	if !ok {
+		t.Fatalf("Expected a pending sign-in, got %d %s", w.Code, target)
+	}
+	now := time.Now()
+	w = post(w.Result().Cookies(), relayState, respond("a1", login.requestID, now.Add(5*time.Minute)))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != server.config.BasePath+"/" {
+		t.Fatalf("Expected the SAML sign-in to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if user := findUser(t, server, "ghopper"); user.Email != "grace@corp.example" || user.DisplayName != "Grace Hopper" {
+		t.Errorf("Expected the account to be provisioned from the attributes, got %+v", user)
+	}
+
+	// IdP-initiated responses are refused until the connection allows them
+	if w := post(nil, "/settings", respond("a2", "", now.Add(5*time.Minute))); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unsolicited response to be refused, got %d", w.Code)
+	}
+	if w := call(adminCookies, "PATCH", "/api/admin/sso/connections/"+connection.ID, map[string]bool{"allowIdpInitiated": true}); w.Code != http.StatusOK {
+		t.Fatalf("Expected the connection to be updated, got %d", w.Code)
+	}
+	response := respond("a3", "", now.Add(5*time.Minute))
+	if w := post(nil, "/settings", response); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/settings" {
+		t.Errorf("Expected an IdP-initiated sign-in to the relay state, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if w := post(nil, "/settings", response); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a replayed assertion to be refused, got %d", w.Code)
+	}
+	if w := post(nil, "https://evil.example/", respond("a4", "", now.Add(5*time.Minute))); w.Header().Get("Location") != server.config.BasePath+"/" {
+		t.Errorf("Expected an off-site relay state to be ignored, got %s", w.Header().Get("Location"))
+	}
+	if w := post(nil, "", respond("a5", "id-forged", now.Add(5*time.Minute))); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a response to an unknown request to be refused, got %d", w.Code)
+	}
+
+	// Assertions just past their expiry are within the clock skew
+	if w := post(nil, "", respond("a6", "", now.Add(-time.Minute))); w.Code != http.StatusSeeOther {
+		t.Errorf("Expected an assertion within the clock skew to be accepted, got %d", w.Code)
+	}
+	if w := post(nil, "", respond("a7", "", now.Add(-5*time.Minute))); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an expired assertion to be refused, got %d", w.Code)
+	}
+}
+
+func TestProvisioningRules(t *testing.T) {
+	t.Setenv("TRUSTED_HEADER_AUTH", "true")
+	t.Setenv("TRUSTED_HEADER_PROXIES", "10.0.0.0/8")
+	server := newTestServer(t)
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+
+	put := func(rules ...string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(PolicyRequest{Rules: rules})
+		req := httptest.NewRequest("PUT", "/api/admin/provisioning-rules", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range adminCookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	arrive := func(user, groups string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/profile", nil)
+		req.RemoteAddr = "10.0.0.5:41000"
+		req.Header.Set("X-Auth-Request-User", user)
+		req.Header.Set("X-Auth-Request-Email", user)
+		req.Header.Set("X-Auth-Request-Groups", groups)
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := put(`p, r.sub.nope ==, *, *, *, allow`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid rule to be refused, got %d", w.Code)
+	}
+	if w := put(
+		`p, r.sub.domain == "contractors.example", sso-proxy, *, *, deny`,
+		`p, "listMatch(r.sub.groups, 'it-admins')", sso-*, support, *, allow`,
+		`p, r.sub.domain == "corp-eu.example", *, *, corp.example, allow`,
+		`p, r.sub.username == "mallory", *, overlord, *, allow`,
+	); w.Code != http.StatusOK {
+		t.Fatalf("Expected the rules to be stored, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := arrive("eve@contractors.example", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a blocked domain to be refused, got %d", w.Code)
+	}
+	if _, err := server.authHandler.users.GetByUsername(context.Background(), "eve"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected no account for a refused user, got %v", err)
+	}
+	if w := arrive("mallory@corp.example", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a rule giving an unknown role to refuse the user, got %d", w.Code)
+	}
+
+	if w := arrive("ivan@corp.example", "staff, it-admins"); w.Code != http.StatusOK {
+		t.Fatalf("Expected the user to be provisioned, got %d: %s", w.Code, w.Body.String())
+	}
+	if ivan := findUser(t, server, "ivan"); ivan.Role != RoleSupport || userOrganization(ivan) != "corp.example" {
+		t.Errorf("Expected the group rule to give the support role, got %q in %q", ivan.Role, userOrganization(ivan))
+	}
+	if w := arrive("jo@corp-eu.example", "staff"); w.Code != http.StatusOK {
+		t.Fatalf("Expected the user to be provisioned, got %d", w.Code)
+	}
+	if jo := findUser(t, server, "jo"); jo.Role != RoleUser || jo.Organization != "corp.example" {
+		t.Errorf("Expected the domain rule to assign the organization, got %q in %q", jo.Role, jo.Organization)
+	}
+	if w := arrive("kim@other.example", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected a user no rule matches to get the defaults, got %d", w.Code)
+	}
+	if kim := findUser(t, server, "kim"); kim.Role != RoleUser || kim.Organization != "" || userOrganization(kim) != "other.example" {
+		t.Errorf("Expected the default role and organization, got %q in %q", kim.Role, kim.Organization)
+	}
+}
+
+func TestEmailTemplates(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("EMAIL_TEMPLATES_DIR", dir)
+	server := newTestServer(t)
+	sent := make(recordingMailer, 10)
+	server.authHandler.mailer = sent
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	call := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		}
+		req := httptest.NewRequest(method, path, reader)
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range adminCookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder, data interface{}) {
+		t.Helper()
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		response := Response{Data: data}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := func() mailer.Message {
+		t.Helper()
+		select {
+		case msg := <-sent:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected an email")
+		}
+		return mailer.Message{}
+	}
+
+	var list []EmailTemplateInfo
+	decode(call("GET", "/api/admin/email-templates", nil), &list)
+	if len(list) != len(translations.EmailNames())*len(translations.Locales()) {
+		t.Errorf("Expected every template in every locale, got %d entries", len(list))
+	}
+
+	const path = "/api/admin/email-templates/en/password_reset"
+	if w := call("GET", "/api/admin/email-templates/en/nope", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown template to be 404, got %d", w.Code)
+	}
+	if w := call("PUT", "/api/admin/email-templates/xx/password_reset", EmailTemplateRequest{Source: "x"}); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown locale to be 404, got %d", w.Code)
+	}
+	for _, source := range []string{
+		`{{define "subject"}}Reset{{end}}`,
+		`{{define "subject"}}Reset{{end}}{{define "body"}}{{.Nope}}{{end}}`,
+		`{{define "subject"}}Reset{{end}}{{define "body"}}{{.Link}{{end}}`,
+	} {
+		if w := call("PUT", path, EmailTemplateRequest{Source: source}); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected %q to be refused, got %d", source, w.Code)
+		}
+	}
+
+	override := `{{define "subject"}}Example Corp password reset{{end}}{{define "body"}}Hello {{.Username}}, go to {{.Link}} within {{.TTL}}.{{end}}`
+	var described EmailTemplate
+	decode(call("PUT", path, EmailTemplateRequest{Source: override}), &described)
+	if !described.Overridden || described.Source != override || !strings.Contains(described.Default, "Reset your password") {
+		t.Errorf("Expected the override to be described, got %+v", described)
+	}
+	if saved, err := os.ReadFile(filepath.Join(dir, "en", "password_reset.tmpl")); err != nil || string(saved) != override {
+		t.Errorf("Expected the override to be saved, got %q, %v", saved, err)
+	}
+
+	body, _ := json.Marshal(PasswordResetRequest{Email: "test@example.com"})
+	server.PasswordResetRequestHandler(httptest.NewRecorder(), jsonRequest("POST", "/api/password-reset/request", body))
+	if msg := next(); msg.Subject != "Example Corp password reset" || !strings.HasPrefix(msg.Body, "Hello testuser, go to ") {
+		t.Errorf("Expected the reset email to use the override, got %q: %q", msg.Subject, msg.Body)
+	}
+
+	var preview EmailTemplatePreview
+	decode(call("POST", path+"/preview", EmailTemplatePreviewRequest{
+		Source: `{{define "subject"}}Draft{{end}}{{define "body"}}{{.Username}} {{.TTL}}{{end}}`,
+	}), &preview)
+	if preview.Subject != "Draft" || preview.Body != "jane 1h0m0s" || preview.SentTo != "" {
+		t.Errorf("Expected the draft rendered with example data, got %+v", preview)
+	}
+	decode(call("POST", path+"/preview", EmailTemplatePreviewRequest{Send: true}), &preview)
+	if preview.Subject != "Example Corp password reset" || preview.SentTo != "admin@example.com" {
+		t.Errorf("Expected the override sent to the admin, got %+v", preview)
+	}
+	if msg := next(); msg.To != "admin@example.com" || msg.Subject != "Example Corp password reset" {
+		t.Errorf("Expected a test email to the admin, got %+v", msg)
+	}
+
+	// Overrides are loaded when the server starts
+	reloaded, err := newEmailTemplateStore(dir, "", server.logger)
+	if err != nil || reloaded.get("en", "password_reset") == nil {
+		t.Errorf("Expected the override to be loaded from the directory, got %v", err)
+	}
+
+	decode(call("DELETE", path, nil), &described)
+	if described.Overridden || described.Source != described.Default {
+		t.Errorf("Expected the default to be restored, got %+v", described)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "en", "password_reset.tmpl")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the override file to be removed, got %v", err)
+	}
+	server.PasswordResetRequestHandler(httptest.NewRecorder(), jsonRequest("POST", "/api/password-reset/request", body))
+	if msg := next(); msg.Subject != "Reset your password" {
+		t.Errorf("Expected the built-in reset email, got %q", msg.Subject)
+	}
+
+	var events []AuditEvent
+	for _, event := range server.audit.Recent(100) {
+		if event.Type == AuditEmailTemplateChanged {
+			events = append(events, event)
+		}
+	}
+	if len(events) != 2 {
+		t.Errorf("Expected the override and reset audited, got %+v", events)
+	}
+}
+
+// brokenUserStore fails every lookup, as an unreachable database would
+type brokenUserStore struct {
+	UserStore
+}
+
+func (brokenUserStore) GetByUsername(ctx context.Context, username string) (*User, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestAdminAlerts(t *testing.T) {
+	type received struct {
+		channel   string
+		body      []byte
+		signature string
+	}
+	alerts := make(chan received, 20)
+	channel := func(name string) *httptest.Server {
+		endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			alerts <- received{channel: name, body: body, signature: r.Header.Get("X-Alert-Signature")}
+		}))
+		t.Cleanup(endpoint.Close)
+		return endpoint
+	}
+	slack, webhook := channel("slack"), channel("webhook")
+	t.Setenv("ALERT_SLACK_WEBHOOK_URL", slack.URL)
+	t.Setenv("ALERT_WEBHOOK_URL", webhook.URL)
+	t.Setenv("ALERT_WEBHOOK_SECRET", "alert-secret")
+	t.Setenv("ALERT_ROUTES", "failed_logins=slack,store_error=webhook,bogus=slack")
+	t.Setenv("ALERT_FAILED_LOGIN_THRESHOLD", "3")
+
+	server := newTestServer(t)
+	stop := server.authHandler.alerts.start(server.audit)
+	defer stop()
+
+	next := func(what string) received {
+		t.Helper()
+		select {
+		case alert := <-alerts:
+			return alert
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected %s", what)
+		}
+		return received{}
+	}
+	expectNone := func(what string) {
+		t.Helper()
+		select {
+		case alert := <-alerts:
+			t.Errorf("Expected no %s, got %s on %s", what, alert.body, alert.channel)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	// byChannel collects one alert from each of the two channels
+	byChannel := func(what string) map[string]received {
+		t.Helper()
+		got := make(map[string]received)
+		for range 2 {
+			alert := next(what)
+			got[alert.channel] = alert
+		}
+		return got
+	}
+
+	// Without a route an alert goes to every channel
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	created := byChannel("admin created alerts")
+	var payload alertPayload
+	if err := json.Unmarshal(created["webhook"].body, &payload); err != nil || payload.Alert != AlertAdminCreated || payload.Details["username"] != "admin" {
+		t.Errorf("Expected an admin created payload, got %s (%v)", created["webhook"].body, err)
+	}
+	mac := hmac.New(sha256.New, []byte("alert-secret"))
+	mac.Write(created["webhook"].body)
+	if created["webhook"].signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("Expected the webhook alert to be signed, got %q", created["webhook"].signature)
+	}
+	var message slackPayload
+	if err := json.Unmarshal(created["slack"].body, &message); err != nil || !strings.Contains(message.Text, "admin_created") || created["slack"].signature != "" {
+		t.Errorf("Expected an unsigned Slack message, got %s", created["slack"].body)
+	}
+
+	registerAndLogin(t, server, "bob", "bob@example.com", "password123")
+	expectNone("alert for a user account")
+	bob := findUser(t, server, "bob")
+	body, _ := json.Marshal(RoleRequest{Role: RoleAdmin})
+	req := jsonRequest("PUT", "/api/admin/users/"+bob.ID+"/role", body)
+	for _, cookie := range adminCookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the promotion to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if promoted := byChannel("promotion alerts"); !bytes.Contains(promoted["webhook"].body, []byte(bob.ID)) {
+		t.Errorf("Expected the promotion alert to name the user, got %s", promoted["webhook"].body)
+	}
+
+	failLogin := func(username string) {
+		body, _ := json.Marshal(LoginRequest{Username: username, Password: "wrong-password"})
+		server.LoginHandler(httptest.NewRecorder(), jsonRequest("POST", "/api/login", body))
+	}
+	failLogin("nobody")
+	failLogin("someone")
+	expectNone("alert below the threshold")
+	failLogin("anyone")
+	if alert := next("a failed logins alert"); alert.channel != "slack" || !bytes.Contains(alert.body, []byte("3 failed logins")) {
+		t.Errorf("Expected a failed logins alert on Slack, got %s on %s", alert.body, alert.channel)
+	}
+	failLogin("nobody")
+	expectNone("second failed logins alert within the cooldown")
+
+	// Store errors are throttled too
+	alerting := server.authHandler.users.(*searchableUserStore).next.(*encryptedUserStore).next.(*alertingUserStore)
+	alerting.next = brokenUserStore{UserStore: alerting.next}
+	loginBody, _ := json.Marshal(LoginRequest{Username: "bob", Password: "password123"})
+	for range 2 {
+		w := httptest.NewRecorder()
+		server.LoginHandler(w, jsonRequest("POST", "/api/login", loginBody))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected the broken store to fail the login, got %d", w.Code)
+		}
+	}
+	if alert := next("a store error alert"); alert.channel != "webhook" || !bytes.Contains(alert.body, []byte("connection refused")) {
+		t.Errorf("Expected a store error alert on the webhook, got %s on %s", alert.body, alert.channel)
+	}
+	expectNone("second store error alert within the cooldown")
+}
+
+func TestBilling(t *testing.T) {
+	var customers atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path != "/v1/customers" || r.Header.Get("Authorization") != "Bearer sk_test" || !strings.HasPrefix(r.PostForm.Get("metadata[account]"), "user:") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		customers.Add(1)
+		json.NewEncoder(w).Encode(map[string]string{"id": "cus_123", "email": r.PostForm.Get("email")})
+	}))
+	defer api.Close()
+	t.Setenv("TIERS", "free=tokens:1+daily:2,pro=tokens:3+daily:100,bogus")
+	t.Setenv("STRIPE_SECRET_KEY", "sk_test")
+	t.Setenv("STRIPE_API_URL", api.URL)
+	t.Setenv("STRIPE_WEBHOOK_SECRET", "whsec_test")
+	t.Setenv("STRIPE_PRICE_TIERS", "price_pro=pro")
+	server := newTestServer(t)
+	if len(server.config.Tiers) != 2 || server.config.Tiers["pro"].AccessTokens != 3 {
+		t.Fatalf("Expected two tiers, got %v", server.config.Tiers)
+	}
+
+	serve := func(req *http.Request, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	createToken := func(cookies []*http.Cookie, name string) int {
+		body, _ := json.Marshal(CreateAccessTokenRequest{Name: name, Scopes: []string{ScopeProfileRead}})
+		return serve(jsonRequest("POST", "/api/tokens", body), cookies).Code
+	}
+	status := func(cookies []*http.Cookie) BillingStatus {
+		t.Helper()
+		w := serve(httptest.NewRequest("GET", "/api/billing", nil), cookies)
+		var resp struct {
+			Data BillingStatus `json:"data"`
+		}
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &resp) != nil {
+			t.Fatalf("Expected the billing status, got %d: %s", w.Code, w.Body.String())
+		}
+		return resp.Data
+	}
+	webhook := func(eventType, status string, created time.Time, sign func([]byte) string) int {
+		subscription := map[string]interface{}{
+			"id":                 "sub_1",
+			"customer":           "cus_123",
+			"status":             status,
+			"items":              map[string]interface{}{"data": []interface{}{map[string]interface{}{"price": map[string]string{"id": "price_pro"}}}},
+			"current_period_end": created.Add(30 * 24 * time.Hour).Unix(),
+		}
+		payload, _ := json.Marshal(map[string]interface{}{
+			"id":      "evt_" + status,
+			"type":    eventType,
+			"created": created.Unix(),
+			"data":    map[string]interface{}{"object": subscription},
+		})
+		req := httptest.NewRequest("POST", "/api/billing/stripe/webhook", bytes.NewReader(payload))
+		req.Header.Set("Stripe-Signature", sign(payload))
+		return serve(req, nil).Code
+	}
+	signed := func(payload []byte) string { return stripe.Sign(payload, "whsec_test", time.Now()) }
+
+	// New users are on the default tier and held to its limits
+	cookies := registerAndLogin(t, server, "alice", "alice@example.com", "password123")
+	if got := status(cookies); got.Tier != "free" || got.Limits.AccessTokens != 1 || got.Limits.DailyQuota != 2 || got.Account != nil {
+		t.Errorf("Expected the free tier, got %+v", got)
+	}
+	if code := createToken(cookies, "first"); code != http.StatusCreated {
+		t.Fatalf("Expected the first token to be created, got %d", code)
+	}
+	if code := createToken(cookies, "second"); code != http.StatusForbidden {
+		t.Errorf("Expected the free tier to refuse a second token, got %d", code)
+	}
+	for i := 0; i < 2; i++ {
+		serve(httptest.NewRequest("GET", "/api/random", nil), cookies)
+	}
+	if w := serve(httptest.NewRequest("GET", "/api/random", nil), cookies); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the free tier's daily quota, got %d", w.Code)
+	}
+
+	// Linking creates the Stripe customer once
+	for i := 0; i < 2; i++ {
+		w := serve(httptest.NewRequest("POST", "/api/billing/customer", nil), cookies)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"customerId":"cus_123"`) {
+			t.Fatalf("Expected the customer to be linked, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	if customers.Load() != 1 {
+		t.Errorf("Expected one customer to be created, got %d", customers.Load())
+	}
+
+	// Subscription events move the account between tiers
+	if code := webhook(stripeSubscriptionUpdated, "active", time.Now(), func([]byte) string { return stripe.Sign([]byte("other"), "whsec_test", time.Now()) }); code != http.StatusBadRequest {
+		t.Errorf("Expected a bad signature to be refused, got %d", code)
+	}
+	if code := webhook(stripeSubscriptionUpdated, "active", time.Now(), func(payload []byte) string { return stripe.Sign(payload, "whsec_test", time.Now().Add(-time.Hour)) }); code != http.StatusBadRequest {
+		t.Errorf("Expected an old signature to be refused, got %d", code)
+	}
+	if code := webhook(stripeSubscriptionUpdated, "active", time.Now(), signed); code != http.StatusOK {
+		t.Fatalf("Expected the webhook to be accepted, got %d", code)
+	}
+	if user := findUser(t, server, "alice"); user.Tier != "pro" {
+		t.Errorf("Expected alice to be on pro, got %q", user.Tier)
+	}
+	if got := status(cookies); got.Tier != "pro" || got.Limits.AccessTokens != 3 || got.Account == nil || got.Account.SubscriptionID != "sub_1" || got.Account.CurrentPeriodEnd == nil {
+		t.Errorf("Expected the pro tier from the subscription, got %+v", got)
+	}
+	if code := createToken(cookies, "second"); code != http.StatusCreated {
+		t.Errorf("Expected pro to allow a second token, got %d", code)
+	}
+	if w := serve(httptest.NewRequest("GET", "/api/random", nil), cookies); w.Code != http.StatusOK {
+		t.Errorf("Expected pro's daily quota, got %d", w.Code)
+	}
+
+	// Events delivered out of order are ignored
+	if code := webhook(stripeSubscriptionUpdated, "past_due", time.Now().Add(-time.Minute), signed); code != http.StatusOK {
+		t.Fatalf("Expected the stale webhook to be acknowledged, got %d", code)
+	}
+	if user := findUser(t, server, "alice"); user.Tier != "pro" {
+		t.Errorf("Expected a stale event to be ignored, got %q", user.Tier)
+	}
+	if code := webhook(stripeSubscriptionDeleted, "canceled", time.Now().Add(time.Second), signed); code != http.StatusOK {
+		t.Fatalf("Expected the webhook to be accepted, got %d", code)
+	}
+	if got := status(cookies); got.Tier != "free" {
+		t.Errorf("Expected a canceled subscription to return to free, got %+v", got)
+	}
+
+	// Admins put organizations on a tier for their members
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.org", "password123")
+	put := func(account, body string) *httptest.ResponseRecorder {
+		return serve(jsonRequest("PUT", "/api/admin/billing/accounts/"+account, []byte(body)), adminCookies)
+	}
+	if w := put("team:example.com", `{"tier":"pro"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid account to be refused, got %d", w.Code)
+	}
+	if w := put("org:example.com", `{"tier":"gold"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown tier to be refused, got %d", w.Code)
+	}
+	if w := put("org:example.com", `{"customerId":"cus_123"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected a linked customer to be refused, got %d", w.Code)
+	}
+	if w := put("org:example.com", `{"tier":"pro"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected the organization's tier to be set, got %d: %s", w.Code, w.Body.String())
+	}
+	bobCookies := registerAndLogin(t, server, "bob", "bob@example.com", "password123")
+	if got := status(bobCookies); got.Tier != "pro" || got.Account == nil || got.Account.Account != "org:example.com" {
+		t.Errorf("Expected bob to get the organization's tier, got %+v", got)
+	}
+	w := serve(httptest.NewRequest("GET", "/api/admin/billing/accounts", nil), adminCookies)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"account":"org:example.com"`) || !strings.Contains(w.Body.String(), `"account":"user:`) {
+		t.Errorf("Expected both billing accounts to be listed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve(httptest.NewRequest("GET", "/api/admin/billing/accounts", nil), bobCookies); w.Code != http.StatusForbidden {
+		t.Errorf("Expected non-admins to be refused, got %d", w.Code)
+	}
+
+	var reasons []string
+	for _, event := range server.audit.Recent(50) {
+		if event.Type == AuditTierChanged {
+			reasons = append(reasons, event.Details["reason"])
+		}
+	}
+	slices.Sort(reasons)
+	if strings.Join(reasons, ",") != "admin,subscription_active,subscription_canceled" {
+		t.Errorf("Expected three tier changes to be audited, got %v", reasons)
+	}
+}
+
+func TestUsageMetering(t *testing.T) {
+	server := newTestServer(t)
+
+	serve := func(req *http.Request, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	cookies := registerAndLogin(t, server, "alice", "alice@example.com", "password123")
+	alice := findUser(t, server, "alice")
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+
+	body, _ := json.Marshal(CreateAccessTokenRequest{Name: "ci", Scopes: []string{ScopeTransformHash, ScopeProfileRead}})
+	w := serve(jsonRequest("POST", "/api/tokens", body), cookies)
+	var created struct {
+		Data CreatedAccessToken `json:"data"`
+	}
+	if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &created) != nil {
+		t.Fatalf("Expected a token, got %d: %s", w.Code, w.Body.String())
+	}
+	withToken := func(req *http.Request) *http.Request {
+		req.Header.Set("Authorization", "Bearer "+created.Data.Token)
+		return req
+	}
+
+	hashBody := `{"input":"hello","algorithm":"sha256"}`
+	var tokenBytesOut int64
+	for i := 0; i < 3; i++ {
+		w := serve(withToken(jsonRequest("POST", "/api/hash", []byte(hashBody))), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the hash to succeed, got %d", w.Code)
+		}
+		tokenBytesOut += int64(w.Body.Len())
+	}
+	serve(withToken(jsonRequest("POST", "/api/hash", []byte(`{"input":"hello","algorithm":"md4"}`))), nil)
+	serve(jsonRequest("POST", "/api/hash", []byte(hashBody)), cookies)
+	serve(jsonRequest("POST", "/api/hash", []byte(hashBody)), nil)
+
+	// Nothing is reported until the counts are aggregated
+	var report UsageReport
+	getReport := func(query string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := serve(httptest.NewRequest("GET", "/api/admin/reports/usage"+query, nil), adminCookies)
+		report = UsageReport{}
+		if w.Code == http.StatusOK && !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") {
+			var resp struct {
+				Data UsageReport `json:"data"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			report = resp.Data
+		}
+		return w
+	}
+	if getReport("?endpoint=POST+/api/hash"); len(report.Records) != 0 {
+		t.Errorf("Expected no records before aggregation, got %+v", report.Records)
+	}
+	if updated := server.usage.aggregate(time.Now()); updated == 0 {
+		t.Fatal("Expected pending usage to be aggregated")
+	}
+
+	tokenKey := "token:" + created.Data.ID
+	if w := getReport("?endpoint=POST+/api/hash&granularity=total"); w.Code != http.StatusOK || len(report.Records) != 3 {
+		t.Fatalf("Expected a record per key, got %d: %+v", w.Code, report.Records)
+	}
+	byKey := make(map[string]UsageRecord)
+	for _, record := range report.Records {
+		byKey[record.Key] = record
+	}
+	token := byKey[tokenKey]
+	if token.Requests != 4 || token.Errors != 1 || token.UserID != alice.ID || token.BytesIn != int64(3*len(hashBody)+len(`{"input":"hello","algorithm":"md4"}`)) || token.BytesOut <= tokenBytesOut {
+		t.Errorf("Unexpected token usage: %+v", token)
+	}
+	if session := byKey["user:"+alice.ID]; session.Requests != 1 || session.UserID != alice.ID {
+		t.Errorf("Expected the session's request under its user, got %+v", session)
+	}
+	if anonymous := byKey[usageAnonymous]; anonymous.Requests != 1 || anonymous.UserID != "" {
+		t.Errorf("Expected the anonymous request, got %+v", anonymous)
+	}
+	if report.Total.Requests != 6 {
+		t.Errorf("Expected the total to sum the records, got %+v", report.Total)
+	}
+	if getReport("?key=" + tokenKey + "&granularity=hour"); len(report.Records) != 1 || !report.Records[0].Period.Equal(time.Now().UTC().Truncate(time.Hour)) {
+		t.Errorf("Expected the token's hourly record, got %+v", report.Records)
+	}
+	for _, query := range []string{"?from=yesterday", "?from=2030-01-02&to=2030-01-01", "?granularity=week", "?format=xml"} {
+		if w := getReport(query); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be refused, got %d", query, w.Code)
+		}
+	}
+	if getReport("?to=2000-01-01T00:00:00Z&from=1999-01-01"); len(report.Records) != 0 {
+		t.Errorf("Expected the range to apply, got %+v", report.Records)
+	}
+
+	w = getReport("?endpoint=POST+/api/hash&format=csv&granularity=total")
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if w.Code != http.StatusOK || err != nil || len(rows) != 4 || rows[0][1] != "key" || !strings.Contains(w.Header().Get("Content-Disposition"), "usage-") {
+		t.Errorf("Expected a CSV report, got %d %v: %v", w.Code, err, rows)
+	}
+	if w := serve(httptest.NewRequest("GET", "/api/admin/reports/usage", nil), cookies); w.Code != http.StatusForbidden {
+		t.Errorf("Expected non-admins to be refused, got %d", w.Code)
+	}
+
+	// Users see the usage of their own sessions and tokens
+	w = serve(withToken(httptest.NewRequest("GET", "/api/usage", nil)), nil)
+	var usage struct {
+		Data struct {
+			Metered struct {
+				Records []UsageRecord `json:"records"`
+			} `json:"metered"`
+		} `json:"data"`
+	}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &usage) != nil {
+		t.Fatalf("Expected usage, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, record := range usage.Data.Metered.Records {
+		if record.UserID != alice.ID {
+			t.Errorf("Expected only alice's usage, got %+v", record)
+		}
+	}
+	if len(usage.Data.Metered.Records) < 3 {
+		t.Errorf("Expected alice's session and token usage, got %+v", usage.Data.Metered.Records)
+	}
+	if w := serve(httptest.NewRequest("GET", "/api/usage?from=soon", nil), cookies); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid range to be refused, got %d", w.Code)
+	}
+
+	// Records past the retention are purged
+	if purged := server.usage.Purge(time.Now().Add(server.config.UsageRetention + 2*time.Hour)); purged == 0 {
+		t.Error("Expected old records to be purged")
+	}
+	if getReport("?from=2000-01-01"); len(report.Records) != 0 {
+		t.Errorf("Expected no records after the purge, got %+v", report.Records)
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	t.Setenv("GRAPHQL_ENABLED", "true")
+	server := newTestServer(t)
+	handler := server.Handler()
+
+	type gqlResult struct {
+		Data   map[string]json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string   `json:"message"`
+			Path    []string `json:"path"`
+		} `json:"errors"`
+	}
+	post := func(cookies []*http.Cookie, query string, variables map[string]interface{}) (*httptest.ResponseRecorder, gqlResult) {
+		body, _ := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+		req := jsonRequest("POST", "/graphql", body)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var result gqlResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Expected a GraphQL result, got %d %q", w.Code, w.Body.String())
+		}
+		return w, result
+	}
+
+	_, result := post(nil, `{ viewer { username } }`, nil)
+	if len(result.Errors) != 0 || string(result.Data["viewer"]) != "null" {
+		t.Fatalf("Expected a null viewer without a session, got %+v", result)
+	}
+
+	_, result = post(nil, `mutation Register($password: String!) {
+		register(username: "gqluser", email: "gql@example.com", password: $password) { success status user { username email } }
+	}`, map[string]interface{}{"password": "Password123!"})
+	var register struct {
+		Success bool
+		Status  int
+		User    struct{ Username, Email string }
+	}
+	json.Unmarshal(result.Data["register"], &register)
+	if !register.Success || register.Status != http.StatusCreated || register.User.Username != "gqluser" {
+		t.Fatalf("Expected the register mutation to create the user, got %s %+v", result.Data["register"], result.Errors)
+	}
+
+	w, result := post(nil, `mutation { login(username: "gqluser", password: "wrong") { success status message } }`, nil)
+	if !strings.Contains(string(result.Data["login"]), `"success":false`) || len(w.Result().Cookies()) != 0 {
+		t.Errorf("Expected a failed login without cookies, got %s", result.Data["login"])
+	}
+
+	w, result = post(nil, `mutation { login(username: "gqluser", password: "Password123!") { success me: user { ...names } } }
+		fragment names on User { username }`, nil)
+	if string(result.Data["login"]) != `{"success":true,"me":{"username":"gqluser"}}` {
+		t.Fatalf("Expected the login mutation to answer in selection order, got %s %+v", result.Data["login"], result.Errors)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("Expected the login mutation to set the session cookie")
+	}
+
+	_, result = post(cookies, `{ viewer { username ... on User { email } } }`, nil)
+	if string(result.Data["viewer"]) != `{"username":"gqluser","email":"gql@example.com"}` {
+		t.Errorf("Expected the session user as viewer, got %s %+v", result.Data["viewer"], result.Errors)
+	}
+
+	_, result = post(nil, `{ profile(username: "gqluser") { username } }`, nil)
+	if string(result.Data["profile"]) != "null" {
+		t.Errorf("Expected no profile while it is private, got %s", result.Data["profile"])
+	}
+	user := findUser(t, server, "gqluser")
+	user.Preferences.Profile.Public = true
+	if err := server.authHandler.users.Update(context.Background(), user); err != nil {
+		t.Fatalf("Failed to update user: %v", err)
+	}
+	_, result = post(nil, `{ profile(username: "gqluser") { username } }`, nil)
+	if string(result.Data["profile"]) != `{"username":"gqluser"}` {
+		t.Errorf("Expected the public profile, got %s", result.Data["profile"])
+	}
+
+	_, result = post(cookies, `mutation { changePassword(currentPassword: "Password123!", newPassword: "NewPassword456!") { success status } }`, nil)
+	if string(result.Data["changePassword"]) != `{"success":true,"status":200}` {
+		t.Errorf("Expected the password to change, got %s %+v", result.Data["changePassword"], result.Errors)
+	}
+	_, result = post(nil, `mutation { login(username: "gqluser", password: "NewPassword456!") { success } }`, nil)
+	if string(result.Data["login"]) != `{"success":true}` {
+		t.Errorf("Expected to log in with the new password, got %s", result.Data["login"])
+	}
+
+	rejected := []struct {
+		name  string
+		query string
+	}{
+		{"unknown field", `{ viewer { password } }`},
+		{"missing argument", `{ profile { username } }`},
+		{"too complex", `{ ` + strings.Repeat(`viewer { id username email } `, 20) + `}`},
+		{"syntax error", `{ viewer { username }`},
+	}
+	for _, tc := range rejected {
+		w, result := post(nil, tc.query, nil)
+		if w.Code != http.StatusOK || len(result.Errors) == 0 || result.Data != nil {
+			t.Errorf("%s: expected a GraphQL error without data, got %d %s", tc.name, w.Code, w.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/graphql?query="+url.QueryEscape(`{ viewer { id } }`), nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"viewer":null`) {
+		t.Errorf("Expected queries over GET, got %d %s", w.Code, w.Body.String())
+	}
+	req = httptest.NewRequest("GET", "/graphql?query="+url.QueryEscape(`mutation { login(username: "gqluser", password: "NewPassword456!") { success } }`), nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Errorf("Expected mutations over GET to be refused, got %d", w.Code)
+	}
+
+	t.Setenv("GRAPHQL_MAX_DEPTH", "2")
+	handler = newTestServer(t).Handler()
+	w, result = post(nil, `mutation { login(username: "gqluser", password: "NewPassword456!") { user { id } } }`, nil)
+	if len(result.Errors) == 0 || result.Data != nil || len(w.Result().Cookies()) != 0 {
+		t.Errorf("Expected operations deeper than the limit to be refused before running, got %s", w.Body.String())
+	}
+
+	t.Setenv("GRAPHQL_ENABLED", "")
+	req = jsonRequest("POST", "/graphql", []byte(`{"query":"{ viewer { id } }"}`))
+	w = httptest.NewRecorder()
+	newTestServer(t).Handler().ServeHTTP(w, req)
+	if w.Code == http.StatusOK && strings.Contains(w.Body.String(), "viewer") {
+		t.Errorf("Expected no GraphQL endpoint when disabled, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSessionStatusSocket(t *testing.T) {
+	server := newTestServer(t)
+	server.authHandler.policy = newBuiltinPolicy(server.authHandler.config)
+	adminCookies := registerAdmin(t, server, "admin", "admin@example.com", "password123")
+	cookies := registerAndLogin(t, server, "watcher", "watcher@example.com", "password123")
+	watcher := findUser(t, server, "watcher")
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	call := func(cookies []*http.Cookie, method, path string, body interface{}) int {
+		data, _ := json.Marshal(body)
+		req := jsonRequest(method, path, data)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// dial opens the socket with a handshake written by hand, returning
+	// the response and a reader for the frames that follow
+	dial := func(cookies []*http.Cookie, header http.Header) (net.Conn, *bufio.Reader, *http.Response) {
+		t.Helper()
+		conn, err := net.Dial("tcp", httpServer.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		req, _ := http.NewRequest("GET", httpServer.URL+"/api/ws", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		req.Write(conn)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatalf("Failed to read handshake response: %v", err)
+		}
+		return conn, reader, resp
+	}
+	// readFrame returns the opcode and payload of the next server frame
+	readFrame := func(conn net.Conn, reader *bufio.Reader) (byte, []byte) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			t.Fatalf("Failed to read frame: %v", err)
+		}
+		if header[1]&0x80 != 0 || header[1]&0x7F > 125 {
+			t.Fatalf("Expected a short unmasked frame, got header %x", header)
+		}
+		payload := make([]byte, header[1]&0x7F)
+		io.ReadFull(reader, payload)
+		return header[0] & 0x0F, payload
+	}
+	readStatus := func(conn net.Conn, reader *bufio.Reader) SessionStatusMessage {
+		t.Helper()
+		opcode, payload := readFrame(conn, reader)
+		var message SessionStatusMessage
+		if opcode != 0x1 || json.Unmarshal(payload, &message) != nil {
+			t.Fatalf("Expected a status message, got opcode %d %q", opcode, payload)
+		}
+		return message
+	}
+
+	if _, _, resp := dial(nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a socket without a session to be refused, got %d", resp.StatusCode)
+	}
+	if _, _, resp := dial(cookies, http.Header{"Origin": {"https://evil.example"}}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a foreign origin to be refused, got %d", resp.StatusCode)
+	}
+	if _, _, resp := dial(cookies, http.Header{"Sec-Websocket-Version": {"8"}}); resp.StatusCode != http.StatusBadRequest || resp.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Errorf("Expected an unsupported version to be refused, got %d", resp.StatusCode)
+	}
+	req := httptest.NewRequest("GET", "/api/ws", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusUpgradeRequired {
+		t.Errorf("Expected a plain GET to ask for an upgrade, got %d", w.Code)
+	}
+
+	conn, reader, resp := dial(cookies, http.Header{"Origin": {httpServer.URL}})
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Expected the handshake to complete, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if message := readStatus(conn, reader); message.Type != SessionStatusConnected || message.Role != RoleUser || message.ExpiresAt == nil {
+		t.Fatalf("Expected a connected message, got %+v", message)
+	}
+
+	// Answering pings is part of reading; send one masked as clients must
+	conn.Write([]byte{0x89, 0x84, 1, 2, 3, 4, 'p' ^ 1, 'i' ^ 2, 'n' ^ 3, 'g' ^ 4})
+	if opcode, payload := readFrame(conn, reader); opcode != 0xA || string(payload) != "ping" {
+		t.Errorf("Expected a pong echoing the ping, got opcode %d %q", opcode, payload)
+	}
+
+	if code := call(adminCookies, "PUT", "/api/admin/users/"+watcher.ID+"/role", RoleRequest{Role: RoleSupport}); code != http.StatusOK {
+		t.Fatalf("Expected the role to change, got %d", code)
+	}
+	if message := readStatus(conn, reader); message.Type != SessionStatusRoleChanged || message.Role != RoleSupport || message.Previous != RoleUser {
+		t.Errorf("Expected a role change, got %+v", message)
+	}
+
+	if code := call(cookies, "POST", "/api/logout", nil); code != http.StatusOK {
+		t.Fatalf("Expected logout to succeed, got %d", code)
+	}
+	if message := readStatus(conn, reader); message.Type != SessionStatusRevoked || message.Reason != "logout" {
+		t.Errorf("Expected the session to be revoked by logout, got %+v", message)
+	}
+	if opcode, payload := readFrame(conn, reader); opcode != 0x8 || len(payload) < 2 || binary.BigEndian.Uint16(payload) != 1000 {
+		t.Errorf("Expected a normal close, got opcode %d %q", opcode, payload)
+	}
+
+	// Another user's logout is not this socket's business, but suspension
+	// signs out every session
+	cookies = registerAndLogin(t, server, "watcher", "watcher@example.com", "password123")
+	conn, reader, _ = dial(cookies, nil)
+	readStatus(conn, reader)
+	call(registerAndLogin(t, server, "bystander", "bystander@example.com", "password123"), "POST", "/api/logout", nil)
+	if code := call(adminCookies, "POST", "/api/admin/users/"+watcher.ID+"/suspend", SuspendUserRequest{Reason: "Spam"}); code != http.StatusOK {
+		t.Fatalf("Expected the user to be suspended, got %d", code)
+	}
+	if message := readStatus(conn, reader); message.Type != SessionStatusForcedLogout || message.Reason != "suspended" {
+		t.Errorf("Expected a forced logout, got %+v", message)
+	}
+
+	// A client that goes away without a close frame still has its socket
+	// closed
+	cookies = registerAndLogin(t, server, "leaver", "leaver@example.com", "password123")
+	conn, reader, _ = dial(cookies, nil)
+	readStatus(conn, reader)
+	conn.(*net.TCPConn).CloseWrite()
+	if opcode, payload := readFrame(conn, reader); opcode != 0x8 || len(payload) < 2 || binary.BigEndian.Uint16(payload) != 1001 {
+		t.Errorf("Expected the server to close the socket, got opcode %d %q", opcode, payload)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestRememberMe(t *testing.T) {
+	t.Setenv("REMEMBER_ME", "true")
+	clock := &frozenClock{now: time.Now()}
+	server := newTestServer(t, WithClock(clock))
+	registerAndLogin(t, server, "keeper", "keeper@example.com", "password123")
+	sessionCookie := server.authHandler.config.SessionCookieName
+
+	// call sends a request with the given cookies and user agent and
+	// returns the response with the cookies it set
+	call := func(cookies []*http.Cookie, agent, method, path string, body interface{}) (*httptest.ResponseRecorder, map[string]*http.Cookie) {
+		t.Helper()
+		data, _ := json.Marshal(body)
+		req := jsonRequest(method, path, data)
+		req.Header.Set("User-Agent", agent)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		set := map[string]*http.Cookie{}
+		for _, cookie := range w.Result().Cookies() {
+			set[cookie.Name] = cookie
+		}
+		return w, set
+	}
+	login := func(agent string) *http.Cookie {
+		t.Helper()
+		w, set := call(nil, agent, "POST", "/api/login", LoginRequest{Username: "keeper", Password: "password123", RememberMe: true})
+		if w.Code != http.StatusOK || set[rememberMeCookie] == nil || set[rememberMeCookie].MaxAge <= 0 {
+			t.Fatalf("Expected a remember me cookie on login, got %d: %v", w.Code, set)
+		}
+		return set[rememberMeCookie]
+	}
+
+	// Without asking, nothing is remembered
+	if _, set := call(nil, "laptop", "POST", "/api/login", LoginRequest{Username: "keeper", Password: "password123"}); set[rememberMeCookie] != nil {
+		t.Error("Expected no remember me cookie without rememberMe")
+	}
+
+	remembered := login("laptop")
+	if devices := findUser(t, server, "keeper").RememberedDevices; len(devices) != 1 || devices[0].TokenHash == "" {
+		t.Fatalf("Expected one remembered device, got %+v", devices)
+	}
+
+	// The session cookie is gone; the remember me cookie signs in again
+	// and is replaced
+	w, set := call([]*http.Cookie{remembered}, "laptop", "GET", "/api/profile", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the remembered device to sign in, got %d: %s", w.Code, w.Body.String())
+	}
+	rotated := set[rememberMeCookie]
+	if set[sessionCookie] == nil || rotated == nil || rotated.Value == remembered.Value {
+		t.Fatalf("Expected a new session and a rotated remember me cookie, got %v", set)
+	}
+	if w, _ := call([]*http.Cookie{set[sessionCookie]}, "laptop", "GET", "/api/profile", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the restored session to work on its own, got %d", w.Code)
+	}
+	found := false
+	for _, event := range server.authHandler.audit.Recent(0) {
+		found = found || event.Type == AuditLoginSucceeded && event.Details["method"] == "remember_me"
+	}
+	if !found {
+		t.Error("Expected the remembered sign in to be audited")
+	}
+
+	// The devices are listed without their secrets
+	w, _ = call([]*http.Cookie{set[sessionCookie]}, "laptop", "GET", "/api/remembered-devices", nil)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "tokenHash") || !strings.Contains(w.Body.String(), `"device"`) {
+		t.Errorf("Expected the remembered devices to be listed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Another user agent cannot use the cookie, and the device is forgotten
+	if _, set := call([]*http.Cookie{rotated}, "elsewhere", "GET", "/api/profile", nil); set[sessionCookie] != nil {
+		t.Error("Expected the cookie to be refused for another user agent")
+	}
+	if devices := findUser(t, server, "keeper").RememberedDevices; len(devices) != 0 {
+		t.Errorf("Expected the device to be forgotten, got %+v", devices)
+	}
+
+	// The token just replaced is still accepted for a moment, without
+	// rotating it again
+	remembered = login("phone")
+	_, set = call([]*http.Cookie{remembered}, "phone", "GET", "/api/profile", nil)
+	if w, again := call([]*http.Cookie{remembered}, "phone", "GET", "/api/profile", nil); w.Code != http.StatusOK || again[sessionCookie] == nil || again[rememberMeCookie] != nil {
+		t.Errorf("Expected the previous token to sign in without rotating, got %d: %v", w.Code, again)
+	}
+
+	// Replaying a superseded token afterwards revokes every session and
+	// device
+	clock.Advance(rememberMeRotationGrace + time.Second)
+	other := login("tablet")
+	session := set[sessionCookie]
+	if _, set := call([]*http.Cookie{remembered}, "phone", "GET", "/api/profile", nil); set[sessionCookie] != nil || set[rememberMeCookie] == nil || set[rememberMeCookie].MaxAge >= 0 {
+		t.Errorf("Expected the replayed cookie to be refused and removed, got %v", set)
+	}
+	if w, _ := call([]*http.Cookie{session}, "phone", "GET", "/api/profile", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected every session to be revoked after a replay, got %d", w.Code)
+	}
+	if _, set := call([]*http.Cookie{other}, "tablet", "GET", "/api/profile", nil); set[sessionCookie] != nil {
+		t.Error("Expected every remembered device to be forgotten after a replay")
+	}
+	found = false
+	for _, event := range server.authHandler.audit.Recent(0) {
+		found = found || event.Type == AuditRememberMeTheft
+	}
+	if !found {
+		t.Error("Expected the replay to be audited")
+	}
+
+	// Removing a device stops its cookie from signing in
+	remembered = login("desktop")
+	_, set = call([]*http.Cookie{remembered}, "desktop", "GET", "/api/profile", nil)
+	session, remembered = set[sessionCookie], set[rememberMeCookie]
+	device := findUser(t, server, "keeper").RememberedDevices[0]
+	if w, _ := call([]*http.Cookie{session}, "desktop", "DELETE", "/api/remembered-devices/missing", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown device, got %d", w.Code)
+	}
+	if w, _ := call([]*http.Cookie{session}, "desktop", "DELETE", "/api/remembered-devices/"+device.ID, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the device to be removed, got %d", w.Code)
+	}
+	if _, set := call([]*http.Cookie{remembered}, "desktop", "GET", "/api/profile", nil); set[sessionCookie] != nil {
+		t.Error("Expected a removed device not to sign in")
+	}
+
+	// Logging out forgets the device
+	remembered = login("desktop")
+	_, set = call([]*http.Cookie{remembered}, "desktop", "GET", "/api/profile", nil)
+	if _, set := call([]*http.Cookie{set[sessionCookie], set[rememberMeCookie]}, "desktop", "POST", "/api/logout", nil); set[rememberMeCookie] == nil || set[rememberMeCookie].MaxAge >= 0 {
+		t.Error("Expected logout to remove the remember me cookie")
+	}
+	if devices := findUser(t, server, "keeper").RememberedDevices; len(devices) != 0 {
+		t.Errorf("Expected logout to forget the device, got %+v", devices)
+	}
+}
+
+func TestRememberMeConcurrentRedeem(t *testing.T) {
+	t.Setenv("REMEMBER_ME", "true")
+	server := newTestServer(t)
+	registerAndLogin(t, server, "racer", "racer@example.com", "password123")
+	sessionCookie := server.authHandler.config.SessionCookieName
+
+	data, _ := json.Marshal(LoginRequest{Username: "racer", Password: "password123", RememberMe: true})
+	w := httptest.NewRecorder()
+	server.Router().ServeHTTP(w, jsonRequest("POST", "/api/login", data))
+	var remembered *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == rememberMeCookie {
+			remembered = cookie
+		}
+	}
+	if remembered == nil {
+		t.Fatalf("Expected a remember me cookie on login, got %d", w.Code)
+	}
+
+	// A browser opening several tabs sends the same cookie with each
+	// request; whichever rotates it first must not make the rest look
+	// like a replay
+	const requests = 8
+	codes := make([]int, requests)
+	restored := make([]bool, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/api/profile", nil)
+			req.AddCookie(remembered)
+			w := httptest.NewRecorder()
+			server.Router().ServeHTTP(w, req)
+			codes[i] = w.Code
+			for _, cookie := range w.Result().Cookies() {
+				restored[i] = restored[i] || cookie.Name == sessionCookie
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range codes {
+		if codes[i] != http.StatusOK || !restored[i] {
+			t.Errorf("Expected request %d to sign in, got %d", i, codes[i])
+		}
+	}
+	for _, event := range server.authHandler.audit.Recent(0) {
+		if event.Type == AuditRememberMeTheft {
+			t.Errorf("Expected no theft to be detected, got %+v", event)
+		}
+	}
+	if devices := findUser(t, server, "racer").RememberedDevices; len(devices) != 1 {
+		t.Errorf("Expected the device to be kept, got %+v", devices)
+	}
+}
+
+func TestAvatarUpload(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("BLOB_STORE", "disk")
+	t.Setenv("BLOB_DIR", dir)
+	server := newTestServer(t)
+	clock := &frozenClock{now: time.Now()}
+	server.authHandler.clock = clock
+	cookies := registerAndLogin(t, server, "pictured", "pictured@example.com", "password123")
+
+	call := func(method, target string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		if bytes.HasPrefix(body, []byte("{")) {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{1}, 64)...)
+
+	if w := call("PUT", "/api/profile/avatar", []byte("<html>not an image</html>")); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for a non-image, got %d", w.Code)
+	}
+	if w := call("PUT", "/api/profile/avatar", append(png, make([]byte, maxAvatarSize)...)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for an oversized avatar, got %d", w.Code)
+	}
+
+	w := call("PUT", "/api/profile/avatar", png)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the avatar to be stored, got %d: %s", w.Code, w.Body.String())
+	}
+	user := findUser(t, server, "pictured")
+	if user.AvatarBlob != blobstore.Key(png) || !strings.HasSuffix(user.AvatarURL, "/api/avatars/"+user.AvatarBlob) {
+		t.Fatalf("Expected the avatar to be content addressed, got %q at %q", user.AvatarBlob, user.AvatarURL)
+	}
+	first := user.AvatarBlob
+
+	// The avatar URL redirects to a signed download
+	avatar, _ := url.Parse(user.AvatarURL)
+	w = call("GET", avatar.Path, nil)
+	if w.Code != http.StatusFound || !strings.Contains(w.Header().Get("Cache-Control"), "public") {
+		t.Fatalf("Expected a cacheable redirect, got %d: %v", w.Code, w.Header())
+	}
+	signed, _ := url.Parse(w.Header().Get("Location"))
+	w = call("GET", signed.RequestURI(), nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), png) || w.Header().Get("Content-Type") != "image/png" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("Expected the signed URL to serve the image, got %d: %v", w.Code, w.Header())
+	}
+	tampered := signed.Query()
+	tampered.Set("expires", fmt.Sprint(clock.Now().Add(time.Hour).Unix()))
+	if w := call("GET", signed.Path+"?"+tampered.Encode(), nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a tampered URL to be refused, got %d", w.Code)
+	}
+	clock.Advance(server.config.BlobURLTTL + time.Second)
+	if w := call("GET", signed.RequestURI(), nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected an expired URL to be refused, got %d", w.Code)
+	}
+	if w := call("GET", "/api/avatars/"+strings.Repeat("0", 64), nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown avatar, got %d", w.Code)
+	}
+
+	// A replaced avatar is collected once it is past the grace period
+	gif := append([]byte("GIF89a"), bytes.Repeat([]byte{2}, 32)...)
+	if w := call("PUT", "/api/profile/avatar", gif); w.Code != http.StatusOK {
+		t.Fatalf("Expected the avatar to be replaced, got %d", w.Code)
+	}
+	if purged := server.authHandler.purgeOrphanedBlobs(time.Now()); purged != 0 {
+		t.Errorf("Expected nothing to be collected within the grace period, got %d", purged)
+	}
+	if purged := server.authHandler.purgeOrphanedBlobs(time.Now().Add(server.config.BlobGCGrace + time.Minute)); purged != 1 {
+		t.Errorf("Expected the replaced avatar to be collected, got %d", purged)
+	}
+	ctx := context.Background()
+	if _, err := server.authHandler.blobs.Stat(ctx, first); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("Expected the replaced avatar to be gone, got %v", err)
+	}
+	if _, err := server.authHandler.blobs.Stat(ctx, blobstore.Key(gif)); err != nil {
+		t.Errorf("Expected the current avatar to be kept, got %v", err)
+	}
+
+	// An avatar URL set by hand, or no avatar, drops the upload
+	body, _ := json.Marshal(map[string]string{"avatarUrl": "https://example.com/me.png"})
+	if w := call("PATCH", "/api/profile", body); w.Code != http.StatusOK {
+		t.Fatalf("Expected the profile update to succeed, got %d", w.Code)
+	}
+	if user := findUser(t, server, "pictured"); user.AvatarBlob != "" {
+		t.Errorf("Expected the uploaded avatar to be dropped, got %q", user.AvatarBlob)
+	}
+	call("PUT", "/api/profile/avatar", png)
+	if w := call("DELETE", "/api/profile/avatar", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the avatar to be removed, got %d", w.Code)
+	}
+	if user := findUser(t, server, "pictured"); user.AvatarBlob != "" || user.AvatarURL != "" {
+		t.Errorf("Expected no avatar, got %q at %q", user.AvatarBlob, user.AvatarURL)
+	}
+
+	// Uploading an old orphan again renews it, so it is not collected
+	// before the profile refers to it
+	key := blobstore.Key(png)
+	aged := time.Now().Add(-server.config.BlobGCGrace - time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, key[:2], key), aged, aged); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := server.authHandler.blobs.Put(ctx, bytes.NewReader(png), "image/png")
+	if err != nil || blob.Key != key || !blob.CreatedAt.After(aged.Add(time.Hour)) {
+		t.Fatalf("Expected the stored avatar to be renewed, got %+v: %v", blob, err)
+	}
+	if purged := server.authHandler.purgeOrphanedBlobs(time.Now()); purged != 0 {
+		t.Errorf("Expected the renewed avatar to be kept, got %d collected", purged)
+	}
+}
+
+func TestS3BlobStore(t *testing.T) {
+	var mutex sync.Mutex
+	objects := map[string][]byte{}
+	types := map[string]string{}
+	puts := 0
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") || r.Header.Get("X-Amz-Date") == "" {
+			http.Error(w, "unsigned", http.StatusForbidden)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if sum := sha256.Sum256(body); r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+			http.Error(w, "payload hash mismatch", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		switch {
+		case r.Method == "GET" && name == "" && r.URL.Query().Get("list-type") == "2":
+			fmt.Fprint(w, `<ListBucketResult>`)
+			for key, content := range objects {
+				if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+					fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size><LastModified>2020-01-01T00:00:00.000Z</LastModified></Contents>`, key, len(content))
+				}
+			}
+			fmt.Fprint(w, `<IsTruncated>false</IsTruncated></ListBucketResult>`)
+		case r.Method == "PUT":
+			puts++
+			objects[name] = body
+			types[name] = r.Header.Get("Content-Type")
+		case r.Method == "GET" || r.Method == "HEAD":
+			content, ok := objects[name]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", types[name])
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Header().Set("Last-Modified", "Wed, 01 Jan 2020 00:00:00 GMT")
+			w.Write(content)
+		case r.Method == "DELETE":
+			delete(objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer s3.Close()
+
+	t.Setenv("BLOB_STORE", "s3")
+	t.Setenv("BLOB_S3_BUCKET", "bucket")
+	t.Setenv("BLOB_S3_ENDPOINT", s3.URL)
+	t.Setenv("BLOB_S3_PREFIX", "avatars/")
+	t.Setenv("BLOB_S3_ACCESS_KEY_ID", "AKID")
+	t.Setenv("BLOB_S3_SECRET_ACCESS_KEY", "secret")
+	server := newTestServer(t)
+	store := server.authHandler.blobs
+	ctx := context.Background()
+
+	blob, err := store.Put(ctx, strings.NewReader("GIF89a-first"), "image/gif")
+	if err != nil || blob.Key != blobstore.Key([]byte("GIF89a-first")) {
+		t.Fatalf("Expected the blob to be stored under its hash, got %+v: %v", blob, err)
+	}
+	if _, ok := objects["avatars/"+blob.Key]; !ok {
+		t.Fatalf("Expected the object under the prefix, got %v", objects)
+	}
+	content, info, err := store.Open(ctx, blob.Key)
+	if err != nil {
+		t.Fatalf("Failed to open blob: %v", err)
+	}
+	data, _ := io.ReadAll(content)
+	content.Close()
+	if string(data) != "GIF89a-first" || info.ContentType != "image/gif" {
+		t.Errorf("Expected the stored content back, got %q as %q", data, info.ContentType)
+	}
+	if _, err := store.Stat(ctx, strings.Repeat("a", 64)); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing blob, got %v", err)
+	}
+
+	signed, err := store.SignedURL(blob.Key, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), 15*time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to sign URL: %v", err)
+	}
+	for _, part := range []string{s3.URL + "/bucket/avatars/" + blob.Key + "?", "X-Amz-Credential=AKID%2F20240501%2Fus-east-1%2Fs3%2Faws4_request", "X-Amz-Date=20240501T120000Z", "X-Amz-Expires=900", "X-Amz-Signature="} {
+		if !strings.Contains(signed, part) {
+			t.Errorf("Expected %q in the signed URL %s", part, signed)
+		}
+	}
+
+	// Content already stored is put again, to renew its LastModified
+	kept, _ := store.Put(ctx, strings.NewReader("GIF89a-kept"), "image/gif")
+	if _, err := store.Put(ctx, strings.NewReader("GIF89a-kept"), "image/gif"); err != nil || puts != 3 {
+		t.Errorf("Expected a second PUT of the same content, got %d PUTs: %v", puts, err)
+	}
+	purged, err := blobstore.Collect(ctx, store, func(key string) bool { return key == kept.Key }, time.Now())
+	if err != nil || purged != 1 {
+		t.Errorf("Expected one blob to be collected, got %d: %v", purged, err)
+	}
+	if len(objects) != 1 || objects["avatars/"+kept.Key] == nil {
+		t.Errorf("Expected only the referenced blob to remain, got %v", objects)
+	}
+}
+
+// plainHasher is a Hasher that keeps passwords readable, for tests. It
+// counts comparisons in compared and keeps the last hash compared against
+// in stored.
+type plainHasher struct {
+	compared *atomic.Int64
+	stored   *atomic.Value
+}
+
+func (p plainHasher) Hash(ctx context.Context, password string) (string, error) {
+	return "plain:" + password, nil
+}
+
+func (p plainHasher) Compare(ctx context.Context, stored, password string) error {
+	p.compared.Add(1)
+	p.stored.Store(stored)
+	if stored != "plain:"+password {
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+	return nil
+}
+
+func (p plainHasher) NeedsRehash(stored string) bool {
+	return false
+}
+
+// failingHasher is a Hasher that cannot hash
+type failingHasher struct{ plainHasher }
+
+func (failingHasher) Hash(ctx context.Context, password string) (string, error) {
+	return "", errors.New("hasher unavailable")
+}
+
+func TestInjectedSideEffects(t *testing.T) {
+	users := NewMemoryUserStore()
+	sent := make(recordingMailer, 10)
+	texts := make(recordingSMS, 10)
+	var compared atomic.Int64
+	var stored atomic.Value
+
+	cfg := LoadConfig()
+	cfg.OutboxFile = filepath.Join(t.TempDir(), "outbox.json")
+	cfg.UserStore = users
+	cfg.Mailer = sent
+	cfg.SMSSender = texts
+	cfg.PasswordHasher = plainHasher{compared: &compared, stored: &stored}
+	server, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if server.authHandler.sms != sms.Sender(texts) {
+		t.Error("Expected the injected SMS sender to be used")
+	}
+
+	registerAndLogin(t, server, "embedded", "embedded@example.com", "password123")
+	user, err := users.GetByUsername(context.Background(), "embedded")
+	if err != nil {
+		t.Fatalf("Expected the user in the injected store: %v", err)
+	}
+	if user.Password != "plain:password123" {
+		t.Errorf("Expected the injected hasher to hash the password, got %q", user.Password)
+	}
+
+	login := func(username, password string) int {
+		body, _ := json.Marshal(LoginRequest{Username: username, Password: password})
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, jsonRequest("POST", "/api/login", body))
+		return w.Code
+	}
+	if code := login("embedded", "wrong-password"); code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong password to be refused, got %d", code)
+	}
+	// Unknown users are compared against a dummy hash from the same hasher
+	before := compared.Load()
+	if code := login("nobody", "password123"); code != http.StatusUnauthorized || compared.Load() != before+1 {
+		t.Errorf("Expected an unknown user to be refused after a comparison, got %d", code)
+	}
+	if server.authHandler.dummyPasswordHash() != "plain:"+dummyPassword {
+		t.Errorf("Expected the dummy hash to come from the injected hasher, got %q", server.authHandler.dummyPasswordHash())
+	}
+	// So are users without a password, and the dummy password does not
+	// sign them in
+	user = findUser(t, server, "embedded")
+	user.Password = ""
+	if err := server.authHandler.users.Update(context.Background(), user); err != nil {
+		t.Fatalf("Failed to remove the password: %v", err)
+	}
+	before = compared.Load()
+	if code := login("embedded", dummyPassword); code != http.StatusUnauthorized || compared.Load() != before+1 || stored.Load() != "plain:"+dummyPassword {
+		t.Errorf("Expected a passwordless user to be refused after comparing the dummy hash, got %d against %q", code, stored.Load())
+	}
+
+	body, _ := json.Marshal(PasswordResetRequest{Email: "embedded@example.com"})
+	server.Router().ServeHTTP(httptest.NewRecorder(), jsonRequest("POST", "/api/password-reset/request", body))
+	select {
+	case msg := <-sent:
+		if msg.To != "embedded@example.com" {
+			t.Errorf("Expected the reset email to go to the user, got %q", msg.To)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the injected mailer to send the reset email")
+	}
+
+	// Without a dummy hash unknown users would answer faster than real ones
+	cfg.PasswordHasher = failingHasher{}
+	if _, err := New(cfg); err == nil {
+		t.Error("Expected a hasher that cannot make the dummy hash to be refused")
+	}
+}
+
+// countingSessions is a SessionManager that counts stored sessions, and
+// cannot be reached while down is set
+type countingSessions struct {
+	*sessionstore.Store
+	puts atomic.Int64
+	down atomic.Bool
+}
+
+func (c *countingSessions) Get(ctx context.Context, id string, now time.Time) (sessionstore.Session, error) {
+	if c.down.Load() {
+		return sessionstore.Session{}, errors.New("connection refused")
+	}
+	return c.Store.Get(ctx, id, now)
+}
+
+func (c *countingSessions) Put(ctx context.Context, session sessionstore.Session) error {
+	c.puts.Add(1)
+	return c.Store.Put(ctx, session)
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent writes
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func TestServerOptions(t *testing.T) {
+	users := NewMemoryUserStore()
+	sessions := &countingSessions{Store: sessionstore.New()}
+	start := time.Date(2031, time.March, 1, 8, 0, 0, 0, time.UTC)
+	auditLines := &lockedBuffer{}
+	debugLines := &lockedBuffer{}
+
+	cfg := LoadConfig()
+	cfg.OutboxFile = filepath.Join(t.TempDir(), "outbox.json")
+	server, err := New(cfg,
+		WithStore(users),
+		WithSessionManager(sessions),
+		WithClock(&frozenClock{now: start}),
+		WithIDGenerator(&sequentialIDs{}),
+		WithAuditOutput(auditLines),
+		WithLogger(log.New(debugLines, "", 0)),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	cookies := registerAndLogin(t, server, "wired", "wired@example.com", "password123")
+	user, err := users.Get(context.Background(), "usr_1")
+	if err != nil || user.Username != "wired" || !user.Created.Equal(start) {
+		t.Fatalf("Expected the user in the given store with the given ID and time, got %+v: %v", user, err)
+	}
+	if count, _ := sessions.Count(context.Background(), start); sessions.puts.Load() != 1 || count != 1 {
+		t.Errorf("Expected the login session in the given session manager, got %d puts", sessions.puts.Load())
+	}
+	req := httptest.NewRequest("GET", "/api/profile", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the session to be found in the given session manager, got %d", w.Code)
+	}
+	sessions.down.Store(true)
+	w = httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while the session manager is down, got %d", w.Code)
+	}
+	sessions.down.Store(false)
+
+	if !strings.Contains(auditLines.String(), "[AUDIT]") || !strings.Contains(auditLines.String(), "type=login_succeeded user=usr_1") {
+		t.Errorf("Expected audit lines in the given writer, got %q", auditLines.String())
+	}
+	if !strings.Contains(debugLines.String(), "[DEBUG] Login request received\n") {
+		t.Errorf("Expected debug lines in the given logger, got %q", debugLines.String())
+	}
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	server := newTestServer(t)
+	server.Router().HandleFunc("/api/test/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("broken handler")
+	}).Methods("GET")
+	server.Router().HandleFunc("/api/test/untyped", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success":true}`))
+	}).Methods("GET")
+	server.Router().HandleFunc("/app/untyped", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}).Methods("GET")
+	handler := server.Handler()
+
+	call := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Accept-Language", "de")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// The router enforces methods, naming the ones the path accepts
+	methods := []struct {
+		method, path, allow string
+	}{
+		{"GET", "/api/login", "POST"},
+		{"DELETE", "/api/profile", "GET, PATCH"},
+		{"POST", "/api/remembered-devices", "GET"},
+		{"POST", "/", "GET, HEAD"},
+	}
+	for _, tc := range methods {
+		w := call(tc.method, tc.path)
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != tc.allow {
+			t.Errorf("%s %s: expected 405 allowing %s, got %d allowing %q", tc.method, tc.path, tc.allow, w.Code, w.Header().Get("Allow"))
+		}
+		if !strings.Contains(w.Body.String(), "Methode nicht erlaubt") {
+			t.Errorf("%s %s: expected a translated refusal, got %q", tc.method, tc.path, w.Body.String())
+		}
+	}
+	if w := call("GET", "/api/missing"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected unknown API routes to be 404, got %d", w.Code)
+	}
+	if w := call("GET", "/settings"); w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("Expected client-side routes to load the frontend, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// A panic is answered with a 500 and leaves the server serving
+	if w := call("GET", "/api/test/panic"); w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "Interner Serverfehler") {
+		t.Errorf("Expected a panic to be a 500, got %d %q", w.Code, w.Body.String())
+	}
+	if w := call("GET", "/api/health"); w.Code != http.StatusOK {
+		t.Errorf("Expected the server to keep serving after a panic, got %d", w.Code)
+	}
+
+	// API responses default to JSON; other routes keep net/http's sniffing
+	if w := call("GET", "/api/test/untyped"); w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected API responses to default to JSON, got %q", w.Header().Get("Content-Type"))
+	}
+	if w := call("GET", "/app/untyped"); !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Expected other routes to be sniffed, got %q", w.Header().Get("Content-Type"))
+	}
+	if w := call("GET", "/api/profile"); w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Expected plain text errors to keep their type, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestAdminBootstrap(t *testing.T) {
+	t.Setenv("ADMIN_BOOTSTRAP_TOKEN", "bootstrap-secret")
+	server := newTestServer(t)
+
+	adminCookies := registerAndLogin(t, server, "alice", "alice@example.com", "password123")
+	otherCookies := registerAndLogin(t, server, "other", "other@example.com", "password123")
+	if role := findUser(t, server, "alice").Role; role != RoleUser {
+		t.Fatalf("Expected registration to grant the user role, got %s", role)
+	}
+
+	bootstrap := func(token string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(AdminBootstrapRequest{Token: token})
+		req := jsonRequest("POST", "/api/admin/bootstrap", body)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := bootstrap("bootstrap-secret", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a session to be required, got %d", w.Code)
+	}
+	if w := bootstrap("wrong", adminCookies); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a wrong token to be refused, got %d", w.Code)
+	}
+	if w := bootstrap("bootstrap-secret", adminCookies); w.Code != http.StatusOK {
+		t.Fatalf("Expected the token to grant admin, got %d %s", w.Code, w.Body.String())
+	}
+	if role := findUser(t, server, "alice").Role; role != RoleAdmin {
+		t.Errorf("Expected the admin role, got %s", role)
+	}
+
+	// Once there is an admin the token is spent
+	if w := bootstrap("bootstrap-secret", otherCookies); w.Code != http.StatusConflict {
+		t.Errorf("Expected the token to stop working once an admin exists, got %d", w.Code)
+	}
+	if role := findUser(t, server, "other").Role; role != RoleUser {
+		t.Errorf("Expected the second user to stay a user, got %s", role)
+	}
+
+	// Without a configured token the endpoint does not exist
+	t.Setenv("ADMIN_BOOTSTRAP_TOKEN", "")
+	server = newTestServer(t)
+	cookies := registerAndLogin(t, server, "alice", "alice@example.com", "password123")
+	if w := bootstrap("", cookies); w.Code != http.StatusNotFound {
+		t.Errorf("Expected no bootstrap without a token, got %d", w.Code)
+	}
+}
+
+func TestSessionMiddleware(t *testing.T) {
+	server := newTestServer(t)
+	server.authenticated.HandleFunc("/api/test/whoami", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(contextUser(r).Username))
+	}).Methods("GET")
+	cookies := registerAndLogin(t, server, "testuser", "test@example.com", "password123")
+
+	whoami := func(cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/test/whoami", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		server.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := whoami(nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected requests without a session to be refused, got %d", w.Code)
+	}
+	if w := whoami(cookies); w.Code != http.StatusOK || w.Body.String() != "testuser" {
+		t.Errorf("Expected the handler to find the session user in the context, got %d %q", w.Code, w.Body.String())
+	}
+
+	// A session whose user is gone never reaches the handler
+	user := findUser(t, server, "testuser")
+	server.authHandler.users.Delete(context.Background(), user.ID)
+	if w := whoami(cookies); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a session of a deleted user to be refused, got %d", w.Code)
+	}
+}
+
+func TestStatelessSessionsMisconfigured(t *testing.T) {
+	cfg := LoadConfig()
+	cfg.OutboxFile = filepath.Join(t.TempDir(), "outbox.json")
+	cfg.SessionMode = SessionModeStateless
+
+	// Asking for stateless sessions must not quietly get server-side ones
+	for name, change := range map[string]func(*Config){
+		"no master key":    func(cfg *Config) { cfg.MasterKey = nil },
+		"short master key": func(cfg *Config) { cfg.MasterKey = []byte("short") },
+		"invalid Redis":    func(cfg *Config) { cfg.RedisURL = "mysql://db" },
+	} {
+		broken := cfg
+		change(&broken)
+		if server, err := New(broken); err == nil {
+			t.Errorf("%s: expected New to fail, got stateless sessions %v", name, server.authHandler.stateless != nil)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	server := newTestServer(t)
+
+	req := httptest.NewRequest("GET", "/api/health", nil)
+	w := httptest.NewRecorder()
+
+	server.HealthHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var response Response
+	json.Unmarshal(w.Body.Bytes(), &response)
+
+	if !response.Success {
+		t.Errorf("Expected success response, got: %v", response)
+	}
+
+	if response.Data == nil {
+		t.Error("Expected health data in response")
+	}
+
+	// Check that health data contains expected fields
+	healthData, ok := response.Data.(map[string]interface{})
+	if !ok {
+		t.Error("Expected health data to be a map")
+	}
+
+	if _, exists := healthData["timestamp"]; !exists {
+		t.Error("Expected timestamp in health data")
+	}
+
+	if _, exists := healthData["status"]; !exists {
+		t.Error("Expected status in health data")
+	}
+}
+
+func TestUserStruct(t *testing.T) {
+	user := User{
+		ID:       "test-id",
+		Username: "testuser",
+		Email:    "test@example.com",
+		Password: "hashedpassword",
+		Created:  time.Now(),
+	}
+
+	if user.ID != "test-id" {
+		t.Errorf("Expected ID 'test-id', got '%s'", user.ID)
+	}
+
+	if user.Username != "testuser" {
+		t.Errorf("Expected Username 'testuser', got '%s'", user.Username)
+	}
+
+	if user.Email != "test@example.com" {
+		t.Errorf("Expected Email 'test@example.com', got '%s'", user.Email)
+	}
+
+	if user.Password != "hashedpassword" {
+		t.Errorf("Expected Password 'hashedpassword', got '%s'", user.Password)
+	}
+
+	if user.Created.IsZero() {
+		t.Error("Expected Created to be set")
+	}
+}
+
+func TestResponseStruct(t *testing.T) {
+	response := Response{
+		Success: true,
+		Message: "Test message",
+		Data:    "test data",
+	}
+
+	if !response.Success {
+		t.Error("Expected Success to be true")
+	}
+
+	if response.Message != "Test message" {
+		t.Errorf("Expected Message 'Test message', got '%s'", response.Message)
+	}
+
+	if response.Data != "test data" {
+		t.Errorf("Expected Data 'test data', got '%v'", response.Data)
+	}
+}
+
+// benchmarkUserCounts are the store sizes the endpoint benchmarks run at,
+// so lookups that scan every user show up as a slowdown at the larger size
+var benchmarkUserCounts = []int{100, 10000}
+
+// seedUsers adds users user0 to user<n-1>, all with password123, straight
+// to the store so large stores are quick to build
+func seedUsers(b *testing.B, server *Server, n int) {
+	b.Helper()
+
+	hashed, err := server.authHandler.passwords.Hash(context.Background(), "password123")
+	if err != nil {
+		b.Fatalf("Failed to hash password: %v", err)
+	}
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		user := &User{
+			ID:                generateID(ids.PrefixUser),
+			Username:          fmt.Sprintf("user%d", i),
+			Email:             fmt.Sprintf("user%d@example.com", i),
+			Password:          hashed,
+			Role:              RoleUser,
+			Created:           now,
+			UpdatedAt:         now,
+			PasswordChangedAt: now,
+			Locale:            "en",
+			Preferences:       defaultNotificationPreferences(),
+		}
+		if err := server.authHandler.users.Create(context.Background(), user); err != nil {
+			b.Fatalf("Failed to seed user: %v", err)
+		}
+	}
+}
+
+// benchmarkRequest sends a request through the full middleware chain
+func benchmarkRequest(b *testing.B, server *Server, method, path string, body []byte, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	server.Router().ServeHTTP(w, req)
+	return w
+}
+
+func BenchmarkUserLookup(b *testing.B) {
+	for _, users := range benchmarkUserCounts {
+		b.Run(fmt.Sprintf("users=%d", users), func(b *testing.B) {
+			server := newTestServer(b)
+			seedUsers(b, server, users)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := server.authHandler.users.GetByUsername(context.Background(), fmt.Sprintf("user%d", i%users)); err != nil {
+					b.Fatalf("Lookup failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRegister(b *testing.B) {
+	for _, users := range benchmarkUserCounts {
+		b.Run(fmt.Sprintf("users=%d", users), func(b *testing.B) {
+			server := newTestServer(b)
+			seedUsers(b, server, users)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				body, _ := json.Marshal(RegisterRequest{
+					Username: fmt.Sprintf("new%d", i),
+					Email:    fmt.Sprintf("new%d@example.com", i),
+					Password: "password123",
+				})
+				if w := benchmarkRequest(b, server, "POST", "/api/register", body, nil); w.Code != http.StatusCreated {
+					b.Fatalf("Registration failed with %d: %s", w.Code, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLogin(b *testing.B) {
+	for _, users := range benchmarkUserCounts {
+		b.Run(fmt.Sprintf("users=%d", users), func(b *testing.B) {
+			server := newTestServer(b)
+			seedUsers(b, server, users)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				body, _ := json.Marshal(LoginRequest{Username: fmt.Sprintf("user%d", i%users), Password: "password123"})
+				if w := benchmarkRequest(b, server, "POST", "/api/login", body, nil); w.Code != http.StatusOK {
+					b.Fatalf("Login failed with %d: %s", w.Code, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkProfile(b *testing.B) {
+	for _, users := range benchmarkUserCounts {
+		b.Run(fmt.Sprintf("users=%d", users), func(b *testing.B) {
+			server := newTestServer(b)
+			seedUsers(b, server, users)
+			body, _ := json.Marshal(LoginRequest{Username: fmt.Sprintf("user%d", users/2), Password: "password123"})
+			login := benchmarkRequest(b, server, "POST", "/api/login", body, nil)
+			if login.Code != http.StatusOK {
+				b.Fatalf("Login failed with %d", login.Code)
+			}
+			cookies := login.Result().Cookies()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if w := benchmarkRequest(b, server, "GET", "/api/profile", nil, cookies); w.Code != http.StatusOK {
+					b.Fatalf("Profile failed with %d", w.Code)
+				}
+			}
+		})
+	}
+}
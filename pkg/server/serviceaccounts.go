@@ -0,0 +1,521 @@
+package server
+
+import (
+	"auth-server/pkg/ids"
+	"auth-server/pkg/randutil"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// serviceAccountKeyPrefix starts every service account key, so they are
+// easy to tell from other secrets and to find in leaked code
+const serviceAccountKeyPrefix = "svck_"
+
+// maxServiceAccountKeys caps how many keys an account may have, enough to
+// rotate without downtime
+const maxServiceAccountKeys = 5
+
+var (
+	errServiceAccountNotFound    = errors.New("service account not found")
+	errServiceAccountKeyNotFound = errors.New("service account key not found")
+	errTooManyServiceAccountKeys = errors.New("too many service account keys")
+)
+
+// ServiceAccount is a machine principal, such as a batch job or another
+// service, kept apart from human users. It has no password and never gets
+// a session: it exchanges one of its keys for a service token with the
+// client_credentials grant, using its ID as the client ID. An account
+// with an Organization may only act on users of that tenant, by default
+// the domain of their email. Its tokens stop working as soon as it is disabled or
+// deleted.
+type ServiceAccount struct {
+	ID           string              `json:"id"`
+	Name         string              `json:"name"`
+	Description  string              `json:"description,omitempty"`
+	Organization string              `json:"organization,omitempty"`
+	Scopes       []string            `json:"scopes"`
+	CreatedAt    time.Time           `json:"createdAt"`
+	CreatedBy    string              `json:"createdBy"`
+	DisabledAt   *time.Time          `json:"disabledAt,omitempty"`
+	Keys         []ServiceAccountKey `json:"keys"`
+}
+
+// ServiceAccountKey is a secret a service account authenticates with.
+// Only a hash of the key is kept.
+type ServiceAccountKey struct {
+	ID         string     `json:"id"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	LastUsedIP string     `json:"lastUsedIp,omitempty"`
+	Hash       []byte     `json:"-"`
+}
+
+// clone copies the account so it can be read without the registry's lock
+func (a *ServiceAccount) clone() *ServiceAccount {
+	c := *a
+	c.Scopes = slices.Clone(a.Scopes)
+	c.Keys = slices.Clone(a.Keys)
+	return &c
+}
+
+// ServiceAccountRequest creates a service account
+type ServiceAccountRequest struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	Organization string   `json:"organization"`
+	Scopes       []string `json:"scopes"`
+}
+
+// ServiceAccountUpdateRequest changes a service account; omitted fields
+// are left alone
+type ServiceAccountUpdateRequest struct {
+	Description *string   `json:"description"`
+	Scopes      *[]string `json:"scopes"`
+	Disabled    *bool     `json:"disabled"`
+}
+
+// ServiceAccountKeyRequest creates a key, which never expires unless
+// ExpiresAt is set
+type ServiceAccountKeyRequest struct {
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// isServiceAccountID reports whether a client ID names a service account
+// rather than an OAuth client
+func isServiceAccountID(id string) bool {
+	return strings.HasPrefix(id, ids.PrefixServiceAccount+"_")
+}
+
+// serviceAccountRegistry stores service accounts in memory
+type serviceAccountRegistry struct {
+	mutex    sync.RWMutex
+	accounts map[string]*ServiceAccount
+}
+
+func newServiceAccountRegistry() *serviceAccountRegistry {
+	return &serviceAccountRegistry{accounts: make(map[string]*ServiceAccount)}
+}
+
+func (s *serviceAccountRegistry) create(account *ServiceAccount) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.accounts[account.ID] = account.clone()
+}
+
+// get returns a copy of the account registered as id
+func (s *serviceAccountRegistry) get(id string) (*ServiceAccount, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	account, ok := s.accounts[id]
+	if !ok {
+		return nil, false
+	}
+	return account.clone(), true
+}
+
+// list returns every account ordered by ID, which is creation order
+func (s *serviceAccountRegistry) list() []*ServiceAccount {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	accounts := make([]*ServiceAccount, 0, len(s.accounts))
+	for _, account := range s.accounts {
+		accounts = append(accounts, account.clone())
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].ID < accounts[j].ID })
+	return accounts
+}
+
+// update applies change to the account registered as id and returns a copy
+// of the result. Nothing is changed when change fails.
+func (s *serviceAccountRegistry) update(id string, change func(*ServiceAccount) error) (*ServiceAccount, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	account, ok := s.accounts[id]
+	if !ok {
+		return nil, errServiceAccountNotFound
+	}
+	updated := account.clone()
+	if err := change(updated); err != nil {
+		return nil, err
+	}
+	s.accounts[id] = updated
+	return updated.clone(), nil
+}
+
+// remove deletes an account, reporting whether it existed
+func (s *serviceAccountRegistry) remove(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, ok := s.accounts[id]
+	delete(s.accounts, id)
+	return ok
+}
+
+// active reports whether the account registered as id exists and is not
+// disabled, so its tokens may be used
+func (s *serviceAccountRegistry) active(id string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	account, ok := s.accounts[id]
+	return ok && account.DisabledAt == nil
+}
+
+// authenticate returns the active account registered as id when secret is
+// one of its unexpired keys, recording the key's use
+func (s *serviceAccountRegistry) authenticate(id, secret, ip string, now time.Time) (*ServiceAccount, string, bool) {
+	hash := sha256.Sum256([]byte(secret))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	account, ok := s.accounts[id]
+	if !ok || account.DisabledAt != nil {
+		return nil, "", false
+	}
+	for i := range account.Keys {
+		key := &account.Keys[i]
+		if subtle.ConstantTimeCompare(hash[:], key.Hash) != 1 {
+			continue
+		}
+		if key.ExpiresAt != nil && !now.Before(*key.ExpiresAt) {
+			return nil, "", false
+		}
+		key.LastUsedAt = &now
+		key.LastUsedIP = ip
+		return account.clone(), key.ID, true
+	}
+	return nil, "", false
+}
+
+// newServiceAccountKey generates a key, returning it with the record to
+// store on the account
+func (h *AuthHandler) newServiceAccountKey(expiresAt *time.Time, now time.Time) (string, ServiceAccountKey, error) {
+	secret, err := randutil.Bytes(32)
+	if err != nil {
+		return "", ServiceAccountKey{}, err
+	}
+	key := serviceAccountKeyPrefix + hex.EncodeToString(secret)
+	hash := sha256.Sum256([]byte(key))
+	return key, ServiceAccountKey{
+		ID:        h.idGenerator.NewID(ids.PrefixKey),
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+		Hash:      hash[:],
+	}, nil
+}
+
+// validServiceAccountScopes reports whether scopes is a non-empty list of
+// valid scope tokens
+func validServiceAccountScopes(scopes []string) bool {
+	return len(scopes) > 0 && !slices.ContainsFunc(scopes, func(scope string) bool { return !validScope(scope) })
+}
+
+// recordServiceAccountChange adds a change to the account's audit trail
+func (s *Server) recordServiceAccountChange(r *http.Request, admin *User, accountID, change string, details map[string]string) {
+	if details == nil {
+		details = make(map[string]string)
+	}
+	details["change"] = change
+	details["serviceAccount"] = accountID
+	s.audit.Record(AuditEvent{
+		Type:    AuditServiceAccountChanged,
+		UserID:  admin.ID,
+		IP:      clientIP(r),
+		Details: details,
+	})
+}
+
+// writeServiceAccountError maps a registry error to the matching response
+func (s *Server) writeServiceAccountError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errServiceAccountNotFound):
+		http.Error(w, localize(r, "Service account not found"), http.StatusNotFound)
+	case errors.Is(err, errServiceAccountKeyNotFound):
+		http.Error(w, localize(r, "Service account key not found"), http.StatusNotFound)
+	case errors.Is(err, errTooManyServiceAccountKeys):
+		http.Error(w, localize(r, "A service account can have at most %d keys", maxServiceAccountKeys), http.StatusConflict)
+	default:
+		s.logger.Printf("[DEBUG] Service account update failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// ServiceAccountsHandler lists service accounts on GET and creates one on
+// POST. A new account has no keys.
+func (s *Server) ServiceAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Service accounts request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		response := Response{
+			Success: true,
+			Message: localize(r, "Service accounts retrieved successfully"),
+			Data:    s.serviceAccounts.list(),
+		}
+
+		json.NewEncoder(w).Encode(response)
+
+	case http.MethodPost:
+		var req ServiceAccountRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+			writeBodyError(w, r, err)
+			return
+		}
+
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || !validServiceAccountScopes(req.Scopes) {
+			s.logger.Printf("[DEBUG] Invalid service account request")
+			http.Error(w, localize(r, "Name and at least one valid scope are required"), http.StatusBadRequest)
+			return
+		}
+		organization := strings.ToLower(strings.TrimSpace(req.Organization))
+		if strings.ContainsAny(organization, " @/") {
+			http.Error(w, localize(r, "Organization must be an email domain"), http.StatusBadRequest)
+			return
+		}
+
+		account := &ServiceAccount{
+			ID:           s.authHandler.idGenerator.NewID(ids.PrefixServiceAccount),
+			Name:         req.Name,
+			Description:  req.Description,
+			Organization: organization,
+			Scopes:       slices.Clone(req.Scopes),
+			CreatedAt:    s.authHandler.clock.Now(),
+			CreatedBy:    admin.ID,
+			Keys:         []ServiceAccountKey{},
+		}
+		s.serviceAccounts.create(account)
+		s.recordServiceAccountChange(r, admin, account.ID, "created", map[string]string{
+			"scopes":       strings.Join(account.Scopes, " "),
+			"organization": account.Organization,
+		})
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(Response{
+			Success: true,
+			Message: localize(r, "Service account created successfully"),
+			Data:    account,
+		})
+		s.logger.Printf("[DEBUG] Service account %s created by %s", account.ID, admin.Username)
+
+	default:
+		s.logger.Printf("[DEBUG] Invalid method: %s", r.Method)
+		http.Error(w, localize(r, "Method not allowed"), http.StatusMethodNotAllowed)
+	}
+}
+
+// ServiceAccountHandler returns a service account on GET, changes its
+// description, scopes or disabled state on PATCH and deletes it on DELETE
+func (s *Server) ServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Service account request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	var account *ServiceAccount
+	message := localize(r, "Service account retrieved successfully")
+	switch r.Method {
+	case http.MethodGet:
+		if account, ok = s.serviceAccounts.get(id); !ok {
+			s.writeServiceAccountError(w, r, errServiceAccountNotFound)
+			return
+		}
+
+	case http.MethodPatch:
+		var req ServiceAccountUpdateRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+			writeBodyError(w, r, err)
+			return
+		}
+		if req.Scopes != nil && !validServiceAccountScopes(*req.Scopes) {
+			http.Error(w, localize(r, "Name and at least one valid scope are required"), http.StatusBadRequest)
+			return
+		}
+
+		details := make(map[string]string)
+		now := s.authHandler.clock.Now()
+		var err error
+		account, err = s.serviceAccounts.update(id, func(account *ServiceAccount) error {
+			if req.Description != nil {
+				account.Description = *req.Description
+			}
+			if req.Scopes != nil {
+				account.Scopes = slices.Clone(*req.Scopes)
+				details["scopes"] = strings.Join(account.Scopes, " ")
+			}
+			if req.Disabled != nil && *req.Disabled != (account.DisabledAt != nil) {
+				if *req.Disabled {
+					account.DisabledAt = &now
+				} else {
+					account.DisabledAt = nil
+				}
+				details["disabled"] = fmt.Sprint(*req.Disabled)
+			}
+			return nil
+		})
+		if err != nil {
+			s.writeServiceAccountError(w, r, err)
+			return
+		}
+		s.recordServiceAccountChange(r, admin, id, "updated", details)
+		message = localize(r, "Service account updated successfully")
+
+	case http.MethodDelete:
+		if !s.serviceAccounts.remove(id) {
+			s.writeServiceAccountError(w, r, errServiceAccountNotFound)
+			return
+		}
+		s.recordServiceAccountChange(r, admin, id, "deleted", nil)
+		message = localize(r, "Service account deleted successfully")
+
+	default:
+		s.logger.Printf("[DEBUG] Invalid method: %s", r.Method)
+		http.Error(w, localize(r, "Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := Response{Success: true, Message: message}
+	if account != nil {
+		response.Data = account
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// ServiceAccountKeysHandler creates a key for a service account. The key
+// is only shown in this response.
+func (s *Server) ServiceAccountKeysHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Service account key request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req ServiceAccountKeyRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+	now := s.authHandler.clock.Now()
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+		http.Error(w, localize(r, "Expiry must be in the future"), http.StatusBadRequest)
+		return
+	}
+
+	secret, key, err := s.authHandler.newServiceAccountKey(req.ExpiresAt, now)
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to generate service account key: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	_, err = s.serviceAccounts.update(id, func(account *ServiceAccount) error {
+		if len(account.Keys) >= maxServiceAccountKeys {
+			return errTooManyServiceAccountKeys
+		}
+		account.Keys = append(account.Keys, key)
+		return nil
+	})
+	if err != nil {
+		s.writeServiceAccountError(w, r, err)
+		return
+	}
+	s.recordServiceAccountChange(r, admin, id, "key_created", map[string]string{"key": key.ID})
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: localize(r, "Key created. Store it now, it will not be shown again."),
+		Data: map[string]interface{}{
+			"key":    key,
+			"secret": secret,
+		},
+	})
+}
+
+// ServiceAccountKeyDeleteHandler revokes one of a service account's keys.
+// Tokens already issued with it stay valid until they expire.
+func (s *Server) ServiceAccountKeyDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Service account key revocation request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	_, err := s.serviceAccounts.update(vars["id"], func(account *ServiceAccount) error {
+		i := slices.IndexFunc(account.Keys, func(key ServiceAccountKey) bool { return key.ID == vars["keyId"] })
+		if i < 0 {
+			return errServiceAccountKeyNotFound
+		}
+		account.Keys = slices.Delete(account.Keys, i, i+1)
+		return nil
+	})
+	if err != nil {
+		s.writeServiceAccountError(w, r, err)
+		return
+	}
+	s.recordServiceAccountChange(r, admin, vars["id"], "key_revoked", map[string]string{"key": vars["keyId"]})
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: localize(r, "Key revoked successfully"),
+	})
+}
+
+// ServiceAccountAuditHandler returns a service account's audit trail:
+// changes made to it and the tokens it was issued, newest first. It
+// covers the events the audit log still holds, including those of a
+// deleted account.
+func (s *Server) ServiceAccountAuditHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Service account audit request received")
+
+	if _, ok := s.authHandler.requireAdmin(w, r); !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	events := []AuditEvent{}
+	for _, event := range s.audit.Recent(0) {
+		if event.Details["serviceAccount"] == id {
+			events = append(events, event)
+		}
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: localize(r, "Audit events retrieved successfully"),
+		Data:    events,
+	})
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"auth-server/pkg/events"
+	"auth-server/pkg/websocket"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionStatusInterval is how often an idle session status socket is
+// pinged and its session checked, which notices sessions that expired or
+// ended without an event
+const sessionStatusInterval = 30 * time.Second
+
+// sessionStatusTimeout bounds each write to a status socket and each
+// session check
+const sessionStatusTimeout = 10 * time.Second
+
+// sessionStatusSignalBuffer is how many signals a socket may fall behind
+// before further ones are dropped; the next check still catches up
+const sessionStatusSignalBuffer = 8
+
+// Session status message types
+const (
+	SessionStatusConnected    = "connected"
+	SessionStatusRoleChanged  = "role_changed"
+	SessionStatusRevoked      = "session_revoked"
+	SessionStatusForcedLogout = "forced_logout"
+)
+
+// SessionStatusMessage is sent over the session status socket. Reason
+// says why a session ended: logout, login (replaced by a new one),
+// expired, revoked, password_reset, remember_me_theft, suspended or
+// deleted.
+type SessionStatusMessage struct {
+	Type      string     `json:"type"`
+	Reason    string     `json:"reason,omitempty"`
+	Role      string     `json:"role,omitempty"`
+	Previous  string     `json:"previous,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// sessionSignal tells a user's status sockets that their sessions may
+// have changed
+type sessionSignal struct {
+	sessionID string // the session concerned, or "" for any of the user's
+	reason    string
+	forced    bool // every session of the user was ended by an account change
+}
+
+// sessionWatcher is one status socket's subscription
+type sessionWatcher struct {
+	signals chan sessionSignal
+}
+
+// sessionWatchers routes domain events about users to their open status
+// sockets
+type sessionWatchers struct {
+	mutex    sync.Mutex
+	users    map[string]map[*sessionWatcher]struct{}
+	stopping chan struct{}
+	stopOnce sync.Once
+}
+
+func newSessionWatchers() *sessionWatchers {
+	return &sessionWatchers{
+		users:    make(map[string]map[*sessionWatcher]struct{}),
+		stopping: make(chan struct{}),
+	}
+}
+
+// watch subscribes to signals about userID until the returned function is
+// called
+func (sw *sessionWatchers) watch(userID string) (*sessionWatcher, func()) {
+	watcher := &sessionWatcher{signals: make(chan sessionSignal, sessionStatusSignalBuffer)}
+
+	sw.mutex.Lock()
+	if sw.users[userID] == nil {
+		sw.users[userID] = make(map[*sessionWatcher]struct{})
+	}
+	sw.users[userID][watcher] = struct{}{}
+	sw.mutex.Unlock()
+
+	return watcher, func() {
+		sw.mutex.Lock()
+		defer sw.mutex.Unlock()
+		delete(sw.users[userID], watcher)
+		if len(sw.users[userID]) == 0 {
+			delete(sw.users, userID)
+		}
+	}
+}
+
+// notify passes signal to every status socket of userID without blocking
+func (sw *sessionWatchers) notify(userID string, signal sessionSignal) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	for watcher := range sw.users[userID] {
+		select {
+		case watcher.signals <- signal:
+		default:
+		}
+	}
+}
+
+// observe is subscribed to the event bus and turns the events that end
+// sessions or change roles into signals
+func (sw *sessionWatchers) observe(event events.Event) {
+	switch event.Type {
+	case events.TypeSessionRevoked:
+		reason := event.Data["reason"]
+		forced := reason == "password_reset" || reason == "remember_me_theft"
+		sw.notify(event.UserID, sessionSignal{sessionID: event.Data["sessionId"], reason: reason, forced: forced})
+	case events.TypePasswordChanged:
+		if event.Data["reason"] == "reset" {
+			sw.notify(event.UserID, sessionSignal{reason: "password_reset", forced: true})
+		}
+	case events.TypeUserSuspended:
+		sw.notify(event.UserID, sessionSignal{reason: "suspended", forced: true})
+	case events.TypeUserDeleted:
+		sw.notify(event.UserID, sessionSignal{reason: "deleted", forced: true})
+	case events.TypeRoleChanged:
+		sw.notify(event.UserID, sessionSignal{})
+	}
+}
+
+// shutdown makes every status socket close with CloseGoingAway. It is
+// registered with the HTTP servers, which do not track hijacked
+// connections themselves.
+func (sw *sessionWatchers) shutdown() {
+	sw.stopOnce.Do(func() { close(sw.stopping) })
+}
+
+// websocketOriginAllowed reports whether a page on r's Origin may open a
+// WebSocket. Browsers send cookies with cross-site handshakes, so only
+// this server's own origin and Config.WebSocketOrigins are let in.
+// Clients that send no Origin are not browsers.
+func (s *Server) websocketOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	if strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+	if public, err := url.Parse(s.config.PublicURL); err == nil && strings.EqualFold(parsed.Scheme, public.Scheme) && strings.EqualFold(parsed.Host, public.Host) {
+		return true
+	}
+	for _, allowed := range s.config.WebSocketOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// SessionStatusHandler upgrades to a WebSocket that tells the client when
+// its session ends, because it was revoked, expired or the account was
+// signed out everywhere, or when the user's role changes, so single page
+// apps can react at once rather than on their next 401. The first message
+// is SessionStatusConnected with the role and session expiry; after a
+// session_revoked or forced_logout message the socket is closed.
+func (s *Server) SessionStatusHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Session status socket request received")
+
+	if !s.websocketOriginAllowed(r) {
+		s.logger.Printf("[DEBUG] Session status socket refused for origin: %s", r.Header.Get("Origin"))
+		http.Error(w, localize(r, "Origin not allowed"), http.StatusForbidden)
+		return
+	}
+
+	record, err := s.authHandler.sessionRecord(r)
+	if err != nil {
+		writeSessionError(w, r, err)
+		return
+	}
+	user, err := s.authHandler.sessionUser(r)
+	if err != nil {
+		writeSessionError(w, r, err)
+		return
+	}
+
+	if !websocket.IsUpgrade(r) {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, localize(r, "A WebSocket upgrade is required"), http.StatusUpgradeRequired)
+		return
+	}
+	conn, err := websocket.Upgrade(w, r)
+	if errors.Is(err, websocket.ErrBadHandshake) {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, localize(r, "Invalid WebSocket handshake"), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to upgrade session status socket: %v", err)
+		http.Error(w, localize(r, "Internal server error"), http.StatusInternalServerError)
+		return
+	}
+	// Every way out closes the socket; a close frame already sent is not
+	// sent again
+	defer conn.Close(websocket.CloseGoingAway, "", sessionStatusTimeout)
+
+	// The request's context ends with its deadline, long before the socket
+	ctx := context.WithoutCancel(r.Context())
+	watcher, unwatch := s.sessionStatus.watch(user.ID)
+	defer unwatch()
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	expiresAt := record.ExpiresAt
+	if err := conn.WriteJSON(SessionStatusMessage{Type: SessionStatusConnected, Role: user.Role, ExpiresAt: &expiresAt}, sessionStatusTimeout); err != nil {
+		return
+	}
+	s.logger.Printf("[DEBUG] Session status socket opened for user: %s", user.Username)
+
+	ticker := time.NewTicker(sessionStatusInterval)
+	defer ticker.Stop()
+	role := user.Role
+	for {
+		var signal sessionSignal
+		select {
+		case <-closed:
+			s.logger.Printf("[DEBUG] Session status socket closed by user: %s", user.Username)
+			return
+		case <-s.sessionStatus.stopping:
+			return
+		case <-ticker.C:
+			if err := conn.Ping(sessionStatusTimeout); err != nil {
+				return
+			}
+		case signal = <-watcher.signals:
+			if signal.sessionID != "" && signal.sessionID != record.ID && !signal.forced {
+				continue
+			}
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, sessionStatusTimeout)
+		current, err := s.authHandler.sessionUser(r.WithContext(checkCtx))
+		cancel()
+		switch {
+		case errors.Is(err, errNoSession) || errors.Is(err, errSessionUserNotFound):
+			message := SessionStatusMessage{Type: SessionStatusRevoked, Reason: signal.reason}
+			if signal.forced {
+				message.Type = SessionStatusForcedLogout
+			}
+			if message.Reason == "" {
+				message.Reason = "revoked"
+				if !s.authHandler.clock.Now().Before(record.ExpiresAt) {
+					message.Reason = "expired"
+				}
+			}
+			conn.WriteJSON(message, sessionStatusTimeout)
+			conn.Close(websocket.CloseNormal, message.Type, sessionStatusTimeout)
+			s.logger.Printf("[DEBUG] Session status socket told user %s: %s (%s)", user.Username, message.Type, message.Reason)
+			return
+		case err != nil:
+			// The store is unavailable; the next signal or tick checks again
+			s.logger.Printf("[DEBUG] Failed to check session of %s: %v", user.Username, err)
+		case current.Role != role:
+			message := SessionStatusMessage{Type: SessionStatusRoleChanged, Role: current.Role, Previous: role}
+			if err := conn.WriteJSON(message, sessionStatusTimeout); err != nil {
+				return
+			}
+			role = current.Role
+		}
+	}
+}
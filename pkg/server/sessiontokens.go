@@ -0,0 +1,327 @@
+package server
+
+import (
+	"auth-server/pkg/cryptoutil"
+	"auth-server/pkg/redis"
+	"auth-server/pkg/sessionstore"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Session modes, set with SESSION_MODE
+const (
+	// SessionModeServer keeps sessions in memory and puts only their ID in
+	// the cookie. It is the default and suits a single instance.
+	SessionModeServer = "server"
+	// SessionModeStateless puts the whole session, encrypted, in the
+	// cookie, so any replica sharing ENCRYPTION_MASTER_KEY can serve it.
+	// Revoked sessions are kept in Redis until they would have expired.
+	SessionModeStateless = "stateless"
+)
+
+// errSessionsUnavailable is returned when the session manager, or in
+// stateless mode the list of revoked sessions, cannot be reached, in which
+// case no session is accepted
+var errSessionsUnavailable = errors.New("sessions unavailable")
+
+// statelessSessions seals sessions into tokens and checks them against a
+// shared revocation list. A session cannot be changed once issued, so
+// re-authentication rotates it to a new token like in server mode.
+type statelessSessions struct {
+	key     []byte
+	revoked revocationList
+}
+
+// newStatelessSessionsFromConfig returns nil unless cfg.SessionMode is
+// stateless. Without REDIS_URL revocations only reach the instance that
+// made them, which is only right for a single instance. Stateless sessions
+// that cannot be set up as configured are an error rather than a quiet
+// fallback to server-side sessions, which work differently.
+func newStatelessSessionsFromConfig(cfg Config) (*statelessSessions, error) {
+	if cfg.SessionMode != SessionModeStateless {
+		return nil, nil
+	}
+
+	if len(cfg.MasterKey) == 0 {
+		return nil, errors.New("stateless sessions need a master key")
+	}
+	key, err := cryptoutil.DeriveKey(cfg.MasterKey, "stateless-sessions")
+	if err != nil {
+		return nil, fmt.Errorf("deriving the session token key: %w", err)
+	}
+
+	var revoked revocationList = newMemoryRevocations()
+	if cfg.RedisURL == "" {
+		cfg.Logger.Printf("[DEBUG] No REDIS_URL set, revoked sessions are only known to this instance")
+	} else if client, err := redis.ParseURL(cfg.RedisURL); err != nil {
+		return nil, fmt.Errorf("REDIS_URL: %w", err)
+	} else {
+		revoked = &redisRevocations{client: client}
+	}
+	return &statelessSessions{key: key, revoked: revoked}, nil
+}
+
+// tokenAdditionalData binds tokens to their purpose, so other ciphertexts
+// made with the same key cannot pass as sessions
+var tokenAdditionalData = []byte("session")
+
+// seal returns the token carrying record
+func (s *statelessSessions) seal(record sessionstore.Session) (string, error) {
+	plaintext, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := cryptoutil.Encrypt(s.key, plaintext, tokenAdditionalData)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// open returns the session in token if it is authentic, unexpired and not
+// revoked
+func (s *statelessSessions) open(ctx context.Context, token string, now time.Time) (sessionstore.Session, error) {
+	ciphertext, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return sessionstore.Session{}, errNoSession
+	}
+	plaintext, err := cryptoutil.Decrypt(s.key, ciphertext, tokenAdditionalData)
+	if err != nil {
+		return sessionstore.Session{}, errNoSession
+	}
+	var record sessionstore.Session
+	if err := json.Unmarshal(plaintext, &record); err != nil || record.Expired(now) {
+		return sessionstore.Session{}, errNoSession
+	}
+
+	revoked, err := s.revoked.isRevoked(ctx, record)
+	if err != nil {
+		return sessionstore.Session{}, fmt.Errorf("%w: %v", errSessionsUnavailable, err)
+	}
+	if revoked {
+		return sessionstore.Session{}, errNoSession
+	}
+	return record, nil
+}
+
+// revocationList remembers revoked stateless sessions until they would
+// have expired anyway
+type revocationList interface {
+	// revoke revokes one session, reporting whether it was not already
+	revoke(ctx context.Context, record sessionstore.Session, now time.Time) (bool, error)
+	// revokeUser revokes every session the user started before now, for
+	// ttl, the longest any of them can still be valid
+	revokeUser(ctx context.Context, userID string, now time.Time, ttl time.Duration) error
+	isRevoked(ctx context.Context, record sessionstore.Session) (bool, error)
+}
+
+// memoryRevocations is a revocationList for a single instance
+type memoryRevocations struct {
+	mutex    sync.Mutex
+	sessions map[string]time.Time      // session ID to when it expires
+	users    map[string]userRevocation // user ID to their latest revocation
+}
+
+type userRevocation struct {
+	at      time.Time
+	expires time.Time
+}
+
+func newMemoryRevocations() *memoryRevocations {
+	return &memoryRevocations{
+		sessions: make(map[string]time.Time),
+		users:    make(map[string]userRevocation),
+	}
+}
+
+func (m *memoryRevocations) revoke(ctx context.Context, record sessionstore.Session, now time.Time) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.sessions[record.ID]; ok {
+		return false, nil
+	}
+	m.sessions[record.ID] = record.ExpiresAt
+	return true, nil
+}
+
+func (m *memoryRevocations) revokeUser(ctx context.Context, userID string, now time.Time, ttl time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.users[userID] = userRevocation{at: now, expires: now.Add(ttl)}
+	return nil
+}
+
+func (m *memoryRevocations) isRevoked(ctx context.Context, record sessionstore.Session) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.sessions[record.ID]; ok {
+		return true, nil
+	}
+	revocation, ok := m.users[record.UserID]
+	return ok && record.CreatedAt.Before(revocation.at), nil
+}
+
+// Purge forgets revocations of sessions that have expired at now
+func (m *memoryRevocations) Purge(now time.Time) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	purged := 0
+	for id, expires := range m.sessions {
+		if !now.Before(expires) {
+			delete(m.sessions, id)
+			purged++
+		}
+	}
+	for id, revocation := range m.users {
+		if !now.Before(revocation.expires) {
+			delete(m.users, id)
+			purged++
+		}
+	}
+	return purged
+}
+
+// redisRevocations is a revocationList shared by every replica through
+// Redis. Keys expire on their own, so there is nothing to purge.
+type redisRevocations struct {
+	client *redis.Client
+}
+
+func revokedSessionKey(id string) string { return "auth:revoked:session:" + id }
+func revokedUserKey(id string) string    { return "auth:revoked:user:" + id }
+
+func (r *redisRevocations) revoke(ctx context.Context, record sessionstore.Session, now time.Time) (bool, error) {
+	ttl := record.ExpiresAt.Sub(now).Milliseconds()
+	if ttl <= 0 {
+		return true, nil
+	}
+	reply, err := r.client.Do(ctx, "SET", revokedSessionKey(record.ID), "1", "PX", strconv.FormatInt(ttl, 10), "NX")
+	if err != nil {
+		return false, err
+	}
+	// SET NX has a null reply when the key already existed
+	return reply != nil, nil
+}
+
+func (r *redisRevocations) revokeUser(ctx context.Context, userID string, now time.Time, ttl time.Duration) error {
+	_, err := r.client.Do(ctx, "SET", revokedUserKey(userID), strconv.FormatInt(now.UnixNano(), 10), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (r *redisRevocations) isRevoked(ctx context.Context, record sessionstore.Session) (bool, error) {
+	reply, err := r.client.Do(ctx, "MGET", revokedSessionKey(record.ID), revokedUserKey(record.UserID))
+	if err != nil {
+		return false, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, fmt.Errorf("unexpected MGET reply %v", reply)
+	}
+	if values[0] != nil {
+		return true, nil
+	}
+	if at, ok := values[1].(string); ok {
+		nanos, err := strconv.ParseInt(at, 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid revocation time %q", at)
+		}
+		return record.CreatedAt.Before(time.Unix(0, nanos)), nil
+	}
+	return false, nil
+}
+
+// issueSession starts record and returns what the session cookie carries:
+// the session ID, or in stateless mode the sealed session
+func (h *AuthHandler) issueSession(ctx context.Context, record sessionstore.Session) (string, error) {
+	if h.stateless != nil {
+		token, err := h.stateless.seal(record)
+		h.slo.observeSessionStore(err)
+		return token, err
+	}
+	err := h.sessions.Put(ctx, record)
+	h.slo.observeSessionStore(err)
+	if err != nil {
+		return "", err
+	}
+	return record.ID, nil
+}
+
+// lookupSession returns the session a cookie's token refers to
+func (h *AuthHandler) lookupSession(ctx context.Context, token string) (sessionstore.Session, error) {
+	now := h.clock.Now()
+	if h.stateless != nil {
+		record, err := h.stateless.open(ctx, token, now)
+		h.slo.observeSessionStore(err)
+		return record, err
+	}
+	record, err := h.sessions.Get(ctx, token, now)
+	if errors.Is(err, sessionstore.ErrNotFound) {
+		err = errNoSession
+	} else if err != nil && !isContextError(err) {
+		err = fmt.Errorf("%w: %v", errSessionsUnavailable, err)
+	}
+	h.slo.observeSessionStore(err)
+	if err != nil {
+		return sessionstore.Session{}, err
+	}
+	return record, nil
+}
+
+// revokeSession ends a session, reporting whether it was still active
+func (h *AuthHandler) revokeSession(ctx context.Context, record sessionstore.Session) (bool, error) {
+	if h.stateless != nil {
+		revoked, err := h.stateless.revoked.revoke(ctx, record, h.clock.Now())
+		h.slo.observeSessionStore(err)
+		return revoked, err
+	}
+	revoked, err := h.sessions.Delete(ctx, record.ID)
+	h.slo.observeSessionStore(err)
+	return revoked, err
+}
+
+// revokeUserSessions ends every session of the user and returns the ones
+// it knows of. Stateless sessions are revoked all at once without being
+// listed, since only their holders have them.
+func (h *AuthHandler) revokeUserSessions(ctx context.Context, userID string) ([]sessionstore.Session, error) {
+	now := h.clock.Now()
+	if h.stateless != nil {
+		err := h.stateless.revoked.revokeUser(ctx, userID, now, h.config.SessionTTL)
+		h.slo.observeSessionStore(err)
+		return nil, err
+	}
+	sessions, err := h.sessions.ForUser(ctx, userID, now)
+	h.slo.observeSessionStore(err)
+	if err != nil {
+		return nil, err
+	}
+
+	var revoked []sessionstore.Session
+	for _, session := range sessions {
+		deleted, err := h.sessions.Delete(ctx, session.ID)
+		h.slo.observeSessionStore(err)
+		if err != nil {
+			return revoked, err
+		}
+		if deleted {
+			revoked = append(revoked, session)
+		}
+	}
+	return revoked, nil
+}
+
+// purgeExpiredSessions deletes the expired sessions of the stored session
+// mode and returns how many were removed
+func (h *AuthHandler) purgeExpiredSessions(now time.Time) int {
+	purged, err := h.sessions.PurgeExpired(context.Background(), now)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to purge expired sessions: %v", err)
+	}
+	return purged
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Session transports a client may ask for at login
+const (
+	// SessionTransportCookie keeps the session in an HttpOnly cookie, for
+	// browser apps. It is the default.
+	SessionTransportCookie = "cookie"
+	// SessionTransportBearer returns the session as a token the client
+	// sends in the Authorization header, for native apps
+	SessionTransportBearer = "bearer"
+)
+
+// validSessionTransport reports whether transport names a session
+// transport, counting "" as the default
+func validSessionTransport(transport string) bool {
+	return transport == "" || transport == SessionTransportCookie || transport == SessionTransportBearer
+}
+
+// SessionTokenResponse answers a login with the bearer transport. The
+// token names follow TokenResponse.
+type SessionTokenResponse struct {
+	User        User   `json:"user"`
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// bearerToken returns the token in r's Authorization header, if any
+func bearerToken(r *http.Request) (string, bool) {
+	return strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// handOverSession gives the client the session token: in the session
+// cookie, or for the bearer transport returned for the response body.
+// Bearer tokens are encoded like the cookie, so they are signed and
+// encrypted with the same keys and the session ID never shows.
+func (h *AuthHandler) handOverSession(w http.ResponseWriter, r *http.Request, token string, maxAge int, transport string) (string, error) {
+	store := h.cookieStore()
+	if transport == SessionTransportBearer {
+		values := map[interface{}]interface{}{"session_id": token}
+		return securecookie.EncodeMulti(h.config.SessionCookieName, values, store.Codecs...)
+	}
+
+	session, _ := store.Get(r, h.config.SessionCookieName)
+	session.Values["session_id"] = token
+	session.Options.MaxAge = maxAge
+	session.Save(r, w)
+	return "", nil
+}
+
+// sessionToken returns the session token r carries: from a bearer
+// Authorization header when there is one, else from the session cookie
+func (h *AuthHandler) sessionToken(r *http.Request) (string, error) {
+	store := h.cookieStore()
+	values := make(map[interface{}]interface{})
+	if bearer, ok := bearerToken(r); ok {
+		if err := securecookie.DecodeMulti(h.config.SessionCookieName, bearer, &values, store.Codecs...); err != nil {
+			return "", errNoSession
+		}
+	} else {
+		session, err := store.Get(r, h.config.SessionCookieName)
+		if err != nil {
+			return "", err
+		}
+		values = session.Values
+	}
+
+	token, ok := values["session_id"].(string)
+	if !ok || token == "" {
+		return "", errNoSession
+	}
+	return token, nil
+}
+
+// requestTransport is the session transport r arrived with
+func requestTransport(r *http.Request) string {
+	if _, ok := bearerToken(r); ok {
+		return SessionTransportBearer
+	}
+	return SessionTransportCookie
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Sign-up velocity limits, the names SIGNUP_VELOCITY_LIMITS takes
+const (
+	SignupIPHourly     = "ip_hour"
+	SignupIPDaily      = "ip_day"
+	SignupDeviceHourly = "device_hour"
+	SignupDeviceDaily  = "device_day"
+)
+
+// signupVelocityLimits are all the limits
+var signupVelocityLimits = []string{SignupIPHourly, SignupIPDaily, SignupDeviceHourly, SignupDeviceDaily}
+
+// Sign-up velocity actions, set with SIGNUP_VELOCITY_ACTION
+const (
+	// SignupActionReview creates the account but holds it for an admin to
+	// approve before it can sign in
+	SignupActionReview = "review"
+	// SignupActionBlock refuses the registration
+	SignupActionBlock = "block"
+)
+
+// accountPendingReviewError is the error code sent to accounts held for
+// review, so clients can explain the wait
+const accountPendingReviewError = "account_pending_review"
+
+// pendingReviewMessage answers a registration held for review
+const pendingReviewMessage = "Registration received. Your account will be available once it has been reviewed."
+
+var errNotPendingReview = errors.New("account is not pending review")
+
+// signupVelocity remembers when recent registrations came from each IP and
+// device, for a day
+type signupVelocity struct {
+	mutex  sync.Mutex
+	events map[string][]time.Time
+}
+
+func newSignupVelocity() *signupVelocity {
+	return &signupVelocity{events: make(map[string][]time.Time)}
+}
+
+// record notes a registration at now for each key
+func (v *signupVelocity) record(now time.Time, keys ...string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for _, key := range keys {
+		v.events[key] = append(v.events[key], now)
+	}
+}
+
+// count returns how many registrations key made in the window up to now
+func (v *signupVelocity) count(key string, window time.Duration, now time.Time) int {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	n := 0
+	for _, at := range v.events[key] {
+		if now.Sub(at) < window {
+			n++
+		}
+	}
+	return n
+}
+
+// Purge forgets registrations older than a day and returns how many keys
+// it dropped entirely
+func (v *signupVelocity) Purge(now time.Time) int {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	purged := 0
+	for key, times := range v.events {
+		kept := times[:0]
+		for _, at := range times {
+			if now.Sub(at) < 24*time.Hour {
+				kept = append(kept, at)
+			}
+		}
+		if len(kept) == 0 {
+			delete(v.events, key)
+			purged++
+			continue
+		}
+		v.events[key] = kept
+	}
+	return purged
+}
+
+// signupDevice fingerprints the device registering: the ID the client app
+// keeps for it when given, else its User-Agent and languages
+func signupDevice(r *http.Request, deviceID string) string {
+	if deviceID != "" {
+		sum := sha256.Sum256([]byte("id:" + deviceID))
+		return hex.EncodeToString(sum[:8])
+	}
+	sum := sha256.Sum256([]byte(r.UserAgent() + "\n" + r.Header.Get("Accept-Language")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// signupLimitsExceeded returns the velocity limits one more registration
+// from ip and device would go over
+func (h *AuthHandler) signupLimitsExceeded(ip, device string, now time.Time) []string {
+	var exceeded []string
+	check := func(name, key string, window time.Duration) {
+		limit := h.config.SignupVelocityLimits[name]
+		if limit > 0 && h.signupVelocity.count(key, window, now) >= limit {
+			exceeded = append(exceeded, name)
+		}
+	}
+	check(SignupIPHourly, "ip:"+ip, time.Hour)
+	check(SignupIPDaily, "ip:"+ip, 24*time.Hour)
+	check(SignupDeviceHourly, "device:"+device, time.Hour)
+	check(SignupDeviceDaily, "device:"+device, 24*time.Hour)
+	return exceeded
+}
+
+// writeAccountPendingReview refuses to sign in an account held for review
+func writeAccountPendingReview(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(Response{
+		Success: false,
+		Message: localize(r, "This account is awaiting review"),
+		Data:    map[string]string{"error": accountPendingReviewError},
+	})
+}
+
+// PendingSignup is an account waiting in the review queue
+type PendingSignup struct {
+	User   User         `json:"user"`
+	Review SignupReview `json:"review"`
+}
+
+// AdminSignupReviewsHandler lists the accounts held for review, oldest
+// first
+func (h *AuthHandler) AdminSignupReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Sign-up review queue request received")
+
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	users, err := h.users.List(r.Context())
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to list users: %v", err)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	pending := []PendingSignup{}
+	for _, user := range users {
+		if user.SignupReview != nil && user.Deletion == nil {
+			pending = append(pending, PendingSignup{User: user.Sanitized(), Review: *user.SignupReview})
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Review.At.Before(pending[j].Review.At)
+	})
+
+	json.NewEncoder(w).Encode(Response{Success: true, Data: pending})
+}
+
+// AdminSignupApproveHandler lets a held account sign in
+func (h *AuthHandler) AdminSignupApproveHandler(w http.ResponseWriter, r *http.Request) {
+	h.decideSignup(w, r, true)
+}
+
+// AdminSignupRejectHandler deletes a held account, which is purged once the
+// deleted account retention passes
+func (h *AuthHandler) AdminSignupRejectHandler(w http.ResponseWriter, r *http.Request) {
+	h.decideSignup(w, r, false)
+}
+
+// decideSignup approves or rejects the held account named in the path
+func (h *AuthHandler) decideSignup(w http.ResponseWriter, r *http.Request, approve bool) {
+	h.logger.Printf("[DEBUG] Sign-up review decision received")
+
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	user, err := h.users.Get(r.Context(), id)
+	if err == nil && (user.SignupReview == nil || user.Deletion != nil) {
+		err = errNotPendingReview
+	}
+	if err == nil {
+		if approve {
+			err = h.approveSignup(r.Context(), user)
+		} else {
+			err = h.deleteAccount(r.Context(), user, admin.ID, "sign-up rejected")
+		}
+	}
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		http.Error(w, localize(r, "User not found"), http.StatusNotFound)
+		return
+	case errors.Is(err, errNotPendingReview):
+		http.Error(w, localize(r, "The account is not awaiting review"), http.StatusConflict)
+		return
+	case err != nil:
+		h.logger.Printf("[DEBUG] Failed to decide sign-up %s: %v", id, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	eventType, message := AuditSignupApproved, "Sign-up approved"
+	if !approve {
+		eventType, message = AuditSignupRejected, "Sign-up rejected"
+	}
+	h.audit.Record(AuditEvent{
+		Type:    eventType,
+		UserID:  admin.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"target": user.ID},
+	})
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: localize(r, message),
+		Data:    user.Sanitized(),
+	})
+}
+
+// approveSignup releases user from review
+func (h *AuthHandler) approveSignup(ctx context.Context, user *User) error {
+	review := user.SignupReview
+	user.SignupReview = nil
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(ctx, user); err != nil {
+		user.SignupReview = review
+		return err
+	}
+	return nil
+}
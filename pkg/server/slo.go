@@ -0,0 +1,230 @@
+package server
+
+import (
+	"auth-server/pkg/metrics"
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sloRoutes are the routes whose latency is tracked, by route template,
+// with the name used in the route label
+var sloRoutes = map[string]string{
+	"/api/login":                   "login",
+	"/api/register":                "register",
+	"/api/login/magic-link/verify": "magic_link_verify",
+	"/api/reauth":                  "reauth",
+	"/oauth/token":                 "token",
+}
+
+// sloLatencyBuckets are the upper bounds, in seconds, of the auth latency
+// histogram. Password hashing puts a normal login around 100ms.
+var sloLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// sloWindowSlots is how many slots each SLI window is split into
+const sloWindowSlots = 30
+
+// sloMetrics records the indicators behind the service level objectives:
+// login outcomes, auth latency, session store errors and mailer failures.
+// Counters and the latency histogram are cumulative for alert rules to
+// rate() over; the auth_sli_* gauges give the same ratios precomputed over
+// Config.SLIWindow. Every series carries the backend it measures, so the
+// same rules work across deployments. A nil sloMetrics records nothing.
+type sloMetrics struct {
+	registry *metrics.Registry
+	now      func() time.Time
+
+	sessionBackend string
+	mailerBackend  string
+
+	logins   *metrics.Window
+	sessions *metrics.Window
+	mails    *metrics.Window
+}
+
+// newSLOMetrics registers the SLI gauges in registry. sessionBackend labels
+// the auth and session series, mailerBackend the mailer ones.
+func newSLOMetrics(registry *metrics.Registry, window time.Duration, now func() time.Time, sessionBackend, mailerBackend string) *sloMetrics {
+	s := &sloMetrics{
+		registry:       registry,
+		now:            now,
+		sessionBackend: sessionBackend,
+		mailerBackend:  mailerBackend,
+		logins:         metrics.NewWindow(window, sloWindowSlots),
+		sessions:       metrics.NewWindow(window, sloWindowSlots),
+		mails:          metrics.NewWindow(window, sloWindowSlots),
+	}
+
+	registry.Gauge("auth_sli_window_seconds", "Span the auth_sli_* ratios are computed over.").Set(window.Seconds())
+	registry.GaugeFunc("auth_sli_login_success_ratio",
+		"Share of logins in the SLI window not failed by the server; rejected credentials do not count against it.",
+		func() float64 { return s.ratio(s.logins, true) }, "backend", sessionBackend)
+	registry.GaugeFunc("auth_sli_session_store_error_ratio",
+		"Share of session store operations in the SLI window that failed.",
+		func() float64 { return s.ratio(s.sessions, false) }, "backend", sessionBackend)
+	registry.GaugeFunc("auth_sli_mailer_failure_ratio",
+		"Share of email sends in the SLI window that failed.",
+		func() float64 { return s.ratio(s.mails, false) }, "backend", mailerBackend)
+	return s
+}
+
+// ratio returns the share of good events in window, or of bad ones, over
+// the SLI window. With no events there is nothing wrong to report.
+func (s *sloMetrics) ratio(window *metrics.Window, good bool) float64 {
+	goodCount, badCount := window.Counts(s.now())
+	total := goodCount + badCount
+	switch {
+	case total == 0 && good:
+		return 1
+	case total == 0:
+		return 0
+	case good:
+		return float64(goodCount) / float64(total)
+	default:
+		return float64(badCount) / float64(total)
+	}
+}
+
+// observeRequest records how long a request to one of sloRoutes took and,
+// for logins, how it ended
+func (s *sloMetrics) observeRequest(route string, status int, elapsed time.Duration) {
+	if s == nil {
+		return
+	}
+	s.registry.Histogram("auth_request_duration_seconds", "Time taken to answer auth requests.", sloLatencyBuckets,
+		"route", route, "backend", s.sessionBackend).Observe(elapsed.Seconds())
+
+	if route != "login" {
+		return
+	}
+	result := "success"
+	switch {
+	case status >= 500:
+		result = "error"
+	case status >= 400:
+		result = "rejected"
+	}
+	s.registry.Counter("auth_login_attempts_total", "Login attempts by result: success, rejected or error.",
+		"backend", s.sessionBackend, "result", result).Inc()
+	if result != "rejected" {
+		s.logins.Observe(s.now(), result == "success")
+	}
+}
+
+// observeSessionStore records a session store operation, failed when err is
+// a store error rather than a missing or revoked session
+func (s *sloMetrics) observeSessionStore(err error) {
+	if s == nil {
+		return
+	}
+	failed := err != nil && !errors.Is(err, errNoSession)
+	s.registry.Counter("auth_session_store_operations_total", "Session store operations by result: ok or error.",
+		"backend", s.sessionBackend, "result", resultLabel(failed)).Inc()
+	s.sessions.Observe(s.now(), !failed)
+}
+
+// observeMail records an email send
+func (s *sloMetrics) observeMail(err error) {
+	if s == nil {
+		return
+	}
+	s.registry.Counter("auth_mailer_sends_total", "Email sends by result: ok or error.",
+		"backend", s.mailerBackend, "result", resultLabel(err != nil)).Inc()
+	s.mails.Observe(s.now(), err == nil)
+}
+
+func resultLabel(failed bool) string {
+	if failed {
+		return "error"
+	}
+	return "ok"
+}
+
+// sessionBackend names where session state is kept: in this process, or
+// in Redis for stateless sessions sharing their revocations
+func sessionBackend(stateless *statelessSessions) string {
+	if stateless != nil {
+		if _, ok := stateless.revoked.(*redisRevocations); ok {
+			return "redis"
+		}
+	}
+	return "memory"
+}
+
+// mailerBackend names how cfg sends email
+func mailerBackend(cfg Config) string {
+	if cfg.SMTPAddr == "" {
+		return "log"
+	}
+	return "smtp"
+}
+
+// statusWriter remembers the status a handler wrote
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Flush keeps streaming handlers working behind the writer
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets WebSocket handlers take over the connection behind the
+// writer, which counts as switching protocols
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && sw.status == 0 {
+		sw.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// sloMiddleware times requests to the routes in sloRoutes and records how
+// they ended
+func (s *Server) sloMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var name string
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				name = sloRoutes[template]
+			}
+		}
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		s.authHandler.slo.observeRequest(name, sw.status, time.Since(start))
+	})
+}
@@ -0,0 +1,447 @@
+package server
+
+import (
+	"auth-server/pkg/randutil"
+	"auth-server/pkg/sms"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SMS code purposes; a code sent for one cannot be used for another
+const (
+	smsPurposeVerifyPhone = "verify_phone"
+	smsPurposeLogin       = "login"
+)
+
+const (
+	// smsCodeTTL is how long a texted code works
+	smsCodeTTL = 5 * time.Minute
+	// smsCodeMaxAttempts is how many wrong guesses burn a code
+	smsCodeMaxAttempts = 5
+	// smsRateWindow is the window Config.SMSRateLimit applies to
+	smsRateWindow = time.Hour
+)
+
+var (
+	errSMSRateLimited = errors.New("too many codes sent to this number")
+	errSMSCapReached  = errors.New("daily SMS cap reached")
+)
+
+// smsCodeStore holds the outstanding code per user and purpose. Only a
+// hash of each code is kept.
+type smsCodeStore struct {
+	mutex sync.Mutex
+	codes map[string]*smsCode // keyed by user ID and purpose
+}
+
+type smsCode struct {
+	hash      string
+	phone     string
+	attempts  int
+	expiresAt time.Time
+}
+
+func newSMSCodeStore() *smsCodeStore {
+	return &smsCodeStore{codes: make(map[string]*smsCode)}
+}
+
+// issue creates a 6 digit code, replacing any outstanding one
+func (s *smsCodeStore) issue(userID, purpose, phone string, now time.Time) (string, error) {
+	b, err := randutil.Bytes(4)
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%06d", binary.BigEndian.Uint32(b)%1000000)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.codes[userID+"|"+purpose] = &smsCode{hash: hashSMSCode(code), phone: phone, expiresAt: now.Add(smsCodeTTL)}
+	return code, nil
+}
+
+// verify checks code and consumes it on success. It returns the number the
+// code was sent to.
+func (s *smsCodeStore) verify(userID, purpose, code string, now time.Time) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := userID + "|" + purpose
+	entry, ok := s.codes[key]
+	if !ok {
+		return "", false
+	}
+	if !now.Before(entry.expiresAt) {
+		delete(s.codes, key)
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(entry.hash), []byte(hashSMSCode(code))) != 1 {
+		entry.attempts++
+		if entry.attempts >= smsCodeMaxAttempts {
+			delete(s.codes, key)
+		}
+		return "", false
+	}
+	delete(s.codes, key)
+	return entry.phone, true
+}
+
+// Purge removes expired codes and returns how many were removed
+func (s *smsCodeStore) Purge(now time.Time) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	purged := 0
+	for key, entry := range s.codes {
+		if !now.Before(entry.expiresAt) {
+			delete(s.codes, key)
+			purged++
+		}
+	}
+	return purged
+}
+
+func hashSMSCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// smsLimiter protects phone numbers from being flooded and caps the number
+// of messages sent per day, since every message costs money
+type smsLimiter struct {
+	perNumber      *failureCounter
+	perNumberLimit int
+	dailyCap       int
+
+	mutex sync.Mutex
+	day   string
+	sent  int
+}
+
+func newSMSLimiter(cfg Config) *smsLimiter {
+	return &smsLimiter{
+		perNumber:      newFailureCounter(smsRateWindow),
+		perNumberLimit: cfg.SMSRateLimit,
+		dailyCap:       cfg.SMSDailyCap,
+	}
+}
+
+// allow counts a message to phone, or returns why it may not be sent
+func (l *smsLimiter) allow(phone string, now time.Time) error {
+	if l.perNumber.Max(phone) >= l.perNumberLimit {
+		return errSMSRateLimited
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if day := now.UTC().Format("2006-01-02"); day != l.day {
+		l.day, l.sent = day, 0
+	}
+	if l.dailyCap > 0 && l.sent >= l.dailyCap {
+		return errSMSCapReached
+	}
+	l.sent++
+	l.perNumber.Add(phone)
+	return nil
+}
+
+// sendSMSCode texts user a new code for purpose, describing the number's
+// rate limit in the response headers. The message is sent in the
+// background; only limit errors are returned.
+func (h *AuthHandler) sendSMSCode(w http.ResponseWriter, r *http.Request, user *User, phone, purpose string) error {
+	err := h.smsLimiter.allow(phone, h.clock.Now())
+	if errors.Is(err, errSMSCapReached) {
+		h.logger.Printf("[DEBUG] Daily SMS cap of %d reached", h.config.SMSDailyCap)
+		return err
+	}
+	count, reset := h.smsLimiter.perNumber.Status(phone)
+	setRateLimitHeaders(w, h.smsLimiter.perNumberLimit, h.smsLimiter.perNumberLimit-count, reset)
+	if err != nil {
+		return err
+	}
+
+	code, err := h.smsCodes.issue(user.ID, purpose, phone, h.clock.Now())
+	if err != nil {
+		return err
+	}
+	body := translations.Sprintf(userLocale(user, r), "Your %s code is %s. It expires in %d minutes.",
+		h.config.Branding.Name, code, int(smsCodeTTL.Minutes()))
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), h.config.SMSTimeout)
+		defer cancel()
+		if err := h.sms.Send(ctx, phone, body); err != nil {
+			h.logger.Printf("[DEBUG] Failed to send SMS to %s: %v", user.Username, err)
+		}
+	}()
+	return nil
+}
+
+// writeSMSError writes the response for a code that could not be sent
+func writeSMSError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errSMSRateLimited):
+		// sendSMSCode has set Retry-After
+		http.Error(w, localize(r, "Too many codes sent to this number, please try again later"), http.StatusTooManyRequests)
+	case errors.Is(err, errSMSCapReached):
+		http.Error(w, localize(r, "Text messages are temporarily unavailable, please try again later"), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, localize(r, "Internal server error"), http.StatusInternalServerError)
+	}
+}
+
+// PhoneHandler starts verification of a new phone number for the session
+// user by texting it a code. The number replaces the current one once
+// PhoneVerifyHandler confirms the code.
+func (h *AuthHandler) PhoneHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Phone number change request received")
+
+	user := contextUser(r)
+
+	var req PhoneRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	phone, err := sms.NormalizeNumber(req.Phone)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Invalid phone number: %q", req.Phone)
+		http.Error(w, localize(r, "Phone number must be in international format, e.g. +14155550100"), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.hasher.Compare(r.Context(), user.Password, req.Password); err != nil {
+		if h.passwordUnavailable(w, r, err) {
+			return
+		}
+		h.logger.Printf("[DEBUG] Invalid current password for user: %s", user.Username)
+		http.Error(w, localize(r, "Invalid current password"), http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.sendSMSCode(w, r, user, phone, smsPurposeVerifyPhone); err != nil {
+		h.logger.Printf("[DEBUG] Failed to send verification code to %s: %v", phone, err)
+		writeSMSError(w, r, err)
+		return
+	}
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "A verification code has been sent to your phone"),
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Phone verification started for user: %s", user.Username)
+}
+
+// PhoneVerifyHandler confirms a texted code and saves the verified number
+func (h *AuthHandler) PhoneVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Phone verification received")
+
+	user := contextUser(r)
+
+	var req PhoneVerifyRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	phone, ok := h.smsCodes.verify(user.ID, smsPurposeVerifyPhone, req.Code, h.clock.Now())
+	if !ok {
+		h.logger.Printf("[DEBUG] Invalid phone verification code for: %s", user.Username)
+		http.Error(w, localize(r, "Invalid or expired code"), http.StatusBadRequest)
+		return
+	}
+
+	oldPhone := user.Phone
+	user.Phone = phone
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to store phone number for %s: %v", user.Username, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditPhoneChanged,
+		UserID:  user.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"from": oldPhone, "to": phone},
+	})
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Phone number verified"),
+		Data:    user.Sanitized(),
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Phone number verified for user: %s", user.Username)
+}
+
+// SMSTwoFactorEnableHandler turns on texted login codes for a user with a
+// verified phone. Recovery codes are issued if the user has none yet.
+func (h *AuthHandler) SMSTwoFactorEnableHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] SMS two-factor enable request received")
+
+	user := contextUser(r)
+
+	var req TwoFactorSetupRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if err := h.hasher.Compare(r.Context(), user.Password, req.Password); err != nil {
+		if h.passwordUnavailable(w, r, err) {
+			return
+		}
+		h.logger.Printf("[DEBUG] Invalid password for SMS two-factor enable: %s", user.Username)
+		http.Error(w, localize(r, "Invalid current password"), http.StatusUnauthorized)
+		return
+	}
+
+	if user.Phone == "" {
+		http.Error(w, localize(r, "Verify a phone number first"), http.StatusBadRequest)
+		return
+	}
+	if user.SMSTwoFactorEnabled {
+		http.Error(w, localize(r, "SMS codes are already enabled"), http.StatusConflict)
+		return
+	}
+
+	var codes []string
+	if len(user.RecoveryCodes) == 0 {
+		var hashes []string
+		var err error
+		codes, hashes, err = generateRecoveryCodes()
+		if err != nil {
+			h.logger.Printf("[DEBUG] Failed to generate recovery codes: %v", err)
+			http.Error(w, localize(r, "Internal server error"), http.StatusInternalServerError)
+			return
+		}
+		user.RecoveryCodes = hashes
+	}
+
+	user.SMSTwoFactorEnabled = true
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to enable SMS two-factor for %s: %v", user.Username, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditTwoFactorEnabled,
+		UserID:  user.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"method": "sms"},
+	})
+
+	if codes != nil {
+		writeRecoveryCodes(w, r, codes, "SMS codes enabled. Store your recovery codes somewhere safe")
+	} else {
+		json.NewEncoder(w).Encode(Response{Success: true, Message: localize(r, "SMS codes enabled")})
+	}
+	h.logger.Printf("[DEBUG] SMS two-factor enabled for user: %s", user.Username)
+}
+
+// SMSTwoFactorDisableHandler turns texted login codes off after checking
+// the password and a current second factor
+func (h *AuthHandler) SMSTwoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] SMS two-factor disable request received")
+
+	user := contextUser(r)
+
+	var req TwoFactorDisableRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if !user.SMSTwoFactorEnabled {
+		http.Error(w, localize(r, "SMS codes are not enabled"), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.hasher.Compare(r.Context(), user.Password, req.Password); err != nil {
+		if h.passwordUnavailable(w, r, err) {
+			return
+		}
+		h.logger.Printf("[DEBUG] Invalid password for SMS two-factor disable: %s", user.Username)
+		http.Error(w, localize(r, "Invalid current password"), http.StatusUnauthorized)
+		return
+	}
+	codes := secondFactorCodes{TOTP: req.Code, SMS: req.SMSCode, Recovery: req.RecoveryCode}
+	if _, ok := h.verifySecondFactor(user, codes, h.clock.Now()); !ok {
+		h.logger.Printf("[DEBUG] Invalid second factor for SMS two-factor disable: %s", user.Username)
+		http.Error(w, localize(r, "Invalid two-factor authentication code"), http.StatusUnauthorized)
+		return
+	}
+
+	user.SMSTwoFactorEnabled = false
+	if !user.HasTwoFactor() {
+		user.RecoveryCodes = nil
+	}
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to disable SMS two-factor for %s: %v", user.Username, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditTwoFactorDisabled,
+		UserID:  user.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"method": "sms"},
+	})
+	h.notifySecurityChange(r, user, NoticeTwoFactorDisabled, "")
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "SMS codes disabled"),
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] SMS two-factor disabled for user: %s", user.Username)
+}
+
+// SMSCodeHandler texts a code to the session user's verified phone, for
+// confirming sensitive changes such as turning SMS codes off
+func (h *AuthHandler) SMSCodeHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] SMS code request received")
+
+	user := contextUser(r)
+
+	if !user.SMSTwoFactorEnabled {
+		http.Error(w, localize(r, "SMS codes are not enabled"), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.sendSMSCode(w, r, user, user.Phone, smsPurposeLogin); err != nil {
+		h.logger.Printf("[DEBUG] Failed to send SMS code to %s: %v", user.Username, err)
+		writeSMSError(w, r, err)
+		return
+	}
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "A code has been sent to your phone"),
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
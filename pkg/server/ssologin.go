@@ -0,0 +1,640 @@
+package server
+
+import (
+	"auth-server/pkg/events"
+	"auth-server/pkg/ids"
+	"auth-server/pkg/oidc"
+	"auth-server/pkg/randutil"
+	"auth-server/pkg/saml"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// ssoLoginTTL is how long a user has to sign in at their identity
+	// provider once sent there
+	ssoLoginTTL = 10 * time.Minute
+	// ssoKeyRefreshInterval limits how often a token signed with an
+	// unknown key makes the provider's key set be fetched again
+	ssoKeyRefreshInterval = time.Minute
+	// ssoStateCookie ties a pending sign-in to the browser that started
+	// it, so a response from the identity provider cannot be replayed into
+	// someone else's browser to sign them in to the wrong account
+	ssoStateCookie = "sso_state"
+)
+
+var (
+	errSSOLoginInvalid = errors.New("sso login unknown or expired")
+	// errSSORefused is returned when a user the identity provider vouches
+	// for cannot be signed in; the reason is logged
+	errSSORefused = errors.New("sso user refused")
+)
+
+// ssoLogin is a sign-in waiting for the identity provider's answer
+type ssoLogin struct {
+	connectionID string
+	// nonce and verifier are the OIDC nonce and PKCE code verifier
+	nonce    string
+	verifier string
+	// requestID is the ID of the SAML AuthnRequest
+	requestID string
+	expiresAt time.Time
+}
+
+// ssoLoginStore holds pending sign-ins by their state
+type ssoLoginStore struct {
+	mutex   sync.Mutex
+	pending map[string]*ssoLogin
+}
+
+func newSSOLoginStore() *ssoLoginStore {
+	return &ssoLoginStore{pending: make(map[string]*ssoLogin)}
+}
+
+func (s *ssoLoginStore) add(state string, login *ssoLogin) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending[state] = login
+}
+
+// take removes and returns the pending sign-in state refers to, so each
+// answer from the identity provider is used once
+func (s *ssoLoginStore) take(state string, now time.Time) (*ssoLogin, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	login, ok := s.pending[state]
+	delete(s.pending, state)
+	if !ok || !now.Before(login.expiresAt) {
+		return nil, errSSOLoginInvalid
+	}
+	return login, nil
+}
+
+// pendingFor reports whether the browser's state cookie is state and a
+// sign-in is waiting for it
+func (s *ssoLoginStore) pendingFor(r *http.Request, state string) bool {
+	cookie, err := r.Cookie(ssoStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.pending[state]
+	return ok
+}
+
+// Purge forgets sign-ins never finished and returns how many were removed
+func (s *ssoLoginStore) Purge(now time.Time) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	purged := 0
+	for state, login := range s.pending {
+		if !now.Before(login.expiresAt) {
+			delete(s.pending, state)
+			purged++
+		}
+	}
+	return purged
+}
+
+// ssoAssertionCache remembers the SAML assertions already signed in with
+// until they expire, so one captured from a browser cannot be posted again
+type ssoAssertionCache struct {
+	mutex sync.Mutex
+	used  map[string]time.Time
+}
+
+func newSSOAssertionCache() *ssoAssertionCache {
+	return &ssoAssertionCache{used: make(map[string]time.Time)}
+}
+
+// use records the assertion id of connectionID, reporting false when it
+// was used before
+func (c *ssoAssertionCache) use(connectionID, id string, expiresAt time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := connectionID + " " + id
+	if _, ok := c.used[key]; ok {
+		return false
+	}
+	c.used[key] = expiresAt
+	return true
+}
+
+// Purge forgets assertions that can no longer be accepted and returns how
+// many were removed
+func (c *ssoAssertionCache) Purge(now time.Time) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	purged := 0
+	for key, expiresAt := range c.used {
+		if !now.Before(expiresAt) {
+			delete(c.used, key)
+			purged++
+		}
+	}
+	return purged
+}
+
+// ssoProfile is the user an identity provider vouched for. Username,
+// DisplayName and Groups are only used when provisioning and may be empty.
+type ssoProfile struct {
+	Subject     string
+	Email       string
+	Username    string
+	DisplayName string
+	Groups      []string
+}
+
+// samlProfile reads the user from a verified assertion through the
+// connection's attribute mapping. The NameID is the subject.
+func (c *SSOConnection) samlProfile(assertion *saml.Assertion) ssoProfile {
+	profile := ssoProfile{
+		Subject:     assertion.NameID,
+		Email:       assertion.Email(),
+		Username:    assertion.Attribute(c.AttributeMapping.Username),
+		DisplayName: assertion.Attribute(c.AttributeMapping.DisplayName),
+	}
+	if c.AttributeMapping.Groups != "" {
+		profile.Groups = assertion.Attributes[c.AttributeMapping.Groups]
+	}
+	if c.AttributeMapping.Email != "" {
+		profile.Email = assertion.Attribute(c.AttributeMapping.Email)
+	}
+	return profile
+}
+
+// SSOLoginRequest starts a sign-in with the identity provider of the
+// email's organization
+type SSOLoginRequest struct {
+	Email string `json:"email"`
+}
+
+// SSOLoginResponse is where to send the user to sign in
+type SSOLoginResponse struct {
+	RedirectURL  string `json:"redirectUrl"`
+	Organization string `json:"organization"`
+}
+
+// SSOLoginHandler routes a user to their organization's identity provider
+// by the domain of their email. A POST with the email answers with the URL
+// to send them to, so a login form can ask for the email first and fall
+// back to the password when the domain has no SSO connection; a GET with
+// the email in the query redirects the browser there.
+func (s *Server) SSOLoginHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] SSO login request received")
+	h := s.authHandler
+
+	var email string
+	switch r.Method {
+	case http.MethodGet:
+		email = r.URL.Query().Get("email")
+	case http.MethodPost:
+		var req SSOLoginRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+			writeBodyError(w, r, err)
+			return
+		}
+		email = req.Email
+	default:
+		s.logger.Printf("[DEBUG] Invalid method: %s", r.Method)
+		http.Error(w, localize(r, "Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	connection, ok := s.ssoConnections.forDomain(tenantOf(strings.TrimSpace(email)))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, "Single sign-on is not set up for your email domain"),
+		})
+		return
+	}
+
+	state, err := randutil.Hex(16)
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to generate SSO state: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	now := h.clock.Now()
+	login := &ssoLogin{connectionID: connection.ID, expiresAt: now.Add(ssoLoginTTL)}
+	var target string
+	if connection.Protocol == SSOProtocolSAML {
+		// Request IDs must not start with a digit
+		login.requestID = "id" + state
+		target, err = s.serviceProvider(connection).AuthnRequestURL(connection.idp, login.requestID, state, now)
+	} else {
+		login.nonce, err = randutil.Hex(16)
+		if err == nil {
+			login.verifier, err = randutil.Hex(32)
+		}
+		target = connection.provider.AuthorizationURL(oidc.AuthRequest{
+			ClientID:    connection.ClientID,
+			RedirectURI: connection.RedirectURL,
+			State:       state,
+			Nonce:       login.nonce,
+			Verifier:    login.verifier,
+			LoginHint:   email,
+			Scopes:      []string{"email", "profile"},
+		})
+	}
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to start SSO login: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	s.ssoLogins.add(state, login)
+
+	// SAML responses are posted across sites, which only carries the
+	// cookie when it is SameSite=None, and browsers drop those unless
+	// Secure
+	cookie := &http.Cookie{
+		Name:     ssoStateCookie,
+		Value:    state,
+		Path:     cookiePath(s.config.BasePath),
+		MaxAge:   int(ssoLoginTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if strings.HasPrefix(s.config.PublicURL, "https://") {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, cookie)
+
+	if r.Method == http.MethodGet {
+		http.Redirect(w, r, target, http.StatusSeeOther)
+		return
+	}
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: localize(r, "Continue signing in with your organization"),
+		Data:    SSOLoginResponse{RedirectURL: target, Organization: connection.Organization},
+	})
+	s.logger.Printf("[DEBUG] Sent user to SSO connection %s of %s", connection.ID, connection.Organization)
+}
+
+// takeSSOLogin returns the pending sign-in state refers to and its
+// connection, which must be the one the identity provider answered at,
+// and clears the state cookie. It writes the error response and returns
+// false when there is none for this browser.
+func (s *Server) takeSSOLogin(w http.ResponseWriter, r *http.Request, state string) (*ssoLogin, *SSOConnection, bool) {
+	http.SetCookie(w, &http.Cookie{Name: ssoStateCookie, Value: "", Path: cookiePath(s.config.BasePath), MaxAge: -1, HttpOnly: true})
+
+	cookie, err := r.Cookie(ssoStateCookie)
+	var login *ssoLogin
+	if err == nil && state != "" && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) == 1 {
+		login, err = s.ssoLogins.take(state, s.authHandler.clock.Now())
+	} else {
+		err = errSSOLoginInvalid
+	}
+	var connection *SSOConnection
+	if err == nil {
+		var ok bool
+		connection, ok = s.ssoConnections.get(mux.Vars(r)["id"])
+		if !ok || connection.ID != login.connectionID || connection.DisabledAt != nil {
+			err = errSSOLoginInvalid
+		}
+	}
+	if err != nil {
+		s.logger.Printf("[DEBUG] SSO answer without a pending sign-in for this browser")
+		http.Error(w, localize(r, "Your sign-in has expired, start again"), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	return login, connection, true
+}
+
+// SSOCallbackHandler finishes a sign-in at an OIDC connection: it redeems
+// the authorization code the provider sent the browser back with and
+// signs in the user its ID token names
+func (s *Server) SSOCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] SSO callback request received")
+
+	query := r.URL.Query()
+	login, connection, ok := s.takeSSOLogin(w, r, query.Get("state"))
+	if !ok {
+		return
+	}
+	if connection.Protocol != SSOProtocolOIDC {
+		http.Error(w, localize(r, "Your sign-in has expired, start again"), http.StatusBadRequest)
+		return
+	}
+
+	if code := query.Get("error"); code != "" || query.Get("code") == "" {
+		s.ssoFailed(w, r, connection, fmt.Errorf("provider answered %q: %s", code, query.Get("error_description")))
+		return
+	}
+	token, err := connection.provider.Exchange(r.Context(), s.ssoClient, connection.ClientID, connection.ClientSecret, connection.RedirectURL, query.Get("code"), login.verifier)
+	var claims oidc.IDToken
+	if err == nil {
+		claims, err = s.verifyIDToken(r.Context(), connection, token, login.nonce)
+	}
+	if err == nil && claims.Email != "" && !claims.EmailVerified {
+		err = errors.New("email is not verified by the provider")
+	}
+	if err != nil {
+		s.ssoFailed(w, r, connection, err)
+		return
+	}
+	s.logger.Printf("[DEBUG] ID token from %s verified for subject %s", connection.Issuer, claims.Subject)
+	s.finishSSOLogin(w, r, connection, ssoProfile{Subject: claims.Subject, Email: claims.Email, DisplayName: claims.Name, Groups: claims.Groups}, s.config.BasePath+"/")
+}
+
+// verifyIDToken verifies an ID token from connection's provider. Its key
+// set is fetched when none is cached, or when the token is signed with a
+// key not in it, which the provider may have rotated in.
+func (s *Server) verifyIDToken(ctx context.Context, connection *SSOConnection, token, nonce string) (oidc.IDToken, error) {
+	now := s.authHandler.clock.Now()
+	verifier := oidc.Verifier{Issuer: connection.Issuer, ClientID: connection.ClientID, Keys: connection.keys, MaxSkew: s.config.SSOMaxSkew}
+	claims, err := verifier.Verify(token, nonce, now)
+	if !errors.Is(err, oidc.ErrUnknownKey) || now.Sub(connection.keysFetchedAt) < ssoKeyRefreshInterval {
+		return claims, err
+	}
+
+	keys, err := oidc.FetchKeys(ctx, s.ssoClient, connection.provider)
+	if err != nil {
+		return oidc.IDToken{}, err
+	}
+	s.ssoConnections.update(connection.ID, func(stored *SSOConnection) error {
+		stored.keys, stored.keysFetchedAt = keys, now
+		return nil
+	})
+	verifier.Keys = keys
+	return verifier.Verify(token, nonce, now)
+}
+
+// SSOAssertionHandler is the assertion consumer service of a SAML
+// connection: it verifies the response the identity provider posted
+// through the browser and signs in the user it names. A response to a
+// sign-in started here carries its state as RelayState; on connections
+// that allow it, any other is taken as IdP-initiated, and its RelayState,
+// when a path on this site, is where the user is sent afterwards.
+func (s *Server) SSOAssertionHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] SSO assertion request received")
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSSOMetadataSize)
+	relayState := r.PostFormValue("RelayState")
+
+	requestID := ""
+	target := s.config.BasePath + "/"
+	connection, ok := s.ssoConnections.get(mux.Vars(r)["id"])
+	if ok && connection.AllowIdPInitiated && connection.DisabledAt == nil && !s.ssoLogins.pendingFor(r, relayState) {
+		if relayState != "" && localReturnTo(relayState) == relayState {
+			target = relayState
+		}
+		s.logger.Printf("[DEBUG] IdP-initiated SAML response at %s", connection.ID)
+	} else {
+		var login *ssoLogin
+		if login, connection, ok = s.takeSSOLogin(w, r, relayState); !ok {
+			return
+		}
+		requestID = login.requestID
+	}
+	if connection.Protocol != SSOProtocolSAML {
+		http.Error(w, localize(r, "Your sign-in has expired, start again"), http.StatusBadRequest)
+		return
+	}
+
+	assertion, err := s.serviceProvider(connection).ParseResponse(connection.idp, r.PostFormValue("SAMLResponse"), requestID, s.authHandler.clock.Now())
+	if err == nil && !s.ssoAssertions.use(connection.ID, assertion.ID, assertion.ExpiresAt) {
+		err = fmt.Errorf("assertion %s was already used", assertion.ID)
+	}
+	if err != nil {
+		s.ssoFailed(w, r, connection, err)
+		return
+	}
+	s.logger.Printf("[DEBUG] SAML assertion from %s verified for %s", connection.EntityID, assertion.NameID)
+	s.finishSSOLogin(w, r, connection, connection.samlProfile(assertion), target)
+}
+
+// SSOServiceProviderMetadataHandler serves this server's SAML metadata for
+// a connection, to set it up at the organization's identity provider
+func (s *Server) SSOServiceProviderMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] SSO service provider metadata request received")
+
+	connection, ok := s.ssoConnections.get(mux.Vars(r)["id"])
+	if !ok || connection.Protocol != SSOProtocolSAML {
+		http.Error(w, localize(r, "SSO connection not found"), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(s.serviceProvider(connection).Metadata())
+}
+
+// ssoFailed answers a sign-in the identity provider refused or whose
+// answer did not verify
+func (s *Server) ssoFailed(w http.ResponseWriter, r *http.Request, connection *SSOConnection, err error) {
+	s.logger.Printf("[DEBUG] SSO sign-in at %s failed: %v", connection.ID, err)
+	s.audit.Record(AuditEvent{
+		Type:    AuditLoginFailed,
+		IP:      clientIP(r),
+		Details: map[string]string{"method": "sso", "connection": connection.ID, "reason": err.Error()},
+	})
+	http.Error(w, localize(r, "Your organization's identity provider could not sign you in"), http.StatusUnauthorized)
+}
+
+// finishSSOLogin signs in the user the identity provider vouched for and
+// sends the browser to target
+func (s *Server) finishSSOLogin(w http.ResponseWriter, r *http.Request, connection *SSOConnection, profile ssoProfile, target string) {
+	h := s.authHandler
+	ip := clientIP(r)
+	if block, blocked := h.bruteForce.blocked(ip, h.clock.Now()); blocked {
+		s.logger.Printf("[DEBUG] SSO login refused from blocked address %s", ip)
+		writeIPBlocked(w, r, block)
+		return
+	}
+
+	user, err := s.userForSSO(r, connection, profile)
+	if errors.Is(err, errSSORefused) || errors.Is(err, ErrIdentityConflict) {
+		h.audit.Record(AuditEvent{
+			Type:    AuditLoginBlocked,
+			IP:      ip,
+			Details: map[string]string{"reason": "sso user cannot be signed in", "connection": connection.ID, "subject": profile.Subject},
+		})
+		http.Error(w, localize(r, "Your account could not be set up, contact an administrator"), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		s.logger.Printf("[DEBUG] Failed to find account for SSO subject %s: %v", profile.Subject, err)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if user.HasTwoFactor() {
+		s.logger.Printf("[DEBUG] SSO login refused for two-factor account: %s", user.Username)
+		http.Error(w, localize(r, "Sign in with your password and authentication code"), http.StatusForbidden)
+		return
+	}
+
+	if len(pendingDocuments(user, h.legalDocuments())) > 0 {
+		s.logger.Printf("[DEBUG] SSO login refused pending terms acceptance: %s", user.Username)
+		http.Error(w, localize(r, "Sign in with your password to accept the updated terms"), http.StatusForbidden)
+		return
+	}
+
+	if err := h.hooks.runPreLogin(r.Context(), user.Username, ip); err != nil {
+		status, message := s.authHandler.hookRejection(err)
+		s.logger.Printf("[DEBUG] SSO login rejected by pre-login hook: %s", message)
+		http.Error(w, localize(r, message), status)
+		return
+	}
+
+	if _, ok := h.completeLogin(w, r, user, ip, "sso", false, SessionTransportCookie); !ok {
+		return
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+	s.logger.Printf("[DEBUG] User logged in through SSO connection %s: %s", connection.ID, user.Username)
+}
+
+// userForSSO returns the account the identity provider's subject signs in
+// to. Once linked that is found by the subject. Otherwise the email must
+// be at one of the connection's domains: an account with it is linked when
+// it has proven the address is its own, and without one a new account is
+// provisioned when the connection allows it.
+func (s *Server) userForSSO(r *http.Request, connection *SSOConnection, profile ssoProfile) (*User, error) {
+	h := s.authHandler
+	ctx := r.Context()
+	provider := connection.identityProvider()
+	subject := profile.Subject
+
+	user, err := h.userByIdentity(ctx, provider, subject)
+	if !errors.Is(err, ErrUserNotFound) {
+		return user, err
+	}
+
+	email := strings.ToLower(strings.TrimSpace(profile.Email))
+	if !slices.Contains(connection.Domains, tenantOf(email)) {
+		s.logger.Printf("[DEBUG] SSO email %q is not at a domain of connection %s", email, connection.ID)
+		return nil, errSSORefused
+	}
+
+	existing, err := h.users.GetByEmail(ctx, email)
+	if err == nil {
+		if existing.EmailVerifiedAt == nil {
+			s.logger.Printf("[DEBUG] SSO email matches unverified account %s", existing.Username)
+			return nil, ErrIdentityConflict
+		}
+		if _, err := s.LinkIdentity(ctx, existing.ID, Identity{Provider: provider, Subject: subject}); err != nil {
+			return nil, err
+		}
+		return h.users.Get(ctx, existing.ID)
+	}
+	if !errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	}
+
+	if !connection.JITProvisioning {
+		s.logger.Printf("[DEBUG] No account for %s and connection %s does not provision", email, connection.ID)
+		return nil, errSSORefused
+	}
+	profile.Email = email
+	return s.provisionSSOUser(r, connection, profile)
+}
+
+// maxSSOUsernameAttempts is how many numbered usernames are tried when
+// the email's local part is taken
+const maxSSOUsernameAttempts = 10
+
+// provisionSSOUser creates the account of an organization member signing
+// in for the first time, linked to the identity provider's subject. The
+// username is the one the provider sent, or else the email's local part,
+// numbered when another organization has it. Accounts start with the user
+// role whatever name the provider asserts, since any organization's
+// provider can assert any name; the provisioning rules may refuse the user
+// or set their role and organization.
+func (s *Server) provisionSSOUser(r *http.Request, connection *SSOConnection, profile ssoProfile) (*User, error) {
+	h := s.authHandler
+	ctx := r.Context()
+	email := profile.Email
+
+	base := profile.Username
+	if base == "" {
+		base, _, _ = strings.Cut(email, "@")
+	}
+	if err := h.checkUsername(base); err != nil {
+		s.logger.Printf("[DEBUG] SSO username %q rejected by policy: %v", base, err)
+		return nil, errSSORefused
+	}
+	username := ""
+	for attempt := 1; attempt <= maxSSOUsernameAttempts && username == ""; attempt++ {
+		candidate := base
+		if attempt > 1 {
+			candidate = fmt.Sprintf("%s%d", base, attempt)
+		}
+		taken, err := h.usernameTaken(ctx, "", candidate)
+		if err != nil {
+			return nil, err
+		}
+		if !taken {
+			username = candidate
+		}
+	}
+	if username == "" {
+		s.logger.Printf("[DEBUG] No free username for %s", email)
+		return nil, errSSORefused
+	}
+
+	now := h.clock.Now()
+	user := &User{
+		ID:              h.idGenerator.NewID(ids.PrefixUser),
+		Username:        username,
+		Email:           email,
+		Role:            RoleUser,
+		Created:         now,
+		UpdatedAt:       now,
+		EmailVerifiedAt: &now,
+		APISecret:       generateAPISecret(),
+		Locale:          requestLocale(r),
+		Preferences:     defaultNotificationPreferences(),
+		Identities: []Identity{{
+			ID:       h.idGenerator.NewID(ids.PrefixIdentity),
+			Provider: connection.identityProvider(),
+			Subject:  profile.Subject,
+			LinkedAt: now,
+		}},
+	}
+	if message := applyProfileFields(user, UpdateProfileRequest{DisplayName: &profile.DisplayName}); message != "" {
+		s.logger.Printf("[DEBUG] Ignoring SSO display name of %s: %s", username, message)
+	}
+	rule, err := h.applyProvisioningRules(user, externalUser{
+		Provider:     connection.identityProvider(),
+		Subject:      profile.Subject,
+		Email:        email,
+		Username:     username,
+		Organization: connection.Organization,
+		Groups:       profile.Groups,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errSSORefused, err)
+	}
+	if err := h.users.Create(ctx, user); err != nil {
+		return nil, err
+	}
+
+	details := map[string]string{"provider": connection.identityProvider(), "identity": user.Identities[0].ID, "provisioned": "true", "role": user.Role}
+	if rule != "" {
+		details["rule"] = rule
+	}
+	h.audit.Record(AuditEvent{Type: AuditIdentityLinked, UserID: user.ID, IP: clientIP(r), Details: details})
+	h.publishEvent(events.TypeUserRegistered, user.ID, map[string]string{"username": user.Username})
+	h.hooks.runPostRegister(ctx, user.Sanitized())
+	s.logger.Printf("[DEBUG] Provisioned %s into %s through SSO", user.Username, connection.Organization)
+	return user, nil
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"auth-server/static"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// apiPathPrefixes are paths owned by the API. Unknown paths under them 404
+// instead of falling back to the frontend.
+var apiPathPrefixes = []string{"/api/", "/oauth/", "/.well-known/", "/metrics"}
+
+// Cache-Control values for the frontend. index.html is revalidated on every
+// load so new deployments are picked up; assets referenced with a ?v=
+// version are cached for good, and the rest for an hour.
+const (
+	cacheIndex     = "no-cache"
+	cacheVersioned = "public, max-age=31536000, immutable"
+	cacheAsset     = "public, max-age=3600"
+)
+
+// spaHandler serves the single-page frontend. Paths that match no file get
+// index.html so client-side routes load the app.
+type spaHandler struct {
+	files fs.FS
+	// basePath is written into index.html as its <base>, which the
+	// frontend's relative links and API calls resolve against
+	basePath string
+	logger   *log.Logger
+}
+
+// staticFiles returns the frontend files, from Config.StaticDir when set and
+// the embedded copy otherwise
+func (s *Server) staticFiles() fs.FS {
+	if s.config.StaticDir != "" {
+		s.logger.Printf("[DEBUG] Serving frontend from %s", s.config.StaticDir)
+		return os.DirFS(s.config.StaticDir)
+	}
+	return static.Files
+}
+
+func (h *spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "index.html"
+	}
+
+	data, err := fs.ReadFile(h.files, name)
+	if err != nil {
+		// Missing assets are real 404s; anything else is assumed to be a
+		// client-side route
+		if path.Ext(name) != "" {
+			http.NotFound(w, r)
+			return
+		}
+		name = "index.html"
+		if data, err = fs.ReadFile(h.files, name); err != nil {
+			h.logger.Printf("[DEBUG] Frontend index.html missing: %v", err)
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	switch {
+	case name == "index.html":
+		w.Header().Set("Cache-Control", cacheIndex)
+		base := fmt.Sprintf("<head>\n    <base href=\"%s/\">", html.EscapeString(h.basePath))
+		data = bytes.Replace(data, []byte("<head>"), []byte(base), 1)
+	case r.URL.Query().Has("v"):
+		w.Header().Set("Cache-Control", cacheVersioned)
+	default:
+		w.Header().Set("Cache-Control", cacheAsset)
+	}
+
+	// Embedded files have no modification time, so validate with a content
+	// hash; ServeContent answers If-None-Match with 304
+	sum := sha256.Sum256(data)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
+
+// isAPIPath reports whether urlPath belongs to the API rather than the
+// frontend
+func isAPIPath(urlPath string) bool {
+	for _, prefix := range apiPathPrefixes {
+		if strings.HasPrefix(urlPath, prefix) || urlPath == strings.TrimSuffix(prefix, "/") {
+			return true
+		}
+	}
+	return false
+}
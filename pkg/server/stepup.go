@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// StepUpPolicy is the authentication strength a route requires of the
+// session making the request. The zero policy accepts any session.
+type StepUpPolicy struct {
+	// MultiFactor requires a second factor to have been verified at login
+	// or by re-authenticating
+	MultiFactor bool
+	// MaxAge requires the password to have been entered this recently;
+	// zero accepts any time during the session
+	MaxAge time.Duration
+}
+
+// stepUpExempt are the routes a session needs to satisfy a policy, so
+// they are never subject to one
+var stepUpExempt = map[string]bool{
+	"/api/reauth":       true,
+	"/api/logout":       true,
+	"/api/2fa/sms/send": true,
+}
+
+// stepUpPolicyFor looks up the policy for a route. A policy for the method
+// and path wins over one for the path alone, and exact paths win over
+// "/*" prefixes, the longest prefix first.
+func stepUpPolicyFor(policies map[string]StepUpPolicy, method, template string) (StepUpPolicy, bool) {
+	if len(policies) == 0 || stepUpExempt[template] {
+		return StepUpPolicy{}, false
+	}
+
+	candidates := []string{template}
+	for path := template; path != ""; {
+		path = path[:strings.LastIndex(path, "/")]
+		candidates = append(candidates, path+"/*")
+	}
+	for _, candidate := range candidates {
+		if policy, ok := policies[method+" "+candidate]; ok {
+			return policy, true
+		}
+		if policy, ok := policies[candidate]; ok {
+			return policy, true
+		}
+	}
+	return StepUpPolicy{}, false
+}
+
+// stepUpMiddleware enforces Config.StepUpPolicies on session requests.
+// Requests without a session are passed on for the handler to reject, and
+// requests authenticated by other means are not affected.
+func (s *Server) stepUpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		policy, ok := stepUpPolicyFor(s.config.StepUpPolicies, r.Method, template)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := s.authHandler
+		record, err := h.sessionRecord(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var message string
+		switch {
+		case policy.MultiFactor && !record.MultiFactor:
+			user, err := h.users.Get(r.Context(), record.UserID)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			message = "Confirm with your two-factor authentication code to continue"
+			if !user.HasTwoFactor() {
+				message = "Enable two-factor authentication to perform this action"
+			}
+		case policy.MaxAge > 0 && h.clock.Now().Sub(record.AuthenticatedAt) > policy.MaxAge:
+			message = "Please confirm your password to continue"
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		s.logger.Printf("[DEBUG] Step-up authentication required for %s %s", r.Method, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: localize(r, message),
+			Data: map[string]interface{}{
+				"stepUpRequired": true,
+				"multiFactor":    policy.MultiFactor,
+				"maxAge":         int(policy.MaxAge.Seconds()),
+			},
+		})
+	})
+}
+
+// ReauthHandler confirms the session user's password, and optionally a
+// second factor, so the session satisfies step-up policies again
+func (h *AuthHandler) ReauthHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Re-authentication request received")
+
+	record, err := h.sessionRecord(r)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Session lookup failed: %v", err)
+		writeSessionError(w, r, err)
+		return
+	}
+	user, err := h.users.Get(r.Context(), record.UserID)
+	if err != nil {
+		h.logger.Printf("[DEBUG] Session lookup failed: %v", err)
+		if errors.Is(err, ErrUserNotFound) {
+			err = errSessionUserNotFound
+		}
+		writeSessionError(w, r, err)
+		return
+	}
+
+	var req ReauthRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	ip := clientIP(r)
+	if err := h.hasher.Compare(r.Context(), user.Password, req.Password); err != nil {
+		if h.passwordUnavailable(w, r, err) {
+			return
+		}
+		h.logger.Printf("[DEBUG] Invalid password for re-authentication: %s", user.Username)
+		h.recordLoginFailure(user.Username, ip)
+		h.audit.Record(AuditEvent{
+			Type:    AuditLoginFailed,
+			UserID:  user.ID,
+			IP:      ip,
+			Details: map[string]string{"username": user.Username, "reason": "invalid password on re-authentication"},
+		})
+		http.Error(w, localize(r, "Invalid current password"), http.StatusUnauthorized)
+		return
+	}
+
+	multiFactor := record.MultiFactor
+	codes := secondFactorCodes{TOTP: req.Code, SMS: req.SMSCode, Recovery: req.RecoveryCode}
+	if !codes.empty() {
+		usedRecoveryCode, ok := h.verifySecondFactor(user, codes, h.clock.Now())
+		if !ok {
+			h.logger.Printf("[DEBUG] Invalid second factor for re-authentication: %s", user.Username)
+			h.recordLoginFailure(user.Username, ip)
+			http.Error(w, localize(r, "Invalid two-factor authentication code"), http.StatusUnauthorized)
+			return
+		}
+		if err := h.users.Update(r.Context(), user); err != nil {
+			h.logger.Printf("[DEBUG] Failed to store second factor use for %s: %v", user.Username, err)
+			writeStoreError(w, r, err)
+			return
+		}
+		if usedRecoveryCode {
+			h.audit.Record(AuditEvent{
+				Type:    AuditRecoveryCodeUsed,
+				UserID:  user.ID,
+				IP:      ip,
+				Details: map[string]string{"remaining": fmt.Sprint(len(user.RecoveryCodes))},
+			})
+		}
+		multiFactor = true
+	}
+
+	// The session gains privileges, so it gets a new ID
+	record.AuthenticatedAt = h.clock.Now()
+	record.MultiFactor = multiFactor
+	record, bearer, ok := h.rotateSession(w, r, record)
+	if !ok {
+		// Logged out while we were checking
+		writeSessionError(w, r, errNoSession)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditReauthenticated,
+		UserID:  user.ID,
+		IP:      ip,
+		Details: map[string]string{"multiFactor": strconv.FormatBool(multiFactor)},
+	})
+
+	data := map[string]interface{}{
+		"authenticatedAt": record.AuthenticatedAt,
+		"multiFactor":     multiFactor,
+	}
+	if bearer != "" {
+		// The old token stopped working with the old session ID
+		data["access_token"] = bearer
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	response := Response{
+		Success: true,
+		Message: localize(r, "Authentication confirmed"),
+		Data:    data,
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] User re-authenticated: %s", user.Username)
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"auth-server/pkg/account"
+	"auth-server/pkg/sessionstore"
+)
+
+// ErrUserNotFound and ErrVersionConflict are the errors UserStore
+// implementations return; see package account
+var (
+	ErrUserNotFound    = account.ErrUserNotFound
+	ErrVersionConflict = account.ErrVersionConflict
+)
+
+// UserStore persists user accounts; see account.UserStore
+type UserStore = account.UserStore
+
+// SessionManager keeps the server-side sessions of the stored session
+// mode; see sessionstore.Manager
+type SessionManager = sessionstore.Manager
+
+// NewMemoryUserStore creates an empty in-memory user store
+func NewMemoryUserStore() UserStore {
+	return account.NewMemoryStore()
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"auth-server/pkg/events"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// accountSuspendedError is the error code sent to suspended users, so
+// clients can show the suspension rather than a generic failure
+const accountSuspendedError = "account_suspended"
+
+var errSuspendSelf = errors.New("admins cannot suspend themselves")
+
+// SuspendUserRequest suspends a user. Without ExpiresAt the suspension is
+// a permanent ban.
+type SuspendUserRequest struct {
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// suspendAccount suspends user and signs them out everywhere. Suspending a
+// suspended user replaces their suspension.
+func (h *AuthHandler) suspendAccount(ctx context.Context, user *User, by string, req SuspendUserRequest) error {
+	if user.ID == by {
+		return errSuspendSelf
+	}
+
+	now := h.clock.Now()
+	previous := user.Suspension
+	user.Suspension = &AccountSuspension{At: now, By: by, Reason: req.Reason, ExpiresAt: req.ExpiresAt}
+	user.UpdatedAt = now
+	if err := h.users.Update(ctx, user); err != nil {
+		user.Suspension = previous
+		return err
+	}
+
+	if _, err := h.revokeUserSessions(ctx, user.ID); err != nil {
+		h.logger.Printf("[DEBUG] Failed to revoke sessions of suspended account %s: %v", user.ID, err)
+	}
+	h.publishEvent(events.TypeUserSuspended, user.ID, map[string]string{"reason": req.Reason})
+	return nil
+}
+
+// writeAccountSuspended refuses a suspended user with the
+// account_suspended error, saying why, until when and whom to appeal to
+func (h *AuthHandler) writeAccountSuspended(w http.ResponseWriter, r *http.Request, suspension *AccountSuspension) {
+	data := map[string]interface{}{
+		"error":  accountSuspendedError,
+		"reason": suspension.Reason,
+	}
+	if suspension.ExpiresAt != nil {
+		data["expiresAt"] = suspension.ExpiresAt
+	}
+	if h.config.SuspensionAppealContact != "" {
+		data["appealContact"] = h.config.SuspensionAppealContact
+	}
+
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(Response{
+		Success: false,
+		Message: localize(r, "This account has been suspended"),
+		Data:    data,
+	})
+}
+
+// AdminSuspendHandler lets admins suspend a user with a reason and an
+// optional expiry. The user is signed out everywhere and cannot sign in
+// until the suspension expires or is lifted.
+func (h *AuthHandler) AdminSuspendHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Account suspension request received")
+
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req SuspendUserRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, localize(r, "A reason is required"), http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(h.clock.Now()) {
+		http.Error(w, localize(r, "The expiry must be in the future"), http.StatusBadRequest)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	user, err := h.users.Get(r.Context(), id)
+	if err == nil && user.Role == RoleAdmin && admin.Role != RoleAdmin {
+		http.Error(w, localize(r, "Only admins can suspend an admin"), http.StatusForbidden)
+		return
+	}
+	if err == nil {
+		err = h.suspendAccount(r.Context(), user, admin.ID, req)
+	}
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		http.Error(w, localize(r, "User not found"), http.StatusNotFound)
+		return
+	case errors.Is(err, errSuspendSelf):
+		http.Error(w, localize(r, "You cannot suspend your own account"), http.StatusBadRequest)
+		return
+	case err != nil:
+		h.logger.Printf("[DEBUG] Failed to suspend account %s: %v", id, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	details := map[string]string{"target": user.ID, "reason": req.Reason}
+	if req.ExpiresAt != nil {
+		details["expiresAt"] = req.ExpiresAt.Format(time.RFC3339)
+	}
+	h.audit.Record(AuditEvent{
+		Type:    AuditAccountSuspended,
+		UserID:  admin.ID,
+		IP:      clientIP(r),
+		Details: details,
+	})
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Account suspended"),
+		Data:    user.Suspension,
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Account suspended: %s", user.Username)
+}
+
+// AdminUnsuspendHandler lets admins lift a user's suspension early
+func (h *AuthHandler) AdminUnsuspendHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Account unsuspension request received")
+
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	user, err := h.users.Get(r.Context(), id)
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, localize(r, "User not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("[DEBUG] User lookup failed: %v", err)
+		writeStoreError(w, r, err)
+		return
+	}
+	if !user.Suspension.ActiveAt(h.clock.Now()) {
+		http.Error(w, localize(r, "The account is not suspended"), http.StatusConflict)
+		return
+	}
+
+	user.Suspension = nil
+	user.UpdatedAt = h.clock.Now()
+	if user.Dormancy != nil && user.Dormancy.DeactivatedAt != nil {
+		// Give the owner a fresh dormancy period to sign in
+		reactivated := user.UpdatedAt
+		user.Dormancy = &AccountDormancy{ReactivatedAt: &reactivated}
+	}
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to lift suspension of %s: %v", id, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditAccountUnsuspended,
+		UserID:  admin.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"target": user.ID},
+	})
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Suspension lifted"),
+		Data:    user.Sanitized(),
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// timeoutMiddleware gives each request a deadline on its context. The
+// route's entry in Config.EndpointTimeouts, keyed by path template, takes
+// precedence over Config.RequestTimeout; a zero timeout means none.
+// Handlers pass the context on to stores and the mailer, which stop once
+// it expires, and the handler then answers 503.
+func (s *Server) timeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := s.config.RequestTimeout
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				if override, ok := s.config.EndpointTimeouts[template]; ok {
+					timeout = override
+				}
+			}
+		}
+
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			s.logger.Printf("[DEBUG] Request exceeded its %s deadline: %s %s", timeout, r.Method, r.URL.Path)
+		}
+	})
+}
+
+// isContextError reports whether err comes from a cancelled or expired
+// request context
+func isContextError(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// storeErrorStatus maps an error from a store, mailer, password hashing
+// or session revocation call to the status and untranslated message returned to the client
+func storeErrorStatus(err error) (int, string) {
+	if isContextError(err) {
+		return http.StatusServiceUnavailable, "Request timed out"
+	}
+	if errors.Is(err, errPasswordHashBusy) {
+		return http.StatusServiceUnavailable, "The server is busy, please try again shortly"
+	}
+	if errors.Is(err, errSessionsUnavailable) {
+		return http.StatusServiceUnavailable, "Sessions are temporarily unavailable, please try again shortly"
+	}
+	if errors.Is(err, ErrVersionConflict) {
+		return http.StatusConflict, versionConflictMessage
+	}
+	return http.StatusInternalServerError, "Internal server error"
+}
+
+// writeStoreError writes the response for a failed store, mailer or
+// password hashing call
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	setBusyRetryAfter(w, err)
+	status, message := storeErrorStatus(err)
+	http.Error(w, localize(r, message), status)
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"auth-server/pkg/events"
+	"auth-server/pkg/ids"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// errTrustedHeaderRefused is returned when a proxy-authenticated user
+// cannot be given an account here; the reason is logged
+var errTrustedHeaderRefused = errors.New("trusted header user refused")
+
+// trustedUpstream reports whether r came straight from a proxy allowed to
+// vouch for users: one in Config.TrustedHeaderProxies, or a local proxy on
+// the unix socket. Forwarding headers are ignored, since any client can
+// send them.
+func (s *Server) trustedUpstream(r *http.Request) bool {
+	if local, _ := r.Context().Value(localConnKey{}).(bool); local {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range s.config.TrustedHeaderProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedHeaderMiddleware signs in the user an SSO proxy such as
+// oauth2-proxy or Pomerium vouches for in Config.TrustedHeaderUser, creating
+// their account on first sight, and hands the request on with the new
+// session. The proxy's user is the subject of a linked identity, so local
+// accounts cannot be claimed by someone the proxy calls by their name or
+// email. Requests from anywhere else have the headers removed.
+func (s *Server) trustedHeaderMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.config.TrustedHeaderAuth {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !s.trustedUpstream(r) {
+			if r.Header.Get(s.config.TrustedHeaderUser) != "" {
+				s.logger.Printf("[DEBUG] Ignoring %s from untrusted peer %s", s.config.TrustedHeaderUser, r.RemoteAddr)
+			}
+			r.Header.Del(s.config.TrustedHeaderUser)
+			r.Header.Del(s.config.TrustedHeaderEmail)
+			r.Header.Del(s.config.TrustedHeaderGroups)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		subject := strings.TrimSpace(r.Header.Get(s.config.TrustedHeaderUser))
+		if subject == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := s.authHandler
+		provider := s.config.TrustedHeaderProvider
+		// Keep the session while it belongs to the user the proxy names
+		if record, err := h.sessionRecord(r); err == nil {
+			if user, err := h.users.Get(r.Context(), record.UserID); err == nil && user.FindIdentity(provider, subject) >= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		user, err := h.userByIdentity(r.Context(), provider, subject)
+		if errors.Is(err, ErrUserNotFound) {
+			user, err = s.provisionTrustedUser(r, subject, strings.TrimSpace(r.Header.Get(s.config.TrustedHeaderEmail)))
+		}
+		if errors.Is(err, errTrustedHeaderRefused) || errors.Is(err, ErrIdentityConflict) {
+			h.audit.Record(AuditEvent{
+				Type:    AuditLoginBlocked,
+				IP:      clientIP(r),
+				Details: map[string]string{"reason": "proxy user cannot be provisioned", "provider": provider, "subject": subject},
+			})
+			http.Error(w, localize(r, "Your account could not be set up, contact an administrator"), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			s.logger.Printf("[DEBUG] Failed to find proxy user %s: %v", subject, err)
+			writeStoreError(w, r, err)
+			return
+		}
+
+		// The cookie transport also stores the session in the request's
+		// cached cookie session, so handlers further on see the user
+		if _, ok := h.completeLogin(w, r, user, clientIP(r), "trusted_header", false, SessionTransportCookie); !ok {
+			return
+		}
+		s.logger.Printf("[DEBUG] Signed in %s vouched for by the SSO proxy", user.Username)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// provisionTrustedUser creates the account for a user the SSO proxy vouches
+// for, linked to them by subject. The username is the subject, or its local
+// part when it is an email. An email already used by a local account is a
+// conflict: that account must link the identity itself. Accounts start
+// with the user role whatever subject the proxy names; the provisioning
+// rules may refuse the user or set their role and organization.
+func (s *Server) provisionTrustedUser(r *http.Request, subject, email string) (*User, error) {
+	h := s.authHandler
+	ctx := r.Context()
+
+	if email == "" {
+		s.logger.Printf("[DEBUG] SSO proxy sent no %s for %s", s.config.TrustedHeaderEmail, subject)
+		return nil, errTrustedHeaderRefused
+	}
+	if _, err := s.UserForIdentity(ctx, s.config.TrustedHeaderProvider, subject, email); !errors.Is(err, ErrUserNotFound) {
+		if err == nil {
+			// Linked since the caller looked
+			return h.userByIdentity(ctx, s.config.TrustedHeaderProvider, subject)
+		}
+		return nil, err
+	}
+
+	username, _, _ := strings.Cut(subject, "@")
+	if err := h.checkUsername(username); err != nil {
+		s.logger.Printf("[DEBUG] Proxy username %q rejected by policy: %v", username, err)
+		return nil, errTrustedHeaderRefused
+	}
+	if taken, err := h.usernameTaken(ctx, "", username); err != nil {
+		return nil, err
+	} else if taken {
+		s.logger.Printf("[DEBUG] Proxy username %q belongs to another account", username)
+		return nil, errTrustedHeaderRefused
+	}
+
+	now := h.clock.Now()
+	user := &User{
+		ID:              h.idGenerator.NewID(ids.PrefixUser),
+		Username:        username,
+		Email:           strings.ToLower(email),
+		Role:            RoleUser,
+		Created:         now,
+		UpdatedAt:       now,
+		EmailVerifiedAt: &now,
+		APISecret:       generateAPISecret(),
+		Locale:          requestLocale(r),
+		Preferences:     defaultNotificationPreferences(),
+		Identities: []Identity{{
+			ID:       h.idGenerator.NewID(ids.PrefixIdentity),
+			Provider: s.config.TrustedHeaderProvider,
+			Subject:  subject,
+			LinkedAt: now,
+		}},
+	}
+	var groups []string
+	for _, group := range strings.Split(r.Header.Get(s.config.TrustedHeaderGroups), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	rule, err := h.applyProvisioningRules(user, externalUser{
+		Provider: s.config.TrustedHeaderProvider,
+		Subject:  subject,
+		Email:    user.Email,
+		Username: username,
+		Groups:   groups,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errTrustedHeaderRefused, err)
+	}
+	if err := h.users.Create(ctx, user); err != nil {
+		return nil, err
+	}
+
+	details := map[string]string{"provider": s.config.TrustedHeaderProvider, "identity": user.Identities[0].ID, "provisioned": "true", "role": user.Role}
+	if rule != "" {
+		details["rule"] = rule
+	}
+	h.audit.Record(AuditEvent{Type: AuditIdentityLinked, UserID: user.ID, IP: clientIP(r), Details: details})
+	h.publishEvent(events.TypeUserRegistered, user.ID, map[string]string{"username": user.Username})
+	h.hooks.runPostRegister(ctx, user.Sanitized())
+	s.logger.Printf("[DEBUG] Provisioned %s for the SSO proxy", user.Username)
+	return user, nil
+}
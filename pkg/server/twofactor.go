@@ -0,0 +1,374 @@
+package server
+
+import (
+	"auth-server/pkg/randutil"
+	"auth-server/pkg/totp"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// recoveryCodeCount is how many recovery codes are issued at a time
+	recoveryCodeCount = 10
+	// totpSkew is how many 30 second steps of clock drift are tolerated
+	totpSkew = 1
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateRecoveryCodes returns a new set of recovery codes, formatted for
+// the user as "xxxxx-xxxxx", and the hashes to store
+func generateRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b, err := randutil.Bytes(7)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))[:10]
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code for storage. Case, spaces and
+// dashes are ignored so codes can be typed back however they were written
+// down. The codes carry 50 random bits, so a fast hash is enough.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// secondFactorCodes are the codes a client supplied as a second factor
+type secondFactorCodes struct {
+	TOTP     string
+	SMS      string
+	Recovery string
+}
+
+func (c secondFactorCodes) empty() bool {
+	return c.TOTP == "" && c.SMS == "" && c.Recovery == ""
+}
+
+// verifySecondFactor checks the supplied codes against the user's enabled
+// second factors. A used recovery or SMS code is consumed and the TOTP
+// step is recorded so none can be replayed; the caller must store user
+// afterwards.
+func (h *AuthHandler) verifySecondFactor(user *User, codes secondFactorCodes, now time.Time) (usedRecoveryCode, ok bool) {
+	if codes.TOTP != "" && user.TwoFactorEnabled {
+		if step, valid := totp.Validate(user.TOTPSecret, codes.TOTP, now, totpSkew); valid && step > user.TOTPLastStep {
+			user.TOTPLastStep = step
+			return false, true
+		}
+	}
+
+	if codes.SMS != "" && user.SMSTwoFactorEnabled {
+		if _, valid := h.smsCodes.verify(user.ID, smsPurposeLogin, codes.SMS, now); valid {
+			return false, true
+		}
+	}
+
+	if codes.Recovery != "" {
+		hash := hashRecoveryCode(codes.Recovery)
+		for i, stored := range user.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+				// Build a new slice; the store's copy shares the old one
+				remaining := make([]string, 0, len(user.RecoveryCodes)-1)
+				remaining = append(remaining, user.RecoveryCodes[:i]...)
+				user.RecoveryCodes = append(remaining, user.RecoveryCodes[i+1:]...)
+				return true, true
+			}
+		}
+	}
+	return false, false
+}
+
+// TwoFactorStatusHandler reports whether the session user has two-factor
+// authentication enabled and how many recovery codes they have left
+func (h *AuthHandler) TwoFactorStatusHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Two-factor status request received")
+
+	user := contextUser(r)
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Two-factor status retrieved successfully"),
+		Data: map[string]interface{}{
+			"enabled":                user.TwoFactorEnabled,
+			"smsEnabled":             user.SMSTwoFactorEnabled,
+			"phone":                  user.Phone,
+			"recoveryCodesRemaining": len(user.RecoveryCodes),
+		},
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// TwoFactorSetupHandler starts enrollment by generating a TOTP secret for
+// the session user. Two-factor authentication is only turned on once a
+// code from the authenticator app is confirmed with TwoFactorEnableHandler.
+func (h *AuthHandler) TwoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Two-factor setup request received")
+
+	user := contextUser(r)
+
+	var req TwoFactorSetupRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if err := h.hasher.Compare(r.Context(), user.Password, req.Password); err != nil {
+		if h.passwordUnavailable(w, r, err) {
+			return
+		}
+		h.logger.Printf("[DEBUG] Invalid password for two-factor setup: %s", user.Username)
+		http.Error(w, localize(r, "Invalid current password"), http.StatusUnauthorized)
+		return
+	}
+
+	if user.TwoFactorEnabled {
+		http.Error(w, localize(r, "Two-factor authentication is already enabled"), http.StatusConflict)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to generate TOTP secret: %v", err)
+		http.Error(w, localize(r, "Internal server error"), http.StatusInternalServerError)
+		return
+	}
+
+	user.PendingTOTPSecret = secret
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to store TOTP secret for %s: %v", user.Username, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Scan the code with your authenticator app, then confirm a code to enable two-factor authentication"),
+		Data: map[string]string{
+			"secret": secret,
+			"uri":    totp.URI(h.config.Branding.Name, user.Username, secret),
+		},
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Two-factor setup started for user: %s", user.Username)
+}
+
+// TwoFactorEnableHandler confirms enrollment with a code from the
+// authenticator app and turns two-factor authentication on. The response
+// carries the recovery codes, which are never shown again.
+func (h *AuthHandler) TwoFactorEnableHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Two-factor enable request received")
+
+	user := contextUser(r)
+
+	var req TwoFactorEnableRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if user.TwoFactorEnabled {
+		http.Error(w, localize(r, "Two-factor authentication is already enabled"), http.StatusConflict)
+		return
+	}
+	if user.PendingTOTPSecret == "" {
+		http.Error(w, localize(r, "Start two-factor setup first"), http.StatusBadRequest)
+		return
+	}
+
+	step, ok := totp.Validate(user.PendingTOTPSecret, req.Code, h.clock.Now(), totpSkew)
+	if !ok {
+		h.logger.Printf("[DEBUG] Invalid TOTP code during enrollment for: %s", user.Username)
+		http.Error(w, localize(r, "Invalid two-factor authentication code"), http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to generate recovery codes: %v", err)
+		http.Error(w, localize(r, "Internal server error"), http.StatusInternalServerError)
+		return
+	}
+
+	user.TwoFactorEnabled = true
+	user.TOTPSecret = user.PendingTOTPSecret
+	user.PendingTOTPSecret = ""
+	user.TOTPLastStep = step
+	user.RecoveryCodes = hashes
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to enable two-factor for %s: %v", user.Username, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:   AuditTwoFactorEnabled,
+		UserID: user.ID,
+		IP:     clientIP(r),
+	})
+
+	writeRecoveryCodes(w, r, codes, "Two-factor authentication enabled. Store your recovery codes somewhere safe")
+	h.logger.Printf("[DEBUG] Two-factor enabled for user: %s", user.Username)
+}
+
+// TwoFactorDisableHandler turns two-factor authentication off after
+// checking the password and a current TOTP or recovery code
+func (h *AuthHandler) TwoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Two-factor disable request received")
+
+	user := contextUser(r)
+
+	var req TwoFactorDisableRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if !user.TwoFactorEnabled {
+		http.Error(w, localize(r, "Two-factor authentication is not enabled"), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.hasher.Compare(r.Context(), user.Password, req.Password); err != nil {
+		if h.passwordUnavailable(w, r, err) {
+			return
+		}
+		h.logger.Printf("[DEBUG] Invalid password for two-factor disable: %s", user.Username)
+		http.Error(w, localize(r, "Invalid current password"), http.StatusUnauthorized)
+		return
+	}
+	codes := secondFactorCodes{TOTP: req.Code, SMS: req.SMSCode, Recovery: req.RecoveryCode}
+	if _, ok := h.verifySecondFactor(user, codes, h.clock.Now()); !ok {
+		h.logger.Printf("[DEBUG] Invalid second factor for two-factor disable: %s", user.Username)
+		http.Error(w, localize(r, "Invalid two-factor authentication code"), http.StatusUnauthorized)
+		return
+	}
+
+	user.TwoFactorEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	if !user.HasTwoFactor() {
+		user.RecoveryCodes = nil
+	}
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to disable two-factor for %s: %v", user.Username, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:   AuditTwoFactorDisabled,
+		UserID: user.ID,
+		IP:     clientIP(r),
+	})
+	h.notifySecurityChange(r, user, NoticeTwoFactorDisabled, "")
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Two-factor authentication disabled"),
+	}
+
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Two-factor disabled for user: %s", user.Username)
+}
+
+// RecoveryCodesHandler replaces the session user's recovery codes with a
+// new set, invalidating the old ones. The new codes are only ever returned
+// in this response; ?download=1 returns them as a text file.
+func (h *AuthHandler) RecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Recovery code regeneration request received")
+
+	user := contextUser(r)
+
+	var req RecoveryCodesRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if !user.HasTwoFactor() {
+		http.Error(w, localize(r, "Two-factor authentication is not enabled"), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.hasher.Compare(r.Context(), user.Password, req.Password); err != nil {
+		if h.passwordUnavailable(w, r, err) {
+			return
+		}
+		h.logger.Printf("[DEBUG] Invalid password for recovery code regeneration: %s", user.Username)
+		http.Error(w, localize(r, "Invalid current password"), http.StatusUnauthorized)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		h.logger.Printf("[DEBUG] Failed to generate recovery codes: %v", err)
+		http.Error(w, localize(r, "Internal server error"), http.StatusInternalServerError)
+		return
+	}
+
+	user.RecoveryCodes = hashes
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to store recovery codes for %s: %v", user.Username, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:   AuditRecoveryCodesRegenerated,
+		UserID: user.ID,
+		IP:     clientIP(r),
+	})
+
+	writeRecoveryCodes(w, r, codes, "New recovery codes generated. Your old codes no longer work")
+	h.logger.Printf("[DEBUG] Recovery codes regenerated for user: %s", user.Username)
+}
+
+// writeRecoveryCodes returns freshly generated recovery codes as JSON, or
+// as a text file download when the request has ?download=1
+func writeRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string, message string) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.URL.Query().Get("download") == "1" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="recovery-codes.txt"`)
+		fmt.Fprintln(w, localize(r, "Each recovery code can be used once in place of an authentication code."))
+		fmt.Fprintln(w)
+		for _, code := range codes {
+			fmt.Fprintln(w, code)
+		}
+		return
+	}
+
+	response := Response{
+		Success: true,
+		Message: localize(r, message),
+		Data:    map[string][]string{"recoveryCodes": codes},
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
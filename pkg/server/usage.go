@@ -0,0 +1,444 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Usage report granularities
+const (
+	UsageByHour  = "hour"
+	UsageByDay   = "day"
+	UsageByTotal = "total"
+)
+
+// usageAnonymous is the key requests made without credentials are metered
+// under; they are not told apart by IP, which would make the report
+// grow with every visitor
+const usageAnonymous = "anonymous"
+
+// UsageRecord is what one API key made of one endpoint over a period: an
+// hour, a day or the whole report range. Keys are "token:<id>" for
+// personal access tokens, "client:<id>" for API clients, "user:<id>" for
+// sessions and "anonymous".
+type UsageRecord struct {
+	Period   time.Time `json:"period"`
+	Key      string    `json:"key"`
+	UserID   string    `json:"userId,omitempty"`
+	Endpoint string    `json:"endpoint"`
+	Requests int64     `json:"requests"`
+	Errors   int64     `json:"errors"`
+	BytesIn  int64     `json:"bytesIn"`
+	BytesOut int64     `json:"bytesOut"`
+}
+
+// add counts other into r
+func (r *UsageRecord) add(other UsageRecord) {
+	r.Requests += other.Requests
+	r.Errors += other.Errors
+	r.BytesIn += other.BytesIn
+	r.BytesOut += other.BytesOut
+}
+
+// usageBucket identifies a record
+type usageBucket struct {
+	period   time.Time
+	key      string
+	endpoint string
+}
+
+// usageFilter selects the records of a report. Empty fields match
+// everything; records are those of hours from From up to To.
+type usageFilter struct {
+	From     time.Time
+	To       time.Time
+	Key      string
+	UserID   string
+	Endpoint string
+}
+
+func (f usageFilter) matches(record UsageRecord) bool {
+	return !record.Period.Before(f.From) && record.Period.Before(f.To) &&
+		(f.Key == "" || record.Key == f.Key) &&
+		(f.UserID == "" || record.UserID == f.UserID) &&
+		(f.Endpoint == "" || record.Endpoint == f.Endpoint)
+}
+
+// usageMeter counts requests and bytes per API key and endpoint. Requests
+// are counted as pending, and the aggregation job folds them into hourly
+// records, which reports read; the hourly records are purged after the
+// retention.
+type usageMeter struct {
+	interval  time.Duration
+	retention time.Duration
+	logger    *log.Logger
+
+	mutex        sync.Mutex
+	pending      map[usageBucket]*UsageRecord
+	hourly       map[usageBucket]*UsageRecord
+	aggregatedAt time.Time
+}
+
+func newUsageMeter(interval, retention time.Duration, logger *log.Logger) *usageMeter {
+	return &usageMeter{
+		interval:  interval,
+		retention: retention,
+		logger:    logger,
+		pending:   make(map[usageBucket]*UsageRecord),
+		hourly:    make(map[usageBucket]*UsageRecord),
+	}
+}
+
+// record counts a request made at now
+func (m *usageMeter) record(now time.Time, key, userID, endpoint string, failed bool, bytesIn, bytesOut int64) {
+	request := UsageRecord{Requests: 1, BytesIn: bytesIn, BytesOut: bytesOut}
+	if failed {
+		request.Errors = 1
+	}
+	bucket := usageBucket{period: now.UTC().Truncate(time.Hour), key: key, endpoint: endpoint}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	record := m.pending[bucket]
+	if record == nil {
+		record = &UsageRecord{Period: bucket.period, Key: key, UserID: userID, Endpoint: endpoint}
+		m.pending[bucket] = record
+	}
+	record.add(request)
+}
+
+// aggregate folds the pending counts into the hourly records and returns
+// how many records it updated
+func (m *usageMeter) aggregate(now time.Time) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	updated := len(m.pending)
+	for bucket, pending := range m.pending {
+		if record, ok := m.hourly[bucket]; ok {
+			record.add(*pending)
+		} else {
+			m.hourly[bucket] = pending
+		}
+	}
+	m.pending = make(map[usageBucket]*UsageRecord)
+	m.aggregatedAt = now
+	return updated
+}
+
+// Purge drops hourly records older than the retention, returning how many
+// were removed
+func (m *usageMeter) Purge(now time.Time) int {
+	cutoff := now.Add(-m.retention)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	purged := 0
+	for bucket := range m.hourly {
+		if bucket.period.Before(cutoff) {
+			delete(m.hourly, bucket)
+			purged++
+		}
+	}
+	return purged
+}
+
+// report returns the hourly records filter selects, summed per period of
+// granularity, key and endpoint, ordered by period, key and endpoint, and
+// when they were last aggregated
+func (m *usageMeter) report(filter usageFilter, granularity string) ([]UsageRecord, time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	summed := make(map[usageBucket]*UsageRecord)
+	for _, record := range m.hourly {
+		if !filter.matches(*record) {
+			continue
+		}
+		period := record.Period
+		switch granularity {
+		case UsageByDay:
+			period = period.Truncate(24 * time.Hour)
+		case UsageByTotal:
+			period = filter.From
+		}
+		bucket := usageBucket{period: period, key: record.Key, endpoint: record.Endpoint}
+		if sum, ok := summed[bucket]; ok {
+			sum.add(*record)
+		} else {
+			sum := *record
+			sum.Period = period
+			summed[bucket] = &sum
+		}
+	}
+
+	records := make([]UsageRecord, 0, len(summed))
+	for _, record := range summed {
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if !a.Period.Equal(b.Period) {
+			return a.Period.Before(b.Period)
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Endpoint < b.Endpoint
+	})
+	return records, m.aggregatedAt
+}
+
+// start aggregates every interval until the returned stop function is
+// called, and once more then so no counts are left pending
+func (m *usageMeter) start() (stop func()) {
+	ticker := time.NewTicker(m.interval)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case now := <-ticker.C:
+				updated := m.aggregate(now)
+				m.logger.Printf("[DEBUG] Usage aggregation updated %d records", updated)
+			case <-done:
+				ticker.Stop()
+				m.aggregate(time.Now())
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// usageKey returns the API key a request is metered under and the user it
+// belongs to, if any
+func (s *Server) usageKey(r *http.Request) (key, userID string) {
+	if auth, ok := r.Context().Value(accessTokenKey{}).(accessTokenAuth); ok {
+		return "token:" + auth.token.ID, auth.userID
+	}
+	caller := s.quotaCaller(r)
+	if id, ok := strings.CutPrefix(caller, "user:"); ok {
+		return caller, id
+	}
+	if strings.HasPrefix(caller, "ip:") {
+		return usageAnonymous, ""
+	}
+	return caller, ""
+}
+
+// usageBody counts the bytes read from a request body
+type usageBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *usageBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+// usageWriter counts the bytes of a response body
+type usageWriter struct {
+	statusWriter
+	written int64
+}
+
+func (uw *usageWriter) Write(p []byte) (int, error) {
+	n, err := uw.statusWriter.Write(p)
+	uw.written += int64(n)
+	return n, err
+}
+
+// usageMiddleware meters every API request by key and endpoint, the
+// method and route template. The key is found before the handler runs,
+// so a logout is metered against the session it ends.
+func (s *Server) usageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		template, err := route.GetPathTemplate()
+		if err != nil || template == "/" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, userID := s.usageKey(r)
+		body := &usageBody{ReadCloser: r.Body}
+		r.Body = body
+		uw := &usageWriter{statusWriter: statusWriter{ResponseWriter: w}}
+		next.ServeHTTP(uw, r)
+
+		failed := uw.status >= http.StatusBadRequest
+		s.usage.record(s.authHandler.clock.Now(), key, userID, r.Method+" "+template, failed, body.read, uw.written)
+	})
+}
+
+// parseUsageFilter reads a report's range from the from and to
+// parameters, RFC 3339 times or dates, defaulting to the current UTC month
+// up to now. It returns false when either is invalid.
+func parseUsageFilter(r *http.Request, now time.Time) (usageFilter, bool) {
+	now = now.UTC()
+	filter := usageFilter{From: time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), To: now}
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		value := r.URL.Query().Get(param.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			if t, err = time.Parse("2006-01-02", value); err != nil {
+				return usageFilter{}, false
+			}
+		}
+		*param.value = t.UTC()
+	}
+	return filter, filter.From.Before(filter.To)
+}
+
+// parseUsageGranularity reads the granularity parameter, which defaults to
+// fallback
+func parseUsageGranularity(r *http.Request, fallback string) (string, bool) {
+	switch granularity := r.URL.Query().Get("granularity"); granularity {
+	case "":
+		return fallback, true
+	case UsageByHour, UsageByDay, UsageByTotal:
+		return granularity, true
+	default:
+		return "", false
+	}
+}
+
+// meteredUsage returns the records of the caller's API keys in the
+// requested range: those of a user's sessions and access tokens, or those
+// of an API client. Anonymous callers have none.
+func (s *Server) meteredUsage(r *http.Request, caller string) (map[string]interface{}, bool) {
+	filter, ok := parseUsageFilter(r, s.authHandler.clock.Now())
+	if !ok {
+		return nil, false
+	}
+	granularity, ok := parseUsageGranularity(r, UsageByTotal)
+	if !ok {
+		return nil, false
+	}
+
+	records := []UsageRecord{}
+	var aggregatedAt time.Time
+	if id, ok := strings.CutPrefix(caller, "user:"); ok {
+		filter.UserID = id
+		records, aggregatedAt = s.usage.report(filter, granularity)
+	} else if strings.HasPrefix(caller, "client:") {
+		filter.Key = caller
+		records, aggregatedAt = s.usage.report(filter, granularity)
+	}
+	return map[string]interface{}{
+		"from":         filter.From,
+		"to":           filter.To,
+		"granularity":  granularity,
+		"aggregatedAt": aggregatedAt,
+		"records":      records,
+	}, true
+}
+
+// UsageReport is the admin usage report
+type UsageReport struct {
+	From         time.Time     `json:"from"`
+	To           time.Time     `json:"to"`
+	Granularity  string        `json:"granularity"`
+	AggregatedAt time.Time     `json:"aggregatedAt"`
+	Records      []UsageRecord `json:"records"`
+	Total        UsageRecord   `json:"total"`
+}
+
+// UsageReportHandler reports metered usage by API key and endpoint for
+// billing and capacity planning, optionally filtered by key, user and
+// endpoint; ?format=csv downloads it
+func (s *Server) UsageReportHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Usage report request received")
+
+	if _, ok := s.authHandler.requireAdmin(w, r); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter, ok := parseUsageFilter(r, s.authHandler.clock.Now())
+	if !ok {
+		http.Error(w, localize(r, "Invalid report range"), http.StatusBadRequest)
+		return
+	}
+	filter.Key = query.Get("key")
+	filter.UserID = query.Get("user")
+	filter.Endpoint = query.Get("endpoint")
+	granularity, ok := parseUsageGranularity(r, UsageByDay)
+	if !ok {
+		http.Error(w, localize(r, "Invalid report granularity"), http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, localize(r, "Unsupported report format"), http.StatusBadRequest)
+		return
+	}
+
+	report := UsageReport{From: filter.From, To: filter.To, Granularity: granularity}
+	report.Records, report.AggregatedAt = s.usage.report(filter, granularity)
+	for _, record := range report.Records {
+		report.Total.add(record)
+	}
+
+	if format == "csv" {
+		writeUsageCSV(w, report)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{Success: true, Data: report})
+}
+
+// writeUsageCSV writes the report as a CSV download, a row per record
+func writeUsageCSV(w http.ResponseWriter, report UsageReport) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s-%s.csv"`,
+		report.From.Format("2006-01-02"), report.To.Format("2006-01-02")))
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"period", "key", "user_id", "endpoint", "requests", "errors", "bytes_in", "bytes_out"})
+	for _, record := range report.Records {
+		out.Write([]string{
+			record.Period.Format(time.RFC3339),
+			csvSafe(record.Key),
+			record.UserID,
+			record.Endpoint,
+			strconv.FormatInt(record.Requests, 10),
+			strconv.FormatInt(record.Errors, 10),
+			strconv.FormatInt(record.BytesIn, 10),
+			strconv.FormatInt(record.BytesOut, 10),
+		})
+	}
+	out.Flush()
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"auth-server/pkg/metrics"
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// cachedUserStore keeps recently read users in an LRU cache in front of
+// another UserStore, so read-heavy clients polling their profile do not
+// reach the store on every request. It sits below encryptedUserStore, so
+// cached users hold sealed personal data like the store does.
+//
+// Every write drops the user from the cache. A lookup that raced with a
+// write does not cache what it read, since that may predate the write.
+// Misses are not cached, so a new user is found as soon as it is created.
+type cachedUserStore struct {
+	next    UserStore
+	size    int
+	ttl     time.Duration
+	metrics *metrics.Registry // nil until the server sets it
+
+	mutex      sync.Mutex
+	entries    *list.List // of *userCacheEntry, most recently used first
+	byID       map[string]*list.Element
+	byUsername map[string]*list.Element
+	byEmail    map[string]*list.Element
+	// generation counts invalidations, so lookups can tell whether a
+	// write happened while they were reading from next
+	generation uint64
+}
+
+type userCacheEntry struct {
+	user    User
+	expires time.Time
+}
+
+// newCachedUserStore wraps next with a cache of cfg.UserCacheSize users
+func newCachedUserStore(next UserStore, cfg Config) *cachedUserStore {
+	return &cachedUserStore{
+		next:       next,
+		size:       cfg.UserCacheSize,
+		ttl:        cfg.UserCacheTTL,
+		entries:    list.New(),
+		byID:       make(map[string]*list.Element),
+		byUsername: make(map[string]*list.Element),
+		byEmail:    make(map[string]*list.Element),
+	}
+}
+
+func (s *cachedUserStore) Create(ctx context.Context, user *User) error {
+	err := s.next.Create(ctx, user)
+	s.invalidate(user.ID)
+	return err
+}
+
+func (s *cachedUserStore) Get(ctx context.Context, id string) (*User, error) {
+	return s.lookup(ctx, s.byID, id, func() (*User, error) { return s.next.Get(ctx, id) })
+}
+
+func (s *cachedUserStore) GetByUsername(ctx context.Context, username string) (*User, error) {
+	return s.lookup(ctx, s.byUsername, username, func() (*User, error) { return s.next.GetByUsername(ctx, username) })
+}
+
+func (s *cachedUserStore) GetByEmail(ctx context.Context, email string) (*User, error) {
+	return s.lookup(ctx, s.byEmail, email, func() (*User, error) { return s.next.GetByEmail(ctx, email) })
+}
+
+// Update invalidates the user whether or not the write succeeds, since a
+// version conflict means the cached copy is already stale
+func (s *cachedUserStore) Update(ctx context.Context, user *User) error {
+	err := s.next.Update(ctx, user)
+	s.invalidate(user.ID)
+	return err
+}
+
+func (s *cachedUserStore) Delete(ctx context.Context, id string) error {
+	err := s.next.Delete(ctx, id)
+	s.invalidate(id)
+	return err
+}
+
+// List always reads from the store, since the cache only holds some users
+func (s *cachedUserStore) List(ctx context.Context) ([]*User, error) {
+	return s.next.List(ctx)
+}
+
+// lookup returns a copy of the user cached under key in index, or reads it
+// with load and caches it
+func (s *cachedUserStore) lookup(ctx context.Context, index map[string]*list.Element, key string, load func() (*User, error)) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	s.mutex.Lock()
+	if element, ok := index[key]; ok {
+		entry := element.Value.(*userCacheEntry)
+		if now.Before(entry.expires) {
+			s.entries.MoveToFront(element)
+			copied := entry.user
+			s.mutex.Unlock()
+			s.count("auth_user_cache_hits_total", "User lookups answered from the cache.")
+			return &copied, nil
+		}
+		s.remove(element)
+	}
+	generation := s.generation
+	s.mutex.Unlock()
+
+	s.count("auth_user_cache_misses_total", "User lookups that went to the user store.")
+	user, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.generation == generation {
+		s.add(user, now.Add(s.ttl))
+	}
+	return user, nil
+}
+
+// add caches a copy of user, evicting the least recently used users over
+// the size limit. The caller holds the mutex.
+func (s *cachedUserStore) add(user *User, expires time.Time) {
+	if element, ok := s.byID[user.ID]; ok {
+		s.remove(element)
+	}
+
+	element := s.entries.PushFront(&userCacheEntry{user: *user, expires: expires})
+	s.byID[user.ID] = element
+	s.byUsername[user.Username] = element
+	s.byEmail[user.Email] = element
+
+	for s.entries.Len() > s.size {
+		s.remove(s.entries.Back())
+	}
+}
+
+// remove drops a cached user from the list and every index. The caller
+// holds the mutex.
+func (s *cachedUserStore) remove(element *list.Element) {
+	entry := s.entries.Remove(element).(*userCacheEntry)
+	delete(s.byID, entry.user.ID)
+	if s.byUsername[entry.user.Username] == element {
+		delete(s.byUsername, entry.user.Username)
+	}
+	if s.byEmail[entry.user.Email] == element {
+		delete(s.byEmail, entry.user.Email)
+	}
+}
+
+// invalidate drops the user with the given ID, if cached
+func (s *cachedUserStore) invalidate(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.generation++
+	if element, ok := s.byID[id]; ok {
+		s.remove(element)
+	}
+}
+
+func (s *cachedUserStore) count(name, help string) {
+	if s.metrics != nil {
+		s.metrics.Counter(name, help).Inc()
+	}
+}
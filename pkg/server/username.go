@@ -0,0 +1,202 @@
+package server
+
+import (
+	"auth-server/pkg/usernamepolicy"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// usernameHistorySize is how many former usernames are kept per user
+const usernameHistorySize = 20
+
+var (
+	errUsernameRequired = errors.New("username is required")
+	errUsernameCooldown = errors.New("username was changed too recently")
+	errUsernameTaken    = errors.New("username is taken")
+)
+
+// nextUsernameChange returns when user may next change their username
+func (h *AuthHandler) nextUsernameChange(user *User) time.Time {
+	if n := len(user.UsernameHistory); n > 0 {
+		return user.UsernameHistory[n-1].ChangedAt.Add(h.config.UsernameChangeCooldown)
+	}
+	return time.Time{}
+}
+
+// userByFormerUsername returns the user who most recently gave up username
+// within the reservation period. The store has no index of former
+// usernames, so every user is checked.
+func (h *AuthHandler) userByFormerUsername(ctx context.Context, username string) (*User, error) {
+	users, err := h.users.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := h.clock.Now().Add(-h.config.UsernameReservationPeriod)
+	var owner *User
+	var ownerChangedAt time.Time
+	for _, user := range users {
+		for _, change := range user.UsernameHistory {
+			if change.Username == username && change.ChangedAt.After(cutoff) && change.ChangedAt.After(ownerChangedAt) {
+				owner, ownerChangedAt = user, change.ChangedAt
+			}
+		}
+	}
+	if owner == nil {
+		return nil, ErrUserNotFound
+	}
+	return owner, nil
+}
+
+// usernameTaken reports whether username belongs to, or is reserved for,
+// someone other than the user with userID. Pass an empty userID for a new
+// account.
+func (h *AuthHandler) usernameTaken(ctx context.Context, userID, username string) (bool, error) {
+	current, err := h.users.GetByUsername(ctx, username)
+	if err == nil {
+		return current.ID != userID, nil
+	}
+	if !errors.Is(err, ErrUserNotFound) {
+		return false, err
+	}
+
+	former, err := h.userByFormerUsername(ctx, username)
+	if errors.Is(err, ErrUserNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return former.ID != userID, nil
+}
+
+// renameUser changes user's username once it passes the username policy,
+// the change cooldown and is free, recording the old one in the user's
+// history. The caller stores the user.
+func (h *AuthHandler) renameUser(ctx context.Context, user *User, username string) error {
+	if username == "" {
+		return errUsernameRequired
+	}
+	if err := h.checkUsername(username); err != nil {
+		return err
+	}
+	now := h.clock.Now()
+	if now.Before(h.nextUsernameChange(user)) {
+		return errUsernameCooldown
+	}
+	taken, err := h.usernameTaken(ctx, user.ID, username)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errUsernameTaken
+	}
+
+	start := max(0, len(user.UsernameHistory)+1-usernameHistorySize)
+	history := make([]UsernameChange, 0, len(user.UsernameHistory)+1-start)
+	history = append(history, user.UsernameHistory[start:]...)
+	user.UsernameHistory = append(history, UsernameChange{Username: user.Username, ChangedAt: now})
+	user.Username = username
+	return nil
+}
+
+// writeRenameError writes the response for an error from renameUser
+func (h *AuthHandler) writeRenameError(w http.ResponseWriter, r *http.Request, user *User, username string, err error) {
+	switch {
+	case errors.Is(err, errUsernameRequired):
+		http.Error(w, localize(r, "Username is required"), http.StatusBadRequest)
+	case errors.Is(err, usernamepolicy.ErrReserved), errors.Is(err, usernamepolicy.ErrBlocked):
+		h.logger.Printf("[DEBUG] Username rejected by policy: %s: %v", username, err)
+		http.Error(w, localize(r, usernamePolicyMessage(err)), http.StatusBadRequest)
+	case errors.Is(err, errUsernameCooldown):
+		h.logger.Printf("[DEBUG] Username change too soon for user: %s", user.Username)
+		retryAfter := h.nextUsernameChange(user).Sub(h.clock.Now())
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		http.Error(w, localize(r, "You changed your username too recently, try again later"), http.StatusTooManyRequests)
+	case errors.Is(err, errUsernameTaken):
+		h.logger.Printf("[DEBUG] Username already exists: %s", username)
+		http.Error(w, localize(r, "Username already exists"), http.StatusConflict)
+	default:
+		h.logger.Printf("[DEBUG] User lookup failed: %v", err)
+		writeStoreError(w, r, err)
+	}
+}
+
+// recordRename audits a username change
+func (h *AuthHandler) recordRename(r *http.Request, user *User) {
+	from := user.UsernameHistory[len(user.UsernameHistory)-1].Username
+	h.audit.Record(AuditEvent{
+		Type:    AuditUsernameChanged,
+		UserID:  user.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"from": from, "to": user.Username},
+	})
+}
+
+// ChangeUsernameHandler changes the session user's username after checking
+// their password. A username can be changed once per
+// Config.UsernameChangeCooldown, and the old one stays reserved for the
+// user for Config.UsernameReservationPeriod.
+func (h *AuthHandler) ChangeUsernameHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Username change request received")
+
+	user := contextUser(r)
+
+	if !h.checkIfMatch(w, r, user) {
+		return
+	}
+
+	var req ChangeUsernameRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if req.CurrentPassword == "" || req.NewUsername == "" {
+		h.logger.Printf("[DEBUG] Missing required fields")
+		http.Error(w, localize(r, "Current password and new username are required"), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.hasher.Compare(r.Context(), user.Password, req.CurrentPassword); err != nil {
+		if h.passwordUnavailable(w, r, err) {
+			return
+		}
+		h.logger.Printf("[DEBUG] Invalid current password for user: %s", user.Username)
+		http.Error(w, localize(r, "Invalid current password"), http.StatusUnauthorized)
+		return
+	}
+
+	if req.NewUsername == user.Username {
+		http.Error(w, localize(r, "This is already your username"), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.renameUser(r.Context(), user, req.NewUsername); err != nil {
+		h.writeRenameError(w, r, user, req.NewUsername, err)
+		return
+	}
+
+	user.UpdatedAt = h.clock.Now()
+	if err := h.users.Update(r.Context(), user); err != nil {
+		h.logger.Printf("[DEBUG] Failed to store new username for %s: %v", user.ID, err)
+		writeUserUpdateError(w, r, err)
+		return
+	}
+	h.recordRename(r, user)
+
+	response := Response{
+		Success: true,
+		Message: localize(r, "Username changed successfully"),
+		Data:    user.Sanitized(),
+	}
+
+	w.Header().Set("ETag", userETag(user))
+	json.NewEncoder(w).Encode(response)
+	h.logger.Printf("[DEBUG] Username changed successfully for user: %s", user.Username)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"auth-server/pkg/usernamepolicy"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// UsernamePolicyRequest represents an update to the username policy. Lists
+// left out of the request are not changed.
+type UsernamePolicyRequest struct {
+	Reserved        *[]string `json:"reserved"`
+	BlockedPatterns *[]string `json:"blockedPatterns"`
+}
+
+// newUsernamePolicyFromConfig builds the username policy, loading each list
+// from its configured file or falling back to the built-in one
+func newUsernamePolicyFromConfig(cfg Config) *usernamepolicy.Policy {
+	reserved := loadUsernameList(cfg.UsernameReservedFile, "reserved usernames", usernamepolicy.DefaultReserved, cfg.Logger)
+	patterns := loadUsernameList(cfg.UsernameBlockedPatternsFile, "blocked username patterns", usernamepolicy.DefaultBlockedPatterns, cfg.Logger)
+
+	policy, err := usernamepolicy.New(reserved, patterns)
+	if err != nil {
+		cfg.Logger.Printf("[DEBUG] Invalid blocked username patterns, using built-in list: %v", err)
+		policy, _ = usernamepolicy.New(reserved, usernamepolicy.DefaultBlockedPatterns)
+	}
+	return policy
+}
+
+// loadUsernameList reads a list file, returning fallback when path is
+// empty or cannot be read
+func loadUsernameList(path, name string, fallback []string, logger *log.Logger) []string {
+	if path == "" {
+		return fallback
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		logger.Printf("[DEBUG] Failed to open %s file %s, using built-in list: %v", name, path, err)
+		return fallback
+	}
+	defer file.Close()
+	entries, err := usernamepolicy.LoadList(file)
+	if err != nil {
+		logger.Printf("[DEBUG] Failed to read %s file %s, using built-in list: %v", name, path, err)
+		return fallback
+	}
+	return entries
+}
+
+// checkUsername validates a username a user wants to take
+func (h *AuthHandler) checkUsername(username string) error {
+	return h.usernamePolicy.Check(username)
+}
+
+// usernamePolicyMessage returns the client-facing message for a username
+// policy error
+func usernamePolicyMessage(err error) string {
+	if errors.Is(err, usernamepolicy.ErrReserved) {
+		return "This username is reserved"
+	}
+	return "This username is not allowed"
+}
+
+// UsernamePolicyHandler lets admins view (GET) and replace (PUT) the
+// reserved usernames and blocked username patterns. Existing accounts are
+// not affected by changes.
+func (s *Server) UsernamePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Printf("[DEBUG] Username policy request received")
+
+	admin, ok := s.authHandler.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	policy := s.authHandler.usernamePolicy
+
+	if r.Method == http.MethodPut {
+		var req UsernamePolicyRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			s.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+			writeBodyError(w, r, err)
+			return
+		}
+
+		// Patterns go first since they are the update that can fail
+		if req.BlockedPatterns != nil {
+			if err := policy.SetBlockedPatterns(*req.BlockedPatterns); err != nil {
+				s.logger.Printf("[DEBUG] Rejected username policy update: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Reserved != nil {
+			policy.SetReserved(*req.Reserved)
+		}
+
+		s.audit.Record(AuditEvent{
+			Type:   AuditUsernamePolicyChanged,
+			UserID: admin.ID,
+			IP:     clientIP(r),
+			Details: map[string]string{
+				"reserved":        strconv.Itoa(len(policy.Reserved())),
+				"blockedPatterns": strconv.Itoa(len(policy.BlockedPatterns())),
+			},
+		})
+	}
+
+	response := Response{
+		Success: true,
+		Message: "Username policy retrieved successfully",
+		Data: map[string]interface{}{
+			"reserved":        policy.Reserved(),
+			"blockedPatterns": policy.BlockedPatterns(),
+		},
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
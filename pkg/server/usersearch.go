@@ -0,0 +1,170 @@
+package server
+
+import (
+	"auth-server/pkg/usersearch"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultUserSearchLimit = 20
+	maxUserSearchLimit     = 100
+)
+
+// searchableUserStore keeps a search index of the users in another
+// UserStore, updated on every successful write. It sits above
+// encryptedUserStore, since email search needs the addresses in the
+// clear; the index lives only in memory and is rebuilt from the store on
+// startup.
+type searchableUserStore struct {
+	next  UserStore
+	index *usersearch.Index
+}
+
+// newSearchableUserStore wraps next and indexes the users it already has
+func newSearchableUserStore(next UserStore, logger *log.Logger) *searchableUserStore {
+	s := &searchableUserStore{next: next, index: usersearch.New()}
+	users, err := next.List(context.Background())
+	if err != nil {
+		logger.Printf("[DEBUG] Failed to index existing users for search: %v", err)
+	}
+	for _, user := range users {
+		s.put(user)
+	}
+	return s
+}
+
+func (s *searchableUserStore) put(user *User) {
+	s.index.Put(user.ID, usersearch.Document{
+		Username:    user.Username,
+		Email:       user.Email,
+		DisplayName: user.DisplayName,
+	})
+}
+
+func (s *searchableUserStore) Create(ctx context.Context, user *User) error {
+	if err := s.next.Create(ctx, user); err != nil {
+		return err
+	}
+	s.put(user)
+	return nil
+}
+
+func (s *searchableUserStore) Get(ctx context.Context, id string) (*User, error) {
+	return s.next.Get(ctx, id)
+}
+
+func (s *searchableUserStore) GetByUsername(ctx context.Context, username string) (*User, error) {
+	return s.next.GetByUsername(ctx, username)
+}
+
+func (s *searchableUserStore) GetByEmail(ctx context.Context, email string) (*User, error) {
+	return s.next.GetByEmail(ctx, email)
+}
+
+func (s *searchableUserStore) Update(ctx context.Context, user *User) error {
+	if err := s.next.Update(ctx, user); err != nil {
+		return err
+	}
+	s.put(user)
+	return nil
+}
+
+func (s *searchableUserStore) List(ctx context.Context) ([]*User, error) {
+	return s.next.List(ctx)
+}
+
+func (s *searchableUserStore) Delete(ctx context.Context, id string) error {
+	if err := s.next.Delete(ctx, id); err != nil {
+		return err
+	}
+	s.index.Remove(id)
+	return nil
+}
+
+// UserSearchResult is one user found by a search
+type UserSearchResult struct {
+	User  User   `json:"user"`
+	Score int    `json:"score"`
+	Field string `json:"field"` // the field that matched best
+	Match string `json:"match"` // exact, prefix or substring
+	// Deleted is set for accounts awaiting purge
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// UserSearchResponse is a page of search results
+type UserSearchResponse struct {
+	Results []UserSearchResult `json:"results"`
+	Total   int                `json:"total"`
+	Offset  int                `json:"offset"`
+	Limit   int                `json:"limit"`
+}
+
+// AdminUserSearchHandler finds users whose username, email or display name
+// starts with or contains q. Exact matches rank first, then prefix and
+// substring matches, with username matches ahead of display name and email
+// ones. Results are paged with offset and limit.
+func (h *AuthHandler) AdminUserSearchHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] User search request received")
+
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	q := query.Get("q")
+	if q == "" {
+		http.Error(w, localize(r, "Search query is required"), http.StatusBadRequest)
+		return
+	}
+
+	offset, limit := 0, defaultUserSearchLimit
+	if value := query.Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, localize(r, "Invalid offset"), http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, localize(r, "Invalid limit"), http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxUserSearchLimit)
+	}
+
+	hits, total := h.userSearch.index.Search(q, offset, limit)
+	response := UserSearchResponse{
+		Results: make([]UserSearchResult, 0, len(hits)),
+		Total:   total,
+		Offset:  offset,
+		Limit:   limit,
+	}
+	for _, hit := range hits {
+		user, err := h.users.Get(r.Context(), hit.ID)
+		if errors.Is(err, ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			h.logger.Printf("[DEBUG] User lookup failed: %v", err)
+			writeStoreError(w, r, err)
+			return
+		}
+		response.Results = append(response.Results, UserSearchResult{
+			User:    user.Sanitized(),
+			Score:   hit.Score,
+			Field:   hit.Field,
+			Match:   hit.Match,
+			Deleted: user.Deletion != nil,
+		})
+	}
+
+	json.NewEncoder(w).Encode(Response{Success: true, Data: response})
+}
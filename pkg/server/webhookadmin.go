@@ -0,0 +1,348 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// webhookLogSize is how many webhook attempts are kept for inspection
+	webhookLogSize = 500
+
+	defaultWebhookDeliveryLimit = 50
+)
+
+// WebhookAttempt is one POST to a webhook endpoint: a pre hook call, or an
+// attempt at a queued post hook, which has a MessageID
+type WebhookAttempt struct {
+	ID        string    `json:"id"`
+	MessageID string    `json:"messageId,omitempty"`
+	Hook      string    `json:"hook"`
+	URL       string    `json:"url"`
+	Time      time.Time `json:"time"`
+	// StatusCode is the endpoint's answer, zero when it could not be reached
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"durationMs"`
+	// Payload is only included when a single attempt is shown
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// failed reports whether the endpoint could not be reached or did not
+// answer with a 2xx status
+func (a WebhookAttempt) failed() bool {
+	return a.Error != "" || a.StatusCode < 200 || a.StatusCode > 299
+}
+
+// webhookLog keeps the most recent webhook attempts in memory
+type webhookLog struct {
+	mutex    sync.RWMutex
+	attempts []WebhookAttempt
+}
+
+// add appends an attempt, evicting the oldest once webhookLogSize is reached
+func (l *webhookLog) add(attempt WebhookAttempt) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.attempts) >= webhookLogSize {
+		l.attempts = l.attempts[1:]
+	}
+	l.attempts = append(l.attempts, attempt)
+}
+
+// get returns the attempt with the given ID
+func (l *webhookLog) get(id string) (WebhookAttempt, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	for _, attempt := range l.attempts {
+		if attempt.ID == id {
+			return attempt, true
+		}
+	}
+	return WebhookAttempt{}, false
+}
+
+// recent returns the attempts matching keep, newest first
+func (l *webhookLog) recent(keep func(WebhookAttempt) bool) []WebhookAttempt {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	var attempts []WebhookAttempt
+	for i := len(l.attempts) - 1; i >= 0; i-- {
+		if keep(l.attempts[i]) {
+			attempts = append(attempts, l.attempts[i])
+		}
+	}
+	return attempts
+}
+
+// webhookAttempts returns the logged attempts matching keep, newest first,
+// or none when webhooks are not configured
+func (h *AuthHandler) webhookAttempts(keep func(WebhookAttempt) bool) []WebhookAttempt {
+	if h.webhooks == nil {
+		return nil
+	}
+	return h.webhooks.log.recent(keep)
+}
+
+// WebhookDelivery is a webhook attempt along with its message, while that
+// is still in the outbox
+type WebhookDelivery struct {
+	Attempt WebhookAttempt `json:"attempt"`
+	Message *OutboxEntry   `json:"message,omitempty"`
+}
+
+// WebhookEndpoint describes a webhook endpoint: the configured one, and
+// any other that queued webhooks are still bound for
+type WebhookEndpoint struct {
+	URL        string     `json:"url"`
+	Configured bool       `json:"configured"`
+	Paused     bool       `json:"paused"`
+	PausedAt   *time.Time `json:"pausedAt,omitempty"`
+	Pending    int        `json:"pending"`
+	Dead       int        `json:"dead"`
+	// LastAttempt is the latest logged attempt, without its payload
+	LastAttempt *WebhookAttempt `json:"lastAttempt,omitempty"`
+}
+
+// WebhookEndpointRequest pauses or resumes a webhook endpoint
+type WebhookEndpointRequest struct {
+	URL    string `json:"url"`
+	Paused bool   `json:"paused"`
+}
+
+// AdminWebhookDeliveriesHandler lists the recent webhook attempts, newest
+// first, without their payloads. ?status=failed or ?status=succeeded and
+// ?hook= narrow the list; ?limit= caps it.
+func (h *AuthHandler) AdminWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Webhook deliveries request received")
+
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	status, hook := query.Get("status"), query.Get("hook")
+	if status != "" && status != "failed" && status != "succeeded" {
+		http.Error(w, localize(r, "Invalid status"), http.StatusBadRequest)
+		return
+	}
+	limit := defaultWebhookDeliveryLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, localize(r, "Invalid limit"), http.StatusBadRequest)
+			return
+		}
+		limit = min(n, webhookLogSize)
+	}
+
+	attempts := h.webhookAttempts(func(a WebhookAttempt) bool {
+		if hook != "" && a.Hook != hook {
+			return false
+		}
+		return status == "" || (status == "failed") == a.failed()
+	})
+	if len(attempts) > limit {
+		attempts = attempts[:limit]
+	}
+	for i := range attempts {
+		attempts[i].Payload = nil
+	}
+	if attempts == nil {
+		attempts = []WebhookAttempt{}
+	}
+
+	json.NewEncoder(w).Encode(Response{Success: true, Data: attempts})
+}
+
+// AdminWebhookDeliveryHandler shows one webhook attempt with its payload
+// and, while it is still queued, its message
+func (h *AuthHandler) AdminWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Webhook delivery request received")
+
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	attempt, ok := h.webhookAttempt(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, localize(r, "Delivery not found"), http.StatusNotFound)
+		return
+	}
+
+	delivery := WebhookDelivery{Attempt: attempt}
+	for _, msg := range h.outbox.list() {
+		if msg.ID == attempt.MessageID {
+			entry := msg.entry()
+			delivery.Message = &entry
+		}
+	}
+
+	json.NewEncoder(w).Encode(Response{Success: true, Data: delivery})
+}
+
+// webhookAttempt returns the logged attempt with the given ID
+func (h *AuthHandler) webhookAttempt(id string) (WebhookAttempt, bool) {
+	if h.webhooks == nil {
+		return WebhookAttempt{}, false
+	}
+	return h.webhooks.log.get(id)
+}
+
+// AdminWebhookReplayHandler sends a post hook again. A webhook still in
+// the outbox is retried now with a fresh set of attempts; one that has
+// left it is queued again with the same payload. Pre hook calls answered a
+// flow that is over, so they cannot be replayed.
+func (h *AuthHandler) AdminWebhookReplayHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Webhook replay request received")
+
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	attempt, ok := h.webhookAttempt(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, localize(r, "Delivery not found"), http.StatusNotFound)
+		return
+	}
+	if attempt.MessageID == "" {
+		http.Error(w, localize(r, "Pre hook calls cannot be replayed"), http.StatusConflict)
+		return
+	}
+
+	msg, err := h.outbox.redeliver(attempt.MessageID, h.clock.Now())
+	switch {
+	case errors.Is(err, errOutboxMessageNotFound):
+		msg = OutboxMessage{
+			Kind:    OutboxKindWebhook,
+			Label:   attempt.Hook,
+			Webhook: &OutboxWebhook{URL: attempt.URL, Body: attempt.Payload},
+		}
+		msg = h.enqueue(context.WithoutCancel(r.Context()), msg)
+	case errors.Is(err, errOutboxMessageInFlight):
+		http.Error(w, localize(r, "The message is being delivered"), http.StatusConflict)
+		return
+	default:
+		if err != nil {
+			// The message is claimed, so it must be attempted anyway
+			h.logger.Printf("[DEBUG] Failed to save outbox: %v", err)
+		}
+		go h.deliver(context.WithoutCancel(r.Context()), msg)
+	}
+
+	h.audit.Record(AuditEvent{
+		Type:    AuditWebhookReplayed,
+		UserID:  admin.ID,
+		IP:      clientIP(r),
+		Details: map[string]string{"delivery": attempt.ID, "message": msg.ID, "hook": attempt.Hook},
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: localize(r, "Message queued for delivery"),
+		Data:    msg.entry(),
+	})
+}
+
+// AdminWebhookEndpointsHandler lists the webhook endpoints on GET, and
+// pauses or resumes one on PUT. Queued webhooks to a paused endpoint wait
+// in the outbox, without using up attempts, until it is resumed. Pre hooks
+// are still called, since flows wait for their verdict.
+func (h *AuthHandler) AdminWebhookEndpointsHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("[DEBUG] Webhook endpoints request received")
+
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var req WebhookEndpointRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			h.logger.Printf("[DEBUG] Failed to decode request body: %v", err)
+			writeBodyError(w, r, err)
+			return
+		}
+		if req.URL == "" {
+			http.Error(w, localize(r, "Endpoint URL is required"), http.StatusBadRequest)
+			return
+		}
+
+		auditType := AuditWebhookPaused
+		var err error
+		if req.Paused {
+			err = h.outbox.pause(req.URL, h.clock.Now())
+		} else {
+			auditType = AuditWebhookResumed
+			_, err = h.outbox.resume(req.URL)
+		}
+		if err != nil {
+			h.logger.Printf("[DEBUG] Failed to save outbox: %v", err)
+			http.Error(w, localize(r, "Failed to save the endpoint setting"), http.StatusInternalServerError)
+			return
+		}
+
+		h.audit.Record(AuditEvent{
+			Type:    auditType,
+			UserID:  admin.ID,
+			IP:      clientIP(r),
+			Details: map[string]string{"url": req.URL},
+		})
+	}
+
+	json.NewEncoder(w).Encode(Response{Success: true, Data: h.webhookEndpoints()})
+}
+
+// webhookEndpoints describes every known webhook endpoint, by URL
+func (h *AuthHandler) webhookEndpoints() []WebhookEndpoint {
+	endpoints := make(map[string]*WebhookEndpoint)
+	endpoint := func(url string) *WebhookEndpoint {
+		if endpoints[url] == nil {
+			endpoints[url] = &WebhookEndpoint{URL: url}
+		}
+		return endpoints[url]
+	}
+
+	if h.webhooks != nil {
+		endpoint(h.webhooks.url).Configured = true
+	}
+	for url, since := range h.outbox.pausedEndpoints() {
+		e := endpoint(url)
+		e.Paused = true
+		e.PausedAt = &since
+	}
+	for _, msg := range h.outbox.list() {
+		if msg.Webhook == nil {
+			continue
+		}
+		e := endpoint(msg.Webhook.URL)
+		if msg.DeadAt != nil {
+			e.Dead++
+		} else {
+			e.Pending++
+		}
+	}
+	for _, e := range endpoints {
+		if latest := h.webhookAttempts(func(a WebhookAttempt) bool { return a.URL == e.URL }); len(latest) > 0 {
+			latest[0].Payload = nil
+			e.LastAttempt = &latest[0]
+		}
+	}
+
+	list := make([]WebhookEndpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].URL < list[j].URL })
+	return list
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"auth-server/pkg/ids"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Hook names used in webhook payloads and in HOOK_WEBHOOK_EVENTS
+const (
+	HookPreRegister        = "pre_register"
+	HookPostRegister       = "post_register"
+	HookPreLogin           = "pre_login"
+	HookPostLogin          = "post_login"
+	HookPostPasswordChange = "post_password_change"
+)
+
+// webhookPayload is the JSON body sent to the hook endpoint
+type webhookPayload struct {
+	Hook string      `json:"hook"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// webhookHooks calls an external HTTP endpoint for auth flow hooks. Pre
+// hooks block the flow and a non-2xx answer rejects it; post hooks go
+// through the outbox, which sends them in the background and retries them.
+type webhookHooks struct {
+	url     string
+	secret  []byte
+	timeout time.Duration
+	client  *http.Client
+	enqueue func(ctx context.Context, msg OutboxMessage) OutboxMessage
+	log     *webhookLog
+	logger  *log.Logger
+}
+
+// registerWebhookHooks adds webhook hooks for the configured hook names, or
+// for every hook when none are listed, queueing post hooks with enqueue. It
+// does nothing and returns nil without a URL.
+func registerWebhookHooks(hooks *Hooks, cfg Config, enqueue func(ctx context.Context, msg OutboxMessage) OutboxMessage) *webhookHooks {
+	if cfg.HookWebhookURL == "" {
+		return nil
+	}
+
+	wh := &webhookHooks{
+		url:     cfg.HookWebhookURL,
+		secret:  []byte(cfg.HookWebhookSecret),
+		timeout: cfg.HookWebhookTimeout,
+		client:  &http.Client{},
+		enqueue: enqueue,
+		log:     &webhookLog{},
+		logger:  cfg.Logger,
+	}
+
+	enabled := func(name string) bool {
+		if len(cfg.HookWebhookEvents) == 0 {
+			return true
+		}
+		for _, event := range cfg.HookWebhookEvents {
+			if event == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	if enabled(HookPreRegister) {
+		hooks.PreRegister(func(ctx context.Context, req RegisterRequest) error {
+			return wh.call(ctx, HookPreRegister, map[string]string{"username": req.Username, "email": req.Email})
+		})
+	}
+	if enabled(HookPostRegister) {
+		hooks.PostRegister(func(ctx context.Context, user User) {
+			wh.notify(ctx, HookPostRegister, user)
+		})
+	}
+	if enabled(HookPreLogin) {
+		hooks.PreLogin(func(ctx context.Context, username, ip string) error {
+			return wh.call(ctx, HookPreLogin, map[string]string{"username": username, "ip": ip})
+		})
+	}
+	if enabled(HookPostLogin) {
+		hooks.PostLogin(func(ctx context.Context, user User) {
+			wh.notify(ctx, HookPostLogin, user)
+		})
+	}
+	if enabled(HookPostPasswordChange) {
+		hooks.PostPasswordChange(func(ctx context.Context, user User) {
+			wh.notify(ctx, HookPostPasswordChange, user)
+		})
+	}
+
+	cfg.Logger.Printf("[DEBUG] Webhook hooks enabled: %s", cfg.HookWebhookURL)
+	return wh
+}
+
+// call posts a pre hook and waits for the verdict. The flow is rejected
+// when the endpoint answers with a non-2xx status or cannot be reached.
+func (wh *webhookHooks) call(ctx context.Context, hook string, data interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, wh.timeout)
+	defer cancel()
+
+	payload, err := json.Marshal(webhookPayload{Hook: hook, Time: time.Now().UTC(), Data: data})
+	if err != nil {
+		return err
+	}
+	resp, err := wh.attempt(ctx, hook, "", wh.url, payload)
+	if err != nil {
+		wh.logger.Printf("[DEBUG] Webhook hook %s failed: %v", hook, err)
+		return Reject(http.StatusServiceUnavailable, "Request could not be verified, try again later")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	var body struct {
+		Message string `json:"message"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body)
+	if body.Message == "" {
+		body.Message = "Request rejected"
+	}
+
+	status := resp.StatusCode
+	if status < 400 || status > 499 {
+		status = http.StatusForbidden
+	}
+	return Reject(status, body.Message)
+}
+
+// notify queues a post hook in the outbox
+func (wh *webhookHooks) notify(ctx context.Context, hook string, data interface{}) {
+	body, err := json.Marshal(webhookPayload{Hook: hook, Time: time.Now().UTC(), Data: data})
+	if err != nil {
+		wh.logger.Printf("[DEBUG] Webhook hook %s failed: %v", hook, err)
+		return
+	}
+	wh.enqueue(ctx, OutboxMessage{
+		Kind:    OutboxKindWebhook,
+		Label:   hook,
+		Webhook: &OutboxWebhook{URL: wh.url, Body: body},
+	})
+}
+
+// send delivers a queued post hook; a non-2xx answer is a failure to be
+// retried
+func (wh *webhookHooks) send(ctx context.Context, msg OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, wh.timeout)
+	defer cancel()
+
+	resp, err := wh.attempt(ctx, msg.Label, msg.ID, msg.Webhook.URL, msg.Webhook.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// attempt posts body to url and logs the attempt for admins to inspect
+func (wh *webhookHooks) attempt(ctx context.Context, hook, messageID, url string, body []byte) (*http.Response, error) {
+	start := time.Now()
+	resp, err := wh.post(ctx, url, body)
+	attempt := WebhookAttempt{
+		ID:         generateID(ids.PrefixDelivery),
+		MessageID:  messageID,
+		Hook:       hook,
+		URL:        url,
+		Time:       start.UTC(),
+		DurationMS: time.Since(start).Milliseconds(),
+		Payload:    body,
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	} else {
+		attempt.StatusCode = resp.StatusCode
+	}
+	wh.log.add(attempt)
+	return resp, err
+}
+
+// post sends body to url signed with HMAC-SHA256 of the body in the
+// X-Hook-Signature header
+func (wh *webhookHooks) post(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if len(wh.secret) > 0 {
+		mac := hmac.New(sha256.New, wh.secret)
+		mac.Write(body)
+		req.Header.Set("X-Hook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	return wh.client.Do(req)
+}
@@ -0,0 +1,179 @@
+// Package sessionstore keeps the auth server's server-side login sessions,
+// and defines the Manager interface through which an embedding application
+// can keep them elsewhere
+package sessionstore
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session is a server-side login session. The session cookie only carries
+// the ID, so a session can be revoked by deleting it here.
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"userId"`
+	IP        string    `json:"ip,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// AuthenticatedAt is when the user last entered their password for
+	// this session, at login or when re-authenticating
+	AuthenticatedAt time.Time `json:"authenticatedAt"`
+	// MultiFactor is set when a second factor was verified for the session
+	MultiFactor bool `json:"multiFactor"`
+}
+
+// Expired reports whether the session is no longer valid at now
+func (s Session) Expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt)
+}
+
+// ErrNotFound is returned by Manager.Get for a session that does not exist
+// or has expired
+var ErrNotFound = errors.New("session not found")
+
+// Manager keeps server-side sessions; Store is the in-memory
+// implementation the server uses by default. Get, ForUser and Count only
+// see sessions unexpired at now. An error other than ErrNotFound means the
+// sessions could not be reached.
+type Manager interface {
+	Put(ctx context.Context, session Session) error
+	// Replace updates an existing session, reporting whether it existed.
+	// Unlike Put it cannot bring back a session deleted in the meantime.
+	Replace(ctx context.Context, session Session) (bool, error)
+	Get(ctx context.Context, id string, now time.Time) (Session, error)
+	// Delete removes a session, reporting whether it existed
+	Delete(ctx context.Context, id string) (bool, error)
+	// ForUser returns the user's sessions, oldest first
+	ForUser(ctx context.Context, userID string, now time.Time) ([]Session, error)
+	Count(ctx context.Context, now time.Time) (int, error)
+	// PurgeExpired deletes every session that has expired at now and
+	// returns how many were removed
+	PurgeExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// Store holds sessions in memory and is safe for concurrent use
+type Store struct {
+	mutex    sync.RWMutex
+	sessions map[string]Session
+}
+
+// New creates an empty session store
+func New() *Store {
+	return &Store{sessions: make(map[string]Session)}
+}
+
+// Put adds or replaces a session
+func (s *Store) Put(ctx context.Context, session Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions[session.ID] = session
+	return nil
+}
+
+// Replace updates an existing session, reporting whether it existed. Unlike
+// Put it cannot bring back a session deleted in the meantime.
+func (s *Store) Replace(ctx context.Context, session Session) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.sessions[session.ID]; !ok {
+		return false, nil
+	}
+	s.sessions[session.ID] = session
+	return true, nil
+}
+
+// Get returns the session with the given ID if it exists and has not
+// expired, and ErrNotFound otherwise
+func (s *Store) Get(ctx context.Context, id string, now time.Time) (Session, error) {
+	if err := ctx.Err(); err != nil {
+		return Session{}, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.Expired(now) {
+		return Session{}, ErrNotFound
+	}
+	return session, nil
+}
+
+// Delete removes a session, reporting whether it existed
+func (s *Store) Delete(ctx context.Context, id string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, ok := s.sessions[id]
+	delete(s.sessions, id)
+	return ok, nil
+}
+
+// ForUser returns the user's unexpired sessions, oldest first
+func (s *Store) ForUser(ctx context.Context, userID string, now time.Time) ([]Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var sessions []Session
+	for _, session := range s.sessions {
+		if session.UserID == userID && !session.Expired(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+// Count returns how many sessions are unexpired at now
+func (s *Store) Count(ctx context.Context, now time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	count := 0
+	for _, session := range s.sessions {
+		if !session.Expired(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// PurgeExpired deletes every session that has expired at now and returns
+// how many were removed
+func (s *Store) PurgeExpired(ctx context.Context, now time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	purged := 0
+	for id, session := range s.sessions {
+		if session.Expired(now) {
+			delete(s.sessions, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
@@ -0,0 +1,101 @@
+// Package sms sends text messages through pluggable providers
+package sms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidNumber is returned for phone numbers not in E.164 form
+var ErrInvalidNumber = errors.New("phone number must be in international format, e.g. +14155550100")
+
+var e164 = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// NormalizeNumber strips spaces, dashes, dots and brackets from a phone
+// number and checks that the result is E.164
+func NormalizeNumber(number string) (string, error) {
+	number = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "").Replace(number)
+	if !e164.MatchString(number) {
+		return "", ErrInvalidNumber
+	}
+	return number, nil
+}
+
+// Sender delivers a text message to an E.164 number. Send gives up when
+// ctx is done.
+type Sender interface {
+	Send(ctx context.Context, to, body string) error
+}
+
+// LogSender writes messages to a writer instead of sending them, which is
+// useful in development and when no provider is configured
+type LogSender struct {
+	Out io.Writer
+}
+
+// Send writes the message to the configured writer
+func (s *LogSender) Send(ctx context.Context, to, body string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(s.Out, "[SMS] to=%s %q\n", to, body)
+	return err
+}
+
+// TwilioSender sends messages with the Twilio Messages API. Providers with
+// a Twilio-compatible API can be used by changing BaseURL.
+type TwilioSender struct {
+	AccountSID string
+	AuthToken  string
+	From       string
+	// BaseURL defaults to https://api.twilio.com
+	BaseURL string
+	Client  *http.Client
+}
+
+// Send posts the message to the provider
+func (s *TwilioSender) Send(ctx context.Context, to, body string) error {
+	baseURL := s.BaseURL
+	if baseURL == "" {
+		baseURL = "https://api.twilio.com"
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	form := url.Values{}
+	form.Set("To", to)
+	form.Set("From", s.From)
+	form.Set("Body", body)
+
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", strings.TrimRight(baseURL, "/"), url.PathEscape(s.AccountSID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.AccountSID, s.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiError struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&apiError)
+		return fmt.Errorf("sms provider returned %s: %s", resp.Status, apiError.Message)
+	}
+	return nil
+}
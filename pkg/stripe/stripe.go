@@ -0,0 +1,217 @@
+// Package stripe creates Stripe customers and reads the subscription
+// events Stripe sends to webhooks
+package stripe
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidSignature is returned for webhook payloads whose
+	// Stripe-Signature header does not match
+	ErrInvalidSignature = errors.New("stripe: invalid webhook signature")
+	// ErrStale is returned for webhook payloads signed outside the
+	// tolerance, which may be replays
+	ErrStale = errors.New("stripe: webhook timestamp outside tolerance")
+	// ErrMalformed is returned for payloads and headers that cannot be read
+	ErrMalformed = errors.New("stripe: malformed webhook")
+)
+
+// Subscription statuses that grant the subscribed plan
+const (
+	StatusActive   = "active"
+	StatusTrialing = "trialing"
+)
+
+// Customer is a Stripe customer
+type Customer struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+}
+
+// CustomerParams describes a customer to create. Metadata is stored on the
+// customer, where it links it back to the account it was created for.
+type CustomerParams struct {
+	Email    string
+	Name     string
+	Metadata map[string]string
+}
+
+// Client calls the Stripe API
+type Client struct {
+	SecretKey string
+	// BaseURL defaults to https://api.stripe.com
+	BaseURL string
+	Client  *http.Client
+}
+
+// CreateCustomer creates a customer
+func (c *Client) CreateCustomer(ctx context.Context, params CustomerParams) (Customer, error) {
+	form := url.Values{}
+	if params.Email != "" {
+		form.Set("email", params.Email)
+	}
+	if params.Name != "" {
+		form.Set("name", params.Name)
+	}
+	keys := make([]string, 0, len(params.Metadata))
+	for key := range params.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		form.Set("metadata["+key+"]", params.Metadata[key])
+	}
+
+	var customer Customer
+	if err := c.post(ctx, "/v1/customers", form, &customer); err != nil {
+		return Customer{}, err
+	}
+	return customer, nil
+}
+
+// post sends a form to the API and decodes the answer into v
+func (c *Client) post(ctx context.Context, path string, form url.Values, v interface{}) error {
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = "https://api.stripe.com"
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(baseURL, "/")+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.SecretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body := io.LimitReader(resp.Body, 1<<20)
+	if resp.StatusCode >= 300 {
+		var apiError struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(body).Decode(&apiError)
+		return fmt.Errorf("stripe returned %s: %s", resp.Status, apiError.Error.Message)
+	}
+	return json.NewDecoder(body).Decode(v)
+}
+
+// Event is a webhook event. Data.Object holds the object the event is
+// about, such as a Subscription.
+type Event struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+// Subscription is a customer's subscription to one or more prices
+type Subscription struct {
+	ID       string `json:"id"`
+	Customer string `json:"customer"`
+	Status   string `json:"status"`
+	Items    struct {
+		Data []struct {
+			Price struct {
+				ID string `json:"id"`
+			} `json:"price"`
+		} `json:"data"`
+	} `json:"items"`
+	CurrentPeriodEnd int64 `json:"current_period_end"`
+}
+
+// PriceIDs returns the prices subscribed to
+func (s Subscription) PriceIDs() []string {
+	ids := make([]string, 0, len(s.Items.Data))
+	for _, item := range s.Items.Data {
+		ids = append(ids, item.Price.ID)
+	}
+	return ids
+}
+
+// Entitled reports whether the subscription grants its plan: it is
+// active or in its trial
+func (s Subscription) Entitled() bool {
+	return s.Status == StatusActive || s.Status == StatusTrialing
+}
+
+// ParseWebhook checks payload against the Stripe-Signature header, an HMAC
+// of "<timestamp>.<payload>" with the endpoint's signing secret, and
+// returns the event. Signatures older or newer than tolerance at now are
+// refused.
+func ParseWebhook(payload []byte, header, secret string, tolerance time.Duration, now time.Time) (Event, error) {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return Event{}, ErrMalformed
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+	verified := false
+	for _, signature := range signatures {
+		if decoded, err := hex.DecodeString(signature); err == nil && hmac.Equal(decoded, expected) {
+			verified = true
+		}
+	}
+	if !verified {
+		return Event{}, ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return Event{}, ErrStale
+	}
+
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return Event{}, ErrMalformed
+	}
+	return event, nil
+}
+
+// Sign returns the Stripe-Signature header for payload signed with secret
+// at timestamp, for testing webhook handlers
+func Sign(payload []byte, secret string, timestamp time.Time) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(payload)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,146 @@
+package transforms
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+
+	"auth-server/pkg/base64util"
+)
+
+// Supported transform directions
+const (
+	DirectionEncode = "encode"
+	DirectionDecode = "decode"
+)
+
+var (
+	// ErrUnknownCodec is returned when the requested codec is not registered
+	ErrUnknownCodec = errors.New("unknown codec")
+	// ErrUnknownDirection is returned when the direction is neither encode nor decode
+	ErrUnknownDirection = errors.New("direction must be \"encode\" or \"decode\"")
+	// ErrEmptyInput is returned when there is nothing to transform
+	ErrEmptyInput = errors.New("input cannot be empty")
+	// ErrInvalidInput is returned when the input is not valid for the codec
+	ErrInvalidInput = errors.New("invalid input for codec")
+)
+
+// Codec converts text to and from an encoded representation
+type Codec interface {
+	Encode(input string) (string, error)
+	Decode(input string) (string, error)
+}
+
+// codecs holds every codec available through Transform, keyed by name
+var codecs = map[string]Codec{
+	"base64": base64Codec{encoder: base64util.NewEncoder()},
+	"base32": base32Codec{},
+	"hex":    hexCodec{},
+	"url":    urlCodec{},
+}
+
+// Get returns the codec registered under name
+func Get(name string) (Codec, error) {
+	codec, ok := codecs[strings.ToLower(name)]
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	return codec, nil
+}
+
+// Names returns the names of all registered codecs in sorted order
+func Names() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Transform runs input through the named codec in the given direction
+func Transform(codecName, direction, input string) (string, error) {
+	codec, err := Get(codecName)
+	if err != nil {
+		return "", err
+	}
+
+	if input == "" {
+		return "", ErrEmptyInput
+	}
+
+	switch strings.ToLower(direction) {
+	case DirectionEncode:
+		return codec.Encode(input)
+	case DirectionDecode:
+		return codec.Decode(input)
+	default:
+		return "", ErrUnknownDirection
+	}
+}
+
+// base64Codec adapts base64util.Encoder to the Codec interface
+type base64Codec struct {
+	encoder *base64util.Encoder
+}
+
+func (c base64Codec) Encode(input string) (string, error) {
+	return c.encoder.Encode(input)
+}
+
+func (c base64Codec) Decode(input string) (string, error) {
+	decoded, err := c.encoder.Decode(input)
+	if err != nil {
+		return "", ErrInvalidInput
+	}
+	return decoded, nil
+}
+
+// base32Codec implements RFC 4648 standard base32
+type base32Codec struct{}
+
+func (base32Codec) Encode(input string) (string, error) {
+	return base32.StdEncoding.EncodeToString([]byte(input)), nil
+}
+
+func (base32Codec) Decode(input string) (string, error) {
+	decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(input))
+	if err != nil {
+		return "", ErrInvalidInput
+	}
+	return string(decoded), nil
+}
+
+// hexCodec implements lowercase hexadecimal encoding
+type hexCodec struct{}
+
+func (hexCodec) Encode(input string) (string, error) {
+	return hex.EncodeToString([]byte(input)), nil
+}
+
+func (hexCodec) Decode(input string) (string, error) {
+	decoded, err := hex.DecodeString(input)
+	if err != nil {
+		return "", ErrInvalidInput
+	}
+	return string(decoded), nil
+}
+
+// urlCodec implements URL percent-encoding. Spaces are encoded as %20 and
+// both %20 and + are accepted when decoding.
+type urlCodec struct{}
+
+func (urlCodec) Encode(input string) (string, error) {
+	return strings.ReplaceAll(url.QueryEscape(input), "+", "%20"), nil
+}
+
+func (urlCodec) Decode(input string) (string, error) {
+	decoded, err := url.QueryUnescape(input)
+	if err != nil {
+		return "", ErrInvalidInput
+	}
+	return decoded, nil
+}
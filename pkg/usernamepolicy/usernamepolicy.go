@@ -0,0 +1,180 @@
+// Package usernamepolicy decides which usernames may be taken: reserved
+// names that would let an account pass as the service itself, and names
+// matching blocked patterns such as profanity
+package usernamepolicy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrReserved is returned for reserved usernames
+	ErrReserved = errors.New("username is reserved")
+	// ErrBlocked is returned for usernames matching a blocked pattern
+	ErrBlocked = errors.New("username is not allowed")
+)
+
+// DefaultReserved is the built-in list of reserved names, used when no
+// list file is configured
+var DefaultReserved = []string{
+	"abuse",
+	"admin",
+	"administrator",
+	"api",
+	"auth",
+	"help",
+	"hostmaster",
+	"info",
+	"login",
+	"moderator",
+	"noreply",
+	"null",
+	"postmaster",
+	"root",
+	"security",
+	"staff",
+	"support",
+	"system",
+	"webmaster",
+	"www",
+}
+
+// DefaultBlockedPatterns is the built-in list of blocked patterns, a few
+// common profanities including simple letter substitutions
+var DefaultBlockedPatterns = []string{
+	`f+u+c+k`,
+	`sh[i1!]+t`,
+	`c+u+n+t`,
+	`b[i1!]+tch`,
+	`wh[o0]+re`,
+}
+
+// Policy decides which usernames may be used. Names are compared after
+// normalizing: lowercased, with the separators "-", "_" and "." removed.
+// A reserved name also covers itself followed by digits, so "admin" covers
+// "Admin_01". Blocked patterns are regular expressions matched anywhere
+// in the normalized name.
+type Policy struct {
+	mutex    sync.RWMutex
+	reserved map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// New creates a policy from reserved names and blocked patterns
+func New(reserved, patterns []string) (*Policy, error) {
+	p := &Policy{}
+	p.SetReserved(reserved)
+	if err := p.SetBlockedPatterns(patterns); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Normalize returns the form of a username the policy compares
+func Normalize(username string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(username)))
+}
+
+// Check validates a username against the policy
+func (p *Policy) Check(username string) error {
+	name := Normalize(username)
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if p.reserved[name] || p.reserved[strings.TrimRight(name, "0123456789")] {
+		return ErrReserved
+	}
+	for _, pattern := range p.patterns {
+		if pattern.MatchString(name) {
+			return ErrBlocked
+		}
+	}
+	return nil
+}
+
+// SetReserved replaces the reserved names
+func (p *Policy) SetReserved(names []string) {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		if name = Normalize(name); name != "" {
+			set[name] = true
+		}
+	}
+	p.mutex.Lock()
+	p.reserved = set
+	p.mutex.Unlock()
+}
+
+// SetBlockedPatterns replaces the blocked patterns. Nothing changes when
+// any pattern is invalid.
+func (p *Policy) SetBlockedPatterns(patterns []string) error {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	p.mutex.Lock()
+	p.patterns = compiled
+	p.mutex.Unlock()
+	return nil
+}
+
+// Reserved returns the reserved names in sorted order
+func (p *Policy) Reserved() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	names := make([]string, 0, len(p.reserved))
+	for name := range p.reserved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BlockedPatterns returns the blocked patterns in the order they were set
+func (p *Policy) BlockedPatterns() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	patterns := make([]string, len(p.patterns))
+	for i, pattern := range p.patterns {
+		patterns[i] = pattern.String()
+	}
+	return patterns
+}
+
+// LoadList reads one entry per line, ignoring blank lines and lines
+// starting with #
+func LoadList(r io.Reader) ([]string, error) {
+	var entries []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries, scanner.Err()
+}
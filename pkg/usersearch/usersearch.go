@@ -0,0 +1,244 @@
+// Package usersearch indexes users by username, email and display name for
+// prefix and substring search, without scanning every user per query
+package usersearch
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Fields a query can match, in the order they rank when matches are
+// otherwise equal
+const (
+	FieldUsername    = "username"
+	FieldDisplayName = "displayName"
+	FieldEmail       = "email"
+)
+
+// Kinds of match, best first
+const (
+	MatchExact     = "exact"
+	MatchPrefix    = "prefix"
+	MatchSubstring = "substring"
+)
+
+// gramSize is the longest n-gram indexed. Queries up to this long are
+// answered straight from the postings; longer ones intersect the postings
+// of their n-grams and check the candidates left.
+const gramSize = 3
+
+var (
+	fieldWeights = map[string]int{FieldUsername: 3, FieldDisplayName: 2, FieldEmail: 1}
+	matchWeights = map[string]int{MatchExact: 30, MatchPrefix: 20, MatchSubstring: 10}
+)
+
+// Document is what is indexed for one user
+type Document struct {
+	Username    string
+	Email       string
+	DisplayName string
+}
+
+// fields returns the document's fields by name, lowercased
+func (d Document) fields() map[string]string {
+	return map[string]string{
+		FieldUsername:    strings.ToLower(d.Username),
+		FieldDisplayName: strings.ToLower(d.DisplayName),
+		FieldEmail:       strings.ToLower(d.Email),
+	}
+}
+
+// Hit is a user matching a query. Score orders hits: the kind of match
+// counts most, then which field matched.
+type Hit struct {
+	ID    string
+	Score int
+	Field string
+	Match string
+
+	length int // of the matched value, shorter ranks first
+}
+
+// Index is an in-memory n-gram index of users. It is safe for concurrent
+// use.
+type Index struct {
+	mutex    sync.RWMutex
+	docs     map[string]map[string]string   // ID to lowercased fields
+	postings map[string]map[string]struct{} // n-gram to IDs
+}
+
+// New creates an empty index
+func New() *Index {
+	return &Index{
+		docs:     make(map[string]map[string]string),
+		postings: make(map[string]map[string]struct{}),
+	}
+}
+
+// Put adds or replaces the document of the user with the given ID
+func (x *Index) Put(id string, doc Document) {
+	fields := doc.fields()
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.remove(id)
+	x.docs[id] = fields
+	for _, value := range fields {
+		for _, gram := range grams(value) {
+			ids := x.postings[gram]
+			if ids == nil {
+				ids = make(map[string]struct{})
+				x.postings[gram] = ids
+			}
+			ids[id] = struct{}{}
+		}
+	}
+}
+
+// Remove drops the user with the given ID from the index
+func (x *Index) Remove(id string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.remove(id)
+}
+
+func (x *Index) remove(id string) {
+	fields, ok := x.docs[id]
+	if !ok {
+		return
+	}
+	delete(x.docs, id)
+	for _, value := range fields {
+		for _, gram := range grams(value) {
+			delete(x.postings[gram], id)
+			if len(x.postings[gram]) == 0 {
+				delete(x.postings, gram)
+			}
+		}
+	}
+}
+
+// Len returns how many users are indexed
+func (x *Index) Len() int {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	return len(x.docs)
+}
+
+// Search returns the hits for query from offset, at most limit of them,
+// best first, and how many hits there are in all. Matching ignores case.
+func (x *Index) Search(query string, offset, limit int) ([]Hit, int) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return nil, 0
+	}
+
+	x.mutex.RLock()
+	var hits []Hit
+	for id := range x.candidates(query) {
+		if hit, ok := match(id, x.docs[id], query); ok {
+			hits = append(hits, hit)
+		}
+	}
+	x.mutex.RUnlock()
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		if hits[i].length != hits[j].length {
+			return hits[i].length < hits[j].length
+		}
+		return hits[i].ID < hits[j].ID
+	})
+
+	total := len(hits)
+	if offset >= total {
+		return []Hit{}, total
+	}
+	end := total
+	if limit > 0 && offset+limit < total {
+		end = offset + limit
+	}
+	return hits[offset:end], total
+}
+
+// candidates returns the IDs whose fields may contain query. The caller
+// holds the read lock.
+func (x *Index) candidates(query string) map[string]struct{} {
+	if utf8.RuneCountInString(query) <= gramSize {
+		return x.postings[query]
+	}
+
+	queryGrams := ngrams(query, gramSize)
+	sort.Slice(queryGrams, func(i, j int) bool {
+		return len(x.postings[queryGrams[i]]) < len(x.postings[queryGrams[j]])
+	})
+	candidates := make(map[string]struct{}, len(x.postings[queryGrams[0]]))
+	for id := range x.postings[queryGrams[0]] {
+		candidates[id] = struct{}{}
+	}
+	for _, gram := range queryGrams[1:] {
+		ids := x.postings[gram]
+		for id := range candidates {
+			if _, ok := ids[id]; !ok {
+				delete(candidates, id)
+			}
+		}
+	}
+	return candidates
+}
+
+// match scores the best match of query among fields
+func match(id string, fields map[string]string, query string) (Hit, bool) {
+	best := Hit{ID: id}
+	for field, value := range fields {
+		kind := ""
+		switch {
+		case value == query:
+			kind = MatchExact
+		case strings.HasPrefix(value, query):
+			kind = MatchPrefix
+		case strings.Contains(value, query):
+			kind = MatchSubstring
+		default:
+			continue
+		}
+		score := matchWeights[kind] + fieldWeights[field]
+		if score > best.Score {
+			best = Hit{ID: id, Score: score, Field: field, Match: kind, length: len(value)}
+		}
+	}
+	return best, best.Score > 0
+}
+
+// grams returns the distinct n-grams of value up to gramSize long
+func grams(value string) []string {
+	seen := make(map[string]bool)
+	var all []string
+	for n := 1; n <= gramSize; n++ {
+		for _, gram := range ngrams(value, n) {
+			if !seen[gram] {
+				seen[gram] = true
+				all = append(all, gram)
+			}
+		}
+	}
+	return all
+}
+
+// ngrams returns the n-grams of value, counted in runes
+func ngrams(value string, n int) []string {
+	runes := []rune(value)
+	if len(runes) < n {
+		return nil
+	}
+	result := make([]string, 0, len(runes)-n+1)
+	for i := 0; i+n <= len(runes); i++ {
+		result = append(result, string(runes[i:i+n]))
+	}
+	return result
+}
@@ -0,0 +1,303 @@
+// Package websocket implements the server side of RFC 6455 WebSockets for
+// text messages: the opening handshake, framing, control frames and the
+// closing handshake. Extensions and subprotocols are not supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acceptGUID is appended to the client's key to derive Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Frame opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close status codes
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+)
+
+// maxControlPayload is the largest payload RFC 6455 allows in a control frame
+const maxControlPayload = 125
+
+var (
+	// ErrBadHandshake is returned by Upgrade for requests that are not a
+	// valid version 13 WebSocket handshake
+	ErrBadHandshake = errors.New("websocket: invalid handshake")
+	// ErrHijackUnsupported is returned by Upgrade when the response writer
+	// cannot hand over its connection
+	ErrHijackUnsupported = errors.New("websocket: connection cannot be hijacked")
+	// ErrMessageTooBig is returned by ReadMessage for messages over the
+	// connection's read limit
+	ErrMessageTooBig = errors.New("websocket: message too big")
+)
+
+// CloseError is returned by ReadMessage once the peer closes the connection
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with code %d %s", e.Code, e.Reason)
+}
+
+// IsUpgrade reports whether r asks to switch to the WebSocket protocol
+func IsUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+// headerHasToken reports whether the comma-separated header name lists
+// token, ignoring case
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AcceptKey returns the Sec-WebSocket-Accept value answering key
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Upgrade completes the opening handshake for r and takes over the
+// connection. Nothing is written when the handshake is invalid, so the
+// caller can answer with an error of its own; it should then set
+// Sec-WebSocket-Version to 13. Deadlines the HTTP server put on the
+// connection are cleared.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, ErrBadHandshake
+	}
+	if r.Method != http.MethodGet || !IsUpgrade(r) || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, ErrBadHandshake
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, ErrHijackUnsupported
+	}
+	netConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	netConn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", AcceptKey(key))
+	if err := rw.Flush(); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return &Conn{conn: netConn, reader: rw.Reader, ReadLimit: 64 << 10}, nil
+}
+
+// Conn is an established WebSocket connection. One goroutine may read
+// while others write; writes are serialised.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// ReadLimit is the largest message ReadMessage accepts, in bytes
+	ReadLimit int64
+
+	writeMutex sync.Mutex
+	closeSent  bool
+}
+
+// WriteText sends a text message, waiting at most timeout when it is
+// positive
+func (c *Conn) WriteText(data []byte, timeout time.Duration) error {
+	return c.writeFrame(opText, data, timeout)
+}
+
+// WriteJSON sends v encoded as JSON in a text message
+func (c *Conn) WriteJSON(v interface{}, timeout time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteText(data, timeout)
+}
+
+// Ping sends a ping; the peer answers with a pong that ReadMessage
+// consumes
+func (c *Conn) Ping(timeout time.Duration) error {
+	return c.writeFrame(opPing, nil, timeout)
+}
+
+// Close sends a close frame with code and reason, unless one was already
+// sent, and closes the connection without waiting for the peer's answer
+func (c *Conn) Close(code int, reason string, timeout time.Duration) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	c.writeFrame(opClose, payload, timeout)
+	return c.conn.Close()
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte, timeout time.Duration) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	// Server frames are never masked
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch length := len(payload); {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	if timeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(timeout))
+		defer c.conn.SetWriteDeadline(time.Time{})
+	}
+	_, err := (&net.Buffers{header, payload}).WriteTo(c.conn)
+	return err
+}
+
+// ReadMessage returns the next text or binary message. Pings are answered
+// and pongs skipped on the way. Once the peer closes the connection the
+// close is acknowledged and a *CloseError returned; a protocol violation
+// closes the connection with CloseProtocolError.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var message []byte
+	fragmented := false
+	for {
+		final, opcode, payload, err := c.readFrame()
+		if err != nil {
+			if errors.Is(err, ErrMessageTooBig) {
+				c.Close(CloseMessageTooBig, "", time.Second)
+			}
+			return nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload, time.Second); err != nil {
+				return nil, err
+			}
+		case opPong:
+		case opClose:
+			closeErr := &CloseError{Code: CloseNormal}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+			}
+			c.Close(closeErr.Code, "", time.Second)
+			return nil, closeErr
+		case opText, opBinary, opContinuation:
+			if (opcode == opContinuation) != fragmented {
+				c.Close(CloseProtocolError, "", time.Second)
+				return nil, &CloseError{Code: CloseProtocolError}
+			}
+			if int64(len(message)+len(payload)) > c.ReadLimit {
+				c.Close(CloseMessageTooBig, "", time.Second)
+				return nil, ErrMessageTooBig
+			}
+			message = append(message, payload...)
+			if final {
+				return message, nil
+			}
+			fragmented = true
+		default:
+			c.Close(CloseProtocolError, "", time.Second)
+			return nil, &CloseError{Code: CloseProtocolError}
+		}
+	}
+}
+
+// readFrame reads one frame and unmasks its payload. Clients must mask
+// every frame, and control frames may be neither fragmented nor long.
+func (c *Conn) readFrame() (final bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return
+	}
+	final = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7F)
+
+	if header[0]&0x70 != 0 || !masked || (opcode >= opClose && (!final || length > maxControlPayload)) {
+		c.Close(CloseProtocolError, "", time.Second)
+		return false, 0, nil, &CloseError{Code: CloseProtocolError}
+	}
+
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err = io.ReadFull(c.reader, extended[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err = io.ReadFull(c.reader, extended[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint64(extended[:]))
+	}
+	if length < 0 || length > c.ReadLimit {
+		return false, 0, nil, ErrMessageTooBig
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return final, opcode, payload, nil
+}
@@ -0,0 +1,10 @@
+// Package static embeds the browser frontend so the server binary does not
+// depend on its working directory.
+package static
+
+import "embed"
+
+// Files holds index.html and the css and js directories
+//
+//go:embed index.html css js
+var Files embed.FS
@@ -49,7 +49,7 @@ class AuthManager {
         const password = document.getElementById('loginPassword').value;
 
         try {
-            const response = await fetch('/api/login', {
+            const response = await fetch('api/login', {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
                 body: JSON.stringify({ username, password }),
@@ -86,7 +86,7 @@ class AuthManager {
         const password = document.getElementById('registerPassword').value;
 
         try {
-            const response = await fetch('/api/register', {
+            const response = await fetch('api/register', {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
                 body: JSON.stringify({ username, email, password }),
@@ -129,7 +129,7 @@ class AuthManager {
         }
 
         try {
-            const response = await fetch('/api/change-password', {
+            const response = await fetch('api/change-password', {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
                 body: JSON.stringify({ currentPassword, newPassword }),
@@ -157,7 +157,7 @@ class AuthManager {
     // Handle user logout
     async handleLogout() {
         try {
-            const response = await fetch('/api/logout', { method: 'POST' });
+            const response = await fetch('api/logout', { method: 'POST' });
             const data = await response.json();
 
             if (data.success) {
@@ -301,7 +301,7 @@ class AuthManager {
         setInterval(async () => {
             if (this.currentUser) {
                 try {
-                    const response = await fetch('/api/profile');
+                    const response = await fetch('api/profile');
                     if (!response.ok || !(await response.json()).success) {
                         console.log('Session expired, redirecting to login');
                         this.forceShowLogin();
@@ -361,7 +361,7 @@ class AuthManager {
     // Check if user is already logged in on page load
     async checkExistingSession() {
         try {
-            const response = await fetch('/api/profile');
+            const response = await fetch('api/profile');
             if (response.ok) {
                 const data = await response.json();
                 if (data.success) {
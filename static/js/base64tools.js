@@ -103,7 +103,7 @@ class Base64ToolsManager {
         }
 
         try {
-            const response = await fetch('/api/base64/encode', {
+            const response = await fetch('api/base64/encode', {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
                 body: JSON.stringify({ text: input }),
@@ -143,7 +143,7 @@ class Base64ToolsManager {
         }
         
         try {
-            const response = await fetch('/api/base64/decode', {
+            const response = await fetch('api/base64/decode', {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
                 body: JSON.stringify({ text: input }),